@@ -0,0 +1,139 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// accessLogKey is the context key for the [accessLogEntry] of a request.
+type accessLogKey struct{}
+
+// accessLogEntry is an [http.ResponseWriter] that records the response of a
+// request for its line in the [Goproxy.AccessLogWriter].
+type accessLogEntry struct {
+	http.ResponseWriter
+	req         *http.Request
+	startTime   time.Time
+	statusCode  int
+	size        int64
+	cacheStatus string
+}
+
+// newAccessLogEntry returns a new [accessLogEntry] for the rw and req.
+func newAccessLogEntry(rw http.ResponseWriter, req *http.Request) *accessLogEntry {
+	return &accessLogEntry{ResponseWriter: rw, req: req, startTime: time.Now()}
+}
+
+// WriteHeader implements [http.ResponseWriter].
+func (e *accessLogEntry) WriteHeader(statusCode int) {
+	if e.statusCode == 0 {
+		e.statusCode = statusCode
+	}
+	e.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements [http.ResponseWriter].
+func (e *accessLogEntry) Write(b []byte) (int, error) {
+	if e.statusCode == 0 {
+		e.statusCode = http.StatusOK
+	}
+	n, err := e.ResponseWriter.Write(b)
+	e.size += int64(n)
+	return n, err
+}
+
+// Flush implements [http.Flusher].
+func (e *accessLogEntry) Flush() {
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		if e.statusCode == 0 {
+			e.statusCode = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// setCacheStatus sets the cache status of the e.
+func (e *accessLogEntry) setCacheStatus(hit bool) {
+	if hit {
+		e.cacheStatus = "HIT"
+	} else {
+		e.cacheStatus = "MISS"
+	}
+}
+
+// line returns the line of the e in the format described in
+// [Goproxy.AccessLogWriter], including the trailing newline.
+func (e *accessLogEntry) line() []byte {
+	host, _, err := net.SplitHostPort(e.req.RemoteAddr)
+	if err != nil {
+		host = e.req.RemoteAddr
+	}
+	requestURI := e.req.RequestURI
+	if requestURI == "" {
+		requestURI = e.req.URL.RequestURI()
+	}
+	statusCode := e.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	cacheStatus := e.cacheStatus
+	if cacheStatus == "" {
+		cacheStatus = "-"
+	}
+
+	b := make([]byte, 0, 256)
+	b = appendAccessLogString(b, host)
+	b = append(b, " - - ["...)
+	b = e.startTime.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] \""...)
+	b = appendAccessLogString(b, e.req.Method+" "+requestURI+" "+e.req.Proto)
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(statusCode), 10)
+	b = append(b, ' ')
+	if e.size > 0 {
+		b = strconv.AppendInt(b, e.size, 10)
+	} else {
+		b = append(b, '-')
+	}
+	b = append(b, " \""...)
+	b = appendAccessLogString(b, e.req.Referer())
+	b = append(b, "\" \""...)
+	b = appendAccessLogString(b, e.req.UserAgent())
+	b = append(b, "\" "...)
+	b = append(b, cacheStatus...)
+	return append(b, '\n')
+}
+
+// appendAccessLogString appends the s to the b with the double quotes,
+// backslashes, and control characters escaped in the way Apache does, so that
+// the s cannot break the fields of an access log line. An empty s is appended
+// as "-".
+func appendAccessLogString(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' || c == 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// writeAccessLog writes the line of the entry to the g.AccessLogWriter.
+func (g *Goproxy) writeAccessLog(entry *accessLogEntry) {
+	line := entry.line()
+	g.accessLogMutex.Lock()
+	defer g.accessLogMutex.Unlock()
+	if _, err := g.AccessLogWriter.Write(line); err != nil {
+		g.logErrorf("failed to write access log: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoproxyAccessLogWriter(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	dc := &DirCacher{Dir: t.TempDir()}
+	for _, tt := range []struct {
+		n        int
+		method   string
+		target   string
+		referer  string
+		wantLine string
+	}{
+		{1, http.MethodGet, "/example.com/@v/v1.0.0.info", "", `192.0.2.1 - - [TIME] "GET /example.com/@v/v1.0.0.info HTTP/1.1" 200 ` + strconv.Itoa(len(info)) + ` "-" "test-agent" MISS`},
+		{2, http.MethodGet, "/example.com/@v/v1.0.0.info", "https://example.com/\"x\"", `192.0.2.1 - - [TIME] "GET /example.com/@v/v1.0.0.info HTTP/1.1" 200 ` + strconv.Itoa(len(info)) + ` "https://example.com/\"x\"" "test-agent" HIT`},
+		{3, http.MethodHead, "/example.com/@v/v1.0.0.info", "", `192.0.2.1 - - [TIME] "HEAD /example.com/@v/v1.0.0.info HTTP/1.1" 200 - "-" "test-agent" HIT`},
+		{4, http.MethodGet, "/example.com/@v/v1.1.0.info?foo=bar", "", `192.0.2.1 - - [TIME] "GET /example.com/@v/v1.1.0.info?foo=bar HTTP/1.1" 404 9 "-" "test-agent" -`},
+	} {
+		var buf bytes.Buffer
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					if version != "v1.0.0" {
+						return nil, nil, nil, fs.ErrNotExist
+					}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:          dc,
+			AccessLogWriter: &buf,
+		}
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.Header.Set("User-Agent", "test-agent")
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		g.ServeHTTP(httptest.NewRecorder(), req)
+		line := regexp.MustCompile(`\[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\]`).ReplaceAllString(buf.String(), "[TIME]")
+		if got, want := line, tt.wantLine+"\n"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestAppendAccessLogString(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{1, "", "-"},
+		{2, "foo bar", "foo bar"},
+		{3, `a"b\c`, `a\"b\\c`},
+		{4, "a\nb\x7f", `a\x0ab\x7f`},
+	} {
+		if got, want := string(appendAccessLogString(nil, tt.s)), tt.want; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyAccessLogWriterError(t *testing.T) {
+	var errBuf bytes.Buffer
+	g := &Goproxy{
+		AccessLogWriter: errorWriter{errors.New("cannot write")},
+		ErrorLogger:     log.New(&errBuf, "", 0),
+	}
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/example.com/@v/list", nil))
+	if got, want := errBuf.String(), "goproxy: failed to write access log: cannot write\n"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// errorWriter is an [io.Writer] that always fails with the err.
+type errorWriter struct{ err error }
+
+// Write implements [io.Writer].
+func (w errorWriter) Write(p []byte) (int, error) { return 0, w.err }
@@ -0,0 +1,352 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// AdminHandler returns an [http.Handler] that serves a JSON API for inspecting
+// and managing the caches of the g. It is independent of [Goproxy.ServeHTTP]
+// and performs no access control, so it should be mounted separately from the
+// module proxy (e.g., on another address or via [http.StripPrefix]) behind
+// authentication.
+//
+// The following routes are served, relative to the root of the handler:
+//   - "GET /stats": responds {"caches": <number of caches>, "modules":
+//     <number of modules>, "versions": <number of module versions>}, where
+//     modules and module versions are counted by their cached .info files.
+//   - "GET /modules": responds {"modules": [{"path": <module path>,
+//     "versions": [<versions>]}]} for each module with cached .info files,
+//     sorted by path and then in semantic version order.
+//   - "DELETE /modules?module=<module path>[&version=<version>]": deletes all
+//     caches of the module, or only the module files of the version if it is
+//     specified, and responds {"deleted": [<cache names>]}.
+//   - "POST /prefetch": with a request body of {"module": <module path>,
+//     "version": <version>}, fetches the module files of the version into
+//     the Cacher, and responds {"module": <module path>, "version": <version>}
+//     with the resolved canonical version (see [Goproxy.Prefetch]). The
+//     version may be a version query (e.g., a branch name), and defaults to
+//     "latest". If the Content-Type of the request is "text/plain", the
+//     request body is "<module path>@<version>" instead, so that clients
+//     such as CI systems can warm the caches ahead of builds without
+//     building JSON. It responds with status 404 if the module version
+//     cannot be found.
+//   - "POST /cleanup": deletes the caches of responses that can change over
+//     time and are older than [Goproxy.MutableCacheTTL], which must not be
+//     zero, and responds {"deleted": [<cache names>]}.
+//   - "GET /config": responds the [ConfigSnapshot] returned by
+//     [Goproxy.Config], with sensitive values redacted.
+//
+// Failures are responded as {"error": <message>}. Listing caches requires the
+// Cacher to implement [Lister], and deleting caches requires it to implement
+// [Deleter]. Otherwise, the corresponding routes respond with status 501.
+func (g *Goproxy) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		g.initOnce.Do(g.init)
+		var allowedMethods []string
+		switch req.URL.Path {
+		case "/stats":
+			allowedMethods = []string{http.MethodGet}
+			if req.Method == http.MethodGet {
+				g.serveAdminStats(rw, req)
+				return
+			}
+		case "/modules":
+			allowedMethods = []string{http.MethodGet, http.MethodDelete}
+			switch req.Method {
+			case http.MethodGet:
+				g.serveAdminModules(rw, req)
+				return
+			case http.MethodDelete:
+				g.serveAdminDeleteModule(rw, req)
+				return
+			}
+		case "/prefetch":
+			allowedMethods = []string{http.MethodPost}
+			if req.Method == http.MethodPost {
+				g.serveAdminPrefetch(rw, req)
+				return
+			}
+		case "/cleanup":
+			allowedMethods = []string{http.MethodPost}
+			if req.Method == http.MethodPost {
+				g.serveAdminCleanup(rw, req)
+				return
+			}
+		case "/config":
+			allowedMethods = []string{http.MethodGet}
+			if req.Method == http.MethodGet {
+				responseJSON(rw, http.StatusOK, g.Config())
+				return
+			}
+		default:
+			responseAdminError(rw, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		rw.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		responseAdminError(rw, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	})
+}
+
+// adminModule is a module in the responses of the admin API.
+type adminModule struct {
+	Path     string   `json:"path"`
+	Versions []string `json:"versions"`
+}
+
+// serveAdminStats serves admin requests for the cache statistics.
+func (g *Goproxy) serveAdminStats(rw http.ResponseWriter, req *http.Request) {
+	names, err := g.listCaches(req.Context(), "")
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	modules := cachedModules(names)
+	var versions int
+	for _, m := range modules {
+		versions += len(m.Versions)
+	}
+	responseJSON(rw, http.StatusOK, struct {
+		Caches   int `json:"caches"`
+		Modules  int `json:"modules"`
+		Versions int `json:"versions"`
+	}{len(names), len(modules), versions})
+}
+
+// serveAdminModules serves admin requests for listing the cached modules.
+func (g *Goproxy) serveAdminModules(rw http.ResponseWriter, req *http.Request) {
+	names, err := g.listCaches(req.Context(), "")
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	responseJSON(rw, http.StatusOK, struct {
+		Modules []adminModule `json:"modules"`
+	}{cachedModules(names)})
+}
+
+// serveAdminDeleteModule serves admin requests for deleting the caches of a
+// module or a module version.
+func (g *Goproxy) serveAdminDeleteModule(rw http.ResponseWriter, req *http.Request) {
+	modulePath := req.URL.Query().Get("module")
+	moduleVersion := req.URL.Query().Get("version")
+	if modulePath == "" {
+		responseAdminError(rw, http.StatusBadRequest, errors.New("missing module"))
+		return
+	}
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		responseAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	prefix := escapedModulePath + "/@"
+	if moduleVersion != "" {
+		if err := checkCanonicalVersion(modulePath, moduleVersion); err != nil {
+			responseAdminError(rw, http.StatusBadRequest, err)
+			return
+		}
+		escapedModuleVersion, err := module.EscapeVersion(moduleVersion)
+		if err != nil {
+			responseAdminError(rw, http.StatusBadRequest, err)
+			return
+		}
+		prefix += "v/" + escapedModuleVersion + "."
+	}
+
+	names, err := g.listCaches(req.Context(), prefix)
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	deleted, err := g.deleteCaches(req.Context(), names)
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	responseJSON(rw, http.StatusOK, struct {
+		Deleted []string `json:"deleted"`
+	}{deleted})
+}
+
+// serveAdminPrefetch serves admin requests for prefetching a module version.
+func (g *Goproxy) serveAdminPrefetch(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Module  string `json:"module"`
+		Version string `json:"version"`
+	}
+	bodyReader := http.MaxBytesReader(rw, req.Body, 1<<20)
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "text/plain" {
+		b, err := io.ReadAll(bodyReader)
+		if err != nil {
+			responseAdminError(rw, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		var ok bool
+		if body.Module, body.Version, ok = strings.Cut(strings.TrimSpace(string(b)), "@"); !ok || body.Version == "" {
+			responseAdminError(rw, http.StatusBadRequest, errors.New("missing version"))
+			return
+		}
+	} else if err := json.NewDecoder(bodyReader).Decode(&body); err != nil {
+		responseAdminError(rw, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if body.Module == "" {
+		responseAdminError(rw, http.StatusBadRequest, errors.New("missing module"))
+		return
+	}
+	if err := module.CheckPath(body.Module); err != nil {
+		responseAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	version, err := g.Prefetch(req.Context(), body.Module, body.Version)
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	body.Version = version
+	responseJSON(rw, http.StatusOK, body)
+}
+
+// serveAdminCleanup serves admin requests for deleting the expired caches of
+// responses that can change over time.
+func (g *Goproxy) serveAdminCleanup(rw http.ResponseWriter, req *http.Request) {
+	if g.MutableCacheTTL <= 0 {
+		responseAdminError(rw, http.StatusBadRequest, errors.New("mutable cache TTL is not set"))
+		return
+	}
+	names, err := g.listCaches(req.Context(), "")
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	var expiredNames []string
+	for _, name := range names {
+		ft, err := parseFetchTarget(name)
+		if err != nil || (!ft.list && ft.moduleQuery == "") {
+			continue
+		}
+		content, err := g.cache(req.Context(), name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			responseAdminError(rw, adminErrorStatus(err), err)
+			return
+		}
+		modTime := contentModTime(content)
+		content.Close()
+		if modTime.IsZero() || time.Since(modTime) > g.MutableCacheTTL {
+			expiredNames = append(expiredNames, name)
+		}
+	}
+	deleted, err := g.deleteCaches(req.Context(), expiredNames)
+	if err != nil {
+		responseAdminError(rw, adminErrorStatus(err), err)
+		return
+	}
+	responseJSON(rw, http.StatusOK, struct {
+		Deleted []string `json:"deleted"`
+	}{deleted})
+}
+
+// listCaches lists the names of the caches whose names start with the prefix
+// in the g.Cacher.
+func (g *Goproxy) listCaches(ctx context.Context, prefix string) ([]string, error) {
+	lister, ok := g.Cacher.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("listing caches %w", ErrUnsupported)
+	}
+	return lister.List(ctx, prefix)
+}
+
+// deleteCaches deletes the caches for the names from the g.Cacher. It returns
+// the names of the deleted caches, which is never nil.
+func (g *Goproxy) deleteCaches(ctx context.Context, names []string) ([]string, error) {
+	deleted := []string{}
+	if len(names) == 0 {
+		return deleted, nil
+	}
+	deleter, ok := g.Cacher.(Deleter)
+	if !ok {
+		return nil, fmt.Errorf("deleting caches %w", ErrUnsupported)
+	}
+	for _, name := range names {
+		if err := deleter.Delete(ctx, name); err != nil {
+			return nil, fmt.Errorf("failed to delete cache %q: %w", name, err)
+		}
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "delete", Name: name})
+		deleted = append(deleted, name)
+	}
+	return deleted, nil
+}
+
+// cachedModules returns the modules with cached .info files of canonical
+// versions among the cache names, sorted by path and then in semantic version
+// order. The returned slice is never nil.
+func cachedModules(names []string) []adminModule {
+	versions := map[string][]string{}
+	for _, name := range names {
+		ft, err := parseFetchTarget(name)
+		if err != nil || ft.ext != ".info" {
+			continue
+		}
+		versions[ft.modulePath] = append(versions[ft.modulePath], ft.moduleVersion)
+	}
+	modules := make([]adminModule, 0, len(versions))
+	for modulePath, moduleVersions := range versions {
+		sort.Slice(moduleVersions, func(i, j int) bool { return semver.Compare(moduleVersions[i], moduleVersions[j]) < 0 })
+		modules = append(modules, adminModule{Path: modulePath, Versions: moduleVersions})
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Path < modules[j].Path })
+	return modules
+}
+
+// adminErrorStatus returns the status code of the admin API response for the
+// err.
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// responseJSON responses the v as a JSON content to the client with the
+// statusCode.
+func responseJSON(rw http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		b, _ = json.Marshal(struct {
+			Error string `json:"error"`
+		}{err.Error()})
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setResponseCacheControlHeader(rw, -1)
+	rw.WriteHeader(statusCode)
+	rw.Write(append(b, '\n'))
+}
+
+// responseAdminError responses the err as a JSON content to the client with the
+// statusCode.
+func responseAdminError(rw http.ResponseWriter, statusCode int, err error) {
+	responseJSON(rw, statusCode, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,254 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoproxyAdminHandler(t *testing.T) {
+	info := marshalInfo("v1.1.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n               int
+		cacher          Cacher
+		mutableCacheTTL time.Duration
+		method          string
+		target          string
+		contentType     string
+		body            string
+		wantStatusCode  int
+		wantAllow       string
+		wantContent     string
+		wantNames       []string
+	}{
+		{
+			n:              1,
+			method:         http.MethodGet,
+			target:         "/stats",
+			wantStatusCode: http.StatusOK,
+			wantContent:    `{"caches":6,"modules":2,"versions":3}`,
+		},
+		{
+			n:              2,
+			method:         http.MethodGet,
+			target:         "/modules",
+			wantStatusCode: http.StatusOK,
+			wantContent:    `{"modules":[{"path":"example.com/Foo","versions":["v1.0.0"]},{"path":"example.com/bar","versions":["v1.0.0","v1.0.1"]}]}`,
+		},
+		{
+			n:              3,
+			method:         http.MethodDelete,
+			target:         "/modules?module=example.com/bar",
+			wantStatusCode: http.StatusOK,
+			wantContent:    `{"deleted":["example.com/bar/@latest","example.com/bar/@v/v1.0.0.info","example.com/bar/@v/v1.0.1.info"]}`,
+			wantNames:      []string{"example.com/!foo/@v/list", "example.com/!foo/@v/v1.0.0.info", "example.com/!foo/@v/v1.0.0.mod"},
+		},
+		{
+			n:              4,
+			method:         http.MethodDelete,
+			target:         "/modules?module=example.com/Foo&version=v1.0.0",
+			wantStatusCode: http.StatusOK,
+			wantContent:    `{"deleted":["example.com/!foo/@v/v1.0.0.info","example.com/!foo/@v/v1.0.0.mod"]}`,
+			wantNames:      []string{"example.com/!foo/@v/list", "example.com/bar/@latest", "example.com/bar/@v/v1.0.0.info", "example.com/bar/@v/v1.0.1.info"},
+		},
+		{
+			n:              5,
+			method:         http.MethodDelete,
+			target:         "/modules?module=example.com/Foo&version=master",
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    `{"error":"example.com/Foo@master: invalid version: not a semantic version"}`,
+		},
+		{
+			n:              6,
+			method:         http.MethodDelete,
+			target:         "/modules",
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    `{"error":"missing module"}`,
+		},
+		{
+			n:              7,
+			method:         http.MethodPost,
+			target:         "/prefetch",
+			body:           `{"module":"example.com/baz"}`,
+			wantStatusCode: http.StatusOK,
+			wantContent:    `{"module":"example.com/baz","version":"v1.1.0"}`,
+			wantNames: []string{
+				"example.com/!foo/@v/list",
+				"example.com/!foo/@v/v1.0.0.info",
+				"example.com/!foo/@v/v1.0.0.mod",
+				"example.com/bar/@latest",
+				"example.com/bar/@v/v1.0.0.info",
+				"example.com/bar/@v/v1.0.1.info",
+				"example.com/baz/@latest",
+				"example.com/baz/@v/v1.1.0.info",
+				"example.com/baz/@v/v1.1.0.mod",
+				"example.com/baz/@v/v1.1.0.zip",
+			},
+		},
+		{
+			n:              8,
+			method:         http.MethodPost,
+			target:         "/prefetch",
+			body:           `{`,
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    `{"error":"invalid request body: unexpected EOF"}`,
+		},
+		{
+			n:              9,
+			method:         http.MethodPost,
+			target:         "/cleanup",
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    `{"error":"mutable cache TTL is not set"}`,
+		},
+		{
+			n:               10,
+			mutableCacheTTL: time.Hour,
+			method:          http.MethodPost,
+			target:          "/cleanup",
+			wantStatusCode:  http.StatusOK,
+			wantContent:     `{"deleted":["example.com/!foo/@v/list","example.com/bar/@latest"]}`,
+			wantNames:       []string{"example.com/!foo/@v/v1.0.0.info", "example.com/!foo/@v/v1.0.0.mod", "example.com/bar/@v/v1.0.0.info", "example.com/bar/@v/v1.0.1.info"},
+		},
+		{
+			n:              11,
+			method:         http.MethodPost,
+			target:         "/stats",
+			wantStatusCode: http.StatusMethodNotAllowed,
+			wantAllow:      "GET",
+			wantContent:    `{"error":"method not allowed"}`,
+		},
+		{
+			n:              12,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/list",
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    `{"error":"not found"}`,
+		},
+		{
+			n:              13,
+			cacher:         &HTTPCacher{},
+			method:         http.MethodGet,
+			target:         "/modules",
+			wantStatusCode: http.StatusNotImplemented,
+			wantContent:    `{"error":"listing caches not supported by cacher"}`,
+		},
+		{
+			n:              14,
+			method:         http.MethodPost,
+			target:         "/config",
+			wantStatusCode: http.StatusMethodNotAllowed,
+			wantAllow:      "GET",
+			wantContent:    `{"error":"method not allowed"}`,
+		},
+		{
+			n:              15,
+			method:         http.MethodPost,
+			target:         "/prefetch",
+			contentType:    "text/plain; charset=utf-8",
+			body:           "example.com/baz@v1.0.0\n",
+			wantStatusCode: http.StatusOK,
+			wantContent:    `{"module":"example.com/baz","version":"v1.0.0"}`,
+			wantNames: []string{
+				"example.com/!foo/@v/list",
+				"example.com/!foo/@v/v1.0.0.info",
+				"example.com/!foo/@v/v1.0.0.mod",
+				"example.com/bar/@latest",
+				"example.com/bar/@v/v1.0.0.info",
+				"example.com/bar/@v/v1.0.1.info",
+				"example.com/baz/@v/v1.0.0.info",
+				"example.com/baz/@v/v1.0.0.mod",
+				"example.com/baz/@v/v1.0.0.zip",
+			},
+		},
+		{
+			n:              16,
+			method:         http.MethodPost,
+			target:         "/prefetch",
+			contentType:    "text/plain",
+			body:           "example.com/baz",
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    `{"error":"missing version"}`,
+		},
+		{
+			n:              17,
+			method:         http.MethodPost,
+			target:         "/prefetch",
+			contentType:    "text/plain",
+			body:           "@v1.0.0",
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    `{"error":"missing module"}`,
+		},
+		{
+			n:              18,
+			method:         http.MethodPost,
+			target:         "/fetch",
+			contentType:    "text/plain",
+			body:           "example.com/baz@v1.0.0",
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    `{"error":"not found"}`,
+		},
+	} {
+		dc := &DirCacher{Dir: t.TempDir(), nowFunc: func() time.Time { return time.Now().Add(-2 * time.Hour) }}
+		for _, name := range []string{
+			"example.com/!foo/@v/list",
+			"example.com/!foo/@v/v1.0.0.info",
+			"example.com/!foo/@v/v1.0.0.mod",
+			"example.com/bar/@latest",
+			"example.com/bar/@v/v1.0.0.info",
+			"example.com/bar/@v/v1.0.1.info",
+		} {
+			if err := dc.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		if tt.cacher == nil {
+			tt.cacher = dc
+		}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					return "v1.1.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:          tt.cacher,
+			ErrorLogger:     log.New(io.Discard, "", 0),
+			MutableCacheTTL: tt.mutableCacheTTL,
+		}
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		g.AdminHandler().ServeHTTP(rec, req)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Allow"), tt.wantAllow; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := strings.TrimSuffix(string(b), "\n"), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.wantNames != nil {
+			if names, err := dc.List(context.Background(), ""); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := strings.Join(names, "\n"), strings.Join(tt.wantNames, "\n"); got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
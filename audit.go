@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"context"
+	"time"
+)
+
+// AuditEvent is a mutation of the [Goproxy.Cacher] (see
+// [Goproxy.OnCacheMutation]).
+type AuditEvent struct {
+	// Operation is the kind of the mutation: "put" for a cache put, "delete"
+	// for a cache deletion, or "sync" for an import of cache files in bulk
+	// (see [Cacher.Sync]).
+	Operation string
+
+	// Name is the name of the cache put or deleted. It is empty for a
+	// "sync" operation, which is reported as a single summary event rather
+	// than one event per imported file.
+	Name string
+
+	// Bytes is the size of the cache put in bytes, or the total size of the
+	// files imported by a "sync" operation. It is zero for a "delete"
+	// operation, or if the size is unknown.
+	Bytes int64
+
+	// Files is the number of files imported by a "sync" operation. It is
+	// zero for other operations.
+	Files int
+
+	// Err is the error of a failed "sync" operation, which may have
+	// imported some of the files before failing. Bytes and Files are zero
+	// for a failed "sync" operation, as the files imported before it failed
+	// are unknown. Err is nil for other operations.
+	Err error
+
+	// Principal is the authenticated principal that caused the mutation,
+	// as set by [WithPrincipal] in the context of the request or the call.
+	// It is empty if there is none (e.g., for background refreshes not
+	// triggered by a request).
+	Principal string
+
+	// Time is when the mutation completed.
+	Time time.Time
+}
+
+// principalKey is the context key for the principal set by [WithPrincipal].
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the ctx carrying the principal, which is
+// reported as the [AuditEvent.Principal] of the cache mutations made with the
+// returned context. It is intended for authentication middleware wrapped
+// around [Goproxy.ServeHTTP] or the admin handlers, which set the principal in
+// the context of each authenticated request.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFromContext returns the principal set by [WithPrincipal] in the
+// ctx, or an empty string if there is none.
+func principalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// auditCacheMutation reports the mutation of the g.Cacher to the
+// g.OnCacheMutation, if any, and records it in the g.recentlyCached.
+func (g *Goproxy) auditCacheMutation(ctx context.Context, e AuditEvent) {
+	if g.OnCacheMutation == nil && g.recentlyCached == nil {
+		return
+	}
+	e.Principal = principalFromContext(ctx)
+	e.Time = time.Now()
+	if g.recentlyCached != nil {
+		g.recentlyCached.add(e)
+	}
+	if g.OnCacheMutation != nil {
+		g.OnCacheMutation(e)
+	}
+}
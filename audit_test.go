@@ -0,0 +1,130 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGoproxyOnCacheMutation(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var (
+		mu     sync.Mutex
+		events []AuditEvent
+	)
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info_, mod, zipContent io.ReadSeekCloser, err error) {
+				return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zip)), nil
+			},
+		},
+		Cacher:  &DirCacher{Dir: t.TempDir(), TrackAccess: true},
+		TempDir: t.TempDir(),
+		OnCacheMutation: func(e AuditEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		},
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	takeEvents := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		lines := make([]string, 0, len(events))
+		for _, e := range events {
+			if e.Time.IsZero() {
+				t.Errorf("unexpected zero time of %+v", e)
+			}
+			line := fmt.Sprintf("%s %s %d %d %s", e.Operation, e.Name, e.Bytes, e.Files, e.Principal)
+			if e.Err != nil {
+				line += " error"
+			}
+			lines = append(lines, line)
+		}
+		events = nil
+		return strings.Join(lines, "\n")
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil)
+	g.ServeHTTP(rec, req.WithContext(WithPrincipal(req.Context(), "alice")))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := takeEvents(), strings.Join([]string{
+		fmt.Sprintf("put example.com/@v/v1.0.0.info %d 0 alice", len(info)),
+		fmt.Sprintf("put example.com/@v/v1.0.0.mod %d 0 alice", len("module example.com")),
+		fmt.Sprintf("put example.com/@v/v1.0.0.zip %d 0 alice", len(zip)),
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/modules?module=example.com&version=v1.0.0", nil)
+	g.AdminHandler().ServeHTTP(rec, req.WithContext(WithPrincipal(req.Context(), "bob")))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := takeEvents(), strings.Join([]string{
+		"delete example.com/@v/v1.0.0.info 0 0 bob",
+		"delete example.com/@v/v1.0.0.mod 0 0 bob",
+		"delete example.com/@v/v1.0.0.zip 0 0 bob",
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	bundle, err := makeTar(map[string][]byte{
+		"example.com/@v/v1.1.0.info": []byte("{}"),
+		"example.com/@v/v1.1.0.mod":  []byte("module example.com"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := g.syncCache(WithPrincipal(context.Background(), "carol"), bytes.NewReader(bundle), "application/x-tar"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := takeEvents(), fmt.Sprintf("sync  %d 2 carol", len("{}")+len("module example.com")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := g.syncCache(WithPrincipal(context.Background(), "carol"), bytes.NewReader(bundle[:len(bundle)/2]), "application/x-tar"); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := takeEvents(), "sync  0 0 carol error"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	evicted, err := g.Evict(WithPrincipal(context.Background(), "dave"), -1)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(evicted) == 0 {
+		t.Fatal("expected evictions")
+	}
+	wantEvents := make([]string, 0, len(evicted))
+	for _, name := range evicted {
+		wantEvents = append(wantEvents, "delete "+name+" 0 0 dave")
+	}
+	if got, want := takeEvents(), strings.Join(wantEvents, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	g.OnCacheMutation = nil
+	if err := g.putCache(context.Background(), "example.com/@v/v1.2.0.mod", strings.NewReader("module example.com")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := takeEvents(), ""; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
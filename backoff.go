@@ -0,0 +1,60 @@
+package goproxy
+
+import "time"
+
+// Backoff is a strategy for the delays between the attempts of a retried
+// operation, such as an upstream request that failed with a temporary error.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+type Backoff interface {
+	// NextDelay returns the delay before the attempt, which starts at 1
+	// for the first retry after the initial attempt. A negative delay is
+	// treated as zero.
+	NextDelay(attempt int) time.Duration
+}
+
+// ExponentialBackoff is a [Backoff] with exponentially growing delays and
+// full jitter, as described in
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/.
+// The delay before an attempt is chosen at random in the range [0, d), where
+// d is the Base multiplied by two to the power of the attempt, capped at the
+// Cap.
+type ExponentialBackoff struct {
+	// Base is the base delay, which is doubled for each attempt.
+	//
+	// If Base is zero or negative, 100 milliseconds is used.
+	Base time.Duration
+
+	// Cap is the maximum delay.
+	//
+	// If Cap is zero or negative, one second is used.
+	Cap time.Duration
+}
+
+// NextDelay implements [Backoff].
+func (eb ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	base := eb.Base
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	cap := eb.Cap
+	if cap <= 0 {
+		cap = time.Second
+	}
+	if attempt < 0 {
+		attempt = 0
+	}
+	return backoffSleep(base, cap, attempt)
+}
+
+// backoffDelay returns the delay before the attempt as per the backoff. If
+// the backoff is nil, the zero [ExponentialBackoff] is used.
+func backoffDelay(backoff Backoff, attempt int) time.Duration {
+	if backoff == nil {
+		backoff = ExponentialBackoff{}
+	}
+	if delay := backoff.NextDelay(attempt); delay > 0 {
+		return delay
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		n        int
+		backoff  ExponentialBackoff
+		attempt  int
+		wantBand time.Duration
+	}{
+		{1, ExponentialBackoff{}, 0, 100 * time.Millisecond},
+		{2, ExponentialBackoff{}, 1, 200 * time.Millisecond},
+		{3, ExponentialBackoff{}, 3, 800 * time.Millisecond},
+		{4, ExponentialBackoff{}, 4, time.Second},
+		{5, ExponentialBackoff{}, 100, time.Second},
+		{6, ExponentialBackoff{}, -1, 100 * time.Millisecond},
+		{7, ExponentialBackoff{Base: time.Second, Cap: time.Minute}, 2, 4 * time.Second},
+		{8, ExponentialBackoff{Base: time.Second, Cap: time.Minute}, 10, time.Minute},
+		{9, ExponentialBackoff{Base: -time.Second, Cap: -time.Second}, 1, 200 * time.Millisecond},
+	} {
+		for i := 0; i < 100; i++ {
+			if delay := tt.backoff.NextDelay(tt.attempt); delay < 0 || delay >= tt.wantBand {
+				t.Fatalf("test(%d): got %v, want in range [0, %v)", tt.n, delay, tt.wantBand)
+			}
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for _, tt := range []struct {
+		n         int
+		backoff   Backoff
+		attempt   int
+		wantDelay time.Duration
+	}{
+		{1, constantBackoff(time.Second), 1, time.Second},
+		{2, constantBackoff(time.Second), 5, time.Second},
+		{3, constantBackoff(-time.Second), 1, 0},
+	} {
+		if got, want := backoffDelay(tt.backoff, tt.attempt), tt.wantDelay; got != want {
+			t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+		}
+	}
+	if delay := backoffDelay(nil, 1); delay < 0 || delay >= 200*time.Millisecond {
+		t.Errorf("got %v, want in range [0, 200ms)", delay)
+	}
+}
+
+func TestHTTPGetBackoff(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if requests++; requests < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(rw, "foobar")
+	}))
+	defer server.Close()
+	backoff := &recordingBackoff{}
+	if err := httpGet(context.Background(), http.DefaultClient, backoff, server.URL, nil); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := fmt.Sprint(backoff.attempts), "[1 2]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	requests = 0
+	backoff = &recordingBackoff{}
+	g := &Goproxy{Backoff: backoff}
+	g.initOnce.Do(g.init)
+	if got, want := g.baseFetcher.(*GoFetcher).Backoff, Backoff(backoff); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	tempFile, err := g.proxySumDB(context.Background(), server.URL, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if tempFile == "" {
+		t.Error("expected temporary file")
+	}
+	if got, want := fmt.Sprint(backoff.attempts), "[1 2]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// constantBackoff is a [Backoff] with constant delays.
+type constantBackoff time.Duration
+
+// NextDelay implements [Backoff].
+func (cb constantBackoff) NextDelay(attempt int) time.Duration { return time.Duration(cb) }
+
+// recordingBackoff is a [Backoff] without delays that records the attempts.
+type recordingBackoff struct {
+	mu       sync.Mutex
+	attempts []int
+}
+
+// NextDelay implements [Backoff].
+func (rb *recordingBackoff) NextDelay(attempt int) time.Duration {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.attempts = append(rb.attempts, attempt)
+	return 0
+}
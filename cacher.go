@@ -2,120 +2,2654 @@ package goproxy
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"log"
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Cacher defines a set of intuitive methods used to cache module files for [Goproxy].
+//
+// The names of the caches are in the forms described in [CacheName]. In
+// particular, the result of the "latest" version query is always cached as
+// "<module>/@latest", separately from the "<module>/@v/<version>.info" caches
+// of specific versions and other version queries, so they never overwrite
+// each other.
+type Cacher interface {
+	// Get gets the matched cache for the name. It returns [fs.ErrNotExist]
+	// if not found.
+	//
+	// The returned [io.ReadCloser] may optionally implement the following
+	// interfaces:
+	//  1. [io.Seeker], mainly for the Range request header.
+	//  2. interface{ LastModified() time.Time }, mainly for the
+	//     Last-Modified response header. Also for the If-Unmodified-Since,
+	//     If-Modified-Since, and If-Range request headers when 1 is
+	//     implemented.
+	//  3. interface{ ModTime() time.Time }, same as 2 but with lower
+	//     priority.
+	//  4. interface{ ETag() string }, mainly for the ETag response header.
+	//     Also for the If-Match, If-None-Match, and If-Range request
+	//     headers when 1 is implemented. Note that the return value will be
+	//     assumed to have complied with RFC 7232, section 2.3, so it will
+	//     be used directly without further processing.
+	//
+	// A zero time (or the Unix epoch) returned by 2 or 3 and an empty
+	// string returned by 4 mean that those are unknown, in which case the
+	// corresponding response headers are omitted.
+	//
+	// Whenever the validator in an If-Range request header does not match
+	// the ETag (using the strong comparison, so a weak ETag never matches)
+	// or the Last-Modified time, the full content is responded instead of
+	// the requested range.
+	//
+	// Once returned, the [io.ReadCloser] must either yield the whole
+	// content or fail with an error other than [io.EOF]. Implementations
+	// backed by networks must therefore never report [io.EOF] when the
+	// connection breaks before the content has been fully read (e.g.,
+	// when fewer bytes than the Content-Length have been received), so
+	// that the response can be failed and the client retries instead of
+	// accepting a truncated module file.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Put puts a cache for the name with the content.
+	//
+	// The content may optionally implement [Sizer] to report its size up
+	// front. Implementations that need to know the size of the content
+	// (e.g., to send the Content-Length of an upload) should use
+	// [ContentSize], which prefers [Sizer.Size] and falls back to seeking
+	// only if it is not available.
+	Put(ctx context.Context, name string, content io.ReadSeeker) error
+	// Sync sync upload cache dir to loacl cached dir
+	//
+	// The opts control how the uploaded bundle is imported. Implementations
+	// should return an error for any option they do not support rather than
+	// silently ignoring it.
+	Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error
+}
+
+// SyncOptions is the options for importing cache files in bulk (see
+// [Cacher.Sync]).
+type SyncOptions struct {
+	// MinFreeBytes is the minimum number of bytes that must remain
+	// available on the filesystem of the cache after each file is written.
+	// Before writing each file, the available space is checked, and the
+	// import is aborted with an error that matches [ErrInsufficientSpace]
+	// if writing the file would drop the available space below
+	// MinFreeBytes. Files that have already been written are kept.
+	//
+	// Checking the available space is supported on Linux, macOS, FreeBSD,
+	// DragonFly BSD, and Windows. On other platforms, the import fails if
+	// MinFreeBytes is positive.
+	//
+	// If MinFreeBytes is zero, the available space is not checked.
+	MinFreeBytes int64
+
+	// Exclusive indicates whether the import must not overlap with any other
+	// exclusive import into the same cache. If another exclusive import is
+	// in progress, the import fails immediately with an error that matches
+	// [ErrSyncInProgress].
+	//
+	// For [DirCacher], the exclusion is advisory. It is enforced within the
+	// process and, on Unix-like systems, across processes by holding an
+	// flock(2) lock on a lock file in the cache directory. Note that
+	// flock(2) may not work as expected on some network filesystems.
+	Exclusive bool
+
+	// MaxQueued is the maximum number of exclusive imports into the same
+	// cache that may wait for the one in progress (see Exclusive). If
+	// fewer imports than MaxQueued are waiting, the import waits for its
+	// turn, or until its context is done. Otherwise, it fails immediately
+	// with an error that matches [ErrSyncQueueFull], so that bursts of
+	// overlapping imports (e.g., a scheduled mirror refresh and a manual
+	// import) neither fail nor pile up without bound. MaxQueued has no
+	// effect if Exclusive is false.
+	//
+	// For [DirCacher], only imports within the same process wait. If an
+	// exclusive import is in progress in another process, the import still
+	// fails immediately with an error that matches [ErrSyncInProgress].
+	//
+	// If MaxQueued is zero or negative, imports never wait.
+	MaxQueued int
+
+	// MaxFiles is the maximum number of files that an import may write. An
+	// import that would write more files is aborted with an error that
+	// matches [ErrTooManyFiles] before the first file beyond the limit is
+	// written. Files that have already been written are kept. Skipped files
+	// do not count towards the limit.
+	//
+	// If MaxFiles is zero, 1,048,576 is used. If MaxFiles is negative,
+	// there is no limit.
+	MaxFiles int
+
+	// MaxPathDepth is the maximum number of slash-separated elements in the
+	// name of each file that an import may write. Module cache paths have
+	// a well-bounded depth, so an import of a file nested deeper (e.g., in a
+	// crafted bundle that stresses the filesystem with thousands of nested
+	// directories) is aborted with an error that matches [ErrPathTooDeep]
+	// before the file is written. Files that have already been written are
+	// kept.
+	//
+	// If MaxPathDepth is zero, 64 is used. If MaxPathDepth is negative,
+	// there is no limit.
+	MaxPathDepth int
+
+	// MaxDecompressionRatio is the maximum ratio of the decompressed size
+	// of a gzip-compressed bundle to the compressed size read so far. An
+	// import of a bundle whose content expands beyond the ratio (e.g., a
+	// "decompression bomb" of a few kilobytes that expands to terabytes) is
+	// aborted with an error that matches [ErrDecompressionBomb] before the
+	// expanded content fills the disk. Files that have already been written
+	// are kept. The ratio is checked only after the first 1 MiB has been
+	// decompressed, so that small bundles with highly compressible content
+	// are not rejected.
+	//
+	// If MaxDecompressionRatio is zero, 100 is used. If
+	// MaxDecompressionRatio is negative, there is no limit.
+	MaxDecompressionRatio float64
+
+	// MaxDecompressedBytes is the maximum size in bytes of the decompressed
+	// content of a gzip-compressed bundle. An import of a bundle whose
+	// content exceeds it is aborted with an error that matches
+	// [ErrDecompressionBomb]. Files that have already been written are
+	// kept.
+	//
+	// If MaxDecompressedBytes is zero or negative, there is no limit.
+	MaxDecompressedBytes int64
+
+	// Hardlink indicates whether to hard link files instead of copying them
+	// when importing from a directory on the same filesystem (see
+	// [DirCacher.SyncFromDir]). It saves both time and space, but the
+	// imported cache files then share their content, modification times,
+	// and permissions with the source files, so the source files must not be
+	// modified afterwards. Files that cannot be hard linked (e.g., because
+	// they are on a different filesystem) are copied instead.
+	//
+	// Hardlink has no effect on imports of bundles (see [Cacher.Sync]).
+	Hardlink bool
+
+	// ImportSymlinks indicates whether to re-create the symbolic links in a
+	// bundle (see [ExportOptions.DereferenceSymlinks]) as symbolic links
+	// with the same targets. Each target must be a clean relative path that
+	// stays within the cache, and no parent directory of a link may itself
+	// be a symbolic link. Otherwise, the import is aborted with an error
+	// that matches [ErrUnsafeSymlink].
+	//
+	// ImportSymlinks is supported by [DirCacher.Sync]. If ImportSymlinks is
+	// false, the symbolic links in a bundle are skipped and logged to the
+	// Logger.
+	ImportSymlinks bool
+
+	// DedupKey identifies the content of the bundle being imported (e.g.,
+	// its SHA-256 hash or ETag). If an import with the same DedupKey into
+	// the same cache is already in progress, the import does not read its
+	// bundle at all, but waits for the in-progress import to complete and
+	// returns its result instead. The in-progress import is done with its
+	// own options by the Sync call that started it, which never returns
+	// before it is done reading its bundle. If that call's ctx is done
+	// before the import completes, the waiting imports start over as if
+	// they were the first ones. If the ctx is done while waiting, the
+	// ctx.Err is returned.
+	//
+	// If DedupKey is empty, imports are never coalesced.
+	DedupKey string
+
+	// StrictNames indicates whether to skip files whose names do not match
+	// the layout of a module cache: "<module>/@latest", "<module>/@v/list",
+	// "<module>/@v/<version>.<ext>" (where the ext is "info", "mod", "zip",
+	// or "ziphash") with escaped module paths and versions, and anything
+	// under "cache/" or "sumdb/". This keeps junk files in a bundle (e.g.,
+	// "README" or ".DS_Store") out of the cache. Each skipped file is logged
+	// to the Logger.
+	StrictNames bool
+
+	// OnDuplicate is the policy for files that appear more than once in a
+	// bundle, which usually indicates a bug in the generator of the
+	// bundle. Names are compared after being cleaned, and only among the
+	// files that are not skipped.
+	//
+	// OnDuplicate is supported by [DirCacher.Sync], as well as by the
+	// [Cacher] values returned by [NewShardedCacher] and [NewFlatKeyCacher]
+	// whose underlying caches are [DirCacher] values. For a resumed import
+	// (see Resume), only the files imported since the checkpoint are
+	// compared.
+	//
+	// If OnDuplicate is zero, [DuplicateOverwrite] is used.
+	OnDuplicate DuplicatePolicy
+
+	// VerifyZipHashes indicates whether to verify each ".zip" file in a
+	// bundle against its sibling ".ziphash" file, if the bundle has one, so
+	// that a corrupt bundle is caught at import time rather than when the
+	// .zip file is served. The pairs are verified as soon as both files
+	// have been imported, no matter which comes first or how far apart
+	// they are in the bundle, by computing the "h1:" hash of each .zip file
+	// from a copy of it in the TempDir. The import is aborted with an error
+	// that matches [ErrZipHashMismatch] at the first mismatch. Files that
+	// have already been written are kept, unless Staged is also true. A
+	// .zip file without a .ziphash file in the same bundle is not verified,
+	// nor is a .ziphash file without a .zip file.
+	//
+	// For a resumed import (see Resume), only the files imported since the
+	// checkpoint are paired.
+	VerifyZipHashes bool
+
+	// ContentTypeAliases maps additional compress types of bundles to the
+	// canonical ones that [Cacher.Sync] understands: "application/gzip"
+	// and "application/x-tar". Keys are media types without parameters,
+	// which are matched case-insensitively. They take precedence over the
+	// default aliases, which map "application/x-gzip",
+	// "application/x-gtar-compressed", "application/x-compressed-tar", and
+	// "application/x-tgz" to "application/gzip", and "application/tar",
+	// "application/x-gtar", and "application/x-ustar" to
+	// "application/x-tar".
+	//
+	// Compress types that are neither canonical nor aliased are still
+	// rejected as unsupported.
+	ContentTypeAliases map[string]string
+
+	// SignaturePublicKey is the minisign public key (either its base64
+	// encoding or the content of its ".pub" file) used to verify the
+	// Signature of a bundle before extracting anything from it. The
+	// signature covers the bundle bytes as they are passed to
+	// [Cacher.Sync] (i.e., still compressed). If the verification fails,
+	// nothing is imported and an error wrapping [ErrBadSignature] is
+	// returned.
+	//
+	// As the verification needs the whole bundle, a bundle that is not an
+	// [io.ReadSeeker] is buffered to a temporary file in the TempDir first.
+	//
+	// If SignaturePublicKey is empty, bundles are not verified.
+	SignaturePublicKey string
+
+	// Signature is the content of the detached minisign signature file
+	// (".minisig") of a bundle. Only prehashed signatures, which are the
+	// default of minisign since version 0.8, are supported.
+	Signature []byte
+
+	// TempDir is the directory for buffering bundles that are not seekable
+	// while verifying their signatures (see SignaturePublicKey).
+	//
+	// If TempDir is empty, [os.TempDir] is used.
+	TempDir string
+
+	// Checkpoint is the file to record the progress of an import of a
+	// bundle in. The name of the last tar entry that has been extracted is
+	// recorded in it every 100 entries and when the import fails, so that an
+	// interrupted import can be resumed (see Resume). The Checkpoint is
+	// removed once the import has completed successfully.
+	//
+	// Checkpoint is supported only by [DirCacher.Sync]. It has no effect on
+	// other imports.
+	//
+	// If Checkpoint is empty, the progress is not recorded.
+	Checkpoint string
+
+	// Resume indicates whether to resume an interrupted import from the
+	// Checkpoint. The tar entries up to and including the recorded one are
+	// read and discarded without being written again, and count as skipped
+	// in the [SyncResult]. As tar entries are identified by their positions
+	// in the bundle, resuming requires the same bundle byte-for-byte as the
+	// interrupted import. An import is aborted if the recorded entry does
+	// not match the bundle.
+	//
+	// If the Checkpoint does not exist, the import starts from the first
+	// tar entry. Resume has no effect if the Checkpoint is empty.
+	Resume bool
+
+	// Staged indicates whether to stage all files of an import before
+	// publishing any of them. The files are written as hidden temporary
+	// files next to their targets, which readers (including other processes
+	// sharing the cache directory) never see, and are renamed into place
+	// only once the whole bundle has been extracted. If the import fails,
+	// the staged files are removed and nothing is published. Otherwise, the
+	// ".info" files are published last, so that a module version is not
+	// discoverable before its other files are. Note that publishing is a
+	// sequence of renames, one per file, rather than a single atomic step.
+	//
+	// As the files are kept staged until the end, a staged import needs
+	// free space for all its files at once, on top of the files they
+	// replace, and the renames add a burst of metadata I/O at the end.
+	// [DirCacher.DirectWrite] is ignored by staged imports.
+	//
+	// Staged is supported only by [DirCacher.Sync], and cannot be combined
+	// with Checkpoint. For the [Cacher] returned by [NewShardedCacher], each
+	// shard is staged and published separately.
+	Staged bool
+
+	// OnComplete is called once with the ctx of an import after it has
+	// completed successfully, along with its [SyncResult] (e.g., to rebuild
+	// an index or to notify replicas of the newly imported cache files). It
+	// is never called if the import fails. If it returns an error, the
+	// import returns the error, although the files have been imported.
+	//
+	// Imports coalesced into an in-progress one by DedupKey do not call
+	// their OnComplete, as the in-progress import is done with its own
+	// options.
+	OnComplete func(ctx context.Context, result SyncResult) error
+
+	// Logger is used to log the files skipped by StrictNames, and the
+	// symbolic links skipped when ImportSymlinks is false.
+	//
+	// If Logger is nil, [log.Default] is used.
+	Logger *log.Logger
+}
+
+// SyncResult is the statistics of a successful import of cache files in bulk
+// (see [SyncOptions.OnComplete]).
+type SyncResult struct {
+	// Files is the number of files imported.
+	Files int
+
+	// Bytes is the total size of the files imported in bytes.
+	Bytes int64
+
+	// Skipped is the number of files not imported because they were
+	// skipped (e.g., by [DirCacher.Skip] or [SyncOptions.StrictNames]).
+	Skipped int
+
+	// VerifiedZipHashes is the number of .zip files verified against their
+	// .ziphash files (see [SyncOptions.VerifyZipHashes]).
+	VerifiedZipHashes int
+}
+
+// complete calls the opts.OnComplete, if any, with the ctx and result.
+func (opts SyncOptions) complete(ctx context.Context, result SyncResult) error {
+	if opts.OnComplete == nil {
+		return nil
+	}
+	return opts.OnComplete(ctx, result)
+}
+
+// skipSymlink reports whether the symbolic link targeted by the name should be
+// skipped because the opts.ImportSymlinks is false. Skipped symbolic links are
+// logged to the opts.Logger.
+func (opts SyncOptions) skipSymlink(name string) bool {
+	if opts.ImportSymlinks {
+		return false
+	}
+	msg := "goproxy: skipped symbolic link: " + name
+	if opts.Logger != nil {
+		opts.Logger.Output(2, msg)
+	} else {
+		log.Output(2, msg)
+	}
+	return true
+}
+
+// skipName reports whether the file targeted by the name should be skipped
+// because it does not match the layout of a module cache while the
+// opts.StrictNames is true. Skipped files are logged to the opts.Logger.
+func (opts SyncOptions) skipName(name string) bool {
+	if !opts.StrictNames || isModuleCacheName(name) {
+		return false
+	}
+	msg := "goproxy: skipped file not matching module cache layout: " + name
+	if opts.Logger != nil {
+		opts.Logger.Output(2, msg)
+	} else {
+		log.Output(2, msg)
+	}
+	return true
+}
+
+// ErrUnsupportedCompression is the error returned when importing cache files
+// in bulk from a bundle whose compress type is not supported (see
+// [SupportedSyncCompressions]).
+var ErrUnsupportedCompression = errors.New("unsupported compress type")
+
+// SupportedSyncCompressions returns the canonical compress types of bundles
+// that [Cacher.Sync] supports, in the order they are preferred. The aliases of
+// them (see [SyncOptions.ContentTypeAliases]) are supported too.
+func SupportedSyncCompressions() []string {
+	return []string{"application/gzip", "application/x-tar"}
+}
+
+// unsupportedCompressionError returns an error that matches
+// [ErrUnsupportedCompression] for the compressType.
+func unsupportedCompressionError(compressType string) error {
+	return fmt.Errorf("%w %q (supported: %s)", ErrUnsupportedCompression, compressType, strings.Join(SupportedSyncCompressions(), ", "))
+}
+
+// defaultContentTypeAliases is the default aliases of the canonical compress
+// types (see [SyncOptions.ContentTypeAliases]).
+var defaultContentTypeAliases = map[string]string{
+	"application/x-gzip":            "application/gzip",
+	"application/x-gtar-compressed": "application/gzip",
+	"application/x-compressed-tar":  "application/gzip",
+	"application/x-tgz":             "application/gzip",
+	"application/tar":               "application/x-tar",
+	"application/x-gtar":            "application/x-tar",
+	"application/x-ustar":           "application/x-tar",
+}
+
+// compressType returns the canonical compress type for the contentType by
+// resolving the aliases in the opts.ContentTypeAliases and the
+// defaultContentTypeAliases. If the contentType is neither canonical nor
+// aliased, it is returned as is.
+func (opts SyncOptions) compressType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-tar":
+		return mediaType
+	}
+	for alias, compressType := range opts.ContentTypeAliases {
+		if strings.EqualFold(alias, mediaType) {
+			return compressType
+		}
+	}
+	if compressType, ok := defaultContentTypeAliases[mediaType]; ok {
+		return compressType
+	}
+	return contentType
+}
+
+// isModuleCacheName reports whether the name matches the layout of a module
+// cache (see [SyncOptions.StrictNames]).
+func isModuleCacheName(name string) bool {
+	if strings.HasPrefix(name, "cache/") || strings.HasPrefix(name, "sumdb/") {
+		return true
+	}
+	escapedModulePath, after, ok := strings.Cut(name, "/@")
+	if !ok {
+		return false
+	}
+	if _, err := module.UnescapePath(escapedModulePath); err != nil {
+		return false
+	}
+	switch after {
+	case "latest", "v/list":
+		return true
+	}
+	if !strings.HasPrefix(after, "v/") {
+		return false
+	}
+	escapedModuleVersion, ext := after[2:], path.Ext(after)
+	switch ext {
+	case ".info", ".mod", ".zip", ".ziphash", ".ready":
+	default:
+		return false
+	}
+	_, err := module.UnescapeVersion(strings.TrimSuffix(escapedModuleVersion, ext))
+	return err == nil
+}
+
+// ErrSyncInProgress is the error returned when an exclusive import of cache
+// files in bulk is attempted while another one is in progress (see
+// [SyncOptions.Exclusive]).
+var ErrSyncInProgress = errors.New("sync in progress")
+
+// ErrSyncQueueFull is the error returned when an exclusive import of cache
+// files in bulk is attempted while too many others are already waiting for
+// the one in progress (see [SyncOptions.MaxQueued]).
+var ErrSyncQueueFull = errors.New("sync queue full")
+
+// ErrTooManyFiles is the error returned when importing cache files in bulk
+// would write more files than allowed (see [SyncOptions.MaxFiles]).
+var ErrTooManyFiles = errors.New("too many files")
+
+// ErrPathTooDeep is the error returned when importing cache files in bulk
+// would write a file nested deeper than allowed (see
+// [SyncOptions.MaxPathDepth]).
+var ErrPathTooDeep = errors.New("path too deep")
+
+// DuplicatePolicy is the policy for files that appear more than once in a
+// bundle being imported (see [SyncOptions.OnDuplicate]).
+type DuplicatePolicy int
+
+const (
+	// DuplicateOverwrite imports every copy of a duplicate file, so that
+	// the last one wins.
+	DuplicateOverwrite DuplicatePolicy = iota
+
+	// DuplicateSkip imports only the first copy of a duplicate file, and
+	// counts the others as skipped (see [SyncResult.Skipped]).
+	DuplicateSkip
+
+	// DuplicateError aborts the import with an error that matches
+	// [ErrDuplicateEntry] at the second copy of a duplicate file. Files
+	// that have already been written are kept.
+	DuplicateError
 )
 
-// Cacher defines a set of intuitive methods used to cache module files for [Goproxy].
-type Cacher interface {
-	// Get gets the matched cache for the name. It returns [fs.ErrNotExist]
-	// if not found.
-	//
-	// The returned [io.ReadCloser] may optionally implement the following
-	// interfaces:
-	//  1. [io.Seeker], mainly for the Range request header.
-	//  2. interface{ LastModified() time.Time }, mainly for the
-	//     Last-Modified response header. Also for the If-Unmodified-Since,
-	//     If-Modified-Since, and If-Range request headers when 1 is
-	//     implemented.
-	//  3. interface{ ModTime() time.Time }, same as 2 but with lower
-	//     priority.
-	//  4. interface{ ETag() string }, mainly for the ETag response header.
-	//     Also for the If-Match, If-None-Match, and If-Range request
-	//     headers when 1 is implemented. Note that the return value will be
-	//     assumed to have complied with RFC 7232, section 2.3, so it will
-	//     be used directly without further processing.
-	Get(ctx context.Context, name string) (io.ReadCloser, error)
+// ErrDuplicateEntry is the error returned when a bundle being imported has
+// more than one file with the same name (see [DuplicateError]).
+var ErrDuplicateEntry = errors.New("duplicate entry")
+
+// checkDuplicate checks the file targeted by the name against the names of
+// the files seen earlier in the same import, which the name is added to,
+// as per the opts.OnDuplicate. It reports whether the file should be
+// skipped. The seen is not used when the opts.OnDuplicate is
+// [DuplicateOverwrite].
+func (opts SyncOptions) checkDuplicate(seen map[string]struct{}, name string) (bool, error) {
+	if opts.OnDuplicate == DuplicateOverwrite {
+		return false, nil
+	}
+	if _, ok := seen[name]; !ok {
+		seen[name] = struct{}{}
+		return false, nil
+	}
+	if opts.OnDuplicate == DuplicateSkip {
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: %s", ErrDuplicateEntry, name)
+}
+
+// defaultSyncMaxFiles is the default value of [SyncOptions.MaxFiles].
+const defaultSyncMaxFiles = 1 << 20
+
+// checkFileCount checks whether writing another file after count files have
+// been written is allowed by the opts.MaxFiles.
+func (opts SyncOptions) checkFileCount(count int) error {
+	maxFiles := opts.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultSyncMaxFiles
+	}
+	if maxFiles > 0 && count >= maxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrTooManyFiles, maxFiles)
+	}
+	return nil
+}
+
+// defaultSyncMaxPathDepth is the default value of [SyncOptions.MaxPathDepth].
+const defaultSyncMaxPathDepth = 64
+
+// checkPathDepth checks whether writing the file targeted by the name is
+// allowed by the opts.MaxPathDepth.
+func (opts SyncOptions) checkPathDepth(name string) error {
+	maxDepth := opts.MaxPathDepth
+	if maxDepth == 0 {
+		maxDepth = defaultSyncMaxPathDepth
+	}
+	if maxDepth > 0 && strings.Count(name, "/")+1 > maxDepth {
+		return fmt.Errorf("%w: %s: more than %d elements", ErrPathTooDeep, name, maxDepth)
+	}
+	return nil
+}
+
+// ErrDecompressionBomb is the error returned when the decompressed content of
+// a bundle being imported expands beyond the allowed limits (see
+// [SyncOptions.MaxDecompressionRatio] and [SyncOptions.MaxDecompressedBytes]).
+var ErrDecompressionBomb = errors.New("decompression bomb")
+
+// defaultSyncMaxDecompressionRatio is the default value of
+// [SyncOptions.MaxDecompressionRatio].
+const defaultSyncMaxDecompressionRatio = 100
+
+// minCheckedDecompressedBytes is the number of decompressed bytes after which
+// [SyncOptions.MaxDecompressionRatio] is checked.
+const minCheckedDecompressedBytes = 1 << 20
+
+// gunzip returns an [io.ReadCloser] that decompresses the gzip-compressed r
+// while guarding against the limits of the opts.MaxDecompressionRatio and the
+// opts.MaxDecompressedBytes.
+func (opts SyncOptions) gunzip(r io.Reader) (io.ReadCloser, error) {
+	br := &bombGuardReader{maxRatio: opts.MaxDecompressionRatio, maxBytes: opts.MaxDecompressedBytes}
+	if br.maxRatio == 0 {
+		br.maxRatio = defaultSyncMaxDecompressionRatio
+	}
+	br.compressed = &countingReader{r: r}
+	gzipReader, err := gzip.NewReader(br.compressed)
+	if err != nil {
+		return nil, err
+	}
+	br.ReadCloser = gzipReader
+	return br, nil
+}
+
+// countingReader is an [io.Reader] that counts the bytes read from the
+// underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements [io.Reader].
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// bombGuardReader is an [io.ReadCloser] that reads decompressed content from
+// the underlying [io.ReadCloser] and returns an error that matches
+// [ErrDecompressionBomb] as soon as the content expands beyond the maxRatio
+// of the bytes read from the compressed reader, or beyond the maxBytes.
+type bombGuardReader struct {
+	io.ReadCloser
+	compressed *countingReader
+	maxRatio   float64
+	maxBytes   int64
+	n          int64
+}
+
+// Read implements [io.Reader].
+func (br *bombGuardReader) Read(p []byte) (int, error) {
+	n, err := br.ReadCloser.Read(p)
+	br.n += int64(n)
+	if br.maxBytes > 0 && br.n > br.maxBytes {
+		return 0, fmt.Errorf("%w: decompressed size exceeds %d bytes", ErrDecompressionBomb, br.maxBytes)
+	}
+	if br.maxRatio > 0 && br.n > minCheckedDecompressedBytes && float64(br.n) > br.maxRatio*float64(br.compressed.n) {
+		return 0, fmt.Errorf("%w: decompression ratio exceeds %g", ErrDecompressionBomb, br.maxRatio)
+	}
+	return n, err
+}
+
+// ErrInsufficientSpace is the error returned when importing cache files in
+// bulk would leave less available space than required.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// Sizer is an optional interface that the content passed to [Cacher.Put] can
+// implement to report its total size in bytes. Both [strings.Reader] and
+// [bytes.Reader] implement it.
+type Sizer interface {
+	// Size returns the total size of the content in bytes, regardless of
+	// how much of it has been read.
+	Size() int64
+}
+
+// ContentSize returns the total size of the content in bytes. It uses
+// [Sizer.Size] if the content implements [Sizer], otherwise it seeks to the
+// end of the content and then back to the start.
+func ContentSize(content io.ReadSeeker) (int64, error) {
+	if s, ok := content.(Sizer); ok {
+		return s.Size(), nil
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// CacheEntry is a cache with its name and content.
+type CacheEntry struct {
+	// Name is the name of the cache.
+	Name string
+
+	// Content is the content of the cache.
+	Content io.ReadSeeker
+}
+
+// BatchPutter is an optional interface that a [Cacher] can implement to put
+// multiple caches at once more efficiently than calling [Cacher.Put] for each
+// of them (e.g., by uploading them in parallel). Implementations should put
+// the ".info" entries last, or make all the entries visible at once, so that
+// the ".info" file of a module version is never visible without its other
+// files.
+//
+// Use [PutAll] instead of calling PutAll directly to get the fallback behavior
+// for cachers that do not implement BatchPutter.
+type BatchPutter interface {
+	// PutAll puts caches for all the entries. It returns the first error
+	// encountered, in which case some of the entries may have been put.
+	PutAll(ctx context.Context, entries []CacheEntry) error
+}
+
+// PutAll puts caches for all the entries to the c. It uses [BatchPutter.PutAll]
+// if the c implements [BatchPutter], otherwise it calls [Cacher.Put] for each
+// entry in order, with the ".info" entries and then the ".ready" entries (see
+// [Goproxy.CompletionMarkers]) last, and stops at the first error.
+func PutAll(ctx context.Context, c Cacher, entries []CacheEntry) error {
+	if bp, ok := c.(BatchPutter); ok {
+		return bp.PutAll(ctx, entries)
+	}
+	for _, entry := range infoLastCacheEntries(entries) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.Put(ctx, entry.Name, entry.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyInfo is the expected size and hash of the content put by
+// [VerifiedPutter.PutVerified].
+type VerifyInfo struct {
+	// Size is the expected size of the content in bytes.
+	//
+	// If Size is zero, the size is not verified. Use SHA256 or Digest to
+	// verify empty content.
+	Size int64
+
+	// SHA256 is the expected hex-encoded SHA-256 hash of the content.
+	//
+	// If SHA256 is empty, the SHA-256 hash is not verified.
+	SHA256 string
+
+	// Digest is the expected hash of the content in the form "<hash
+	// name>:<hex-encoded hash>" (e.g., "sha512:..."), as in
+	// [ManifestEntry.Digest]. The content is verified with the hash
+	// function named in the Digest, which is not necessarily the one the
+	// [VerifiedPutter] is configured with, so that a hash is always
+	// verified with the same hash function it was computed with. A Digest
+	// naming an unsupported hash function is an error. Only one of SHA256
+	// and Digest can be set.
+	//
+	// If Digest is empty, the hash is verified only as per SHA256.
+	Digest string
+}
+
+// ErrContentMismatch is the error returned by [VerifiedPutter.PutVerified]
+// when the content does not match the expected [VerifyInfo].
+var ErrContentMismatch = errors.New("content mismatch")
+
+// ErrSizeMismatch is the error returned when the content of a cache being put
+// delivers more or fewer bytes than its declared size, which is either the
+// [VerifyInfo.Size] given to [VerifiedPutter.PutVerified] or, for
+// [DirCacher], the size reported by a content that implements [Sizer]. Errors
+// that match ErrSizeMismatch also match [ErrContentMismatch].
+var ErrSizeMismatch = errors.New("size mismatch")
+
+// sizeMismatchError is an error that matches both [ErrSizeMismatch] and
+// [ErrContentMismatch].
+type sizeMismatchError struct {
+	err error
+}
+
+// sizeMismatchErrorf formats according to a format specifier and returns the
+// string as a value that satisfies error and matches [ErrSizeMismatch].
+func sizeMismatchErrorf(format string, v ...any) error {
+	return &sizeMismatchError{err: fmt.Errorf("%w: "+format, append([]any{ErrSizeMismatch}, v...)...)}
+}
+
+// Error implements error.
+func (e *sizeMismatchError) Error() string { return e.err.Error() }
+
+// Unwrap returns the underlying error of the e.
+func (e *sizeMismatchError) Unwrap() error { return e.err }
+
+// Is reports whether the target is [ErrContentMismatch].
+func (*sizeMismatchError) Is(target error) bool { return target == ErrContentMismatch }
+
+// VerifiedPutter is an optional interface that a [Cacher] can implement to put
+// a cache while verifying that its content matches the expected size and hash.
+// This catches truncated or corrupted content at the moment of caching rather
+// than when it is served later.
+type VerifiedPutter interface {
+	// PutVerified is like [Cacher.Put] but verifies the content against the
+	// expect while copying it. If the content does not match, no cache is
+	// put, and an error that matches [ErrContentMismatch] is returned.
+	PutVerified(ctx context.Context, name string, content io.Reader, expect VerifyInfo) error
+}
+
+// Lister is an optional interface that a [Cacher] can implement to list the
+// names of its caches.
+type Lister interface {
+	// List returns the names of all caches whose names start with the
+	// prefix, in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Deleter is an optional interface that a [Cacher] can implement to delete
+// caches.
+type Deleter interface {
+	// Delete deletes the cache for the name. Deleting a cache that does not
+	// exist is not an error.
+	//
+	// Delete must not affect the contents returned by [Cacher.Get] for the
+	// name before it is called. They keep yielding the cache as it was when
+	// they were returned (i.e., a snapshot), so that in-flight downloads of
+	// it complete. Implementations that cannot keep such snapshots (e.g.,
+	// those streaming objects from an object storage on demand) must
+	// instead either make Delete fail while the cache is being read, or
+	// make the affected contents fail with an error other than [io.EOF] as
+	// described in [Cacher.Get], so that a client never receives a
+	// truncated or mixed cache.
+	Delete(ctx context.Context, name string) error
+}
+
+// RangeReader is an optional interface that a [Cacher] can implement to read a
+// byte range of a cache without reading the whole cache (e.g., by sending a
+// ranged GET request to an object storage). When serving a request with a
+// single range in its Range header for a cache whose size is known (see
+// [Sizer]), a RangeReader is preferred over seeking the content returned by
+// [Cacher.Get], which is then never read.
+type RangeReader interface {
+	// RangeReadCloser returns the bytes from the start to the end
+	// (inclusive, as in the Range request header) of the cache for the
+	// name. The range is always within the size of the cache. It returns
+	// [fs.ErrNotExist] if not found.
+	RangeReadCloser(ctx context.Context, name string, start, end int64) (io.ReadCloser, error)
+}
+
+// Stater is an optional interface that a [Cacher] can implement to report the
+// size of a cache without reading it (e.g., from the metadata of an object
+// storage). It is used when the content returned by [Cacher.Get] can neither
+// report its size (see [Sizer]) nor seek, so that responses served from the
+// cache still have a Content-Length header instead of being chunked.
+type Stater interface {
+	// Stat returns the [fs.FileInfo] of the cache for the name, of which
+	// at least the Size must be valid. It returns [fs.ErrNotExist] if not
+	// found.
+	Stat(ctx context.Context, name string) (fs.FileInfo, error)
+}
+
+// Readlinker is an optional interface that a [Cacher] can implement to report
+// caches that are symbolic links to other caches (e.g., in a
+// content-addressed layout), so that they are exported as links instead of
+// copies of their targets (see [ExportOptions.DereferenceSymlinks]).
+type Readlinker interface {
+	// Readlink returns the slash-separated target of the cache for the
+	// name, as stored in the link, if it is a symbolic link. It returns an
+	// empty string if the cache is not a symbolic link, and
+	// [fs.ErrNotExist] if not found.
+	Readlink(ctx context.Context, name string) (string, error)
+}
+
+// ErrUnsupported is the error returned by an optional method of a [Cacher]
+// that wraps another one (e.g., the one returned by [NewTimeoutCacher]) when
+// the wrapped [Cacher] does not implement it, and by the operations of
+// [Goproxy] that need an optional interface the [Goproxy.Cacher] does not
+// implement (e.g., those of [Goproxy.AdminHandler]). Such a method behaves as
+// if the optional interface were not implemented.
+var ErrUnsupported = errors.New("not supported by cacher")
+
+// DirCacher implements [Cacher] using a directory on the local disk. If the
+// directory does not exist, it will be created with 0755 permissions. Cache
+// files will be created with 0644 permissions.
+//
+// The file operations of DirCacher cannot be interrupted by their contexts,
+// so they block for as long as the filesystem does not respond (e.g., on a
+// hung NFS mount). Use [NewTimeoutCacher] to bound them.
+type DirCacher struct {
+	// Dir is the directory for storing cache files.
+	Dir string
+
+	// Skip reports whether the file targeted by the name should be
+	// excluded when cache files are imported in bulk (see [DirCacher.Sync]).
+	// The name is a slash-separated path relative to the root of the
+	// imported bundle.
+	//
+	// If Skip is nil, files whose names end with ".lock" and files whose
+	// base names are "lock" (such as "cache/lock" in a module cache) are
+	// skipped.
+	Skip func(name string) bool
+
+	// RestrictSymlinks indicates whether to confine all file operations to
+	// the Dir, refusing to access cache files whose paths resolve to
+	// locations outside of the Dir (e.g., by following symbolic links). This
+	// prevents a symbolic link inside the Dir from redirecting reads and
+	// writes to an unexpected location.
+	//
+	// When built with Go 1.25 or later, the confinement is enforced by an
+	// [os.Root] opened at the Dir, which also refuses to follow symbolic
+	// links with absolute targets. Otherwise, the paths are resolved and
+	// checked before each file operation, which cannot guard against
+	// symbolic links that are changed concurrently.
+	RestrictSymlinks bool
+
+	// CopyBufferSize is the size of the buffers used to copy content into
+	// cache files. The buffers are pooled and reused across operations, so
+	// a larger size (e.g., 1 MiB) can reduce the number of system calls
+	// needed to write large files without increasing allocations.
+	//
+	// If CopyBufferSize is zero, 32 KiB (the same as [io.Copy]) is used.
+	CopyBufferSize int
+
+	// KeepFailedTemp indicates whether to keep the temporary file of a cache
+	// file that fails to be written (e.g., due to a disk error during
+	// copying) instead of removing it. The kept file retains its temporary
+	// name (see TempPattern and TempSubdir), and its path relative to the
+	// Dir is included in the returned error, so that the partial content
+	// can be inspected to diagnose the failure. Temporary files are always
+	// removed after successful writes.
+	//
+	// KeepFailedTemp is intended for debugging. Kept files are never cleaned
+	// up automatically.
+	KeepFailedTemp bool
+
+	// DirectWrite indicates whether to write cache files directly to their
+	// final paths, instead of writing them to temporary files first and then
+	// renaming them into place. This can be much faster on filesystems where
+	// renaming is expensive (e.g., some FUSE-based ones).
+	//
+	// Note that DirectWrite sacrifices atomicity: a concurrent Get may see a
+	// partially written cache file, and a crash in the middle of a write
+	// leaves a truncated cache file behind that will be served as is.
+	// Consider enabling [Goproxy.TreatEmptyCachesAsMisses] to at least
+	// recover from files that were created but never written. Cache files
+	// that fail to be written without a crash are removed. Existing cache
+	// files are still replaced through temporary files, so that a failed
+	// write never destroys them. KeepFailedTemp has no effect on cache
+	// files written directly.
+	DirectWrite bool
+
+	// SpoolDir is the directory for writing temporary files of cache files
+	// before they are moved into the Dir (e.g., a directory on a faster
+	// volume than the Dir). If it does not exist, it will be created with
+	// 0755 permissions.
+	//
+	// If the SpoolDir is on a different filesystem than the Dir, moving a
+	// temporary file by renaming it fails. In that case, the temporary file
+	// is copied into another temporary file next to the target cache file,
+	// which is synced to the disk and then renamed into place. Cache files
+	// therefore still appear atomically, but their content is written twice,
+	// and a crash in the middle of a write may leave temporary files behind
+	// in both directories. The same applies when RestrictSymlinks is true,
+	// since temporary files outside of the Dir are never renamed into it.
+	//
+	// If SpoolDir is empty, temporary files are written next to their target
+	// cache files. SpoolDir has no effect when DirectWrite is true.
+	SpoolDir string
+
+	// TempPattern is the pattern of the names of temporary files of cache
+	// files, as accepted by [os.CreateTemp], in which every "{name}" is
+	// replaced with the base name of the target cache file (e.g.,
+	// "{name}.partial.*"). Patterns should start with "." so that temporary
+	// files are never listed as caches (see [DirCacher.List]).
+	//
+	// If TempPattern is empty, ".{name}.tmp.*" is used.
+	TempPattern string
+
+	// TempSubdir is the slash-separated path of a directory relative to the
+	// Dir for writing temporary files of cache files, instead of next to
+	// their target cache files (e.g., so that in-flight files can be
+	// excluded from scanning by antivirus software). As it is on the same
+	// filesystem as the Dir, cache files are still renamed into place
+	// atomically. If it does not exist, it will be created with 0755
+	// permissions. Its first element should start with "." (e.g., ".tmp")
+	// so that it is never listed as caches. It must stay within the Dir, so
+	// it must not be absolute or start with "..", otherwise all operations
+	// of the DirCacher fail.
+	//
+	// If TempSubdir is empty, temporary files are written next to their
+	// target cache files.
+	TempSubdir string
+
+	// DetectCaseCollisions indicates whether to refuse to write a cache file
+	// whose path differs only in case from that of an existing file or
+	// directory in the Dir, returning an error that matches
+	// [ErrNameCollision] instead. On case-insensitive filesystems (e.g., the
+	// defaults on macOS and Windows), such a write would otherwise silently
+	// overwrite the existing file. The check reads every directory along
+	// the path of the cache file before it is put into place, so it is
+	// opt-in.
+	DetectCaseCollisions bool
+
+	// TrackAccess indicates whether to track the order and frequency in
+	// which cache files are got and put, for use by
+	// [DirCacher.LeastRecentlyUsed], [DirCacher.TopEntries], and
+	// [DirCacher.Evict] (e.g., to decide which cache files to evict). The
+	// accesses are kept only in memory, so that frequent reads never cause
+	// disk writes. As a result, they are lost when the process exits, and
+	// cache files that have not been accessed since then are not tracked at
+	// all. They should be considered less recently and less frequently used
+	// than all tracked ones.
+	TrackAccess bool
+
+	// Protect reports whether the named cache file must be spared by
+	// [DirCacher.Evict], regardless of how recently it has been accessed.
+	//
+	// If Protect is nil, no cache files are protected by it.
+	Protect func(name string) bool
+
+	// ProtectLatestVersions indicates whether [DirCacher.Evict] spares the
+	// module files (i.e., the ".info", ".mod", ".zip", and ".ziphash" files)
+	// of the latest cached version of each module, which is the most likely
+	// to be requested again, even if it is cold. As with the "latest" query
+	// of the go command, the latest version is the highest release version,
+	// or the highest pre-release version if there are no release versions,
+	// or the highest pseudo-version if there are neither. It applies in
+	// addition to Protect, and the latest versions are found by listing the
+	// cache files once per eviction pass.
+	ProtectLatestVersions bool
+
+	// HashDirLevels is the number of levels of intermediate directories
+	// inserted above each cache file, each named after the next byte of the
+	// SHA-256 hash of its name in hex (e.g.,
+	// "3f/a2/github.com/foo/bar/@v/list" for 2). This spreads the cache
+	// files evenly across up to 256^HashDirLevels directories, so that no
+	// single directory (such as "github.com") accumulates so many entries
+	// that directory operations slow down. The names are recovered from the
+	// paths, so they are still used as is everywhere else (e.g., by
+	// [DirCacher.List] and [DirCacher.Manifest]). Note that listing the
+	// cache files whose names start with a prefix then requires walking the
+	// whole Dir.
+	//
+	// Changing HashDirLevels changes where cache files are looked up, so
+	// the existing ones are no longer found. To switch a Dir to another
+	// HashDirLevels, migrate its cache files into a new Dir (e.g., with
+	// [Goproxy.Export] from the old DirCacher and [DirCacher.Sync] into the
+	// new one).
+	//
+	// HashDirLevels must be in the range [0, 32]. If HashDirLevels is zero,
+	// cache files are stored directly under their names.
+	HashDirLevels int
+
+	// HashFunc is the hash function used for the hashes of cache files that
+	// the DirCacher computes (see [ManifestOptions.Digest]), and HashName
+	// is its name (e.g., "sha512"), which is recorded alongside the hashes
+	// so that they are always verified with the same hash function, even
+	// after HashFunc changes. Besides HashFunc, hashes named "sha224",
+	// "sha256", "sha384" and "sha512" can always be verified (see
+	// [VerifyInfo.Digest]). HashFunc does not affect the hashes that name
+	// cache files (see HashDirLevels), which are always SHA-256.
+	//
+	// HashName must be set if HashFunc is not nil, and must not contain
+	// ":". If HashFunc is nil, SHA-256 named "sha256" is used.
+	HashFunc func() hash.Hash
+	HashName string
+
+	restrictedFSMutex  sync.Mutex
+	restrictedFS       dirFS
+	copyBufferPoolOnce sync.Once
+	copyBufferPool     sync.Pool
+	syncSemaphoreOnce  sync.Once
+	syncSemaphore      chan struct{}
+	syncQueueMutex     sync.Mutex
+	syncQueued         int
+	syncGroup          singleflightGroup
+	accessTrackerOnce  sync.Once
+	accessTracker      *accessTracker
+
+	// nowFunc returns the current time. It is used in place of [time.Now]
+	// so that tests can control the time. If nowFunc is nil, [time.Now] is
+	// used.
+	nowFunc func() time.Time
+
+	// renameFunc renames a file. It is used in place of [os.Rename] when
+	// moving files from the SpoolDir so that tests can simulate failures. If
+	// renameFunc is nil, [os.Rename] is used.
+	renameFunc func(oldpath, newpath string) error
+}
+
+// now returns the current time.
+func (dc *DirCacher) now() time.Time {
+	if dc.nowFunc != nil {
+		return dc.nowFunc()
+	}
+	return time.Now()
+}
+
+// ErrInvalidName is the error returned by [DirCacher] when a cache name is not
+// a valid slash-separated path relative to the cache directory.
+var ErrInvalidName = errors.New("invalid cache name")
+
+// checkCacheName checks whether the name is a valid cache name. A valid cache
+// name is a non-empty, slash-separated, relative path that does not contain
+// backslashes, empty elements, or "." or ".." elements.
+func checkCacheName(name string) error {
+	if name == "." || !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// skip reports whether the file targeted by the name should be excluded when
+// cache files are imported in bulk.
+func (dc *DirCacher) skip(name string) bool {
+	if dc.Skip != nil {
+		return dc.Skip(name)
+	}
+	return isLockFile(name)
+}
+
+// isLockFile reports whether the file targeted by the name is a lock file that
+// the Go binary uses to coordinate access to the module cache.
+func isLockFile(name string) bool {
+	return strings.HasSuffix(name, ".lock") || path.Base(name) == "lock"
+}
+
+// ErrNameCollision is the error returned by [DirCacher] when a cache file
+// would collide with an existing file or directory whose path differs only in
+// case (see [DirCacher.DetectCaseCollisions]).
+var ErrNameCollision = errors.New("cache name collision")
+
+// checkCaseCollision checks whether any element of the named path collides
+// case-insensitively with a differently-cased existing entry in the fsys.
+// Elements that do not exist yet are not collisions.
+func checkCaseCollision(fsys dirFS, name string) error {
+	dir := "."
+	for _, elem := range strings.Split(name, "/") {
+		f, err := fsys.open(dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		entries, err := f.ReadDir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Name() != elem && strings.EqualFold(entry.Name(), elem) {
+				return fmt.Errorf("%w: %s collides with %s", ErrNameCollision, name, path.Join(dir, entry.Name()))
+			}
+		}
+		dir = path.Join(dir, elem)
+	}
+	return nil
+}
+
+// ErrIsDir is the error wrapped in the error returned by [DirCacher.Get] when
+// the name targets a directory rather than a cache file.
+var ErrIsDir = errors.New("cache is a directory")
+
+// Get implements [Cacher]. It returns exactly [fs.ErrNotExist] if the cache
+// file targeted by the name does not exist. Other failures are returned as
+// [*fs.PathError] with the "get" operation and the name, wrapping the
+// underlying error (e.g., one that matches [fs.ErrPermission]), or
+// [ErrIsDir] if the name targets a directory.
+func (dc *DirCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkCacheName(name); err != nil {
+		return nil, err
+	}
+	fsys, err := dc.fs(false)
+	if err != nil {
+		return nil, err
+	}
+	file := dc.fileName(name)
+	f, err := fsys.open(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "get", Path: name, Err: err}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "get", Path: name, Err: err}
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, &fs.PathError{Op: "get", Path: name, Err: ErrIsDir}
+	}
+	dc.touch(file, true)
+	return &struct {
+		*os.File
+		os.FileInfo
+	}{f, fi}, nil
+}
+
+// Stat implements [Stater].
+func (dc *DirCacher) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	if err := checkCacheName(name); err != nil {
+		return nil, err
+	}
+	fsys, err := dc.fs(false)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.open(dc.fileName(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: ErrIsDir}
+	}
+	return fi, nil
+}
+
+// Readlink implements [Readlinker].
+func (dc *DirCacher) Readlink(ctx context.Context, name string) (string, error) {
+	if err := checkCacheName(name); err != nil {
+		return "", err
+	}
+	fsys, err := dc.fs(false)
+	if err != nil {
+		return "", err
+	}
+	file := dc.fileName(name)
+	fi, err := fsys.lstat(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fs.ErrNotExist
+		}
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return "", nil
+	}
+	target, err := fsys.readlink(file)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// ErrUnsafeSymlink is the error returned by [DirCacher.Sync] when a bundle
+// contains a symbolic link whose target is absolute or resolves to a location
+// outside of the [DirCacher.Dir].
+var ErrUnsafeSymlink = errors.New("unsafe symbolic link")
+
+// checkSymlinkTarget checks whether the slash-separated target of a symbolic
+// link at the file, which is relative to the root of a [dirFS], stays within
+// the root. The target must be clean, so that its ".." elements can only be
+// the leading ones, which climb from the directory of the file rather than
+// from wherever a symbolic link within the target points to.
+func checkSymlinkTarget(file, target string) error {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) || strings.Contains(target, `\`) || path.Clean(target) != target {
+		return fmt.Errorf("%w: %q", ErrUnsafeSymlink, target)
+	}
+	if resolved := path.Join(path.Dir(file), target); resolved == "." || !fs.ValidPath(resolved) {
+		return fmt.Errorf("%w: %q", ErrUnsafeSymlink, target)
+	}
+	return nil
+}
+
+// checkSymlinkParents checks that no parent directory of the file, which is
+// relative to the root of the fsys, is a symbolic link, so that writing the file
+// cannot follow a symbolic link (e.g., one imported by [DirCacher.Sync]) out of
+// the root. Parent directories that do not exist yet are not checked.
+func checkSymlinkParents(fsys dirFS, file string) error {
+	dir := path.Dir(file)
+	if dir == "." {
+		return nil
+	}
+	elems := strings.Split(dir, "/")
+	for i := range elems {
+		parent := strings.Join(elems[:i+1], "/")
+		fi, err := fsys.lstat(parent)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %q is a symbolic link", ErrUnsafeSymlink, parent)
+		}
+	}
+	return nil
+}
+
+// symlink creates the cache file for the name as a symbolic link to the
+// slash-separated target, replacing any existing one.
+func (dc *DirCacher) symlink(name, target string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	fsys, err := dc.fs(true)
+	if err != nil {
+		return err
+	}
+	file := dc.fileName(name)
+	if err := checkSymlinkTarget(file, target); err != nil {
+		return err
+	}
+	return dc.writeSymlink(fsys, file, target)
+}
+
+// checkSymlinkParents checks that no parent directory of the cache file for the
+// name is a symbolic link (see [checkSymlinkParents]).
+func (dc *DirCacher) checkSymlinkParents(name string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	fsys, err := dc.fs(true)
+	if err != nil {
+		return err
+	}
+	return checkSymlinkParents(fsys, dc.fileName(name))
+}
+
+// writeSymlink creates the named file in the fsys as a symbolic link to the
+// target, replacing any existing one.
+func (dc *DirCacher) writeSymlink(fsys dirFS, name, target string) error {
+	if err := checkSymlinkParents(fsys, name); err != nil {
+		return err
+	}
+	if err := fsys.mkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := fsys.remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return fsys.symlink(target, name)
+}
+
+// accesses returns the [accessTracker] of the dc.
+func (dc *DirCacher) accesses() *accessTracker {
+	dc.accessTrackerOnce.Do(func() { dc.accessTracker = &accessTracker{} })
+	return dc.accessTracker
+}
+
+// touch records an access to the cache file at the file path (see
+// [DirCacher.fileName]) if dc.TrackAccess is true. The access counts as a hit
+// if the hit is true.
+func (dc *DirCacher) touch(file string, hit bool) {
+	if !dc.TrackAccess {
+		return
+	}
+	if name, ok := dc.cacheName(file); ok {
+		dc.accesses().touch(name, hit, dc.now())
+	}
+}
+
+// LeastRecentlyUsed returns the names of up to n cache files whose accesses
+// have been tracked (see [DirCacher.TrackAccess]), ordered from the least
+// recently accessed to the most recently accessed. If n is negative, the names
+// of all tracked cache files are returned.
+func (dc *DirCacher) LeastRecentlyUsed(n int) []string {
+	return dc.accesses().leastRecentlyUsed(n)
+}
+
+// TopEntries returns the stats of up to n cache files whose accesses have been
+// tracked (see [DirCacher.TrackAccess]), ordered from the most frequently got
+// to the least frequently got, with ties broken by putting the more recently
+// accessed first. If n is negative, the stats of all tracked cache files are
+// returned, which ends with the least frequently got ones (e.g., to tune the
+// eviction thresholds or to decide which modules to mirror in advance).
+func (dc *DirCacher) TopEntries(ctx context.Context, n int) ([]EntryStat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return dc.accesses().mostFrequentlyUsed(n), nil
+}
+
+// Put implements [Cacher]. If the content implements [Sizer], no cache is put,
+// and an error that matches [ErrSizeMismatch] is returned, unless the content
+// delivers exactly as many bytes as its size.
+func (dc *DirCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	return dc.put(ctx, name, sizeVerifyingReader(content))
+}
+
+// PutVerified implements [VerifiedPutter]. The content is verified as it is
+// copied into the temporary file, which is removed on mismatch.
+func (dc *DirCacher) PutVerified(ctx context.Context, name string, content io.Reader, expect VerifyInfo) error {
+	vr, err := newVerifyingReader(content, expect, dc.lookupHashFunc)
+	if err != nil {
+		return err
+	}
+	return dc.put(ctx, name, vr)
+}
+
+// PutAll implements [BatchPutter]. Each directory needed by the entries is
+// created only once, and the sizes of their contents are verified as per
+// [DirCacher.Put].
+//
+// Unless dc.DirectWrite is true, the entries are committed atomically as a
+// whole: all of them are written to temporary files first, and only then are
+// they renamed into place, with the ".info" files and then the ".ready" files
+// last, so that the ".info" file of a module version is never visible without
+// its other files. If any entry fails, the entries already renamed into place
+// are removed again.
+func (dc *DirCacher) PutAll(ctx context.Context, entries []CacheEntry) error {
+	fsys, err := dc.fs(true)
+	if err != nil {
+		return err
+	}
+	createdDirs := map[string]bool{}
+	files := make([]CacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		if err := checkCacheName(entry.Name); err != nil {
+			return err
+		}
+		entry.Name = dc.fileName(entry.Name)
+		files = append(files, entry)
+		if dir := path.Dir(entry.Name); !createdDirs[dir] {
+			if err := fsys.mkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+			createdDirs[dir] = true
+		}
+	}
+	entries = files
+	if dc.DirectWrite {
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := dc.writeFile(fsys, entry.Name, sizeVerifyingReader(entry.Content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	entries = infoLastCacheEntries(entries)
+	tempNames := make([]string, 0, len(entries))
+	committed := 0
+	defer func() {
+		for _, tempName := range tempNames[committed:] {
+			fsys.remove(tempName)
+		}
+	}()
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tempName, err := dc.stageFile(fsys, entry.Name, sizeVerifyingReader(entry.Content))
+		if err != nil {
+			return err
+		}
+		tempNames = append(tempNames, tempName)
+	}
+	for i, entry := range entries {
+		if err := fsys.rename(tempNames[i], entry.Name); err != nil {
+			for _, committedEntry := range entries[:committed] {
+				fsys.remove(committedEntry.Name)
+			}
+			return err
+		}
+		committed++
+	}
+	for _, entry := range entries {
+		dc.touch(entry.Name, false)
+	}
+	return nil
+}
+
+// infoLastCacheEntries returns a copy of the entries with the ".info" entries,
+// followed by the ".ready" entries (see [Goproxy.CompletionMarkers]), moved to
+// the end, preserving the relative order of the others.
+func infoLastCacheEntries(entries []CacheEntry) []CacheEntry {
+	sorted := make([]CacheEntry, 0, len(entries))
+	var infos, markers []CacheEntry
+	for _, entry := range entries {
+		switch path.Ext(entry.Name) {
+		case ".info":
+			infos = append(infos, entry)
+		case ".ready":
+			markers = append(markers, entry)
+		default:
+			sorted = append(sorted, entry)
+		}
+	}
+	return append(append(sorted, infos...), markers...)
+}
+
+// List implements [Lister]. Hidden files and directories whose base names
+// start with a dot, such as temporary files, are not listed.
+func (dc *DirCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+	if !fs.ValidPath(dir) || strings.Contains(dir, `\`) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, prefix)
+	}
+
+	if err := dc.checkHashDirLevels(); err != nil {
+		return nil, err
+	}
+	if dc.HashDirLevels > 0 {
+		dir = "."
+	}
+
+	var names []string
+	err := fs.WalkDir(dc.fsys(), dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != dir && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if name, ok := dc.cacheName(name); ok && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SizeByPrefix returns the total sizes in bytes of the cache files in the
+// dc.Dir, aggregated by the first depth elements of their names (e.g.,
+// "github.com/foo" for 2), so that disk usage can be attributed to module
+// namespaces. Only the elements of the module path count toward the depth.
+// For example, "github.com/foo/@v/list" is aggregated as "github.com/foo" for
+// any depth of 2 or more. The elements are escaped as in the names (see
+// [module.EscapePath]).
+//
+// Hidden files and directories, such as temporary files, are skipped, and so
+// are lock files. SizeByPrefix walks the whole dc.Dir and stats every cache
+// file in it, so it takes time proportional to the number of cache files and
+// should not be called on hot paths of huge caches.
+//
+// SizeByPrefix returns an error if the depth is not positive.
+func (dc *DirCacher) SizeByPrefix(ctx context.Context, depth int) (map[string]int64, error) {
+	if depth <= 0 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+	if err := dc.checkHashDirLevels(); err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	err := fs.WalkDir(dc.fsys(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != "." && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || isLockFile(name) || !d.Type().IsRegular() {
+			return nil
+		}
+		cacheName, ok := dc.cacheName(name)
+		if !ok {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		sizes[namePrefix(cacheName, depth)] += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// namePrefix returns the first depth elements of the module path in the name
+// (see [DirCacher.SizeByPrefix]).
+func namePrefix(name string, depth int) string {
+	if i := strings.Index(name, "/@"); i >= 0 {
+		name = name[:i]
+	}
+	elems := strings.SplitN(name, "/", depth+1)
+	if len(elems) > depth {
+		elems = elems[:depth]
+	}
+	return strings.Join(elems, "/")
+}
+
+// Delete implements [Deleter]. On Unix-like systems, contents returned by
+// [DirCacher.Get] before the deletion keep reading the deleted cache file until
+// they are closed, as open files survive being unlinked. On Windows, deleting a
+// cache file that is open fails instead.
+func (dc *DirCacher) Delete(ctx context.Context, name string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	fsys, err := dc.fs(false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := fsys.remove(dc.fileName(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if dc.TrackAccess {
+		dc.accesses().forget(name)
+	}
+	return nil
+}
+
+// layoutVersionFile is the name of the file in the root of the
+// [DirCacher.Dir] that records the version of its on-disk layout.
+const layoutVersionFile = ".goproxy-cache-version"
+
+// currentLayoutVersion is the current version of the on-disk layout of
+// [DirCacher]. Version 0 is the layout of caches without a layout version
+// file.
+const currentLayoutVersion = 1
+
+// layoutMigrations[i] migrates the on-disk layout of [DirCacher] from version i
+// to version i+1. Each migration must be idempotent, so that an interrupted
+// migration can simply be run again.
+var layoutMigrations = [currentLayoutVersion]func(ctx context.Context, dc *DirCacher, fsys dirFS) error{
+	// Version 1 has the same layout as version 0, and only adds the layout
+	// version file.
+	func(context.Context, *DirCacher, dirFS) error { return nil },
+}
+
+// Migrate upgrades the on-disk layout of the dc.Dir to the current version,
+// which is recorded in its ".goproxy-cache-version" file, so that existing
+// caches keep working after the layout changes instead of having to be wiped
+// and fetched again. Caches without the file, including new ones, have the
+// initial layout of version 0. Migrate is idempotent, and does nothing if the
+// layout is already current.
+//
+// Migrate returns an error if the layout is newer than the current version
+// (i.e., it was written by a newer version of this package), or if an
+// exclusive import is in progress (see [SyncOptions.Exclusive]). It should be
+// called before the dc is used to serve requests.
+func (dc *DirCacher) Migrate(ctx context.Context) error {
+	unlock, err := dc.lockSync(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	fsys, err := dc.fs(true)
+	if err != nil {
+		return err
+	}
+	version, err := readLayoutVersion(fsys)
+	if err != nil {
+		return err
+	}
+	if version > currentLayoutVersion {
+		return fmt.Errorf("unsupported cache layout version %d (newer than %d)", version, currentLayoutVersion)
+	}
+	buf := dc.copyBuffer()
+	defer dc.putCopyBuffer(buf)
+	for ; version < currentLayoutVersion; version++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := layoutMigrations[version](ctx, dc, fsys); err != nil {
+			return fmt.Errorf("failed to migrate cache layout from version %d to %d: %w", version, version+1, err)
+		}
+		if err := writeCacheFile(fsys, dc.tempNaming(), layoutVersionFile, strings.NewReader(strconv.Itoa(version+1)+"\n"), *buf, dc.now(), false, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLayoutVersion reads the layout version recorded in the fsys. It returns
+// 0 if no version is recorded.
+func readLayoutVersion(fsys dirFS) (int, error) {
+	f, err := fsys.open(layoutVersionFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, 64))
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid cache layout version %q", bytes.TrimSpace(b))
+	}
+	return version, nil
+}
+
+// put is like [DirCacher.Put] but does not require the content to be seekable.
+func (dc *DirCacher) put(_ context.Context, name string, content io.Reader) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	fsys, err := dc.fs(true)
+	if err != nil {
+		return err
+	}
+	file := dc.fileName(name)
+	if err := fsys.mkdirAll(path.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return dc.writeFile(fsys, file, content)
+}
+
+// writeFile is like [writeCacheFile] but uses a buffer from the pool, stamps
+// the file with the current time, and records an access to it. If the
+// dc.DirectWrite is true, the named file is written directly unless it exists.
+func (dc *DirCacher) writeFile(fsys dirFS, name string, content io.Reader) error {
+	if dc.DirectWrite {
+		if dc.DetectCaseCollisions {
+			if err := checkCaseCollision(fsys, name); err != nil {
+				return err
+			}
+		}
+		buf := dc.copyBuffer()
+		err := writeCacheFileDirect(fsys, name, content, *buf, dc.now())
+		dc.putCopyBuffer(buf)
+		if err == nil {
+			dc.touch(name, false)
+			return nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	tempName, err := dc.stageFile(fsys, name, content)
+	if err != nil {
+		return err
+	}
+	return dc.commitFile(fsys, tempName, name)
+}
+
+// stageFile writes the content to a temporary file for the named file in the
+// fsys, and returns the name of the temporary file, which can then be
+// renamed into place by [DirCacher.commitFile]. It writes the content to the
+// dc.SpoolDir first if it is not empty.
+func (dc *DirCacher) stageFile(fsys dirFS, name string, content io.Reader) (string, error) {
+	buf := dc.copyBuffer()
+	defer dc.putCopyBuffer(buf)
+	if dc.SpoolDir != "" {
+		return dc.stageSpooledFile(fsys, name, content, *buf)
+	}
+	return stageCacheFile(fsys, dc.tempNaming(), name, content, *buf, dc.now(), dc.KeepFailedTemp, false)
+}
+
+// commitFile renames the temporary file staged by [DirCacher.stageFile] to the
+// named file in the fsys, and records an access to it.
+func (dc *DirCacher) commitFile(fsys dirFS, tempName, name string) error {
+	if dc.DetectCaseCollisions {
+		if err := checkCaseCollision(fsys, name); err != nil {
+			fsys.remove(tempName)
+			return err
+		}
+	}
+	if err := commitCacheFile(fsys, tempName, name, dc.KeepFailedTemp); err != nil {
+		return err
+	}
+	dc.touch(name, false)
+	return nil
+}
+
+// stageSpooledFile is like [stageCacheFile] but writes the content to a
+// temporary file in the dc.SpoolDir first, and then moves it next to the named
+// file in the fsys as [DirCacher.SpoolDir] describes.
+func (dc *DirCacher) stageSpooledFile(fsys dirFS, name string, content io.Reader, buf []byte) (_ string, err error) {
+	if err := os.MkdirAll(dc.SpoolDir, 0o755); err != nil {
+		return "", err
+	}
+	_, pattern := dc.tempNaming().location(name)
+	f, err := os.CreateTemp(dc.SpoolDir, pattern)
+	if err != nil {
+		return "", err
+	}
+	spoolName := f.Name()
+	moved := false
+	defer func() {
+		if err != nil && dc.KeepFailedTemp {
+			err = fmt.Errorf("%w (temporary file kept as %s)", err, spoolName)
+			return
+		}
+		if !moved {
+			os.Remove(spoolName)
+		}
+	}()
+	// Hide the [io.ReaderFrom] implemented by the f to make sure the buf
+	// is actually used.
+	if _, err := io.CopyBuffer(struct{ io.Writer }{f}, content, buf); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	modTime := dc.now()
+	if osfs, ok := fsys.(osDirFS); ok {
+		if err := os.Chtimes(spoolName, modTime, modTime); err != nil {
+			return "", err
+		}
+		if err := os.Chmod(spoolName, 0o644); err != nil {
+			return "", err
+		}
+		tf, tempName, err := dc.tempNaming().createTemp(fsys, name)
+		if err != nil {
+			return "", err
+		}
+		tf.Close()
+		rename := dc.renameFunc
+		if rename == nil {
+			rename = os.Rename
+		}
+		err = rename(spoolName, osfs.path(tempName))
+		if err == nil {
+			moved = true
+			return tempName, nil
+		}
+		fsys.remove(tempName)
+		if !isCrossDeviceError(err) {
+			return "", err
+		}
+	}
+
+	f, err = os.Open(spoolName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return stageCacheFile(fsys, dc.tempNaming(), name, f, buf, modTime, false, true)
+}
+
+// defaultCopyBufferSize is the default value of [DirCacher.CopyBufferSize].
+const defaultCopyBufferSize = 32 << 10
+
+// copyBuffer returns a buffer from the pool for copying content into cache
+// files. The returned buffer should be put back by calling [putCopyBuffer].
+func (dc *DirCacher) copyBuffer() *[]byte {
+	dc.copyBufferPoolOnce.Do(func() {
+		size := dc.CopyBufferSize
+		if size <= 0 {
+			size = defaultCopyBufferSize
+		}
+		dc.copyBufferPool.New = func() any {
+			buf := make([]byte, size)
+			return &buf
+		}
+	})
+	return dc.copyBufferPool.Get().(*[]byte)
+}
+
+// putCopyBuffer puts the buf obtained from [copyBuffer] back to the pool.
+func (dc *DirCacher) putCopyBuffer(buf *[]byte) { dc.copyBufferPool.Put(buf) }
+
+// fs returns the [dirFS] for accessing cache files. If create is true, the
+// dc.Dir will be created if it does not exist.
+func (dc *DirCacher) fs(create bool) (dirFS, error) {
+	if err := dc.checkHashDirLevels(); err != nil {
+		return nil, err
+	}
+	if err := dc.checkTempSubdir(); err != nil {
+		return nil, err
+	}
+	if !dc.RestrictSymlinks {
+		return osDirFS(dc.Dir), nil
+	}
+
+	dc.restrictedFSMutex.Lock()
+	defer dc.restrictedFSMutex.Unlock()
+	if dc.restrictedFS != nil {
+		return dc.restrictedFS, nil
+	}
+	if create {
+		if err := os.MkdirAll(dc.Dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	fsys, err := newRestrictedDirFS(dc.Dir)
+	if err != nil {
+		return nil, err
+	}
+	dc.restrictedFS = fsys
+	return fsys, nil
+}
+
+// fsys returns an [fs.FS] of the cache files for walking the dc.Dir, which is
+// confined to the dc.Dir like the [dirFS] returned by [DirCacher.fs]. If the
+// [dirFS] is unavailable, opening any file in the returned [fs.FS] fails with
+// the cause.
+func (dc *DirCacher) fsys() fs.FS {
+	fsys, err := dc.fs(false)
+	if err != nil {
+		return errFS{err}
+	}
+	return fsys.ioFS()
+}
+
+// errFS is an [fs.FS] that fails to open any file with its error.
+type errFS struct{ err error }
+
+// Open implements [fs.FS].
+func (efs errFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: efs.err}
+}
+
+// Close releases the resources held by the dc, such as the [os.Root] opened at
+// the dc.Dir if the dc.RestrictSymlinks is true. Close must not be called
+// while other operations on the dc are in progress, but the dc may still be
+// used afterwards, in which case the resources are acquired again.
+func (dc *DirCacher) Close() error {
+	dc.restrictedFSMutex.Lock()
+	defer dc.restrictedFSMutex.Unlock()
+	fsys := dc.restrictedFS
+	dc.restrictedFS = nil
+	if c, ok := fsys.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// dirFS provides the file operations used by [DirCacher]. All names are
+// slash-separated paths relative to the root of the dirFS.
+type dirFS interface {
+	// open opens the named file for reading.
+	open(name string) (*os.File, error)
+
+	// createTemp creates a new temporary file in the dir with a name
+	// generated from the pattern like [os.CreateTemp]. It returns the
+	// opened file and its name.
+	createTemp(dir, pattern string) (*os.File, string, error)
+
+	// create creates the named file for writing. It returns an error that
+	// matches [fs.ErrExist] if the named file exists.
+	create(name string) (*os.File, error)
+
+	// mkdirAll creates the named directory along with any necessary
+	// parents.
+	mkdirAll(name string, perm fs.FileMode) error
+
+	// chmod changes the mode of the named file.
+	chmod(name string, mode fs.FileMode) error
+
+	// chtimes changes the access and modification times of the named file.
+	chtimes(name string, atime, mtime time.Time) error
+
+	// rename renames the oldname to the newname.
+	rename(oldname, newname string) error
+
+	// remove removes the named file.
+	remove(name string) error
+
+	// lstat returns the [fs.FileInfo] of the named file without following
+	// it if it is a symbolic link.
+	lstat(name string) (fs.FileInfo, error)
+
+	// readlink returns the target of the named symbolic link.
+	readlink(name string) (string, error)
+
+	// symlink creates the named file as a symbolic link to the
+	// slash-separated target.
+	symlink(target, name string) error
+
+	// ioFS returns an [fs.FS] of the files in the dirFS, for walking them
+	// with the same restrictions as the other file operations.
+	ioFS() fs.FS
+}
+
+// osDirFS implements [dirFS] using the local disk without any restrictions.
+type osDirFS string
+
+// path returns the local file path for the name.
+func (dir osDirFS) path(name string) string {
+	return filepath.Join(string(dir), filepath.FromSlash(name))
+}
+
+// open implements [dirFS].
+func (dir osDirFS) open(name string) (*os.File, error) { return os.Open(dir.path(name)) }
+
+// createTemp implements [dirFS].
+func (dir osDirFS) createTemp(tempDir, pattern string) (*os.File, string, error) {
+	f, err := os.CreateTemp(dir.path(tempDir), pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, path.Join(tempDir, filepath.Base(f.Name())), nil
+}
 
-	// Put puts a cache for the name with the content.
-	Put(ctx context.Context, name string, content io.ReadSeeker) error
-	// Sync sync upload cache dir to loacl cached dir
-	Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string) error
+// create implements [dirFS].
+func (dir osDirFS) create(name string) (*os.File, error) {
+	return os.OpenFile(dir.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
 }
 
-// DirCacher implements [Cacher] using a directory on the local disk. If the
-// directory does not exist, it will be created with 0755 permissions. Cache
-// files will be created with 0644 permissions.
-type DirCacher string
+// mkdirAll implements [dirFS].
+func (dir osDirFS) mkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(dir.path(name), perm)
+}
+
+// chmod implements [dirFS].
+func (dir osDirFS) chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(dir.path(name), mode)
+}
 
-// Get implements [Cacher].
-func (dc DirCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
-	f, err := os.Open(filepath.Join(string(dc), filepath.FromSlash(name)))
+// chtimes implements [dirFS].
+func (dir osDirFS) chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(dir.path(name), atime, mtime)
+}
+
+// rename implements [dirFS].
+func (dir osDirFS) rename(oldname, newname string) error {
+	return os.Rename(dir.path(oldname), dir.path(newname))
+}
+
+// remove implements [dirFS].
+func (dir osDirFS) remove(name string) error { return os.Remove(dir.path(name)) }
+
+// lstat implements [dirFS].
+func (dir osDirFS) lstat(name string) (fs.FileInfo, error) { return os.Lstat(dir.path(name)) }
+
+// readlink implements [dirFS].
+func (dir osDirFS) readlink(name string) (string, error) { return os.Readlink(dir.path(name)) }
+
+// symlink implements [dirFS].
+func (dir osDirFS) symlink(target, name string) error {
+	return os.Symlink(filepath.FromSlash(target), dir.path(name))
+}
+
+// ioFS implements [dirFS].
+func (dir osDirFS) ioFS() fs.FS { return os.DirFS(string(dir)) }
+
+// defaultTempPattern is the default value of [DirCacher.TempPattern].
+const defaultTempPattern = ".{name}.tmp.*"
+
+// tempNaming is how [DirCacher] places and names the temporary files of cache
+// files (see [DirCacher.TempPattern] and [DirCacher.TempSubdir]).
+type tempNaming struct {
+	pattern string
+	subdir  string
+}
+
+// checkTempSubdir checks whether the dc.TempSubdir stays within the dc.Dir.
+func (dc *DirCacher) checkTempSubdir() error {
+	if dc.TempSubdir == "" {
+		return nil
+	}
+	subdir := path.Clean(dc.TempSubdir)
+	if subdir == "." || !fs.ValidPath(subdir) || strings.Contains(subdir, `\`) || filepath.VolumeName(filepath.FromSlash(subdir)) != "" {
+		return fmt.Errorf("invalid temp subdir %q", dc.TempSubdir)
+	}
+	return nil
+}
+
+// tempNaming returns the [tempNaming] of the dc.
+func (dc *DirCacher) tempNaming() tempNaming {
+	return tempNaming{pattern: dc.TempPattern, subdir: dc.TempSubdir}
+}
+
+// location returns the directory in a [dirFS] and the pattern for
+// [os.CreateTemp] of the temporary file for the named cache file.
+func (tn tempNaming) location(name string) (dir, pattern string) {
+	pattern = tn.pattern
+	if pattern == "" {
+		pattern = defaultTempPattern
+	}
+	pattern = strings.ReplaceAll(pattern, "{name}", path.Base(name))
+	if tn.subdir != "" {
+		return path.Clean(tn.subdir), pattern
+	}
+	return path.Dir(name), pattern
+}
+
+// createTemp creates a new temporary file for the named cache file in the
+// fsys. It returns the opened file and its name.
+func (tn tempNaming) createTemp(fsys dirFS, name string) (*os.File, string, error) {
+	dir, pattern := tn.location(name)
+	if tn.subdir != "" {
+		if err := fsys.mkdirAll(dir, 0o755); err != nil {
+			return nil, "", err
+		}
+	}
+	return fsys.createTemp(dir, pattern)
+}
+
+// writeCacheFile atomically writes the content to the named file in the fsys
+// through a temporary file placed by the tn, using the buf for copying, and
+// sets its modification time to the modTime.
+// The directory of the file must already exist.
+//
+// If keepFailedTemp is true and the write fails, the temporary file is kept
+// and its name is included in the returned error. If fsync is true, the
+// temporary file is synced to the disk before it is renamed into place.
+func writeCacheFile(fsys dirFS, tn tempNaming, name string, content io.Reader, buf []byte, modTime time.Time, keepFailedTemp, fsync bool) error {
+	tempName, err := stageCacheFile(fsys, tn, name, content, buf, modTime, keepFailedTemp, fsync)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	fi, err := f.Stat()
+	return commitCacheFile(fsys, tempName, name, keepFailedTemp)
+}
+
+// stageCacheFile is the first half of [writeCacheFile]. It writes the content
+// to a temporary file for the named file in the fsys as placed by the tn, and
+// returns the name of the temporary file.
+func stageCacheFile(fsys dirFS, tn tempNaming, name string, content io.Reader, buf []byte, modTime time.Time, keepFailedTemp, fsync bool) (_ string, err error) {
+	f, tempName, err := tn.createTemp(fsys, name)
 	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if keepFailedTemp {
+			err = fmt.Errorf("%w (temporary file kept as %s)", err, tempName)
+			return
+		}
+		fsys.remove(tempName)
+	}()
+	// Hide the [io.ReaderFrom] implemented by the f to make sure the buf
+	// is actually used.
+	//
+	// There is no separate path for tiny content such as .info and .mod
+	// files: content that fits in the buf is already written with a single
+	// write, the chmod is needed as the temporary file is created with mode
+	// 0600, and a file created with O_TMPFILE cannot be linked over an
+	// existing one, so it would still need a rename.
+	if _, err := io.CopyBuffer(struct{ io.Writer }{f}, content, buf); err != nil {
 		f.Close()
-		return nil, err
+		return "", err
 	}
-	return &struct {
-		*os.File
-		os.FileInfo
-	}{f, fi}, nil
+	if fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	if err := fsys.chtimes(tempName, modTime, modTime); err != nil {
+		return "", err
+	}
+	if err := fsys.chmod(tempName, 0o644); err != nil {
+		return "", err
+	}
+	return tempName, nil
 }
 
-// Put implements [Cacher].
-func (dc DirCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
-	file := filepath.Join(string(dc), filepath.FromSlash(name))
-	dir := filepath.Dir(file)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+// commitCacheFile is the second half of [writeCacheFile]. It renames the
+// temporary file staged by [stageCacheFile] to the named file in the fsys.
+func commitCacheFile(fsys dirFS, tempName, name string, keepFailedTemp bool) error {
+	if err := fsys.rename(tempName, name); err != nil {
+		if keepFailedTemp {
+			return fmt.Errorf("%w (temporary file kept as %s)", err, tempName)
+		}
+		fsys.remove(tempName)
 		return err
 	}
+	return nil
+}
+
+// verifyingReader is an [io.Reader] that verifies the content read from the
+// underlying reader against a [VerifyInfo]. It returns an error that matches
+// [ErrContentMismatch] instead of [io.EOF] if the content does not match, or
+// one that matches [ErrSizeMismatch] as soon as the content exceeds the
+// expected size. A negative size is not verified.
+type verifyingReader struct {
+	r        io.Reader
+	size     int64
+	wantSum  []byte
+	hashName string
+	hash     hash.Hash
+	n        int64
+}
+
+// sizeVerifyingReader returns the content wrapped in a [verifyingReader] that
+// verifies its size if the content implements [Sizer], or the content as it is
+// otherwise. If the content also implements [io.Seeker], the size is verified
+// from its current offset, as the content may have been partially read.
+func sizeVerifyingReader(content io.Reader) io.Reader {
+	s, ok := content.(Sizer)
+	if !ok {
+		return content
+	}
+	size := s.Size()
+	if seeker, ok := content.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return content
+		}
+		size -= offset
+	}
+	return &verifyingReader{r: content, size: size}
+}
+
+// newVerifyingReader returns a new [verifyingReader] for the r and expect. The
+// lookup returns the hash function named in the [VerifyInfo.Digest], or nil if
+// there is no such hash function.
+func newVerifyingReader(r io.Reader, expect VerifyInfo, lookup func(name string) func() hash.Hash) (*verifyingReader, error) {
+	vr := &verifyingReader{r: r, size: expect.Size}
+	if vr.size == 0 {
+		vr.size = -1
+	}
+	switch {
+	case expect.SHA256 != "" && expect.Digest != "":
+		return nil, errors.New("only one of SHA256 and Digest can be set")
+	case expect.SHA256 != "":
+		wantSum, err := hex.DecodeString(expect.SHA256)
+		if err != nil || len(wantSum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 hash %q", expect.SHA256)
+		}
+		vr.wantSum = wantSum
+		vr.hashName = "SHA-256"
+		vr.hash = sha256.New()
+	case expect.Digest != "":
+		name, newHash, wantSum, err := parseDigest(expect.Digest, lookup)
+		if err != nil {
+			return nil, err
+		}
+		vr.wantSum = wantSum
+		vr.hashName = name
+		vr.hash = newHash()
+	}
+	return vr, nil
+}
+
+// Read implements [io.Reader].
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.n += int64(n)
+	if vr.hash != nil {
+		vr.hash.Write(p[:n])
+	}
+	if vr.size >= 0 && vr.n > vr.size {
+		return n, sizeMismatchErrorf("size exceeds %d bytes", vr.size)
+	}
+	if err == io.EOF {
+		if vr.size >= 0 && vr.n != vr.size {
+			return n, sizeMismatchErrorf("got size %d, want %d", vr.n, vr.size)
+		}
+		if vr.hash != nil {
+			if sum := vr.hash.Sum(nil); !bytes.Equal(sum, vr.wantSum) {
+				return n, fmt.Errorf("%w: got %s %x, want %x", ErrContentMismatch, vr.hashName, sum, vr.wantSum)
+			}
+		}
+	}
+	return n, err
+}
 
-	f, err := os.CreateTemp(dir, fmt.Sprintf(".%s.tmp.*", filepath.Base(file)))
+// writeCacheFileDirect is like [writeCacheFile] but writes the content directly
+// to the named file, which is removed if the write fails. It returns an error
+// that matches [fs.ErrExist] without reading the content if the named file
+// exists, which is never touched.
+func writeCacheFileDirect(fsys dirFS, name string, content io.Reader, buf []byte, modTime time.Time) (err error) {
+	f, err := fsys.create(name)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(f.Name())
-	if _, err := io.Copy(f, content); err != nil {
+	defer func() {
+		if err != nil {
+			fsys.remove(name)
+		}
+	}()
+	// Hide the [io.ReaderFrom] implemented by the f to make sure the buf
+	// is actually used.
+	if _, err := io.CopyBuffer(struct{ io.Writer }{f}, content, buf); err != nil {
+		f.Close()
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
 
-	if err := os.Chmod(f.Name(), 0o644); err != nil {
+	if err := fsys.chtimes(name, modTime, modTime); err != nil {
 		return err
 	}
-	return os.Rename(f.Name(), file)
+	return fsys.chmod(name, 0o644)
 }
 
-func (dc DirCacher) putNoSeeker(_ context.Context, name string, content io.Reader) error {
-	file := filepath.Join(string(dc), filepath.FromSlash(name))
-	dir := filepath.Dir(file)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+// SyncFromDir imports the cache files from the srcDir, which must be laid out
+// in the same way as a bundle for [DirCacher.Sync] (e.g., the
+// "$GOMODCACHE/cache/download" directory). Only regular files are imported.
+// Files for which [DirCacher.Skip] reports true and files within hidden
+// directories or with hidden names (i.e., starting with ".", such as
+// temporary files) are skipped.
+//
+// If opts.Hardlink is true, files are hard linked into the dc.Dir instead of
+// being copied where possible. Hard linking is not used when
+// [DirCacher.RestrictSymlinks] is true.
+func (dc *DirCacher) SyncFromDir(ctx context.Context, srcDir string, opts SyncOptions) error {
+	if opts.Exclusive {
+		unlock, err := dc.lockSync(ctx, opts.MaxQueued)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	var result SyncResult
+	if err := filepath.WalkDir(srcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if err := opts.checkPathDepth(name); err != nil {
+			return err
+		}
+		if dc.skip(name) || opts.skipName(name) {
+			result.Skipped++
+			return nil
+		}
+		if err := opts.checkFileCount(result.Files); err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if opts.Hardlink && !dc.RestrictSymlinks {
+			if err := dc.link(name, p); err == nil {
+				result.Files++
+				result.Bytes += fi.Size()
+				return nil
+			}
+		}
+		if opts.MinFreeBytes > 0 {
+			if err := dc.checkFreeSpace(name, fi.Size(), opts.MinFreeBytes); err != nil {
+				return err
+			}
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := dc.put(ctx, name, f); err != nil {
+			return err
+		}
+		result.Files++
+		result.Bytes += fi.Size()
+		return nil
+	}); err != nil {
 		return err
 	}
+	return opts.complete(ctx, result)
+}
 
-	f, err := os.CreateTemp(dir, fmt.Sprintf(".%s.tmp.*", filepath.Base(file)))
+// link hard links the src file to the name in the dc.Dir, replacing any
+// existing file there.
+func (dc *DirCacher) link(name, src string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	if err := dc.checkHashDirLevels(); err != nil {
+		return err
+	}
+	name = dc.fileName(name)
+	fsys := osDirFS(dc.Dir)
+	if err := fsys.mkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	f, tempName, err := dc.tempNaming().createTemp(fsys, name)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(f.Name())
-	if _, err := io.Copy(f, content); err != nil {
+	f.Close()
+	if err := fsys.remove(tempName); err != nil {
 		return err
 	}
-	if err := f.Close(); err != nil {
+	if err := os.Link(src, fsys.path(tempName)); err != nil {
+		return err
+	}
+	if dc.DetectCaseCollisions {
+		if err := checkCaseCollision(fsys, name); err != nil {
+			fsys.remove(tempName)
+			return err
+		}
+	}
+	if err := fsys.rename(tempName, name); err != nil {
+		fsys.remove(tempName)
+		return err
+	}
+	return nil
+}
+
+// checkFreeSpace checks whether writing size bytes for the name would leave
+// at least minFree bytes available on the filesystem of the dc.Dir.
+func (dc *DirCacher) checkFreeSpace(name string, size, minFree int64) error {
+	if err := os.MkdirAll(dc.Dir, 0o755); err != nil {
 		return err
 	}
+	free, err := freeSpace(dc.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to get available disk space: %w", err)
+	}
+	if free-size < minFree {
+		return fmt.Errorf("%w: writing %s (%d bytes) would leave %d of %d required bytes available", ErrInsufficientSpace, name, size, free-size, minFree)
+	}
+	return nil
+}
+
+// writeTarFile writes the content to the tw as a regular file with the name.
+// The size of the content is determined by [Sizer] or [io.Seeker] if
+// possible. Otherwise, the content is buffered by the cb first. The
+// modification time of the file is taken from the content in the same way as
+// [Cacher.Get] describes, falling back to the current time.
+func writeTarFile(tw *tar.Writer, cb contentBuffer, name string, content io.Reader) error {
+	modTime := time.Now()
+	if lm, ok := content.(interface{ LastModified() time.Time }); ok {
+		modTime = lm.LastModified()
+	} else if mt, ok := content.(interface{ ModTime() time.Time }); ok {
+		modTime = mt.ModTime()
+	}
+
+	var size int64
+	if rs, ok := content.(io.ReadSeeker); ok {
+		var err error
+		if size, err = ContentSize(rs); err != nil {
+			return err
+		}
+	} else if s, ok := content.(Sizer); ok {
+		size = s.Size()
+	} else {
+		rs, release, err := cb.buffer(content)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if size, err = ContentSize(rs); err != nil {
+			return err
+		}
+		content = rs
+	}
 
-	if err := os.Chmod(f.Name(), 0o644); err != nil {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  modTime,
+	}); err != nil {
 		return err
 	}
-	return os.Rename(f.Name(), file)
+	_, err := io.Copy(tw, content)
+	return err
+}
+
+// writeTarSymlink writes a symbolic link with the name to the target to the
+// tw.
+func writeTarSymlink(tw *tar.Writer, name, target string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0o777,
+		ModTime:  time.Now(),
+	})
+}
+
+// contentBuffer buffers content whose size is unknown into an
+// [io.ReadSeeker], in memory up to maxMemory bytes and in a temporary file in
+// tempDir beyond that.
+type contentBuffer struct {
+	maxMemory int64
+	tempDir   string
+}
+
+// buffer reads the content into an [io.ReadSeeker] positioned at its start.
+// The returned function must be called once the [io.ReadSeeker] is no longer
+// needed, so that its temporary file, if any, is removed.
+func (cb contentBuffer) buffer(content io.Reader) (io.ReadSeeker, func(), error) {
+	var b bytes.Buffer
+	if cb.maxMemory > 0 {
+		if _, err := io.Copy(&b, io.LimitReader(content, cb.maxMemory+1)); err != nil {
+			return nil, nil, err
+		}
+		if int64(b.Len()) <= cb.maxMemory {
+			return bytes.NewReader(b.Bytes()), func() {}, nil
+		}
+	}
+
+	f, err := os.CreateTemp(cb.tempDir, tempDirPattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, io.MultiReader(&b, content)); err != nil {
+		release()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return f, release, nil
+}
+
+// syncLockFile is the name of the lock file that [DirCacher.Sync] holds during
+// exclusive imports.
+const syncLockFile = ".goproxy-sync.lock"
+
+// lockSync acquires the lock for an exclusive import. If the lock is already
+// held within the process, it waits for the lock until the ctx is done if
+// fewer than maxQueued others are waiting, or returns [ErrSyncQueueFull]
+// otherwise. It returns [ErrSyncInProgress] if the lock is held by another
+// process, or within the process if the maxQueued is not positive. The
+// returned function releases the lock.
+func (dc *DirCacher) lockSync(ctx context.Context, maxQueued int) (func(), error) {
+	dc.syncSemaphoreOnce.Do(func() { dc.syncSemaphore = make(chan struct{}, 1) })
+	select {
+	case dc.syncSemaphore <- struct{}{}:
+	default:
+		if err := dc.waitSync(ctx, maxQueued); err != nil {
+			return nil, err
+		}
+	}
+	release := func() { <-dc.syncSemaphore }
+	if err := os.MkdirAll(dc.Dir, 0o755); err != nil {
+		release()
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dc.Dir, syncLockFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if locked, err := tryLockFile(f); err != nil || !locked {
+		f.Close()
+		release()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrSyncInProgress
+	}
+	return func() {
+		f.Close() // Closing the file also releases the lock on it.
+		release()
+	}, nil
+}
+
+// waitSync waits in the queue of exclusive imports for the in-process lock
+// acquired by [DirCacher.lockSync], and acquires it.
+func (dc *DirCacher) waitSync(ctx context.Context, maxQueued int) error {
+	if maxQueued <= 0 {
+		return ErrSyncInProgress
+	}
+	dc.syncQueueMutex.Lock()
+	if dc.syncQueued >= maxQueued {
+		dc.syncQueueMutex.Unlock()
+		return ErrSyncQueueFull
+	}
+	dc.syncQueued++
+	dc.syncQueueMutex.Unlock()
+	defer func() {
+		dc.syncQueueMutex.Lock()
+		dc.syncQueued--
+		dc.syncQueueMutex.Unlock()
+	}()
+	select {
+	case dc.syncSemaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Sync sync upload cache dir to loacl cached dir
-func (dc DirCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string) (err error) {
-	switch compressType {
+//
+// Symbolic links in the bundle (see [ExportOptions.DereferenceSymlinks]) are
+// skipped unless the opts.ImportSymlinks is true. Files are never written
+// through symbolic links in the dc.Dir, so an import that would do so is
+// aborted with an error that matches [ErrUnsafeSymlink].
+func (dc *DirCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) (err error) {
+	if key := opts.DedupKey; key != "" {
+		opts.DedupKey = ""
+		return dc.syncGroup.doInline(ctx, key, func(ctx context.Context) error {
+			return dc.Sync(ctx, uploadCacheDirReader, compressType, opts)
+		})
+	}
+	if opts.Exclusive {
+		unlock, err := dc.lockSync(ctx, opts.MaxQueued)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	uploadCacheDirReader, release, err := opts.verifyBundle(uploadCacheDirReader)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	switch compressType = opts.compressType(compressType); compressType {
 	case "application/gzip":
-		gzipReader, err := gzip.NewReader(uploadCacheDirReader)
+		gzipReader, err := opts.gunzip(uploadCacheDirReader)
 		if err != nil {
 			return err
 		}
@@ -123,9 +2657,31 @@ func (dc DirCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, co
 		uploadCacheDirReader = gzipReader
 		fallthrough
 	case "application/x-tar":
+		var staging *syncStaging
+		if opts.Staged {
+			if opts.Checkpoint != "" {
+				return errors.New("staged imports cannot be checkpointed")
+			}
+			if staging, err = dc.newSyncStaging(); err != nil {
+				return err
+			}
+			defer staging.discard()
+		}
+		var cp *syncCheckpoint
+		cp, err = newSyncCheckpoint(opts)
+		if err != nil {
+			return err
+		}
+		defer func() { err = cp.close(err) }()
 		tarReader := tar.NewReader(uploadCacheDirReader)
+		var result SyncResult
+		seen := map[string]struct{}{}
+		zv := newSyncZipHashVerifier(opts)
 		// 遍历tar文件中的每个文件并解压到目标目录
-		for {
+		for index := 0; ; index++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			header, err := tarReader.Next()
 			if err == io.EOF {
 				break // 结束循环
@@ -133,15 +2689,94 @@ func (dc DirCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, co
 			if err != nil {
 				return err
 			}
-			if header.FileInfo().IsDir() || strings.HasSuffix(header.Name, ".lock") {
+			if skip, err := cp.skip(index, header.Name); err != nil {
+				return err
+			} else if skip {
+				if !header.FileInfo().IsDir() {
+					result.Skipped++
+				}
+				continue
+			}
+			if header.FileInfo().IsDir() {
+				if err := cp.done(index, header.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			name := path.Clean(header.Name)
+			if err := opts.checkPathDepth(name); err != nil {
+				return err
+			}
+			if dc.skip(name) || opts.skipName(name) {
+				result.Skipped++
+				if err := cp.done(index, header.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			if skip, err := opts.checkDuplicate(seen, name); err != nil {
+				return err
+			} else if skip {
+				result.Skipped++
+				if err := cp.done(index, header.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := opts.checkFileCount(result.Files); err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeSymlink {
+				if opts.skipSymlink(name) {
+					result.Skipped++
+					if err := cp.done(index, header.Name); err != nil {
+						return err
+					}
+					continue
+				}
+				if staging != nil {
+					err = staging.stageSymlink(name, header.Linkname)
+				} else {
+					err = dc.symlink(name, header.Linkname)
+				}
+				if err != nil {
+					return err
+				}
+				result.Files++
+				if err := cp.done(index, header.Name); err != nil {
+					return err
+				}
 				continue
 			}
-			err = dc.putNoSeeker(ctx, header.Name, tarReader)
+			if opts.MinFreeBytes > 0 {
+				if err := dc.checkFreeSpace(name, header.Size, opts.MinFreeBytes); err != nil {
+					return err
+				}
+			}
+			content, done, err := zv.reader(name, tarReader)
 			if err != nil {
 				return err
 			}
+			if staging != nil {
+				err = staging.stage(name, content)
+			} else if err = dc.checkSymlinkParents(name); err == nil {
+				err = dc.put(ctx, name, content)
+			}
+			if err := done(err); err != nil {
+				return err
+			}
+			result.Files++
+			result.Bytes += header.Size
+			if err := cp.done(index, header.Name); err != nil {
+				return err
+			}
 		}
-		return nil
+		if staging != nil {
+			if err := staging.publish(ctx); err != nil {
+				return err
+			}
+		}
+		return opts.complete(ctx, zv.result(result))
 	}
-	return fmt.Errorf("not support %s type cached dir", compressType)
+	return unsupportedCompressionError(compressType)
 }
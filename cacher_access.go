@@ -0,0 +1,144 @@
+package goproxy
+
+import (
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessTrackerShards is the number of shards of an [accessTracker].
+const accessTrackerShards = 32
+
+// accessTracker tracks the order and frequency in which names are accessed, in
+// memory. It is optimized for frequent accesses and infrequent queries:
+// recording an access only stamps the name with a logical clock and counts it
+// under the lock of its shard, and the order is only computed when queried.
+// The zero value is ready to use.
+type accessTracker struct {
+	clock  uint64
+	shards [accessTrackerShards]accessTrackerShard
+}
+
+// accessTrackerShard is a shard of an [accessTracker].
+type accessTrackerShard struct {
+	mu      sync.Mutex
+	entries map[string]accessEntry
+}
+
+// accessEntry is the tracked accesses to a name.
+type accessEntry struct {
+	stamp      uint64
+	hits       int64
+	lastAccess time.Time
+}
+
+// shard returns the shard for the name.
+func (at *accessTracker) shard(name string) *accessTrackerShard {
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	return &at.shards[h.Sum32()%accessTrackerShards]
+}
+
+// touch records an access to the name at the now. The access counts as a hit
+// if the hit is true.
+func (at *accessTracker) touch(name string, hit bool, now time.Time) {
+	stamp := atomic.AddUint64(&at.clock, 1)
+	s := at.shard(name)
+	s.mu.Lock()
+	if s.entries == nil {
+		s.entries = map[string]accessEntry{}
+	}
+	e := s.entries[name]
+	if stamp > e.stamp {
+		e.stamp = stamp
+		e.lastAccess = now
+	}
+	if hit {
+		e.hits++
+	}
+	s.entries[name] = e
+	s.mu.Unlock()
+}
+
+// forget stops tracking the name.
+func (at *accessTracker) forget(name string) {
+	s := at.shard(name)
+	s.mu.Lock()
+	delete(s.entries, name)
+	s.mu.Unlock()
+}
+
+// trackedAccess is a tracked name with its accesses.
+type trackedAccess struct {
+	name string
+	accessEntry
+}
+
+// tracked returns all tracked names with their accesses, in no particular
+// order.
+func (at *accessTracker) tracked() []trackedAccess {
+	var accesses []trackedAccess
+	for i := range at.shards {
+		s := &at.shards[i]
+		s.mu.Lock()
+		for name, e := range s.entries {
+			accesses = append(accesses, trackedAccess{name, e})
+		}
+		s.mu.Unlock()
+	}
+	return accesses
+}
+
+// leastRecentlyUsed returns up to n tracked names, ordered from the least
+// recently accessed to the most recently accessed. If n is negative, all
+// tracked names are returned.
+func (at *accessTracker) leastRecentlyUsed(n int) []string {
+	accesses := at.tracked()
+	sort.Slice(accesses, func(i, j int) bool { return accesses[i].stamp < accesses[j].stamp })
+	if n >= 0 && n < len(accesses) {
+		accesses = accesses[:n]
+	}
+	names := make([]string, len(accesses))
+	for i, a := range accesses {
+		names[i] = a.name
+	}
+	return names
+}
+
+// EntryStat is the tracked accesses to a cache file, as returned by
+// [DirCacher.TopEntries].
+type EntryStat struct {
+	// Name is the name of the cache file.
+	Name string
+
+	// Hits is the number of times the cache file has been got.
+	Hits int64
+
+	// LastAccess is the time the cache file was last got or put.
+	LastAccess time.Time
+}
+
+// mostFrequentlyUsed returns the stats of up to n tracked names, ordered from
+// the most frequently hit to the least frequently hit, with ties broken by
+// putting the more recently accessed first. If n is negative, the stats of all
+// tracked names are returned.
+func (at *accessTracker) mostFrequentlyUsed(n int) []EntryStat {
+	accesses := at.tracked()
+	sort.Slice(accesses, func(i, j int) bool {
+		if accesses[i].hits != accesses[j].hits {
+			return accesses[i].hits > accesses[j].hits
+		}
+		return accesses[i].stamp > accesses[j].stamp
+	})
+	if n >= 0 && n < len(accesses) {
+		accesses = accesses[:n]
+	}
+	stats := make([]EntryStat, len(accesses))
+	for i, a := range accesses {
+		stats[i] = EntryStat{Name: a.name, Hits: a.hits, LastAccess: a.lastAccess}
+	}
+	return stats
+}
@@ -0,0 +1,154 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CompactionOptions are the options for [DirCacher.ReportCompaction].
+type CompactionOptions struct {
+	// MaxDirEntries is the number of entries in a directory above which it
+	// is reported as over-full.
+	//
+	// If MaxDirEntries is zero, 10000 is used.
+	MaxDirEntries int
+
+	// SmallFileSize is the size in bytes at or below which a file is
+	// counted as small.
+	//
+	// If SmallFileSize is zero, 4096 (a common file system block size) is
+	// used.
+	SmallFileSize int64
+}
+
+// CompactionReport is the report returned by [DirCacher.ReportCompaction].
+type CompactionReport struct {
+	// Dirs is the number of directories walked, including the root.
+	Dirs int
+
+	// Files is the number of files walked.
+	Files int
+
+	// SmallFiles is the number of files not larger than the
+	// [CompactionOptions.SmallFileSize].
+	SmallFiles int
+
+	// SmallFilesSize is the total size in bytes of the SmallFiles.
+	SmallFilesSize int64
+
+	// OverfullDirs are the directories with more entries than the
+	// [CompactionOptions.MaxDirEntries], sorted by their numbers of entries
+	// in descending order and then by their names.
+	OverfullDirs []OverfullDir
+}
+
+// OverfullDir is a directory reported in [CompactionReport.OverfullDirs].
+type OverfullDir struct {
+	// Dir is the slash-separated path of the directory relative to the
+	// [DirCacher.Dir] (e.g., "github.com" or "example.com/@v").
+	Dir string
+
+	// Entries is the number of files and directories in the Dir.
+	Entries int
+
+	// SmallFiles is the number of small files in the Dir.
+	SmallFiles int
+
+	// Suggestion is a human-readable suggestion for reducing the Entries.
+	Suggestion string
+}
+
+// ReportCompaction walks the dc.Dir and reports how its files are spread
+// across directories, so that operators can tell whether the many small files
+// that a module cache accumulates (e.g., .info and .mod files) are putting
+// pressure on the inodes or slowing down directory scans, and plan for it. As
+// with [DirCacher.List], hidden files and directories are skipped.
+//
+// ReportCompaction only reports. It never modifies the dc.Dir.
+func (dc *DirCacher) ReportCompaction(ctx context.Context, opts CompactionOptions) (*CompactionReport, error) {
+	maxDirEntries := opts.MaxDirEntries
+	if maxDirEntries == 0 {
+		maxDirEntries = 10000
+	}
+	smallFileSize := opts.SmallFileSize
+	if smallFileSize == 0 {
+		smallFileSize = 4096
+	}
+
+	report := &CompactionReport{}
+	dirs := map[string]*OverfullDir{}
+	err := fs.WalkDir(dc.fsys(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if name != "." {
+			parent := dirs[path.Dir(name)]
+			parent.Entries++
+			if !d.IsDir() {
+				report.Files++
+				fi, err := d.Info()
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						return nil
+					}
+					return err
+				}
+				if fi.Size() <= smallFileSize {
+					parent.SmallFiles++
+					report.SmallFiles++
+					report.SmallFilesSize += fi.Size()
+				}
+			}
+		}
+		if d.IsDir() {
+			report.Dirs++
+			dirs[name] = &OverfullDir{Dir: name}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if dir.Entries > maxDirEntries {
+			dir.Suggestion = compactionSuggestion(dir)
+			report.OverfullDirs = append(report.OverfullDirs, *dir)
+		}
+	}
+	sort.Slice(report.OverfullDirs, func(i, j int) bool {
+		di, dj := report.OverfullDirs[i], report.OverfullDirs[j]
+		if di.Entries != dj.Entries {
+			return di.Entries > dj.Entries
+		}
+		return di.Dir < dj.Dir
+	})
+	return report, nil
+}
+
+// compactionSuggestion returns the [OverfullDir.Suggestion] for the dir.
+func compactionSuggestion(dir *OverfullDir) string {
+	if dir.Dir == "@v" || strings.HasSuffix(dir.Dir, "/@v") {
+		if 2*dir.SmallFiles > dir.Entries {
+			return "many versions of this module are cached; delete unused versions (e.g., with the admin API) to reduce the small .info and .mod files"
+		}
+		return "many versions of this module are cached; delete unused versions (e.g., with the admin API)"
+	}
+	return "many modules share this directory; spread the caches across several DirCachers (e.g., with NewShardedCacher)"
+}
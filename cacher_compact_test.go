@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirCacherReportCompaction(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	for name, content := range map[string]string{
+		"example.com/a/@v/list":        "v1.0.0\nv1.1.0",
+		"example.com/a/@v/v1.0.0.info": "{}",
+		"example.com/a/@v/v1.0.0.mod":  "module example.com/a",
+		"example.com/a/@v/v1.1.0.info": "{}",
+		"example.com/a/@v/v1.1.0.mod":  "module example.com/a",
+		"example.com/a/@v/v1.1.0.zip":  strings.Repeat("z", 100),
+		"example.com/b/@v/list":        "v1.0.0",
+		"example.com/c/@v/list":        "v1.0.0",
+		"example.com/d/@latest":        "{}",
+	} {
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dirCacher.Dir, "example.com", "a", "@v", ".v1.2.0.zip.tmp.1"), []byte("tmp"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	report, err := dirCacher.ReportCompaction(context.Background(), CompactionOptions{MaxDirEntries: 3, SmallFileSize: 50})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := report.Dirs, 9; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := report.Files, 9; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := report.SmallFiles, 8; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := report.SmallFilesSize, int64(13+2+20+2+20+6+6+2); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := len(report.OverfullDirs), 2; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	for i, want := range []OverfullDir{
+		{
+			Dir:        "example.com/a/@v",
+			Entries:    6,
+			SmallFiles: 5,
+			Suggestion: "many versions of this module are cached; delete unused versions (e.g., with the admin API) to reduce the small .info and .mod files",
+		},
+		{
+			Dir:        "example.com",
+			Entries:    4,
+			Suggestion: "many modules share this directory; spread the caches across several DirCachers (e.g., with NewShardedCacher)",
+		},
+	} {
+		if got := report.OverfullDirs[i]; got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	if report, err := dirCacher.ReportCompaction(context.Background(), CompactionOptions{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got := report.OverfullDirs; len(got) != 0 {
+		t.Errorf("got %+v, want none", got)
+	}
+
+	dirCacher = &DirCacher{Dir: filepath.Join(t.TempDir(), "missing")}
+	if report, err := dirCacher.ReportCompaction(context.Background(), CompactionOptions{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := report.Files, 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dirCacher = &DirCacher{Dir: t.TempDir()}
+	if _, err := dirCacher.ReportCompaction(ctx, CompactionOptions{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,129 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Evict deletes up to n cache files whose accesses have been tracked (see
+// [DirCacher.TrackAccess]), starting from the least recently accessed one, and
+// returns their names, which is never nil. Cache files protected by the
+// dc.Protect or the dc.ProtectLatestVersions are never deleted and do not
+// count toward the n. If n is negative, all unprotected tracked cache files
+// are deleted.
+//
+// Evictions made directly through Evict are not audited. Use [Goproxy.Evict]
+// to report them to the [Goproxy.OnCacheMutation].
+func (dc *DirCacher) Evict(ctx context.Context, n int) ([]string, error) {
+	evicted := []string{}
+	var latest map[string]string
+	if dc.ProtectLatestVersions {
+		var err error
+		if latest, err = dc.latestVersions(ctx); err != nil {
+			return evicted, err
+		}
+	}
+	for _, name := range dc.LeastRecentlyUsed(-1) {
+		if n >= 0 && len(evicted) >= n {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return evicted, err
+		}
+		if dir, version, ok := cachedModuleVersion(name); ok && latest[dir] == version {
+			continue
+		}
+		if dc.Protect != nil && dc.Protect(name) {
+			continue
+		}
+		if err := dc.Delete(ctx, name); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, name)
+	}
+	return evicted, nil
+}
+
+// Evict evicts up to n cache files from the g.Cacher, which must have an Evict
+// method like [DirCacher.Evict], and returns their names, which is never nil.
+// Each evicted cache file is reported to the g.OnCacheMutation as a "delete"
+// event, including those evicted before an error.
+func (g *Goproxy) Evict(ctx context.Context, n int) ([]string, error) {
+	g.initOnce.Do(g.init)
+	evicter, ok := g.Cacher.(interface {
+		Evict(ctx context.Context, n int) ([]string, error)
+	})
+	if !ok {
+		return []string{}, errors.New("cacher does not support eviction")
+	}
+	evicted, err := evicter.Evict(ctx, n)
+	for _, name := range evicted {
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "delete", Name: name})
+	}
+	if evicted == nil {
+		evicted = []string{}
+	}
+	return evicted, err
+}
+
+// latestVersions returns the latest cached version of each module in the dc
+// (see [DirCacher.ProtectLatestVersions]), keyed by the directory of its
+// module files (e.g., "example.com/@v/").
+func (dc *DirCacher) latestVersions(ctx context.Context) (map[string]string, error) {
+	names, err := dc.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]string{}
+	for _, name := range names {
+		dir, version, ok := cachedModuleVersion(name)
+		if !ok {
+			continue
+		}
+		if v, ok := latest[dir]; !ok || versionRank(version) > versionRank(v) ||
+			versionRank(version) == versionRank(v) && semver.Compare(version, v) > 0 {
+			latest[dir] = version
+		}
+	}
+	return latest, nil
+}
+
+// versionRank returns the rank of the version for finding the latest version,
+// which prefers release versions to pre-release versions, and pre-release
+// versions to pseudo-versions.
+func versionRank(version string) int {
+	switch {
+	case module.IsPseudoVersion(version):
+		return 0
+	case semver.Prerelease(version) != "":
+		return 1
+	}
+	return 2
+}
+
+// cachedModuleVersion returns the directory (e.g., "example.com/@v/") and the
+// unescaped semantic version of the named cache file of a module file. It
+// returns false if the named cache file is not a module file.
+func cachedModuleVersion(name string) (dir, version string, ok bool) {
+	i := strings.LastIndex(name, "/@v/")
+	if i < 0 {
+		return "", "", false
+	}
+	dir, file := name[:i+len("/@v/")], name[i+len("/@v/"):]
+	ext := path.Ext(file)
+	switch ext {
+	case ".info", ".mod", ".zip", ".ziphash":
+	default:
+		return "", "", false
+	}
+	version, err := module.UnescapeVersion(strings.TrimSuffix(file, ext))
+	if err != nil || !semver.IsValid(version) {
+		return "", "", false
+	}
+	return dir, version, true
+}
@@ -0,0 +1,142 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirCacherEvict(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		protect     bool
+		limit       int
+		wantEvicted []string
+	}{
+		{1, false, 3, []string{
+			"example.com/foo/@v/v1.0.0.info",
+			"example.com/foo/@v/v1.0.0.mod",
+			"example.com/foo/@v/v1.1.0.info",
+		}},
+		{2, true, 3, []string{
+			"example.com/foo/@v/v1.0.0.info",
+			"example.com/foo/@v/v1.0.0.mod",
+			"example.com/bar/@v/v1.0.0.info",
+		}},
+		{3, true, -1, []string{
+			"example.com/foo/@v/v1.0.0.info",
+			"example.com/foo/@v/v1.0.0.mod",
+			"example.com/bar/@v/v1.0.0.info",
+			"example.com/bar/@v/v1.0.0-beta.info",
+			"example.com/foo/@v/v1.1.0-rc.1.info",
+			"example.com/foo/@v/list",
+		}},
+		{4, true, 0, []string{}},
+	} {
+		var now time.Time
+		dirCacher := &DirCacher{
+			Dir:         t.TempDir(),
+			TrackAccess: true,
+			nowFunc:     func() time.Time { return now },
+		}
+		dirCacher.ProtectLatestVersions = tt.protect
+		names := []string{
+			"example.com/foo/@v/v1.0.0.info",
+			"example.com/foo/@v/v1.0.0.mod",
+			"example.com/foo/@v/v1.1.0.info",
+			"example.com/foo/@v/v1.1.0.mod",
+			"example.com/bar/@v/v1.0.0.info",
+			"example.com/bar/@v/v1.0.0-beta.info",
+			"example.com/bar/@v/v1.2.0.info",
+			"example.com/bar/@v/v1.2.0.ziphash",
+			"example.com/foo/@v/v1.1.0-rc.1.info",
+			"example.com/foo/@v/list",
+		}
+		for i, name := range names {
+			now = time.Date(2000, 1, 1, 0, 0, i, 0, time.UTC)
+			if err := dirCacher.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		evicted, err := dirCacher.Evict(context.Background(), tt.limit)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := evicted, tt.wantEvicted; !reflect.DeepEqual(got, want) {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		for _, name := range names {
+			want := true
+			for _, evictedName := range tt.wantEvicted {
+				if name == evictedName {
+					want = false
+				}
+			}
+			rc, err := dirCacher.Get(context.Background(), name)
+			if err == nil {
+				rc.Close()
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got := err == nil; got != want {
+				t.Errorf("test(%d): %s: got %t, want %t", tt.n, name, got, want)
+			}
+		}
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir(), TrackAccess: true}
+	if err := dirCacher.Put(context.Background(), "example.com/@v/v1.0.0.info", strings.NewReader("{}")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dirCacher.Evict(ctx, -1); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !errors.Is(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherLatestVersions(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	for _, name := range []string{
+		"example.com/foo/@v/v1.0.0.info",
+		"example.com/foo/@v/v1.10.0.mod",
+		"example.com/foo/@v/v1.9.0.zip",
+		"example.com/foo/@v/v1.11.0-rc.1.info",
+		"example.com/foo/@v/v1.11.1-0.20000101000000-abcdefabcdef.info",
+		"example.com/foo/@v/list",
+		"example.com/foo/@latest",
+		"example.com/foo/@v/master.info",
+		"example.com/foo/bar/@v/v2.0.0-beta.info",
+		"example.com/foo/bar/@v/v2.0.0-alpha.info",
+		"example.com/foo/bar/@v/v2.0.1-0.20000101000000-abcdefabcdef.info",
+		"example.com/!foo/@v/v0.0.0-20000101000000-abcdefabcdef.info",
+		"example.com/!foo/@v/v0.0.0-20010101000000-abcdefabcdef.info",
+	} {
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	latest, err := dirCacher.latestVersions(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := latest, map[string]string{
+		"example.com/foo/@v/":     "v1.10.0",
+		"example.com/foo/bar/@v/": "v2.0.0-beta",
+		"example.com/!foo/@v/":    "v0.0.0-20010101000000-abcdefabcdef",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dirCacher.latestVersions(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,348 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FlatKeyMapper maps slash-separated cache names to flat keys and back, for
+// [Cacher] implementations backed by key-value stores that work poorly with
+// deep "/"-separated keys (e.g., object storages and Redis).
+//
+// A key is built by replacing each "/" in a name with the Separator, after
+// percent-encoding any "%" and Separator already in the name, so that the
+// mapping is bijective and the original name can always be recovered (e.g.,
+// for listing caches).
+//
+// Object storages often partition keys by their prefixes and throttle
+// requests to the same partition (e.g., Amazon S3 limits the request rate
+// per prefix). Since the names of all caches of a module share the same
+// prefix, fetching a popular module can then turn its partition into a hot
+// spot. Setting HashPrefixLength spreads the keys evenly across partitions
+// by prefixing them with a part of the hash of their names.
+type FlatKeyMapper struct {
+	// Separator is the character that replaces each "/" in cache names. It
+	// must be a single ASCII punctuation character other than "/" and "%".
+	//
+	// If Separator is empty, "_" is used.
+	Separator string
+
+	// HashPrefixLength is the number of leading hex digits of the SHA-256
+	// hash of a cache name that is prepended to its key, followed by the
+	// Separator (e.g., "3f_example.com_@v_list" for 2). It must not exceed
+	// 64. Note that keys with hash prefixes no longer share the prefixes of
+	// their names, so listing the caches whose names start with a prefix
+	// requires listing all keys.
+	//
+	// If HashPrefixLength is zero, keys are not prefixed.
+	HashPrefixLength int
+}
+
+// separator returns the separator of the m.
+func (m FlatKeyMapper) separator() byte {
+	if m.Separator == "" {
+		return '_'
+	}
+	return m.Separator[0]
+}
+
+// check checks whether the m is valid.
+func (m FlatKeyMapper) check() error {
+	if s := m.Separator; s != "" {
+		if len(s) != 1 || s == "/" || s == "%" || !isASCIIPunct(s[0]) {
+			return fmt.Errorf("invalid separator %q", s)
+		}
+	}
+	if m.HashPrefixLength < 0 || m.HashPrefixLength > 2*sha256.Size {
+		return fmt.Errorf("hash prefix length %d out of range [0, %d]", m.HashPrefixLength, 2*sha256.Size)
+	}
+	return nil
+}
+
+// isASCIIPunct reports whether the c is an ASCII punctuation character.
+func isASCIIPunct(c byte) bool {
+	return c > ' ' && c < 0x7f && !('0' <= c && c <= '9') && !('A' <= c && c <= 'Z') && !('a' <= c && c <= 'z')
+}
+
+// hashPrefix returns the hash prefix of the name.
+func (m FlatKeyMapper) hashPrefix(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:m.HashPrefixLength]
+}
+
+// Key returns the flat key for the name.
+func (m FlatKeyMapper) Key(name string) string {
+	sep := m.separator()
+	var b strings.Builder
+	if m.HashPrefixLength > 0 {
+		b.WriteString(m.hashPrefix(name))
+		b.WriteByte(sep)
+	}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '/':
+			b.WriteByte(sep)
+		case '%', sep:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Name returns the cache name for the key. It reports false if the key cannot
+// be returned by [FlatKeyMapper.Key].
+func (m FlatKeyMapper) Name(key string) (string, bool) {
+	sep := m.separator()
+	var prefix string
+	if m.HashPrefixLength > 0 {
+		if len(key) <= m.HashPrefixLength || key[m.HashPrefixLength] != sep {
+			return "", false
+		}
+		prefix, key = key[:m.HashPrefixLength], key[m.HashPrefixLength+1:]
+	}
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; c {
+		case sep:
+			b.WriteByte('/')
+		case '%':
+			if i+2 >= len(key) {
+				return "", false
+			}
+			d, err := hex.DecodeString(key[i+1 : i+3])
+			if err != nil || (d[0] != '%' && d[0] != sep) || key[i+1:i+3] != fmt.Sprintf("%02X", d[0]) {
+				return "", false
+			}
+			b.WriteByte(d[0])
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	name := b.String()
+	if prefix != "" && prefix != m.hashPrefix(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// NewFlatKeyCacher returns a [Cacher] that stores caches in the c under the
+// flat keys mapped from their names by the m. When importing cache files in
+// bulk (see [Cacher.Sync]), the names of the extracted files are mapped in the
+// same way. Note that [SyncOptions.StrictNames] is checked against the
+// original names, while the c only sees the keys (e.g., in [DirCacher.Skip]),
+// and that bundles with symbolic links cannot be imported, since their
+// targets cannot be mapped.
+//
+// The returned [Cacher] implements [Lister], [Deleter], [Stater],
+// [Readlinker], [RangeReader], and [VerifiedPutter] by forwarding them to the
+// c under the mapped keys. Those that the c does not implement fail with an
+// error that matches [ErrUnsupported]. [Lister.List] returns the original
+// names, skipping keys that cannot be mapped back, and [Readlinker.Readlink]
+// maps the targets back to names relative to the links, reporting links whose
+// targets cannot be mapped back as regular caches, so that they are exported
+// as copies.
+//
+// NewFlatKeyCacher panics if the m is invalid.
+func NewFlatKeyCacher(c Cacher, m FlatKeyMapper) Cacher {
+	if err := m.check(); err != nil {
+		panic("goproxy: NewFlatKeyCacher: " + err.Error())
+	}
+	return &flatKeyCacher{cacher: c, mapper: m}
+}
+
+// flatKeyCacher is the [Cacher] returned by [NewFlatKeyCacher].
+type flatKeyCacher struct {
+	cacher Cacher
+	mapper FlatKeyMapper
+}
+
+// Get implements [Cacher].
+func (fc *flatKeyCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return fc.cacher.Get(ctx, fc.mapper.Key(name))
+}
+
+// Put implements [Cacher].
+func (fc *flatKeyCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	return fc.cacher.Put(ctx, fc.mapper.Key(name), content)
+}
+
+// Sync implements [Cacher].
+func (fc *flatKeyCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	uploadCacheDirReader, release, err := opts.verifyBundle(uploadCacheDirReader)
+	if err != nil {
+		return err
+	}
+	defer release()
+	opts.SignaturePublicKey, opts.Signature = "", nil
+
+	switch compressType = opts.compressType(compressType); compressType {
+	case "application/gzip":
+		gzipReader, err := opts.gunzip(uploadCacheDirReader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		uploadCacheDirReader = gzipReader
+	case "application/x-tar":
+	default:
+		return unsupportedCompressionError(compressType)
+	}
+
+	outerCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var src syncResultCollector
+	innerOpts := opts
+	innerOpts.StrictNames = false
+	innerOpts.OnComplete = src.add
+	innerOpts.Checkpoint, innerOpts.Resume = "", false
+	innerOpts.VerifyZipHashes = false
+	zv := newSyncZipHashVerifier(opts)
+	s := startShardSync(ctx, fc.cacher, innerOpts)
+	tarReader := tar.NewReader(uploadCacheDirReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s.wait(err)
+		}
+		name := path.Clean(header.Name)
+		if header.FileInfo().IsDir() {
+			continue
+		}
+		if opts.skipName(name) {
+			src.add(ctx, SyncResult{Skipped: 1})
+			continue
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			return s.wait(fmt.Errorf("%s: symbolic links are not supported", header.Name))
+		}
+		header.Name = fc.mapper.Key(name)
+		if err := s.tw.WriteHeader(header); err != nil {
+			return s.wait(err)
+		}
+		content, done, err := zv.reader(name, tarReader)
+		if err != nil {
+			return s.wait(err)
+		}
+		_, err = io.Copy(s.tw, content)
+		if err := done(err); err != nil {
+			return s.wait(err)
+		}
+	}
+	err = s.tw.Close()
+	if err == nil {
+		err = s.pw.Close()
+	}
+	if err := s.wait(err); err != nil {
+		return err
+	}
+	return opts.complete(outerCtx, zv.result(src.result))
+}
+
+// List implements [Lister].
+func (fc *flatKeyCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	lister, ok := fc.cacher.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("listing caches %w", ErrUnsupported)
+	}
+	keyPrefix := ""
+	if fc.mapper.HashPrefixLength == 0 {
+		keyPrefix = fc.mapper.Key(prefix)
+	}
+	keys, err := lister.List(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if name, ok := fc.mapper.Name(key); ok && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements [Deleter].
+func (fc *flatKeyCacher) Delete(ctx context.Context, name string) error {
+	deleter, ok := fc.cacher.(Deleter)
+	if !ok {
+		return fmt.Errorf("deleting caches %w", ErrUnsupported)
+	}
+	return deleter.Delete(ctx, fc.mapper.Key(name))
+}
+
+// Stat implements [Stater].
+func (fc *flatKeyCacher) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	stater, ok := fc.cacher.(Stater)
+	if !ok {
+		return nil, fmt.Errorf("stating caches %w", ErrUnsupported)
+	}
+	return stater.Stat(ctx, fc.mapper.Key(name))
+}
+
+// Readlink implements [Readlinker].
+func (fc *flatKeyCacher) Readlink(ctx context.Context, name string) (string, error) {
+	readlinker, ok := fc.cacher.(Readlinker)
+	if !ok {
+		return "", fmt.Errorf("reading links of caches %w", ErrUnsupported)
+	}
+	target, err := readlinker.Readlink(ctx, fc.mapper.Key(name))
+	if err != nil || target == "" || strings.Contains(target, "/") {
+		return "", err
+	}
+	targetName, ok := fc.mapper.Name(target)
+	if !ok {
+		return "", nil
+	}
+	return relativeCacheName(path.Dir(name), targetName), nil
+}
+
+// RangeReadCloser implements [RangeReader].
+func (fc *flatKeyCacher) RangeReadCloser(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	rr, ok := fc.cacher.(RangeReader)
+	if !ok {
+		return nil, fmt.Errorf("reading ranges of caches %w", ErrUnsupported)
+	}
+	return rr.RangeReadCloser(ctx, fc.mapper.Key(name), start, end)
+}
+
+// PutVerified implements [VerifiedPutter].
+func (fc *flatKeyCacher) PutVerified(ctx context.Context, name string, content io.Reader, expect VerifyInfo) error {
+	vp, ok := fc.cacher.(VerifiedPutter)
+	if !ok {
+		return fmt.Errorf("verified puts of caches %w", ErrUnsupported)
+	}
+	return vp.PutVerified(ctx, fc.mapper.Key(name), content, expect)
+}
+
+// relativeCacheName returns the slash-separated path of the cache name
+// relative to the dir, which is a directory of cache names ("." for the
+// root).
+func relativeCacheName(dir, name string) string {
+	var dirElems []string
+	if dir != "." {
+		dirElems = strings.Split(dir, "/")
+	}
+	nameElems := strings.Split(name, "/")
+	i := 0
+	for i < len(dirElems) && i < len(nameElems)-1 && dirElems[i] == nameElems[i] {
+		i++
+	}
+	rel := strings.Repeat("../", len(dirElems)-i)
+	return rel + strings.Join(nameElems[i:], "/")
+}
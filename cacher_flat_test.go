@@ -0,0 +1,268 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFlatKeyMapper(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		mapper  FlatKeyMapper
+		name    string
+		wantKey string
+	}{
+		{1, FlatKeyMapper{}, "example.com/@v/v1.0.0.zip", "example.com_@v_v1.0.0.zip"},
+		{2, FlatKeyMapper{}, "example.com/foo_bar/@v/list", "example.com_foo%5Fbar_@v_list"},
+		{3, FlatKeyMapper{}, "example.com/100%/@latest", "example.com_100%25_@latest"},
+		{4, FlatKeyMapper{Separator: "|"}, "example.com/foo_bar/@v/list", "example.com|foo_bar|@v|list"},
+		{5, FlatKeyMapper{Separator: "|"}, "example.com/a|b/@v/list", "example.com|a%7Cb|@v|list"},
+		{6, FlatKeyMapper{HashPrefixLength: 4}, "example.com/@v/list", "7f2d_example.com_@v_list"},
+		{7, FlatKeyMapper{}, "sumdb/sum.golang.org/lookup/example.com@v1.0.0", "sumdb_sum.golang.org_lookup_example.com@v1.0.0"},
+	} {
+		key := tt.mapper.Key(tt.name)
+		if tt.mapper.HashPrefixLength > 0 {
+			if got, want := key[tt.mapper.HashPrefixLength:], tt.wantKey[tt.mapper.HashPrefixLength:]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := key[:tt.mapper.HashPrefixLength], tt.mapper.hashPrefix(tt.name); got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if got, want := key, tt.wantKey; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if name, ok := tt.mapper.Name(key); !ok {
+			t.Errorf("test(%d): expected ok", tt.n)
+		} else if got, want := name, tt.name; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		n      int
+		mapper FlatKeyMapper
+		key    string
+	}{
+		{1, FlatKeyMapper{}, "example.com_%41"},
+		{2, FlatKeyMapper{}, "example.com_%5f"},
+		{3, FlatKeyMapper{}, "example.com_%2"},
+		{4, FlatKeyMapper{}, "example.com_%zz"},
+		{5, FlatKeyMapper{HashPrefixLength: 4}, "0000_example.com_@v_list"},
+		{6, FlatKeyMapper{HashPrefixLength: 4}, "example.com_@v_list"},
+		{7, FlatKeyMapper{HashPrefixLength: 4}, "0000"},
+	} {
+		if _, ok := tt.mapper.Name(tt.key); ok {
+			t.Errorf("test(%d): expected not ok", tt.n)
+		}
+	}
+}
+
+func TestFlatKeyMapperCheck(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		mapper  FlatKeyMapper
+		wantErr string
+	}{
+		{1, FlatKeyMapper{}, ""},
+		{2, FlatKeyMapper{Separator: ":", HashPrefixLength: 64}, ""},
+		{3, FlatKeyMapper{Separator: "/"}, `invalid separator "/"`},
+		{4, FlatKeyMapper{Separator: "%"}, `invalid separator "%"`},
+		{5, FlatKeyMapper{Separator: "a"}, `invalid separator "a"`},
+		{6, FlatKeyMapper{Separator: "__"}, `invalid separator "__"`},
+		{7, FlatKeyMapper{HashPrefixLength: 65}, "hash prefix length 65 out of range [0, 64]"},
+	} {
+		err := tt.mapper.check()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			}
+		} else if err == nil {
+			t.Errorf("test(%d): expected error", tt.n)
+		} else if got, want := err.Error(), tt.wantErr; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestNewFlatKeyCacher(t *testing.T) {
+	names := []string{
+		"example.com/@latest",
+		"example.com/@v/list",
+		"example.com/@v/v1.0.0.info",
+		"example.com/foo_bar/@v/v1.0.0.mod",
+		"sumdb/sum.golang.org/latest",
+	}
+	for _, tt := range []struct {
+		n      int
+		mapper FlatKeyMapper
+	}{
+		{1, FlatKeyMapper{}},
+		{2, FlatKeyMapper{Separator: "|", HashPrefixLength: 2}},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		fc := NewFlatKeyCacher(dc, tt.mapper)
+		for _, name := range names {
+			if err := fc.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+
+		var wantKeys []string
+		for _, name := range names {
+			wantKeys = append(wantKeys, tt.mapper.Key(name))
+		}
+		sort.Strings(wantKeys)
+		if got, want := strings.Join(walkDirFiles(t, dc.Dir), ","), strings.Join(wantKeys, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		for _, name := range names {
+			rc, err := fc.Get(context.Background(), name)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), name; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+
+		if got, err := fc.(Lister).List(context.Background(), ""); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if want := names; strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, err := fc.(Lister).List(context.Background(), "example.com/@v/"); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if want := names[1:3]; strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		if err := fc.(Deleter).Delete(context.Background(), names[0]); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, err := fc.(Lister).List(context.Background(), ""); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if want := names[1:]; strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestFlatKeyCacherOptionalInterfaces(t *testing.T) {
+	mapper := FlatKeyMapper{}
+	dc := &DirCacher{Dir: t.TempDir()}
+	fc := NewFlatKeyCacher(dc, mapper)
+	if err := fc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("module example.com"), VerifyInfo{Size: 18}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := os.Stat(filepath.Join(dc.Dir, mapper.Key("example.com/@v/v1.0.0.mod"))); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if fi, err := fc.(Stater).Stat(context.Background(), "example.com/@v/v1.0.0.mod"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := fi.Size(), int64(18); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	rangeName := ""
+	rfc := NewFlatKeyCacher(&testRangeCacher{
+		Cacher: dc,
+		rangeReadCloser: func(ctx context.Context, c Cacher, name string, start, end int64) (io.ReadCloser, error) {
+			rangeName = name
+			return io.NopCloser(strings.NewReader("example.com")), nil
+		},
+	}, mapper)
+	if rc, err := rfc.(RangeReader).RangeReadCloser(context.Background(), "example.com/@v/v1.0.0.mod", 7, 17); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else {
+		rc.Close()
+	}
+	if got, want := rangeName, mapper.Key("example.com/@v/v1.0.0.mod"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		n          int
+		name       string
+		linkTarget string
+		wantTarget string
+	}{
+		{1, "example.com/@v/v1.0.0.mod", "", ""},
+		{2, "example.com/@v/v1.0.1.mod", mapper.Key("example.com/@v/v1.0.0.mod"), "v1.0.0.mod"},
+		{3, "example.com/foo/@v/v1.0.0.mod", mapper.Key("example.com/@v/v1.0.0.mod"), "../../@v/v1.0.0.mod"},
+		{4, "example.com/@latest", mapper.Key("example.com/@v/v1.0.0.mod"), "@v/v1.0.0.mod"},
+		{5, "example.com/@v/v1.0.2.mod", "%zz", ""},
+	} {
+		if tt.linkTarget != "" {
+			if err := os.Symlink(tt.linkTarget, filepath.Join(dc.Dir, mapper.Key(tt.name))); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		if got, err := fc.(Readlinker).Readlink(context.Background(), tt.name); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if want := tt.wantTarget; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	fc = NewFlatKeyCacher(&testCacher{Cacher: dc}, mapper)
+	for _, err := range []error{
+		func() error { _, err := fc.(Lister).List(context.Background(), ""); return err }(),
+		fc.(Deleter).Delete(context.Background(), "example.com/@v/list"),
+		func() error { _, err := fc.(Stater).Stat(context.Background(), "example.com/@v/list"); return err }(),
+		func() error {
+			_, err := fc.(Readlinker).Readlink(context.Background(), "example.com/@v/list")
+			return err
+		}(),
+		func() error {
+			_, err := fc.(RangeReader).RangeReadCloser(context.Background(), "example.com/@v/list", 0, 1)
+			return err
+		}(),
+		fc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{}),
+	} {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("got %v, want ErrUnsupported", err)
+		}
+	}
+}
+
+func TestFlatKeyCacherSync(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{
+		"./.DS_Store":                 []byte("junk"),
+		"./example.com/@v/list":       []byte("v1.0.0"),
+		"./example.com/@v/v1.0.0.mod": []byte("module example.com"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	dc := &DirCacher{Dir: t.TempDir()}
+	fc := NewFlatKeyCacher(dc, FlatKeyMapper{})
+	if err := fc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{StrictNames: true, Logger: log.New(io.Discard, "", 0)}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := strings.Join(walkDirFiles(t, dc.Dir), ","), "example.com_@v_list,example.com_@v_v1.0.0.mod"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, err := fc.(Lister).List(context.Background(), ""); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(got, ","), "example.com/@v/list,example.com/@v/v1.0.0.mod"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := fc.Sync(context.Background(), bytes.NewReader(bundle), "application/zip", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err.Error(), `unsupported compress type "application/zip" (supported: application/gzip, application/x-tar)`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !netbsd && !openbsd
+
+package goproxy
+
+import "os"
+
+// tryLockFile always reports that the lock is acquired, since file locking
+// is not supported on this platform.
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
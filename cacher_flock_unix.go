@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || dragonfly || netbsd || openbsd
+
+package goproxy
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLockFile tries to acquire an exclusive flock(2) lock on the f without
+// blocking. It reports whether the lock is acquired. The lock is released
+// when the f is closed.
+func tryLockFile(f *os.File) (bool, error) {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return true, nil
+		} else if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		} else if !errors.Is(err, syscall.EINTR) {
+			return false, err
+		}
+	}
+}
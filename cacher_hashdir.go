@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// maxHashDirLevels is the maximum value of [DirCacher.HashDirLevels], at which
+// every byte of the SHA-256 hash of a name names a directory level.
+const maxHashDirLevels = sha256.Size
+
+// checkHashDirLevels checks whether the dc.HashDirLevels is valid.
+func (dc *DirCacher) checkHashDirLevels() error {
+	if dc.HashDirLevels < 0 || dc.HashDirLevels > maxHashDirLevels {
+		return fmt.Errorf("hash dir levels %d out of range [0, %d]", dc.HashDirLevels, maxHashDirLevels)
+	}
+	return nil
+}
+
+// hashDirs returns the intermediate directories of the cache file for the name
+// (see [DirCacher.HashDirLevels]), with a trailing slash.
+func (dc *DirCacher) hashDirs(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	var b strings.Builder
+	for _, c := range sum[:dc.HashDirLevels] {
+		b.WriteString(hex.EncodeToString([]byte{c}))
+		b.WriteByte('/')
+	}
+	return b.String()
+}
+
+// fileName returns the slash-separated path relative to the dc.Dir of the
+// cache file for the name.
+func (dc *DirCacher) fileName(name string) string {
+	if dc.HashDirLevels <= 0 {
+		return name
+	}
+	return dc.hashDirs(name) + name
+}
+
+// cacheName returns the name of the cache file at the slash-separated file
+// path relative to the dc.Dir. It reports false if the file path cannot be
+// returned by [DirCacher.fileName].
+func (dc *DirCacher) cacheName(file string) (string, bool) {
+	if dc.HashDirLevels <= 0 {
+		return file, true
+	}
+	n := 3 * dc.HashDirLevels
+	if len(file) <= n {
+		return "", false
+	}
+	name := file[n:]
+	if file[:n] != dc.hashDirs(name) {
+		return "", false
+	}
+	return name, true
+}
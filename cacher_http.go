@@ -0,0 +1,120 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTPCacher implements [Cacher] by getting caches over HTTP from another Go
+// module proxy, such as a central [Goproxy] instance in front of which edge
+// instances with their own caches are deployed. A cache is got from
+// "<BaseURL>/<name>", so the other proxy fetches it on a miss if it is allowed
+// to.
+//
+// HTTPCacher is read-only. Put does nothing, as the caches are owned by the
+// other proxy, and Sync is not supported.
+type HTTPCacher struct {
+	// BaseURL is the base URL of the other proxy (e.g.,
+	// "https://goproxy.example.com").
+	BaseURL string
+
+	// Transport is used to execute outgoing requests.
+	//
+	// If Transport is nil, [http.DefaultTransport] is used.
+	Transport http.RoundTripper
+
+	initOnce   sync.Once
+	initErr    error
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+// init initializes the hc.
+func (hc *HTTPCacher) init() {
+	hc.baseURL, hc.initErr = url.Parse(hc.BaseURL)
+	if hc.initErr != nil {
+		hc.initErr = fmt.Errorf("invalid base URL: %w", hc.initErr)
+		return
+	}
+	hc.httpClient = &http.Client{Transport: hc.Transport}
+}
+
+// Get implements [Cacher]. The returned [io.ReadCloser] implements [Sizer] if
+// the response has a Content-Length, and reports the Last-Modified and ETag of
+// the response.
+func (hc *HTTPCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if hc.initOnce.Do(hc.init); hc.initErr != nil {
+		return nil, hc.initErr
+	}
+	if err := checkCacheName(name); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, appendURL(hc.baseURL, name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		content := &httpCacheContent{ReadCloser: resp.Body, etag: resp.Header.Get("ETag")}
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			content.lastModified, _ = http.ParseTime(lm)
+		}
+		if resp.ContentLength >= 0 {
+			return &sizedHTTPCacheContent{httpCacheContent: content, size: resp.ContentLength}, nil
+		}
+		return content, nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return nil, notExistErrorf("GET %s: %s: %s", resp.Request.URL.Redacted(), resp.Status, respBody)
+	}
+	return nil, fmt.Errorf("GET %s: %s: %s", resp.Request.URL.Redacted(), resp.Status, respBody)
+}
+
+// Put implements [Cacher]. It does nothing but check the name.
+func (hc *HTTPCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	return checkCacheName(name)
+}
+
+// Sync implements [Cacher]. It always returns an error, as importing cache
+// files in bulk is not supported.
+func (hc *HTTPCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	return errors.New("sync not supported by HTTPCacher")
+}
+
+// httpCacheContent is the content of a cache got by [HTTPCacher].
+type httpCacheContent struct {
+	io.ReadCloser
+	lastModified time.Time
+	etag         string
+}
+
+// LastModified returns the last modification time of the hcc.
+func (hcc *httpCacheContent) LastModified() time.Time { return hcc.lastModified }
+
+// ETag returns the entity tag of the hcc.
+func (hcc *httpCacheContent) ETag() string { return hcc.etag }
+
+// sizedHTTPCacheContent is an [httpCacheContent] with a known size.
+type sizedHTTPCacheContent struct {
+	*httpCacheContent
+	size int64
+}
+
+// Size implements [Sizer].
+func (shcc *sizedHTTPCacheContent) Size() int64 { return shcc.size }
@@ -0,0 +1,160 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPCacher(t *testing.T) {
+	server, setHandler := newHTTPTestServer()
+	defer server.Close()
+	modTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		n                int
+		baseURL          string
+		handler          http.HandlerFunc
+		name             string
+		wantPath         string
+		wantContent      string
+		wantSize         int64
+		wantLastModified time.Time
+		wantETag         string
+		wantErr          error
+	}{
+		{
+			n:       1,
+			baseURL: server.URL,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("ETag", `"foobar"`)
+				rw.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+				responseSuccess(rw, req, strings.NewReader("module example.com/Foo"), "text/plain; charset=utf-8", -2)
+			},
+			name:             "example.com/!foo/@v/v1.0.0.mod",
+			wantPath:         "/example.com/!foo/@v/v1.0.0.mod",
+			wantContent:      "module example.com/Foo",
+			wantSize:         22,
+			wantLastModified: modTime,
+			wantETag:         `"foobar"`,
+		},
+		{
+			n:       2,
+			baseURL: server.URL + "/prefix/",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+				rw.(http.Flusher).Flush()
+				io.WriteString(rw, "v1.0.0")
+			},
+			name:        "example.com/@v/list",
+			wantPath:    "/prefix/example.com/@v/list",
+			wantContent: "v1.0.0",
+			wantSize:    -1,
+		},
+		{
+			n:       3,
+			baseURL: server.URL,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseNotFound(rw, req, -2, "unknown revision v1.0.0")
+			},
+			name:     "example.com/@v/v1.0.0.info",
+			wantPath: "/example.com/@v/v1.0.0.info",
+			wantErr:  fs.ErrNotExist,
+		},
+		{
+			n:       4,
+			baseURL: server.URL,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseString(rw, req, http.StatusGone, -2, "gone")
+			},
+			name:     "example.com/@v/v1.0.0.info",
+			wantPath: "/example.com/@v/v1.0.0.info",
+			wantErr:  fs.ErrNotExist,
+		},
+		{
+			n:       5,
+			baseURL: server.URL,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseInternalServerError(rw, req)
+			},
+			name:     "example.com/@v/v1.0.0.info",
+			wantPath: "/example.com/@v/v1.0.0.info",
+			wantErr:  fmt.Errorf("GET %s/example.com/@v/v1.0.0.info: 500 Internal Server Error: internal server error", server.URL),
+		},
+		{
+			n:       6,
+			baseURL: server.URL,
+			name:    "../foobar",
+			wantErr: fmt.Errorf("%w: %q", ErrInvalidName, "../foobar"),
+		},
+		{
+			n:       7,
+			baseURL: "\x00",
+			name:    "example.com/@v/list",
+			wantErr: errors.New(`invalid base URL: parse "\x00": net/url: invalid control character in URL`),
+		},
+	} {
+		var gotPath string
+		setHandler(func(rw http.ResponseWriter, req *http.Request) {
+			gotPath = req.URL.Path
+			if tt.handler != nil {
+				tt.handler(rw, req)
+			}
+		})
+		hc := &HTTPCacher{BaseURL: tt.baseURL}
+		rc, err := hc.Get(context.Background(), tt.name)
+		if got, want := gotPath, tt.wantPath; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.wantErr != nil {
+			if err == nil {
+				rc.Close()
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !errors.Is(got, want) && !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := int64(-1), tt.wantSize; want >= 0 {
+			if s, ok := rc.(Sizer); ok {
+				got = s.Size()
+			}
+			if got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+		} else if _, ok := rc.(Sizer); ok {
+			t.Errorf("test(%d): unexpected Sizer", tt.n)
+		}
+		if got, want := rc.(interface{ LastModified() time.Time }).LastModified(), tt.wantLastModified; !got.Equal(want) {
+			t.Errorf("test(%d): got %s, want %s", tt.n, got, want)
+		}
+		if got, want := rc.(interface{ ETag() string }).ETag(), tt.wantETag; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(rc); err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if err := rc.Close(); err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	hc := &HTTPCacher{BaseURL: server.URL}
+	if err := hc.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+	if err := hc.Sync(context.Background(), strings.NewReader(""), "application/x-tar", SyncOptions{}); err == nil {
+		t.Error("expected error")
+	} else if got, want := err, errors.New("sync not supported by HTTPCacher"); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// NewLimitedCacher returns a [Cacher] that limits the number of concurrent
+// operations on the c to maxConcurrent, so that a spike of requests does not
+// overwhelm the store behind the c (e.g., a shared network filesystem).
+// Operations beyond the limit wait for others to complete, or fail with the
+// error of their context if it is done first.
+//
+// An operation is in flight only while its method of the c is running. In
+// particular, reading the content returned by [Cacher.Get] is not limited,
+// so that callers holding the content of one cache while getting another do
+// not deadlock.
+//
+// The returned [Cacher] implements [BatchPutter], whose [BatchPutter.PutAll]
+// counts as a single operation and puts the entries by [PutAll] on the c. It
+// also implements [Lister], [Deleter], [Stater], [Readlinker], [RangeReader],
+// and [VerifiedPutter] by forwarding them to the c, with their operations
+// limited in the same way. Those that the c does not implement fail with an
+// error that matches [ErrUnsupported].
+//
+// NewLimitedCacher panics if the maxConcurrent is not positive.
+func NewLimitedCacher(c Cacher, maxConcurrent int) Cacher {
+	if maxConcurrent <= 0 {
+		panic("goproxy: NewLimitedCacher: non-positive max concurrent")
+	}
+	return &limitedCacher{cacher: c, sem: make(chan struct{}, maxConcurrent)}
+}
+
+// limitedCacher is the [Cacher] returned by [NewLimitedCacher].
+type limitedCacher struct {
+	cacher Cacher
+	sem    chan struct{}
+}
+
+// acquire acquires a slot for an operation. The returned function must be
+// called to release the slot once the operation is done.
+func (lc *limitedCacher) acquire(ctx context.Context) (func(), error) {
+	select {
+	case lc.sem <- struct{}{}:
+		return func() { <-lc.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Get implements [Cacher].
+func (lc *limitedCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return lc.cacher.Get(ctx, name)
+}
+
+// Put implements [Cacher].
+func (lc *limitedCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return lc.cacher.Put(ctx, name, content)
+}
+
+// PutAll implements [BatchPutter].
+func (lc *limitedCacher) PutAll(ctx context.Context, entries []CacheEntry) error {
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return PutAll(ctx, lc.cacher, entries)
+}
+
+// Sync implements [Cacher].
+func (lc *limitedCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return lc.cacher.Sync(ctx, uploadCacheDirReader, compressType, opts)
+}
+
+// List implements [Lister].
+func (lc *limitedCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	lister, ok := lc.cacher.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("listing caches %w", ErrUnsupported)
+	}
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return lister.List(ctx, prefix)
+}
+
+// Delete implements [Deleter].
+func (lc *limitedCacher) Delete(ctx context.Context, name string) error {
+	deleter, ok := lc.cacher.(Deleter)
+	if !ok {
+		return fmt.Errorf("deleting caches %w", ErrUnsupported)
+	}
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return deleter.Delete(ctx, name)
+}
+
+// Stat implements [Stater].
+func (lc *limitedCacher) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	stater, ok := lc.cacher.(Stater)
+	if !ok {
+		return nil, fmt.Errorf("stating caches %w", ErrUnsupported)
+	}
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return stater.Stat(ctx, name)
+}
+
+// Readlink implements [Readlinker].
+func (lc *limitedCacher) Readlink(ctx context.Context, name string) (string, error) {
+	readlinker, ok := lc.cacher.(Readlinker)
+	if !ok {
+		return "", fmt.Errorf("reading links of caches %w", ErrUnsupported)
+	}
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return readlinker.Readlink(ctx, name)
+}
+
+// RangeReadCloser implements [RangeReader].
+func (lc *limitedCacher) RangeReadCloser(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	rr, ok := lc.cacher.(RangeReader)
+	if !ok {
+		return nil, fmt.Errorf("reading ranges of caches %w", ErrUnsupported)
+	}
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return rr.RangeReadCloser(ctx, name, start, end)
+}
+
+// PutVerified implements [VerifiedPutter].
+func (lc *limitedCacher) PutVerified(ctx context.Context, name string, content io.Reader, expect VerifyInfo) error {
+	vp, ok := lc.cacher.(VerifiedPutter)
+	if !ok {
+		return fmt.Errorf("verified puts of caches %w", ErrUnsupported)
+	}
+	release, err := lc.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return vp.PutVerified(ctx, name, content, expect)
+}
@@ -0,0 +1,158 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewLimitedCacher(t *testing.T) {
+	var inFlight, maxInFlight int32
+	track := func() func() {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return func() { atomic.AddInt32(&inFlight, -1) }
+	}
+	dc := &DirCacher{Dir: t.TempDir()}
+	lc := NewLimitedCacher(&testCacher{
+		Cacher: dc,
+		get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+			defer track()()
+			return c.Get(ctx, name)
+		},
+		put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+			defer track()()
+			return c.Put(ctx, name, content)
+		},
+	}, 3)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		name := "example.com/@v/v1.0." + strings.Repeat("0", i%5+1) + ".info"
+		go func() {
+			defer wg.Done()
+			if err := lc.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			rc, err := lc.Get(context.Background(), name)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					errs <- err
+				}
+				return
+			}
+			rc.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error %q", err)
+	}
+	if got, want := atomic.LoadInt32(&maxInFlight), int32(3); got > want {
+		t.Errorf("got %d, want at most %d", got, want)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got < 2 {
+		t.Errorf("got %d, want concurrent operations", got)
+	}
+
+	lc = NewLimitedCacher(dc, 1)
+	if err := lc.(BatchPutter).PutAll(context.Background(), []CacheEntry{{Name: "example.com/@v/list", Content: strings.NewReader("v1.0.0")}}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, err := lc.(Lister).List(context.Background(), "example.com/@v/l"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(got, ","), "example.com/@v/list"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := lc.(Deleter).Delete(context.Background(), "example.com/@v/list"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := lc.Get(context.Background(), "example.com/@v/list"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+	if err := lc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{Size: 6}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if fi, err := lc.(Stater).Stat(context.Background(), "example.com/@v/list"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := fi.Size(), int64(6); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if target, err := lc.(Readlinker).Readlink(context.Background(), "example.com/@v/list"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if target != "" {
+		t.Errorf("got %q, want empty", target)
+	}
+
+	lc = NewLimitedCacher(&testCacher{Cacher: dc}, 1)
+	for _, err := range []error{
+		func() error { _, err := lc.(Lister).List(context.Background(), ""); return err }(),
+		lc.(Deleter).Delete(context.Background(), "example.com/@v/list"),
+		func() error { _, err := lc.(Stater).Stat(context.Background(), "example.com/@v/list"); return err }(),
+		func() error {
+			_, err := lc.(Readlinker).Readlink(context.Background(), "example.com/@v/list")
+			return err
+		}(),
+		func() error {
+			_, err := lc.(RangeReader).RangeReadCloser(context.Background(), "example.com/@v/list", 0, 1)
+			return err
+		}(),
+		lc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{}),
+	} {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("got %v, want ErrUnsupported", err)
+		}
+	}
+}
+
+func TestNewLimitedCacherContext(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+	lc := NewLimitedCacher(&testCacher{
+		Cacher: &DirCacher{Dir: t.TempDir()},
+		get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+			close(started)
+			<-block
+			return c.Get(ctx, name)
+		},
+	}, 1)
+	go lc.Get(context.Background(), "example.com/@v/list")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lc.Put(ctx, "example.com/@v/list", strings.NewReader("v1.0.0")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	close(block)
+	if err := lc.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+
+	func() {
+		defer func() {
+			if got, want := recover(), "goproxy: NewLimitedCacher: non-positive max concurrent"; got != want {
+				t.Errorf("got %v, want %q", got, want)
+			}
+		}()
+		NewLimitedCacher(&DirCacher{}, 0)
+	}()
+}
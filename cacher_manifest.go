@@ -0,0 +1,225 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// ManifestOptions are the options for [DirCacher.Manifest].
+type ManifestOptions struct {
+	// SHA256 indicates whether to include the SHA-256 hashes of the cache
+	// files in the manifest. Hashing reads every cache file in full, so a
+	// manifest without hashes, whose entries can still be compared by their
+	// sizes and modification times, is much cheaper to produce.
+	SHA256 bool
+
+	// Digest is like SHA256, but includes the hashes computed with the
+	// [DirCacher.HashFunc] as the [ManifestEntry.Digest] instead.
+	Digest bool
+}
+
+// ManifestEntry is an entry of the manifest written by [DirCacher.Manifest],
+// which describes a cache file.
+type ManifestEntry struct {
+	// Name is the name of the cache file.
+	Name string `json:"name"`
+
+	// Size is the size of the cache file in bytes.
+	Size int64 `json:"size"`
+
+	// SHA256 is the hex-encoded SHA-256 hash of the cache file. It is empty
+	// unless the [ManifestOptions.SHA256] is true.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Digest is the hash of the cache file computed with the
+	// [DirCacher.HashFunc] in the form "<hash name>:<hex-encoded hash>"
+	// (e.g., "sha512:..."), so that it can be verified with the same hash
+	// function regardless of how the reader is configured. It is empty
+	// unless the [ManifestOptions.Digest] is true.
+	Digest string `json:"digest,omitempty"`
+
+	// ModTime is the modification time of the cache file.
+	ModTime time.Time `json:"mtime"`
+}
+
+// Manifest walks the dc.Dir and writes a manifest of all its cache files to
+// the w as JSON lines, one [ManifestEntry] per cache file, in lexical order of
+// their paths, which are their names unless the [DirCacher.HashDirLevels] is
+// positive. It allows a mirror to diff its cache against another one and
+// fetch only the cache files it is missing. As with [DirCacher.List], hidden
+// files and directories are skipped. Cache files removed during the walk are
+// skipped as well.
+//
+// The manifest is streamed to the w as the dc.Dir is walked, so a failed
+// Manifest may have written a partial manifest.
+func (dc *DirCacher) Manifest(ctx context.Context, w io.Writer, opts ManifestOptions) error {
+	if err := dc.checkHashDirLevels(); err != nil {
+		return err
+	}
+	hashName, newHash, err := dc.hashFunc()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	fsys := dc.fsys()
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		cacheName, ok := dc.cacheName(name)
+		if !ok {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		entry := ManifestEntry{Name: cacheName, Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+		var sha256Hash, digestHash hash.Hash
+		var hashes []io.Writer
+		if opts.SHA256 {
+			sha256Hash = sha256.New()
+			hashes = append(hashes, sha256Hash)
+		}
+		if opts.Digest {
+			digestHash = newHash()
+			hashes = append(hashes, digestHash)
+		}
+		if len(hashes) > 0 {
+			if err := hashFSFile(fsys, name, io.MultiWriter(hashes...)); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+		}
+		if sha256Hash != nil {
+			entry.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+		}
+		if digestHash != nil {
+			entry.Digest = formatDigest(hashName, digestHash.Sum(nil))
+		}
+		return enc.Encode(entry)
+	})
+}
+
+// hashFile writes the content of the file targeted by the name to the hashes.
+func hashFile(name string, hashes io.Writer) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(hashes, f)
+	return err
+}
+
+// hashFSFile is like [hashFile], but for the named file in the fsys.
+func hashFSFile(fsys fs.FS, name string, hashes io.Writer) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(hashes, f)
+	return err
+}
+
+// readManifest reads the manifest written by [DirCacher.Manifest] from the r
+// and returns its entries by their names.
+func readManifest(r io.Reader) (map[string]ManifestEntry, error) {
+	entries := map[string]ManifestEntry{}
+	dec := json.NewDecoder(r)
+	for {
+		var entry ManifestEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries[entry.Name] = entry
+	}
+}
+
+// writeDeltaTarFile is like writeTarFile but writes nothing if the content
+// matches the entry in size and, if the entry has one, hash. The
+// [ManifestEntry.Digest] is preferred over the [ManifestEntry.SHA256], and is
+// verified with one of the builtinHashFuncs. A content whose entry has a
+// Digest naming another hash function is always written.
+func writeDeltaTarFile(tw *tar.Writer, cb contentBuffer, name string, content io.Reader, entry ManifestEntry) error {
+	rs, ok := content.(io.ReadSeeker)
+	if !ok {
+		var (
+			release func()
+			err     error
+		)
+		if rs, release, err = cb.buffer(content); err != nil {
+			return err
+		}
+		defer release()
+		content = rs
+	}
+	size, err := ContentSize(rs)
+	if err != nil {
+		return err
+	}
+	if size == entry.Size {
+		var (
+			h       hash.Hash
+			wantSum []byte
+		)
+		switch {
+		case entry.Digest != "":
+			if _, newHash, sum, err := parseDigest(entry.Digest, func(name string) func() hash.Hash { return builtinHashFuncs[name] }); err == nil {
+				h, wantSum = newHash(), sum
+			}
+		case entry.SHA256 != "":
+			if sum, err := hex.DecodeString(entry.SHA256); err == nil {
+				h, wantSum = sha256.New(), sum
+			}
+		default:
+			return nil
+		}
+		if h != nil {
+			if _, err := io.Copy(h, rs); err != nil {
+				return err
+			}
+			if _, err := rs.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if bytes.Equal(h.Sum(nil), wantSum) {
+				return nil
+			}
+		}
+	}
+	return writeTarFile(tw, cb, name, content)
+}
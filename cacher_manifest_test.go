@@ -0,0 +1,80 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirCacherManifest(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	modTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, content := range map[string]string{
+		"example.com/@v/list":        "v1.0.0",
+		"example.com/@v/v1.0.0.info": "{}",
+		"example.com/@v/v1.0.0.zip":  "",
+		"example.com/@latest":        "{}",
+	} {
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.Chtimes(filepath.Join(dirCacher.Dir, filepath.FromSlash(name)), modTime, modTime); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dirCacher.Dir, "example.com", "@v", ".v1.1.0.zip.tmp.1"), []byte("tmp"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	for _, tt := range []struct {
+		n           int
+		dir         string
+		opts        ManifestOptions
+		wantContent string
+	}{
+		{
+			n:   1,
+			dir: dirCacher.Dir,
+			wantContent: `{"name":"example.com/@latest","size":2,"mtime":"2000-01-01T00:00:00Z"}
+{"name":"example.com/@v/list","size":6,"mtime":"2000-01-01T00:00:00Z"}
+{"name":"example.com/@v/v1.0.0.info","size":2,"mtime":"2000-01-01T00:00:00Z"}
+{"name":"example.com/@v/v1.0.0.zip","size":0,"mtime":"2000-01-01T00:00:00Z"}
+`,
+		},
+		{
+			n:    2,
+			dir:  dirCacher.Dir,
+			opts: ManifestOptions{SHA256: true},
+			wantContent: `{"name":"example.com/@latest","size":2,"sha256":"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","mtime":"2000-01-01T00:00:00Z"}
+{"name":"example.com/@v/list","size":6,"sha256":"2485f4d55aae6c5b073114bc4c4b1907c0abae14166281beee7d93f76ebf41fc","mtime":"2000-01-01T00:00:00Z"}
+{"name":"example.com/@v/v1.0.0.info","size":2,"sha256":"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","mtime":"2000-01-01T00:00:00Z"}
+{"name":"example.com/@v/v1.0.0.zip","size":0,"sha256":"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855","mtime":"2000-01-01T00:00:00Z"}
+`,
+		},
+		{
+			n:   3,
+			dir: filepath.Join(dirCacher.Dir, "nonexistent"),
+		},
+	} {
+		var buf bytes.Buffer
+		if err := (&DirCacher{Dir: tt.dir}).Manifest(context.Background(), &buf, tt.opts); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := buf.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dirCacher.Manifest(ctx, &bytes.Buffer{}, ManifestOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !errors.Is(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
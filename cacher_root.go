@@ -0,0 +1,102 @@
+//go:build go1.25
+
+package goproxy
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rootDirFS implements [dirFS] using an [os.Root], which confines all file
+// operations to its directory.
+type rootDirFS struct{ root *os.Root }
+
+// newRestrictedDirFS creates a new [dirFS] that confines all file operations to
+// the dir.
+func newRestrictedDirFS(dir string) (dirFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return rootDirFS{root: root}, nil
+}
+
+// open implements [dirFS].
+func (rfs rootDirFS) open(name string) (*os.File, error) {
+	return rfs.root.Open(filepath.FromSlash(name))
+}
+
+// createTemp implements [dirFS].
+func (rfs rootDirFS) createTemp(dir, pattern string) (*os.File, string, error) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for attempt := 0; ; attempt++ {
+		backoffRandMutex.Lock()
+		random := strconv.FormatUint(backoffRand.Uint64(), 36)
+		backoffRandMutex.Unlock()
+
+		name := dir + "/" + prefix + random + suffix
+		f, err := rfs.root.OpenFile(filepath.FromSlash(name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			if os.IsExist(err) && attempt < 10000 {
+				continue
+			}
+			return nil, "", err
+		}
+		return f, name, nil
+	}
+}
+
+// mkdirAll implements [dirFS].
+func (rfs rootDirFS) mkdirAll(name string, perm fs.FileMode) error {
+	return rfs.root.MkdirAll(filepath.FromSlash(name), perm)
+}
+
+// create implements [dirFS].
+func (rfs rootDirFS) create(name string) (*os.File, error) {
+	return rfs.root.OpenFile(filepath.FromSlash(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+// chmod implements [dirFS].
+func (rfs rootDirFS) chmod(name string, mode fs.FileMode) error {
+	return rfs.root.Chmod(filepath.FromSlash(name), mode)
+}
+
+// chtimes implements [dirFS].
+func (rfs rootDirFS) chtimes(name string, atime, mtime time.Time) error {
+	return rfs.root.Chtimes(filepath.FromSlash(name), atime, mtime)
+}
+
+// rename implements [dirFS].
+func (rfs rootDirFS) rename(oldname, newname string) error {
+	return rfs.root.Rename(filepath.FromSlash(oldname), filepath.FromSlash(newname))
+}
+
+// remove implements [dirFS].
+func (rfs rootDirFS) remove(name string) error {
+	return rfs.root.Remove(filepath.FromSlash(name))
+}
+
+// lstat implements [dirFS].
+func (rfs rootDirFS) lstat(name string) (fs.FileInfo, error) {
+	return rfs.root.Lstat(filepath.FromSlash(name))
+}
+
+// readlink implements [dirFS].
+func (rfs rootDirFS) readlink(name string) (string, error) {
+	return rfs.root.Readlink(filepath.FromSlash(name))
+}
+
+// symlink implements [dirFS].
+func (rfs rootDirFS) symlink(target, name string) error {
+	return rfs.root.Symlink(filepath.FromSlash(target), filepath.FromSlash(name))
+}
+
+// ioFS implements [dirFS].
+func (rfs rootDirFS) ioFS() fs.FS { return rfs.root.FS() }
+
+// Close implements [io.Closer].
+func (rfs rootDirFS) Close() error { return rfs.root.Close() }
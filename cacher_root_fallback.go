@@ -0,0 +1,180 @@
+//go:build !go1.25
+
+package goproxy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkedDirFS implements [dirFS] by checking whether each path stays within
+// the directory before performing any file operation on it.
+type checkedDirFS struct{ osDirFS }
+
+// newRestrictedDirFS creates a new [dirFS] that confines all file operations to
+// the dir.
+func newRestrictedDirFS(dir string) (dirFS, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return checkedDirFS{osDirFS(dir)}, nil
+}
+
+// check checks whether the named file stays within the directory. The op is
+// used to describe the returned error.
+func (cfs checkedDirFS) check(op, name string) error {
+	if err := checkFileWithinDir(cfs.path(name), string(cfs.osDirFS)); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// open implements [dirFS].
+func (cfs checkedDirFS) open(name string) (*os.File, error) {
+	if err := cfs.check("open", name); err != nil {
+		return nil, err
+	}
+	return cfs.osDirFS.open(name)
+}
+
+// createTemp implements [dirFS].
+func (cfs checkedDirFS) createTemp(dir, pattern string) (*os.File, string, error) {
+	if err := cfs.check("createtemp", dir); err != nil {
+		return nil, "", err
+	}
+	return cfs.osDirFS.createTemp(dir, pattern)
+}
+
+// create implements [dirFS].
+func (cfs checkedDirFS) create(name string) (*os.File, error) {
+	if err := cfs.check("create", name); err != nil {
+		return nil, err
+	}
+	return cfs.osDirFS.create(name)
+}
+
+// mkdirAll implements [dirFS].
+func (cfs checkedDirFS) mkdirAll(name string, perm fs.FileMode) error {
+	if err := cfs.check("mkdir", name); err != nil {
+		return err
+	}
+	return cfs.osDirFS.mkdirAll(name, perm)
+}
+
+// chmod implements [dirFS].
+func (cfs checkedDirFS) chmod(name string, mode fs.FileMode) error {
+	if err := cfs.check("chmod", name); err != nil {
+		return err
+	}
+	return cfs.osDirFS.chmod(name, mode)
+}
+
+// chtimes implements [dirFS].
+func (cfs checkedDirFS) chtimes(name string, atime, mtime time.Time) error {
+	if err := cfs.check("chtimes", name); err != nil {
+		return err
+	}
+	return cfs.osDirFS.chtimes(name, atime, mtime)
+}
+
+// rename implements [dirFS].
+func (cfs checkedDirFS) rename(oldname, newname string) error {
+	if err := cfs.check("rename", oldname); err != nil {
+		return err
+	}
+	if err := cfs.check("rename", newname); err != nil {
+		return err
+	}
+	return cfs.osDirFS.rename(oldname, newname)
+}
+
+// remove implements [dirFS].
+func (cfs checkedDirFS) remove(name string) error {
+	if err := cfs.check("remove", name); err != nil {
+		return err
+	}
+	return cfs.osDirFS.remove(name)
+}
+
+// lstat implements [dirFS]. Only the directory of the named file is checked,
+// since the file itself is not followed.
+func (cfs checkedDirFS) lstat(name string) (fs.FileInfo, error) {
+	if err := cfs.check("lstat", path.Dir(name)); err != nil {
+		return nil, err
+	}
+	return cfs.osDirFS.lstat(name)
+}
+
+// readlink implements [dirFS]. Only the directory of the named file is
+// checked, since the file itself is not followed.
+func (cfs checkedDirFS) readlink(name string) (string, error) {
+	if err := cfs.check("readlink", path.Dir(name)); err != nil {
+		return "", err
+	}
+	return cfs.osDirFS.readlink(name)
+}
+
+// symlink implements [dirFS].
+func (cfs checkedDirFS) symlink(target, name string) error {
+	if err := cfs.check("symlink", name); err != nil {
+		return err
+	}
+	return cfs.osDirFS.symlink(target, name)
+}
+
+// ioFS implements [dirFS].
+func (cfs checkedDirFS) ioFS() fs.FS { return checkedFS{cfs} }
+
+// checkedFS is the [fs.FS] of a [checkedDirFS].
+type checkedFS struct{ cfs checkedDirFS }
+
+// Open implements [fs.FS].
+func (cf checkedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return cf.cfs.open(name)
+}
+
+// errPathEscapesDir indicates a path resolves to a location outside of the
+// expected directory.
+var errPathEscapesDir = errors.New("path escapes from cache directory")
+
+// checkFileWithinDir checks whether the file is still within the dir after
+// following symbolic links. Only the longest existing prefix of the file path
+// is resolved, since the rest of it will be created as regular directories and
+// files.
+func checkFileWithinDir(file, dir string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	existing, rest := file, ""
+	for {
+		realExisting, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			file = filepath.Join(realExisting, rest)
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+
+	rel, err := filepath.Rel(realDir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errPathEscapesDir
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+)
+
+// NewShardedCacher returns a [Cacher] that spreads caches across the shards.
+// Each cache is routed to the shard at the index returned by the shardFn for
+// its name, for all operations. When importing cache files in bulk (see
+// [Cacher.Sync]), each extracted file is routed to its shard in the same way,
+// and the shards import their files concurrently with the same options.
+// Note that [SyncOptions.MaxFiles] is additionally enforced on the whole
+// bundle, counting the files that the shards may skip, and that imports are
+// coalesced by [SyncOptions.DedupKey] for the whole bundle rather than by the
+// shards. Symbolic links are routed by their own names, so their targets may
+// end up in other shards.
+//
+// If shardFn is nil, the FNV-1a hash of the name modulo the number of shards
+// is used. The shardFn must return an index in the range [0, len(shards)).
+//
+// The returned [Cacher] implements [Lister] by merging the results of all
+// shards, provided that all of them implement [Lister]. It also implements
+// [Deleter], [Stater], and [RangeReader] by forwarding them to the shard of
+// each name. Those that the shards do not implement fail with an error that
+// matches [ErrUnsupported].
+//
+// Note that the routing depends on the number and order of the shards.
+// Changing either of them invalidates the routing of existing caches, which
+// then appear to be missing until they are fetched again.
+//
+// NewShardedCacher panics if shards is empty.
+func NewShardedCacher(shards []Cacher, shardFn func(name string) int) Cacher {
+	if len(shards) == 0 {
+		panic("goproxy: NewShardedCacher requires at least one shard")
+	}
+	sc := &shardedCacher{shards: append([]Cacher(nil), shards...), shardFn: shardFn}
+	if sc.shardFn == nil {
+		sc.shardFn = func(name string) int {
+			h := fnv.New32a()
+			io.WriteString(h, name)
+			return int(h.Sum32() % uint32(len(sc.shards)))
+		}
+	}
+	return sc
+}
+
+// shardedCacher is the [Cacher] returned by [NewShardedCacher].
+type shardedCacher struct {
+	shards    []Cacher
+	shardFn   func(name string) int
+	syncGroup singleflightGroup
+}
+
+// shard returns the shard for the name.
+func (sc *shardedCacher) shard(name string) (Cacher, error) {
+	i := sc.shardFn(name)
+	if i < 0 || i >= len(sc.shards) {
+		return nil, fmt.Errorf("shard index %d out of range [0, %d) for %q", i, len(sc.shards), name)
+	}
+	return sc.shards[i], nil
+}
+
+// Get implements [Cacher].
+func (sc *shardedCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	shard, err := sc.shard(name)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Get(ctx, name)
+}
+
+// Put implements [Cacher].
+func (sc *shardedCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	shard, err := sc.shard(name)
+	if err != nil {
+		return err
+	}
+	return shard.Put(ctx, name, content)
+}
+
+// Sync implements [Cacher].
+func (sc *shardedCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	if key := opts.DedupKey; key != "" {
+		opts.DedupKey = ""
+		return sc.syncGroup.doInline(ctx, key, func(ctx context.Context) error {
+			return sc.Sync(ctx, uploadCacheDirReader, compressType, opts)
+		})
+	}
+	uploadCacheDirReader, release, err := opts.verifyBundle(uploadCacheDirReader)
+	if err != nil {
+		return err
+	}
+	defer release()
+	opts.SignaturePublicKey, opts.Signature = "", nil
+
+	switch compressType = opts.compressType(compressType); compressType {
+	case "application/gzip":
+		gzipReader, err := opts.gunzip(uploadCacheDirReader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		uploadCacheDirReader = gzipReader
+	case "application/x-tar":
+	default:
+		return unsupportedCompressionError(compressType)
+	}
+
+	outerCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var src syncResultCollector
+	innerOpts := opts
+	innerOpts.OnComplete = src.add
+	innerOpts.Checkpoint, innerOpts.Resume = "", false
+	innerOpts.VerifyZipHashes = false
+	zv := newSyncZipHashVerifier(opts)
+	syncs := make([]*shardSync, len(sc.shards))
+	defer func() {
+		for _, s := range syncs {
+			if s != nil {
+				s.pw.CloseWithError(errors.New("sync aborted"))
+				<-s.done
+			}
+		}
+	}()
+	tarReader := tar.NewReader(uploadCacheDirReader)
+	var count int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.FileInfo().IsDir() {
+			continue
+		}
+		if err := opts.checkFileCount(count); err != nil {
+			return err
+		}
+		count++
+		name := path.Clean(header.Name)
+		i := sc.shardFn(name)
+		if i < 0 || i >= len(sc.shards) {
+			return fmt.Errorf("shard index %d out of range [0, %d) for %q", i, len(sc.shards), header.Name)
+		}
+		s := syncs[i]
+		if s == nil {
+			s = startShardSync(ctx, sc.shards[i], innerOpts)
+			syncs[i] = s
+		}
+		if err := s.tw.WriteHeader(header); err != nil {
+			return s.wait(err)
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		content, done, err := zv.reader(name, tarReader)
+		if err != nil {
+			return s.wait(err)
+		}
+		_, err = io.Copy(s.tw, content)
+		if err := done(err); err != nil {
+			return s.wait(err)
+		}
+	}
+
+	var firstErr error
+	for i, s := range syncs {
+		if s == nil {
+			continue
+		}
+		err := s.tw.Close()
+		if err == nil {
+			err = s.pw.Close()
+		}
+		if err = s.wait(err); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		syncs[i] = nil
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return opts.complete(outerCtx, zv.result(src.result))
+}
+
+// List implements [Lister].
+func (sc *shardedCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for _, shard := range sc.shards {
+		lister, ok := shard.(Lister)
+		if !ok {
+			return nil, fmt.Errorf("listing caches %w", ErrUnsupported)
+		}
+		shardNames, err := lister.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, shardNames...)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements [Deleter].
+func (sc *shardedCacher) Delete(ctx context.Context, name string) error {
+	shard, err := sc.shard(name)
+	if err != nil {
+		return err
+	}
+	deleter, ok := shard.(Deleter)
+	if !ok {
+		return fmt.Errorf("deleting caches %w", ErrUnsupported)
+	}
+	return deleter.Delete(ctx, name)
+}
+
+// Stat implements [Stater].
+func (sc *shardedCacher) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	shard, err := sc.shard(name)
+	if err != nil {
+		return nil, err
+	}
+	stater, ok := shard.(Stater)
+	if !ok {
+		return nil, fmt.Errorf("stating caches %w", ErrUnsupported)
+	}
+	return stater.Stat(ctx, name)
+}
+
+// RangeReadCloser implements [RangeReader].
+func (sc *shardedCacher) RangeReadCloser(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	shard, err := sc.shard(name)
+	if err != nil {
+		return nil, err
+	}
+	rr, ok := shard.(RangeReader)
+	if !ok {
+		return nil, fmt.Errorf("reading ranges of caches %w", ErrUnsupported)
+	}
+	return rr.RangeReadCloser(ctx, name, start, end)
+}
+
+// shardSync is an in-progress import of cache files in bulk into a shard of a
+// [shardedCacher].
+type shardSync struct {
+	pw   *io.PipeWriter
+	tw   *tar.Writer
+	done chan struct{}
+	err  error
+}
+
+// syncResultCollector collects the [SyncResult] values of the imports into
+// other [Cacher] values by [Cacher.Sync], for a [Cacher] that imports through
+// them.
+type syncResultCollector struct {
+	mu     sync.Mutex
+	result SyncResult
+}
+
+// add is a [SyncOptions.OnComplete] that adds the result to the src.
+func (src *syncResultCollector) add(ctx context.Context, result SyncResult) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.result.Files += result.Files
+	src.result.Bytes += result.Bytes
+	src.result.Skipped += result.Skipped
+	src.result.VerifiedZipHashes += result.VerifiedZipHashes
+	return nil
+}
+
+// startShardSync starts importing the cache files written to the returned
+// shardSync into the shard.
+func startShardSync(ctx context.Context, shard Cacher, opts SyncOptions) *shardSync {
+	pr, pw := io.Pipe()
+	s := &shardSync{pw: pw, tw: tar.NewWriter(pw), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		s.err = shard.Sync(ctx, pr, "application/x-tar", opts)
+		if s.err != nil {
+			pr.CloseWithError(s.err)
+		} else {
+			pr.CloseWithError(errors.New("sync finished before all files were written"))
+		}
+	}()
+	return s
+}
+
+// wait waits for the import to complete and returns its error, or the writeErr
+// if the import succeeded but writing to it failed.
+func (s *shardSync) wait(writeErr error) error {
+	if writeErr != nil {
+		s.pw.CloseWithError(writeErr)
+	}
+	<-s.done
+	if s.err != nil {
+		return s.err
+	}
+	return writeErr
+}
@@ -0,0 +1,231 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewShardedCacher(t *testing.T) {
+	names := []string{
+		"example.com/@v/list",
+		"example.com/@v/v1.0.0.info",
+		"example.com/@v/v1.0.0.mod",
+		"example.com/@v/v1.0.0.zip",
+		"example.com/foo/@v/v1.0.0.mod",
+		"example.com/bar/@v/v1.0.0.mod",
+		"sumdb/sum.golang.org/latest",
+	}
+
+	shards := []Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}
+	sc := NewShardedCacher(shards, nil).(*shardedCacher)
+	for _, name := range names {
+		want := sc.shardFn(name)
+		if want < 0 || want >= len(shards) {
+			t.Fatalf("%s: got shard %d, want in [0, %d)", name, want, len(shards))
+		}
+		for i := 0; i < 10; i++ {
+			if got := sc.shardFn(name); got != want {
+				t.Errorf("%s: got shard %d, want %d", name, got, want)
+			}
+		}
+		other := NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil).(*shardedCacher)
+		if got := other.shardFn(name); got != want {
+			t.Errorf("%s: got shard %d, want %d", name, got, want)
+		}
+
+		if err := sc.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+			t.Fatalf("%s: unexpected error %q", name, err)
+		}
+		for i, shard := range shards {
+			rc, err := shard.Get(context.Background(), name)
+			if i != want {
+				if err == nil {
+					rc.Close()
+					t.Errorf("%s: unexpected cache in shard %d", name, i)
+				} else if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s: unexpected error %q", name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error %q", name, err)
+			}
+			rc.Close()
+		}
+		if rc, err := sc.Get(context.Background(), name); err != nil {
+			t.Fatalf("%s: unexpected error %q", name, err)
+		} else if b, err := io.ReadAll(rc); err != nil {
+			t.Errorf("%s: unexpected error %q", name, err)
+		} else if err := rc.Close(); err != nil {
+			t.Errorf("%s: unexpected error %q", name, err)
+		} else if got, want := string(b), name; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if got, err := sc.List(context.Background(), "example.com/@v/"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(got, ","), strings.Join(names[:4], ","); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, name := range names {
+		if fi, err := sc.Stat(context.Background(), name); err != nil {
+			t.Fatalf("%s: unexpected error %q", name, err)
+		} else if got, want := fi.Size(), int64(len(name)); got != want {
+			t.Errorf("%s: got %d, want %d", name, got, want)
+		}
+	}
+	if err := sc.Delete(context.Background(), names[0]); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := shards[sc.shardFn(names[0])].Get(context.Background(), names[0]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+
+	var rangeShards []int
+	rangeShardCachers := make([]Cacher, len(shards))
+	for i := range shards {
+		i := i
+		rangeShardCachers[i] = &testRangeCacher{
+			Cacher: shards[i],
+			rangeReadCloser: func(ctx context.Context, c Cacher, name string, start, end int64) (io.ReadCloser, error) {
+				rangeShards = append(rangeShards, i)
+				return io.NopCloser(strings.NewReader(name[start : end+1])), nil
+			},
+		}
+	}
+	rsc := NewShardedCacher(rangeShardCachers, nil).(*shardedCacher)
+	for _, name := range names {
+		rangeShards = nil
+		if rc, err := rsc.RangeReadCloser(context.Background(), name, 0, 6); err != nil {
+			t.Fatalf("%s: unexpected error %q", name, err)
+		} else {
+			rc.Close()
+		}
+		if got, want := fmt.Sprint(rangeShards), fmt.Sprint([]int{rsc.shardFn(name)}); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+
+	usc := NewShardedCacher([]Cacher{&testCacher{Cacher: shards[0]}}, nil).(*shardedCacher)
+	for _, err := range []error{
+		func() error { _, err := usc.List(context.Background(), ""); return err }(),
+		usc.Delete(context.Background(), "example.com/@v/list"),
+		func() error { _, err := usc.Stat(context.Background(), "example.com/@v/list"); return err }(),
+		func() error {
+			_, err := usc.RangeReadCloser(context.Background(), "example.com/@v/list", 0, 1)
+			return err
+		}(),
+	} {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("got %v, want ErrUnsupported", err)
+		}
+	}
+
+	sc = NewShardedCacher(shards, func(name string) int { return 3 }).(*shardedCacher)
+	if _, err := sc.Get(context.Background(), "example.com/@v/list"); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, errors.New(`shard index 3 out of range [0, 3) for "example.com/@v/list"`); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic")
+			}
+		}()
+		NewShardedCacher(nil, nil)
+	}()
+}
+
+func TestShardedCacherSync(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{
+		"./example.com/@v/list":       []byte("v1.0.0"),
+		"./example.com/@v/v1.0.0.mod": []byte("module example.com"),
+		"./example.org/@v/list":       []byte("v1.1.0"),
+		"./example.org/@v/v1.1.0.mod": []byte("module example.org"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	shardFn := func(name string) int {
+		if strings.HasPrefix(name, "example.com/") {
+			return 0
+		}
+		return 1
+	}
+
+	for _, tt := range []struct {
+		n         int
+		shards    int
+		wantFiles [][]string
+	}{
+		{
+			n:      1,
+			shards: 2,
+			wantFiles: [][]string{
+				{"example.com/@v/list", "example.com/@v/v1.0.0.mod"},
+				{"example.org/@v/list", "example.org/@v/v1.1.0.mod"},
+			},
+		},
+		{
+			n:      2,
+			shards: 3,
+			wantFiles: [][]string{
+				{"example.com/@v/list", "example.com/@v/v1.0.0.mod"},
+				{"example.org/@v/list", "example.org/@v/v1.1.0.mod"},
+				nil,
+			},
+		},
+	} {
+		shards := make([]Cacher, tt.shards)
+		dirs := make([]string, tt.shards)
+		for i := range shards {
+			dirs[i] = t.TempDir()
+			shards[i] = &DirCacher{Dir: dirs[i]}
+		}
+		sc := NewShardedCacher(shards, shardFn)
+		if err := sc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{}); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		for i, dir := range dirs {
+			if got, want := strings.Join(walkDirFiles(t, dir), ","), strings.Join(tt.wantFiles[i], ","); got != want {
+				t.Errorf("test(%d): shard %d: got %q, want %q", tt.n, i, got, want)
+			}
+		}
+	}
+
+	sc := NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, shardFn)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{DedupKey: "foobar"}); err != nil {
+				t.Errorf("unexpected error %q", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := sc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{MinFreeBytes: 1 << 62}); err == nil {
+		t.Fatal("expected error")
+	} else if _, serr := freeSpace(t.TempDir()); serr == nil && !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrInsufficientSpace)
+	}
+
+	if err := sc.Sync(context.Background(), bytes.NewReader(bundle), "application/zip", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err.Error(), `unsupported compress type "application/zip" (supported: application/gzip, application/x-tar)`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
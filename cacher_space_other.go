@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package goproxy
+
+import "errors"
+
+// freeSpace returns the number of bytes available on the filesystem
+// containing the dir. It is not supported on this platform.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("checking available disk space is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package goproxy
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem containing the dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	if int64(st.Bavail) < 0 {
+		return 0, nil
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,23 @@
+package goproxy
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// procGetDiskFreeSpaceExW is the GetDiskFreeSpaceExW function of kernel32.dll.
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the number of bytes available to the caller on the
+// filesystem containing the dir.
+func freeSpace(dir string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytesAvailable uint64
+	if r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&freeBytesAvailable)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return int64(freeBytesAvailable), nil
+}
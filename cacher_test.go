@@ -1,18 +1,34 @@
 package goproxy
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDirCacher(t *testing.T) {
-	dirCacher := DirCacher(t.TempDir())
+	dirCacher := &DirCacher{Dir: t.TempDir()}
 
 	if rc, err := dirCacher.Get(context.Background(), "a/b/c"); err == nil {
 		t.Fatal("expected error")
@@ -26,13 +42,13 @@ func TestDirCacher(t *testing.T) {
 		t.Fatalf("unexpected error %q", err)
 	}
 
-	if fi, err := os.Stat(filepath.Join(string(dirCacher), filepath.FromSlash("a/b"))); err != nil {
+	if fi, err := os.Stat(filepath.Join(dirCacher.Dir, filepath.FromSlash("a/b"))); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	} else if got, want := fi.Mode().Perm(), os.FileMode(0o755).Perm(); got != want {
 		t.Errorf("got %d, want %d", got, want)
 	}
 
-	if fi, err := os.Stat(filepath.Join(string(dirCacher), filepath.FromSlash("a/b/c"))); err != nil {
+	if fi, err := os.Stat(filepath.Join(dirCacher.Dir, filepath.FromSlash("a/b/c"))); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	} else if got, want := fi.Mode().Perm(), os.FileMode(0o644).Perm(); got != want {
 		t.Errorf("got %d, want %d", got, want)
@@ -61,8 +77,3329 @@ func TestDirCacher(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 
-	dirCacher = DirCacher(filepath.Join(string(dirCacher), filepath.FromSlash("a/b/c")))
+	dirCacher = &DirCacher{Dir: filepath.Join(dirCacher.Dir, filepath.FromSlash("a/b/c"))}
 	if err := dirCacher.Put(context.Background(), "d/e/f", strings.NewReader("foobar")); err == nil {
 		t.Fatal("expected error")
 	}
 }
+
+func TestDirCacherGetErrors(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.info", strings.NewReader("{}")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	if _, err := dc.Get(context.Background(), "example.com/@v/v1.1.0.info"); err != fs.ErrNotExist {
+		t.Errorf("got %v, want exactly fs.ErrNotExist", err)
+	}
+
+	_, err := dc.Get(context.Background(), "example.com/@v")
+	if !errors.Is(err, ErrIsDir) {
+		t.Errorf("got %v, want ErrIsDir", err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want not fs.ErrNotExist", err)
+	}
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("got %T, want *fs.PathError", err)
+	} else if got, want := pathErr.Op+" "+pathErr.Path, "get example.com/@v"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	file := filepath.Join(dc.Dir, "example.com", "@v", "v1.0.0.info")
+	if err := os.Chmod(file, 0); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer os.Chmod(file, 0o644)
+	if f, err := os.Open(file); err == nil {
+		f.Close()
+		t.Skip("skipping test: file permissions are not enforced")
+	}
+	_, err = dc.Get(context.Background(), "example.com/@v/v1.0.0.info")
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, want fs.ErrPermission", err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want not fs.ErrNotExist", err)
+	}
+	if !errors.As(err, &pathErr) {
+		t.Errorf("got %T, want *fs.PathError", err)
+	} else if got, want := pathErr.Op+" "+pathErr.Path, "get example.com/@v/v1.0.0.info"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherStat(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.info", strings.NewReader("foobar")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if fi, err := dc.Stat(context.Background(), "example.com/@v/v1.0.0.info"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := fi.Size(), int64(len("foobar")); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if _, err := dc.Stat(context.Background(), "example.com/@v/v1.1.0.info"); err != fs.ErrNotExist {
+		t.Errorf("got %v, want exactly fs.ErrNotExist", err)
+	}
+	_, err := dc.Stat(context.Background(), "example.com/@v")
+	if !errors.Is(err, ErrIsDir) {
+		t.Errorf("got %v, want ErrIsDir", err)
+	}
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("got %T, want *fs.PathError", err)
+	} else if got, want := pathErr.Op+" "+pathErr.Path, "stat example.com/@v"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := dc.Stat(context.Background(), "../example.com/@v/v1.0.0.info"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDirCacherNowFunc(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	dirCacher := &DirCacher{Dir: t.TempDir(), nowFunc: func() time.Time { return now }}
+	if err := dirCacher.Put(context.Background(), "a/b/c", strings.NewReader("foobar")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dirCacher.Dir, filepath.FromSlash("a/b/c"))); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := fi.ModTime(), now; !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if rc, err := dirCacher.Get(context.Background(), "a/b/c"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if mt, ok := rc.(interface{ ModTime() time.Time }); !ok {
+		t.Fatal("expected ModTime method")
+	} else if got, want := mt.ModTime(), now; !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	} else if err := rc.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
+
+func TestDirCacherKeepFailedTemp(t *testing.T) {
+	for _, tt := range []struct {
+		n              int
+		keepFailedTemp bool
+		contentErr     error
+		wantFiles      []string
+	}{
+		{
+			n:         1,
+			wantFiles: []string{"a/b/c"},
+		},
+		{
+			n:              2,
+			keepFailedTemp: true,
+			wantFiles:      []string{"a/b/c"},
+		},
+		{
+			n:          3,
+			contentErr: errors.New("cannot read"),
+		},
+		{
+			n:              4,
+			keepFailedTemp: true,
+			contentErr:     errors.New("cannot read"),
+			wantFiles:      []string{"a/b/.c.tmp.*"},
+		},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), KeepFailedTemp: tt.keepFailedTemp}
+		err := dirCacher.Put(context.Background(), "a/b/c", &testReadSeeker{
+			ReadSeeker: strings.NewReader("foobar"),
+			read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+				if tt.contentErr != nil {
+					return 0, tt.contentErr
+				}
+				return rs.Read(p)
+			},
+		})
+		if tt.contentErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if !errors.Is(err, tt.contentErr) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, tt.contentErr)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+
+		files := walkDirFiles(t, dirCacher.Dir)
+		if got, want := len(files), len(tt.wantFiles); got != want {
+			t.Fatalf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		for i, file := range files {
+			if matched, _ := path.Match(tt.wantFiles[i], file); !matched {
+				t.Errorf("test(%d): got %q, want %q", tt.n, file, tt.wantFiles[i])
+			}
+			if tt.keepFailedTemp && tt.contentErr != nil && !strings.Contains(err.Error(), file) {
+				t.Errorf("test(%d): got %q, want it to contain %q", tt.n, err, file)
+			}
+		}
+	}
+}
+
+func TestDirCacherTempNaming(t *testing.T) {
+	for _, tt := range []struct {
+		n                int
+		tempPattern      string
+		tempSubdir       string
+		restrictSymlinks bool
+		spoolDir         bool
+		wantFailedFiles  []string
+		wantFiles        []string
+	}{
+		{
+			n:               1,
+			wantFailedFiles: []string{"a/b/.c.tmp.*"},
+			wantFiles:       []string{"a/b/c"},
+		},
+		{
+			n:               2,
+			tempPattern:     ".{name}.partial-*",
+			wantFailedFiles: []string{"a/b/.c.partial-*"},
+			wantFiles:       []string{"a/b/c"},
+		},
+		{
+			n:               3,
+			tempSubdir:      ".tmp",
+			wantFailedFiles: []string{".tmp/.c.tmp.*"},
+			wantFiles:       []string{"a/b/c"},
+		},
+		{
+			n:               4,
+			tempPattern:     "{name}-{name}.*",
+			tempSubdir:      ".tmp/goproxy/",
+			wantFailedFiles: []string{".tmp/goproxy/c-c.*"},
+			wantFiles:       []string{"a/b/c"},
+		},
+		{
+			n:                5,
+			tempSubdir:       ".tmp",
+			restrictSymlinks: true,
+			wantFailedFiles:  []string{".tmp/.c.tmp.*"},
+			wantFiles:        []string{"a/b/c"},
+		},
+		{
+			n:               6,
+			tempPattern:     ".{name}.partial-*",
+			tempSubdir:      ".tmp",
+			spoolDir:        true,
+			wantFailedFiles: []string{"spool/.c.partial-*"},
+			wantFiles:       []string{"a/b/c"},
+		},
+	} {
+		root := t.TempDir()
+		dirCacher := &DirCacher{
+			Dir:              filepath.Join(root, "cache"),
+			TempPattern:      tt.tempPattern,
+			TempSubdir:       tt.tempSubdir,
+			RestrictSymlinks: tt.restrictSymlinks,
+			KeepFailedTemp:   true,
+		}
+		if tt.spoolDir {
+			dirCacher.SpoolDir = filepath.Join(root, "spool")
+		}
+		if err := dirCacher.Put(context.Background(), "a/b/c", &testReadSeeker{
+			ReadSeeker: strings.NewReader("foobar"),
+			read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+				return 0, errors.New("cannot read")
+			},
+		}); err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		}
+		files := walkDirFiles(t, root)
+		if got, want := len(files), len(tt.wantFailedFiles); got != want {
+			t.Fatalf("test(%d): got %q, want %q", tt.n, files, tt.wantFailedFiles)
+		}
+		for i, file := range files {
+			file = strings.TrimPrefix(file, "cache/")
+			if matched, _ := path.Match(tt.wantFailedFiles[i], file); !matched {
+				t.Errorf("test(%d): got %q, want %q", tt.n, file, tt.wantFailedFiles[i])
+			}
+		}
+		for _, file := range files {
+			if err := os.Remove(filepath.Join(root, filepath.FromSlash(file))); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+
+		if err := dirCacher.Put(context.Background(), "a/b/c", strings.NewReader("foobar")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := walkDirFiles(t, dirCacher.Dir), tt.wantFiles; !reflect.DeepEqual(got, want) {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if names, err := dirCacher.List(context.Background(), ""); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := names, []string{"a/b/c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherInvalidTempSubdir(t *testing.T) {
+	for _, tt := range []struct {
+		n          int
+		tempSubdir string
+		wantErr    error
+	}{
+		{1, ".tmp/../.tmp2", nil},
+		{2, "..", errors.New(`invalid temp subdir ".."`)},
+		{3, ".tmp/../../tmp", errors.New(`invalid temp subdir ".tmp/../../tmp"`)},
+		{4, "/tmp", errors.New(`invalid temp subdir "/tmp"`)},
+		{5, ".", errors.New(`invalid temp subdir "."`)},
+		{6, `..\tmp`, errors.New(`invalid temp subdir "..\\tmp"`)},
+	} {
+		root := t.TempDir()
+		dirCacher := &DirCacher{Dir: filepath.Join(root, "cache"), TempSubdir: tt.tempSubdir}
+		err := dirCacher.Put(context.Background(), "a/b/c", strings.NewReader("foobar"))
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got := walkDirFiles(t, root); len(got) != 0 {
+				t.Errorf("test(%d): got %q, want none", tt.n, got)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+	}
+}
+
+func TestDirCacherDetectCaseCollisions(t *testing.T) {
+	for _, tt := range []struct {
+		n                    int
+		existing             string
+		name                 string
+		detectCaseCollisions bool
+		directWrite          bool
+		restrictSymlinks     bool
+		wantErr              error
+	}{
+		{
+			n:        1,
+			existing: "example.com/@v/v1.0.0-RC1.info",
+			name:     "example.com/@v/v1.0.0-rc1.info",
+		},
+		{
+			n:                    2,
+			existing:             "example.com/@v/v1.0.0-RC1.info",
+			name:                 "example.com/@v/v1.0.0-rc1.info",
+			detectCaseCollisions: true,
+			wantErr:              fmt.Errorf("%w: example.com/@v/v1.0.0-rc1.info collides with example.com/@v/v1.0.0-RC1.info", ErrNameCollision),
+		},
+		{
+			n:                    3,
+			existing:             "Example.com/@v/list",
+			name:                 "example.com/@v/list",
+			detectCaseCollisions: true,
+			wantErr:              fmt.Errorf("%w: example.com/@v/list collides with Example.com", ErrNameCollision),
+		},
+		{
+			n:                    4,
+			existing:             "example.com/@v/v1.0.0-RC1.info",
+			name:                 "example.com/@v/v1.0.0-rc1.info",
+			detectCaseCollisions: true,
+			directWrite:          true,
+			wantErr:              fmt.Errorf("%w: example.com/@v/v1.0.0-rc1.info collides with example.com/@v/v1.0.0-RC1.info", ErrNameCollision),
+		},
+		{
+			n:                    5,
+			existing:             "example.com/@v/v1.0.0-RC1.info",
+			name:                 "example.com/@v/v1.0.0-rc1.info",
+			detectCaseCollisions: true,
+			restrictSymlinks:     true,
+			wantErr:              fmt.Errorf("%w: example.com/@v/v1.0.0-rc1.info collides with example.com/@v/v1.0.0-RC1.info", ErrNameCollision),
+		},
+		{
+			n:                    6,
+			existing:             "example.com/@v/v1.0.0.info",
+			name:                 "example.com/@v/v1.0.0.info",
+			detectCaseCollisions: true,
+		},
+		{
+			n:                    7,
+			existing:             "example.com/@v/v1.0.0.info",
+			name:                 "example.com/@v/v1.1.0.info",
+			detectCaseCollisions: true,
+		},
+	} {
+		dirCacher := &DirCacher{
+			Dir:                  t.TempDir(),
+			DetectCaseCollisions: tt.detectCaseCollisions,
+			DirectWrite:          tt.directWrite,
+			RestrictSymlinks:     tt.restrictSymlinks,
+		}
+		if err := os.MkdirAll(filepath.Join(dirCacher.Dir, filepath.Dir(filepath.FromSlash(tt.existing))), 0o755); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if err := os.WriteFile(filepath.Join(dirCacher.Dir, filepath.FromSlash(tt.existing)), []byte("existing"), 0o644); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		err := dirCacher.Put(context.Background(), tt.name, strings.NewReader("new"))
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			} else if !errors.Is(err, ErrNameCollision) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, ErrNameCollision)
+			}
+			if _, err := os.Stat(filepath.Join(dirCacher.Dir, filepath.FromSlash(tt.name))); !os.IsNotExist(err) {
+				t.Errorf("test(%d): got %v, want %v", tt.n, err, os.ErrNotExist)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, filepath.FromSlash(tt.existing))); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), "existing"; tt.existing != tt.name && got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		for _, file := range walkDirFiles(t, dirCacher.Dir) {
+			if strings.Contains(file, ".tmp.") {
+				t.Errorf("test(%d): got temporary file %q left behind", tt.n, file)
+			}
+		}
+	}
+}
+
+func TestDirCacherDirectWrite(t *testing.T) {
+	for _, tt := range []struct {
+		n                int
+		directWrite      bool
+		restrictSymlinks bool
+		existing         bool
+		contentErr       error
+		wantFiles        []string
+		wantDuringWrite  []string
+		wantContent      string
+	}{
+		{
+			n:               1,
+			existing:        true,
+			wantFiles:       []string{"a/b/c"},
+			wantDuringWrite: []string{"a/b/.c.tmp.*", "a/b/c"},
+			wantContent:     "foobar",
+		},
+		{
+			n:               2,
+			directWrite:     true,
+			wantFiles:       []string{"a/b/c"},
+			wantDuringWrite: []string{"a/b/c"},
+			wantContent:     "foobar",
+		},
+		{
+			n:                3,
+			directWrite:      true,
+			restrictSymlinks: true,
+			wantFiles:        []string{"a/b/c"},
+			wantDuringWrite:  []string{"a/b/c"},
+			wantContent:      "foobar",
+		},
+		{
+			n:               4,
+			directWrite:     true,
+			contentErr:      errors.New("cannot read"),
+			wantDuringWrite: []string{"a/b/c"},
+		},
+		{
+			n:               5,
+			directWrite:     true,
+			existing:        true,
+			wantFiles:       []string{"a/b/c"},
+			wantDuringWrite: []string{"a/b/.c.tmp.*", "a/b/c"},
+			wantContent:     "foobar",
+		},
+		{
+			n:               6,
+			directWrite:     true,
+			existing:        true,
+			contentErr:      errors.New("cannot read"),
+			wantFiles:       []string{"a/b/c"},
+			wantDuringWrite: []string{"a/b/.c.tmp.*", "a/b/c"},
+			wantContent:     "old",
+		},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), DirectWrite: tt.directWrite, RestrictSymlinks: tt.restrictSymlinks}
+		if tt.existing {
+			if err := dirCacher.Put(context.Background(), "a/b/c", strings.NewReader("old")); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		var duringWrite []string
+		err := dirCacher.Put(context.Background(), "a/b/c", &testReadSeeker{
+			ReadSeeker: strings.NewReader("foobar"),
+			read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+				if duringWrite == nil {
+					duringWrite = walkDirFiles(t, dirCacher.Dir)
+				}
+				if tt.contentErr != nil {
+					return 0, tt.contentErr
+				}
+				return rs.Read(p)
+			},
+		})
+		if tt.contentErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if !errors.Is(err, tt.contentErr) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, tt.contentErr)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+
+		if got, want := len(duringWrite), len(tt.wantDuringWrite); got != want {
+			t.Fatalf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		for i, file := range duringWrite {
+			if matched, _ := path.Match(tt.wantDuringWrite[i], file); !matched {
+				t.Errorf("test(%d): got %q, want %q", tt.n, file, tt.wantDuringWrite[i])
+			}
+		}
+		if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), strings.Join(tt.wantFiles, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.wantContent == "" {
+			continue
+		}
+		if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "a", "b", "c")); err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherSpoolDir(t *testing.T) {
+	for _, tt := range []struct {
+		n                int
+		restrictSymlinks bool
+		crossDevice      bool
+		renameErr        error
+		wantRenames      int
+		wantErr          error
+		wantContent      string
+	}{
+		{
+			n:           1,
+			wantRenames: 1,
+			wantContent: "foobar",
+		},
+		{
+			n:           2,
+			crossDevice: true,
+			wantRenames: 1,
+			wantContent: "foobar",
+		},
+		{
+			n:           3,
+			renameErr:   errors.New("cannot rename"),
+			wantRenames: 1,
+			wantErr:     errors.New("cannot rename"),
+			wantContent: "old",
+		},
+		{
+			n:                4,
+			restrictSymlinks: true,
+			wantContent:      "foobar",
+		},
+	} {
+		renameErr := tt.renameErr
+		if tt.crossDevice {
+			if crossDeviceErrno == nil {
+				continue
+			}
+			renameErr = &os.LinkError{Op: "rename", Err: crossDeviceErrno}
+		}
+		dirCacher := &DirCacher{
+			Dir:              t.TempDir(),
+			SpoolDir:         filepath.Join(t.TempDir(), "spool"),
+			RestrictSymlinks: tt.restrictSymlinks,
+		}
+		if err := dirCacher.Put(context.Background(), "a/b/c", strings.NewReader("old")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		var renames int
+		dirCacher.renameFunc = func(oldpath, newpath string) error {
+			renames++
+			if renameErr != nil {
+				return renameErr
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		var duringWrite, spoolDuringWrite []string
+		err := dirCacher.Put(context.Background(), "a/b/c", &testReadSeeker{
+			ReadSeeker: strings.NewReader("foobar"),
+			read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+				if duringWrite == nil {
+					duringWrite = walkDirFiles(t, dirCacher.Dir)
+					spoolDuringWrite = walkDirFiles(t, dirCacher.SpoolDir)
+				}
+				return rs.Read(p)
+			},
+		})
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+
+		if got, want := renames, tt.wantRenames; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := strings.Join(duringWrite, ","), "a/b/c"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := len(spoolDuringWrite), 1; got != want {
+			t.Fatalf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if matched, _ := path.Match(".c.tmp.*", spoolDuringWrite[0]); !matched {
+			t.Errorf("test(%d): got %q, want %q", tt.n, spoolDuringWrite[0], ".c.tmp.*")
+		}
+		if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), "a/b/c"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got := walkDirFiles(t, dirCacher.SpoolDir); len(got) != 0 {
+			t.Errorf("test(%d): got %q, want none", tt.n, got)
+		}
+		if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "a", "b", "c")); err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherTrackAccess(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		trackAccess bool
+		wantNames   []string
+	}{
+		{1, true, []string{"a/c", "a/b", "a/d"}},
+		{2, false, []string{}},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), TrackAccess: tt.trackAccess}
+		for _, name := range []string{"a/b", "a/c", "a/d"} {
+			if err := dirCacher.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		for _, name := range []string{"a/b", "a/e", "a/d"} {
+			if rc, err := dirCacher.Get(context.Background(), name); err == nil {
+				rc.Close()
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		if got, want := dirCacher.LeastRecentlyUsed(-1), tt.wantNames; !reflect.DeepEqual(got, want) {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := len(dirCacher.LeastRecentlyUsed(len(tt.wantNames)+1)), len(tt.wantNames); got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if len(tt.wantNames) > 0 {
+			if got, want := dirCacher.LeastRecentlyUsed(1), tt.wantNames[:1]; !reflect.DeepEqual(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir(), TrackAccess: true}
+	if err := dirCacher.Put(context.Background(), "a/b", strings.NewReader("foobar")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if rc, err := dirCacher.Get(context.Background(), "a/b"); err != nil {
+					t.Errorf("unexpected error %q", err)
+				} else {
+					rc.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := dirCacher.LeastRecentlyUsed(-1), []string{"a/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherTopEntries(t *testing.T) {
+	at := func(seconds int) time.Time {
+		return time.Date(2000, 1, 1, 0, 0, seconds, 0, time.UTC)
+	}
+	var now time.Time
+	dirCacher := &DirCacher{
+		Dir:         t.TempDir(),
+		TrackAccess: true,
+		nowFunc:     func() time.Time { return now },
+	}
+	for i, name := range []string{"a/b", "a/c", "a/d", "a/e"} {
+		now = at(i + 1)
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for i, name := range []string{"a/c", "a/b", "a/c", "a/d", "a/c", "a/b", "a/f"} {
+		now = at(i + 5)
+		if rc, err := dirCacher.Get(context.Background(), name); err == nil {
+			rc.Close()
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n         int
+		limit     int
+		wantStats []EntryStat
+	}{
+		{1, -1, []EntryStat{
+			{Name: "a/c", Hits: 3, LastAccess: at(9)},
+			{Name: "a/b", Hits: 2, LastAccess: at(10)},
+			{Name: "a/d", Hits: 1, LastAccess: at(8)},
+			{Name: "a/e", Hits: 0, LastAccess: at(4)},
+		}},
+		{2, 2, []EntryStat{
+			{Name: "a/c", Hits: 3, LastAccess: at(9)},
+			{Name: "a/b", Hits: 2, LastAccess: at(10)},
+		}},
+		{3, 0, []EntryStat{}},
+		{4, 10, []EntryStat{
+			{Name: "a/c", Hits: 3, LastAccess: at(9)},
+			{Name: "a/b", Hits: 2, LastAccess: at(10)},
+			{Name: "a/d", Hits: 1, LastAccess: at(8)},
+			{Name: "a/e", Hits: 0, LastAccess: at(4)},
+		}},
+	} {
+		stats, err := dirCacher.TopEntries(context.Background(), tt.limit)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := stats, tt.wantStats; !reflect.DeepEqual(got, want) {
+			t.Errorf("test(%d): got %+v, want %+v", tt.n, got, want)
+		}
+	}
+
+	if err := dirCacher.Delete(context.Background(), "a/c"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if stats, err := dirCacher.TopEntries(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := stats, []EntryStat{{Name: "a/b", Hits: 2, LastAccess: at(10)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dirCacher.TopEntries(ctx, -1); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !errors.Is(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherSizeByPrefix(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	for name, content := range map[string]string{
+		"github.com/foo/bar/@v/list":          "v1.0.0",
+		"github.com/foo/bar/@v/v1.0.0.zip":    "0123456789",
+		"github.com/foo/baz/@v/v1.0.0.mod":    "module github.com/foo/baz",
+		"github.com/qux/@v/v1.0.0.info":       "{}",
+		"github.com/!quux/a/b/@v/v1.0.0.info": "{}",
+		"example.com/@latest":                 "{}",
+		"sumdb/sum.golang.org/lookup/foo":     "foo",
+	} {
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for name, content := range map[string]string{
+		"github.com/foo/bar/@v/v1.0.0.lock": "lock",
+		"github.com/foo/bar/@v/.v1.0.0.tmp": "temporary",
+		"github.com/foo/.staging/@v/list":   "hidden",
+	} {
+		file := filepath.Join(dirCacher.Dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n         int
+		depth     int
+		wantSizes map[string]int64
+		wantErr   error
+	}{
+		{1, 2, map[string]int64{
+			"github.com/foo":       6 + 10 + 25,
+			"github.com/qux":       2,
+			"github.com/!quux":     2,
+			"example.com":          2,
+			"sumdb/sum.golang.org": 3,
+		}, nil},
+		{2, 1, map[string]int64{
+			"github.com":  6 + 10 + 25 + 2 + 2,
+			"example.com": 2,
+			"sumdb":       3,
+		}, nil},
+		{3, 0, nil, errors.New("invalid depth 0")},
+	} {
+		sizes, err := dirCacher.SizeByPrefix(context.Background(), tt.depth)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := sizes, tt.wantSizes; !reflect.DeepEqual(got, want) {
+				t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+			}
+		}
+	}
+
+	if sizes, err := (&DirCacher{Dir: filepath.Join(t.TempDir(), "nonexistent")}).SizeByPrefix(context.Background(), 2); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got := len(sizes); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+}
+
+func TestDirCacherCopyBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		n              int
+		copyBufferSize int
+		wantReadSize   int
+	}{
+		{1, 0, 32 << 10},
+		{2, 1 << 20, 1 << 20},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), CopyBufferSize: tt.copyBufferSize}
+		for i := 0; i < 2; i++ {
+			var maxReadSize int
+			if err := dirCacher.Put(context.Background(), "a/b/c", &testReadSeeker{
+				ReadSeeker: bytes.NewReader(make([]byte, 2<<20)),
+				read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+					if len(p) > maxReadSize {
+						maxReadSize = len(p)
+					}
+					return rs.Read(p)
+				},
+			}); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := maxReadSize, tt.wantReadSize; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestDirCacherRestrictSymlinks(t *testing.T) {
+	outsideDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outsideDir, "secret"), []byte("foobar"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(outsideDir, filepath.Join(dir, "outside")); err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "inside"), 0o755); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "inside", "file"), []byte("foobar"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := os.Symlink("inside", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	for _, tt := range []struct {
+		n                int
+		restrictSymlinks bool
+		name             string
+		wantErr          bool
+	}{
+		{1, false, "outside/secret", false},
+		{2, true, "outside/secret", true},
+		{3, true, "outside/a/b", true},
+		{4, true, "link/file", false},
+		{5, true, "inside/file", false},
+		{6, true, "../secret", true},
+	} {
+		dirCacher := &DirCacher{Dir: dir, RestrictSymlinks: tt.restrictSymlinks}
+		rc, err := dirCacher.Get(context.Background(), tt.name)
+		if err == nil {
+			rc.Close()
+		}
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			}
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+
+		if !tt.restrictSymlinks {
+			continue
+		}
+		if err := dirCacher.Put(context.Background(), tt.name, strings.NewReader("foobar")); tt.wantErr {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+	}
+	if got, want := strings.Join(walkDirFiles(t, outsideDir), ","), "secret"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		n                int
+		restrictSymlinks bool
+		prefix           string
+		wantNames        string
+		wantErr          bool
+	}{
+		{1, false, "outside/", "outside/secret", false},
+		{2, true, "outside/", "", true},
+		{3, true, "link/", "link/file", false},
+		{4, true, "", "inside/file,link,outside", false},
+	} {
+		dirCacher := &DirCacher{Dir: dir, RestrictSymlinks: tt.restrictSymlinks}
+		names, err := dirCacher.List(context.Background(), tt.prefix)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(names, ","), tt.wantNames; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if err := dirCacher.Close(); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if tt.restrictSymlinks {
+			if got, want := dirCacher.restrictedFS, dirFS(nil); got != want {
+				t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestContentSize(t *testing.T) {
+	for _, tt := range []struct {
+		n        int
+		content  io.ReadSeeker
+		wantSize int64
+		wantErr  error
+	}{
+		{
+			n:        1,
+			content:  strings.NewReader("foobar"),
+			wantSize: 6,
+		},
+		{
+			n: 2,
+			content: &testReadSeeker{
+				ReadSeeker: strings.NewReader("foobar"),
+				seek: func(rs io.ReadSeeker, offset int64, whence int) (int64, error) {
+					return 0, errors.New("cannot seek")
+				},
+			},
+			wantErr: errors.New("cannot seek"),
+		},
+		{
+			n:        3,
+			content:  &testReadSeeker{ReadSeeker: strings.NewReader("foobar")},
+			wantSize: 6,
+		},
+		{
+			n: 4,
+			content: struct {
+				io.ReadSeeker
+				Sizer
+			}{
+				&testReadSeeker{
+					ReadSeeker: strings.NewReader("foobar"),
+					seek: func(rs io.ReadSeeker, offset int64, whence int) (int64, error) {
+						return 0, errors.New("cannot seek")
+					},
+				},
+				strings.NewReader("foo"),
+			},
+			wantSize: 3,
+		},
+	} {
+		size, err := ContentSize(tt.content)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := size, tt.wantSize; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if b, err := io.ReadAll(tt.content); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), "foobar"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestContentBuffer(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		maxMemory   int64
+		content     string
+		wantSpilled bool
+	}{
+		{1, 16, "foobar", false},
+		{2, 6, "foobar", false},
+		{3, 5, "foobar", true},
+		{4, -1, "foobar", true},
+		{5, 16, "", false},
+	} {
+		tempDir := t.TempDir()
+		cb := contentBuffer{maxMemory: tt.maxMemory, tempDir: tempDir}
+		rs, release, err := cb.buffer(io.MultiReader(strings.NewReader(tt.content)))
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		f, spilled := rs.(*os.File)
+		if got, want := spilled, tt.wantSpilled; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+		if got, want := len(walkDirFiles(t, tempDir)), 0; !spilled && got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if size, err := ContentSize(rs); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := size, int64(len(tt.content)); got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(rs); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.content; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		release()
+		if spilled {
+			if got, want := filepath.Dir(f.Name()), tempDir; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if _, err := os.Stat(f.Name()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("test(%d): expected fs.ErrNotExist, got %v", tt.n, err)
+			}
+		}
+	}
+}
+
+func TestPutAll(t *testing.T) {
+	for _, tt := range []struct {
+		n         int
+		cacher    func(dir string, puts *[]string) Cacher
+		cancelCtx bool
+		wantPuts  []string
+		wantErr   error
+		wantFiles []string
+	}{
+		{
+			n: 1,
+			cacher: func(dir string, puts *[]string) Cacher {
+				return &DirCacher{Dir: dir}
+			},
+			wantFiles: []string{"a/b", "a/c", "d/e"},
+		},
+		{
+			n: 2,
+			cacher: func(dir string, puts *[]string) Cacher {
+				return &testCacher{
+					Cacher: &DirCacher{Dir: dir},
+					put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+						*puts = append(*puts, name)
+						return c.Put(ctx, name, content)
+					},
+				}
+			},
+			wantPuts:  []string{"a/b", "a/c", "d/e"},
+			wantFiles: []string{"a/b", "a/c", "d/e"},
+		},
+		{
+			n: 3,
+			cacher: func(dir string, puts *[]string) Cacher {
+				return &testCacher{
+					Cacher: &DirCacher{Dir: dir},
+					put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+						*puts = append(*puts, name)
+						if name == "a/c" {
+							return errors.New("cannot put")
+						}
+						return c.Put(ctx, name, content)
+					},
+				}
+			},
+			wantPuts:  []string{"a/b", "a/c"},
+			wantErr:   errors.New("cannot put"),
+			wantFiles: []string{"a/b"},
+		},
+		{
+			n: 4,
+			cacher: func(dir string, puts *[]string) Cacher {
+				return &DirCacher{Dir: dir}
+			},
+			cancelCtx: true,
+			wantErr:   context.Canceled,
+		},
+		{
+			n: 5,
+			cacher: func(dir string, puts *[]string) Cacher {
+				return &testCacher{Cacher: &DirCacher{Dir: dir}}
+			},
+			cancelCtx: true,
+			wantErr:   context.Canceled,
+		},
+	} {
+		dir := t.TempDir()
+		var puts []string
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancelCtx {
+			cancel()
+		}
+		err := PutAll(ctx, tt.cacher(dir, &puts), []CacheEntry{
+			{Name: "a/b", Content: strings.NewReader("foo")},
+			{Name: "a/c", Content: strings.NewReader("bar")},
+			{Name: "d/e", Content: strings.NewReader("foobar")},
+		})
+		cancel()
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(puts, ","), strings.Join(tt.wantPuts, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dir), ","), strings.Join(tt.wantFiles, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherPutAll(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	if err := dirCacher.PutAll(context.Background(), []CacheEntry{
+		{Name: "a/b", Content: strings.NewReader("foo")},
+		{Name: "a/c", Content: strings.NewReader("bar")},
+	}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for name, want := range map[string]string{"a/b": "foo", "a/c": "bar"} {
+		if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, filepath.FromSlash(name))); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		} else if got := string(b); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if err := dirCacher.PutAll(context.Background(), []CacheEntry{
+		{Name: "d/e", Content: strings.NewReader("foo")},
+		{Name: "d/f", Content: &testReadSeeker{
+			ReadSeeker: strings.NewReader("bar"),
+			read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+				return 0, errors.New("cannot read")
+			},
+		}},
+	}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err.Error(), "cannot read"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), "a/b,a/c"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	dirCacher = &DirCacher{Dir: filepath.Join(dirCacher.Dir, filepath.FromSlash("a/b"))}
+	if err := dirCacher.PutAll(context.Background(), []CacheEntry{{Name: "d/e", Content: strings.NewReader("foo")}}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDirCacherPutAllAtomic(t *testing.T) {
+	failingContent := func(content string) io.ReadSeeker {
+		return &testReadSeeker{
+			ReadSeeker: strings.NewReader(content),
+			read: func(rs io.ReadSeeker, p []byte) (n int, err error) {
+				return 0, errors.New("cannot read")
+			},
+		}
+	}
+	for _, tt := range []struct {
+		n           int
+		spool       bool
+		directWrite bool
+		failName    string
+		wantFiles   string
+	}{
+		{1, false, false, "", "example.com/@v/v1.0.0.info,example.com/@v/v1.0.0.mod,example.com/@v/v1.0.0.zip,example.com/@v/v1.0.0.ziphash"},
+		{2, false, false, "example.com/@v/v1.0.0.mod", ""},
+		{3, false, false, "example.com/@v/v1.0.0.zip", ""},
+		{4, false, false, "example.com/@v/v1.0.0.ziphash", ""},
+		{5, true, false, "example.com/@v/v1.0.0.zip", ""},
+		{6, false, true, "example.com/@v/v1.0.0.zip", "example.com/@v/v1.0.0.info,example.com/@v/v1.0.0.mod"},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), DirectWrite: tt.directWrite}
+		if tt.spool {
+			dirCacher.SpoolDir = t.TempDir()
+		}
+		var entries []CacheEntry
+		for _, name := range []string{
+			"example.com/@v/v1.0.0.info",
+			"example.com/@v/v1.0.0.mod",
+			"example.com/@v/v1.0.0.zip",
+			"example.com/@v/v1.0.0.ziphash",
+		} {
+			var content io.ReadSeeker = strings.NewReader(name)
+			if name == tt.failName {
+				content = failingContent(name)
+			}
+			entries = append(entries, CacheEntry{Name: name, Content: content})
+		}
+		err := dirCacher.PutAll(context.Background(), entries)
+		if tt.failName != "" {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err.Error(), "cannot read"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), tt.wantFiles; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.spool {
+			if got := walkDirFiles(t, dirCacher.SpoolDir); len(got) != 0 {
+				t.Errorf("test(%d): got %q, want none", tt.n, got)
+			}
+		}
+	}
+
+	var puts []string
+	if err := PutAll(context.Background(), &testCacher{
+		Cacher: &DirCacher{Dir: t.TempDir()},
+		put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+			puts = append(puts, name)
+			return c.Put(ctx, name, content)
+		},
+	}, []CacheEntry{
+		{Name: "example.com/@v/v1.0.0.info", Content: strings.NewReader("info")},
+		{Name: "example.com/@v/v1.0.0.mod", Content: strings.NewReader("mod")},
+		{Name: "example.com/@v/v1.0.0.zip", Content: strings.NewReader("zip")},
+	}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := strings.Join(puts, ","), "example.com/@v/v1.0.0.mod,example.com/@v/v1.0.0.zip,example.com/@v/v1.0.0.info"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherPutVerified(t *testing.T) {
+	const content = "foobar"
+	sum := sha256.Sum256([]byte(content))
+	hexSum := hex.EncodeToString(sum[:])
+	emptySum := sha256.Sum256(nil)
+	sha512Sum := sha512.Sum512([]byte(content))
+	hexSHA512Sum := hex.EncodeToString(sha512Sum[:])
+	for _, tt := range []struct {
+		n       int
+		content string
+		expect  VerifyInfo
+		wantErr error
+	}{
+		{1, content, VerifyInfo{}, nil},
+		{2, content, VerifyInfo{Size: 6}, nil},
+		{3, content, VerifyInfo{SHA256: hexSum}, nil},
+		{4, content, VerifyInfo{Size: 6, SHA256: strings.ToUpper(hexSum)}, nil},
+		{5, "", VerifyInfo{SHA256: hex.EncodeToString(emptySum[:])}, nil},
+		{6, content, VerifyInfo{Size: 7}, fmt.Errorf("%w: got size 6, want 7", ErrSizeMismatch)},
+		{7, content, VerifyInfo{Size: 5}, fmt.Errorf("%w: size exceeds 5 bytes", ErrSizeMismatch)},
+		{8, "foobaz", VerifyInfo{SHA256: hexSum}, fmt.Errorf("%w: got SHA-256 %x, want %s", ErrContentMismatch, sha256.Sum256([]byte("foobaz")), hexSum)},
+		{9, content, VerifyInfo{SHA256: "foobar"}, errors.New(`invalid SHA-256 hash "foobar"`)},
+		{10, content, VerifyInfo{Digest: "sha512:" + hexSHA512Sum}, nil},
+		{11, content, VerifyInfo{Size: 6, Digest: "sha256:" + hexSum}, nil},
+		{12, "foobaz", VerifyInfo{Digest: "sha512:" + hexSHA512Sum}, fmt.Errorf("%w: got sha512 %x, want %s", ErrContentMismatch, sha512.Sum512([]byte("foobaz")), hexSHA512Sum)},
+		{13, content, VerifyInfo{Digest: "md5:3858f62230ac3c915f300c664312c63f"}, errors.New(`unsupported hash function "md5"`)},
+		{14, content, VerifyInfo{Digest: "foobar"}, errors.New(`invalid digest "foobar"`)},
+		{15, content, VerifyInfo{Digest: "sha512:" + hexSum}, errors.New(`invalid digest "sha512:` + hexSum + `"`)},
+		{16, content, VerifyInfo{SHA256: hexSum, Digest: "sha256:" + hexSum}, errors.New("only one of SHA256 and Digest can be set")},
+	} {
+		for _, directWrite := range []bool{false, true} {
+			dirCacher := &DirCacher{Dir: t.TempDir(), DirectWrite: directWrite}
+			err := dirCacher.PutVerified(context.Background(), "a/b", struct{ io.Reader }{strings.NewReader(tt.content)}, tt.expect)
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("test(%d): expected error", tt.n)
+				}
+				if got, want := err, tt.wantErr; !compareErrors(got, want) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+				}
+				if errors.Is(tt.wantErr, ErrSizeMismatch) && (!errors.Is(err, ErrSizeMismatch) || !errors.Is(err, ErrContentMismatch)) {
+					t.Errorf("test(%d): got %q, want an error that matches %q and %q", tt.n, err, ErrSizeMismatch, ErrContentMismatch)
+				} else if errors.Is(tt.wantErr, ErrContentMismatch) && !errors.Is(err, ErrContentMismatch) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, err, ErrContentMismatch)
+				}
+				if entries, err := os.ReadDir(filepath.Join(dirCacher.Dir, "a")); err != nil && !os.IsNotExist(err) {
+					t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+				} else if got := len(entries); got != 0 {
+					t.Errorf("test(%d): got %d, want 0", tt.n, got)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "a", "b")); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), tt.content; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestDirCacherPutSizeMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		n        int
+		size     int64
+		offset   int64
+		putAll   bool
+		wantErr  error
+		wantFile bool
+	}{
+		{n: 1, size: 6, wantFile: true},
+		{n: 2, size: 7, wantErr: fmt.Errorf("%w: got size 6, want 7", ErrSizeMismatch)},
+		{n: 3, size: 5, wantErr: fmt.Errorf("%w: size exceeds 5 bytes", ErrSizeMismatch)},
+		{n: 4, size: 0, wantErr: fmt.Errorf("%w: size exceeds 0 bytes", ErrSizeMismatch)},
+		{n: 5, size: 6, putAll: true, wantFile: true},
+		{n: 6, size: 7, putAll: true, wantErr: fmt.Errorf("%w: got size 6, want 7", ErrSizeMismatch)},
+		{n: 7, size: 5, putAll: true, wantErr: fmt.Errorf("%w: size exceeds 5 bytes", ErrSizeMismatch)},
+		{n: 8, size: 6, offset: 2, wantFile: true},
+		{n: 9, size: 7, offset: 2, wantErr: fmt.Errorf("%w: got size 4, want 5", ErrSizeMismatch)},
+		{n: 10, size: 6, offset: 2, putAll: true, wantFile: true},
+	} {
+		for _, directWrite := range []bool{false, true} {
+			dirCacher := &DirCacher{Dir: t.TempDir(), DirectWrite: directWrite}
+			content := &declaredSizeReader{ReadSeeker: strings.NewReader("foobar"), size: tt.size}
+			if _, err := content.Seek(tt.offset, io.SeekStart); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			var err error
+			if tt.putAll {
+				err = dirCacher.PutAll(context.Background(), []CacheEntry{{Name: "a/b", Content: content}})
+			} else {
+				err = dirCacher.Put(context.Background(), "a/b", content)
+			}
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("test(%d): expected error", tt.n)
+				} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+				} else if !errors.Is(err, ErrSizeMismatch) || !errors.Is(err, ErrContentMismatch) {
+					t.Errorf("test(%d): got %q, want an error that matches %q and %q", tt.n, err, ErrSizeMismatch, ErrContentMismatch)
+				}
+			} else if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			entries, err := os.ReadDir(filepath.Join(dirCacher.Dir, "a"))
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			wantNames := ""
+			if tt.wantFile {
+				wantNames = "b"
+			}
+			if got, want := strings.Join(names, ","), wantNames; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
+type declaredSizeReader struct {
+	io.ReadSeeker
+	size int64
+}
+
+func (dsr *declaredSizeReader) Size() int64 { return dsr.size }
+
+func TestDirCacherHashFunc(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir(), HashFunc: sha512.New, HashName: "custom"}
+	if err := dirCacher.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var buf bytes.Buffer
+	if err := dirCacher.Manifest(context.Background(), &buf, ManifestOptions{SHA256: true, Digest: true}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var entry ManifestEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	sha256Sum := sha256.Sum256([]byte("v1.0.0"))
+	if got, want := entry.SHA256, hex.EncodeToString(sha256Sum[:]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	sha512Sum := sha512.Sum512([]byte("v1.0.0"))
+	if got, want := entry.Digest, "custom:"+hex.EncodeToString(sha512Sum[:]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := dirCacher.PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{Size: entry.Size, Digest: entry.Digest}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := dirCacher.PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.1"), VerifyInfo{Size: entry.Size, Digest: entry.Digest}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrContentMismatch) {
+		t.Errorf("got %q, want %q", err, ErrContentMismatch)
+	}
+	if err := (&DirCacher{Dir: t.TempDir()}).PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{Digest: entry.Digest}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, errors.New(`unsupported hash function "custom"`); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := (&DirCacher{Dir: t.TempDir()}).PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{Digest: "sha512:" + hex.EncodeToString(sha512Sum[:])}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	buf.Reset()
+	if err := (&DirCacher{Dir: dirCacher.Dir}).Manifest(context.Background(), &buf, ManifestOptions{Digest: true}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := buf.String(), `"digest":"sha256:`+hex.EncodeToString(sha256Sum[:])+`"`; !strings.Contains(got, want) {
+		t.Errorf("got %q, want to contain %q", got, want)
+	}
+
+	for _, hashName := range []string{"", "foo:bar"} {
+		err := (&DirCacher{Dir: dirCacher.Dir, HashFunc: sha512.New, HashName: hashName}).Manifest(context.Background(), io.Discard, ManifestOptions{Digest: true})
+		if err == nil {
+			t.Fatal("expected error")
+		} else if got, want := err, fmt.Errorf("invalid hash name %q", hashName); !compareErrors(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDirCacherSync(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{
+		"./cache/lock":                           nil,
+		"./cache/download/foo.lock":              nil,
+		"./example.com/@v/list":                  []byte("v1.0.0"),
+		"./example.com/@v/v1.0.0.lock":           nil,
+		"./example.com/@v/v1.0.0.mod":            []byte("module example.com"),
+		"./sumdb/sum.golang.org/lookup/foo.lock": nil,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n         int
+		skip      func(name string) bool
+		wantFiles []string
+	}{
+		{
+			n:         1,
+			wantFiles: []string{"example.com/@v/list", "example.com/@v/v1.0.0.mod"},
+		},
+		{
+			n:    2,
+			skip: func(name string) bool { return strings.HasSuffix(name, "/list") },
+			wantFiles: []string{
+				"cache/download/foo.lock",
+				"cache/lock",
+				"example.com/@v/v1.0.0.lock",
+				"example.com/@v/v1.0.0.mod",
+				"sumdb/sum.golang.org/lookup/foo.lock",
+			},
+		},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), Skip: tt.skip}
+		if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{}); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), strings.Join(tt.wantFiles, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/zip", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err.Error(), `unsupported compress type "application/zip" (supported: application/gzip, application/x-tar)`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSyncOptionsCompressType(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"./example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var gzipBundle bytes.Buffer
+	gw := gzip.NewWriter(&gzipBundle)
+	gw.Write(bundle)
+	gw.Close()
+	for _, tt := range []struct {
+		n                  int
+		contentTypeAliases map[string]string
+		contentType        string
+		wantCompressType   string
+	}{
+		{1, nil, "application/gzip", "application/gzip"},
+		{2, nil, "application/x-tar", "application/x-tar"},
+		{3, nil, "Application/GZIP; charset=binary", "application/gzip"},
+		{4, nil, "application/x-gzip", "application/gzip"},
+		{5, nil, "application/x-gtar-compressed", "application/gzip"},
+		{6, nil, "application/x-compressed-tar", "application/gzip"},
+		{7, nil, "application/x-tgz", "application/gzip"},
+		{8, nil, "application/tar", "application/x-tar"},
+		{9, nil, "application/x-gtar", "application/x-tar"},
+		{10, nil, "application/x-ustar", "application/x-tar"},
+		{11, map[string]string{"Application/X-Bundle": "application/gzip"}, "application/x-bundle", "application/gzip"},
+		{12, map[string]string{"application/x-gzip": "application/x-tar"}, "application/x-gzip", "application/x-tar"},
+		{13, nil, "application/zip", "application/zip"},
+		{14, nil, "application/octet-stream", "application/octet-stream"},
+		{15, nil, "invalid/", "invalid/"},
+	} {
+		opts := SyncOptions{ContentTypeAliases: tt.contentTypeAliases}
+		if got, want := opts.compressType(tt.contentType), tt.wantCompressType; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		content := bundle
+		if tt.wantCompressType == "application/gzip" {
+			content = gzipBundle.Bytes()
+		}
+		dc := &DirCacher{Dir: t.TempDir()}
+		err := dc.Sync(context.Background(), bytes.NewReader(content), tt.contentType, opts)
+		switch tt.wantCompressType {
+		case "application/gzip", "application/x-tar":
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := strings.Join(walkDirFiles(t, dc.Dir), ","), "example.com/@v/list"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		default:
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err.Error(), fmt.Sprintf("unsupported compress type %q (supported: application/gzip, application/x-tar)", tt.contentType); got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestSupportedSyncCompressions(t *testing.T) {
+	if got, want := strings.Join(SupportedSyncCompressions(), ","), "application/gzip,application/x-tar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	bundle, err := makeTar(map[string][]byte{"example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var gzipBundle bytes.Buffer
+	gw := gzip.NewWriter(&gzipBundle)
+	if _, err := gw.Write(bundle); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	bundles := map[string][]byte{
+		"application/gzip":  gzipBundle.Bytes(),
+		"application/x-tar": bundle,
+	}
+	for i, compressType := range SupportedSyncCompressions() {
+		content, ok := bundles[compressType]
+		if !ok {
+			t.Fatalf("test(%d): no bundle for %q", i+1, compressType)
+		}
+		for _, c := range []Cacher{
+			&DirCacher{Dir: t.TempDir()},
+			NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}}, nil),
+			NewFlatKeyCacher(&DirCacher{Dir: t.TempDir()}, FlatKeyMapper{}),
+		} {
+			if err := c.Sync(context.Background(), bytes.NewReader(content), compressType, SyncOptions{}); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", i+1, err)
+			}
+		}
+	}
+
+	if err := (&DirCacher{Dir: t.TempDir()}).Sync(context.Background(), bytes.NewReader(bundle), "application/zstd", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrUnsupportedCompression)
+	} else if got, want := err.Error(), `unsupported compress type "application/zstd" (supported: application/gzip, application/x-tar)`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherSyncStrictNames(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{
+		"./.DS_Store":                          []byte("junk"),
+		"./README":                             []byte("junk"),
+		"./cache/vcs/foo":                      []byte("vcs"),
+		"./example.com/@latest":                []byte("{}"),
+		"./example.com/@v/.DS_Store":           []byte("junk"),
+		"./example.com/@v/list":                []byte("v1.0.0"),
+		"./example.com/@v/v1.0.0.mod":          []byte("module example.com"),
+		"./example.com/@v/v1.0.0.mod~":         []byte("module example.com"),
+		"./sumdb/sum.golang.org/supported":     nil,
+		"./example.com/@v/v1.0.0.zip.partial":  []byte("zip"),
+		"./example.com/!foo/@v/v1.0.0.ziphash": []byte("h1:"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n           int
+		strictNames bool
+		wantFiles   []string
+		wantLogs    []string
+	}{
+		{
+			n:           1,
+			strictNames: true,
+			wantFiles: []string{
+				"cache/vcs/foo",
+				"example.com/!foo/@v/v1.0.0.ziphash",
+				"example.com/@latest",
+				"example.com/@v/list",
+				"example.com/@v/v1.0.0.mod",
+				"sumdb/sum.golang.org/supported",
+			},
+			wantLogs: []string{
+				"goproxy: skipped file not matching module cache layout: .DS_Store",
+				"goproxy: skipped file not matching module cache layout: README",
+				"goproxy: skipped file not matching module cache layout: example.com/@v/.DS_Store",
+				"goproxy: skipped file not matching module cache layout: example.com/@v/v1.0.0.mod~",
+				"goproxy: skipped file not matching module cache layout: example.com/@v/v1.0.0.zip.partial",
+			},
+		},
+		{
+			n: 2,
+			wantFiles: []string{
+				".DS_Store",
+				"README",
+				"cache/vcs/foo",
+				"example.com/!foo/@v/v1.0.0.ziphash",
+				"example.com/@latest",
+				"example.com/@v/.DS_Store",
+				"example.com/@v/list",
+				"example.com/@v/v1.0.0.mod",
+				"example.com/@v/v1.0.0.mod~",
+				"example.com/@v/v1.0.0.zip.partial",
+				"sumdb/sum.golang.org/supported",
+			},
+		},
+	} {
+		var logBuf bytes.Buffer
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{StrictNames: tt.strictNames, Logger: log.New(&logBuf, "", 0)}); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), strings.Join(tt.wantFiles, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.TrimSuffix(logBuf.String(), "\n"), strings.Join(tt.wantLogs, "\n"); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherSyncFromDir(t *testing.T) {
+	srcDir := t.TempDir()
+	for name, content := range map[string]string{
+		"cache/lock":                        "",
+		"example.com/@v/list":               "v1.0.0",
+		"example.com/@v/v1.0.0.lock":        "",
+		"example.com/@v/v1.0.0.mod":         "module example.com",
+		"example.com/@v/.v1.0.0.zip.tmp.42": "zip",
+		".hidden/example.com/@v/list":       "v1.0.0",
+	} {
+		file := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n                int
+		hardlink         bool
+		restrictSymlinks bool
+		wantSameFile     bool
+	}{
+		{n: 1},
+		{n: 2, hardlink: true, wantSameFile: true},
+		{n: 3, hardlink: true, restrictSymlinks: true},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir(), RestrictSymlinks: tt.restrictSymlinks}
+		if err := dirCacher.Put(context.Background(), "example.com/@v/list", strings.NewReader("old")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if err := dirCacher.SyncFromDir(context.Background(), srcDir, SyncOptions{Hardlink: tt.hardlink}); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), "example.com/@v/list,example.com/@v/v1.0.0.mod"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		for _, name := range []string{"example.com/@v/list", "example.com/@v/v1.0.0.mod"} {
+			srcFile := filepath.Join(srcDir, filepath.FromSlash(name))
+			dstFile := filepath.Join(dirCacher.Dir, filepath.FromSlash(name))
+			if b, err := os.ReadFile(dstFile); err != nil {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			} else if want, err := os.ReadFile(srcFile); err != nil {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			} else if got := string(b); got != string(want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			srcFI, err := os.Stat(srcFile)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			dstFI, err := os.Stat(dstFile)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := os.SameFile(srcFI, dstFI), tt.wantSameFile; got != want {
+				t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+			}
+		}
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	if err := dirCacher.SyncFromDir(context.Background(), filepath.Join(srcDir, "nonexistent"), SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %q, want an error that matches %q", err, fs.ErrNotExist)
+	}
+}
+
+func TestDirCacherSyncMaxFiles(t *testing.T) {
+	files := map[string][]byte{
+		"./cache/lock":                nil,
+		"./example.com/@v/list":       []byte("v1.0.0"),
+		"./example.com/@v/v1.0.0.mod": []byte("module example.com"),
+		"./example.com/@v/v1.0.0.zip": []byte("zip"),
+		"./example.org/@v/list":       []byte("v1.0.0"),
+		"./example.org/@v/v1.0.0.mod": []byte("module example.org"),
+	}
+	bundle, err := makeTar(files)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	srcDir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.WriteFile(file, content, 0o644); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n         int
+		maxFiles  int
+		fromDir   bool
+		wantFiles int
+		wantErr   error
+	}{
+		{n: 1, wantFiles: 5},
+		{n: 2, maxFiles: 5, wantFiles: 5},
+		{n: 3, maxFiles: -1, wantFiles: 5},
+		{n: 4, maxFiles: 3, wantFiles: 3, wantErr: ErrTooManyFiles},
+		{n: 5, maxFiles: 3, fromDir: true, wantFiles: 3, wantErr: ErrTooManyFiles},
+		{n: 6, maxFiles: 5, fromDir: true, wantFiles: 5},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		opts := SyncOptions{MaxFiles: tt.maxFiles}
+		var err error
+		if tt.fromDir {
+			err = dirCacher.SyncFromDir(context.Background(), srcDir, opts)
+		} else {
+			err = dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", opts)
+		}
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, tt.wantErr)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := len(walkDirFiles(t, dirCacher.Dir)), tt.wantFiles; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+
+	sc := NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil)
+	if err := sc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{MaxFiles: 2}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrTooManyFiles)
+	}
+
+	if got, want := (SyncOptions{}).checkFileCount(defaultSyncMaxFiles), fmt.Errorf("%w: more than %d files", ErrTooManyFiles, defaultSyncMaxFiles); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherSyncMaxPathDepth(t *testing.T) {
+	deepName := "example.com/" + strings.Repeat("a/", 70) + "@v/list"
+	files := map[string][]byte{
+		"./example.com/@v/list": []byte("v1.0.0"),
+		"./" + deepName:         []byte("v1.0.0"),
+	}
+	bundle, err := makeTar(files)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	srcDir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.WriteFile(file, content, 0o644); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n            int
+		maxPathDepth int
+		fromDir      bool
+		wantDeepFile bool
+		wantErr      error
+	}{
+		{n: 1, wantErr: fmt.Errorf("%w: %s: more than 64 elements", ErrPathTooDeep, deepName)},
+		{n: 2, maxPathDepth: 73, wantDeepFile: true},
+		{n: 3, maxPathDepth: -1, wantDeepFile: true},
+		{n: 4, maxPathDepth: 72, wantErr: fmt.Errorf("%w: %s: more than 72 elements", ErrPathTooDeep, deepName)},
+		{n: 5, fromDir: true, wantErr: fmt.Errorf("%w: %s: more than 64 elements", ErrPathTooDeep, deepName)},
+		{n: 6, maxPathDepth: -1, fromDir: true, wantDeepFile: true},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		opts := SyncOptions{MaxPathDepth: tt.maxPathDepth}
+		var err error
+		if tt.fromDir {
+			err = dirCacher.SyncFromDir(context.Background(), srcDir, opts)
+		} else {
+			err = dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", opts)
+		}
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			} else if !errors.Is(err, ErrPathTooDeep) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, ErrPathTooDeep)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		_, err = os.Stat(filepath.Join(dirCacher.Dir, filepath.FromSlash(deepName)))
+		if got, want := err == nil, tt.wantDeepFile; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherSyncOnDuplicate(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range []struct {
+		name    string
+		content string
+	}{
+		{"./example.com/@v/v1.0.0.mod", "module example.com // first"},
+		{"./example.com/@v/list", "v1.0.0"},
+		{"example.com/@v/v1.0.0.mod", "module example.com // second"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.content))}); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if _, err := io.WriteString(tw, file.content); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	bundle := buf.Bytes()
+	for _, tt := range []struct {
+		n           int
+		onDuplicate DuplicatePolicy
+		wantMod     string
+		wantResult  SyncResult
+		wantErr     error
+	}{
+		{1, DuplicateOverwrite, "module example.com // second", SyncResult{Files: 3, Bytes: 61}, nil},
+		{2, DuplicateSkip, "module example.com // first", SyncResult{Files: 2, Bytes: 33, Skipped: 1}, nil},
+		{3, DuplicateError, "module example.com // first", SyncResult{}, fmt.Errorf("%w: example.com/@v/v1.0.0.mod", ErrDuplicateEntry)},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		var result SyncResult
+		err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{
+			OnDuplicate: tt.onDuplicate,
+			OnComplete: func(ctx context.Context, r SyncResult) error {
+				result = r
+				return nil
+			},
+		})
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			} else if !errors.Is(err, ErrDuplicateEntry) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, ErrDuplicateEntry)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := result, tt.wantResult; got != want {
+			t.Errorf("test(%d): got %+v, want %+v", tt.n, got, want)
+		}
+		if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "example.com", "@v", "v1.0.0.mod")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantMod; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	sc := NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil)
+	if err := sc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{OnDuplicate: DuplicateError}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrDuplicateEntry) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrDuplicateEntry)
+	}
+}
+
+func TestDirCacherSyncVerifyZipHashes(t *testing.T) {
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHash := mustHashZip(t, zip)
+	otherZip, err := makeZip(map[string][]byte{"example.com@v1.1.0/go.mod": []byte("module example.com // tampered")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	goodBundle, err := makeTar(map[string][]byte{
+		"./example.com/@v/v1.0.0.zip":     zip,
+		"./example.com/@v/v1.0.0.mod":     []byte("module example.com"),
+		"./example.com/@v/v1.0.0.ziphash": []byte(zipHash + "\n"),
+		"./example.com/@v/v1.2.0.zip":     otherZip,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	badBundle, err := makeTar(map[string][]byte{
+		"./example.com/@v/v1.0.0.zip":     zip,
+		"./example.com/@v/v1.0.0.ziphash": []byte(zipHash),
+		"./example.com/@v/v1.1.0.zip":     otherZip,
+		"./example.com/@v/v1.1.0.ziphash": []byte(zipHash),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n             int
+		cacher        func() Cacher
+		bundle        []byte
+		verify        bool
+		staged        bool
+		wantVerified  int
+		wantErr       error
+		wantFileCount int
+	}{
+		{n: 1, cacher: func() Cacher { return &DirCacher{Dir: t.TempDir()} }, bundle: goodBundle, verify: true, wantVerified: 1, wantFileCount: 4},
+		{n: 2, cacher: func() Cacher { return &DirCacher{Dir: t.TempDir()} }, bundle: badBundle, wantFileCount: 4},
+		{
+			n:       3,
+			cacher:  func() Cacher { return &DirCacher{Dir: t.TempDir()} },
+			bundle:  badBundle,
+			verify:  true,
+			wantErr: fmt.Errorf("%w: example.com/@v/v1.1.0.zip: got %s, want %s", ErrZipHashMismatch, mustHashZip(t, otherZip), zipHash),
+		},
+		{
+			n:       4,
+			cacher:  func() Cacher { return &DirCacher{Dir: t.TempDir()} },
+			bundle:  badBundle,
+			verify:  true,
+			staged:  true,
+			wantErr: fmt.Errorf("%w: example.com/@v/v1.1.0.zip: got %s, want %s", ErrZipHashMismatch, mustHashZip(t, otherZip), zipHash),
+		},
+		{
+			n: 5,
+			cacher: func() Cacher {
+				return NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil)
+			},
+			bundle:        goodBundle,
+			verify:        true,
+			wantVerified:  1,
+			wantFileCount: 4,
+		},
+		{
+			n: 6,
+			cacher: func() Cacher {
+				return NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil)
+			},
+			bundle:  badBundle,
+			verify:  true,
+			wantErr: fmt.Errorf("%w: example.com/@v/v1.1.0.zip: got %s, want %s", ErrZipHashMismatch, mustHashZip(t, otherZip), zipHash),
+		},
+		{
+			n: 7,
+			cacher: func() Cacher {
+				return NewFlatKeyCacher(&DirCacher{Dir: t.TempDir()}, FlatKeyMapper{HashPrefixLength: 2})
+			},
+			bundle:  badBundle,
+			verify:  true,
+			wantErr: fmt.Errorf("%w: example.com/@v/v1.1.0.zip: got %s, want %s", ErrZipHashMismatch, mustHashZip(t, otherZip), zipHash),
+		},
+	} {
+		c := tt.cacher()
+		var result SyncResult
+		err := c.Sync(context.Background(), bytes.NewReader(tt.bundle), "application/x-tar", SyncOptions{
+			VerifyZipHashes: tt.verify,
+			Staged:          tt.staged,
+			TempDir:         t.TempDir(),
+			OnComplete: func(ctx context.Context, r SyncResult) error {
+				result = r
+				return nil
+			},
+		})
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			} else if !errors.Is(err, ErrZipHashMismatch) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, ErrZipHashMismatch)
+			}
+			if tt.staged {
+				if got, want := len(walkDirFiles(t, c.(*DirCacher).Dir)), 0; got != want {
+					t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+				}
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := result.VerifiedZipHashes, tt.wantVerified; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := result.Files, tt.wantFileCount; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherSyncMaxDecompressionRatio(t *testing.T) {
+	gzipTar := func(files map[string][]byte) []byte {
+		tarBundle, err := makeTar(files)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(tarBundle); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		return buf.Bytes()
+	}
+	bundle := gzipTar(map[string][]byte{
+		"example.com/@v/list":       []byte("v1.0.0"),
+		"example.com/@v/v1.0.0.mod": bytes.Repeat([]byte("module example.com\n"), 1000),
+	})
+	bomb := gzipTar(map[string][]byte{"example.com/@v/v1.0.0.zip": make([]byte, 16<<20)})
+	for _, tt := range []struct {
+		n                    int
+		bundle               []byte
+		maxRatio             float64
+		maxDecompressedBytes int64
+		wantErr              error
+	}{
+		{n: 1, bundle: bundle},
+		{n: 2, bundle: bomb, wantErr: fmt.Errorf("%w: decompression ratio exceeds 100", ErrDecompressionBomb)},
+		{n: 3, bundle: bomb, maxRatio: 10000},
+		{n: 4, bundle: bomb, maxRatio: -1},
+		{n: 5, bundle: bundle, maxDecompressedBytes: 1024, wantErr: fmt.Errorf("%w: decompressed size exceeds 1024 bytes", ErrDecompressionBomb)},
+		{n: 6, bundle: bomb, maxRatio: -1, maxDecompressedBytes: 1 << 20, wantErr: fmt.Errorf("%w: decompressed size exceeds 1048576 bytes", ErrDecompressionBomb)},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		err := dirCacher.Sync(context.Background(), bytes.NewReader(tt.bundle), "application/gzip", SyncOptions{
+			MaxDecompressionRatio: tt.maxRatio,
+			MaxDecompressedBytes:  tt.maxDecompressedBytes,
+		})
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if !errors.Is(err, ErrDecompressionBomb) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, ErrDecompressionBomb)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if _, err := os.Stat(filepath.Join(dirCacher.Dir, "example.com", "@v", "v1.0.0.zip")); !os.IsNotExist(err) {
+				t.Errorf("test(%d): got %v, want %v", tt.n, err, os.ErrNotExist)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+	}
+
+	sc := NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil)
+	if err := sc.Sync(context.Background(), bytes.NewReader(bomb), "application/gzip", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrDecompressionBomb) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrDecompressionBomb)
+	}
+}
+
+func TestDirCacherSyncResume(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{
+		"a.com/@v/list":       []byte("v1.0.0"),
+		"a.com/@v/v1.0.0.mod": []byte("module a.com"),
+		"b.com/@v/list":       []byte("v1.0.0"),
+		"b.com/@v/v1.0.0.mod": []byte("module b.com"),
+		"c.com/@v/list":       []byte("v1.0.0"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	otherBundle, err := makeTar(map[string][]byte{
+		"a.com/@v/list":       []byte("v1.0.0"),
+		"a.com/@v/v1.0.0.mod": []byte("module a.com"),
+		"c.com/@v/list":       []byte("v1.0.0"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{
+		MaxFiles:   3,
+		Checkpoint: checkpoint,
+	}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrTooManyFiles)
+	}
+	if b, err := os.ReadFile(checkpoint); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), `{"entry":2,"name":"b.com/@v/list"}`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := os.WriteFile(filepath.Join(dirCacher.Dir, "a.com", "@v", "list"), []byte("modified"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(otherBundle), "application/x-tar", SyncOptions{
+		Checkpoint: checkpoint,
+		Resume:     true,
+	}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, errors.New(`checkpoint does not match bundle: got entry 2 "c.com/@v/list", want "b.com/@v/list"`); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var result SyncResult
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{
+		Checkpoint: checkpoint,
+		Resume:     true,
+		OnComplete: func(ctx context.Context, r SyncResult) error {
+			result = r
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := result, (SyncResult{Files: 2, Bytes: 18, Skipped: 3}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, tt := range []struct {
+		n           int
+		name        string
+		wantContent string
+	}{
+		{1, "a.com/@v/list", "modified"},
+		{2, "b.com/@v/list", "v1.0.0"},
+		{3, "b.com/@v/v1.0.0.mod", "module b.com"},
+		{4, "c.com/@v/list", "v1.0.0"},
+	} {
+		if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, filepath.FromSlash(tt.name))); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("got %v, want %v", err, os.ErrNotExist)
+	}
+
+	dirCacher = &DirCacher{Dir: t.TempDir()}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{
+		Checkpoint: checkpoint,
+		Resume:     true,
+	}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := len(walkDirFiles(t, dirCacher.Dir)), 5; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestDirCacherSyncStaged(t *testing.T) {
+	for _, tt := range []struct {
+		n                 int
+		staged            bool
+		abort             bool
+		wantVisibleDuring bool
+		wantErr           error
+		wantNames         []string
+	}{
+		{1, false, false, true, nil, []string{"v1.0.0.info", "v1.0.0.mod"}},
+		{2, true, false, false, nil, []string{"v1.0.0.info", "v1.0.0.mod"}},
+		{3, false, true, true, errors.New("connection reset"), []string{"v1.0.0.mod"}},
+		{4, true, true, false, errors.New("connection reset"), nil},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		pr, pw := io.Pipe()
+		resume := make(chan struct{})
+		go func() {
+			tw := tar.NewWriter(pw)
+			writeEntry := func(name, content string) {
+				tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(content))})
+				io.WriteString(tw, content)
+				tw.Flush()
+			}
+			writeEntry("example.com/@v/v1.0.0.mod", "module example.com")
+			<-resume
+			if tt.abort {
+				pw.CloseWithError(errors.New("connection reset"))
+				return
+			}
+			writeEntry("example.com/@v/v1.0.0.info", `{"Version":"v1.0.0"}`)
+			tw.Close()
+			pw.Close()
+		}()
+		syncErr := make(chan error, 1)
+		go func() {
+			syncErr <- dirCacher.Sync(context.Background(), pr, "application/x-tar", SyncOptions{Staged: tt.staged})
+		}()
+
+		// Wait for the first file to be either published or staged.
+		vDir := filepath.Join(dirCacher.Dir, "example.com", "@v")
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			if entries, _ := os.ReadDir(vDir); len(entries) > 0 {
+				if _, err := os.Stat(filepath.Join(vDir, "v1.0.0.mod")); err == nil || !tt.wantVisibleDuring {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("test(%d): timed out waiting for the first file", tt.n)
+			}
+		}
+		rc, err := dirCacher.Get(context.Background(), "example.com/@v/v1.0.0.mod")
+		if err == nil {
+			rc.Close()
+		}
+		if tt.wantVisibleDuring {
+			if err != nil {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			}
+		} else if got, want := err, fs.ErrNotExist; !errors.Is(got, want) {
+			t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+		}
+		if names, err := dirCacher.List(context.Background(), ""); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := len(names) > 0, tt.wantVisibleDuring; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+
+		close(resume)
+		err = <-syncErr
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		var names []string
+		if entries, err := os.ReadDir(vDir); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else {
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+		}
+		if got, want := strings.Join(names, ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	bundle, err := makeTar(map[string][]byte{"example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{
+		Staged:     true,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint"),
+	}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, errors.New("staged imports cannot be checkpointed"); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherSyncMinFreeBytes(t *testing.T) {
+	if _, err := freeSpace(t.TempDir()); err != nil {
+		t.Skipf("skipping test: %v", err)
+	}
+	bundle, err := makeTar(map[string][]byte{"./example.com/@v/v1.0.0.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{MinFreeBytes: 1}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := strings.Join(walkDirFiles(t, dirCacher.Dir), ","), "example.com/@v/v1.0.0.mod"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	dirCacher = &DirCacher{Dir: t.TempDir()}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{MinFreeBytes: 1 << 62}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrInsufficientSpace)
+	}
+	if got := walkDirFiles(t, dirCacher.Dir); len(got) > 0 {
+		t.Errorf("got %q, want none", got)
+	}
+}
+
+func TestDirCacherSyncExclusive(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"./example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dir := t.TempDir()
+	dirCacher := &DirCacher{Dir: dir}
+	pr, pw := io.Pipe()
+	errCh := make(chan error)
+	go func() {
+		errCh <- dirCacher.Sync(context.Background(), pr, "application/x-tar", SyncOptions{Exclusive: true})
+	}()
+	if _, err := pw.Write(bundle[:512]); err != nil { // Wait for the first Sync to start reading.
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	for _, dc := range []*DirCacher{dirCacher, {Dir: dir}} {
+		if err := dc.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{Exclusive: true}); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := err, ErrSyncInProgress; !compareErrors(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	if _, err := pw.Write(bundle[512:]); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{Exclusive: true}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
+
+func TestDirCacherSyncMaxQueued(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"./example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	opts := SyncOptions{Exclusive: true, MaxQueued: 2}
+	pr, pw := io.Pipe()
+	errCh := make(chan error)
+	go func() {
+		errCh <- dirCacher.Sync(context.Background(), pr, "application/x-tar", opts)
+	}()
+	if _, err := pw.Write(bundle[:512]); err != nil { // Wait for the first Sync to start reading.
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	queued := func() int {
+		dirCacher.syncQueueMutex.Lock()
+		defer dirCacher.syncQueueMutex.Unlock()
+		return dirCacher.syncQueued
+	}
+	waitQueued := func(n int) {
+		for deadline := time.Now().Add(10 * time.Second); queued() != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d queued syncs, got %d", n, queued())
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	queuedErrCh := make(chan error, 2)
+	go func() {
+		queuedErrCh <- dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", opts)
+	}()
+	waitQueued(1)
+	canceledErrCh := make(chan error, 1)
+	go func() {
+		canceledErrCh <- dirCacher.Sync(ctx, bytes.NewReader(bundle), "application/x-tar", opts)
+	}()
+	waitQueued(2)
+
+	for _, tt := range []struct {
+		n         int
+		maxQueued int
+		wantErr   error
+	}{
+		{1, 2, ErrSyncQueueFull},
+		{2, 1, ErrSyncQueueFull},
+		{3, 0, ErrSyncInProgress},
+		{4, -1, ErrSyncInProgress},
+	} {
+		if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{Exclusive: true, MaxQueued: tt.maxQueued}); err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	cancel()
+	if got, want := <-canceledErrCh, context.Canceled; !errors.Is(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	waitQueued(1)
+	go func() {
+		queuedErrCh <- dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", opts)
+	}()
+	waitQueued(2)
+
+	if _, err := pw.Write(bundle[512:]); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-queuedErrCh; err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if got := queued(); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+}
+
+func TestDirCacherSyncDedupKey(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"./example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	pr, pw := io.Pipe()
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = dirCacher.Sync(context.Background(), pr, "application/x-tar", SyncOptions{DedupKey: "foobar"})
+	}()
+	if _, err := pw.Write(bundle[:512]); err != nil { // Wait for the first Sync to start reading.
+		t.Fatalf("unexpected error %q", err)
+	}
+	var reads int32
+	for i := 1; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = dirCacher.Sync(context.Background(), &testReadSeeker{
+				ReadSeeker: bytes.NewReader(bundle),
+				read: func(rs io.ReadSeeker, p []byte) (int, error) {
+					atomic.AddInt32(&reads, 1)
+					return rs.Read(p)
+				},
+			}, "application/x-tar", SyncOptions{DedupKey: "foobar"})
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	pw.CloseWithError(errors.New("foobar"))
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Fatalf("test(%d): expected error", i)
+		} else if got, want := err, errors.New("foobar"); !compareErrors(got, want) {
+			t.Errorf("test(%d): got %q, want %q", i, got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&reads), int32(0); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	for _, dedupKey := range []string{"foobar", ""} {
+		if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{DedupKey: dedupKey}); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "example.com", "@v", "list")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "v1.0.0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	otherBundle, err := makeTar(map[string][]byte{"./example.com/@v/list": []byte("v1.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	dirCacher = &DirCacher{Dir: t.TempDir()}
+	pr, pw = io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leaderDone := make(chan error, 1)
+	go func() {
+		leaderDone <- dirCacher.Sync(ctx, pr, "application/x-tar", SyncOptions{DedupKey: "foobar"})
+	}()
+	if _, err := pw.Write(bundle[:512]); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	waiterDone := make(chan error, 1)
+	go func() {
+		waiterDone <- dirCacher.Sync(context.Background(), bytes.NewReader(otherBundle), "application/x-tar", SyncOptions{DedupKey: "foobar"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	go func() {
+		pw.Write(bundle[512:])
+		pw.Close()
+	}()
+	if err := <-leaderDone; err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	pr.Close() // The leader is done reading its bundle once it returns.
+	if err := <-waiterDone; err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "example.com", "@v", "list")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "v1.0.1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSyncOptionsOnComplete(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{
+		"example.com/@v/list":        []byte("v1.0.0"),
+		"example.com/@v/v1.0.0.info": []byte("{}"),
+		"cache/lock":                 nil,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	type ctxKey struct{}
+	for _, tt := range []struct {
+		n             int
+		cacher        func() Cacher
+		readErr       error
+		onCompleteErr error
+		wantCalls     int
+		wantResult    SyncResult
+		wantErr       error
+	}{
+		{
+			n:          1,
+			cacher:     func() Cacher { return &DirCacher{Dir: t.TempDir()} },
+			wantCalls:  1,
+			wantResult: SyncResult{Files: 2, Bytes: 8, Skipped: 1},
+		},
+		{
+			n:       2,
+			cacher:  func() Cacher { return &DirCacher{Dir: t.TempDir()} },
+			readErr: errors.New("connection reset"),
+			wantErr: errors.New("connection reset"),
+		},
+		{
+			n:             3,
+			cacher:        func() Cacher { return &DirCacher{Dir: t.TempDir()} },
+			onCompleteErr: errors.New("failed to notify replicas"),
+			wantCalls:     1,
+			wantResult:    SyncResult{Files: 2, Bytes: 8, Skipped: 1},
+			wantErr:       errors.New("failed to notify replicas"),
+		},
+		{
+			n: 4,
+			cacher: func() Cacher {
+				return NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, func(name string) int {
+					if path.Base(name) == "list" {
+						return 0
+					}
+					return 1
+				})
+			},
+			wantCalls:  1,
+			wantResult: SyncResult{Files: 2, Bytes: 8, Skipped: 1},
+		},
+		{
+			n: 5,
+			cacher: func() Cacher {
+				return NewShardedCacher([]Cacher{&DirCacher{Dir: t.TempDir()}, &DirCacher{Dir: t.TempDir()}}, nil)
+			},
+			readErr: errors.New("connection reset"),
+			wantErr: errors.New("connection reset"),
+		},
+		{
+			n:          6,
+			cacher:     func() Cacher { return NewFlatKeyCacher(&DirCacher{Dir: t.TempDir()}, FlatKeyMapper{}) },
+			wantCalls:  1,
+			wantResult: SyncResult{Files: 3, Bytes: 8},
+		},
+	} {
+		var (
+			calls  int
+			result SyncResult
+		)
+		ctx := context.WithValue(context.Background(), ctxKey{}, tt.n)
+		var r io.Reader = bytes.NewReader(bundle)
+		if tt.readErr != nil {
+			r = io.MultiReader(bytes.NewReader(bundle[:len(bundle)/2]), &testReadSeeker{
+				ReadSeeker: strings.NewReader(""),
+				read: func(rs io.ReadSeeker, p []byte) (int, error) {
+					return 0, tt.readErr
+				},
+			})
+		}
+		err := tt.cacher().Sync(ctx, r, "application/x-tar", SyncOptions{
+			OnComplete: func(ctx context.Context, r SyncResult) error {
+				if got, want := ctx.Value(ctxKey{}), tt.n; got != want {
+					t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+				}
+				calls++
+				result = r
+				return tt.onCompleteErr
+			},
+		})
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := calls, tt.wantCalls; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := result, tt.wantResult; got != want {
+			t.Errorf("test(%d): got %+v, want %+v", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherDelete(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir(), TrackAccess: true}
+	if err := dirCacher.Put(context.Background(), "a/b", strings.NewReader("foobar")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := dirCacher.Delete(context.Background(), "a/b"); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dirCacher.Dir, "a", "b")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want %v", err, os.ErrNotExist)
+	}
+	if got := dirCacher.LeastRecentlyUsed(-1); len(got) != 0 {
+		t.Errorf("got %q, want none", got)
+	}
+	if err := dirCacher.Delete(context.Background(), "../a"); err == nil {
+		t.Error("expected error")
+	}
+	if err := (&DirCacher{Dir: filepath.Join(t.TempDir(), "404"), RestrictSymlinks: true}).Delete(context.Background(), "a/b"); err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestDirCacherDeleteWhileGetting(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	content := strings.Repeat("foobar", 1<<16)
+	if err := dirCacher.Put(context.Background(), "example.com/@v/v1.0.0.zip", strings.NewReader(content)); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	rc, err := dirCacher.Get(context.Background(), "example.com/@v/v1.0.0.zip")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer rc.Close()
+	head := make([]byte, 1024)
+	if _, err := io.ReadFull(rc, head); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	err = dirCacher.Delete(context.Background(), "example.com/@v/v1.0.0.zip")
+	if runtime.GOOS == "windows" {
+		if err == nil {
+			t.Error("expected error")
+		}
+	} else {
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if _, err := dirCacher.Get(context.Background(), "example.com/@v/v1.0.0.zip"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got %v, want fs.ErrNotExist", err)
+		}
+		if err := dirCacher.Put(context.Background(), "example.com/@v/v1.0.0.zip", strings.NewReader("other")); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	tail, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := string(head)+string(tail), content; got != want {
+		t.Errorf("got %d bytes, want the %d bytes of the original content", len(got), len(want))
+	}
+}
+
+func TestDirCacherMigrate(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		fresh       bool
+		version     string
+		wantVersion string
+		wantErr     error
+	}{
+		{1, true, "", "1\n", nil},
+		{2, false, "", "1\n", nil},
+		{3, false, "1\n", "1\n", nil},
+		{4, false, "2\n", "2\n", errors.New("unsupported cache layout version 2 (newer than 1)")},
+		{5, false, "foo", "foo", errors.New(`invalid cache layout version "foo"`)},
+	} {
+		dir := filepath.Join(t.TempDir(), "cache")
+		dirCacher := &DirCacher{Dir: dir}
+		if !tt.fresh {
+			if err := dirCacher.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		if tt.version != "" {
+			if err := os.WriteFile(filepath.Join(dir, layoutVersionFile), []byte(tt.version), 0o644); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			err := dirCacher.Migrate(context.Background())
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("test(%d): expected error", tt.n)
+				}
+				if got, want := err, tt.wantErr; !compareErrors(got, want) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+				}
+			} else if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, layoutVersionFile)); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantVersion; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		names, err := dirCacher.List(context.Background(), "")
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		wantNames := "example.com/@v/list"
+		if tt.fresh {
+			wantNames = ""
+		}
+		if got, want := strings.Join(names, ","), wantNames; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherList(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	for _, name := range []string{
+		"example.com/@v/list",
+		"example.com/@v/v1.0.0.info",
+		"example.com/@v/v1.0.0.mod",
+		"example.com/foo/@v/v1.0.0.info",
+		"example.com.bar/@latest",
+		"other.example/@latest",
+	} {
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader("foobar")); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, name := range []string{"example.com/@v/.v1.1.0.info.tmp.0", ".hidden/example.com/@latest"} {
+		if err := os.MkdirAll(filepath.Join(dirCacher.Dir, filepath.FromSlash(path.Dir(name))), 0o755); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.WriteFile(filepath.Join(dirCacher.Dir, filepath.FromSlash(name)), nil, 0o644); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n         int
+		prefix    string
+		wantNames []string
+		wantErr   error
+	}{
+		{
+			n:      1,
+			prefix: "",
+			wantNames: []string{
+				"example.com.bar/@latest",
+				"example.com/@v/list",
+				"example.com/@v/v1.0.0.info",
+				"example.com/@v/v1.0.0.mod",
+				"example.com/foo/@v/v1.0.0.info",
+				"other.example/@latest",
+			},
+		},
+		{
+			n:         2,
+			prefix:    "example.com/@v/",
+			wantNames: []string{"example.com/@v/list", "example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"},
+		},
+		{
+			n:         3,
+			prefix:    "example.com/@v/v1",
+			wantNames: []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"},
+		},
+		{
+			n:         4,
+			prefix:    "example.com",
+			wantNames: []string{"example.com.bar/@latest", "example.com/@v/list", "example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/foo/@v/v1.0.0.info"},
+		},
+		{
+			n:      5,
+			prefix: "nonexistent.example/@v/",
+		},
+		{
+			n:       6,
+			prefix:  "../",
+			wantErr: ErrInvalidName,
+		},
+	} {
+		names, err := dirCacher.List(context.Background(), tt.prefix)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(names, ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestDirCacherHashDirLevels(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir(), HashDirLevels: 2, TrackAccess: true}
+	hashedFile := func(name string) string {
+		sum := sha256.Sum256([]byte(name))
+		return filepath.Join(dirCacher.Dir, hex.EncodeToString(sum[:1]), hex.EncodeToString(sum[1:2]), filepath.FromSlash(name))
+	}
+	files := map[string]string{
+		"example.com/@latest":                  "{}",
+		"github.com/foo/bar/@v/list":           "v1.0.0",
+		"github.com/foo/bar/@v/v1.0.0.mod":     "module github.com/foo/bar",
+		"github.com/foo/baz/@v/v1.0.0.info":    "{}",
+		"github.com/foo/baz/@v/v1.0.0.ziphash": "h1:foobar=",
+	}
+	for _, name := range []string{"example.com/@latest", "github.com/foo/bar/@v/list"} {
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader(files[name])); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if err := dirCacher.PutAll(context.Background(), []CacheEntry{{
+		Name:    "github.com/foo/bar/@v/v1.0.0.mod",
+		Content: strings.NewReader(files["github.com/foo/bar/@v/v1.0.0.mod"]),
+	}}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	bundle, err := makeTar(map[string][]byte{
+		"github.com/foo/baz/@v/v1.0.0.info":    []byte(files["github.com/foo/baz/@v/v1.0.0.info"]),
+		"github.com/foo/baz/@v/v1.0.0.ziphash": []byte(files["github.com/foo/baz/@v/v1.0.0.ziphash"]),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{Staged: true}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, file := range []string{"ab/cd/example.com/@v/list", "example.com/@v/list"} {
+		if err := os.MkdirAll(filepath.Join(dirCacher.Dir, filepath.Dir(filepath.FromSlash(file))), 0o755); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := os.WriteFile(filepath.Join(dirCacher.Dir, filepath.FromSlash(file)), []byte("stray"), 0o644); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	var names []string
+	for name, content := range files {
+		names = append(names, name)
+		if b, err := os.ReadFile(hashedFile(name)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		} else if got, want := string(b), content; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		rc, err := dirCacher.Get(context.Background(), name)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		} else if got, want := string(b), content; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	sort.Strings(names)
+	for _, tt := range []struct {
+		n         int
+		prefix    string
+		wantNames []string
+	}{
+		{1, "", names},
+		{2, "github.com/foo/", names[1:]},
+		{3, "github.com/foo/bar/@v/v", names[2:3]},
+		{4, "golang.org/", nil},
+	} {
+		if got, err := dirCacher.List(context.Background(), tt.prefix); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := strings.Join(got, ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := dirCacher.Manifest(context.Background(), &buf, ManifestOptions{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var manifestNames []string
+	for dec := json.NewDecoder(&buf); dec.More(); {
+		var entry ManifestEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		manifestNames = append(manifestNames, entry.Name)
+	}
+	sort.Strings(manifestNames)
+	if got, want := strings.Join(manifestNames, ","), strings.Join(names, ","); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var topNames []string
+	if stats, err := dirCacher.TopEntries(context.Background(), -1); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else {
+		for _, stat := range stats {
+			topNames = append(topNames, stat.Name)
+		}
+	}
+	sort.Strings(topNames)
+	if got, want := strings.Join(topNames, ","), strings.Join(names, ","); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := dirCacher.Delete(context.Background(), "example.com/@latest"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := os.Stat(hashedFile("example.com/@latest")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := dirCacher.Get(context.Background(), "example.com/@latest"); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, fs.ErrNotExist; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	dirCacher = &DirCacher{Dir: t.TempDir(), HashDirLevels: 33}
+	wantErr := errors.New("hash dir levels 33 out of range [0, 32]")
+	if _, err := dirCacher.Get(context.Background(), "example.com/@latest"); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, wantErr; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := dirCacher.Put(context.Background(), "example.com/@latest", strings.NewReader("{}")); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, wantErr; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := dirCacher.List(context.Background(), ""); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, wantErr; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDirCacherFileName(t *testing.T) {
+	for _, tt := range []struct {
+		n             int
+		hashDirLevels int
+		name          string
+		wantFile      string
+	}{
+		{1, 0, "example.com/@v/list", "example.com/@v/list"},
+		{2, 1, "example.com/@v/list", "82/example.com/@v/list"},
+		{3, 2, "example.com/@v/list", "82/0a/example.com/@v/list"},
+		{4, 3, "cache/download/example.com/@v/list", ""},
+	} {
+		dc := &DirCacher{HashDirLevels: tt.hashDirLevels}
+		file := dc.fileName(tt.name)
+		if tt.wantFile != "" {
+			if got, want := file, tt.wantFile; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, ok := dc.cacheName(file); !ok {
+			t.Errorf("test(%d): expected ok", tt.n)
+		} else if want := tt.name; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	dc := &DirCacher{HashDirLevels: 2}
+	for _, tt := range []struct {
+		n    int
+		file string
+	}{
+		{1, "example.com/@v/list"},
+		{2, "00/00/example.com/@v/list"},
+		{3, "82/0a"},
+		{4, "82/0a/"},
+		{5, "820a/example.com/@v/list"},
+	} {
+		if name, ok := dc.cacheName(tt.file); ok {
+			t.Errorf("test(%d): unexpected name %q", tt.n, name)
+		}
+	}
+}
+
+func TestDirCacherInvalidName(t *testing.T) {
+	dirCacher := &DirCacher{Dir: t.TempDir()}
+	for _, name := range []string{"", ".", "..", "/a", "a/", "a//b", "a/./b", "a/../b", "../a", `a\b`, `\a`} {
+		if _, err := dirCacher.Get(context.Background(), name); err == nil {
+			t.Errorf("%q: expected error", name)
+		} else if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: got %q, want an error that matches %q", name, err, ErrInvalidName)
+		}
+		if err := dirCacher.Put(context.Background(), name, strings.NewReader("foobar")); err == nil {
+			t.Errorf("%q: expected error", name)
+		} else if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: got %q, want an error that matches %q", name, err, ErrInvalidName)
+		}
+		if err := dirCacher.PutAll(context.Background(), []CacheEntry{{Name: name, Content: strings.NewReader("foobar")}}); err == nil {
+			t.Errorf("%q: expected error", name)
+		} else if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: got %q, want an error that matches %q", name, err, ErrInvalidName)
+		}
+	}
+	if got := walkDirFiles(t, dirCacher.Dir); len(got) > 0 {
+		t.Errorf("got %q, want none", got)
+	}
+
+	bundle, err := makeTar(map[string][]byte{"../example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	dirCacher = &DirCacher{Dir: filepath.Join(t.TempDir(), "cache")}
+	if err := dirCacher.Sync(context.Background(), bytes.NewReader(bundle), "application/x-tar", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("got %q, want an error that matches %q", err, ErrInvalidName)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dirCacher.Dir), "example.com")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestCheckCacheName(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		name    string
+		wantErr bool
+	}{
+		{1, "example.com/@v/v1.0.0.zip", false},
+		{2, "example.com/@latest", false},
+		{3, "sumdb/sum.golang.org/lookup/example.com@v1.0.0", false},
+		{4, "", true},
+		{5, ".", true},
+		{6, "/example.com/@latest", true},
+		{7, "example.com/@v/", true},
+		{8, "example.com//@latest", true},
+		{9, "example.com/../@latest", true},
+		{10, `example.com\@latest`, true},
+	} {
+		if err := checkCacheName(tt.name); tt.wantErr {
+			if err == nil {
+				t.Errorf("test(%d): expected error", tt.n)
+			} else if !errors.Is(err, ErrInvalidName) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, ErrInvalidName)
+			}
+		} else if err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		}
+	}
+}
+
+func TestIsLockFile(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		name string
+		want bool
+	}{
+		{1, "cache/lock", true},
+		{2, "lock", true},
+		{3, "example.com/@v/v1.0.0.lock", true},
+		{4, "example.com/@v/v1.0.0.zip", false},
+		{5, "example.com/lockfile", false},
+	} {
+		if got, want := isLockFile(tt.name), tt.want; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestIsModuleCacheName(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		name string
+		want bool
+	}{
+		{1, "example.com/@latest", true},
+		{2, "example.com/@v/list", true},
+		{3, "example.com/@v/v1.0.0.info", true},
+		{4, "example.com/@v/v1.0.0.mod", true},
+		{5, "example.com/@v/v1.0.0.zip", true},
+		{6, "example.com/@v/v1.0.0.ziphash", true},
+		{7, "example.com/!foo/@v/v1.0.0-!r!c1.zip", true},
+		{8, "cache/vcs/foo", true},
+		{9, "sumdb/sum.golang.org/lookup/example.com@v1.0.0", true},
+		{10, ".DS_Store", false},
+		{11, "README", false},
+		{12, "example.com/@v/v1.0.0.zip.partial", false},
+		{13, "example.com/@v/.DS_Store", false},
+		{14, "example.com/@v/v1.0.0", false},
+		{15, "Example.com/@v/v1.0.0.zip", false},
+		{16, "example.com/@v/v1.0.0-RC1.zip", false},
+		{17, "example.com/@foo", false},
+		{18, "example.com/@v/v1.0.0.ready", true},
+	} {
+		if got, want := isModuleCacheName(tt.name), tt.want; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func makeTar(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(files[name])),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func walkDirFiles(t *testing.T, dir string) []string {
+	var files []string
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	return files
+}
+
+func BenchmarkDirCacherPut(b *testing.B) {
+	for _, bb := range []struct {
+		name           string
+		content        []byte
+		copyBufferSize int
+	}{
+		{"Size=64MiB/CopyBufferSize=0", bytes.Repeat([]byte("0123456789abcdef"), 4<<20), 0},
+		{"Size=64MiB/CopyBufferSize=1048576", bytes.Repeat([]byte("0123456789abcdef"), 4<<20), 1 << 20},
+		{"Size=128B/CopyBufferSize=0", bytes.Repeat([]byte("0123456789abcdef"), 8), 0}, // About the size of an .info file.
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			dirCacher := &DirCacher{Dir: b.TempDir(), CopyBufferSize: bb.copyBufferSize}
+			b.SetBytes(int64(len(bb.content)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Hide the [io.WriterTo] implemented by the [bytes.Reader],
+				// as most content being cached is streamed.
+				if err := dirCacher.Put(context.Background(), "example.com/@v/v1.0.0.zip", struct{ io.ReadSeeker }{bytes.NewReader(bb.content)}); err != nil {
+					b.Fatalf("unexpected error %q", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDirCacherTrackAccess(b *testing.B) {
+	names := make([]string, 1024)
+	for i := range names {
+		names[i] = fmt.Sprintf("example.com/@v/v1.0.%d.info", i)
+	}
+	for _, trackAccess := range []bool{false, true} {
+		b.Run(fmt.Sprintf("TrackAccess=%t", trackAccess), func(b *testing.B) {
+			dirCacher := &DirCacher{Dir: b.TempDir(), TrackAccess: trackAccess}
+			for _, name := range names {
+				if err := dirCacher.Put(context.Background(), name, strings.NewReader("{}")); err != nil {
+					b.Fatalf("unexpected error %q", err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					rc, err := dirCacher.Get(context.Background(), names[i%len(names)])
+					if err != nil {
+						b.Errorf("unexpected error %q", err)
+						return
+					}
+					rc.Close()
+				}
+			})
+		})
+	}
+}
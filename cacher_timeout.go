@@ -0,0 +1,328 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// NewTimeoutCacher returns a [Cacher] that bounds each operation on the c by
+// the timeout, so that a hung store behind the c (e.g., an unresponsive NFS
+// mount, on which [DirCacher] blocks in system calls that cannot observe
+// contexts) does not tie up its caller forever. An operation that has not
+// returned within the timeout, or before the deadline of its context, fails
+// with an [*fs.PathError] wrapping [context.DeadlineExceeded], and one whose
+// context is canceled first fails with [context.Canceled], even if the method
+// of the c is still running. Such
+// a method is left running in the background, and the content it returns (see
+// [Cacher.Get]) is closed once it returns. The contents given to it (see
+// [Cacher.Put]) are never read again after the operation has failed, so that
+// callers can safely reuse them.
+//
+// The context given to the method of the c has the timeout as its deadline,
+// except for [Cacher.Get], whose content may depend on its context (e.g., the
+// response body of [HTTPCacher]). Reading the content returned by
+// [Cacher.Get] is not bounded, and neither is [Cacher.Sync], as imports of
+// large bundles can legitimately take a long time.
+//
+// The returned [Cacher] implements [BatchPutter], whose [BatchPutter.PutAll]
+// counts as a single operation and puts the entries by [PutAll] on the c. It
+// also implements [Lister], [Deleter], [Stater], [Readlinker], [RangeReader],
+// and [VerifiedPutter] by forwarding them to the c, with their operations
+// bounded in the same way as [Cacher.Put], except for
+// [RangeReader.RangeReadCloser], which is bounded in the same way as
+// [Cacher.Get]. Those that the c does not implement fail with an error that
+// matches [ErrUnsupported]. Contents given to the c that implement [Sizer] keep
+// implementing it.
+//
+// NewTimeoutCacher panics if the timeout is not positive.
+func NewTimeoutCacher(c Cacher, timeout time.Duration) Cacher {
+	if timeout <= 0 {
+		panic("goproxy: NewTimeoutCacher: non-positive timeout")
+	}
+	return &timeoutCacher{cacher: c, timeout: timeout}
+}
+
+// timeoutCacher is the [Cacher] returned by [NewTimeoutCacher].
+type timeoutCacher struct {
+	cacher  Cacher
+	timeout time.Duration
+}
+
+// wait runs the f in a new goroutine and waits for it to return for up to the
+// tc.timeout, or until the ctx is done. If the f does not return in time, the
+// abandon is called right away, and the cleanup is called once the f returns,
+// if they are not nil. The op and name are used to describe the timeout error.
+func (tc *timeoutCacher) wait(ctx context.Context, op, name string, f func() error, abandon, cleanup func()) error {
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	timer := time.NewTimer(tc.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		err = &fs.PathError{Op: op, Path: name, Err: context.DeadlineExceeded}
+	case <-ctx.Done():
+		if err = ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+			err = &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	if abandon != nil {
+		abandon()
+	}
+	if cleanup != nil {
+		go func() {
+			<-done
+			cleanup()
+		}()
+	}
+	return err
+}
+
+// Get implements [Cacher].
+func (tc *timeoutCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	var content io.ReadCloser
+	err := tc.wait(ctx, "get", name, func() (err error) {
+		content, err = tc.cacher.Get(ctx, name)
+		return err
+	}, nil, func() {
+		if content != nil {
+			content.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Put implements [Cacher].
+func (tc *timeoutCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	guard := &contentGuard{}
+	return tc.wait(ctx, "put", name, func() error {
+		return tc.cacher.Put(ctx, name, guard.wrap(content))
+	}, guard.abandon, nil)
+}
+
+// PutAll implements [BatchPutter].
+func (tc *timeoutCacher) PutAll(ctx context.Context, entries []CacheEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	guard := &contentGuard{}
+	guardedEntries := make([]CacheEntry, len(entries))
+	for i, entry := range entries {
+		guardedEntries[i] = CacheEntry{Name: entry.Name, Content: guard.wrap(entry.Content)}
+	}
+	name := ""
+	if len(entries) > 0 {
+		name = entries[0].Name
+	}
+	return tc.wait(ctx, "putall", name, func() error {
+		return PutAll(ctx, tc.cacher, guardedEntries)
+	}, guard.abandon, nil)
+}
+
+// Sync implements [Cacher].
+func (tc *timeoutCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	return tc.cacher.Sync(ctx, uploadCacheDirReader, compressType, opts)
+}
+
+// List implements [Lister].
+func (tc *timeoutCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	lister, ok := tc.cacher.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("listing caches %w", ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	var names []string
+	err := tc.wait(ctx, "list", prefix, func() (err error) {
+		names, err = lister.List(ctx, prefix)
+		return err
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Delete implements [Deleter].
+func (tc *timeoutCacher) Delete(ctx context.Context, name string) error {
+	deleter, ok := tc.cacher.(Deleter)
+	if !ok {
+		return fmt.Errorf("deleting caches %w", ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	return tc.wait(ctx, "delete", name, func() error {
+		return deleter.Delete(ctx, name)
+	}, nil, nil)
+}
+
+// Stat implements [Stater].
+func (tc *timeoutCacher) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	stater, ok := tc.cacher.(Stater)
+	if !ok {
+		return nil, fmt.Errorf("stating caches %w", ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	var fi fs.FileInfo
+	err := tc.wait(ctx, "stat", name, func() (err error) {
+		fi, err = stater.Stat(ctx, name)
+		return err
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// Readlink implements [Readlinker].
+func (tc *timeoutCacher) Readlink(ctx context.Context, name string) (string, error) {
+	readlinker, ok := tc.cacher.(Readlinker)
+	if !ok {
+		return "", fmt.Errorf("reading links of caches %w", ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	var target string
+	err := tc.wait(ctx, "readlink", name, func() (err error) {
+		target, err = readlinker.Readlink(ctx, name)
+		return err
+	}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// RangeReadCloser implements [RangeReader].
+func (tc *timeoutCacher) RangeReadCloser(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	rr, ok := tc.cacher.(RangeReader)
+	if !ok {
+		return nil, fmt.Errorf("reading ranges of caches %w", ErrUnsupported)
+	}
+	var content io.ReadCloser
+	err := tc.wait(ctx, "getrange", name, func() (err error) {
+		content, err = rr.RangeReadCloser(ctx, name, start, end)
+		return err
+	}, nil, func() {
+		if content != nil {
+			content.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// PutVerified implements [VerifiedPutter].
+func (tc *timeoutCacher) PutVerified(ctx context.Context, name string, content io.Reader, expect VerifyInfo) error {
+	vp, ok := tc.cacher.(VerifiedPutter)
+	if !ok {
+		return fmt.Errorf("verified puts of caches %w", ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+	defer cancel()
+	guard := &contentGuard{}
+	return tc.wait(ctx, "put", name, func() error {
+		return vp.PutVerified(ctx, name, guard.wrapReader(content), expect)
+	}, guard.abandon, nil)
+}
+
+// errContentAbandoned is the error returned by the contents wrapped by a
+// [contentGuard] once it has been abandoned.
+var errContentAbandoned = errors.New("content abandoned by timed out cacher operation")
+
+// contentGuard guards contents given to an operation of a [timeoutCacher], so
+// that they are never read after the operation has been abandoned.
+type contentGuard struct {
+	mu        sync.RWMutex
+	abandoned bool
+}
+
+// wrap returns the content guarded by the cg. The returned content implements
+// [Sizer] if the content does.
+func (cg *contentGuard) wrap(content io.ReadSeeker) io.ReadSeeker {
+	gc := &guardedContent{cg: cg, content: content}
+	if s, ok := content.(Sizer); ok {
+		return &sizedGuardedContent{guardedContent: gc, sizer: s}
+	}
+	return gc
+}
+
+// wrapReader is like [contentGuard.wrap] but for a content that cannot seek.
+func (cg *contentGuard) wrapReader(content io.Reader) io.Reader {
+	return &guardedReader{cg: cg, content: content}
+}
+
+// read reads from the content into the p unless the cg has been abandoned.
+func (cg *contentGuard) read(content io.Reader, p []byte) (int, error) {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+	if cg.abandoned {
+		return 0, errContentAbandoned
+	}
+	return content.Read(p)
+}
+
+// abandon makes the contents guarded by the cg fail from now on. It waits for
+// any read or seek in progress to complete.
+func (cg *contentGuard) abandon() {
+	cg.mu.Lock()
+	cg.abandoned = true
+	cg.mu.Unlock()
+}
+
+// guardedContent is a content guarded by a [contentGuard].
+type guardedContent struct {
+	cg      *contentGuard
+	content io.ReadSeeker
+}
+
+// Read implements [io.Reader].
+func (gc *guardedContent) Read(p []byte) (int, error) {
+	return gc.cg.read(gc.content, p)
+}
+
+// Seek implements [io.Seeker].
+func (gc *guardedContent) Seek(offset int64, whence int) (int64, error) {
+	gc.cg.mu.RLock()
+	defer gc.cg.mu.RUnlock()
+	if gc.cg.abandoned {
+		return 0, errContentAbandoned
+	}
+	return gc.content.Seek(offset, whence)
+}
+
+// sizedGuardedContent is a [guardedContent] whose content implements [Sizer].
+type sizedGuardedContent struct {
+	*guardedContent
+	sizer Sizer
+}
+
+// Size implements [Sizer].
+func (sgc *sizedGuardedContent) Size() int64 {
+	return sgc.sizer.Size()
+}
+
+// guardedReader is a content that cannot seek guarded by a [contentGuard].
+type guardedReader struct {
+	cg      *contentGuard
+	content io.Reader
+}
+
+// Read implements [io.Reader].
+func (gr *guardedReader) Read(p []byte) (int, error) {
+	return gr.cg.read(gr.content, p)
+}
@@ -0,0 +1,188 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTimeoutCacher(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	tc := NewTimeoutCacher(dc, time.Minute)
+	if err := tc.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if rc, err := tc.Get(context.Background(), "example.com/@v/list"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if b, err := io.ReadAll(rc); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "v1.0.0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	} else {
+		rc.Close()
+	}
+	if err := tc.(BatchPutter).PutAll(context.Background(), []CacheEntry{{Name: "example.com/@latest", Content: strings.NewReader("{}")}}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, err := tc.(Lister).List(context.Background(), "example.com/"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(got, ","), "example.com/@latest,example.com/@v/list"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := tc.(Deleter).Delete(context.Background(), "example.com/@latest"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := tc.Get(context.Background(), "example.com/@latest"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+	if err := tc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("module example.com"), VerifyInfo{Size: 1}); !errors.Is(err, ErrContentMismatch) {
+		t.Errorf("got %v, want ErrContentMismatch", err)
+	}
+	if err := tc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("module example.com"), VerifyInfo{Size: 18}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if fi, err := tc.(Stater).Stat(context.Background(), "example.com/@v/v1.0.0.mod"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := fi.Size(), int64(18); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if target, err := tc.(Readlinker).Readlink(context.Background(), "example.com/@v/v1.0.0.mod"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if target != "" {
+		t.Errorf("got %q, want empty", target)
+	}
+
+	var putSizer bool
+	tc = NewTimeoutCacher(&testCacher{
+		Cacher: dc,
+		put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+			_, putSizer = content.(Sizer)
+			return c.Put(ctx, name, content)
+		},
+	}, time.Minute)
+	if err := tc.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !putSizer {
+		t.Error("expected content implementing Sizer")
+	}
+	for _, err := range []error{
+		func() error { _, err := tc.(Lister).List(context.Background(), ""); return err }(),
+		tc.(Deleter).Delete(context.Background(), "example.com/@v/list"),
+		func() error { _, err := tc.(Stater).Stat(context.Background(), "example.com/@v/list"); return err }(),
+		func() error {
+			_, err := tc.(Readlinker).Readlink(context.Background(), "example.com/@v/list")
+			return err
+		}(),
+		func() error {
+			_, err := tc.(RangeReader).RangeReadCloser(context.Background(), "example.com/@v/list", 0, 1)
+			return err
+		}(),
+		tc.(VerifiedPutter).PutVerified(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0"), VerifyInfo{}),
+	} {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("got %v, want ErrUnsupported", err)
+		}
+	}
+
+	func() {
+		defer func() {
+			if got, want := recover(), "goproxy: NewTimeoutCacher: non-positive timeout"; got != want {
+				t.Errorf("got %v, want %q", got, want)
+			}
+		}()
+		NewTimeoutCacher(dc, 0)
+	}()
+}
+
+func TestNewTimeoutCacherSlow(t *testing.T) {
+	block := make(chan struct{})
+	closed := make(chan struct{}, 3)
+	readErrs := make(chan error, 1)
+	tc := NewTimeoutCacher(&testCacher{
+		Cacher: &DirCacher{Dir: t.TempDir()},
+		get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+			<-block
+			return &testReadCloser{Reader: strings.NewReader(name), close: func() { closed <- struct{}{} }}, nil
+		},
+		put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+			<-block
+			_, err := io.ReadAll(content)
+			readErrs <- err
+			return err
+		},
+	}, 10*time.Millisecond)
+
+	for _, tt := range []struct {
+		n   int
+		ctx func() (context.Context, context.CancelFunc)
+		op  string
+	}{
+		{1, func() (context.Context, context.CancelFunc) { return context.Background(), func() {} }, "get"},
+		{2, func() (context.Context, context.CancelFunc) { return context.Background(), func() {} }, "put"},
+		{3, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), time.Millisecond)
+		}, "get"},
+	} {
+		ctx, cancel := tt.ctx()
+		start := time.Now()
+		var err error
+		switch tt.op {
+		case "get":
+			_, err = tc.Get(ctx, "example.com/@v/list")
+		case "put":
+			err = tc.Put(ctx, "example.com/@v/list", strings.NewReader("v1.0.0"))
+		}
+		cancel()
+		if got, want := time.Since(start), 5*time.Second; got > want {
+			t.Errorf("test(%d): got %v, want at most %v", tt.n, got, want)
+		}
+		var pe *fs.PathError
+		if err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, context.DeadlineExceeded)
+		} else if !errors.As(err, &pe) {
+			t.Errorf("test(%d): got %T, want *fs.PathError", tt.n, err)
+		} else if got, want := pe.Op, tt.op; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tc.Get(ctx, "example.com/@v/list"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+
+	close(block)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for abandoned contents to be closed")
+		}
+	}
+	select {
+	case err := <-readErrs:
+		if got, want := err, errContentAbandoned; !errors.Is(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for abandoned put")
+	}
+}
+
+type testReadCloser struct {
+	io.Reader
+	close func()
+}
+
+func (rc *testReadCloser) Close() error {
+	rc.close()
+	return nil
+}
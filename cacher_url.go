@@ -0,0 +1,197 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacherFactory constructs a [Cacher] from a URL whose scheme it has been
+// registered for by [RegisterCacherScheme].
+type CacherFactory func(u *url.URL) (Cacher, error)
+
+var (
+	cacherSchemesMutex sync.RWMutex
+	cacherSchemes      = map[string]CacherFactory{
+		"file":  newFileCacher,
+		"mem":   newMemCacher,
+		"http":  newHTTPCacher,
+		"https": newHTTPCacher,
+	}
+)
+
+// RegisterCacherScheme registers the factory for the URLs with the scheme in
+// [NewCacherFromURL], so that third-party backends (e.g., "s3" or "redis")
+// can be configured with a single string. Schemes are case-insensitive.
+//
+// RegisterCacherScheme panics if the scheme is empty or already registered,
+// or if the factory is nil.
+func RegisterCacherScheme(scheme string, factory CacherFactory) {
+	if scheme == "" {
+		panic("goproxy: RegisterCacherScheme: empty scheme")
+	}
+	if factory == nil {
+		panic("goproxy: RegisterCacherScheme: nil factory")
+	}
+	scheme = strings.ToLower(scheme)
+	cacherSchemesMutex.Lock()
+	defer cacherSchemesMutex.Unlock()
+	if _, ok := cacherSchemes[scheme]; ok {
+		panic("goproxy: RegisterCacherScheme: scheme " + scheme + " already registered")
+	}
+	cacherSchemes[scheme] = factory
+}
+
+// NewCacherFromURL returns the [Cacher] described by the rawurl, as
+// constructed by the [CacherFactory] registered for its scheme (see
+// [RegisterCacherScheme]). The following schemes are built in:
+//   - "file": a [DirCacher] whose Dir is the path of the URL (e.g.,
+//     "file:///var/cache/goproxy").
+//   - "mem": a [Cacher] that keeps caches in memory, which is lost when the
+//     process exits (e.g., "mem://"). It implements [Lister] and [Deleter],
+//     but does not support [Cacher.Sync].
+//   - "http" and "https": an [HTTPCacher] whose BaseURL is the rawurl
+//     (e.g., "https://goproxy.example.com").
+func NewCacherFromURL(rawurl string) (Cacher, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cacher URL: %w", err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("invalid cacher URL %q: missing scheme", rawurl)
+	}
+	cacherSchemesMutex.RLock()
+	factory, ok := cacherSchemes[u.Scheme]
+	cacherSchemesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid cacher URL %q: unsupported scheme %q", rawurl, u.Scheme)
+	}
+	return factory(u)
+}
+
+// newFileCacher is the [CacherFactory] for the "file" scheme.
+func newFileCacher(u *url.URL) (Cacher, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("invalid cacher URL %q: unexpected host %q", u, u.Host)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("invalid cacher URL %q: missing path", u)
+	}
+	dir := u.Path
+	if filepath.VolumeName(dir[1:]) != "" {
+		dir = dir[1:] // Remove the leading slash of "/C:/path" on Windows.
+	}
+	return &DirCacher{Dir: filepath.FromSlash(dir)}, nil
+}
+
+// newMemCacher is the [CacherFactory] for the "mem" scheme.
+func newMemCacher(u *url.URL) (Cacher, error) {
+	if u.Host != "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid cacher URL %q: unexpected host or path", u)
+	}
+	return &memCacher{}, nil
+}
+
+// newHTTPCacher is the [CacherFactory] for the "http" and "https" schemes.
+func newHTTPCacher(u *url.URL) (Cacher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid cacher URL %q: missing host", u)
+	}
+	return &HTTPCacher{BaseURL: u.String()}, nil
+}
+
+// memCacher is the [Cacher] for the "mem" scheme of [NewCacherFromURL].
+type memCacher struct {
+	mu     sync.RWMutex
+	caches map[string]memCache
+}
+
+// memCache is a cache kept by a [memCacher].
+type memCache struct {
+	content []byte
+	modTime time.Time
+}
+
+// Get implements [Cacher].
+func (mc *memCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkCacheName(name); err != nil {
+		return nil, err
+	}
+	mc.mu.RLock()
+	cache, ok := mc.caches[name]
+	mc.mu.RUnlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memCacheContent{Reader: bytes.NewReader(cache.content), modTime: cache.modTime}, nil
+}
+
+// Put implements [Cacher].
+func (mc *memCacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.caches == nil {
+		mc.caches = map[string]memCache{}
+	}
+	mc.caches[name] = memCache{content: b, modTime: time.Now()}
+	return nil
+}
+
+// Sync implements [Cacher].
+func (mc *memCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	return errors.New("sync not supported by in-memory cacher")
+}
+
+// List implements [Lister].
+func (mc *memCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	var names []string
+	for name := range mc.caches {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements [Deleter]. Contents returned by [memCacher.Get] before
+// the deletion are not affected, as they read the bytes of the cache as it was.
+func (mc *memCacher) Delete(ctx context.Context, name string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	delete(mc.caches, name)
+	mc.mu.Unlock()
+	return nil
+}
+
+// memCacheContent is the content of a cache got by [memCacher].
+type memCacheContent struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+// ModTime returns the time at which the cache was put.
+func (mcc *memCacheContent) ModTime() time.Time { return mcc.modTime }
+
+// Close implements [io.Closer].
+func (mcc *memCacheContent) Close() error { return nil }
@@ -0,0 +1,157 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCacherFromURL(t *testing.T) {
+	wantDir := t.TempDir()
+	dir := filepath.ToSlash(wantDir)
+	if !strings.HasPrefix(dir, "/") {
+		dir = "/" + dir
+	}
+	for _, tt := range []struct {
+		n          int
+		rawurl     string
+		wantCacher string
+		wantErr    error
+	}{
+		{1, "file://" + dir, "*goproxy.DirCacher", nil},
+		{2, "FILE://localhost" + dir, "*goproxy.DirCacher", nil},
+		{3, "mem://", "*goproxy.memCacher", nil},
+		{4, "https://goproxy.example.com/cache", "*goproxy.HTTPCacher", nil},
+		{5, "s4://bucket/prefix", "", errors.New(`invalid cacher URL "s4://bucket/prefix": unsupported scheme "s4"`)},
+		{6, "/var/cache", "", errors.New(`invalid cacher URL "/var/cache": missing scheme`)},
+		{7, "file://example.com/var/cache", "", errors.New(`invalid cacher URL "file://example.com/var/cache": unexpected host "example.com"`)},
+		{8, "file://", "", errors.New(`invalid cacher URL "file:": missing path`)},
+		{9, "mem://example.com", "", errors.New(`invalid cacher URL "mem://example.com": unexpected host or path`)},
+		{10, "http:///cache", "", errors.New(`invalid cacher URL "http:///cache": missing host`)},
+		{11, "file://%zz", "", errors.New(`invalid cacher URL: parse "file://%zz": invalid URL escape "%zz"`)},
+	} {
+		c, err := NewCacherFromURL(tt.rawurl)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := fmt.Sprintf("%T", c), tt.wantCacher; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if dc, ok := c.(*DirCacher); ok {
+			if got, want := dc.Dir, wantDir; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestRegisterCacherScheme(t *testing.T) {
+	var gotURL *url.URL
+	dc := &DirCacher{Dir: t.TempDir()}
+	RegisterCacherScheme("Test-Register", func(u *url.URL) (Cacher, error) {
+		gotURL = u
+		if u.Host == "" {
+			return nil, errors.New("missing bucket")
+		}
+		return dc, nil
+	})
+	t.Cleanup(func() {
+		cacherSchemesMutex.Lock()
+		delete(cacherSchemes, "test-register")
+		cacherSchemesMutex.Unlock()
+	})
+
+	if c, err := NewCacherFromURL("test-register://bucket/prefix"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if c != Cacher(dc) {
+		t.Errorf("got %v, want %v", c, dc)
+	}
+	if got, want := gotURL.Host+gotURL.Path, "bucket/prefix"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := NewCacherFromURL("test-register:///prefix"); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err.Error(), "missing bucket"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		n         int
+		scheme    string
+		factory   CacherFactory
+		wantPanic string
+	}{
+		{1, "", newMemCacher, "goproxy: RegisterCacherScheme: empty scheme"},
+		{2, "test-nil", nil, "goproxy: RegisterCacherScheme: nil factory"},
+		{3, "TEST-REGISTER", newMemCacher, "goproxy: RegisterCacherScheme: scheme test-register already registered"},
+		{4, "file", newMemCacher, "goproxy: RegisterCacherScheme: scheme file already registered"},
+	} {
+		func() {
+			defer func() {
+				if got, want := recover(), tt.wantPanic; got != want {
+					t.Errorf("test(%d): got %v, want %q", tt.n, got, want)
+				}
+			}()
+			RegisterCacherScheme(tt.scheme, tt.factory)
+		}()
+	}
+}
+
+func TestMemCacher(t *testing.T) {
+	c, err := NewCacherFromURL("mem://")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, name := range []string{"example.com/@v/v1.0.0.mod", "example.com/@v/list", "example.org/@latest"} {
+		if err := c.Put(context.Background(), name, strings.NewReader(name)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if rc, err := c.Get(context.Background(), "example.com/@v/list"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if b, err := io.ReadAll(rc); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "example.com/@v/list"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	} else if got := rc.(interface{ ModTime() time.Time }).ModTime(); got.IsZero() {
+		t.Error("got zero mod time")
+	} else {
+		rc.Close()
+	}
+	if _, err := c.Get(context.Background(), "example.com/@v/v1.1.0.mod"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+	if _, err := c.Get(context.Background(), "../example.com/@v/list"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("got %v, want ErrInvalidName", err)
+	}
+	if got, err := c.(Lister).List(context.Background(), "example.com/"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(got, ","), "example.com/@v/list,example.com/@v/v1.0.0.mod"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := c.(Deleter).Delete(context.Background(), "example.com/@v/list"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := c.Get(context.Background(), "example.com/@v/list"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+	if err := c.Sync(context.Background(), strings.NewReader(""), "", SyncOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err.Error(), "sync not supported by in-memory cacher"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+package goproxy
+
+// crossDeviceErrno is always nil, since cross-device renames cannot be
+// detected on this platform.
+var crossDeviceErrno error
+
+// isCrossDeviceError always reports false, since cross-device renames cannot
+// be detected on this platform.
+func isCrossDeviceError(err error) bool {
+	return false
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package goproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// crossDeviceErrno is the error that a rename fails with when the old and new
+// paths are on different filesystems.
+var crossDeviceErrno error = syscall.EXDEV
+
+// isCrossDeviceError reports whether the err indicates that a file cannot be
+// renamed because the old and new paths are on different filesystems.
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, crossDeviceErrno)
+}
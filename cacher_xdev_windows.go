@@ -0,0 +1,19 @@
+package goproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNotSameDevice is the ERROR_NOT_SAME_DEVICE Windows error code.
+const errorNotSameDevice syscall.Errno = 17
+
+// crossDeviceErrno is the error that a rename fails with when the old and new
+// paths are on different volumes.
+var crossDeviceErrno error = errorNotSameDevice
+
+// isCrossDeviceError reports whether the err indicates that a file cannot be
+// renamed because the old and new paths are on different volumes.
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, crossDeviceErrno)
+}
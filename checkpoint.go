@@ -0,0 +1,115 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// syncCheckpointInterval is the number of tar entries extracted between two
+// records of a [syncCheckpoint].
+const syncCheckpointInterval = 100
+
+// syncCheckpoint records the progress of [DirCacher.Sync] in a file (see
+// [SyncOptions.Checkpoint]). The zero value records nothing.
+type syncCheckpoint struct {
+	file string
+
+	resumeEntry int
+	resumeName  string
+
+	entry   int
+	name    string
+	pending int
+}
+
+// syncCheckpointState is the content of a [syncCheckpoint] file.
+type syncCheckpointState struct {
+	Entry int    `json:"entry"`
+	Name  string `json:"name"`
+}
+
+// newSyncCheckpoint returns a new [syncCheckpoint] for the opts. If the
+// opts.Resume is true, the progress recorded in the opts.Checkpoint, if any,
+// is loaded.
+func newSyncCheckpoint(opts SyncOptions) (*syncCheckpoint, error) {
+	cp := &syncCheckpoint{file: opts.Checkpoint, resumeEntry: -1, entry: -1}
+	if cp.file == "" || !opts.Resume {
+		return cp, nil
+	}
+	b, err := os.ReadFile(cp.file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return cp, nil
+		}
+		return nil, err
+	}
+	var state syncCheckpointState
+	if err := json.Unmarshal(b, &state); err != nil || state.Entry < 0 {
+		return nil, fmt.Errorf("invalid checkpoint: %s", cp.file)
+	}
+	cp.resumeEntry, cp.resumeName = state.Entry, state.Name
+	return cp, nil
+}
+
+// skip reports whether the tar entry at the index with the name has already
+// been extracted by the resumed import. It returns an error if the recorded
+// entry does not match the bundle.
+func (cp *syncCheckpoint) skip(index int, name string) (bool, error) {
+	if index > cp.resumeEntry {
+		return false, nil
+	}
+	if index == cp.resumeEntry && name != cp.resumeName {
+		return false, fmt.Errorf("checkpoint does not match bundle: got entry %d %q, want %q", index, name, cp.resumeName)
+	}
+	return true, nil
+}
+
+// done records that the tar entry at the index with the name has been
+// extracted. The progress is written to the file every
+// syncCheckpointInterval entries.
+func (cp *syncCheckpoint) done(index int, name string) error {
+	cp.entry, cp.name = index, name
+	if cp.file == "" {
+		return nil
+	}
+	if cp.pending++; cp.pending < syncCheckpointInterval {
+		return nil
+	}
+	return cp.write()
+}
+
+// write writes the progress to the file atomically.
+func (cp *syncCheckpoint) write() error {
+	cp.pending = 0
+	b, err := json.Marshal(syncCheckpointState{Entry: cp.entry, Name: cp.name})
+	if err != nil {
+		return err
+	}
+	tempFile := cp.file + ".tmp"
+	if err := os.WriteFile(tempFile, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, cp.file)
+}
+
+// close finishes recording the progress of the import that ended with the
+// err. The file is removed if the err is nil. Otherwise, the latest progress
+// is written to it. The err is returned as is.
+func (cp *syncCheckpoint) close(err error) error {
+	if cp.file == "" {
+		return err
+	}
+	if err == nil {
+		if err := os.Remove(cp.file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if cp.pending > 0 {
+		cp.write()
+	}
+	return err
+}
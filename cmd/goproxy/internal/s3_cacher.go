@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/goproxy/goproxy"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
@@ -23,7 +24,7 @@ type s3Cacher struct {
 }
 
 // Sync implements goproxy.Cacher.
-func (s3c *s3Cacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string) error {
+func (s3c *s3Cacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts goproxy.SyncOptions) error {
 	panic("unimplemented")
 }
 
@@ -84,13 +85,10 @@ func (s3c *s3Cacher) Get(ctx context.Context, name string) (io.ReadCloser, error
 
 // Put implements [github.com/goproxy/goproxy.Cacher].
 func (s3c *s3Cacher) Put(ctx context.Context, name string, content io.ReadSeeker) error {
-	size, err := content.Seek(0, io.SeekEnd)
+	size, err := goproxy.ContentSize(content)
 	if err != nil {
 		return err
 	}
-	if _, err := content.Seek(0, io.SeekStart); err != nil {
-		return err
-	}
 
 	contentType := "application/octet-stream"
 	nameExt := filepath.Ext(name)
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -46,9 +47,14 @@ type serverCmdConfig struct {
 	tlsCertFile      string
 	tlsKeyFile       string
 	pathPrefix       string
+	noUploadPage     bool
+	allowedPrefixes  []string
 	goBin            string
 	maxDirectFetches int
+	sumDB            string
 	proxiedSumDBs    []string
+	mutableCacheTTL  time.Duration
+	revalidateCaches bool
 	cacher           string
 	cacherDir        string
 	s3CacherOpts     s3CacherOptions
@@ -57,6 +63,7 @@ type serverCmdConfig struct {
 	connectTimeout   time.Duration
 	fetchTimeout     time.Duration
 	shutdownTimeout  time.Duration
+	logConfig        bool
 }
 
 // newServerCmdConfig creates a new [serverCmdConfig].
@@ -67,9 +74,14 @@ func newServerCmdConfig(cmd *cobra.Command) *serverCmdConfig {
 	fs.StringVar(&cfg.tlsCertFile, "tls-cert-file", "", "path to the TLS certificate file")
 	fs.StringVar(&cfg.tlsKeyFile, "tls-key-file", "", "path to the TLS key file")
 	fs.StringVar(&cfg.pathPrefix, "path-prefix", "", "prefix for all request paths")
+	fs.BoolVar(&cfg.noUploadPage, "disable-upload-page", false, "serve a plain text landing page instead of the HTML page at / for uploading cache files in bulk")
+	fs.StringSliceVar(&cfg.allowedPrefixes, "allowed-prefixes", nil, "list of module path patterns (same form as GOPRIVATE) that are served, all others being forbidden (empty means all are served)")
 	fs.StringVar(&cfg.goBin, "go-bin", "go", "path to the Go binary that is used to execute direct fetches")
 	fs.IntVar(&cfg.maxDirectFetches, "max-direct-fetches", 0, "maximum number (0 means no limit) of concurrent direct fetches")
+	fs.StringVar(&cfg.sumDB, "sumdb", "", "checksum database used to verify fetched modules (same form as GOSUMDB, which is used if empty)")
 	fs.StringSliceVar(&cfg.proxiedSumDBs, "proxied-sumdbs", nil, "list of proxied checksum databases")
+	fs.DurationVar(&cfg.mutableCacheTTL, "mutable-cache-ttl", 0, "maximum age (0 means always refresh) of cached @latest, @v/list, and version query responses that are served without being refreshed")
+	fs.BoolVar(&cfg.revalidateCaches, "revalidate-mutable-caches", false, "revalidate cached responses older than --mutable-cache-ttl with conditional requests instead of refetching them")
 	fs.StringVar(&cfg.cacher, "cacher", "dir", "cacher to use (valid values: dir, s3)")
 	fs.StringVar(&cfg.cacherDir, "cacher-dir", "caches", "directory for the dir cacher")
 	fs.StringVar(&cfg.s3CacherOpts.accessKeyID, "cacher-s3-access-key-id", "", "access key ID for the S3 cacher")
@@ -85,6 +97,7 @@ func newServerCmdConfig(cmd *cobra.Command) *serverCmdConfig {
 	fs.DurationVar(&cfg.connectTimeout, "connect-timeout", 30*time.Second, "maximum amount of time (0 means no limit) will wait for an outgoing connection to establish")
 	fs.DurationVar(&cfg.fetchTimeout, "fetch-timeout", 10*time.Minute, "maximum amount of time (0 means no limit) will wait for a fetch to complete")
 	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 10*time.Second, "maximum amount of time (0 means no limit) will wait for the server to shutdown")
+	fs.BoolVar(&cfg.logConfig, "log-config", false, "log the effective configuration (with secrets redacted) at startup")
 	return cfg
 }
 
@@ -94,20 +107,34 @@ func runServerCmd(cmd *cobra.Command, args []string, cfg *serverCmdConfig) error
 	transport.DialContext = (&net.Dialer{Timeout: cfg.connectTimeout, KeepAlive: 30 * time.Second}).DialContext
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.insecure}
 	transport.RegisterProtocol("file", http.NewFileTransport(httpDirFS{}))
+	fetcher := &goproxy.GoFetcher{
+		GoBin:            cfg.goBin,
+		SumDB:            cfg.sumDB,
+		MaxDirectFetches: cfg.maxDirectFetches,
+		TempDir:          cfg.tempDir,
+		Transport:        transport,
+	}
+	if err := fetcher.Validate(); err != nil {
+		return fmt.Errorf("invalid fetcher configuration: %w", err)
+	}
 	g := &goproxy.Goproxy{
-		Fetcher: &goproxy.GoFetcher{
-			GoBin:            cfg.goBin,
-			MaxDirectFetches: cfg.maxDirectFetches,
-			TempDir:          cfg.tempDir,
-			Transport:        transport,
-		},
-		ProxiedSumDBs: cfg.proxiedSumDBs,
-		TempDir:       cfg.tempDir,
-		Transport:     transport,
+		Fetcher:                 fetcher,
+		ProxiedSumDBs:           cfg.proxiedSumDBs,
+		TempDir:                 cfg.tempDir,
+		Transport:               transport,
+		MutableCacheTTL:         cfg.mutableCacheTTL,
+		PathPrefix:              cfg.pathPrefix,
+		DisableUploadPage:       cfg.noUploadPage,
+		AllowedPrefixes:         cfg.allowedPrefixes,
+		RevalidateMutableCaches: cfg.revalidateCaches,
 	}
 	switch cfg.cacher {
 	case "dir":
-		g.Cacher = goproxy.DirCacher(cfg.cacherDir)
+		dc := &goproxy.DirCacher{Dir: cfg.cacherDir}
+		if err := dc.Migrate(cmd.Context()); err != nil {
+			return fmt.Errorf("failed to migrate cache layout: %w", err)
+		}
+		g.Cacher = dc
 	case "s3":
 		s3CacherOpts := cfg.s3CacherOpts
 		s3CacherOpts.transport = transport
@@ -119,11 +146,15 @@ func runServerCmd(cmd *cobra.Command, args []string, cfg *serverCmdConfig) error
 	default:
 		return fmt.Errorf("invalid --cacher: %q", cfg.cacher)
 	}
+	if cfg.logConfig {
+		b, err := json.Marshal(g.Config())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "effective configuration: %s\n", b)
+	}
 
 	handler := http.Handler(g)
-	if cfg.pathPrefix != "" {
-		handler = http.StripPrefix(cfg.pathPrefix, handler)
-	}
 	if cfg.fetchTimeout > 0 {
 		handler = func(h http.Handler) http.Handler {
 			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
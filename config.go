@@ -0,0 +1,212 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// redacted is the value that replaces sensitive values in [ConfigSnapshot].
+const redacted = "REDACTED"
+
+// ConfigSnapshot is the effective configuration of a [Goproxy], with defaults
+// resolved, as returned by [Goproxy.Config]. It is intended for debugging and
+// can be marshaled to JSON as it is.
+//
+// Sensitive values are replaced with "REDACTED", including the passwords in
+// URLs (e.g., those of proxies in GOPROXY) and the values of environment
+// variables whose names suggest secrets (e.g., "GITHUB_TOKEN" and
+// "AWS_SECRET_ACCESS_KEY").
+type ConfigSnapshot struct {
+	Fetcher                 string           `json:"fetcher"`
+	GoFetcher               *GoFetcherConfig `json:"go_fetcher,omitempty"`
+	Cacher                  string           `json:"cacher"`
+	CacherDir               string           `json:"cacher_dir,omitempty"`
+	MaxConcurrentFetches    int              `json:"max_concurrent_fetches"`
+	ProxiedSumDBs           []string         `json:"proxied_sumdbs"`
+	TempDir                 string           `json:"temp_dir"`
+	MaxMemoryBufferSize     int64            `json:"max_memory_buffer_size"`
+	PathPrefix              string           `json:"path_prefix"`
+	AllowedPrefixes         string           `json:"allowed_prefixes"`
+	MutableCacheTTL         string           `json:"mutable_cache_ttl"`
+	MutableCacheSoftTTL     string           `json:"mutable_cache_soft_ttl"`
+	RevalidateMutableCaches bool             `json:"revalidate_mutable_caches"`
+	ResolutionCacheTTL      string           `json:"resolution_cache_ttl"`
+	ServeWhileCaching       bool             `json:"serve_while_caching"`
+	ValidateModFiles        bool             `json:"validate_mod_files"`
+	ValidateInfoFiles       bool             `json:"validate_info_files"`
+	Metrics                 bool             `json:"metrics"`
+	Tracing                 bool             `json:"tracing"`
+	AccessLog               bool             `json:"access_log"`
+}
+
+// GoFetcherConfig is the effective configuration of a [GoFetcher] in a
+// [ConfigSnapshot].
+type GoFetcherConfig struct {
+	GoBin            string   `json:"go_bin"`
+	GOPROXY          string   `json:"goproxy"`
+	GONOPROXY        string   `json:"gonoproxy"`
+	GOSUMDB          string   `json:"gosumdb"`
+	GONOSUMDB        string   `json:"gonosumdb"`
+	Env              []string `json:"env"`
+	MaxDirectFetches int      `json:"max_direct_fetches"`
+	VCSCacheDir      string   `json:"vcs_cache_dir,omitempty"`
+	TempDir          string   `json:"temp_dir"`
+	MaxRedirects     int      `json:"max_redirects"`
+	RedirectHosts    []string `json:"redirect_hosts"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// Config returns the effective configuration of the g. The Env of a
+// [GoFetcher] is reported as it is passed to the Go binary for direct
+// fetches, which excludes the variables that the [GoFetcher] handles by
+// itself (e.g., GOPROXY and GOSUMDB, which are reported separately). Only the
+// variables that affect fetching are reported (i.e., those prefixed with "GO"
+// and the proxy variables such as HTTPS_PROXY), as the rest of the process
+// environment is none of the proxy's business and may hold secrets.
+func (g *Goproxy) Config() ConfigSnapshot {
+	g.initOnce.Do(g.init)
+	cs := ConfigSnapshot{
+		Fetcher:                 fmt.Sprintf("%T", g.baseFetcher),
+		Cacher:                  "none",
+		MaxConcurrentFetches:    g.MaxConcurrentFetches,
+		ProxiedSumDBs:           make([]string, 0, len(g.ProxiedSumDBs)),
+		TempDir:                 g.TempDir,
+		MaxMemoryBufferSize:     g.contentBuffer().maxMemory,
+		PathPrefix:              g.pathPrefix,
+		AllowedPrefixes:         g.allowedPrefixes,
+		MutableCacheTTL:         g.MutableCacheTTL.String(),
+		MutableCacheSoftTTL:     g.MutableCacheSoftTTL.String(),
+		RevalidateMutableCaches: g.RevalidateMutableCaches,
+		ResolutionCacheTTL:      g.ResolutionCacheTTL.String(),
+		ServeWhileCaching:       g.ServeWhileCaching,
+		ValidateModFiles:        g.ValidateModFiles,
+		ValidateInfoFiles:       g.ValidateInfoFiles,
+		Metrics:                 g.metrics != nil,
+		Tracing:                 g.Tracer != nil,
+		AccessLog:               g.AccessLogWriter != nil,
+	}
+	if gf, ok := g.baseFetcher.(*GoFetcher); ok {
+		cs.GoFetcher = gf.config()
+	}
+	if g.Cacher != nil {
+		cs.Cacher = fmt.Sprintf("%T", g.Cacher)
+	}
+	if dc, ok := g.Cacher.(*DirCacher); ok {
+		cs.CacherDir = dc.Dir
+	}
+	if cs.TempDir == "" {
+		cs.TempDir = os.TempDir()
+	}
+	for _, sumdb := range g.ProxiedSumDBs {
+		cs.ProxiedSumDBs = append(cs.ProxiedSumDBs, redactURLs(sumdb))
+	}
+	return cs
+}
+
+// config returns the effective configuration of the gf.
+func (gf *GoFetcher) config() *GoFetcherConfig {
+	gf.initOnce.Do(gf.init)
+	c := &GoFetcherConfig{
+		GoBin:            gf.goBin,
+		GOPROXY:          redactURLs(gf.envGOPROXY),
+		GONOPROXY:        gf.envGONOPROXY,
+		GOSUMDB:          redactURLs(gf.envGOSUMDB),
+		GONOSUMDB:        gf.envGONOSUMDB,
+		Env:              make([]string, 0, len(gf.env)),
+		MaxDirectFetches: gf.MaxDirectFetches,
+		VCSCacheDir:      gf.vcsCacheDir,
+		TempDir:          gf.TempDir,
+		MaxRedirects:     gf.MaxRedirects,
+		RedirectHosts:    append([]string{}, gf.RedirectHosts...),
+	}
+	if c.TempDir == "" {
+		c.TempDir = os.TempDir()
+	}
+	if c.MaxRedirects == 0 {
+		c.MaxRedirects = 5
+	} else if c.MaxRedirects < 0 {
+		c.MaxRedirects = 0
+	}
+	for _, e := range gf.env {
+		if k, _, _ := strings.Cut(e, "="); isFetchEnvKey(k) {
+			c.Env = append(c.Env, redactEnv(e))
+		}
+	}
+	if gf.initErr != nil {
+		c.Error = gf.initErr.Error()
+	} else if gf.goBinErr != nil {
+		c.Error = gf.goBinErr.Error()
+	}
+	return c
+}
+
+// isFetchEnvKey reports whether the environment variable named by the key
+// affects the fetches of a [GoFetcher].
+func isFetchEnvKey(key string) bool {
+	switch strings.ToUpper(key) {
+	case "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY":
+		return true
+	}
+	return strings.HasPrefix(key, "GO")
+}
+
+// sensitiveEnvKeyParts is the parts of environment variable names that suggest
+// their values are secrets.
+var sensitiveEnvKeyParts = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "AUTH", "CREDENTIAL", "COOKIE", "SESSION"}
+
+// redactEnv redacts the value of the environment variable entry e (in the form
+// "key=value") if its key suggests a secret, or the URLs in the value
+// otherwise.
+func redactEnv(e string) string {
+	k, v, ok := strings.Cut(e, "=")
+	if !ok || v == "" {
+		return e
+	}
+	upperKey := strings.ToUpper(k)
+	for _, part := range sensitiveEnvKeyParts {
+		if strings.Contains(upperKey, part) {
+			return k + "=" + redacted
+		}
+	}
+	return k + "=" + redactURLs(v)
+}
+
+// redactURLs redacts the passwords of the URLs in the s, which may be a list
+// separated by commas, pipes, or spaces (e.g., GOPROXY and GOSUMDB).
+func redactURLs(s string) string {
+	var b strings.Builder
+	for s != "" {
+		i := strings.IndexAny(s, ",| ")
+		if i < 0 {
+			i = len(s)
+		}
+		b.WriteString(redactURL(s[:i]))
+		if i < len(s) {
+			b.WriteByte(s[i])
+			i++
+		}
+		s = s[i:]
+	}
+	return b.String()
+}
+
+// redactURL redacts the password of the rawURL, or its username if it has no
+// password (e.g., a token), if it is a URL with user information. Otherwise,
+// it returns the rawURL unchanged.
+func redactURL(rawURL string) string {
+	if !strings.Contains(rawURL, "@") {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	} else {
+		u.User = url.User(redacted)
+	}
+	return u.String()
+}
@@ -0,0 +1,141 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ErrorReason is a short machine-readable code for the class of failure of a
+// fetch request, which is reported in the "X-Goproxy-Error" header of the
+// response and in the error log if [Goproxy.DebugHeaders] is true.
+type ErrorReason string
+
+// The reasons for failures of fetch requests.
+const (
+	// ReasonNotFound is the reason for module files, versions, or modules
+	// that do not exist.
+	ReasonNotFound ErrorReason = "not_found"
+
+	// ReasonUpstreamTimeout is the reason for fetches that have not
+	// completed in time.
+	ReasonUpstreamTimeout ErrorReason = "upstream_timeout"
+
+	// ReasonBadUpstream is the reason for upstream failures other than
+	// timeouts (e.g., 5xx responses from an upstream GOPROXY).
+	ReasonBadUpstream ErrorReason = "bad_upstream"
+
+	// ReasonChecksumMismatch is the reason for fetched module files that do
+	// not match their checksums (e.g., as verified against a checksum
+	// database).
+	ReasonChecksumMismatch ErrorReason = "checksum_mismatch"
+
+	// ReasonAuthFailed is the reason for fetches rejected for lack of
+	// credentials (e.g., for private repositories accessed through VCS).
+	ReasonAuthFailed ErrorReason = "auth_failed"
+
+	// ReasonFetchInProgress is the reason for fetches that have been
+	// rejected because the same fetch is already in progress.
+	ReasonFetchInProgress ErrorReason = "fetch_in_progress"
+
+	// ReasonInternal is the reason for all other failures.
+	ReasonInternal ErrorReason = "internal"
+)
+
+// authFailureMessages are the lowercase substrings of the error messages of
+// the go command and VCS tools that indicate authentication failures.
+var authFailureMessages = []string{
+	"terminal prompts disabled",
+	"could not read username",
+	"could not read password",
+	"authentication failed",
+	"authentication required",
+	"permission denied (publickey)",
+	"401 unauthorized",
+}
+
+// ErrorReasonOf returns the [ErrorReason] of the err of a failed fetch. It
+// returns an empty string if the err is nil.
+//
+// Errors of the go command (e.g., those of [GoFetcher]) carry no types, so
+// they are classified by their messages, in the same way as they are
+// rendered into responses.
+func ErrorReasonOf(err error) ErrorReason {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	lowerMsg := strings.ToLower(msg)
+	switch {
+	case errors.Is(err, ErrZipHashMismatch),
+		errors.Is(err, ErrContentMismatch),
+		strings.Contains(lowerMsg, "checksum mismatch"),
+		strings.Contains(msg, "SECURITY ERROR"):
+		return ReasonChecksumMismatch
+	case containsAny(lowerMsg, authFailureMessages):
+		return ReasonAuthFailed
+	case errors.Is(err, errFetchInProgress):
+		return ReasonFetchInProgress
+	case isTimeoutError(err):
+		return ReasonUpstreamTimeout
+	case errors.Is(err, errBadUpstream):
+		return ReasonBadUpstream
+	case errors.Is(err, fs.ErrNotExist):
+		return ReasonNotFound
+	}
+	return ReasonInternal
+}
+
+// isTimeoutError reports whether the err is caused by a timeout.
+func isTimeoutError(err error) bool {
+	if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errFetchTimedOut)
+}
+
+// containsAny reports whether the s contains any of the substrs.
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorReasonHeader is the name of the header that reports the [ErrorReason]
+// of failed fetch responses.
+const errorReasonHeader = "X-Goproxy-Error"
+
+// debugHeadersKey is the context key for whether [Goproxy.DebugHeaders] is
+// true.
+type debugHeadersKey struct{}
+
+// setErrorReasonHeader sets the "X-Goproxy-Error" header of the rw to the
+// [ErrorReason] of the err if the context of the req says so (see
+// [Goproxy.DebugHeaders]).
+func setErrorReasonHeader(rw http.ResponseWriter, req *http.Request, err error) {
+	if debug, _ := req.Context().Value(debugHeadersKey{}).(bool); debug {
+		rw.Header().Set(errorReasonHeader, string(ErrorReasonOf(err)))
+	}
+}
+
+// logFetchErrorf is like [Goproxy.logErrorf] but for the err of a failed
+// fetch. It appends the [ErrorReason] of the err to the message if the
+// g.DebugHeaders is true.
+func (g *Goproxy) logFetchErrorf(err error, format string, v ...any) {
+	msg := "goproxy: " + fmt.Sprintf(format, v...)
+	if g.DebugHeaders {
+		msg += " (reason: " + string(ErrorReasonOf(err)) + ")"
+	}
+	if g.ErrorLogger != nil {
+		g.ErrorLogger.Output(2, msg)
+	} else {
+		log.Output(2, msg)
+	}
+}
@@ -0,0 +1,101 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorReasonOf(t *testing.T) {
+	for _, tt := range []struct {
+		n          int
+		err        error
+		wantReason ErrorReason
+	}{
+		{1, nil, ""},
+		{2, notExistErrorf("example.com@v1.0.0: unknown revision v1.0.0"), ReasonNotFound},
+		{3, context.DeadlineExceeded, ReasonUpstreamTimeout},
+		{4, notExistErrorf("%w: no response within 1m0s", errFetchTimedOut), ReasonUpstreamTimeout},
+		{5, upstreamNotExistError("not found: fetch timed out"), ReasonUpstreamTimeout},
+		{6, errBadUpstream, ReasonBadUpstream},
+		{7, upstreamNotExistError("not found: bad upstream"), ReasonBadUpstream},
+		{8, notExistErrorf("verifying example.com@v1.0.0: checksum mismatch"), ReasonChecksumMismatch},
+		{9, notExistErrorf("SECURITY ERROR\nThis download does NOT match the one reported by the checksum server."), ReasonChecksumMismatch},
+		{10, fmt.Errorf("example.com/@v/v1.0.0.zip: %w", ErrZipHashMismatch), ReasonChecksumMismatch},
+		{11, notExistErrorf("fatal: could not read Username for 'https://example.com': terminal prompts disabled"), ReasonAuthFailed},
+		{12, notExistErrorf("git@example.com: Permission denied (publickey)."), ReasonAuthFailed},
+		{13, notExistErrorf("reading https://example.com/@v/list: 401 Unauthorized"), ReasonAuthFailed},
+		{14, errFetchInProgress, ReasonFetchInProgress},
+		{15, errors.New("foobar"), ReasonInternal},
+	} {
+		if got, want := ErrorReasonOf(tt.err), tt.wantReason; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyErrorReasonHeader(t *testing.T) {
+	for _, tt := range []struct {
+		n              int
+		debugHeaders   bool
+		err            error
+		wantStatusCode int
+		wantReason     string
+		wantLog        string
+	}{
+		{1, true, notExistErrorf("unknown revision v1.0.0"), http.StatusNotFound, "not_found", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: unknown revision v1.0.0 (reason: not_found)\n"},
+		{2, true, context.DeadlineExceeded, http.StatusNotFound, "upstream_timeout", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: context deadline exceeded (reason: upstream_timeout)\n"},
+		{3, true, errBadUpstream, http.StatusNotFound, "bad_upstream", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: bad upstream (reason: bad_upstream)\n"},
+		{4, true, notExistErrorf("checksum mismatch"), http.StatusNotFound, "checksum_mismatch", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: checksum mismatch (reason: checksum_mismatch)\n"},
+		{5, true, notExistErrorf("terminal prompts disabled"), http.StatusNotFound, "auth_failed", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: terminal prompts disabled (reason: auth_failed)\n"},
+		{6, true, errFetchInProgress, http.StatusServiceUnavailable, "fetch_in_progress", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: fetch in progress (reason: fetch_in_progress)\n"},
+		{7, true, errors.New("foobar"), http.StatusInternalServerError, "internal", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: foobar (reason: internal)\n"},
+		{8, false, context.DeadlineExceeded, http.StatusNotFound, "", "goproxy: failed to download module version: example.com/@v/v1.0.0.info: context deadline exceeded\n"},
+	} {
+		var logBuf strings.Builder
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					return nil, nil, nil, tt.err
+				},
+			},
+			Cacher:       &DirCacher{Dir: t.TempDir()},
+			DebugHeaders: tt.debugHeaders,
+			TempDir:      t.TempDir(),
+			ErrorLogger:  log.New(&logBuf, "", 0),
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Header().Get("X-Goproxy-Error"), tt.wantReason; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := logBuf.String(), tt.wantLog; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+				return "", time.Time{}, notExistErrorf("terminal prompts disabled")
+			},
+		},
+		DebugHeaders: true,
+		ErrorLogger:  log.New(io.Discard, "", 0),
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@latest", nil))
+	if got, want := rec.Header().Get("X-Goproxy-Error"), "auth_failed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
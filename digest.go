@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// defaultHashName is the name of the hash function used when
+// [DirCacher.HashFunc] is nil.
+const defaultHashName = "sha256"
+
+// builtinHashFuncs are the hash functions that digests (see
+// [ManifestEntry.Digest] and [VerifyInfo.Digest]) can name without them being
+// configured as a [DirCacher.HashFunc], so that caches written with different
+// hash functions can still be read.
+var builtinHashFuncs = map[string]func() hash.Hash{
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// hashFunc returns the name and the hash function of the dc.HashFunc.
+func (dc *DirCacher) hashFunc() (string, func() hash.Hash, error) {
+	if dc.HashFunc == nil {
+		return defaultHashName, sha256.New, nil
+	}
+	if dc.HashName == "" || strings.Contains(dc.HashName, ":") {
+		return "", nil, fmt.Errorf("invalid hash name %q", dc.HashName)
+	}
+	return dc.HashName, dc.HashFunc, nil
+}
+
+// lookupHashFunc returns the hash function named by the name, which is the
+// dc.HashFunc if the name is the dc.HashName, or one of the builtinHashFuncs
+// otherwise. It returns nil if there is no such hash function.
+func (dc *DirCacher) lookupHashFunc(name string) func() hash.Hash {
+	if dc.HashFunc != nil && name == dc.HashName {
+		return dc.HashFunc
+	}
+	return builtinHashFuncs[name]
+}
+
+// formatDigest returns the digest of the sum computed by the hash function
+// named by the name, in the form "<name>:<hex-encoded sum>".
+func formatDigest(name string, sum []byte) string {
+	return name + ":" + hex.EncodeToString(sum)
+}
+
+// parseDigest parses the digest formatted by [formatDigest]. The lookup
+// returns the hash function named by a name, or nil if there is no such hash
+// function.
+func parseDigest(digest string, lookup func(name string) func() hash.Hash) (name string, newHash func() hash.Hash, sum []byte, err error) {
+	name, hexSum, ok := strings.Cut(digest, ":")
+	if !ok {
+		return "", nil, nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	if newHash = lookup(name); newHash == nil {
+		return "", nil, nil, fmt.Errorf("unsupported hash function %q", name)
+	}
+	sum, err = hex.DecodeString(hexSum)
+	if err != nil || len(sum) != newHash().Size() {
+		return "", nil, nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	return name, newHash, sum, nil
+}
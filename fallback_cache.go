@@ -0,0 +1,222 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fallbackCache tracks the caches that have been put to the
+// [Goproxy.FallbackCacher] and are still to be flushed to the
+// [Goproxy.Cacher].
+type fallbackCache struct {
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	pending  [][]string
+	flushing chan struct{}
+	closed   bool
+}
+
+// init initializes the fc to flush every interval, or every minute if the
+// interval is zero or negative.
+func (fc *fallbackCache) init(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	fc.interval = interval
+	fc.ctx, fc.cancel = context.WithCancel(context.Background())
+}
+
+// Close stops flushing the caches in the g.FallbackCacher to the g.Cacher in
+// the background (see [Goproxy.FallbackCacher]), and waits for the flush in
+// progress, if any, to stop. The caches that are still to be flushed are left
+// in the g.FallbackCacher, where they keep being served. Close always returns
+// nil.
+func (g *Goproxy) Close() error {
+	g.initOnce.Do(g.init)
+	fc := &g.fallbackCache
+	fc.mu.Lock()
+	fc.closed = true
+	flushing := fc.flushing
+	fc.mu.Unlock()
+	fc.cancel()
+	if flushing != nil {
+		<-flushing
+	}
+	return nil
+}
+
+// putFallbackCache puts caches for all the entries to the g.FallbackCacher
+// after putting them to the g.Cacher has failed with the putErr, and schedules
+// them to be flushed to the g.Cacher. It returns the putErr if there is no
+// g.FallbackCacher or putting to it also fails.
+func (g *Goproxy) putFallbackCache(ctx context.Context, entries []CacheEntry, putErr error) error {
+	if g.FallbackCacher == nil || errors.Is(putErr, context.Canceled) || errors.Is(putErr, context.DeadlineExceeded) {
+		return putErr
+	}
+	for _, entry := range entries {
+		if _, err := entry.Content.Seek(0, io.SeekStart); err != nil {
+			return putErr
+		}
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if err := PutAll(ctx, g.FallbackCacher, entries); err != nil {
+		g.logErrorf("failed to cache module files to fallback cacher: %s: %v", strings.Join(names, ","), err)
+		return putErr
+	}
+	g.logErrorf("failed to cache module files, cached to fallback cacher instead: %s: %v", strings.Join(names, ","), putErr)
+
+	fc := &g.fallbackCache
+	fc.mu.Lock()
+	fc.pending = append(fc.pending, names)
+	var flushing chan struct{}
+	if fc.flushing == nil && !fc.closed {
+		flushing = make(chan struct{})
+		fc.flushing = flushing
+	}
+	fc.mu.Unlock()
+	if flushing != nil {
+		go g.flushFallbackCache(flushing)
+	}
+	return nil
+}
+
+// forgetFallbackCache stops the caches for the names from being flushed from
+// the g.FallbackCacher, as they have just been put to the g.Cacher and must
+// not be overwritten by the staler content in the g.FallbackCacher.
+func (g *Goproxy) forgetFallbackCache(ctx context.Context, names ...string) {
+	if g.FallbackCacher == nil {
+		return
+	}
+	fc := &g.fallbackCache
+	fc.mu.Lock()
+	var forgotten []string
+	for i, group := range fc.pending {
+		kept := group[:0]
+		for _, name := range group {
+			if containsString(names, name) {
+				forgotten = append(forgotten, name)
+			} else {
+				kept = append(kept, name)
+			}
+		}
+		fc.pending[i] = kept
+	}
+	fc.mu.Unlock()
+	if deleter, ok := g.FallbackCacher.(Deleter); ok {
+		for _, name := range forgotten {
+			deleter.Delete(ctx, name)
+		}
+	}
+}
+
+// flushFallbackCache flushes the pending caches in the g.FallbackCacher to the
+// g.Cacher every g.FallbackFlushInterval until none is left or [Goproxy.Close]
+// is called, and then closes the flushing.
+func (g *Goproxy) flushFallbackCache(flushing chan struct{}) {
+	fc := &g.fallbackCache
+	defer close(flushing)
+	timer := time.NewTimer(fc.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-fc.ctx.Done():
+			fc.mu.Lock()
+			fc.flushing = nil
+			fc.mu.Unlock()
+			return
+		}
+
+		fc.mu.Lock()
+		pending := fc.pending
+		fc.pending = nil
+		fc.mu.Unlock()
+
+		var failed [][]string
+		for _, names := range pending {
+			if len(names) == 0 {
+				continue
+			}
+			if fc.ctx.Err() != nil {
+				failed = append(failed, names)
+				continue
+			}
+			if err := g.flushFallbackCacheGroup(fc.ctx, names); err != nil {
+				if fc.ctx.Err() == nil {
+					g.logErrorf("failed to flush module files from fallback cacher: %s: %v", strings.Join(names, ","), err)
+				}
+				failed = append(failed, names)
+			}
+		}
+
+		fc.mu.Lock()
+		fc.pending = append(failed, fc.pending...)
+		if len(fc.pending) == 0 {
+			fc.flushing = nil
+			fc.mu.Unlock()
+			return
+		}
+		fc.mu.Unlock()
+		timer.Reset(fc.interval)
+	}
+}
+
+// flushFallbackCacheGroup puts the caches for the names from the
+// g.FallbackCacher to the g.Cacher at once, and then deletes them from the
+// g.FallbackCacher if it implements [Deleter]. Caches that no longer exist in
+// the g.FallbackCacher are skipped.
+func (g *Goproxy) flushFallbackCacheGroup(ctx context.Context, names []string) error {
+	cb := g.contentBuffer()
+	entries := make([]CacheEntry, 0, len(names))
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	for _, name := range names {
+		rc, err := g.FallbackCacher.Get(ctx, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		rs, release, err := cb.buffer(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		releases = append(releases, release)
+		entries = append(entries, CacheEntry{Name: name, Content: rs})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := PutAll(ctx, g.Cacher, g.cacheKeyEntries(ctx, entries)); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		size, _ := ContentSize(entry.Content)
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "put", Name: entry.Name, Bytes: size})
+	}
+	if deleter, ok := g.FallbackCacher.(Deleter); ok {
+		for _, entry := range entries {
+			if err := deleter.Delete(ctx, entry.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				g.logErrorf("failed to delete module file from fallback cacher: %s: %v", entry.Name, err)
+			}
+		}
+	}
+	return nil
+}
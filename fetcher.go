@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,11 +15,14 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 	"golang.org/x/mod/sumdb"
@@ -70,6 +75,16 @@ type Fetcher interface {
 	Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error)
 }
 
+// ZipSizer is an optional interface that a [Fetcher] may implement to report
+// the size of a module zip file without downloading it (see
+// [Goproxy.Inspect]).
+type ZipSizer interface {
+	// ZipSize returns the size of the module zip file for the given module
+	// path and version. It returns -1 if the size cannot be determined
+	// without downloading the module zip file.
+	ZipSize(ctx context.Context, path, version string) (int64, error)
+}
+
 // GoFetcher implements [Fetcher] using the local Go binary.
 //
 // Make sure that the Go binary and the version control systems (such as Git)
@@ -91,17 +106,32 @@ type Fetcher interface {
 type GoFetcher struct {
 	// Env is the environment. Each entry is in the form "key=value".
 	//
-	// If Env is nil, [os.Environ] is used.
+	// Env is merged with [os.Environ], with Env taking precedence. That is,
+	// each key in Env overrides its value in [os.Environ], while all other
+	// keys in [os.Environ] (e.g., GOFLAGS and GONOSUMDB set on the host) are
+	// inherited rather than silently dropped. To clear an inherited key, set
+	// it to an empty value in Env.
 	//
 	// If Env contains duplicate environment keys, only the last value in
 	// the slice for each duplicate key is used.
 	//
 	// Make sure that all environment values are valid, particularly for
-	// GOPROXY and GOSUMDB, to prevent constant fetch failures.
+	// GOPROXY and GOSUMDB, to prevent constant fetch failures. Use
+	// [GoFetcher.Validate] to check them in advance.
 	Env []string
 
+	// SumDB is the checksum database used to verify fetched modules, in
+	// the same form as GOSUMDB: "off" to disable verification entirely, or
+	// "<name>[+<key>] [<url>]" to use a custom checksum database.
+	//
+	// If SumDB is empty, the GOSUMDB from Env is used.
+	SumDB string
+
 	// GoBin is the path to the Go binary that is used to execute direct
-	// fetches.
+	// fetches. Unless direct fetches are disabled (i.e., "direct" is not in
+	// GOPROXY and GONOPROXY is empty), it is looked up once, so that a missing
+	// Go binary is reported by [GoFetcher.Validate] and by each direct fetch
+	// with a clear error.
 	//
 	// If GoBin is empty, "go" is used.
 	GoBin string
@@ -111,33 +141,143 @@ type GoFetcher struct {
 	// If MaxDirectFetches is zero, there is no limit.
 	MaxDirectFetches int
 
+	// VCSCacheDir is the directory for keeping the version control
+	// repositories cloned by direct fetches, so that fetching another
+	// version of a module fetches only what is missing into the existing
+	// clone of its repository instead of cloning it again. If VCSCacheDir
+	// is not empty, it is used as the GOMODCACHE of the Go binary (with
+	// "-modcacherw" added to the GOFLAGS), which keeps a bare clone of each
+	// repository in its "cache/vcs" directory. The module files that direct
+	// downloads leave in it are removed once they are no longer needed, as
+	// they are meant to be cached elsewhere (e.g., by the Cacher of a
+	// [Goproxy]), so that only the clones are kept.
+	//
+	// If VCSCacheDir is empty, the GOMODCACHE from Env is used as it is.
+	VCSCacheDir string
+
+	// MaxVCSCacheSize is the maximum total size, in bytes, of the clones
+	// kept in the VCSCacheDir. After each direct download, the least
+	// recently used clones are removed in the background, once the direct
+	// fetches in progress complete, until the total size is within it.
+	//
+	// If MaxVCSCacheSize is zero, there is no limit.
+	MaxVCSCacheSize int64
+
+	// VCSCacheMaxAge is how long a clone is kept in the VCSCacheDir after it
+	// was last used by a direct download. Older clones are removed along
+	// with those beyond the MaxVCSCacheSize.
+	//
+	// If VCSCacheMaxAge is zero, clones are never removed for their age.
+	VCSCacheMaxAge time.Duration
+
 	// TempDir is the directory for storing temporary files.
 	//
 	// If TempDir is empty, [os.TempDir] is used.
 	TempDir string
 
+	// Latest controls how the "latest" version query is resolved. See
+	// [LatestOptions] for details.
+	//
+	// If Latest is the zero value, the query is passed through to the
+	// upstream (a proxy from GOPROXY or the local Go binary), which selects
+	// the version by itself.
+	Latest LatestOptions
+
 	// Transport is used to execute outgoing requests, excluding those
 	// initiated by direct fetches.
 	//
 	// If Transport is nil, [http.DefaultTransport] is used.
 	Transport http.RoundTripper
 
+	// MaxRedirects is the maximum number of redirects that each outgoing
+	// request (see Transport) follows. A request that would follow more
+	// redirects fails.
+	//
+	// If MaxRedirects is zero, 5 is used. If MaxRedirects is negative,
+	// redirects are never followed.
+	MaxRedirects int
+
+	// RedirectHosts is the list of hosts, in addition to the host of the
+	// original request, that redirects of outgoing requests may target
+	// (e.g., the CDN that an upstream proxy redirects module zip files
+	// to). Each entry is either a host name (e.g., "cdn.example.com") or a
+	// wildcard that matches all subdomains of a domain (e.g.,
+	// "*.example.com"), and is matched case-insensitively against the host
+	// name of the redirect target, regardless of its port. Redirects to any
+	// other hosts are rejected, so that upstreams cannot make the gf send
+	// requests to unexpected hosts (e.g., those on internal networks).
+	//
+	// If RedirectHosts is empty, redirects may only target the host of the
+	// original request.
+	RedirectHosts []string
+
+	// InsecureUpstreams is the list of glob patterns (in the syntax of
+	// [path.Match]) of hosts and module path prefixes that may be fetched
+	// insecurely, in addition to those in GOINSECURE (see Env). Direct
+	// fetches of matching modules may use insecure schemes (e.g., plain
+	// HTTP) and skip certificate verification, and outgoing requests (see
+	// Transport) to matching hosts skip certificate verification.
+	//
+	// Fetching insecurely exposes the gf to man-in-the-middle attacks, so
+	// only upstreams on trusted networks should be listed, and checksum
+	// verification (see SumDB) should be kept enabled for their modules
+	// whenever possible. Outgoing requests skip certificate verification
+	// only if the Transport is nil or an [*http.Transport]. Unlike the
+	// InsecureUpstreams, the GOINSECURE only applies to direct fetches.
+	//
+	// If InsecureUpstreams is empty, only the GOINSECURE is used, and
+	// outgoing requests always verify certificates.
+	InsecureUpstreams []string
+
+	// Backoff is the strategy for the delays between the attempts of the
+	// outgoing requests (see Transport) that are retried after failing
+	// with temporary errors (e.g., status 429, 502, or 503), including
+	// those to checksum databases.
+	//
+	// If Backoff is nil, the zero [ExponentialBackoff] is used.
+	Backoff Backoff
+
+	// OnUpstreamMismatch enables the verification of downloads against the
+	// proxies in GOPROXY (see Env) after the one that served them. Each
+	// module version is always served by the first proxy that succeeds,
+	// but with the verification enabled, it is then also downloaded from
+	// each of the later proxies before "direct" or "off", and
+	// OnUpstreamMismatch is called for each of them that would have served
+	// a different .mod or .zip file, so that a misconfigured or poisoned
+	// upstream is noticed rather than quietly trusted once the earlier
+	// ones fail. Later proxies that fail are ignored, as they would not
+	// have served anything.
+	//
+	// The verification runs before [GoFetcher.Download] returns, which
+	// therefore takes as long as the slowest of the proxies.
+	//
+	// If OnUpstreamMismatch is nil, no later proxies are consulted.
+	OnUpstreamMismatch func(mismatch UpstreamMismatch)
+
 	initOnce              sync.Once
 	initErr               error
 	env                   []string
 	envGOPROXY            string
 	envGONOPROXY          string
+	envGOSUMDB            string
+	envGONOSUMDB          string
+	envGOINSECURE         string
+	insecureUpstreams     string
+	goBin                 string
+	goBinErr              error
 	directFetchWorkerPool chan struct{}
+	vcsCacheDir           string
+	vcsCacheMutex         sync.RWMutex
+	vcsCacheRefsMutex     sync.Mutex
+	vcsCacheRefs          map[string]int
+	vcsCachePruneQueued   bool
 	httpClient            *http.Client
 	sumdbClient           *sumdb.Client
 }
 
 // init initializes the f.
 func (gf *GoFetcher) init() {
-	env := gf.Env
-	if env == nil {
-		env = os.Environ()
-	}
+	env := mergeEnv(os.Environ(), gf.Env)
 	var envGOSUMDB, envGONOSUMDB, envGOPRIVATE string
 	for _, e := range env {
 		if k, v, ok := strings.Cut(e, "="); ok {
@@ -153,11 +293,16 @@ func (gf *GoFetcher) init() {
 				envGONOSUMDB = v
 			case "GOPRIVATE":
 				envGOPRIVATE = v
+			case "GOINSECURE":
+				gf.envGOINSECURE = v
 			default:
 				gf.env = append(gf.env, e)
 			}
 		}
 	}
+	if gf.SumDB != "" {
+		envGOSUMDB = gf.SumDB
+	}
 	gf.envGOPROXY, gf.initErr = cleanEnvGOPROXY(gf.envGOPROXY)
 	if gf.initErr != nil {
 		return
@@ -166,11 +311,23 @@ func (gf *GoFetcher) init() {
 		gf.envGONOPROXY = envGOPRIVATE
 	}
 	gf.envGONOPROXY = cleanCommaSeparatedList(gf.envGONOPROXY)
+	gf.goBin = gf.GoBin
+	if gf.goBin == "" {
+		gf.goBin = "go"
+	}
+	if gf.envGONOPROXY != "" || envGOPROXYHasDirect(gf.envGOPROXY) {
+		if _, err := exec.LookPath(gf.goBin); err != nil {
+			gf.goBinErr = fmt.Errorf("go binary required for direct fetches is unavailable (install Go, set GoBin, or disable direct fetches): %w", err)
+		}
+	}
 	envGOSUMDB = cleanEnvGOSUMDB(envGOSUMDB)
 	if envGONOSUMDB == "" {
 		envGONOSUMDB = envGOPRIVATE
 	}
 	envGONOSUMDB = cleanCommaSeparatedList(envGONOSUMDB)
+	gf.envGOSUMDB, gf.envGONOSUMDB = envGOSUMDB, envGONOSUMDB
+	gf.insecureUpstreams = cleanCommaSeparatedList(strings.Join(gf.InsecureUpstreams, ","))
+	gf.envGOINSECURE = cleanCommaSeparatedList(gf.envGOINSECURE + "," + gf.insecureUpstreams)
 	gf.env = append(
 		gf.env,
 		"GO111MODULE=on",
@@ -179,24 +336,148 @@ func (gf *GoFetcher) init() {
 		"GOSUMDB=off",
 		"GONOSUMDB=",
 		"GOPRIVATE=",
+		"GOINSECURE="+gf.envGOINSECURE,
 	)
 
 	if gf.MaxDirectFetches > 0 {
 		gf.directFetchWorkerPool = make(chan struct{}, gf.MaxDirectFetches)
 	}
+	if gf.VCSCacheDir != "" {
+		gf.vcsCacheDir, gf.initErr = filepath.Abs(gf.VCSCacheDir)
+		if gf.initErr != nil {
+			return
+		}
+		gf.env = vcsCacheEnv(gf.env, gf.vcsCacheDir)
+	}
 
-	gf.httpClient = &http.Client{Transport: gf.Transport}
+	gf.httpClient = &http.Client{Transport: gf.transport(), CheckRedirect: gf.checkRedirect}
 	if envGOSUMDB != "off" {
 		sco, err := newSumdbClientOps(gf.envGOPROXY, envGOSUMDB, gf.httpClient)
 		if err != nil {
 			gf.initErr = err
 			return
 		}
+		sco.backoff = gf.Backoff
 		gf.sumdbClient = sumdb.NewClient(sco)
 		gf.sumdbClient.SetGONOSUMDB(envGONOSUMDB)
 	}
 }
 
+// mergeEnv returns the environment entries of the base overridden by the ones
+// of the overrides, in the order of their first appearances. Only the last
+// value of each key is kept. Keys are case-insensitive on Windows.
+func mergeEnv(base, overrides []string) []string {
+	merged := make([]string, 0, len(base)+len(overrides))
+	indexes := map[string]int{}
+	for _, e := range append(append([]string{}, base...), overrides...) {
+		k, _, ok := strings.Cut(e, "=")
+		if !ok {
+			continue
+		}
+		if runtime.GOOS == "windows" {
+			k = strings.ToUpper(k)
+		}
+		if i, ok := indexes[k]; ok {
+			merged[i] = e
+			continue
+		}
+		indexes[k] = len(merged)
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// errRedirectRejected indicates that a redirect of an outgoing request of
+// [GoFetcher] has been rejected (see [GoFetcher.MaxRedirects] and
+// [GoFetcher.RedirectHosts]).
+var errRedirectRejected = errors.New("redirect rejected")
+
+// checkRedirect implements [http.Client.CheckRedirect] for the outgoing
+// requests of the gf.
+func (gf *GoFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := gf.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 5
+	} else if maxRedirects < 0 {
+		maxRedirects = 0
+	}
+	if len(via) > maxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", errRedirectRejected, maxRedirects)
+	}
+	if host := req.URL.Hostname(); !strings.EqualFold(host, via[0].URL.Hostname()) && !gf.allowsRedirectHost(host) {
+		return fmt.Errorf("%w: host %q not allowed", errRedirectRejected, host)
+	}
+	return nil
+}
+
+// transport returns the [http.RoundTripper] for the outgoing requests of the
+// gf, which skips certificate verification for the hosts matched by the
+// gf.insecureUpstreams. The GOINSECURE is left to the go command for direct
+// fetches, as it does not apply to proxies.
+func (gf *GoFetcher) transport() http.RoundTripper {
+	if gf.insecureUpstreams == "" {
+		return gf.Transport
+	}
+	secure := gf.Transport
+	if secure == nil {
+		secure = http.DefaultTransport
+	}
+	t, ok := secure.(*http.Transport)
+	if !ok {
+		return gf.Transport
+	}
+	insecure := t.Clone()
+	if insecure.TLSClientConfig == nil {
+		insecure.TLSClientConfig = &tls.Config{}
+	}
+	insecure.TLSClientConfig.InsecureSkipVerify = true
+	return &insecureUpstreamTransport{secure: secure, insecure: insecure, patterns: gf.insecureUpstreams}
+}
+
+// insecureUpstreamTransport is the [http.RoundTripper] that sends requests to
+// the hosts matched by the patterns through the insecure, and all others
+// through the secure.
+type insecureUpstreamTransport struct {
+	secure   http.RoundTripper
+	insecure http.RoundTripper
+	patterns string
+}
+
+// RoundTrip implements [http.RoundTripper].
+func (iut *insecureUpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if module.MatchPrefixPatterns(iut.patterns, req.URL.Hostname()) {
+		return iut.insecure.RoundTrip(req)
+	}
+	return iut.secure.RoundTrip(req)
+}
+
+// allowsRedirectHost reports whether the host is in the gf.RedirectHosts.
+func (gf *GoFetcher) allowsRedirectHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range gf.RedirectHosts {
+		h = strings.ToLower(h)
+		if suffix := strings.TrimPrefix(h, "*"); suffix != h {
+			if strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports the error, if any, in the configuration of the gf, such as
+// an invalid GOPROXY, an invalid checksum database key, or a missing Go binary
+// when direct fetches are enabled. Calling Validate at startup surfaces
+// misconfigurations that would otherwise cause every fetch to fail.
+func (gf *GoFetcher) Validate() error {
+	if gf.initOnce.Do(gf.init); gf.initErr != nil {
+		return gf.initErr
+	}
+	return gf.goBinErr
+}
+
 // skipProxy reports whether the module path should be fetched directly rather
 // than using a proxy.
 func (gf *GoFetcher) skipProxy(path string) bool {
@@ -209,20 +490,66 @@ func (gf *GoFetcher) Query(ctx context.Context, path, query string) (version str
 		err = gf.initErr
 		return
 	}
+	if query == "latest" && gf.Latest != (LatestOptions{}) {
+		return gf.queryLatest(ctx, path)
+	}
+	return gf.query(ctx, path, query)
+}
+
+// query performs the version query for the given module path using the
+// upstream.
+func (gf *GoFetcher) query(ctx context.Context, path, query string) (version string, time time.Time, err error) {
+	upstream := "direct"
 	if gf.skipProxy(path) {
 		version, time, err = gf.directQuery(ctx, path, query)
 	} else {
 		err = walkEnvGOPROXY(gf.envGOPROXY, func(proxy *url.URL) error {
+			upstream = proxy.Redacted()
+			end := startUpstreamTraceStep(ctx, upstream)
 			version, time, err = gf.proxyQuery(ctx, path, query, proxy)
+			end(err)
 			return err
 		}, func() error {
+			upstream = "direct"
+			end := startUpstreamTraceStep(ctx, upstream)
 			version, time, err = gf.directQuery(ctx, path, query)
+			end(err)
 			return err
 		})
 	}
+	if err == nil {
+		setRequestUpstream(ctx, upstream)
+	}
 	return
 }
 
+// queryLatest performs the "latest" version query for the given module path
+// by selecting the version locally as described in [LatestOptions].
+func (gf *GoFetcher) queryLatest(ctx context.Context, path string) (version string, time time.Time, err error) {
+	versions, err := gf.List(ctx, path)
+	if err != nil {
+		return
+	}
+	version, err = selectLatestVersion(versions, gf.Latest, func(version string) (bool, error) {
+		return gf.hasGoMod(ctx, path, version)
+	})
+	if err != nil {
+		return
+	}
+	if version != "" {
+		return gf.query(ctx, path, version)
+	}
+	upstreamVersion, upstreamTime, err := gf.query(ctx, path, "latest")
+	if err != nil {
+		return
+	}
+	if !gf.Latest.allows(upstreamVersion) {
+		err = notExistErrorf("no matching versions for query %q", "latest")
+		return
+	}
+	return upstreamVersion, upstreamTime, nil
+}
+
 // proxyQuery performs the version query for the given module path using the
 // given proxy.
 func (gf *GoFetcher) proxyQuery(ctx context.Context, path, query string, proxy *url.URL) (version string, time time.Time, err error) {
@@ -241,7 +568,13 @@ func (gf *GoFetcher) proxyQuery(ctx context.Context, path, query string, proxy *
 		u = appendURL(proxy, escapedPath+"/@v/"+escapedQuery+".info")
 	}
 	var info bytes.Buffer
-	err = httpGet(ctx, gf.httpClient, u.String(), &info)
+	if checkCanonicalVersion(path, query) == nil {
+		// The .info file of a canonical version never changes, so it
+		// cannot revalidate a cached result of another version.
+		err = httpGet(ctx, gf.httpClient, gf.Backoff, u.String(), &info)
+	} else {
+		err = httpGetIfModifiedSince(ctx, gf.httpClient, gf.Backoff, u.String(), requestIfModifiedSince(ctx), &info)
+	}
 	if err != nil {
 		return
 	}
@@ -267,31 +600,42 @@ func (gf *GoFetcher) directQuery(ctx context.Context, path, query string) (versi
 	return info.Version, info.Time, json.Unmarshal(output, &info)
 }
 
-// List implements [Fetcher].
+// List implements [Fetcher]. Like the go command, it drops pseudo-versions,
+// non-canonical versions, and versions that do not match the major version
+// suffix of the path (e.g., "v1.0.0" for "example.com/foo/v2", or "v2.0.0"
+// without "+incompatible" for "example.com/foo").
 func (gf *GoFetcher) List(ctx context.Context, path string) (versions []string, err error) {
 	if gf.initOnce.Do(gf.init); gf.initErr != nil {
 		err = gf.initErr
 		return
 	}
 
+	upstream := "direct"
 	if gf.skipProxy(path) {
 		versions, err = gf.directList(ctx, path)
 	} else {
 		err = walkEnvGOPROXY(gf.envGOPROXY, func(proxy *url.URL) error {
+			upstream = proxy.Redacted()
+			end := startUpstreamTraceStep(ctx, upstream)
 			versions, err = gf.proxyList(ctx, path, proxy)
+			end(err)
 			return err
 		}, func() error {
+			upstream = "direct"
+			end := startUpstreamTraceStep(ctx, upstream)
 			versions, err = gf.directList(ctx, path)
+			end(err)
 			return err
 		})
 	}
 	if err != nil {
 		return
 	}
+	setRequestUpstream(ctx, upstream)
 
 	for i := range versions {
 		parts := strings.Fields(versions[i])
-		if len(parts) > 0 && semver.IsValid(parts[0]) && !module.IsPseudoVersion(parts[0]) {
+		if len(parts) > 0 && checkCanonicalVersion(path, parts[0]) == nil && !module.IsPseudoVersion(parts[0]) {
 			versions[i] = parts[0]
 		} else {
 			versions[i] = ""
@@ -313,7 +657,7 @@ func (gf *GoFetcher) proxyList(ctx context.Context, path string, proxy *url.URL)
 		return
 	}
 	var list bytes.Buffer
-	err = httpGet(ctx, gf.httpClient, appendURL(proxy, escapedPath+"/@v/list").String(), &list)
+	err = httpGetIfModifiedSince(ctx, gf.httpClient, gf.Backoff, appendURL(proxy, escapedPath+"/@v/list").String(), requestIfModifiedSince(ctx), &list)
 	if err != nil {
 		return
 	}
@@ -351,18 +695,35 @@ func (gf *GoFetcher) Download(ctx context.Context, path, version string) (info,
 		// an error occurs.
 		cleanup func()
 	)
+	upstream := "direct"
+	var upstreamProxy *url.URL
 	if gf.skipProxy(path) {
+		cleanup = gf.vcsCacheCleanup(path, version)
 		infoFile, modFile, zipFile, err = gf.directDownload(ctx, path, version)
 	} else {
 		err = walkEnvGOPROXY(gf.envGOPROXY, func(proxy *url.URL) error {
+			upstream, upstreamProxy = proxy.Redacted(), proxy
+			end := startUpstreamTraceStep(ctx, upstream)
 			infoFile, modFile, zipFile, cleanup, err = gf.proxyDownload(ctx, path, version, proxy)
+			end(err)
 			return err
 		}, func() error {
+			upstream, upstreamProxy = "direct", nil
+			end := startUpstreamTraceStep(ctx, upstream)
+			cleanup = gf.vcsCacheCleanup(path, version)
 			infoFile, modFile, zipFile, err = gf.directDownload(ctx, path, version)
+			if err != nil && cleanup != nil {
+				cleanup()
+				cleanup = nil
+			}
+			end(err)
 			return err
 		})
 	}
 	if err != nil {
+		if cleanup != nil {
+			cleanup()
+		}
 		return
 	}
 	if cleanup != nil {
@@ -397,6 +758,9 @@ func (gf *GoFetcher) Download(ctx context.Context, path, version string) (info,
 			return
 		}
 	}
+	if gf.OnUpstreamMismatch != nil && upstreamProxy != nil {
+		gf.verifyUpstreams(ctx, path, version, upstreamProxy, modFile, zipFile)
+	}
 
 	infoContent := strings.NewReader(marshalInfo(infoVersion, infoTime))
 	modContent, err := os.Open(modFile)
@@ -441,9 +805,51 @@ func (gf *GoFetcher) Download(ctx context.Context, path, version string) (info,
 		defer zipClosedOnce.Do(closed)
 		return zipContent.Close()
 	})}
+	setRequestUpstream(ctx, upstream)
+	return
+}
+
+// ZipSize implements [ZipSizer]. The size is reported by the first proxy in
+// GOPROXY that has the module zip file, without downloading it. Since direct
+// fetches always download the module zip file, -1 is returned for modules
+// that would be fetched directly.
+func (gf *GoFetcher) ZipSize(ctx context.Context, path, version string) (size int64, err error) {
+	if gf.initOnce.Do(gf.init); gf.initErr != nil {
+		err = gf.initErr
+		return
+	}
+
+	if err = checkCanonicalVersion(path, version); err != nil {
+		return
+	}
+
+	if gf.skipProxy(path) {
+		return -1, nil
+	}
+	err = walkEnvGOPROXY(gf.envGOPROXY, func(proxy *url.URL) error {
+		size, err = gf.proxyZipSize(ctx, path, version, proxy)
+		return err
+	}, func() error {
+		size = -1
+		return nil
+	})
 	return
 }
 
+// proxyZipSize returns the size of the module zip file for the given module
+// path and version using the given proxy.
+func (gf *GoFetcher) proxyZipSize(ctx context.Context, path, version string, proxy *url.URL) (int64, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return 0, err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return 0, err
+	}
+	return httpContentSize(ctx, gf.httpClient, appendURL(proxy, escapedPath+"/@v/"+escapedVersion+".zip").String())
+}
+
 // proxyDownload downloads the module files for the given module path and
 // version using the given proxy.
 func (gf *GoFetcher) proxyDownload(ctx context.Context, path, version string, proxy *url.URL) (infoFile, modFile, zipFile string, cleanup func(), err error) {
@@ -467,15 +873,15 @@ func (gf *GoFetcher) proxyDownload(ctx context.Context, path, version string, pr
 		}
 	}()
 
-	infoFile, err = httpGetTemp(ctx, gf.httpClient, urlWithoutExt+".info", tempDir)
+	infoFile, err = httpGetTemp(ctx, gf.httpClient, gf.Backoff, urlWithoutExt+".info", tempDir)
 	if err != nil {
 		return
 	}
-	modFile, err = httpGetTemp(ctx, gf.httpClient, urlWithoutExt+".mod", tempDir)
+	modFile, err = httpGetTemp(ctx, gf.httpClient, gf.Backoff, urlWithoutExt+".mod", tempDir)
 	if err != nil {
 		return
 	}
-	zipFile, err = httpGetTemp(ctx, gf.httpClient, urlWithoutExt+".zip", tempDir)
+	zipFile, err = httpGetTemp(ctx, gf.httpClient, gf.Backoff, urlWithoutExt+".zip", tempDir)
 	if err != nil {
 		return
 	}
@@ -483,6 +889,81 @@ func (gf *GoFetcher) proxyDownload(ctx context.Context, path, version string, pr
 	return
 }
 
+// UpstreamMismatch is a module version that two upstreams would serve with
+// different content (see [GoFetcher.OnUpstreamMismatch]).
+type UpstreamMismatch struct {
+	// Path is the module path.
+	Path string
+
+	// Version is the module version.
+	Version string
+
+	// Upstream is the redacted URL of the proxy that served the module
+	// version.
+	Upstream string
+
+	// OtherUpstream is the redacted URL of the later proxy that would have
+	// served it with different content.
+	OtherUpstream string
+
+	// Files is the extensions of the module files that differ, which are
+	// ".mod", ".zip", or both.
+	Files []string
+}
+
+// verifyUpstreams downloads the module files for the given module path and
+// version from each proxy after the upstream in the gf.envGOPROXY, calling
+// the gf.OnUpstreamMismatch for each whose .mod or .zip file differs from the
+// modFile or zipFile served by the upstream.
+func (gf *GoFetcher) verifyUpstreams(ctx context.Context, path, version string, upstream *url.URL, modFile, zipFile string) {
+	found := false
+	walkEnvGOPROXY(gf.envGOPROXY, func(proxy *url.URL) error {
+		if !found {
+			found = proxy.String() == upstream.String()
+			return fs.ErrNotExist // Move on to the next proxy.
+		}
+		_, otherModFile, otherZipFile, cleanup, err := gf.proxyDownload(ctx, path, version, proxy)
+		if err != nil {
+			return fs.ErrNotExist
+		}
+		defer cleanup()
+		var files []string
+		if same, err := sameFileContent(modFile, otherModFile); err != nil {
+			return fs.ErrNotExist
+		} else if !same {
+			files = append(files, ".mod")
+		}
+		if same, err := sameFileContent(zipFile, otherZipFile); err != nil {
+			return fs.ErrNotExist
+		} else if !same {
+			files = append(files, ".zip")
+		}
+		if len(files) > 0 {
+			gf.OnUpstreamMismatch(UpstreamMismatch{
+				Path:          path,
+				Version:       version,
+				Upstream:      upstream.Redacted(),
+				OtherUpstream: proxy.Redacted(),
+				Files:         files,
+			})
+		}
+		return fs.ErrNotExist
+	}, func() error { return nil })
+}
+
+// sameFileContent reports whether the files named a and b have the same
+// content, without reading them into memory entirely.
+func sameFileContent(a, b string) (bool, error) {
+	hashA, hashB := sha256.New(), sha256.New()
+	if err := hashFile(a, hashA); err != nil {
+		return false, err
+	}
+	if err := hashFile(b, hashB); err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashA.Sum(nil), hashB.Sum(nil)), nil
+}
+
 // directDownload downloads the module files for the given module path and
 // version using the local Go binary.
 func (gf *GoFetcher) directDownload(ctx context.Context, path, version string) (infoFile, modFile, zipFile string, err error) {
@@ -490,16 +971,76 @@ func (gf *GoFetcher) directDownload(ctx context.Context, path, version string) (
 	if err != nil {
 		return
 	}
-	var download struct{ Info, GoMod, Zip string }
-	return download.Info, download.GoMod, download.Zip, json.Unmarshal(output, &download)
+	var download struct {
+		Info, GoMod, Zip string
+		Origin           struct{ URL string }
+	}
+	if err = json.Unmarshal(output, &download); err != nil {
+		return
+	}
+	if gf.vcsCacheDir != "" {
+		gf.touchVCSClone(download.Origin.URL)
+		gf.queuePruneVCSCache()
+	}
+	return download.Info, download.GoMod, download.Zip, nil
+}
+
+// hasGoMod reports whether the module version for the given module path has
+// its own go.mod file, rather than the one synthesized for modules without
+// go.mod files, in the same way as the go command.
+func (gf *GoFetcher) hasGoMod(ctx context.Context, path, version string) (bool, error) {
+	var mod []byte
+	fetchDirect := func() error {
+		if cleanup := gf.vcsCacheCleanup(path, version); cleanup != nil {
+			defer cleanup()
+		}
+		_, modFile, _, err := gf.directDownload(ctx, path, version)
+		if err != nil {
+			return err
+		}
+		mod, err = os.ReadFile(modFile)
+		return err
+	}
+	var err error
+	if gf.skipProxy(path) {
+		err = fetchDirect()
+	} else {
+		err = walkEnvGOPROXY(gf.envGOPROXY, func(proxy *url.URL) error {
+			escapedPath, err := module.EscapePath(path)
+			if err != nil {
+				return err
+			}
+			escapedVersion, err := module.EscapeVersion(version)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := httpGet(ctx, gf.httpClient, gf.Backoff, appendURL(proxy, escapedPath+"/@v/"+escapedVersion+".mod").String(), &buf); err != nil {
+				return err
+			}
+			mod = buf.Bytes()
+			return nil
+		}, fetchDirect)
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(mod) != "module "+modfile.AutoQuote(path)+"\n", nil
 }
 
 // execGo executes the local Go binary with the given args and returns the output.
 func (gf *GoFetcher) execGo(ctx context.Context, args ...string) ([]byte, error) {
+	if gf.goBinErr != nil {
+		return nil, gf.goBinErr
+	}
 	if gf.directFetchWorkerPool != nil {
 		gf.directFetchWorkerPool <- struct{}{}
 		defer func() { <-gf.directFetchWorkerPool }()
 	}
+	if gf.vcsCacheDir != "" {
+		gf.vcsCacheMutex.RLock()
+		defer gf.vcsCacheMutex.RUnlock()
+	}
 
 	tempDir, err := os.MkdirTemp(gf.TempDir, tempDirPattern)
 	if err != nil {
@@ -507,11 +1048,7 @@ func (gf *GoFetcher) execGo(ctx context.Context, args ...string) ([]byte, error)
 	}
 	defer os.RemoveAll(tempDir)
 
-	goBin := gf.GoBin
-	if goBin == "" {
-		goBin = "go"
-	}
-	cmd := exec.CommandContext(ctx, goBin, args...)
+	cmd := exec.CommandContext(ctx, gf.goBin, args...)
 	cmd.Env = gf.env
 	cmd.Dir = tempDir
 	output, err := cmd.Output()
@@ -539,13 +1076,108 @@ func (gf *GoFetcher) execGo(ctx context.Context, args ...string) ([]byte, error)
 		msg = strings.TrimPrefix(msg, "go: ")
 		msg = strings.TrimPrefix(msg, "go list -m: ")
 		msg = strings.TrimRight(msg, "\n")
-		return nil, notExistErrorf(msg)
+		return nil, upstreamNotExistError(msg)
 	}
 	return output, nil
 }
 
 const defaultEnvGOPROXY = "https://proxy.golang.org,direct"
 
+// LatestOptions are the options for resolving the "latest" version query in
+// [GoFetcher]. Unless it is the zero value, the version is selected locally
+// from the tagged versions returned by [GoFetcher.List], with the following
+// precedence:
+//  1. Versions excluded by the options are dropped. In addition, unless
+//     ExcludeIncompatible is set, "+incompatible" versions are dropped if the
+//     highest remaining compatible version has its own go.mod file, as the go
+//     command does.
+//  2. The highest remaining release version is selected.
+//  3. Otherwise, the highest remaining pre-release version is selected.
+//  4. Otherwise, the query is passed through to the upstream, which usually
+//     selects a pseudo-version for the commit at the tip of the repository's
+//     default branch. Its result is used only if it is not excluded by the
+//     options.
+//
+// So release tags are always preferred over pseudo-versions, even if the
+// upstream would select a pseudo-version. If no version is selected, the
+// query fails with an error that matches [fs.ErrNotExist].
+type LatestOptions struct {
+	// ExcludePrereleases excludes pre-release versions (e.g.,
+	// "v1.1.0-rc.1"), even if there are no release versions. It does not
+	// exclude pseudo-versions.
+	ExcludePrereleases bool
+
+	// ExcludePseudoVersions excludes pseudo-versions, so the query fails
+	// instead of falling back to one when there are no tagged versions.
+	ExcludePseudoVersions bool
+
+	// ExcludeIncompatible excludes "+incompatible" versions (e.g.,
+	// "v2.0.0+incompatible"), even if the highest compatible version has no
+	// go.mod file or there are no compatible versions.
+	ExcludeIncompatible bool
+}
+
+// allows reports whether the version is not excluded by the lo.
+func (lo LatestOptions) allows(version string) bool {
+	switch {
+	case module.IsPseudoVersion(version):
+		return !lo.ExcludePseudoVersions
+	case lo.ExcludePrereleases && semver.Prerelease(version) != "":
+		return false
+	case lo.ExcludeIncompatible && strings.HasSuffix(version, "+incompatible"):
+		return false
+	}
+	return true
+}
+
+// selectLatestVersion selects the "latest" version from the tagged versions
+// as described in [LatestOptions]. It reports whether a version has its own
+// go.mod file using the hasGoMod. It returns an empty string if no version is
+// selected.
+func selectLatestVersion(versions []string, opts LatestOptions, hasGoMod func(version string) (bool, error)) (string, error) {
+	var candidates []string
+	for _, version := range versions {
+		if semver.IsValid(version) && opts.allows(version) {
+			candidates = append(candidates, version)
+		}
+	}
+	semver.Sort(candidates)
+	var lastCompatible string
+	hasIncompatible := false
+	for _, version := range candidates {
+		if strings.HasSuffix(version, "+incompatible") {
+			hasIncompatible = true
+		} else {
+			lastCompatible = version
+		}
+	}
+	if hasIncompatible && lastCompatible != "" {
+		ok, err := hasGoMod(lastCompatible)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			compatibleCandidates := candidates[:0]
+			for _, version := range candidates {
+				if !strings.HasSuffix(version, "+incompatible") {
+					compatibleCandidates = append(compatibleCandidates, version)
+				}
+			}
+			candidates = compatibleCandidates
+		}
+	}
+	var latestPrerelease string
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if semver.Prerelease(candidates[i]) == "" {
+			return candidates[i], nil
+		}
+		if latestPrerelease == "" {
+			latestPrerelease = candidates[i]
+		}
+	}
+	return latestPrerelease, nil
+}
+
 // cleanEnvGOPROXY returns the cleaned envGOPROXY.
 func cleanEnvGOPROXY(envGOPROXY string) (string, error) {
 	if envGOPROXY == "" || envGOPROXY == defaultEnvGOPROXY {
@@ -585,6 +1217,17 @@ func cleanEnvGOPROXY(envGOPROXY string) (string, error) {
 	return cleaned, nil
 }
 
+// envGOPROXYHasDirect reports whether the cleaned envGOPROXY contains
+// "direct".
+func envGOPROXYHasDirect(envGOPROXY string) bool {
+	for _, proxy := range strings.FieldsFunc(envGOPROXY, func(r rune) bool { return r == ',' || r == '|' }) {
+		if proxy == "direct" {
+			return true
+		}
+	}
+	return false
+}
+
 // walkEnvGOPROXY walks through the proxy list parsed from the envGOPROXY.
 func walkEnvGOPROXY(envGOPROXY string, onProxy func(proxy *url.URL) error, onDirect func() error) error {
 	if envGOPROXY == "" {
@@ -626,6 +1269,31 @@ func walkEnvGOPROXY(envGOPROXY string, onProxy func(proxy *url.URL) error, onDir
 	return lastErr
 }
 
+// requestIfModifiedSince returns the [RequestInfo.IfModifiedSince] of the
+// request being served, if any.
+func requestIfModifiedSince(ctx context.Context) time.Time {
+	if ri := RequestInfoFromContext(ctx); ri != nil {
+		return ri.IfModifiedSince
+	}
+	return time.Time{}
+}
+
+// startUpstreamTraceStep starts a "goproxy.fetch.upstream" step for an attempt
+// to fetch from the upstream in the request trace carried by the ctx, if any
+// (see [Goproxy.RequestTraces]).
+func startUpstreamTraceStep(ctx context.Context, upstream string) func(err error) {
+	return startRequestTraceStep(ctx, "goproxy.fetch.upstream", TraceAttribute{Key: "goproxy.upstream", Value: upstream})
+}
+
+// setRequestUpstream sets the [RequestInfo.Upstream] of the request being
+// served, if any, to the upstream.
+func setRequestUpstream(ctx context.Context, upstream string) {
+	if ri := RequestInfoFromContext(ctx); ri != nil {
+		ri.Upstream = upstream
+	}
+	setRequestTraceUpstream(ctx, upstream)
+}
+
 const defaultEnvGOSUMDB = "sum.golang.org"
 
 // cleanEnvGOSUMDB returns the cleaned envGOSUMDB.
@@ -695,7 +1363,9 @@ func cleanCommaSeparatedList(list string) string {
 }
 
 // checkCanonicalVersion is like [module.Check] but also checks whether the
-// version is canonical.
+// version is canonical, and whether a "+incompatible" version is used only
+// with a major version of v2 or higher for a path without a major version
+// suffix, as the go command requires.
 func checkCanonicalVersion(path, version string) error {
 	if err := module.Check(path, version); err != nil {
 		return err
@@ -706,6 +1376,21 @@ func checkCanonicalVersion(path, version string) error {
 			Err:  &module.InvalidVersionError{Version: version, Err: errors.New("not a canonical version")},
 		}
 	}
+	if strings.HasSuffix(version, "+incompatible") {
+		if _, pathMajor, _ := module.SplitPathVersion(path); pathMajor != "" {
+			return &module.ModuleError{
+				Path: path,
+				Err:  &module.InvalidVersionError{Version: version, Err: fmt.Errorf("+incompatible suffix not allowed: module path includes a major version suffix %q", pathMajor)},
+			}
+		}
+		switch semver.Major(version) {
+		case "v0", "v1":
+			return &module.ModuleError{
+				Path: path,
+				Err:  &module.InvalidVersionError{Version: version, Err: fmt.Errorf("+incompatible suffix not allowed: major version %s is compatible", semver.Major(version))},
+			}
+		}
+	}
 	return nil
 }
 
@@ -8,8 +8,10 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -39,6 +41,7 @@ func clearGoFetcherBuiltInEnv(t *testing.T) {
 		"GOSUMDB",
 		"GONOSUMDB",
 		"GOPRIVATE",
+		"GOINSECURE",
 	} {
 		t.Setenv(key, "")
 	}
@@ -142,6 +145,276 @@ func TestGoFetcherInit(t *testing.T) {
 	}
 }
 
+func TestGoFetcherInitEnv(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GONOSUMDB", "host.example.com")
+	for _, tt := range []struct {
+		n                int
+		env              []string
+		wantGOFLAGS      string
+		wantEnvGONOSUMDB string
+	}{
+		{1, nil, "-mod=mod", "host.example.com"},
+		{2, []string{"GOFLAGS=-modcacherw", "GONOSUMDB=env.example.com"}, "-modcacherw", "env.example.com"},
+		{3, []string{"GOFLAGS=-modcacherw", "GOFLAGS=-mod=readonly"}, "-mod=readonly", "host.example.com"},
+		{4, []string{"GOFLAGS=", "GONOSUMDB="}, "", ""},
+	} {
+		gf := &GoFetcher{Env: tt.env, TempDir: t.TempDir()}
+		gf.initOnce.Do(gf.init)
+		if gf.initErr != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, gf.initErr)
+		}
+		var goflags []string
+		for _, e := range gf.env {
+			if strings.HasPrefix(e, "GOFLAGS=") {
+				goflags = append(goflags, e)
+			}
+		}
+		if got, want := strings.Join(goflags, ","), "GOFLAGS="+tt.wantGOFLAGS; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := getenv(gf.env, "PATH"), os.Getenv("PATH"); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := gf.envGONOSUMDB, tt.wantEnvGONOSUMDB; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := getenv(gf.env, "GONOSUMDB"), ""; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	for _, tt := range []struct {
+		n         int
+		base      []string
+		overrides []string
+		want      []string
+	}{
+		{1, nil, nil, []string{}},
+		{2, []string{"A=1", "B=2"}, nil, []string{"A=1", "B=2"}},
+		{3, []string{"A=1", "B=2"}, []string{"B=3", "C=4"}, []string{"A=1", "B=3", "C=4"}},
+		{4, []string{"A=1", "A=2"}, []string{"C=3", "C="}, []string{"A=2", "C="}},
+		{5, []string{"A=1", "foobar"}, []string{"B"}, []string{"A=1"}},
+	} {
+		if got, want := strings.Join(mergeEnv(tt.base, tt.overrides), ","), strings.Join(tt.want, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoFetcherRedirects(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	cdnServer, setCDNHandler := newHTTPTestServer()
+	defer cdnServer.Close()
+	setCDNHandler(func(rw http.ResponseWriter, req *http.Request) {
+		responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+	})
+	cdnURL, err := url.Parse(cdnServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	cdnURL.Host = "localhost:" + cdnURL.Port()
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	setProxyHandler(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/example.com/@v/v1.0.0.info":
+			http.Redirect(rw, req, "/same-host/example.com/@v/v1.0.0.info", http.StatusFound)
+		case "/same-host/example.com/@v/v1.0.0.info":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		case "/example.com/@v/v1.1.0.info":
+			http.Redirect(rw, req, cdnURL.String()+"/example.com/@v/v1.0.0.info", http.StatusFound)
+		case "/example.com/@v/v1.2.0.info":
+			http.Redirect(rw, req, "/example.com/@v/v1.0.0.info", http.StatusFound)
+		default:
+			responseNotFound(rw, req, -2)
+		}
+	})
+	for _, tt := range []struct {
+		n             int
+		maxRedirects  int
+		redirectHosts []string
+		query         string
+		wantErr       error
+	}{
+		{n: 1, query: "v1.0.0"},
+		{
+			n:       2,
+			query:   "v1.1.0",
+			wantErr: fmt.Errorf(`Get "%s/example.com/@v/v1.0.0.info": redirect rejected: host "localhost" not allowed`, cdnURL),
+		},
+		{n: 3, redirectHosts: []string{"LOCALHOST"}, query: "v1.1.0"},
+		{
+			n:             4,
+			redirectHosts: []string{"cdn.example.com", "*.localhost"},
+			query:         "v1.1.0",
+			wantErr:       fmt.Errorf(`Get "%s/example.com/@v/v1.0.0.info": redirect rejected: host "localhost" not allowed`, cdnURL),
+		},
+		{n: 5, maxRedirects: 2, query: "v1.2.0"},
+		{
+			n:            6,
+			maxRedirects: 1,
+			query:        "v1.2.0",
+			wantErr:      errors.New(`Get "/same-host/example.com/@v/v1.0.0.info": redirect rejected: stopped after 1 redirects`),
+		},
+		{
+			n:            7,
+			maxRedirects: -1,
+			query:        "v1.0.0",
+			wantErr:      errors.New(`Get "/same-host/example.com/@v/v1.0.0.info": redirect rejected: stopped after 0 redirects`),
+		},
+	} {
+		gf := &GoFetcher{
+			Env:           []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+			MaxRedirects:  tt.maxRedirects,
+			RedirectHosts: tt.redirectHosts,
+		}
+		version, _, err := gf.Query(context.Background(), "example.com", tt.query)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			} else if !errors.Is(err, errRedirectRejected) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, errRedirectRejected)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := version, "v1.0.0"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoFetcherInsecureUpstreams(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	proxyServer := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+	}))
+	defer proxyServer.Close()
+	for _, tt := range []struct {
+		n                 int
+		env               []string
+		insecureUpstreams []string
+		wantEnvGOINSECURE string
+		wantErr           bool
+	}{
+		{n: 1, wantErr: true},
+		{n: 2, insecureUpstreams: []string{"127.0.0.1"}, wantEnvGOINSECURE: "127.0.0.1"},
+		{n: 3, insecureUpstreams: []string{"example.com", "*.example.com"}, wantEnvGOINSECURE: "example.com,*.example.com", wantErr: true},
+		{n: 4, env: []string{"GOINSECURE=127.0.0.*"}, wantEnvGOINSECURE: "127.0.0.*", wantErr: true},
+		{n: 5, env: []string{"GOINSECURE=example.com, "}, insecureUpstreams: []string{"127.0.0.1"}, wantEnvGOINSECURE: "example.com,127.0.0.1"},
+	} {
+		gf := &GoFetcher{
+			Env:               append([]string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"}, tt.env...),
+			InsecureUpstreams: tt.insecureUpstreams,
+		}
+		version, _, err := gf.Query(context.Background(), "example.com", "v1.0.0")
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := version, "v1.0.0"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := getenv(gf.env, "GOINSECURE"), tt.wantEnvGOINSECURE; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoFetcherValidate(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	_, vkey, err := note.GenerateKey(nil, "sumdb.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n       int
+		env     []string
+		sumDB   string
+		goBin   string
+		wantErr error
+	}{
+		{
+			n: 1,
+		},
+		{
+			n:     2,
+			sumDB: "off",
+		},
+		{
+			n:     3,
+			sumDB: vkey + " https://sumdb.example.com",
+		},
+		{
+			n:     4,
+			env:   append(os.Environ(), "GOSUMDB=foobar"),
+			sumDB: vkey,
+		},
+		{
+			n:       5,
+			sumDB:   "sumdb.example.com+foobar",
+			wantErr: errors.New("invalid GOSUMDB: malformed verifier id"),
+		},
+		{
+			n:       6,
+			sumDB:   vkey + " https://sumdb.example.com extra",
+			wantErr: errors.New("invalid GOSUMDB: too many fields"),
+		},
+		{
+			n:       7,
+			env:     append(os.Environ(), "GOPROXY=,"),
+			wantErr: errors.New("GOPROXY list is not the empty string, but contains no entries"),
+		},
+		{
+			n:       8,
+			goBin:   "goproxy-nonexistent-go",
+			wantErr: exec.ErrNotFound,
+		},
+		{
+			n:       9,
+			env:     append(os.Environ(), "GOPROXY=https://proxy.example.com", "GONOPROXY=example.com"),
+			goBin:   "goproxy-nonexistent-go",
+			wantErr: exec.ErrNotFound,
+		},
+		{
+			n:     10,
+			env:   append(os.Environ(), "GOPROXY=https://proxy.example.com"),
+			goBin: "goproxy-nonexistent-go",
+		},
+		{
+			n:     11,
+			env:   append(os.Environ(), "GOPROXY=off"),
+			goBin: "foobar",
+		},
+	} {
+		gf := &GoFetcher{Env: tt.env, SumDB: tt.sumDB, GoBin: tt.goBin, TempDir: t.TempDir()}
+		err := gf.Validate()
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !errors.Is(got, want) && !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := gf.sumdbClient == nil, tt.sumDB == "off"; got != want {
+				t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+			}
+		}
+	}
+}
+
 func TestGoFetcherSkipProxy(t *testing.T) {
 	clearGoFetcherBuiltInEnv(t)
 	for _, tt := range []struct {
@@ -269,6 +542,108 @@ func TestGoFetcherQuery(t *testing.T) {
 	}
 }
 
+func TestGoFetcherQueryLatest(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	infoTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	newProxyHandler := func(list, latest string, hasGoMod bool) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.URL.Path == "/example.com/@v/list":
+				responseSuccess(rw, req, strings.NewReader(list), "text/plain; charset=utf-8", -2)
+			case req.URL.Path == "/example.com/@latest":
+				responseSuccess(rw, req, strings.NewReader(marshalInfo(latest, infoTime)), "application/json; charset=utf-8", -2)
+			case strings.HasSuffix(req.URL.Path, ".info"):
+				version := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/example.com/@v/"), ".info")
+				responseSuccess(rw, req, strings.NewReader(marshalInfo(version, infoTime)), "application/json; charset=utf-8", -2)
+			case strings.HasSuffix(req.URL.Path, ".mod"):
+				mod := "module example.com\n"
+				if hasGoMod {
+					mod += "\ngo 1.18\n"
+				}
+				responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
+			default:
+				responseNotFound(rw, req, -2)
+			}
+		}
+	}
+	for _, tt := range []struct {
+		n            int
+		proxyHandler http.HandlerFunc
+		latest       LatestOptions
+		wantVersion  string
+		wantErr      error
+	}{
+		{
+			n:            1,
+			proxyHandler: newProxyHandler("v1.0.0\nv2.0.0+incompatible", "v2.0.0+incompatible", false),
+			wantVersion:  "v2.0.0+incompatible",
+		},
+		{
+			n:            2,
+			proxyHandler: newProxyHandler("v1.0.0\nv2.0.0+incompatible", "v2.0.0+incompatible", false),
+			latest:       LatestOptions{ExcludeIncompatible: true},
+			wantVersion:  "v1.0.0",
+		},
+		{
+			n:            3,
+			proxyHandler: newProxyHandler("v1.0.0\nv2.0.0+incompatible", "v2.0.0+incompatible", true),
+			latest:       LatestOptions{ExcludePrereleases: true},
+			wantVersion:  "v1.0.0",
+		},
+		{
+			n:            4,
+			proxyHandler: newProxyHandler("v1.0.0\nv1.1.0-rc.1", "v0.0.0-20000101000000-000000000000", false),
+			latest:       LatestOptions{ExcludePseudoVersions: true},
+			wantVersion:  "v1.0.0",
+		},
+		{
+			n:            5,
+			proxyHandler: newProxyHandler("v1.1.0-rc.1", "v1.1.0-rc.1", false),
+			latest:       LatestOptions{ExcludePrereleases: true},
+			wantErr:      notExistErrorf("no matching versions for query \"latest\""),
+		},
+		{
+			n:            6,
+			proxyHandler: newProxyHandler("", "v0.0.0-20000101000000-000000000000", false),
+			latest:       LatestOptions{ExcludePrereleases: true},
+			wantVersion:  "v0.0.0-20000101000000-000000000000",
+		},
+		{
+			n:            7,
+			proxyHandler: newProxyHandler("", "v0.0.0-20000101000000-000000000000", false),
+			latest:       LatestOptions{ExcludePseudoVersions: true},
+			wantErr:      notExistErrorf("no matching versions for query \"latest\""),
+		},
+	} {
+		setProxyHandler(tt.proxyHandler)
+		gf := &GoFetcher{
+			Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+			TempDir: t.TempDir(),
+			Latest:  tt.latest,
+		}
+		version, time, err := gf.Query(context.Background(), "example.com", "latest")
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !errors.Is(got, fs.ErrNotExist) || !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := version, tt.wantVersion; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := time, infoTime; !got.Equal(want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
 func TestGoFetcherProxyQuery(t *testing.T) {
 	clearGoFetcherBuiltInEnv(t)
 	proxyServer, setProxyHandler := newHTTPTestServer()
@@ -486,12 +861,39 @@ invalid
 			wantVersions: []string{"v1.0.0", "v1.1.0"},
 		},
 		{
-			n:       5,
+			n: 5,
+			proxyHandler: func(rw http.ResponseWriter, req *http.Request) {
+				responseSuccess(rw, req, strings.NewReader("v1.0.0\nv2.0.0\nv2.1.0\nv2.0.0+incompatible\nv3.0.0\nv2.2"), "text/plain; charset=utf-8", -2)
+			},
+			env:          append(os.Environ(), "GOPROXY="+proxyServer.URL),
+			path:         "example.com/v2",
+			wantVersions: []string{"v2.0.0", "v2.1.0"},
+		},
+		{
+			n: 6,
+			proxyHandler: func(rw http.ResponseWriter, req *http.Request) {
+				responseSuccess(rw, req, strings.NewReader("v1.0.0\nv2.0.0\nv2.0.0+incompatible\nv1.0.0+incompatible\nv3.0.0-rc.1+incompatible"), "text/plain; charset=utf-8", -2)
+			},
+			env:          append(os.Environ(), "GOPROXY="+proxyServer.URL),
+			path:         "example.com",
+			wantVersions: []string{"v1.0.0", "v2.0.0+incompatible", "v3.0.0-rc.1+incompatible"},
+		},
+		{
+			n: 7,
+			proxyHandler: func(rw http.ResponseWriter, req *http.Request) {
+				responseSuccess(rw, req, strings.NewReader("v1.0.0\nv2.0.0\nv2.4.0\nv2.0.0+incompatible\nv3.0.0"), "text/plain; charset=utf-8", -2)
+			},
+			env:          append(os.Environ(), "GOPROXY="+proxyServer.URL),
+			path:         "gopkg.in/yaml.v2",
+			wantVersions: []string{"v2.0.0", "v2.4.0"},
+		},
+		{
+			n:       8,
 			path:    "foobar",
 			wantErr: errors.New(`malformed module path "foobar": missing dot in first path element`),
 		},
 		{
-			n:       6,
+			n:       9,
 			env:     append(os.Environ(), "GOSUMDB=foobar"),
 			wantErr: errors.New("invalid GOSUMDB: malformed verifier id"),
 		},
@@ -701,6 +1103,7 @@ func TestGoFetcherDownload(t *testing.T) {
 		proxyHandler http.HandlerFunc
 		sumdbHandler http.HandlerFunc
 		env          []string
+		sumDB        string
 		path         string
 		version      string
 		wantInfo     string
@@ -848,6 +1251,42 @@ func TestGoFetcherDownload(t *testing.T) {
 			env:     append(os.Environ(), "GOSUMDB=foobar"),
 			wantErr: errors.New("invalid GOSUMDB: malformed verifier id"),
 		},
+		{
+			n:        15,
+			env:      append(os.Environ(), "GOPROXY="+proxyServer.URL, "GOSUMDB=foobar"),
+			sumDB:    vkey + " " + sumdbServer.URL,
+			path:     "example.com",
+			version:  infoVersion,
+			wantInfo: info,
+			wantMod:  mod,
+			wantZip:  string(zip),
+		},
+		{
+			n: 16,
+			sumdbHandler: func(rw http.ResponseWriter, req *http.Request) {
+				responseNotFound(rw, req, -2)
+			},
+			env:      append(os.Environ(), "GOPROXY="+proxyServer.URL, "GOSUMDB="+vkey+" "+sumdbServer.URL),
+			sumDB:    "off",
+			path:     "example.com",
+			version:  infoVersion,
+			wantInfo: info,
+			wantMod:  mod,
+			wantZip:  string(zip),
+		},
+		{
+			n: 17,
+			sumdbHandler: sumdb.NewServer(sumdb.NewTestServer(skey, func(modulePath, moduleVersion string) ([]byte, error) {
+				gosum := fmt.Sprintf("%s %s %s\n", modulePath, "v1.1.0", dirHash)
+				gosum += fmt.Sprintf("%s %s/go.mod %s\n", modulePath, moduleVersion, modHash)
+				return []byte(gosum), nil
+			})).ServeHTTP,
+			env:     append(os.Environ(), "GOPROXY="+proxyServer.URL, "GOSUMDB=off"),
+			sumDB:   vkey + " " + sumdbServer.URL,
+			path:    "example.com",
+			version: infoVersion,
+			wantErr: notExistErrorf("example.com@v1.0.0: invalid version: untrusted revision v1.0.0"),
+		},
 	} {
 		if tt.proxyHandler == nil {
 			tt.proxyHandler = proxyHandler
@@ -857,7 +1296,7 @@ func TestGoFetcherDownload(t *testing.T) {
 			tt.sumdbHandler = sumdbHandler
 		}
 		setSumDBHandler(tt.sumdbHandler)
-		gf := &GoFetcher{Env: tt.env, TempDir: t.TempDir()}
+		gf := &GoFetcher{Env: tt.env, SumDB: tt.sumDB, TempDir: t.TempDir()}
 		gf.initOnce.Do(gf.init)
 		gf.env = append(gf.env, "GOPROXY="+proxyServer.URL+"/direct/")
 		info, mod, zip, err := gf.Download(context.Background(), tt.path, tt.version)
@@ -901,6 +1340,150 @@ func TestGoFetcherDownload(t *testing.T) {
 	}
 }
 
+func TestGoFetcherOnUpstreamMismatch(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	otherZip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com // poisoned")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	newProxyHandler := func(mod string, zip []byte, requests *int) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			*requests++
+			switch req.URL.Path {
+			case "/example.com/@v/v1.0.0.info":
+				responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+			case "/example.com/@v/v1.0.0.mod":
+				responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
+			case "/example.com/@v/v1.0.0.zip":
+				responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
+			default:
+				responseNotFound(rw, req, -2)
+			}
+		}
+	}
+	notFoundHandler := func(requests *int) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			*requests++
+			responseNotFound(rw, req, -2)
+		}
+	}
+	for _, tt := range []struct {
+		n              int
+		handlers       func(requests []int) []http.HandlerFunc
+		verify         bool
+		wantMod        string
+		wantMismatches []string
+		wantRequests   []int
+	}{
+		{
+			n: 1,
+			handlers: func(requests []int) []http.HandlerFunc {
+				return []http.HandlerFunc{
+					newProxyHandler("module example.com", zip, &requests[0]),
+					newProxyHandler("module example.com", zip, &requests[1]),
+					newProxyHandler("module example.com // poisoned", otherZip, &requests[2]),
+				}
+			},
+			verify:         true,
+			wantMod:        "module example.com",
+			wantMismatches: []string{"0 2 .mod,.zip"},
+			wantRequests:   []int{3, 3, 3},
+		},
+		{
+			n: 2,
+			handlers: func(requests []int) []http.HandlerFunc {
+				return []http.HandlerFunc{
+					notFoundHandler(&requests[0]),
+					newProxyHandler("module example.com // poisoned", zip, &requests[1]),
+					newProxyHandler("module example.com", zip, &requests[2]),
+				}
+			},
+			verify:         true,
+			wantMod:        "module example.com // poisoned",
+			wantMismatches: []string{"1 2 .mod"},
+			wantRequests:   []int{1, 3, 3},
+		},
+		{
+			n: 3,
+			handlers: func(requests []int) []http.HandlerFunc {
+				return []http.HandlerFunc{
+					newProxyHandler("module example.com", zip, &requests[0]),
+					notFoundHandler(&requests[1]),
+					newProxyHandler("module example.com", zip, &requests[2]),
+				}
+			},
+			verify:       true,
+			wantMod:      "module example.com",
+			wantRequests: []int{3, 1, 3},
+		},
+		{
+			n: 4,
+			handlers: func(requests []int) []http.HandlerFunc {
+				return []http.HandlerFunc{
+					newProxyHandler("module example.com", zip, &requests[0]),
+					newProxyHandler("module example.com // poisoned", otherZip, &requests[1]),
+					newProxyHandler("module example.com // poisoned", otherZip, &requests[2]),
+				}
+			},
+			wantMod:      "module example.com",
+			wantRequests: []int{3, 0, 0},
+		},
+	} {
+		requests := make([]int, 3)
+		var proxyURLs []string
+		for _, handler := range tt.handlers(requests) {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			proxyURLs = append(proxyURLs, server.URL)
+		}
+		var mismatches []string
+		gf := &GoFetcher{
+			Env:     []string{"GOPROXY=" + strings.Join(proxyURLs, ",") + ",off", "GOSUMDB=off"},
+			TempDir: t.TempDir(),
+		}
+		if tt.verify {
+			gf.OnUpstreamMismatch = func(mismatch UpstreamMismatch) {
+				if got, want := mismatch.Path+"@"+mismatch.Version, "example.com@v1.0.0"; got != want {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+				}
+				var upstream, otherUpstream int
+				for i, proxyURL := range proxyURLs {
+					if mismatch.Upstream == proxyURL {
+						upstream = i
+					}
+					if mismatch.OtherUpstream == proxyURL {
+						otherUpstream = i
+					}
+				}
+				mismatches = append(mismatches, fmt.Sprintf("%d %d %s", upstream, otherUpstream, strings.Join(mismatch.Files, ",")))
+			}
+		}
+		info, mod, zipContent, err := gf.Download(context.Background(), "example.com", "v1.0.0")
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if b, err := io.ReadAll(mod); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantMod; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		info.Close()
+		mod.Close()
+		zipContent.Close()
+		if got, want := strings.Join(mismatches, "\n"), strings.Join(tt.wantMismatches, "\n"); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := fmt.Sprint(requests), fmt.Sprint(tt.wantRequests); got != want {
+			t.Errorf("test(%d): got %s, want %s", tt.n, got, want)
+		}
+	}
+}
+
 func TestGoFetcherProxyDownload(t *testing.T) {
 	clearGoFetcherBuiltInEnv(t)
 	proxyServer, setProxyHandler := newHTTPTestServer()
@@ -1201,6 +1784,13 @@ func TestGoFetcherExecGo(t *testing.T) {
 			tempDir: filepath.Join(t.TempDir(), "404"),
 			wantErr: fs.ErrNotExist,
 		},
+		{
+			n:       7,
+			ctx:     context.Background(),
+			goBin:   "goproxy-nonexistent-go",
+			args:    []string{"env", "GOPROXY"},
+			wantErr: exec.ErrNotFound,
+		},
 	} {
 		if tt.tempDir == "" {
 			tt.tempDir = t.TempDir()
@@ -1218,7 +1808,7 @@ func TestGoFetcherExecGo(t *testing.T) {
 		if tt.wantErr != nil {
 			if err == nil {
 				t.Fatalf("test(%d): expected error", tt.n)
-			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+			} else if got, want := err, tt.wantErr; !errors.Is(got, want) && !compareErrors(got, want) {
 				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 			}
 		} else {
@@ -1232,6 +1822,54 @@ func TestGoFetcherExecGo(t *testing.T) {
 	}
 }
 
+func TestSelectLatestVersion(t *testing.T) {
+	for _, tt := range []struct {
+		n                  int
+		versions           []string
+		opts               LatestOptions
+		hasGoMod           bool
+		wantVersion        string
+		wantHasGoModCalled bool
+	}{
+		{1, nil, LatestOptions{}, false, "", false},
+		{2, []string{"v1.0.0", "v1.1.0-rc.1", "v0.9.0"}, LatestOptions{}, false, "v1.0.0", false},
+		{3, []string{"v1.1.0-rc.1", "v1.0.0-rc.1"}, LatestOptions{}, false, "v1.1.0-rc.1", false},
+		{4, []string{"v1.1.0-rc.1", "v1.0.0-rc.1"}, LatestOptions{ExcludePrereleases: true}, false, "", false},
+		{5, []string{"v1.0.0", "v2.0.0+incompatible", "v3.0.0-rc.1+incompatible"}, LatestOptions{}, false, "v2.0.0+incompatible", true},
+		{6, []string{"v1.0.0", "v2.0.0+incompatible", "v3.0.0-rc.1+incompatible"}, LatestOptions{}, true, "v1.0.0", true},
+		{7, []string{"v1.0.0", "v2.0.0+incompatible"}, LatestOptions{ExcludeIncompatible: true}, false, "v1.0.0", false},
+		{8, []string{"v2.0.0+incompatible", "v3.0.0-rc.1+incompatible"}, LatestOptions{}, true, "v2.0.0+incompatible", false},
+		{9, []string{"v2.0.0+incompatible"}, LatestOptions{ExcludeIncompatible: true}, false, "", false},
+		{10, []string{"v1.1.0-rc.1", "v2.0.0+incompatible"}, LatestOptions{ExcludePrereleases: true}, false, "v2.0.0+incompatible", false},
+		{11, []string{"v1.0.0", "v1.1.0-rc.1", "v2.0.0-rc.1+incompatible"}, LatestOptions{}, false, "v1.0.0", true},
+		{12, []string{"", "master", "v1.0.0"}, LatestOptions{}, false, "v1.0.0", false},
+	} {
+		var hasGoModCalled bool
+		version, err := selectLatestVersion(tt.versions, tt.opts, func(version string) (bool, error) {
+			hasGoModCalled = true
+			return tt.hasGoMod, nil
+		})
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := version, tt.wantVersion; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := hasGoModCalled, tt.wantHasGoModCalled; got != want {
+			t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+		}
+	}
+
+	wantErr := errors.New("foobar")
+	if _, err := selectLatestVersion([]string{"v1.0.0", "v2.0.0+incompatible"}, LatestOptions{}, func(version string) (bool, error) {
+		return false, wantErr
+	}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, wantErr; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestCleanEnvGOPROXY(t *testing.T) {
 	for _, tt := range []struct {
 		n              int
@@ -1601,6 +2239,45 @@ func TestCheckCanonicalVersion(t *testing.T) {
 			version: "v2.0.0",
 			wantErr: errors.New("example.com@v2.0.0: invalid version: should be v0 or v1, not v2"),
 		},
+		{
+			n:       6,
+			path:    "example.com",
+			version: "v2.0.0+incompatible",
+		},
+		{
+			n:       7,
+			path:    "example.com/v2",
+			version: "v2.1.0",
+		},
+		{
+			n:       8,
+			path:    "example.com/v2",
+			version: "v1.0.0",
+			wantErr: errors.New("example.com/v2@v1.0.0: invalid version: should be v2, not v1"),
+		},
+		{
+			n:       9,
+			path:    "example.com/v2",
+			version: "v2.0.0+incompatible",
+			wantErr: errors.New(`example.com/v2@v2.0.0+incompatible: invalid version: +incompatible suffix not allowed: module path includes a major version suffix "/v2"`),
+		},
+		{
+			n:       10,
+			path:    "example.com",
+			version: "v1.0.0+incompatible",
+			wantErr: errors.New("example.com@v1.0.0+incompatible: invalid version: +incompatible suffix not allowed: major version v1 is compatible"),
+		},
+		{
+			n:       11,
+			path:    "gopkg.in/yaml.v2",
+			version: "v2.4.0",
+		},
+		{
+			n:       12,
+			path:    "gopkg.in/yaml.v2",
+			version: "v2.4.0+incompatible",
+			wantErr: errors.New(`gopkg.in/yaml.v2@v2.4.0+incompatible: invalid version: +incompatible suffix not allowed: module path includes a major version suffix ".v2"`),
+		},
 	} {
 		err := checkCanonicalVersion(tt.path, tt.version)
 		if tt.wantErr != nil {
@@ -0,0 +1,202 @@
+package goproxy
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// vcsCacheEnv returns the env with the GOMODCACHE set to the dir and
+// "-modcacherw" added to the GOFLAGS (see [GoFetcher.VCSCacheDir]), so that the
+// module files downloaded into the dir can be removed.
+func vcsCacheEnv(env []string, dir string) []string {
+	goflags := ""
+	for _, e := range env {
+		if k, v, ok := strings.Cut(e, "="); ok && k == "GOFLAGS" {
+			goflags = v
+		}
+	}
+	hasModCacheRW := false
+	for _, flag := range strings.Fields(goflags) {
+		if flag == "-modcacherw" || flag == "--modcacherw" || flag == "-modcacherw=true" {
+			hasModCacheRW = true
+		}
+	}
+	if !hasModCacheRW {
+		goflags = strings.TrimSpace(goflags + " -modcacherw")
+	}
+	return mergeEnv(env, []string{"GOMODCACHE=" + dir, "GOFLAGS=" + goflags})
+}
+
+// vcsCacheCleanup registers a use of the module files of the given module path
+// and version that a direct download is about to download into the
+// gf.vcsCacheDir, and returns a function that releases it, or nil if the
+// gf.vcsCacheDir is empty. The module files are removed once all uses of them
+// are released, so that concurrent direct downloads of the same module version
+// do not remove the files that the others are still using.
+func (gf *GoFetcher) vcsCacheCleanup(path, version string) func() {
+	if gf.vcsCacheDir == "" {
+		return nil
+	}
+	key := path + "@" + version
+	gf.vcsCacheRefsMutex.Lock()
+	if gf.vcsCacheRefs == nil {
+		gf.vcsCacheRefs = map[string]int{}
+	}
+	gf.vcsCacheRefs[key]++
+	gf.vcsCacheRefsMutex.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			gf.vcsCacheRefsMutex.Lock()
+			defer gf.vcsCacheRefsMutex.Unlock()
+			if gf.vcsCacheRefs[key]--; gf.vcsCacheRefs[key] > 0 {
+				return
+			}
+			delete(gf.vcsCacheRefs, key)
+			gf.removeVCSCacheFiles(path, version)
+		})
+	}
+}
+
+// removeVCSCacheFiles removes the module files of the given module path and
+// version downloaded into the gf.vcsCacheDir by direct downloads.
+func (gf *GoFetcher) removeVCSCacheFiles(path, version string) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return
+	}
+	nameWithoutExt := filepath.Join(gf.vcsCacheDir, "cache", "download", filepath.FromSlash(escapedPath), "@v", escapedVersion)
+	for _, ext := range []string{".info", ".mod", ".zip", ".ziphash", ".lock"} {
+		os.Remove(nameWithoutExt + ext)
+	}
+	os.RemoveAll(filepath.Join(gf.vcsCacheDir, filepath.FromSlash(escapedPath)+"@"+escapedVersion))
+}
+
+// touchVCSClone marks the clone of the repository at the remoteURL in the
+// gf.vcsCacheDir as just used, so that [GoFetcher.pruneVCSCache] keeps it. Each
+// clone is identified by the ".info" file next to it, which records the
+// version control system and the remote URL separated by a colon (e.g.,
+// "git3:https://example.com/repo").
+func (gf *GoFetcher) touchVCSClone(remoteURL string) {
+	if remoteURL == "" {
+		return
+	}
+	vcsDir := filepath.Join(gf.vcsCacheDir, "cache", "vcs")
+	infoFiles, err := filepath.Glob(filepath.Join(vcsDir, "*.info"))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, infoFile := range infoFiles {
+		b, err := os.ReadFile(infoFile)
+		if err != nil {
+			continue
+		}
+		_, name, ok := strings.Cut(strings.TrimSpace(string(b)), ":")
+		if !ok || name != remoteURL {
+			continue
+		}
+		os.Chtimes(strings.TrimSuffix(infoFile, ".info"), now, now)
+	}
+}
+
+// vcsClone is a clone of a repository in the [GoFetcher.VCSCacheDir].
+type vcsClone struct {
+	dir      string
+	size     int64
+	lastUsed time.Time
+}
+
+// queuePruneVCSCache prunes the gf.vcsCacheDir (see
+// [GoFetcher.pruneVCSCache]) in the background, unless a prune is already
+// queued.
+func (gf *GoFetcher) queuePruneVCSCache() {
+	if gf.MaxVCSCacheSize <= 0 && gf.VCSCacheMaxAge <= 0 {
+		return
+	}
+	gf.vcsCacheRefsMutex.Lock()
+	queued := gf.vcsCachePruneQueued
+	gf.vcsCachePruneQueued = true
+	gf.vcsCacheRefsMutex.Unlock()
+	if !queued {
+		go gf.pruneVCSCache()
+	}
+}
+
+// pruneVCSCache removes the clones in the gf.vcsCacheDir that are older than
+// the gf.VCSCacheMaxAge, and then the least recently used ones until their
+// total size is within the gf.MaxVCSCacheSize. As the clones may be in use, it
+// waits for the direct fetches in progress to complete, and holds off new ones
+// until it is done. The last use of a clone is the last time anything in it
+// was modified or it was touched by [GoFetcher.touchVCSClone]. Removals are
+// best-effort, as a clone that cannot be removed now is retried by the next
+// prune.
+func (gf *GoFetcher) pruneVCSCache() {
+	gf.vcsCacheMutex.Lock()
+	defer gf.vcsCacheMutex.Unlock()
+	gf.vcsCacheRefsMutex.Lock()
+	gf.vcsCachePruneQueued = false
+	gf.vcsCacheRefsMutex.Unlock()
+	if gf.MaxVCSCacheSize <= 0 && gf.VCSCacheMaxAge <= 0 {
+		return
+	}
+
+	vcsDir := filepath.Join(gf.vcsCacheDir, "cache", "vcs")
+	entries, err := os.ReadDir(vcsDir)
+	if err != nil {
+		return
+	}
+	var (
+		clones    []vcsClone
+		totalSize int64
+	)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		clone := vcsClone{dir: filepath.Join(vcsDir, entry.Name())}
+		filepath.WalkDir(clone.dir, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				clone.size += fi.Size()
+			}
+			if fi.ModTime().After(clone.lastUsed) {
+				clone.lastUsed = fi.ModTime()
+			}
+			return nil
+		})
+		clones = append(clones, clone)
+		totalSize += clone.size
+	}
+	sort.Slice(clones, func(i, j int) bool { return clones[i].lastUsed.Before(clones[j].lastUsed) })
+	for _, clone := range clones {
+		stale := gf.VCSCacheMaxAge > 0 && time.Since(clone.lastUsed) > gf.VCSCacheMaxAge
+		oversized := gf.MaxVCSCacheSize > 0 && totalSize > gf.MaxVCSCacheSize
+		if !stale && !oversized {
+			continue
+		}
+		if err := os.RemoveAll(clone.dir); err != nil {
+			continue
+		}
+		os.Remove(clone.dir + ".info")
+		os.Remove(clone.dir + ".lock")
+		totalSize -= clone.size
+	}
+}
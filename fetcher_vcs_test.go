@@ -0,0 +1,197 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVCSCacheEnv(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		env         []string
+		wantGOFLAGS string
+	}{
+		{1, nil, "GOFLAGS=-modcacherw"},
+		{2, []string{"GOFLAGS=-mod=mod"}, "GOFLAGS=-mod=mod -modcacherw"},
+		{3, []string{"GOFLAGS=-modcacherw -mod=mod"}, "GOFLAGS=-modcacherw -mod=mod"},
+		{4, []string{"GOMODCACHE=/tmp/modcache", "GOFLAGS="}, "GOFLAGS=-modcacherw"},
+	} {
+		env := vcsCacheEnv(tt.env, "/var/cache/vcs")
+		var gotGOMODCACHE, gotGOFLAGS string
+		for _, e := range env {
+			switch {
+			case strings.HasPrefix(e, "GOMODCACHE="):
+				gotGOMODCACHE = e
+			case strings.HasPrefix(e, "GOFLAGS="):
+				gotGOFLAGS = e
+			}
+		}
+		if got, want := gotGOMODCACHE, "GOMODCACHE=/var/cache/vcs"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := gotGOFLAGS, tt.wantGOFLAGS; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoFetcherVCSCache(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is unavailable")
+	}
+	clearGoFetcherBuiltInEnv(t)
+	t.Setenv("GOPATH", t.TempDir())
+	repoDir := t.TempDir()
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_COUNT", "2")
+	t.Setenv("GIT_CONFIG_KEY_0", "url."+repoDir+".insteadOf")
+	t.Setenv("GIT_CONFIG_VALUE_0", "https://example.com/repo")
+	t.Setenv("GIT_CONFIG_KEY_1", "protocol.file.allow")
+	t.Setenv("GIT_CONFIG_VALUE_1", "always")
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=goproxy", "-c", "user.email=goproxy@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("unexpected error %q: %s", err, output)
+		}
+	}
+	git("init", "-q")
+	if err := os.WriteFile(filepath.Join(repoDir, "go.mod"), []byte("module example.com/repo.git\n"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	git("add", "go.mod")
+	git("commit", "-q", "-m", "v1.0.0")
+	git("tag", "v1.0.0")
+	if err := os.WriteFile(filepath.Join(repoDir, "repo.go"), []byte("package repo\n"), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	git("add", "repo.go")
+	git("commit", "-q", "-m", "v1.1.0")
+	git("tag", "v1.1.0")
+
+	vcsCacheDir := t.TempDir()
+	gf := &GoFetcher{
+		Env:         []string{"GOPROXY=direct", "GOSUMDB=off"},
+		TempDir:     t.TempDir(),
+		VCSCacheDir: vcsCacheDir,
+	}
+	download := func(version string) {
+		info, mod, zip, err := gf.Download(context.Background(), "example.com/repo.git", version)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if b, err := io.ReadAll(mod); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		} else if got, want := string(b), "module example.com/repo.git\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		info.Close()
+		mod.Close()
+		zip.Close()
+	}
+	clones := func() []string {
+		var dirs []string
+		entries, _ := os.ReadDir(filepath.Join(vcsCacheDir, "cache", "vcs"))
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(vcsCacheDir, "cache", "vcs", entry.Name()))
+			}
+		}
+		return dirs
+	}
+
+	download("v1.0.0")
+	cloneDirs := clones()
+	if got, want := len(cloneDirs), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	marker := filepath.Join(cloneDirs[0], "goproxy-test-marker")
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, name := range []string{
+		filepath.Join(vcsCacheDir, "cache", "download", "example.com", "repo.git", "@v", "v1.0.0.zip"),
+		filepath.Join(vcsCacheDir, "example.com", "repo.git@v1.0.0"),
+	} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("got %v, want not exist", err)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cloneDirs[0], old, old); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	download("v1.1.0")
+	if got, want := strings.Join(clones(), ","), cloneDirs[0]; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+	if fi, err := os.Stat(cloneDirs[0]); err != nil {
+		t.Errorf("unexpected error %q", err)
+	} else if time.Since(fi.ModTime()) > time.Hour {
+		t.Errorf("got mod time %v, want recent", fi.ModTime())
+	}
+
+	gf.VCSCacheMaxAge = time.Hour
+	gf.pruneVCSCache()
+	if got, want := len(clones()), 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	filepath.WalkDir(cloneDirs[0], func(path string, d fs.DirEntry, err error) error {
+		if err == nil {
+			os.Chtimes(path, old, old)
+		}
+		return nil
+	})
+	gf.pruneVCSCache()
+	if got := clones(); len(got) != 0 {
+		t.Errorf("got %q, want none", got)
+	}
+	if _, err := os.Stat(cloneDirs[0] + ".info"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist", err)
+	}
+
+	gf.VCSCacheMaxAge = 0
+	gf.MaxVCSCacheSize = 1
+	download("v1.0.0")
+	for deadline := time.Now().Add(10 * time.Second); len(clones()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	gf.vcsCacheMutex.Lock() // Wait for the scheduled prune to complete.
+	gf.vcsCacheMutex.Unlock()
+	if got := clones(); len(got) != 0 {
+		t.Errorf("got %q, want none", got)
+	}
+}
+
+func TestGoFetcherVCSCacheCleanup(t *testing.T) {
+	gf := &GoFetcher{vcsCacheDir: t.TempDir()}
+	zipFile := filepath.Join(gf.vcsCacheDir, "cache", "download", "example.com", "@v", "v1.0.0.zip")
+	if err := os.MkdirAll(filepath.Dir(zipFile), 0o755); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := os.WriteFile(zipFile, nil, 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	cleanup1 := gf.vcsCacheCleanup("example.com", "v1.0.0")
+	cleanup2 := gf.vcsCacheCleanup("example.com", "v1.0.0")
+	cleanup1()
+	cleanup1()
+	if _, err := os.Stat(zipFile); err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+	cleanup2()
+	if _, err := os.Stat(zipFile); !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist", err)
+	}
+}
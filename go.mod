@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/minio/minio-go/v7 v7.0.66
 	github.com/spf13/cobra v1.8.0
+	golang.org/x/crypto v0.17.0
 	golang.org/x/mod v0.16.0
 )
 
@@ -22,7 +23,6 @@ require (
 	github.com/rs/xid v1.5.0 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
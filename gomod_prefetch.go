@@ -0,0 +1,232 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// PrefetchReport is the report of [Goproxy.PrefetchFromGoMod].
+type PrefetchReport struct {
+	// Modules is the prefetched module versions, sorted by module path and
+	// then by semantic version.
+	Modules []PrefetchedModule
+}
+
+// PrefetchedModule is a module version in a [PrefetchReport].
+type PrefetchedModule struct {
+	// Path is the module path.
+	Path string
+
+	// Version is the module version.
+	Version string
+
+	// ModOnly indicates whether the go.sum file only has the checksum of
+	// the go.mod file of the module version (i.e., the module version is in
+	// the module graph but provides no packages to the build), in which
+	// case only its .mod file has been requested.
+	ModOnly bool
+
+	// Err is the error that occurred while prefetching the module version.
+	// It matches [ErrZipHashMismatch] if the cached .zip file does not
+	// match its checksum in the go.sum file.
+	Err error
+}
+
+// PrefetchFromGoMod caches the module versions needed to build the main module
+// of the go.mod file at the goModPath to the g.Cacher, so that the main module
+// can then be built against the g.Cacher alone (e.g., in an air-gapped
+// environment). The module versions are those required by the go.mod file
+// (after applying its replace directives with module versions) and those in
+// the go.sum file at the goSumPath. The module files of each module version
+// are cached in the same way as [Goproxy.Prefetch], except for those whose
+// go.sum entries are only for their go.mod files, for which only the .mod
+// files are requested.
+//
+// The "h1:" hash of each cached .zip file is verified against its entry in the
+// go.sum file, if any. If the goSumPath is empty, only the module versions
+// required by the go.mod file are cached, and nothing is verified.
+//
+// Errors of individual module versions are reported in the returned
+// [PrefetchReport]. The returned error is non-nil only if the files cannot be
+// read or parsed, if the g.Cacher is nil, or if the ctx is done before all
+// module versions have been prefetched, in which case the module versions not
+// prefetched yet report the ctx.Err.
+func (g *Goproxy) PrefetchFromGoMod(ctx context.Context, goModPath, goSumPath string) (PrefetchReport, error) {
+	g.initOnce.Do(g.init)
+	var report PrefetchReport
+	if g.Cacher == nil {
+		return report, errors.New("cacher is not set")
+	}
+	requirements, err := readGoModRequirements(goModPath)
+	if err != nil {
+		return report, err
+	}
+	modules := map[module.Version]bool{} // The values indicate ModOnly.
+	for _, mod := range requirements {
+		modules[mod] = false
+	}
+	sums := map[module.Version]string{}
+	if goSumPath != "" {
+		entries, err := readGoSum(goSumPath)
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range entries {
+			if version, ok := cutGoModSuffix(entry.mod.Version); ok {
+				mod := module.Version{Path: entry.mod.Path, Version: version}
+				if _, ok := modules[mod]; !ok {
+					modules[mod] = true
+				}
+				continue
+			}
+			modules[entry.mod] = false
+			sums[entry.mod] = entry.hash
+		}
+	}
+
+	report.Modules = make([]PrefetchedModule, 0, len(modules))
+	for mod, modOnly := range modules {
+		report.Modules = append(report.Modules, PrefetchedModule{Path: mod.Path, Version: mod.Version, ModOnly: modOnly})
+	}
+	sort.Slice(report.Modules, func(i, j int) bool {
+		mi, mj := report.Modules[i], report.Modules[j]
+		if mi.Path != mj.Path {
+			return mi.Path < mj.Path
+		}
+		return semver.Compare(mi.Version, mj.Version) < 0
+	})
+
+	workerPool := make(chan struct{}, 4)
+	var wg sync.WaitGroup
+	for i := range report.Modules {
+		pm := &report.Modules[i]
+		release, err := acquireWorker(ctx, workerPool)
+		if err != nil {
+			pm.Err = err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			pm.Err = g.prefetchGoModModule(ctx, pm, sums[module.Version{Path: pm.Path, Version: pm.Version}])
+		}()
+	}
+	wg.Wait()
+	return report, ctx.Err()
+}
+
+// prefetchGoModModule prefetches the module version of the pm for
+// [Goproxy.PrefetchFromGoMod], and verifies its cached .zip file against the
+// zipHash if it is not empty.
+func (g *Goproxy) prefetchGoModModule(ctx context.Context, pm *PrefetchedModule, zipHash string) error {
+	if pm.ModOnly {
+		name, err := CacheName(pm.Path, pm.Version, "mod")
+		if err != nil {
+			return notExistErrorf("%w", err)
+		}
+		content, err := g.GetOrFetch(ctx, name)
+		if err != nil {
+			return err
+		}
+		return content.Close()
+	}
+	if _, err := g.Prefetch(ctx, pm.Path, pm.Version); err != nil {
+		return err
+	}
+	if zipHash == "" {
+		return nil
+	}
+	name, err := CacheName(pm.Path, pm.Version, "zip")
+	if err != nil {
+		return notExistErrorf("%w", err)
+	}
+	content, err := g.cache(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	got, err := g.computeZipHash(content)
+	if err != nil {
+		return err
+	}
+	if got != zipHash {
+		return fmt.Errorf("%w: %s: got %s, want %s", ErrZipHashMismatch, name, got, zipHash)
+	}
+	return nil
+}
+
+// readGoModRequirements returns the module versions required by the go.mod
+// file at the name, with its replace directives with module versions applied.
+func readGoModRequirements(name string) ([]module.Version, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := modfile.Parse(name, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	replaced := map[module.Version]module.Version{}
+	for _, r := range f.Replace {
+		replaced[r.Old] = r.New
+	}
+	var modules []module.Version
+	for _, r := range f.Require {
+		mod := r.Mod
+		if r, ok := replaced[mod]; ok {
+			mod = r
+		} else if r, ok := replaced[module.Version{Path: mod.Path}]; ok {
+			mod = r
+		}
+		if mod.Version == "" {
+			continue // Replaced by a local directory.
+		}
+		modules = append(modules, mod)
+	}
+	return modules, nil
+}
+
+// goSumEntry is an entry of a go.sum file.
+type goSumEntry struct {
+	mod  module.Version
+	hash string
+}
+
+// readGoSum returns the entries of the go.sum file at the name.
+func readGoSum(name string) ([]goSumEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []goSumEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: invalid line", name, i+1)
+		}
+		entries = append(entries, goSumEntry{mod: module.Version{Path: fields[0], Version: fields[1]}, hash: fields[2]})
+	}
+	return entries, nil
+}
+
+// cutGoModSuffix returns the version without the "/go.mod" suffix of the
+// version of a go.sum entry, and reports whether the suffix was found.
+func cutGoModSuffix(version string) (string, bool) {
+	if !strings.HasSuffix(version, "/go.mod") {
+		return version, false
+	}
+	return strings.TrimSuffix(version, "/go.mod"), true
+}
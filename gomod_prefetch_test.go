@@ -0,0 +1,157 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoproxyPrefetchFromGoMod(t *testing.T) {
+	zips := map[string][]byte{}
+	for _, mv := range []string{"example.com/foo@v1.0.0", "example.com/baz@v1.2.0", "example.com/qux@v0.1.0"} {
+		path, _, _ := strings.Cut(mv, "@")
+		zip, err := makeZip(map[string][]byte{mv + "/go.mod": []byte("module " + path)})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		zips[mv] = zip
+	}
+	dir := t.TempDir()
+	goModPath := filepath.Join(dir, "go.mod")
+	if err := os.WriteFile(goModPath, []byte(`module example.com/main
+
+go 1.18
+
+require (
+	example.com/bar v1.1.0
+	example.com/foo v1.0.0
+	example.com/local v1.0.0
+	example.com/missing v1.0.0 // indirect
+)
+
+replace example.com/bar v1.1.0 => example.com/baz v1.2.0
+
+replace example.com/local => ./local
+`), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	goSumPath := filepath.Join(dir, "go.sum")
+	if err := os.WriteFile(goSumPath, []byte(strings.Join([]string{
+		"example.com/baz v1.2.0 h1:mismatched=",
+		"example.com/baz v1.2.0/go.mod h1:ignored=",
+		"example.com/foo v1.0.0 " + mustHashZip(t, zips["example.com/foo@v1.0.0"]),
+		"example.com/foo v1.0.0/go.mod h1:ignored=",
+		"example.com/qux v0.1.0/go.mod h1:ignored=",
+		"",
+	}, "\n")), 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dc := &DirCacher{Dir: t.TempDir()}
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				zipContent, ok := zips[path+"@"+version]
+				if !ok {
+					return nil, nil, nil, notExistErrorf("%s@%s: unknown module", path, version)
+				}
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zipContent)), nil
+			},
+		},
+		Cacher:      dc,
+		TempDir:     t.TempDir(),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	report, err := g.PrefetchFromGoMod(context.Background(), goModPath, goSumPath)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for i, tt := range []struct {
+		n           int
+		wantPath    string
+		wantVersion string
+		wantModOnly bool
+		wantErr     error
+	}{
+		{1, "example.com/baz", "v1.2.0", false, errors.New("zip hash mismatch: example.com/baz/@v/v1.2.0.zip: got " + mustHashZip(t, zips["example.com/baz@v1.2.0"]) + ", want h1:mismatched=")},
+		{2, "example.com/foo", "v1.0.0", false, nil},
+		{3, "example.com/missing", "v1.0.0", false, errors.New("example.com/missing@v1.0.0: unknown module")},
+		{4, "example.com/qux", "v0.1.0", true, nil},
+	} {
+		if i >= len(report.Modules) {
+			t.Fatalf("test(%d): got %d modules, want more", tt.n, len(report.Modules))
+		}
+		pm := report.Modules[i]
+		if got, want := pm.Path, tt.wantPath; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := pm.Version, tt.wantVersion; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := pm.ModOnly, tt.wantModOnly; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+		if tt.wantErr != nil {
+			if pm.Err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := pm.Err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if pm.Err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, pm.Err)
+		}
+	}
+	if got, want := len(report.Modules), 4; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if !errors.Is(report.Modules[0].Err, ErrZipHashMismatch) {
+		t.Errorf("got %q, want an error that matches %q", report.Modules[0].Err, ErrZipHashMismatch)
+	}
+	for _, tt := range []struct {
+		n            int
+		name         string
+		wantNotExist bool
+	}{
+		{1, "example.com/foo/@v/v1.0.0.zip", false},
+		{2, "example.com/qux/@v/v0.1.0.mod", false},
+		{3, "example.com/local/@v/v1.0.0.zip", true},
+		{4, "example.com/bar/@v/v1.1.0.zip", true},
+	} {
+		rc, err := dc.Get(context.Background(), tt.name)
+		if err == nil {
+			rc.Close()
+		}
+		if got, want := errors.Is(err, fs.ErrNotExist), tt.wantNotExist; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		n         int
+		goModPath string
+		goSumPath string
+		goSum     string
+		wantErr   string
+	}{
+		{1, filepath.Join(dir, "nonexistent"), "", "", "no such file or directory"},
+		{2, goModPath, filepath.Join(dir, "invalid.sum"), "example.com/foo v1.0.0\n", "invalid.sum:1: invalid line"},
+	} {
+		if tt.goSum != "" {
+			if err := os.WriteFile(tt.goSumPath, []byte(tt.goSum), 0o644); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		if _, err := g.PrefetchFromGoMod(context.Background(), tt.goModPath, tt.goSumPath); err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		} else if got, want := err.Error(), tt.wantErr; !strings.Contains(got, want) {
+			t.Errorf("test(%d): got %q, want an error that contains %q", tt.n, got, want)
+		}
+	}
+}
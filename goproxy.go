@@ -4,21 +4,31 @@ Package goproxy implements a minimalist Go module proxy handler.
 package goproxy
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
 )
 
 // tempDirPattern is the pattern for creating temporary directories.
@@ -30,6 +40,20 @@ const tempDirPattern = "goproxy.tmp.*"
 // bulk static analysis), Goproxy supports a non-standard header,
 // "Disable-Module-Fetch: true", which instructs it to return only cached
 // content.
+//
+// Goproxy serves exactly the endpoints of the GOPROXY protocol for each module
+// path: "/@latest", "/@v/list", and "/@v/<version>.info", ".mod", and ".zip"
+// (and ".ziphash" if ServeZipHashes is true). Any other path under a module
+// path results in a 404 response. The "upgrade" and "patch" version queries,
+// which the go command resolves itself, result in a 400 response, and so does
+// "/@v/latest.info". Query strings are ignored, as the go command never sends
+// them.
+//
+// Cache files can be imported in bulk (see [Cacher.Sync]) by POST requests to
+// any path other than the module and checksum database endpoints (e.g., "/"
+// and "/upload"). OPTIONS requests to them advertise the supported compress
+// types of bundles (see [SupportedSyncCompressions]) in the
+// "X-Goproxy-Sync-Compressions" response header.
 type Goproxy struct {
 	// Fetcher is used to fetch module files.
 	//
@@ -40,6 +64,146 @@ type Goproxy struct {
 	// body.
 	Fetcher Fetcher
 
+	// RewritePath maps the module paths to fetch to the ones that the
+	// Fetcher actually fetches, which allows serving modules under vanity
+	// paths (e.g., "go.corp/foo") while fetching them from their real paths
+	// (e.g., "github.com/corp/foo-internal"). Requests and caches keep the
+	// original paths. The module directives of the fetched .mod files and
+	// the go.mod files in the fetched .zip files, as well as the file paths
+	// in the fetched .zip files, are rewritten to declare the original
+	// paths. If RewritePath returns an error, the fetch fails with it.
+	//
+	// Note that the rewritten module files no longer match the checksums of
+	// the real module paths, so the original paths should not be verified
+	// against a public checksum database (see GONOSUMDB).
+	//
+	// If RewritePath is nil, module paths are not rewritten.
+	RewritePath func(path string) (string, error)
+
+	// ShadowFetcher is a secondary Fetcher, such as a candidate upstream
+	// GOPROXY to switch to, that a sample of the module versions downloaded
+	// by the Fetcher (see ShadowSampleRate) are downloaded from again in
+	// the background, so that discrepancies between the two can be found
+	// before switching. The .mod and .zip files downloaded by both are
+	// compared by their SHA-256 hashes, and those that differ, as well as
+	// the failures of the ShadowFetcher, are reported to the
+	// OnShadowMismatch. The .info files are not compared, as they may
+	// legitimately differ (e.g., in their Origin fields). Note that a .zip
+	// file repacked by an upstream differs from the original one even if
+	// their files do not.
+	//
+	// Shadow fetches never affect or delay the responses, and are never
+	// cached. The downloaded .mod and .zip files are kept until they are
+	// hashed in the background, and shadow fetches count toward the
+	// MaxConcurrentFetches, beyond which downloads are not shadowed. Module
+	// paths are rewritten by the RewritePath for the ShadowFetcher as well.
+	//
+	// If ShadowFetcher is nil, no shadow fetches are made.
+	ShadowFetcher Fetcher
+
+	// ShadowSampleRate is the fraction of the downloads by the Fetcher that
+	// are shadowed by the ShadowFetcher, in the range (0, 1].
+	//
+	// If ShadowSampleRate is zero or negative, no downloads are shadowed.
+	ShadowSampleRate float64
+
+	// OnShadowMismatch is called in the background with each discrepancy
+	// found by a shadow fetch (see ShadowFetcher).
+	//
+	// If OnShadowMismatch is nil, discrepancies are logged to the
+	// ErrorLogger.
+	OnShadowMismatch func(m ShadowMismatch)
+
+	// IntegrityCheckSampleRate is the fraction of the cache hits of .mod
+	// and .zip files, in the range (0, 1], that trigger an integrity check.
+	// An integrity check downloads the module version from the Fetcher
+	// again in the background, and reports the cached .mod and .zip files
+	// that differ from the downloaded ones to the OnIntegrityMismatch.
+	//
+	// Integrity checks never affect the responses or the caches, so that a
+	// compromised or misbehaving upstream cannot replace cached module
+	// files. Failures to download from the Fetcher are logged to the
+	// ErrorLogger.
+	//
+	// If IntegrityCheckSampleRate is zero or negative, no integrity checks
+	// are made.
+	IntegrityCheckSampleRate float64
+
+	// OnIntegrityMismatch is called in the background with each divergence
+	// found by an integrity check (see IntegrityCheckSampleRate).
+	//
+	// If OnIntegrityMismatch is nil, divergences are logged to the
+	// ErrorLogger.
+	OnIntegrityMismatch func(m IntegrityMismatch)
+
+	// MaxConcurrentFetches is the maximum number of concurrent upstream
+	// fetches. It bounds all network fetches made through the Fetcher (no
+	// matter whether they go to a GOPROXY or directly to a version control
+	// system), as well as checksum database proxying, regardless of how
+	// many requests arrive. Requests served from the Cacher do not count
+	// toward the limit. When the limit is reached, further fetches wait
+	// until a slot is freed or their request contexts are done.
+	//
+	// Unlike [GoFetcher.MaxDirectFetches], which bounds only direct fetches
+	// made by a single [GoFetcher], MaxConcurrentFetches works with any
+	// Fetcher.
+	//
+	// If MaxConcurrentFetches is zero, there is no limit.
+	MaxConcurrentFetches int
+
+	// MaxCoalescedWait is the maximum time that a request waits for an
+	// in-flight fetch of the same content started by another request (see
+	// [Goproxy.GetOrFetch]). A request that would wait longer is responded
+	// with status 503 and a "Retry-After: 1" header instead of holding its
+	// connection until the fetch completes, which sheds load when a popular
+	// module version is fetched for the first time. The in-flight fetch is
+	// not interrupted, and its result is cached for the retries as usual.
+	//
+	// Note that the go command reports a 503 as an error without falling
+	// back to the next proxy in GOPROXY, unlike a 404 or 410, so that the
+	// module version is never mistaken for a nonexistent one. Clients
+	// should retry the failed command.
+	//
+	// If MaxCoalescedWait is zero, requests wait until the in-flight fetch
+	// completes or their request contexts are done.
+	MaxCoalescedWait time.Duration
+
+	// RequestRate is the maximum number of requests per second handled by
+	// [Goproxy.ServeHTTP], averaged over time with bursts of up to
+	// RequestBurst requests, so that a misbehaving client or a spike of
+	// traffic cannot overload the proxy. Requests beyond the limit are
+	// responded with status 429 and a "Retry-After" header of the whole
+	// seconds until the limit allows another request, plus a random jitter
+	// of up to a second so that rejected clients do not all retry at the
+	// same time. Rejected requests do not count toward the limit.
+	//
+	// If RequestRate is zero or negative, there is no limit.
+	RequestRate float64
+
+	// RequestBurst is the maximum number of requests that can be handled at
+	// once beyond the RequestRate, after a period of fewer requests.
+	//
+	// If RequestBurst is zero or negative, the RequestRate rounded up to a
+	// whole number is used.
+	RequestBurst int
+
+	// MaxConcurrentRequests is the maximum number of requests handled by
+	// [Goproxy.ServeHTTP] at once, including the ones served from the
+	// Cacher, so that a spike of traffic cannot exhaust the memory of the
+	// process. Requests beyond the limit are shed rather than queued: they
+	// are responded with status 503 and a "Retry-After" header of a second
+	// plus a random jitter of up to a second, rounded up to whole seconds,
+	// so that shed clients do not all retry at the same time.
+	//
+	// The landing page (GET and HEAD requests to "/") is exempt from the
+	// limit so that it can keep serving as a health check under load. The
+	// handlers returned by [Goproxy.MetricsHandler] and
+	// [Goproxy.AdminHandler] are independent of ServeHTTP and never
+	// limited.
+	//
+	// If MaxConcurrentRequests is zero or negative, there is no limit.
+	MaxConcurrentRequests int
+
 	// ProxiedSumDBs is a list of proxied checksum databases (see
 	// https://go.dev/design/25530-sumdb#proxying-a-checksum-database). Each
 	// entry is in the form "<sumdb-name>" or "<sumdb-name> <sumdb-URL>".
@@ -50,6 +214,12 @@ type Goproxy struct {
 	// If ProxiedSumDBs contains duplicate checksum database names, only the
 	// last value in the slice for each duplicate checksum database name is
 	// used.
+	//
+	// Responses of proxied checksum databases are cached to the Cacher
+	// under names in the form "sumdb/<sumdb-name>/<path>", the same as the
+	// go command uses in its module cache. Tile and lookup responses are
+	// served from the Cacher when cached, while latest responses are always
+	// fetched and only served from the Cacher when fetching fails.
 	ProxiedSumDBs []string
 
 	// Cacher is used to cache module files.
@@ -57,32 +227,773 @@ type Goproxy struct {
 	// If Cacher is nil, caching is disabled.
 	Cacher Cacher
 
+	// NameResolver maps the logical name of each cache that is got from or
+	// put to the Cacher while serving requests to its physical key in the
+	// Cacher. Combined with a Cacher shared by several Goproxy instances
+	// (e.g., one per environment), it allows them to share most caches
+	// while keeping their own versions of some (e.g., by redirecting the
+	// names of pinned modules to per-instance namespaces, such as
+	// "staging/" + name).
+	//
+	// The names are the same as the ones given to the Cacher, so the module
+	// paths and versions in them are escaped (see [module.EscapePath] and
+	// [module.EscapeVersion]). Names to match against should therefore be
+	// escaped in the same way, and the returned keys must be valid names
+	// for the Cacher. NameResolver applies only to the Cacher, not to the
+	// FallbackCacher. Operations that list or import the Cacher as a whole
+	// (e.g., [Goproxy.Export], [Goproxy.CachedVersions], the scrubber, the
+	// admin API, and uploads) work with the physical keys as is.
+	//
+	// If NameResolver is nil, the logical names are used as the physical
+	// keys.
+	NameResolver func(ctx context.Context, name string) string
+
+	// FallbackCacher is used to cache module files when putting them to the
+	// Cacher fails (e.g., because its volume is momentarily full or
+	// read-only), so that the requests for them still succeed rather than
+	// discarding what has just been fetched. Caches in FallbackCacher are
+	// served when they are missing from the Cacher, and are put to the
+	// Cacher again in the background every FallbackFlushInterval until it
+	// succeeds, after which they are deleted from FallbackCacher if it
+	// implements [Deleter], or until [Goproxy.Close] is called. A small local
+	// disk (e.g., a [DirCacher]) is a good choice.
+	//
+	// The caches waiting to be flushed are tracked in memory, so those left
+	// in a persistent FallbackCacher by a previous run are still served but
+	// no longer flushed. FallbackCacher has no effect if Cacher is nil.
+	//
+	// If FallbackCacher is nil, failures in putting caches to the Cacher
+	// fail the requests.
+	FallbackCacher Cacher
+
+	// FallbackFlushInterval is how often the caches in FallbackCacher are
+	// flushed to the Cacher. It is read only once, when the Goproxy is first
+	// used.
+	//
+	// If FallbackFlushInterval is zero, 1 minute is used.
+	FallbackFlushInterval time.Duration
+
+	// BypassUnavailableCacher indicates whether to serve requests straight
+	// from the Fetcher when the Cacher fails to get a cache with an error
+	// other than [fs.ErrNotExist], or fails to put a cache (e.g., when a
+	// network store is down), instead of failing them. Once the Cacher has
+	// failed in this way for a request, the rest of the request is served
+	// as if nothing was cached, and nothing fetched for it is put to the
+	// Cacher. Each degraded request is logged to the ErrorLogger.
+	//
+	// Note that the Cacher being bypassed can go unnoticed, as requests
+	// keep succeeding without being cached, so the ErrorLogger should be
+	// monitored when BypassUnavailableCacher is true.
+	BypassUnavailableCacher bool
+
 	// TempDir is the directory for storing temporary files.
 	//
 	// If TempDir is empty, [os.TempDir] is used.
 	TempDir string
 
+	// MaxMemoryBufferSize is the maximum number of bytes of a cache that is
+	// buffered in memory when it must be read again but the content
+	// returned by the Cacher is not seekable (e.g., when exporting caches
+	// or putting revalidated caches back to the Cacher). Larger caches are
+	// spilled to temporary files in TempDir instead, so that the memory
+	// used does not grow with the sizes of the caches.
+	//
+	// If MaxMemoryBufferSize is zero, 32 MiB is used. If it is negative,
+	// such caches are always buffered in temporary files.
+	MaxMemoryBufferSize int64
+
 	// Transport is used to execute outgoing requests.
 	//
-	// If Transport is nil, [http.DefaultTransport] is used.
+	// If Transport is nil, [http.DefaultTransport] is used, tuned by the
+	// TransportOptions.
 	Transport http.RoundTripper
 
+	// TransportOptions tunes the connection pool of the transport used when
+	// Transport is nil, including by the default Fetcher. It is ignored if
+	// Transport is not nil.
+	TransportOptions TransportOptions
+
+	// Backoff is the strategy for the delays between the attempts of the
+	// outgoing requests to proxied checksum databases (see ProxiedSumDBs)
+	// that are retried after failing with temporary errors. It is also
+	// used as the [GoFetcher.Backoff] of the default Fetcher.
+	//
+	// If Backoff is nil, the zero [ExponentialBackoff] is used.
+	Backoff Backoff
+
 	// ErrorLogger is used to log errors that occur during proxying.
 	//
 	// If ErrorLogger is nil, [log.Default] is used.
 	ErrorLogger *log.Logger
 
-	initOnce      sync.Once
-	fetcher       Fetcher
-	proxiedSumDBs map[string]*url.URL
-	httpClient    *http.Client
+	// ErrorResponder is used to render all error responses (e.g., to emit
+	// them in a structured format such as JSON). When it is called, the
+	// Cache-Control header has already been set. The status is the status
+	// code of the response, and the err describes the error. The message of
+	// the err is the plain-text body that would otherwise be responded, and
+	// the err wraps the underlying error if there is one, so that, for
+	// example, errors.Is(err, fs.ErrNotExist) works as expected.
+	//
+	// Note that the go command expects the plain-text error responses of
+	// the GOPROXY protocol, so a custom ErrorResponder should only be used
+	// for clients that understand its format.
+	//
+	// If ErrorResponder is nil, errors are responded in plain text.
+	ErrorResponder func(rw http.ResponseWriter, req *http.Request, status int, err error)
+
+	// Tracer is used to trace requests, cache operations, and fetches (see
+	// [Tracer] for the spans that are started).
+	//
+	// If Tracer is nil, nothing is traced.
+	Tracer Tracer
+
+	// MetricsHooks is the hooks that are called to report metrics (see
+	// [MetricsHooks] for the events that are reported).
+	MetricsHooks MetricsHooks
+
+	// Metrics indicates whether to collect the built-in metrics of
+	// requests, fetches, and caches, which are served by
+	// [Goproxy.MetricsHandler] in the Prometheus text exposition format.
+	Metrics bool
+
+	// OnCacheMiss is called with the [RequestInfo] of each request for a
+	// module file that is not served from the Cacher, before anything is
+	// fetched for it, so it is called regardless of the outcome of the
+	// fetch. This includes requests for caches that do not exist and, for
+	// the "list" and "query" operations, requests for caches that are older
+	// than the MutableCacheTTL, for which [RequestInfo.Stale] is true (and
+	// [RequestInfo.IfModifiedSince] is not zero if the refresh will be a
+	// conditional fetch). The "list" and "query" operations are only
+	// considered when the MutableCacheTTL is not zero, since they are
+	// otherwise never served from the Cacher unless fetching fails.
+	//
+	// OnCacheMiss is called synchronously while serving the request, so it
+	// should return quickly (e.g., by handing the info off to a goroutine
+	// that posts it to a webhook). It must be safe for concurrent use.
+	//
+	// If OnCacheMiss is nil, cache misses are not reported.
+	OnCacheMiss func(info RequestInfo)
+
+	// SyncOptions is the options for importing uploaded cache files in bulk
+	// (see [Cacher.Sync]).
+	SyncOptions SyncOptions
+
+	// MaxSyncBodySize is the maximum size in bytes of the request bodies of
+	// cache files uploaded in bulk. Requests with larger bodies are
+	// responded with status 413 before anything is imported, so a client
+	// cannot fill the disk or memory by streaming an unbounded body. The
+	// limit applies to the bodies as uploaded (i.e., compressed), while the
+	// [SyncOptions.MaxDecompressionRatio] and the
+	// [SyncOptions.MaxDecompressedBytes] bound what they decompress to.
+	//
+	// If MaxSyncBodySize is zero, 1 GiB is used. If MaxSyncBodySize is
+	// negative, there is no limit.
+	MaxSyncBodySize int64
+
+	// ListOptions is the options for the version lists served at the
+	// /@v/list endpoint. See [ListOptions] for details.
+	ListOptions ListOptions
+
+	// CanonicalizeVersions indicates whether to serve module files requested
+	// with versions that differ from canonical ones only in build metadata
+	// (e.g., "v1.2.3+meta" for "v1.2.3") as if they were requested with the
+	// canonical versions, so that equivalent versions share the same caches
+	// instead of missing them. The "+incompatible" suffix is kept, as it is
+	// part of the canonical version, and shorter forms (e.g., "v1.2") are
+	// left as they are, since they are queries for the latest matching
+	// versions rather than equivalent versions. The content served is that
+	// of the canonical version, byte for byte (e.g., the .info file reports
+	// the canonical version).
+	//
+	// If CanonicalizeVersions is false, such versions are treated as version
+	// queries for .info files and rejected for other module files.
+	CanonicalizeVersions bool
+
+	// ValidateModFiles indicates whether to validate fetched .mod files before
+	// caching them. If ValidateModFiles is true, each fetched .mod file must
+	// parse as a go.mod file (see [modfile.ParseLax]) and its module
+	// directive must match the requested module path. Otherwise, the module
+	// version is neither cached nor served, and an error that matches
+	// [fs.ErrNotExist] is returned instead. This prevents malformed .mod
+	// files (such as HTML error pages) from a flaky upstream from
+	// poisoning the Cacher.
+	ValidateModFiles bool
+
+	// ValidateInfoFiles indicates whether to validate fetched .info files,
+	// including those for the "/@latest" and "/@v/<query>.info" endpoints,
+	// before caching them. If ValidateInfoFiles is true, each fetched .info
+	// file must be a JSON object whose Version field is a canonical
+	// semantic version and whose Time field, if any, is an RFC 3339 time.
+	// Otherwise, it is neither cached nor served, and the request fails as
+	// one to a bad upstream, which is never remembered by the
+	// NegativeCacheTTL, so that the client can retry. This prevents a
+	// malformed .info file from a flaky upstream from persistently breaking
+	// the resolution of version queries such as "go get
+	// example.com/foo@latest".
+	ValidateInfoFiles bool
+
+	// NormalizeGoMod indicates whether to serve .mod files normalized for
+	// read and analysis tooling: formatted canonically as by "go mod edit
+	// -fmt", with the requirements of each module collapsed into its
+	// highest version and duplicate exclusions removed. Only the served
+	// .mod files are normalized. The cached ones are always byte-exact.
+	// Range requests for .mod files are served in full. A .mod file that
+	// does not parse is served as it is.
+	//
+	// WARNING: Normalized .mod files no longer match their hashes recorded
+	// in go.sum files and checksum databases, so the go command fails to
+	// verify them (with "SECURITY ERROR"). NEVER enable NormalizeGoMod for
+	// a proxy used by "go build" or any other go command. Use it only for a
+	// separate proxy dedicated to tooling that reads .mod files.
+	NormalizeGoMod bool
+
+	// SniffModuleFiles indicates whether to check the leading bytes of
+	// fetched module files before caching them, so that an error page
+	// served with status 200 by a misconfigured upstream (e.g., the HTML
+	// login page of a captive portal) is not cached in place of a module
+	// file. If SniffModuleFiles is true, each fetched .info file must start
+	// with a JSON object, each .mod file must not start with "<" (as HTML
+	// does), and each .zip file must start with a zip header. Otherwise,
+	// the module version is neither cached nor served, and an error that
+	// matches [fs.ErrNotExist] is returned instead. Unlike
+	// ValidateModFiles, it reads only the first few bytes of each file.
+	SniffModuleFiles bool
+
+	// ServeCachedOnMalformedUpstream indicates whether to use the cached
+	// copies of the fetched module files rejected by SniffModuleFiles,
+	// ValidateModFiles, or ValidateInfoFiles instead of failing. A module
+	// version is fetched as a whole even if only some of its files are
+	// missing from the Cacher, so a briefly misbehaving upstream would
+	// otherwise fail requests for the missing files of module versions that
+	// are partly cached. Each rejected module file is logged to the
+	// ErrorLogger along with the reason. Rejected module files without
+	// cached copies fail as usual.
+	//
+	// If ServeCachedOnMalformedUpstream is false, rejected module files
+	// always fail, so that upstream anomalies are never masked.
+	ServeCachedOnMalformedUpstream bool
+
+	// WarnRetractedVersions indicates whether to check the module files of
+	// canonical versions against the "retract" directives in the go.mod file
+	// of the latest version of their modules, as the go command does. If
+	// WarnRetractedVersions is true, successful responses for retracted
+	// versions include an "X-Goproxy-Retracted" header whose value is the
+	// rationale of the retraction, or "retracted" if there is none.
+	//
+	// The retractions of each module are cached in memory for 10 minutes.
+	// Checking them requires listing the versions of the module and fetching
+	// (and caching) its latest version, so they are not checked for requests
+	// with the Disable-Module-Fetch header, and any failure to check them is
+	// logged rather than failing the request.
+	WarnRetractedVersions bool
+
+	// RejectRetractedVersions is like WarnRetractedVersions, but responds
+	// "gone" (410) to requests for the module files of retracted versions
+	// instead of serving them.
+	//
+	// Note that this intentionally breaks builds that depend on retracted
+	// versions, and that the go command treats 410 like 404, so it falls
+	// back to the next proxy in its GOPROXY, if any.
+	RejectRetractedVersions bool
+
+	// TreatEmptyCachesAsMisses indicates whether zero-byte caches that can
+	// never be valid (i.e., .info files, .mod files, and @latest responses)
+	// are treated as not found, so that they are fetched again instead of
+	// being served. Such caches usually result from crashes during caching.
+	// Caches that can legitimately be empty, such as @v/list responses, are
+	// not affected.
+	//
+	// The size of a cache is determined only if the [io.ReadCloser] returned
+	// by the Cacher implements [Sizer] or [io.Seeker].
+	TreatEmptyCachesAsMisses bool
+
+	// CompletionMarkers indicates whether a module version is considered
+	// cached only if its completion marker, an empty
+	// "<module>/@v/<version>.ready" cache, exists. The marker is put after
+	// all the module files of the version have been cached, and is checked
+	// before serving any of its .info, .mod, and .zip files from the Cacher.
+	// A module version that lacks the marker is fetched and cached again,
+	// which heals module versions that were cached only partially, such as
+	// by interrupted imports.
+	//
+	// Note that enabling CompletionMarkers for existing caches without
+	// markers causes all their module versions to be fetched again once.
+	CompletionMarkers bool
+
+	// ImmutableVersions indicates whether to treat the cached .info, .mod,
+	// and .zip files of module versions as immutable, which they are by
+	// definition. When the module files of a module version are fetched
+	// because some of them are not cached (e.g., only its .zip file is
+	// cached and its .info file is requested), the ones that are already
+	// cached are kept as they are instead of being put to the Cacher
+	// again, which saves rewriting large .zip files. As a result, corrupt
+	// module files are not healed by fetching again (see
+	// [Goproxy.StartScrubber] for detecting them).
+	//
+	// Mutable caches such as the @v/list and @latest ones are never
+	// affected.
+	ImmutableVersions bool
+
+	// ServeWhileCaching indicates whether to serve a module file that has
+	// just been downloaded concurrently with caching it to the Cacher,
+	// rather than after it has been cached. This lowers the time to first
+	// byte for large module zip files, especially with a Cacher that
+	// uploads to a remote store.
+	//
+	// Module files are still fully downloaded (and verified) by the Fetcher
+	// before being served. Concurrent requests for the module files of the
+	// same module version share a single download (see
+	// [Goproxy.GetOrFetch]), whose caching is aborted if all of their clients
+	// go away before their responses complete, in which case the Cacher is
+	// expected to discard the partially written cache. Failures in caching
+	// are logged, but do not affect the responses.
+	//
+	// Concurrent serving requires the module files returned by the Fetcher
+	// to implement [io.ReaderAt], as the files returned by [GoFetcher] do.
+	// Otherwise, they are served after being cached.
+	ServeWhileCaching bool
+
+	// RedirectUpstream is the policy for redirecting requests for module
+	// zip files straight to an upstream, rather than fetching and caching
+	// the zip files, so that the bandwidth of huge or rarely reused modules
+	// is offloaded to the upstream. It is called with the module path, the
+	// version, and the operation (currently always "download") of each
+	// request for a .zip file. If it returns a URL and true, the request is
+	// responded with a 302 redirect to the URL, even if the zip file has
+	// been cached.
+	//
+	// The URL usually points to the same file on an upstream proxy (e.g.,
+	// "https://proxy.golang.org/<escaped module path>/@v/<escaped
+	// version>.zip"). Only .zip files can be redirected, since the go
+	// command verifies them against the checksum database anyway, while the
+	// .info and .mod files are always served. PrefetchModuleFiles
+	// does not prefetch redirected zip files, but computing their .ziphash
+	// files (see ServeZipHashes) still fetches them. Requests for cached
+	// files only are never redirected.
+	//
+	// If RedirectUpstream is nil, no requests are redirected.
+	RedirectUpstream func(modulePath, version, op string) (string, bool)
+
+	// PrefetchModuleFiles indicates whether to prefetch the module files of a
+	// module version into the Cacher in the background when its .info or
+	// .mod file is served from the Cacher but its .zip file is not cached, as
+	// the go command usually requests the .info, .mod, and .zip files in
+	// quick succession. On a cache miss, the three files are always fetched
+	// and cached together, so prefetching is not needed then.
+	//
+	// Prefetching lowers the latency of the following requests, but it may
+	// fetch and cache module zip files that are never requested (e.g., by
+	// "go list -m" or "go mod graph", which only need .info or .mod files),
+	// costing extra upstream traffic and cache space. Failures in
+	// prefetching are logged.
+	PrefetchModuleFiles bool
+
+	// MutableCacheTTL is how long cached responses that can change over
+	// time (i.e., @latest responses, @v/list responses, and .info responses
+	// for version queries such as branch names) are served from the Cacher
+	// without being refreshed. Once a cache is older than MutableCacheTTL,
+	// it is treated as a miss and refreshed from the Fetcher, but it is
+	// still served if the refresh fails, unless it is older than
+	// MaxStaleAge. Module files of canonical versions are immutable, so
+	// their caches never expire.
+	//
+	// The age of a cache is determined by the modification time reported
+	// by the [io.ReadCloser] returned by the Cacher (see [Cacher.Get]). A
+	// cache whose modification time is unknown is always refreshed.
+	//
+	// If MutableCacheTTL is zero, such responses are always refreshed from
+	// the Fetcher, and their caches are served only if the refresh fails.
+	MutableCacheTTL time.Duration
+
+	// RevalidateMutableCaches indicates whether to revalidate caches older
+	// than [Goproxy.MutableCacheTTL] with conditional requests, rather
+	// than refetching them unconditionally. If RevalidateMutableCaches is
+	// true, the modification time of such a cache is set as the
+	// [RequestInfo.IfModifiedSince] of the refresh. If the Fetcher then
+	// returns [ErrNotModified], the cache is served and put to the Cacher
+	// again, so that its age is reset. [GoFetcher] supports this by sending
+	// If-Modified-Since headers to the proxies from GOPROXY.
+	//
+	// RevalidateMutableCaches has no effect if MutableCacheTTL is zero.
+	RevalidateMutableCaches bool
+
+	// MutableCacheSoftTTL is how long cached responses that can change over
+	// time (see MutableCacheTTL) are served from the Cacher before they are
+	// refreshed in the background. Once a cache is older than
+	// MutableCacheSoftTTL, it is still served immediately, but a refresh
+	// from the Fetcher is started in the background, so that subsequent
+	// requests get the refreshed cache. Concurrent refreshes of the same
+	// cache are coalesced into one, along with any fetches of it, and
+	// failures in refreshing are logged. Refreshes count toward the
+	// MaxConcurrentFetches, and those beyond it are skipped until the next
+	// request. Caches older than a non-zero MutableCacheTTL are still
+	// refreshed before being served, so MutableCacheSoftTTL should be less
+	// than MutableCacheTTL. If MutableCacheTTL is zero, caches whose
+	// modification times are known are always served once they exist.
+	//
+	// If MutableCacheSoftTTL is zero, caches are never refreshed in the
+	// background.
+	MutableCacheSoftTTL time.Duration
+
+	// MaxStaleAge is the maximum age of cached responses that can change
+	// over time (see MutableCacheTTL) that are still served stale, either
+	// while being refreshed in the background (see MutableCacheSoftTTL) or
+	// because refreshing them has failed. A cache older than MaxStaleAge is
+	// refreshed before being served, and if the refresh fails, the request
+	// fails with the error of the refresh rather than being served from the
+	// cache, so that ancient data is not served indefinitely while the
+	// upstream is down. Caches whose modification times are unknown are
+	// not limited, and neither are those served to requests with the
+	// Disable-Module-Fetch header.
+	//
+	// If MaxStaleAge is zero, 24 hours is used. If it is negative, stale
+	// caches are served regardless of their age.
+	MaxStaleAge time.Duration
+
+	// ResolutionCacheTTL is how long the responses that can change over
+	// time (see MutableCacheTTL) that have just been fetched are served from
+	// an in-memory cache, which is independent of the Cacher. Such responses
+	// are small but requested very often, so serving them from memory for a
+	// short time (e.g., 1 to 5 minutes) saves the upstream round trips and
+	// the Cacher accesses, even when the Cacher keeps module files forever.
+	//
+	// If ResolutionCacheTTL is zero, the in-memory cache is disabled.
+	ResolutionCacheTTL time.Duration
+
+	// ResolutionCacheMaxEntries is the maximum number of responses kept in
+	// the in-memory cache (see ResolutionCacheTTL), beyond which the least
+	// recently used ones are evicted.
+	//
+	// If ResolutionCacheMaxEntries is zero, 10000 is used.
+	ResolutionCacheMaxEntries int
+
+	// NegativeCacheTTL is how long the definitive not-found results of
+	// fetching module files (e.g., status 404 or 410 from the upstream
+	// GOPROXY) are remembered in memory, so that repeated requests for
+	// module versions that do not exist are responded without fetching
+	// them again. Other errors, including those of bad upstreams and timed
+	// out fetches, are never remembered. Each module version is remembered
+	// as a whole, so a not-found .info file also answers its .mod and .zip
+	// files. Each in-memory cache keeps at most ResolutionCacheMaxEntries
+	// results.
+	//
+	// If NegativeCacheTTL is zero, not-found results of module files are
+	// not remembered.
+	NegativeCacheTTL time.Duration
+
+	// MutableNegativeCacheTTL is like NegativeCacheTTL, but for the results
+	// of version lists and queries (e.g., /@v/list and /@latest), which
+	// turn into found ones as soon as a version is published, so it should
+	// be short. Cached responses in the Cacher are still served as if the
+	// fetch failed.
+	//
+	// If MutableNegativeCacheTTL is zero, the smaller of NegativeCacheTTL
+	// and 10 seconds is used. If it is negative, not-found results of
+	// version lists and queries are not remembered.
+	MutableNegativeCacheTTL time.Duration
+
+	// NotCachedMessage is the message in the body of the "not found" (404)
+	// responses to requests with the Disable-Module-Fetch header (e.g.,
+	// those to an offline mirror) for content that is not cached, in which
+	// every "{module}" is replaced by the requested module path and every
+	// "{version}" by the requested version or version query (e.g.,
+	// "{module}@{version} is not present in the offline mirror; request it
+	// to be added"). The status stays 404 so that the go command still
+	// treats such responses as missing content, but the body tells
+	// developers that the content has not been mirrored rather than that
+	// it does not exist.
+	//
+	// If NotCachedMessage is empty, "temporarily unavailable" is used.
+	NotCachedMessage string
+
+	// PathPrefix is the base path under which the g is mounted (e.g.,
+	// "/goproxy"), for deployments where requests reach the g without the
+	// prefix being stripped. It is stripped from the request path before the
+	// request is handled, and requests whose paths are not under it are
+	// responded with "not found". Leading and trailing slashes are optional.
+	//
+	// If PathPrefix is empty, the g is assumed to be mounted at the root.
+	PathPrefix string
+
+	// LandingPage is the plain text served for GET and HEAD requests to "/"
+	// (relative to the PathPrefix) if DisableUploadPage is true. Browsers and
+	// scanners request "/" constantly, so it is served (like the "204 No
+	// Content" for "/favicon.ico") without being mistaken for a module path,
+	// which would trigger fetch attempts and spam the ErrorLogger.
+	//
+	// If LandingPage is empty, "goproxy" is used.
+	LandingPage string
+
+	// DisableUploadPage indicates whether to serve the LandingPage instead of
+	// the HTML page for uploading cache files in bulk (see [Cacher.Sync]) for
+	// GET and HEAD requests to "/", for deployments that do not accept
+	// uploads from browsers.
+	DisableUploadPage bool
+
+	// AllowedPrefixes is the list of module path patterns that are served,
+	// in the same form as the entries of GOPRIVATE: each pattern is a glob
+	// pattern (see [path.Match]) that matches a module path or any of its
+	// path prefixes (e.g., "github.com/ourorg" or "*.corp.example.com").
+	// Fetch requests and checksum database lookups for modules that match
+	// none of the patterns are responded with "forbidden" (403) before
+	// anything is fetched or read from the Cacher.
+	//
+	// If AllowedPrefixes is empty, all modules are served.
+	AllowedPrefixes []string
+
+	// MaxModulePathLength is the maximum length in bytes of the module
+	// paths in fetch requests. Fetch requests with longer module paths are
+	// responded with "bad request" (400) before anything is fetched or read
+	// from the Cacher.
+	//
+	// If MaxModulePathLength is zero, 1024 is used. If MaxModulePathLength
+	// is negative, there is no limit.
+	MaxModulePathLength int
+
+	// MaxModuleVersionLength is like MaxModulePathLength, but for the
+	// versions and version queries in fetch requests.
+	//
+	// If MaxModuleVersionLength is zero, 256 is used. If
+	// MaxModuleVersionLength is negative, there is no limit.
+	MaxModuleVersionLength int
+
+	// ZipContentDisposition indicates whether to add a
+	// "Content-Disposition: attachment" header to successful module zip file
+	// responses, suggesting a file name in the form
+	// "<module-path>@<version>.zip" (with the slashes in the module path
+	// replaced with underscores). This helps browsers save downloaded module
+	// zip files with meaningful names.
+	ZipContentDisposition bool
+
+	// ServeZipHashes indicates whether to serve the .ziphash files of module
+	// versions (i.e., the "h1:" hashes of their .zip files, as stored in
+	// $GOMODCACHE/cache/download) at the /@v/<version>.ziphash endpoint,
+	// which is not part of the GOPROXY protocol.
+	//
+	// If ServeZipHashes is true, a missing .ziphash file is computed from the
+	// .zip file and cached, either when it is requested or while a cached
+	// .zip file is being served in full, so that caches built from .zip files
+	// alone heal themselves. When computed while serving, the .zip file is
+	// recorded to a temporary file as it is streamed to the client, rather
+	// than being read from the Cacher again.
+	ServeZipHashes bool
+
+	// ZipDigestTrailer indicates whether to send the hex-encoded SHA-256
+	// hash of the body of each response to a .zip file request in an HTTP
+	// trailer named "X-Goproxy-Content-SHA256", computed while the body is
+	// being streamed, so that clients can verify that the whole body has
+	// arrived intact. The trailer is declared up front in the Trailer
+	// header, and the Content-Length header is omitted, since trailers can
+	// only follow a chunked body in HTTP/1.1. The trailer is only sent for
+	// successful responses with a body, including partial ones, for which
+	// it is the hash of the range that has been sent.
+	//
+	// Note that clients that do not read trailers cannot tell the size of
+	// the body in advance when ZipDigestTrailer is true.
+	ZipDigestTrailer bool
+
+	// ImmutableCacheControl is the Cache-Control header of successful
+	// responses for the module files of canonical versions (the
+	// "/@v/<version>.info", "/@v/<version>.mod", "/@v/<version>.zip", and
+	// "/@v/<version>.ziphash" endpoints), whose content never changes (e.g.,
+	// "public, max-age=31536000, immutable" to let a CDN in front of the
+	// Goproxy keep them for a year without revalidating).
+	//
+	// If ImmutableCacheControl is empty, "public, max-age=604800" is used.
+	ImmutableCacheControl string
+
+	// MutableCacheControl is the Cache-Control header of successful
+	// responses for the "/@latest", "/@v/<query>.info", and "/@v/list"
+	// endpoints, whose content changes as new versions are published.
+	//
+	// If MutableCacheControl is empty, "public, max-age=60" is used.
+	MutableCacheControl string
+
+	// DebugHeaders indicates whether to add debugging headers to responses.
+	//
+	// If DebugHeaders is true, successful fetch responses include an
+	// "X-Cache" header whose value is "HIT" if the content was served from
+	// the Cacher, or "MISS" if it was just fetched from the Fetcher. Responses
+	// with content just fetched also include an "X-Goproxy-Upstream" header
+	// whose value is the [RequestInfo.Upstream], if it is known. Failed
+	// fetch responses include an "X-Goproxy-Error" header whose value is
+	// the [ErrorReason] of the failure (e.g., "upstream_timeout"), which is
+	// also appended to the error log.
+	DebugHeaders bool
+
+	// RequestTraces indicates whether to trace the requests that ask for it
+	// with an "X-Goproxy-Trace: 1" header, to explain why a particular
+	// request was slow or failed.
+	//
+	// If RequestTraces is true, the decision path of such a request is
+	// recorded: each cache get and put and each fetch (named as the spans
+	// described in [Tracer]), each attempt of an upstream in the GOPROXY of
+	// a [GoFetcher] ("goproxy.fetch.upstream"), and each retry after a
+	// transient failure ("goproxy.fetch.retry"), with their attributes,
+	// durations, and errors, followed by the upstream the content was
+	// fetched from and the total duration. A request that waits for a fetch
+	// started by another request records the wait instead
+	// ("goproxy.fetch.coalesced"), as the steps of the fetch are recorded by
+	// the request that started it. The trace is sent in the
+	// "X-Goproxy-Trace" response trailer, and is also written to the
+	// ErrorLogger if DebugHeaders is true. As traces expose internals such
+	// as cache names and upstream URLs, it should only be enabled when the
+	// clients are trusted.
+	RequestTraces bool
+
+	// AccessLogWriter is where each request is logged as a line in the
+	// Combined Log Format used by Apache and Nginx, so that existing log
+	// pipelines can ingest it without custom parsers:
+	//
+	//	<remote host> - - [<time>] "<request line>" <status> <bytes> "<referer>" "<user agent>" <cache status>
+	//
+	// The appended cache status is "HIT" if the response content was served
+	// from the Cacher, "MISS" if it was just fetched, or "-" otherwise. The
+	// bytes are "-" if no body was sent. The line is written in a single
+	// call to the Write method of the AccessLogWriter, and calls are
+	// serialized, once the response is complete.
+	//
+	// If AccessLogWriter is nil, requests are not logged.
+	AccessLogWriter io.Writer
+
+	// OnCacheMutation is called with an [AuditEvent] after each successful
+	// mutation of the Cacher made by the Goproxy, including the caches put
+	// when fetching, the caches deleted through the admin handlers or by
+	// the scrubber (see [Goproxy.StartScrubber]), and imports of cache
+	// files in bulk (see [Cacher.Sync]). An import is reported as a single
+	// "sync" event summarizing the imported files, rather than one event
+	// per file. Imports coalesced into an in-progress one (see
+	// [SyncOptions.DedupKey]) are not reported again. As a failed import
+	// may have imported some of the files, it is reported as well, as a
+	// "sync" event with the [AuditEvent.Err]. Cache files evicted through
+	// [Goproxy.Evict] are reported as "delete" events.
+	//
+	// OnCacheMutation is called synchronously, so it should not block. The
+	// caches put to the FallbackCacher are not reported.
+	//
+	// If OnCacheMutation is nil, cache mutations are not reported.
+	OnCacheMutation func(e AuditEvent)
+
+	// RecentlyCachedSize is the maximum number of the most recently cached
+	// module versions remembered for [Goproxy.RecentlyCached], in a ring
+	// buffer that overwrites the oldest ones.
+	//
+	// If RecentlyCachedSize is zero or negative, no module versions are
+	// remembered.
+	RecentlyCachedSize int
+
+	// ReadinessCanary is the module version, in the form
+	// "<module path>@<version>", that [Goproxy.Readiness] fetches and
+	// caches end to end to probe the whole pipeline. It should be a tiny
+	// module version that the Fetcher can always fetch.
+	//
+	// If ReadinessCanary is empty, [Goproxy.Readiness] always reports
+	// ready.
+	ReadinessCanary string
+
+	// ReadinessCacheTTL is how long the report of [Goproxy.Readiness] is
+	// reused before the ReadinessCanary is probed again.
+	//
+	// If ReadinessCacheTTL is zero, 30 seconds is used. If it is negative,
+	// every call probes again.
+	ReadinessCacheTTL time.Duration
+
+	initOnce        sync.Once
+	pathPrefix      string
+	allowedPrefixes string
+	transport       http.RoundTripper
+	baseFetcher     Fetcher
+	fetcher         Fetcher
+	shadowFetcher   Fetcher
+	zipSizer        ZipSizer
+	fetchWorkerPool chan struct{}
+	proxiedSumDBs   map[string]*url.URL
+	httpClient      *http.Client
+	fetchGroup      singleflightGroup
+	backgroundSlots chan struct{}
+	retractionsMu   sync.Mutex
+	retractions     map[string]*moduleRetractions
+	accessLogMutex  sync.Mutex
+	resolutions     *resolutionCache
+	negatives       *resolutionCache
+	mutNegatives    *resolutionCache
+	requestLimiter  *rateLimiter
+	requestSlots    chan struct{}
+	recentlyCached  *recentCaches
+	readinessGroup  singleflightGroup
+	readinessMutex  sync.Mutex
+	readiness       *ReadinessReport
+	fallbackCache   fallbackCache
+	metrics         *metrics
 }
 
 // init initializes the g.
 func (g *Goproxy) init() {
-	g.fetcher = g.Fetcher
-	if g.fetcher == nil {
-		g.fetcher = &GoFetcher{TempDir: g.TempDir, Transport: g.Transport}
+	if pathPrefix := strings.Trim(g.PathPrefix, "/"); pathPrefix != "" {
+		g.pathPrefix = "/" + pathPrefix
+	}
+	g.allowedPrefixes = cleanCommaSeparatedList(strings.Join(g.AllowedPrefixes, ","))
+	maxEntries := g.ResolutionCacheMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	if g.ResolutionCacheTTL > 0 {
+		g.resolutions = newResolutionCache(g.ResolutionCacheTTL, maxEntries)
+	}
+	if g.NegativeCacheTTL > 0 {
+		g.negatives = newResolutionCache(g.NegativeCacheTTL, maxEntries)
+	}
+	mutableNegativeTTL := g.MutableNegativeCacheTTL
+	if mutableNegativeTTL == 0 {
+		mutableNegativeTTL = g.NegativeCacheTTL
+		if mutableNegativeTTL > defaultMaxMutableNegativeCacheTTL {
+			mutableNegativeTTL = defaultMaxMutableNegativeCacheTTL
+		}
+	}
+	if mutableNegativeTTL > 0 {
+		g.mutNegatives = newResolutionCache(mutableNegativeTTL, maxEntries)
+	}
+	if g.RequestRate > 0 {
+		g.requestLimiter = newRateLimiter(g.RequestRate, g.RequestBurst)
+	}
+	if g.MaxConcurrentRequests > 0 {
+		g.requestSlots = make(chan struct{}, g.MaxConcurrentRequests)
+	}
+	if g.RecentlyCachedSize > 0 {
+		g.recentlyCached = newRecentCaches(g.RecentlyCachedSize)
+	}
+	g.fallbackCache.init(g.FallbackFlushInterval)
+
+	g.transport = g.Transport
+	if g.transport == nil && g.TransportOptions != (TransportOptions{}) {
+		g.transport = g.TransportOptions.newTransport()
+	}
+
+	g.baseFetcher = g.Fetcher
+	if g.baseFetcher == nil {
+		g.baseFetcher = &GoFetcher{TempDir: g.TempDir, Transport: g.transport, Backoff: g.Backoff}
+	}
+	g.fetcher = g.baseFetcher
+	g.zipSizer, _ = g.fetcher.(ZipSizer)
+	g.shadowFetcher = g.ShadowFetcher
+	if g.RewritePath != nil {
+		g.fetcher = &rewritingFetcher{Fetcher: g.fetcher, rewrite: g.RewritePath, tempDir: g.TempDir}
+		g.zipSizer = nil // The sizes of rewritten .zip files differ.
+		if g.shadowFetcher != nil {
+			g.shadowFetcher = &rewritingFetcher{Fetcher: g.shadowFetcher, rewrite: g.RewritePath, tempDir: g.TempDir}
+		}
+	}
+	if g.Metrics {
+		g.metrics = newMetrics()
+		g.fetcher = &metricsFetcher{Fetcher: g.fetcher, metrics: g.metrics}
+	}
+	if g.MaxConcurrentFetches > 0 {
+		g.fetchWorkerPool = make(chan struct{}, g.MaxConcurrentFetches)
+		g.fetcher = &limitedFetcher{Fetcher: g.fetcher, workerPool: g.fetchWorkerPool}
+		g.backgroundSlots = make(chan struct{}, g.MaxConcurrentFetches)
+	}
+	if g.Tracer != nil || g.RequestTraces {
+		g.fetcher = &tracedFetcher{Fetcher: g.fetcher, g: g}
 	}
 
 	g.proxiedSumDBs = map[string]*url.URL{}
@@ -103,41 +1014,257 @@ func (g *Goproxy) init() {
 		g.proxiedSumDBs[name] = u
 	}
 
-	g.httpClient = &http.Client{Transport: g.Transport}
+	g.httpClient = &http.Client{Transport: g.transport}
 }
 
 // ServeHTTP implements [http.Handler].
 func (g *Goproxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	g.initOnce.Do(g.init)
+	if g.AccessLogWriter != nil {
+		entry := newAccessLogEntry(rw, req)
+		defer g.writeAccessLog(entry)
+		rw = entry
+		req = req.WithContext(context.WithValue(req.Context(), accessLogKey{}, entry))
+	}
+	if g.metrics != nil {
+		rm := &requestMetrics{}
+		cw := &countingResponseWriter{ResponseWriter: rw}
+		defer func() { g.metrics.observeRequest(rm, cw.statusCode) }()
+		rw = cw
+		req = req.WithContext(context.WithValue(req.Context(), requestMetricsContextKey{}, rm))
+	}
+	if g.ErrorResponder != nil {
+		req = req.WithContext(context.WithValue(req.Context(), errorResponderKey{}, g.ErrorResponder))
+	}
+	if g.DebugHeaders {
+		req = req.WithContext(context.WithValue(req.Context(), debugHeadersKey{}, true))
+	}
+	if g.BypassUnavailableCacher {
+		req = req.WithContext(context.WithValue(req.Context(), cacheBypassKey{}, &cacheBypass{}))
+	}
+	if g.Tracer != nil {
+		ctx, end := g.startSpan(req.Context(), "goproxy.request",
+			TraceAttribute{Key: "http.request.method", Value: req.Method},
+			TraceAttribute{Key: "url.path", Value: req.URL.Path},
+		)
+		defer end(nil)
+		req = req.WithContext(ctx)
+	}
+	if g.RequestTraces {
+		if rt := newRequestTrace(req); rt != nil {
+			rw.Header().Set("Trailer", requestTraceHeader)
+			defer func() {
+				trace := rt.String()
+				rw.Header().Set(requestTraceHeader, trace)
+				if g.DebugHeaders {
+					g.logErrorf("trace: %s %s: %s", req.Method, req.URL.Path, trace)
+				}
+			}()
+			req = req.WithContext(context.WithValue(req.Context(), requestTraceKey{}, rt))
+		}
+	}
+	if g.pathPrefix != "" {
+		var ok bool
+		if req, ok = stripPathPrefix(req, g.pathPrefix); !ok {
+			responseNotFound(rw, req, 86400)
+			return
+		}
+	}
+	if delay := g.requestLimiter.reserve(); delay > 0 {
+		responseTooManyRequests(rw, req, retryAfterSeconds(delay))
+		return
+	}
+	if g.requestSlots != nil && !isLandingPageRequest(req) {
+		select {
+		case g.requestSlots <- struct{}{}:
+			defer func() { <-g.requestSlots }()
+		default:
+			responseServiceUnavailable(rw, req, retryAfterSeconds(time.Second), "too many concurrent requests")
+			return
+		}
+	}
 
-	switch req.Method {
-	case http.MethodPost:
-		g.serveSync(rw, req)
+	methods := allowedMethods(req.URL.Path)
+	switch {
+	case req.Method == http.MethodOptions:
+		rw.Header().Set("Allow", strings.Join(methods, ", "))
+		if containsString(methods, http.MethodPost) {
+			rw.Header().Set("X-Goproxy-Sync-Compressions", strings.Join(SupportedSyncCompressions(), ", "))
+		}
+		setResponseCacheControlHeader(rw, 86400)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	case !containsString(methods, req.Method):
+		rw.Header().Set("Allow", strings.Join(methods, ", "))
+		responseMethodNotAllowed(rw, req, 86400)
+		return
+	case req.Method == http.MethodPost:
+		g.serveSync(rw, withRequestInfo(req, &RequestInfo{Operation: "sync"}))
 		return
-	case http.MethodGet, http.MethodHead:
-		if req.URL.Path == "/" {
+	case req.URL.Path == "/":
+		if !g.DisableUploadPage {
 			g.uploadPage(rw, req)
 			return
 		}
-	default:
-		responseMethodNotAllowed(rw, req, 86400)
+		landingPage := g.LandingPage
+		if landingPage == "" {
+			landingPage = "goproxy"
+		}
+		responseString(rw, req, http.StatusOK, 86400, landingPage)
+		return
+	case req.URL.Path == "/favicon.ico":
+		setResponseCacheControlHeader(rw, 86400)
+		rw.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	path := cleanPath(req.URL.Path)
-	if path != req.URL.Path || path[len(path)-1] == '/' {
-		responseNotFound(rw, req, 86400)
+	path := req.URL.Path
+	if err := checkRequestPath(path); err != nil {
+		responseNotFound(rw, req, 86400, err)
 		return
 	}
 	target := path[1:] // Remove the leading slash.
 
 	if strings.HasPrefix(target, "sumdb/") {
-		g.serveSumDB(rw, req, target)
+		g.serveSumDB(rw, withRequestInfo(req, &RequestInfo{Operation: "sumdb"}), target)
 		return
 	}
 	g.serveFetch(rw, req, target)
 }
 
+// isLandingPageRequest reports whether the req is a GET or HEAD request for
+// the landing page, which is exempt from the [Goproxy.MaxConcurrentRequests].
+func isLandingPageRequest(req *http.Request) bool {
+	return req.URL.Path == "/" && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+}
+
+// allowedMethods returns the HTTP methods allowed for requests to the path,
+// which is relative to the [Goproxy.PathPrefix]. The module endpoints (whose
+// paths contain "/@", which never appears in module paths), the checksum
+// database endpoints, and "/favicon.ico" are read-only, while cache files can
+// be uploaded to any other path (e.g., "/" as the curl examples do, and
+// "/upload" as the upload page does).
+func allowedMethods(path string) []string {
+	if strings.Contains(path, "/@") || strings.HasPrefix(path, "/sumdb/") || path == "/favicon.ico" {
+		return []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	return []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions}
+}
+
+// containsString reports whether the ss contains the s.
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPathPrefix returns a shallow copy of the req with the prefix stripped
+// from its URL path, which always keeps a leading slash. It reports false if
+// the path is not under the prefix.
+func stripPathPrefix(req *http.Request, prefix string) (*http.Request, bool) {
+	p := strings.TrimPrefix(req.URL.Path, prefix)
+	if len(p) == len(req.URL.Path) || (p != "" && p[0] != '/') {
+		return req, false
+	}
+	if p == "" {
+		p = "/"
+	}
+	u := *req.URL
+	u.Path = p
+	if rp := strings.TrimPrefix(u.RawPath, prefix); len(rp) < len(u.RawPath) && rp != "" {
+		u.RawPath = rp
+	} else {
+		u.RawPath = ""
+	}
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.URL = &u
+	return req2, true
+}
+
+// RequestInfo is the information about a request being served by [Goproxy],
+// parsed from its URL.
+type RequestInfo struct {
+	// ModulePath is the unescaped module path. It is set only for the
+	// "list", "query", and "download" operations.
+	ModulePath string
+
+	// Version is the unescaped version query for the "query" operation
+	// (e.g., "latest" for the /@latest endpoint), or the canonical version
+	// for the "download" operation.
+	Version string
+
+	// Operation is the operation of the request. It is one of the
+	// following:
+	//  - "list": the /@v/list endpoint.
+	//  - "query": the /@latest endpoint and the /@v/<query>.info endpoint
+	//    with a non-canonical version.
+	//  - "download": the /@v/<version>.info, /@v/<version>.mod, and
+	//    /@v/<version>.zip endpoints.
+	//  - "sumdb": the checksum database proxy endpoints.
+	//  - "sync": the bulk import of cache files via POST.
+	Operation string
+
+	// Upstream is the upstream that served the last successful fetch for
+	// the request: the URL (with any password redacted) of the proxy from
+	// GOPROXY, or "direct" for a direct fetch. It is set by [GoFetcher], and
+	// other [Fetcher] implementations may set it in the same way. It is
+	// empty if nothing has been fetched, such as when the request is served
+	// from the [Cacher].
+	Upstream string
+
+	// IfModifiedSince is the modification time of the cached response
+	// being revalidated (see [Goproxy.RevalidateMutableCaches]). If it is
+	// not zero, the [Fetcher] may perform a conditional fetch and return
+	// [ErrNotModified] if the response has not been modified since then.
+	IfModifiedSince time.Time
+
+	// Stale indicates whether the cached response exists but is older than
+	// the [Goproxy.MutableCacheTTL], so it is being refreshed rather than
+	// fetched for the first time.
+	Stale bool
+}
+
+// MetricsHooks is the hooks called by [Goproxy] to report metrics. Each hook
+// is optional and must be safe for concurrent use.
+type MetricsHooks struct {
+	// OnFetch is called for each fetch request or [Goproxy.GetOrFetch]
+	// call that started a fetch from the [Fetcher] for the name, which is
+	// the cache name targeted by the request or passed to the call.
+	OnFetch func(ctx context.Context, name string)
+
+	// OnFetchCoalesced is called for each fetch request or
+	// [Goproxy.GetOrFetch] call that waited for an in-flight fetch started
+	// by another one instead of starting its own, whether or not that fetch
+	// succeeded. The name is the cache name targeted by the request or
+	// passed to the call, which may differ from the one of the in-flight
+	// fetch when both target the same module version.
+	OnFetchCoalesced func(ctx context.Context, name string)
+}
+
+// requestInfoKey is the context key for the [RequestInfo].
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the [RequestInfo] of the request being served
+// by [Goproxy]. The context of a request is populated before it is routed, so
+// the RequestInfo is available from the context passed to the [Fetcher] and
+// the [Cacher]. It returns nil if the ctx carries no RequestInfo, such as for
+// requests rejected before they are routed.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return ri
+}
+
+// withRequestInfo returns a shallow copy of the req with the ri added to its
+// context.
+func withRequestInfo(req *http.Request, ri *RequestInfo) *http.Request {
+	setRequestOperation(req.Context(), ri.Operation)
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, ri))
+}
+
 func (g *Goproxy) uploadPage(rw http.ResponseWriter, req *http.Request) {
 	const UPLOAD_PAGE_HTML = `
 <!DOCTYPE html>
@@ -193,14 +1320,38 @@ func (g *Goproxy) uploadPage(rw http.ResponseWriter, req *http.Request) {
 </body>
 </html>
 	`
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
 	rw.WriteHeader(http.StatusOK)
-	rw.Header().Set("Content-Type", "text/html")
 	fmt.Fprint(rw, UPLOAD_PAGE_HTML)
 }
 
+// defaultMaxSyncBodySize is the default value of [Goproxy.MaxSyncBodySize].
+const defaultMaxSyncBodySize = 1 << 30
+
 func (g *Goproxy) serveSync(rw http.ResponseWriter, req *http.Request) {
+	if g.Cacher == nil {
+		responseErrorString(rw, req, http.StatusNotImplemented, -1, "not implemented: cacher is nil", nil)
+		return
+	}
+	maxBodySize := g.MaxSyncBodySize
+	if maxBodySize == 0 {
+		maxBodySize = defaultMaxSyncBodySize
+	}
+	var body *countingReader
+	if maxBodySize > 0 {
+		body = &countingReader{r: http.MaxBytesReader(rw, req.Body, maxBodySize)}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, req.Body}
+	}
+
 	// 解析multipart表单，但不会解析文件内容
 	if err := req.ParseMultipartForm(10 << 20); err != nil {
+		if body != nil && body.n >= maxBodySize {
+			responseRequestEntityTooLarge(rw, req, fmt.Sprintf("more than %d bytes", maxBodySize))
+			return
+		}
 		g.logErrorf("failed to parsing multipartForm, %v", err)
 		responseError(rw, req, err, true)
 		return
@@ -215,11 +1366,12 @@ func (g *Goproxy) serveSync(rw http.ResponseWriter, req *http.Request) {
 				responseError(rw, req, err, true)
 				return
 			}
-			if g.Cacher == nil {
-				responseString(rw, req, http.StatusOK, 86400, "cacher is nil")
-			}
-			err = g.Cacher.Sync(req.Context(), file, fileHeader.Header.Get("Content-Type"))
+			compressType := g.syncCompressType(fileHeader.Header.Get("Content-Type"), fileHeader.Filename)
+			err = g.syncCache(req.Context(), file, compressType)
+			file.Close()
 			if err != nil {
+				g.logErrorf("failed to sync cache: %s: %v", fileHeader.Filename, err)
+				responseSyncError(rw, req, err)
 				return
 			}
 		}
@@ -230,60 +1382,229 @@ func (g *Goproxy) serveSync(rw http.ResponseWriter, req *http.Request) {
 // serveFetch serves fetch requests.
 func (g *Goproxy) serveFetch(rw http.ResponseWriter, req *http.Request, target string) {
 	noFetch, _ := strconv.ParseBool(req.Header.Get("Disable-Module-Fetch"))
+	if g.CanonicalizeVersions {
+		target = canonicalizeFetchTarget(target)
+	}
 
-	escapedModulePath, after, ok := strings.Cut(target, "/@")
-	if !ok {
-		responseNotFound(rw, req, 86400, "missing /@v/")
+	if g.ServeZipHashes && strings.HasSuffix(target, ".ziphash") {
+		g.serveFetchZipHash(rw, req, target, noFetch)
 		return
 	}
-	modulePath, err := module.UnescapePath(escapedModulePath)
+
+	ft, err := parseFetchTarget(target)
 	if err != nil {
-		responseNotFound(rw, req, 86400, err)
+		if errors.Is(err, errUnsupportedVersionQuery) {
+			responseBadRequest(rw, req, 86400, err)
+		} else {
+			responseNotFound(rw, req, 86400, err)
+		}
 		return
 	}
-	switch after {
-	case "latest":
-		g.serveFetchQuery(rw, req, target, modulePath, after, noFetch)
-		return
-	case "v/list":
-		g.serveFetchList(rw, req, target, modulePath, noFetch)
+	if err := g.checkFetchTargetLength(ft); err != nil {
+		responseBadRequest(rw, req, 86400, err)
 		return
 	}
-
-	if !strings.HasPrefix(after, "v/") {
-		responseNotFound(rw, req, 86400, "missing /@v/")
+	if !g.allowsModule(ft.modulePath) {
+		responseForbidden(rw, req, 86400, "module path not allowed")
 		return
 	}
-	after = after[2:] // Remove the leading "v/".
-	ext := path.Ext(after)
-	switch ext {
-	case ".info", ".mod", ".zip":
-	case "":
-		responseNotFound(rw, req, 86400, fmt.Sprintf("no file extension in filename %q", after))
-		return
+	req = withRequestInfo(req, ft.requestInfo())
+	switch {
+	case ft.list:
+		g.serveFetchList(rw, req, target, ft.modulePath, noFetch)
+	case ft.moduleQuery != "":
+		g.serveFetchQuery(rw, req, target, ft.modulePath, ft.moduleQuery, noFetch)
 	default:
-		responseNotFound(rw, req, 86400, fmt.Sprintf("unexpected extension %q", ext))
-		return
+		g.serveFetchDownload(rw, req, target, ft.modulePath, ft.moduleVersion, noFetch)
 	}
+}
 
-	escapedModuleVersion := strings.TrimSuffix(after, ext)
-	moduleVersion, err := module.UnescapeVersion(escapedModuleVersion)
+const (
+	// defaultMaxModulePathLength is the default value of
+	// [Goproxy.MaxModulePathLength].
+	defaultMaxModulePathLength = 1024
+
+	// defaultMaxModuleVersionLength is the default value of
+	// [Goproxy.MaxModuleVersionLength].
+	defaultMaxModuleVersionLength = 256
+)
+
+// checkFetchTargetLength checks whether the module path and version (or
+// version query) of the ft are within the g.MaxModulePathLength and the
+// g.MaxModuleVersionLength.
+func (g *Goproxy) checkFetchTargetLength(ft *fetchTarget) error {
+	maxPathLength := g.MaxModulePathLength
+	if maxPathLength == 0 {
+		maxPathLength = defaultMaxModulePathLength
+	}
+	if maxPathLength > 0 && len(ft.modulePath) > maxPathLength {
+		return fmt.Errorf("module path too long: more than %d bytes", maxPathLength)
+	}
+	maxVersionLength := g.MaxModuleVersionLength
+	if maxVersionLength == 0 {
+		maxVersionLength = defaultMaxModuleVersionLength
+	}
+	if maxVersionLength > 0 && len(ft.moduleVersion)+len(ft.moduleQuery) > maxVersionLength {
+		return fmt.Errorf("module version too long: more than %d bytes", maxVersionLength)
+	}
+	return nil
+}
+
+// allowsModule reports whether the module of the modulePath is allowed to be
+// served by the g.AllowedPrefixes.
+func (g *Goproxy) allowsModule(modulePath string) bool {
+	return g.allowedPrefixes == "" || module.MatchPrefixPatterns(g.allowedPrefixes, modulePath)
+}
+
+// fetchTarget is a parsed fetch target.
+type fetchTarget struct {
+	// modulePath is the unescaped module path.
+	modulePath string
+
+	// list indicates whether the target lists the available versions.
+	list bool
+
+	// moduleQuery is the unescaped version query. It is set only if the
+	// target performs a version query.
+	moduleQuery string
+
+	// moduleVersion is the unescaped canonical version. It is set only if
+	// the target downloads a module file.
+	moduleVersion string
+
+	// ext is the extension of the module file to download.
+	ext string
+}
+
+// requestInfo returns the [RequestInfo] of the ft.
+func (ft *fetchTarget) requestInfo() *RequestInfo {
+	switch {
+	case ft.list:
+		return &RequestInfo{ModulePath: ft.modulePath, Operation: "list"}
+	case ft.moduleQuery != "":
+		return &RequestInfo{ModulePath: ft.modulePath, Version: ft.moduleQuery, Operation: "query"}
+	}
+	return &RequestInfo{ModulePath: ft.modulePath, Version: ft.moduleVersion, Operation: "download"}
+}
+
+// parseFetchTarget parses the target of a fetch request. Any error it returns
+// indicates that the target is not a valid fetch target.
+func parseFetchTarget(target string) (*fetchTarget, error) {
+	escapedModulePath, after, ok := strings.Cut(target, "/@")
+	if !ok {
+		return nil, errors.New("missing /@v/")
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
 	if err != nil {
-		responseNotFound(rw, req, 86400, err)
-		return
+		return nil, err
+	}
+	switch after {
+	case "latest":
+		return &fetchTarget{modulePath: modulePath, moduleQuery: after}, nil
+	case "v/list":
+		return &fetchTarget{modulePath: modulePath, list: true}, nil
+	case "upgrade", "patch":
+		return nil, unsupportedVersionQueryError(after)
+	}
+
+	if !strings.HasPrefix(after, "v/") {
+		return nil, errors.New("missing /@v/")
+	}
+	after = after[2:] // Remove the leading "v/".
+	if strings.Contains(after, "/") {
+		return nil, fmt.Errorf("unexpected slash in filename %q", after)
+	}
+	ext := path.Ext(after)
+	switch ext {
+	case ".info", ".mod", ".zip":
+	case "":
+		return nil, fmt.Errorf("no file extension in filename %q", after)
+	default:
+		return nil, fmt.Errorf("unexpected extension %q", ext)
+	}
+
+	escapedModuleVersion := strings.TrimSuffix(after, ext)
+	moduleVersion, err := module.UnescapeVersion(escapedModuleVersion)
+	if err != nil {
+		return nil, err
 	}
 	switch moduleVersion {
 	case "latest", "upgrade", "patch":
-		responseNotFound(rw, req, 86400, "invalid version")
-		return
+		if ext == ".info" {
+			return nil, unsupportedVersionQueryError(moduleVersion)
+		}
+		return nil, errors.New("invalid version")
 	}
 	if checkCanonicalVersion(modulePath, moduleVersion) == nil {
-		g.serveFetchDownload(rw, req, target, modulePath, moduleVersion, noFetch)
+		return &fetchTarget{modulePath: modulePath, moduleVersion: moduleVersion, ext: ext}, nil
 	} else if ext == ".info" {
-		g.serveFetchQuery(rw, req, target, modulePath, moduleVersion, noFetch)
-	} else {
-		responseNotFound(rw, req, 86400, "unrecognized version")
+		return &fetchTarget{modulePath: modulePath, moduleQuery: moduleVersion}, nil
+	}
+	return nil, errors.New("unrecognized version")
+}
+
+// canonicalizeFetchTarget returns the target of a fetch request for a module
+// file with its version canonicalized (see [Goproxy.CanonicalizeVersions]), or
+// the target itself if its version needs no canonicalization.
+func canonicalizeFetchTarget(target string) string {
+	prefix, filename, ok := strings.Cut(target, "/@v/")
+	if !ok {
+		return target
+	}
+	ext := path.Ext(filename)
+	switch ext {
+	case ".info", ".mod", ".zip", ".ziphash":
+	default:
+		return target
+	}
+	version, err := module.UnescapeVersion(strings.TrimSuffix(filename, ext))
+	if err != nil {
+		return target
+	}
+	canonicalVersion := canonicalizeVersion(version)
+	if canonicalVersion == version {
+		return target
+	}
+	escapedVersion, err := module.EscapeVersion(canonicalVersion)
+	if err != nil {
+		return target
+	}
+	return prefix + "/@v/" + escapedVersion + ext
+}
+
+// canonicalizeVersion returns the canonical version equivalent to the version
+// if it differs from that only in build metadata, or the version itself
+// otherwise. Unlike [semver.Canonical], it keeps the "+incompatible" suffix, and
+// it leaves shorter forms (e.g., "v1.2") alone, as they are version queries.
+func canonicalizeVersion(version string) string {
+	if !semver.IsValid(version) {
+		return version
+	}
+	build := semver.Build(version)
+	if build == "" || build == "+incompatible" {
+		return version
+	}
+	if base := strings.TrimSuffix(version, build); semver.Canonical(base) != base {
+		return version
+	}
+	if strings.HasPrefix(build, "+incompatible.") {
+		return semver.Canonical(version) + "+incompatible"
+	}
+	return semver.Canonical(version)
+}
+
+// errUnsupportedVersionQuery is the error returned by [parseFetchTarget] for
+// version queries that the GOPROXY protocol does not support, which results in
+// a 400 response instead of a 404 one.
+var errUnsupportedVersionQuery = errors.New("unsupported version query")
+
+// unsupportedVersionQueryError returns an error that matches
+// [errUnsupportedVersionQuery] for the query.
+func unsupportedVersionQueryError(query string) error {
+	if query == "latest" {
+		return fmt.Errorf("%w %q (use /@latest)", errUnsupportedVersionQuery, query)
 	}
+	return fmt.Errorf("%w %q (resolved by the go command itself)", errUnsupportedVersionQuery, query)
 }
 
 // serveFetchQuery serves fetch query requests.
@@ -292,19 +1613,36 @@ func (g *Goproxy) serveFetchQuery(rw http.ResponseWriter, req *http.Request, tar
 		contentType        = "application/json; charset=utf-8"
 		cacheControlMaxAge = 60
 	)
+	req = withCacheControl(req, g.MutableCacheControl)
+	if g.serveResolution(rw, req, target, contentType, cacheControlMaxAge) {
+		return
+	}
 	if noFetch {
 		g.serveCache(rw, req, target, contentType, cacheControlMaxAge, nil)
 		return
 	}
-	version, time, err := g.fetcher.Query(req.Context(), modulePath, moduleQuery)
+	if g.serveFreshCache(rw, req, target, contentType, cacheControlMaxAge) {
+		return
+	}
+	if err := g.mutNegatives.notFound(target); err != nil {
+		g.serveStaleCache(rw, req, target, contentType, cacheControlMaxAge, func() { responseError(rw, req, err, true) })
+		return
+	}
+	content, fetched, err := g.fetchShared(req.Context(), &fetchTarget{modulePath: modulePath, moduleQuery: moduleQuery}, target)
 	if err != nil {
-		g.serveCache(rw, req, target, contentType, cacheControlMaxAge, func() {
-			g.logErrorf("failed to query module version: %s: %v", target, err)
+		if errors.As(err, new(*cachePutError)) {
+			g.logErrorf("failed to cache module file: %s: %v", target, err)
+			responseInternalServerError(rw, req)
+			return
+		}
+		g.serveStaleCache(rw, req, target, contentType, cacheControlMaxAge, func() {
+			g.logFetchErrorf(err, "failed to query module version: %s: %v", target, err)
+			g.mutNegatives.putNotFound(target, err)
 			responseError(rw, req, err, true)
 		})
 		return
 	}
-	g.servePutCache(rw, req, target, contentType, cacheControlMaxAge, strings.NewReader(marshalInfo(version, time)))
+	g.serveFetchedResolution(rw, req, target, contentType, cacheControlMaxAge, content, fetched)
 }
 
 // serveFetchList serves fetch list requests.
@@ -313,24 +1651,120 @@ func (g *Goproxy) serveFetchList(rw http.ResponseWriter, req *http.Request, targ
 		contentType        = "text/plain; charset=utf-8"
 		cacheControlMaxAge = 60
 	)
+	req = withCacheControl(req, g.MutableCacheControl)
+	if g.serveResolution(rw, req, target, contentType, cacheControlMaxAge) {
+		return
+	}
 	if noFetch {
 		g.serveCache(rw, req, target, contentType, cacheControlMaxAge, nil)
 		return
 	}
-	versions, err := g.fetcher.List(req.Context(), modulePath)
+	if g.serveFreshCache(rw, req, target, contentType, cacheControlMaxAge) {
+		return
+	}
+	if err := g.mutNegatives.notFound(target); err != nil {
+		g.serveStaleCache(rw, req, target, contentType, cacheControlMaxAge, func() { responseError(rw, req, err, true) })
+		return
+	}
+	content, fetched, err := g.fetchShared(req.Context(), &fetchTarget{modulePath: modulePath, list: true}, target)
 	if err != nil {
-		g.serveCache(rw, req, target, contentType, cacheControlMaxAge, func() {
-			g.logErrorf("failed to list module versions: %s: %v", target, err)
+		if errors.As(err, new(*cachePutError)) {
+			g.logErrorf("failed to cache module file: %s: %v", target, err)
+			responseInternalServerError(rw, req)
+			return
+		}
+		g.serveStaleCache(rw, req, target, contentType, cacheControlMaxAge, func() {
+			g.logFetchErrorf(err, "failed to list module versions: %s: %v", target, err)
+			g.mutNegatives.putNotFound(target, err)
 			responseError(rw, req, err, true)
 		})
 		return
 	}
-	g.servePutCache(rw, req, target, contentType, cacheControlMaxAge, strings.NewReader(strings.Join(versions, "\n")))
+	g.serveFetchedResolution(rw, req, target, contentType, cacheControlMaxAge, content, fetched)
+}
+
+// serveFetchedResolution serves requests with the content of the mutable
+// cache for the name returned by [Goproxy.fetchShared], remembering it in the
+// g.resolutions if it has been freshly fetched.
+func (g *Goproxy) serveFetchedResolution(rw http.ResponseWriter, req *http.Request, name, contentType string, cacheControlMaxAge int, content io.ReadCloser, fetched bool) {
+	defer content.Close()
+	if !fetched {
+		g.setCacheStatusHeader(rw, req, true)
+		responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
+		return
+	}
+	b, err := io.ReadAll(content)
+	if err != nil {
+		g.logErrorf("failed to read module file: %s: %v", name, err)
+		responseInternalServerError(rw, req)
+		return
+	}
+	g.resolutions.put(name, string(b))
+	g.setCacheStatusHeader(rw, req, false)
+	g.setUpstreamHeader(rw, req)
+	responseSuccess(rw, req, bytes.NewReader(b), contentType, cacheControlMaxAge)
+}
+
+// ListOptions are the options for the version lists served at the /@v/list
+// endpoint. The GOPROXY protocol does not require the versions to be in any
+// particular order, since the go command sorts them itself, so the zero value
+// serves them as returned by the [Fetcher]. The options are for other
+// consumers of the endpoint.
+//
+// The options are applied to the versions returned by the [Fetcher] before
+// they are cached. Version lists that were cached before the options changed,
+// or that were imported by [Cacher.Sync], are served as they are until they
+// are fetched again.
+type ListOptions struct {
+	// Sort sorts the versions in ascending semantic version order. Invalid
+	// versions, if any, are placed first.
+	Sort bool
+
+	// Descending reverses the order of the versions sorted by Sort. It is
+	// used only if Sort is true.
+	Descending bool
+
+	// ExcludePrereleases excludes pre-release versions (e.g.,
+	// "v1.1.0-rc.1"). It does not exclude pseudo-versions.
+	ExcludePrereleases bool
+
+	// ExcludePseudoVersions excludes pseudo-versions, which the upstream
+	// may list for modules without tagged versions.
+	ExcludePseudoVersions bool
+}
+
+// apply returns the versions filtered and sorted as specified by the lo.
+func (lo ListOptions) apply(versions []string) []string {
+	if lo.ExcludePrereleases || lo.ExcludePseudoVersions {
+		filtered := make([]string, 0, len(versions))
+		for _, version := range versions {
+			switch {
+			case module.IsPseudoVersion(version):
+				if lo.ExcludePseudoVersions {
+					continue
+				}
+			case lo.ExcludePrereleases && semver.Prerelease(version) != "":
+				continue
+			}
+			filtered = append(filtered, version)
+		}
+		versions = filtered
+	}
+	if lo.Sort {
+		sort.SliceStable(versions, func(i, j int) bool {
+			if lo.Descending {
+				return semver.Compare(versions[i], versions[j]) > 0
+			}
+			return semver.Compare(versions[i], versions[j]) < 0
+		})
+	}
+	return versions
 }
 
 // serveFetchDownload serves fetch download requests.
 func (g *Goproxy) serveFetchDownload(rw http.ResponseWriter, req *http.Request, target, modulePath, moduleVersion string, noFetch bool) {
 	const cacheControlMaxAge = 604800
+	req = withCacheControl(req, g.ImmutableCacheControl)
 
 	ext := path.Ext(target)
 	var contentType string
@@ -343,12 +1777,148 @@ func (g *Goproxy) serveFetchDownload(rw http.ResponseWriter, req *http.Request,
 		contentType = "application/zip"
 	}
 
+	if (g.WarnRetractedVersions || g.RejectRetractedVersions) && !noFetch {
+		if rationale, retracted, err := g.retraction(req.Context(), modulePath, moduleVersion); err != nil {
+			g.logErrorf("failed to check retractions: %s: %v", target, err)
+		} else if retracted && g.RejectRetractedVersions {
+			responseGone(rw, req, 60, "retracted")
+			return
+		} else if retracted {
+			if rationale = strings.Join(strings.Fields(rationale), " "); rationale == "" {
+				rationale = "retracted"
+			}
+			rw.Header().Set("X-Goproxy-Retracted", rationale)
+		}
+	}
+
+	if ext == ".zip" && !noFetch {
+		if u, ok := g.redirectUpstream(modulePath, moduleVersion); ok {
+			http.Redirect(rw, req, u, http.StatusFound)
+			return
+		}
+	}
+
+	if g.ZipDigestTrailer && ext == ".zip" {
+		dw := newDigestTrailerWriter(rw)
+		defer dw.finish()
+		rw = dw
+	}
+
+	if content, err := g.cache(req.Context(), target); err == nil {
+		defer content.Close()
+		if g.PrefetchModuleFiles && ext != ".zip" && !noFetch {
+			if _, ok := g.redirectUpstream(modulePath, moduleVersion); !ok {
+				g.prefetchModuleFiles(target)
+			}
+		}
+		if (ext == ".mod" || ext == ".zip") && !noFetch && g.sampleIntegrityCheck() {
+			g.startIntegrityCheck(modulePath, moduleVersion)
+		}
+		g.setContentDispositionHeader(rw, modulePath, moduleVersion, ext)
+		g.setCacheStatusHeader(rw, req, true)
+		if g.NormalizeGoMod && ext == ".mod" {
+			normalized, err := g.normalizedGoMod(target, content)
+			if err != nil {
+				g.logErrorf("failed to get cached module file: %s: %v", target, err)
+				responseInternalServerError(rw, req)
+				return
+			}
+			responseSuccess(rw, req, normalized, contentType, cacheControlMaxAge)
+			return
+		}
+		if g.serveCacheRange(rw, req, target, content, contentType, cacheControlMaxAge) {
+			return
+		}
+		var served io.Reader = content
+		if g.ServeZipHashes && ext == ".zip" {
+			var finish func()
+			served, finish = g.recordZipHash(req.Context(), target, content)
+			defer finish()
+		}
+		if ext != ".zip" {
+			responseSuccess(rw, req, served, contentType, cacheControlMaxAge)
+			return
+		}
+		size, sizeKnown := readCloserSize(content)
+		cw := &countingResponseWriter{ResponseWriter: rw}
+		responseSuccess(cw, req, served, contentType, cacheControlMaxAge)
+		if sizeKnown && req.Method == http.MethodGet && cw.statusCode == http.StatusOK && cw.written != size {
+			g.logErrorf("short read of cached module file: %s: served %d of %d bytes", target, cw.written, size)
+			panic(http.ErrAbortHandler)
+		}
+		return
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		g.logErrorf("failed to get cached module file: %s: %v", target, err)
+		responseInternalServerError(rw, req)
+		return
+	}
+	g.reportCacheMiss(req)
 	if noFetch {
-		g.serveCache(rw, req, target, contentType, cacheControlMaxAge, nil)
+		g.responseNotCached(rw, req)
+		return
+	}
+	targetWithoutExt := strings.TrimSuffix(target, path.Ext(target))
+	if err := g.negatives.notFound(targetWithoutExt); err != nil {
+		responseError(rw, req, err, false)
+		return
+	}
+
+	ft := &fetchTarget{modulePath: modulePath, moduleVersion: moduleVersion, ext: ext}
+	content, fetched, err := g.fetchShared(req.Context(), ft, target)
+	if err != nil {
+		if errors.As(err, new(*cachePutError)) {
+			g.logErrorf("failed to cache module file: %s: %v", target, err)
+			responseInternalServerError(rw, req)
+			return
+		}
+		g.logFetchErrorf(err, "failed to download module version: %s: %v", target, err)
+		g.negatives.putNotFound(targetWithoutExt, err)
+		responseError(rw, req, err, false)
+		return
+	}
+	defer content.Close()
+	var served io.Reader = content
+	if g.NormalizeGoMod && ext == ".mod" {
+		if served, err = g.normalizedGoMod(target, content); err != nil {
+			g.logErrorf("failed to read module file: %s: %v", target, err)
+			responseInternalServerError(rw, req)
+			return
+		}
+	}
+	g.setContentDispositionHeader(rw, modulePath, moduleVersion, ext)
+	g.setCacheStatusHeader(rw, req, !fetched)
+	if fetched {
+		g.setUpstreamHeader(rw, req)
+	}
+	responseSuccess(rw, req, served, contentType, cacheControlMaxAge)
+}
+
+// serveFetchZipHash serves fetch requests for .ziphash files.
+func (g *Goproxy) serveFetchZipHash(rw http.ResponseWriter, req *http.Request, target string, noFetch bool) {
+	const (
+		contentType        = "text/plain; charset=utf-8"
+		cacheControlMaxAge = 604800
+	)
+	req = withCacheControl(req, g.ImmutableCacheControl)
+	zipTarget := strings.TrimSuffix(target, ".ziphash") + ".zip"
+	ft, err := parseFetchTarget(zipTarget)
+	if err != nil || ft.moduleVersion == "" {
+		responseNotFound(rw, req, 86400, "unrecognized version")
+		return
+	}
+	if err := g.checkFetchTargetLength(ft); err != nil {
+		responseBadRequest(rw, req, 86400, err)
+		return
+	}
+	if !g.allowsModule(ft.modulePath) {
+		responseForbidden(rw, req, 86400, "module path not allowed")
 		return
 	}
+	req = withRequestInfo(req, ft.requestInfo())
 
 	if content, err := g.cache(req.Context(), target); err == nil {
+		defer content.Close()
+		g.setCacheStatusHeader(rw, req, true)
 		responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
 		return
 	} else if !errors.Is(err, fs.ErrNotExist) {
@@ -357,49 +1927,1748 @@ func (g *Goproxy) serveFetchDownload(rw http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	info, mod, zip, err := g.fetcher.Download(req.Context(), modulePath, moduleVersion)
+	var zipContent io.ReadCloser
+	if noFetch {
+		zipContent, err = g.cache(req.Context(), zipTarget)
+	} else {
+		zipContent, err = g.GetOrFetch(req.Context(), zipTarget)
+	}
 	if err != nil {
-		g.logErrorf("failed to download module version: %s: %v", target, err)
+		if errors.Is(err, fs.ErrNotExist) && noFetch {
+			g.responseNotCached(rw, req)
+			return
+		}
+		g.logFetchErrorf(err, "failed to get module file: %s: %v", zipTarget, err)
 		responseError(rw, req, err, false)
 		return
 	}
-	defer func() {
-		info.Close()
-		mod.Close()
-		zip.Close()
-	}()
+	defer zipContent.Close()
+	zipHash, err := g.computeZipHash(zipContent)
+	if err != nil {
+		g.logErrorf("failed to compute zip hash: %s: %v", target, err)
+		responseError(rw, req, err, false)
+		return
+	}
+	if err := g.putCache(req.Context(), target, strings.NewReader(zipHash)); err != nil {
+		g.logErrorf("failed to cache module file: %s: %v", target, err)
+		responseInternalServerError(rw, req)
+		return
+	}
+	g.setCacheStatusHeader(rw, req, false)
+	responseSuccess(rw, req, strings.NewReader(zipHash), contentType, cacheControlMaxAge)
+}
 
-	targetWithoutExt := strings.TrimSuffix(target, path.Ext(target))
-	for _, cache := range []struct {
-		ext     string
-		content io.ReadSeeker
-	}{
-		{".info", info},
-		{".mod", mod},
-		{".zip", zip},
-	} {
-		if err := g.putCache(req.Context(), targetWithoutExt+cache.ext, cache.content); err != nil {
-			g.logErrorf("failed to cache module file: %s: %v", target, err)
-			responseInternalServerError(rw, req)
+// recordZipHash returns a reader that serves the content of the cached .zip
+// file for the target while recording it, if its .ziphash file is not cached.
+// The returned function must be called once the reader has been served, and
+// caches the .ziphash file computed from the record if the content has been
+// read in full.
+func (g *Goproxy) recordZipHash(ctx context.Context, target string, content io.Reader) (io.Reader, func()) {
+	rs, ok := content.(io.ReadSeeker)
+	if !ok {
+		return content, func() {}
+	}
+	zipHashTarget := strings.TrimSuffix(target, ".zip") + ".ziphash"
+	if zipHashContent, err := g.cache(ctx, zipHashTarget); err == nil {
+		zipHashContent.Close()
+		return content, func() {}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return content, func() {}
+	}
+	f, err := os.CreateTemp(g.TempDir, tempDirPattern)
+	if err != nil {
+		g.logErrorf("failed to record module file: %s: %v", target, err)
+		return content, func() {}
+	}
+	zr := &zipRecorder{ReadSeeker: rs, modTime: contentModTime(content), file: f}
+	if et, ok := content.(interface{ ETag() string }); ok {
+		zr.etag = et.ETag()
+	}
+	return zr, func() {
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if zr.err != nil {
+			return
+		}
+		if size, err := rs.Seek(0, io.SeekEnd); err != nil || size != zr.recorded {
 			return
 		}
+		zipHash, err := dirhash.HashZip(f.Name(), dirhash.DefaultHash)
+		if err != nil {
+			g.logErrorf("failed to compute zip hash: %s: %v", zipHashTarget, err)
+			return
+		}
+		if err := g.putCache(ctx, zipHashTarget, strings.NewReader(zipHash)); err != nil {
+			g.logErrorf("failed to cache module file: %s: %v", zipHashTarget, err)
+		}
 	}
+}
 
-	var content io.ReadSeeker
-	switch ext {
-	case ".info":
-		content = info
-	case ".mod":
-		content = mod
-	case ".zip":
-		content = zip
+// computeZipHash computes the "h1:" hash of the .zip file content through a
+// temporary file.
+func (g *Goproxy) computeZipHash(content io.Reader) (string, error) {
+	f, err := os.CreateTemp(g.TempDir, tempDirPattern)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, content); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	zipHash, err := dirhash.HashZip(f.Name(), dirhash.DefaultHash)
+	if err != nil {
+		return "", notExistErrorf("invalid zip file: %w", err)
+	}
+	return zipHash, nil
+}
+
+// zipRecorder is an [io.ReadSeeker] that records the bytes read sequentially
+// from the start of the underlying [io.ReadSeeker] to a file. Reads after a
+// seek away from the end of the record are not recorded. It preserves the
+// modification time and the ETag of the underlying content.
+type zipRecorder struct {
+	io.ReadSeeker
+	modTime  time.Time
+	etag     string
+	file     *os.File
+	offset   int64
+	recorded int64
+	err      error
+}
+
+// Read implements [io.Reader].
+func (zr *zipRecorder) Read(p []byte) (int, error) {
+	n, err := zr.ReadSeeker.Read(p)
+	if n > 0 && zr.err == nil && zr.offset == zr.recorded {
+		if _, zr.err = zr.file.Write(p[:n]); zr.err == nil {
+			zr.recorded += int64(n)
+		}
+	}
+	zr.offset += int64(n)
+	return n, err
+}
+
+// Seek implements [io.Seeker].
+func (zr *zipRecorder) Seek(offset int64, whence int) (int64, error) {
+	offset, err := zr.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		zr.offset = offset
+	}
+	return offset, err
+}
+
+// ModTime returns the modification time of the underlying content.
+func (zr *zipRecorder) ModTime() time.Time { return zr.modTime }
+
+// ETag returns the ETag of the underlying content.
+func (zr *zipRecorder) ETag() string { return zr.etag }
+
+// contextSectionReader is an [io.SectionReader] whose reads fail once the ctx
+// is done, so that a cache being written from it is discarded rather than
+// finalized.
+type contextSectionReader struct {
+	ctx context.Context
+	*io.SectionReader
+}
+
+// Read implements [io.Reader].
+func (csr *contextSectionReader) Read(p []byte) (int, error) {
+	if err := csr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return csr.SectionReader.Read(p)
+}
+
+// GetOrFetch gets the cached content for the name from the g.Cacher. If the
+// content is not cached, it fetches the content from the g.Fetcher and caches
+// it to the g.Cacher. Concurrent calls that need to fetch
+// the same content, including the fetch requests served by [Goproxy.ServeHTTP],
+// are coalesced into a single fetch, which keeps going as long as any of them
+// is still waiting for it, even if the ctx of the call that started it is
+// done.
+//
+// The name is in the same form as the cache names used for fetch requests,
+// such as "example.com/@v/v1.0.0.zip" or "example.com/@latest". The freshly
+// fetched content is returned directly rather than got again from the
+// g.Cacher, and it is shared by the coalesced calls, each of which gets an
+// independent reader that starts at the beginning of the content.
+//
+// Any error that matches [fs.ErrNotExist] indicates that the content cannot
+// be found, including when the name is invalid.
+func (g *Goproxy) GetOrFetch(ctx context.Context, name string) (io.ReadCloser, error) {
+	g.initOnce.Do(g.init)
+
+	ft, err := parseFetchTarget(name)
+	if err != nil {
+		return nil, notExistErrorf("invalid cache name %q: %w", name, err)
+	}
+
+	if content, err := g.cache(ctx, name); err == nil {
+		return content, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	content, _, err := g.fetchShared(ctx, ft, name)
+	return content, err
+}
+
+// fetchKey returns the key of the g.fetchGroup for fetching the content for the
+// name, whose fetch target is the ft. Fetches of module files of the same
+// module version share the same key, as they are fetched together.
+func (ft fetchTarget) fetchKey(name string) string {
+	if ft.moduleVersion != "" {
+		return ft.modulePath + "@" + ft.moduleVersion
+	}
+	return name
+}
+
+// backgroundFetchTimeout is the maximum time that a background fetch (see
+// [Goproxy.startBackgroundFetch]) may take, as no request bounds it.
+const backgroundFetchTimeout = 10 * time.Minute
+
+// startBackgroundFetch starts the fn for the key of the g.fetchGroup in the
+// background, unless a fetch for the key is already in flight, in which case
+// it is left to that fetch. The fn is called with the ctx bounded by the
+// backgroundFetchTimeout. At most g.MaxConcurrentFetches background fetches
+// run at the same time, and those beyond the limit are skipped rather than
+// queued, as they are only best-effort. It reports whether the fn is started.
+func (g *Goproxy) startBackgroundFetch(ctx context.Context, key string, fn func(ctx context.Context) error) bool {
+	release := func() {}
+	if g.backgroundSlots != nil {
+		select {
+		case g.backgroundSlots <- struct{}{}:
+			release = func() { <-g.backgroundSlots }
+		default:
+			return false
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, backgroundFetchTimeout)
+	if !g.fetchGroup.tryGo(ctx, key, func(ctx context.Context) error {
+		defer release()
+		defer cancel()
+		return fn(ctx)
+	}) {
+		cancel()
+		release()
+		return false
+	}
+	return true
+}
+
+// coalescedWaitError returns an error that matches errFetchInProgress if the
+// err of a shared call for the name is caused by the waitCtx (see
+// [Goproxy.MaxCoalescedWait]) rather than the ctx. Otherwise, it returns the
+// err as is.
+func coalescedWaitError(ctx, waitCtx context.Context, name string, shared bool, err error) error {
+	if shared && ctx.Err() == nil && waitCtx.Err() != nil && errors.Is(err, waitCtx.Err()) {
+		return fmt.Errorf("%s: %w", name, errFetchInProgress)
+	}
+	return err
+}
+
+// Prefetch fetches the module files of the modulePath at the version resolved
+// from the query into the g.Cacher through [Goproxy.GetOrFetch], without
+// reading any of them, and returns the resolved canonical version. The query
+// may be a canonical version or a version query (e.g., a branch name), and
+// defaults to "latest" if it is empty. A version query is resolved through
+// [Goproxy.GetOrFetch] as well, so its result is cached and shared with
+// concurrent requests for it like any other. It is mainly for warming the
+// caches before the module versions are requested.
+//
+// Any error that matches [fs.ErrNotExist] indicates that the module version
+// cannot be found, including when the modulePath is invalid.
+func (g *Goproxy) Prefetch(ctx context.Context, modulePath, query string) (string, error) {
+	g.initOnce.Do(g.init)
+	if err := module.CheckPath(modulePath); err != nil {
+		return "", notExistErrorf("%w", err)
+	}
+	if query == "" {
+		query = "latest"
+	}
+	version := query
+	if checkCanonicalVersion(modulePath, version) != nil {
+		var err error
+		if version, err = g.resolveQuery(ctx, modulePath, query); err != nil {
+			return "", err
+		}
+	}
+	name, err := CacheName(modulePath, version, "zip")
+	if err != nil {
+		return "", notExistErrorf("%w", err)
+	}
+	content, err := g.GetOrFetch(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	content.Close()
+	return version, nil
+}
+
+// resolveQuery resolves the query for the modulePath to a canonical version by
+// getting the result of the query through [Goproxy.GetOrFetch].
+func (g *Goproxy) resolveQuery(ctx context.Context, modulePath, query string) (string, error) {
+	var (
+		name string
+		err  error
+	)
+	if query == "latest" {
+		name, err = CacheName(modulePath, "", "latest")
+	} else {
+		name, err = CacheName(modulePath, query, "info")
+	}
+	if err != nil {
+		return "", notExistErrorf("%w", err)
+	}
+	content, err := g.GetOrFetch(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	version, _, err := unmarshalInfo(string(b))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if err := checkCanonicalVersion(modulePath, version); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return version, nil
+}
+
+// fetchShared fetches the content for the name targeted by the ft from the
+// g.Fetcher through the g.fetchGroup, caching it to the g.Cacher, and returns
+// it (see [Goproxy.GetOrFetch]). It also reports whether the returned content
+// is the freshly fetched one, rather than the cached one got after a fetch
+// that found it unmodified or that did not share it.
+//
+// Failures in caching the fetched content are returned as [cachePutError]s.
+func (g *Goproxy) fetchShared(ctx context.Context, ft *fetchTarget, name string) (io.ReadCloser, bool, error) {
+	waitCtx := ctx
+	if g.MaxCoalescedWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, g.MaxCoalescedWait)
+		defer cancel()
+	}
+	waitStart := time.Now()
+	val, shared, err := g.fetchGroup.doValue(ctx, waitCtx, ft.fetchKey(name), func(ctx context.Context) (interface{}, error) {
+		if g.MetricsHooks.OnFetch != nil {
+			g.MetricsHooks.OnFetch(ctx, name)
+		}
+		return g.fetchSharedEntries(ctx, ft, name)
+	}, func(val interface{}, waits int) {
+		if sf, ok := val.(*sharedFetch); ok {
+			sf.hold(waits)
+		}
+	}, func(val interface{}) {
+		if sf, ok := val.(*sharedFetch); ok {
+			sf.release()
+		}
+	})
+	setSpanAttributes(ctx, coalescedAttribute(shared))
+	if shared {
+		addCoalescedRequestTraceStep(ctx, name, time.Since(waitStart), err)
+	}
+	if shared && g.MetricsHooks.OnFetchCoalesced != nil {
+		g.MetricsHooks.OnFetchCoalesced(ctx, name)
+	}
+	if err != nil {
+		return nil, false, coalescedWaitError(ctx, waitCtx, name, shared, err)
+	}
+	if sf, ok := val.(*sharedFetch); ok {
+		if content, ok := sf.open(ctx, name); ok {
+			return content, true, nil
+		}
+		sf.release()
+	}
+	content, err := g.cache(ctx, name)
+	return content, false, err
+}
+
+// fetchSharedEntries fetches the contents for the name targeted by the ft from
+// the g.Fetcher into a [sharedFetch] and caches them to the g.Cacher. If the
+// g.ServeWhileCaching is true, the contents are cached in the background while
+// being shared. If the fetch finds the cached content for the name unmodified,
+// it puts the content to the g.Cacher again so that its age is reset, and
+// returns nil.
+func (g *Goproxy) fetchSharedEntries(ctx context.Context, ft *fetchTarget, name string) (interface{}, error) {
+	entries, closeEntries, err := g.fetchCacheEntries(ctx, ft, name)
+	if errors.Is(err, ErrNotModified) {
+		if err := g.touchCache(ctx, name); err != nil {
+			return nil, &cachePutError{err}
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sf, readersAt, err := newSharedFetch(entries, closeEntries)
+	if err != nil {
+		closeEntries()
+		return nil, err
+	}
+	if !g.ServeWhileCaching || g.Cacher == nil || ft.moduleVersion == "" || !readersAt {
+		if err := g.putAllCache(ctx, entries); err != nil {
+			sf.release()
+			return nil, &cachePutError{err}
+		}
+		return sf, nil
+	}
+
+	putCtx, cancelPut := context.WithCancel(detachedContext{ctx})
+	putEntries := make([]CacheEntry, len(entries))
+	for i, entry := range entries {
+		putEntries[i] = CacheEntry{Name: entry.Name, Content: &contextSectionReader{ctx: putCtx, SectionReader: sf.section(entry.Name)}}
+	}
+	sf.refs++
+	sf.putDone, sf.cancelPut = make(chan struct{}), cancelPut
+	go func() {
+		defer sf.release()
+		defer close(sf.putDone)
+		defer cancelPut()
+		if err := g.putAllCache(putCtx, putEntries); err != nil {
+			g.logErrorf("failed to cache module file: %s: %v", name, err)
+		}
+	}()
+	return sf, nil
+}
+
+// cachePutError is an error in caching fetched contents, as opposed to an
+// error in fetching them.
+type cachePutError struct{ err error }
+
+// Error implements [error].
+func (e *cachePutError) Error() string { return e.err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *cachePutError) Unwrap() error { return e.err }
+
+// sharedFetch is the contents fetched by a fetch of the g.fetchGroup, shared by
+// the concurrent calls that waited for it (see [Goproxy.fetchShared]). Each
+// call holds a reference to it and reads its content independently. The
+// contents are closed once all references are released.
+type sharedFetch struct {
+	contents map[string]*io.SectionReader
+	close    func()
+
+	// putDone is closed once the contents have been cached in the
+	// background (see [Goproxy.ServeWhileCaching]), which is aborted by
+	// the cancelPut. It is nil if the contents were cached before being
+	// shared.
+	putDone   chan struct{}
+	cancelPut context.CancelFunc
+
+	// serialized indicates whether any of the contents does not implement
+	// [io.ReaderAt], in which case reads of the contents are serialized
+	// and the readers of the contents do not implement [io.ReaderAt]
+	// either.
+	serialized bool
+
+	mu      sync.Mutex
+	refs    int
+	readers int
+}
+
+// newSharedFetch returns a new [sharedFetch] of the entries, which are closed by
+// the close, with a reference held by the caller. It also reports whether all
+// contents of the entries implement [io.ReaderAt], so that they can be read
+// concurrently without being serialized.
+func newSharedFetch(entries []CacheEntry, close func()) (*sharedFetch, bool, error) {
+	sf := &sharedFetch{contents: make(map[string]*io.SectionReader, len(entries)), close: close, refs: 1}
+	readersAt := true
+	for _, entry := range entries {
+		size, err := ContentSize(entry.Content)
+		if err != nil {
+			return nil, false, err
+		}
+		ra, ok := entry.Content.(io.ReaderAt)
+		if !ok {
+			ra = &readSeekerAt{rs: entry.Content}
+			readersAt = false
+		}
+		sf.contents[entry.Name] = io.NewSectionReader(ra, 0, size)
+	}
+	sf.serialized = !readersAt
+	return sf, readersAt, nil
+}
+
+// section returns a new reader of the content for the name in the sf that
+// reads from the start of the content.
+func (sf *sharedFetch) section(name string) *io.SectionReader {
+	content := sf.contents[name]
+	return io.NewSectionReader(content, 0, content.Size())
+}
+
+// hold adds n references to the sf.
+func (sf *sharedFetch) hold(n int) {
+	sf.mu.Lock()
+	sf.refs += n
+	sf.mu.Unlock()
+}
+
+// release releases a reference to the sf, closing the contents if it is the
+// last one.
+func (sf *sharedFetch) release() {
+	sf.mu.Lock()
+	sf.refs--
+	last := sf.refs == 0
+	sf.mu.Unlock()
+	if last {
+		sf.close()
+	}
+}
+
+// open returns a new reader of the content for the name in the sf that reads
+// from the start of the content, consuming a reference that is released when
+// the reader is closed. It reports false without consuming the reference if
+// the sf has no content for the name.
+//
+// If the contents are being cached in the background, closing the reader
+// waits for the caching to complete, and the caching is aborted once the ctxs
+// of all readers are done before it completes, as is the case when a request
+// serving the content is canceled.
+func (sf *sharedFetch) open(ctx context.Context, name string) (io.ReadSeekCloser, bool) {
+	if _, ok := sf.contents[name]; !ok {
+		return nil, false
+	}
+	if sf.putDone != nil {
+		sf.mu.Lock()
+		sf.readers++
+		sf.mu.Unlock()
+		go func() {
+			select {
+			case <-ctx.Done():
+				sf.mu.Lock()
+				sf.readers--
+				if sf.readers == 0 {
+					sf.cancelPut()
+				}
+				sf.mu.Unlock()
+			case <-sf.putDone:
+			}
+		}()
+	}
+	var once sync.Once
+	closer := closerFunc(func() error {
+		once.Do(func() {
+			if sf.putDone != nil {
+				<-sf.putDone
+			}
+			sf.release()
+		})
+		return nil
+	})
+	if sf.serialized {
+		return struct {
+			io.ReadSeeker
+			io.Closer
+		}{sf.section(name), closer}, true
+	}
+	return struct {
+		*io.SectionReader
+		io.Closer
+	}{sf.section(name), closer}, true
+}
+
+// readSeekerAt implements [io.ReaderAt] for an [io.ReadSeeker] by seeking
+// before each read, which is serialized.
+type readSeekerAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+// ReadAt implements [io.ReaderAt].
+func (rsa *readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	rsa.mu.Lock()
+	defer rsa.mu.Unlock()
+	if _, err := rsa.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rsa.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// redirectUpstream returns the URL to redirect the request for the .zip file
+// of the modulePath and moduleVersion to as decided by the g.RedirectUpstream.
+// It reports false if the request should not be redirected.
+func (g *Goproxy) redirectUpstream(modulePath, moduleVersion string) (string, bool) {
+	if g.RedirectUpstream == nil {
+		return "", false
+	}
+	u, ok := g.RedirectUpstream(modulePath, moduleVersion, "download")
+	return u, ok && u != ""
+}
+
+// prefetchModuleFiles fetches the module files of the module version targeted
+// by the target into the g.Cacher in the background if its .zip file is not
+// cached.
+func (g *Goproxy) prefetchModuleFiles(target string) {
+	name := strings.TrimSuffix(target, path.Ext(target)) + ".zip"
+	go func() {
+		content, err := g.GetOrFetch(context.Background(), name)
+		if err != nil {
+			g.logErrorf("failed to prefetch module files: %s: %v", name, err)
+			return
+		}
+		content.Close()
+	}()
+}
+
+// fetchCacheEntries fetches the cache entries for the ft, whose cache name is
+// the name, from the g.fetcher. The returned function must be called to
+// release the entries once they are no longer needed.
+func (g *Goproxy) fetchCacheEntries(ctx context.Context, ft *fetchTarget, name string) ([]CacheEntry, func(), error) {
+	switch {
+	case ft.list:
+		versions, err := g.list(ctx, ft.modulePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		versions = g.ListOptions.apply(versions)
+		return []CacheEntry{{Name: name, Content: strings.NewReader(strings.Join(versions, "\n"))}}, func() {}, nil
+	case ft.moduleQuery != "":
+		version, time, err := g.query(ctx, ft.modulePath, ft.moduleQuery)
+		if err == nil {
+			err = g.checkQueryResult(version, time)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return []CacheEntry{{Name: name, Content: strings.NewReader(marshalInfo(version, time))}}, func() {}, nil
+	}
+
+	info, mod, zip, err := g.download(ctx, ft.modulePath, ft.moduleVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	nameWithoutExt := strings.TrimSuffix(name, ft.ext)
+	entries := g.withCompletionMarker(g.withoutCachedEntries(ctx, []CacheEntry{
+		{Name: nameWithoutExt + ".info", Content: info},
+		{Name: nameWithoutExt + ".mod", Content: mod},
+		{Name: nameWithoutExt + ".zip", Content: zip},
+	}), nameWithoutExt)
+	return entries, func() {
+		info.Close()
+		mod.Close()
+		zip.Close()
+	}, nil
+}
+
+// CachedVersions returns the versions of the modulePath that have .info files
+// cached in the g.Cacher, sorted in semantic version order. Unlike the
+// upstream @v/list, it reflects only the contents of the local cache and
+// includes pseudo-versions.
+//
+// The g.Cacher must implement [Lister].
+func (g *Goproxy) CachedVersions(ctx context.Context, modulePath string) ([]string, error) {
+	lister, ok := g.Cacher.(Lister)
+	if !ok {
+		return nil, errors.New("cacher does not support listing")
+	}
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, notExistErrorf("%w", err)
+	}
+	prefix := escapedModulePath + "/@v/"
+	names, err := lister.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, name := range names {
+		escapedModuleVersion := strings.TrimPrefix(name, prefix)
+		if path.Ext(escapedModuleVersion) != ".info" || strings.Contains(escapedModuleVersion, "/") {
+			continue
+		}
+		moduleVersion, err := module.UnescapeVersion(strings.TrimSuffix(escapedModuleVersion, ".info"))
+		if err != nil || checkCanonicalVersion(modulePath, moduleVersion) != nil {
+			continue
+		}
+		versions = append(versions, moduleVersion)
+	}
+	sort.Slice(versions, func(i, j int) bool { return semver.Compare(versions[i], versions[j]) < 0 })
+	return versions, nil
+}
+
+// ModuleInfo is the result of inspecting a module version (see
+// [Goproxy.Inspect]).
+type ModuleInfo struct {
+	// Module is the inspected module version as it was given, in the form
+	// "<module>@<query>".
+	Module string
+
+	// Path is the module path.
+	Path string
+
+	// Version is the canonical version that the query resolves to. It is
+	// empty if the module version is not resolvable.
+	Version string
+
+	// Time is the time of the Version.
+	Time time.Time
+
+	// ZipSize is the size of the module zip file of the Version. It is -1
+	// if the size is unknown.
+	ZipSize int64
+
+	// Err is the error that occurred while inspecting the module version.
+	// It matches [fs.ErrNotExist] if the module version cannot be fetched.
+	// Note that the Version may still be set if only determining the
+	// ZipSize failed.
+	Err error
+}
+
+// Inspect resolves each of the modules, in the form "<module>@<query>" (e.g.,
+// "example.com/foo@v1.0.0" or "example.com/foo@latest"), by using the
+// g.Fetcher, and reports what fetching their module zip files would be like,
+// without downloading or caching anything. It is mainly for planning the
+// capacity of a new mirror.
+//
+// The sizes of the module zip files are reported only if the g.Fetcher
+// implements [ZipSizer] (e.g., [GoFetcher] with proxies in its GOPROXY).
+//
+// Errors of individual modules are reported in their [ModuleInfo.Err]. The
+// returned error is non-nil only if the ctx is done before all modules have
+// been inspected, in which case the modules inspected so far are returned.
+func (g *Goproxy) Inspect(ctx context.Context, modules []string) ([]ModuleInfo, error) {
+	g.initOnce.Do(g.init)
+	infos := make([]ModuleInfo, 0, len(modules))
+	for _, m := range modules {
+		if err := ctx.Err(); err != nil {
+			return infos, err
+		}
+		infos = append(infos, g.inspectModule(ctx, m))
+	}
+	return infos, nil
+}
+
+// inspectModule inspects the module version m for [Goproxy.Inspect].
+func (g *Goproxy) inspectModule(ctx context.Context, m string) ModuleInfo {
+	info := ModuleInfo{Module: m, ZipSize: -1}
+	modulePath, moduleQuery, ok := strings.Cut(m, "@")
+	if !ok || moduleQuery == "" {
+		info.Err = notExistErrorf("invalid module version %q: missing version", m)
+		return info
+	}
+	info.Path = modulePath
+	if err := module.CheckPath(modulePath); err != nil {
+		info.Err = notExistErrorf("%w", err)
+		return info
+	}
+	if !g.allowsModule(modulePath) {
+		info.Err = notExistErrorf("%s: module path not allowed", modulePath)
+		return info
+	}
+	version, t, err := g.query(ctx, modulePath, moduleQuery)
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	info.Version, info.Time = version, t
+	if g.zipSizer == nil {
+		return info
+	}
+	release, err := acquireWorker(ctx, g.fetchWorkerPool)
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	defer release()
+	ctx, end := g.startSpan(ctx, "goproxy.fetch.zip_size",
+		TraceAttribute{Key: "goproxy.module.path", Value: modulePath},
+		TraceAttribute{Key: "goproxy.module.version", Value: version},
+	)
+	info.ZipSize, err = g.zipSizer.ZipSize(ctx, modulePath, version)
+	end(err)
+	if err != nil {
+		info.ZipSize, info.Err = -1, err
+	}
+	return info
+}
+
+// MirrorOptions are the options for [Goproxy.MirrorModules].
+type MirrorOptions struct {
+	// Concurrency is the maximum number of module versions that are mirrored
+	// concurrently.
+	//
+	// If Concurrency is zero, 4 is used.
+	Concurrency int
+
+	// IncludePrereleases indicates whether to also mirror pre-release
+	// versions (e.g., "v1.1.0-beta.1").
+	IncludePrereleases bool
+
+	// SkipCached indicates whether to skip module versions whose .info,
+	// .mod, and .zip files are all cached, without fetching them again. It
+	// makes an interrupted mirroring resumable by simply running it again.
+	SkipCached bool
+}
+
+// MirrorReport is the result of mirroring modules (see
+// [Goproxy.MirrorModules]).
+type MirrorReport struct {
+	// Modules is the mirrored modules, in the order they were given.
+	Modules []MirroredModule
+}
+
+// MirroredModule is a module in a [MirrorReport].
+type MirroredModule struct {
+	// Path is the module path.
+	Path string
+
+	// Versions is the versions in the version list of the module that have
+	// been mirrored, in the order of the list.
+	Versions []MirroredVersion
+
+	// Err is the error that occurred while getting the version list of the
+	// module, in which case none of its versions has been mirrored.
+	Err error
+}
+
+// MirroredVersion is a module version in a [MirroredModule].
+type MirroredVersion struct {
+	// Version is the version.
+	Version string
+
+	// Skipped indicates whether the module version has been skipped because
+	// it was already cached (see [MirrorOptions.SkipCached]).
+	Skipped bool
+
+	// Err is the error that occurred while mirroring the module version.
+	Err error
+}
+
+// MirrorModules caches all versions of each of the modulePaths to the
+// g.Cacher, as listed by the @v/list of the g.Fetcher, in the same way as
+// prefetching them through [Goproxy.GetOrFetch]. It is mainly for standing up
+// a new mirror with the whole history of some modules.
+//
+// Errors of individual modules and module versions are reported in the
+// returned [MirrorReport]. The returned error is non-nil only if the g.Cacher
+// is nil, or if the ctx is done before all modules have been mirrored, in
+// which case the module versions not mirrored yet report the ctx.Err.
+func (g *Goproxy) MirrorModules(ctx context.Context, modulePaths []string, opts MirrorOptions) (MirrorReport, error) {
+	g.initOnce.Do(g.init)
+	var report MirrorReport
+	if g.Cacher == nil {
+		return report, errors.New("cacher is not set")
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	workerPool := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	report.Modules = make([]MirroredModule, len(modulePaths))
+	for i, modulePath := range modulePaths {
+		mm := &report.Modules[i]
+		mm.Path = modulePath
+		if err := ctx.Err(); err != nil {
+			mm.Err = err
+			continue
+		}
+		versions, err := g.mirrorVersions(ctx, modulePath, opts)
+		if err != nil {
+			mm.Err = err
+			continue
+		}
+		mm.Versions = make([]MirroredVersion, len(versions))
+		for j, version := range versions {
+			mv := &mm.Versions[j]
+			mv.Version = version
+			release, err := acquireWorker(ctx, workerPool)
+			if err != nil {
+				mv.Err = err
+				continue
+			}
+			wg.Add(1)
+			go func(modulePath string) {
+				defer wg.Done()
+				defer release()
+				mv.Skipped, mv.Err = g.mirrorModuleVersion(ctx, modulePath, mv.Version, opts)
+			}(modulePath)
+		}
+	}
+	wg.Wait()
+	return report, ctx.Err()
+}
+
+// mirrorVersions returns the versions of the modulePath to be mirrored for
+// [Goproxy.MirrorModules].
+func (g *Goproxy) mirrorVersions(ctx context.Context, modulePath string, opts MirrorOptions) ([]string, error) {
+	if err := module.CheckPath(modulePath); err != nil {
+		return nil, notExistErrorf("%w", err)
+	}
+	if !g.allowsModule(modulePath) {
+		return nil, notExistErrorf("%s: module path not allowed", modulePath)
+	}
+	list, err := g.list(ctx, modulePath)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0, len(list))
+	for _, version := range list {
+		if !opts.IncludePrereleases && semver.Prerelease(version) != "" {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// mirrorModuleVersion caches the module files of the modulePath and
+// moduleVersion for [Goproxy.MirrorModules]. It reports whether the module
+// version has been skipped because it was already cached.
+func (g *Goproxy) mirrorModuleVersion(ctx context.Context, modulePath, moduleVersion string, opts MirrorOptions) (bool, error) {
+	if err := checkCanonicalVersion(modulePath, moduleVersion); err != nil {
+		return false, notExistErrorf("%w", err)
+	}
+	if opts.SkipCached {
+		cached := true
+		for _, ext := range []string{"info", "mod", "zip"} {
+			name, err := CacheName(modulePath, moduleVersion, ext)
+			if err != nil {
+				return false, notExistErrorf("%w", err)
+			}
+			content, err := g.cache(ctx, name)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					return false, err
+				}
+				cached = false
+				break
+			}
+			content.Close()
+		}
+		if cached {
+			return true, nil
+		}
+	}
+	for _, ext := range []string{"zip", "info", "mod"} {
+		name, err := CacheName(modulePath, moduleVersion, ext)
+		if err != nil {
+			return false, notExistErrorf("%w", err)
+		}
+		content, err := g.GetOrFetch(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		content.Close()
+	}
+	return false, nil
+}
+
+// upstreamFetchKey returns the key of the g.fetchGroup for the op of the
+// g.fetcher on the modulePath with the arg, such as "query:example.com@latest",
+// which never collides with those of fetches (see [fetchTarget.fetchKey]) as
+// module paths cannot contain colons.
+func upstreamFetchKey(op, modulePath, arg string) string {
+	if arg == "" {
+		return op + ":" + modulePath
+	}
+	return op + ":" + modulePath + "@" + arg
+}
+
+// queryResult is the result of a [Fetcher.Query] shared through the
+// g.fetchGroup.
+type queryResult struct {
+	version string
+	time    time.Time
+}
+
+// query queries the moduleQuery of the modulePath from the g.fetcher.
+// Concurrent queries for the same module version query are coalesced into a
+// single one through the g.fetchGroup.
+func (g *Goproxy) query(ctx context.Context, modulePath, moduleQuery string) (string, time.Time, error) {
+	val, _, err := g.fetchGroup.doValue(ctx, ctx, upstreamFetchKey("query", modulePath, moduleQuery), func(ctx context.Context) (interface{}, error) {
+		version, time, err := g.fetcher.Query(ctx, modulePath, moduleQuery)
+		if err != nil {
+			return nil, err
+		}
+		return queryResult{version: version, time: time}, nil
+	}, nil, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	qr := val.(queryResult)
+	return qr.version, qr.time, nil
+}
+
+// list lists the versions of the modulePath from the g.fetcher. Concurrent
+// lists of the same module are coalesced into a single one through the
+// g.fetchGroup, and each of them gets its own copy of the versions.
+func (g *Goproxy) list(ctx context.Context, modulePath string) ([]string, error) {
+	val, _, err := g.fetchGroup.doValue(ctx, ctx, upstreamFetchKey("list", modulePath, ""), func(ctx context.Context) (interface{}, error) {
+		return g.fetcher.List(ctx, modulePath)
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), val.([]string)...), nil
+}
+
+// fetchDownload downloads the module files of the modulePath and moduleVersion
+// from the g.fetcher. Concurrent downloads of the same module version are
+// coalesced into a single one through the g.fetchGroup, and each of them gets
+// independent readers of the shared module files (see [sharedFetch]), which
+// are closed once all of the readers are closed.
+func (g *Goproxy) fetchDownload(ctx context.Context, modulePath, moduleVersion string) (info, mod, zip io.ReadSeekCloser, err error) {
+	val, _, err := g.fetchGroup.doValue(ctx, ctx, upstreamFetchKey("download", modulePath, moduleVersion), func(ctx context.Context) (interface{}, error) {
+		info, mod, zip, err := g.fetcher.Download(ctx, modulePath, moduleVersion)
+		if err != nil {
+			return nil, err
+		}
+		closeFiles := func() {
+			info.Close()
+			mod.Close()
+			zip.Close()
+		}
+		sf, _, err := newSharedFetch([]CacheEntry{
+			{Name: ".info", Content: info},
+			{Name: ".mod", Content: mod},
+			{Name: ".zip", Content: zip},
+		}, closeFiles)
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		return sf, nil
+	}, func(val interface{}, waits int) {
+		val.(*sharedFetch).hold(waits)
+	}, func(val interface{}) {
+		val.(*sharedFetch).release()
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sf := val.(*sharedFetch)
+	sf.hold(2) // One reference for each of the module files besides the one already held.
+	var files [3]io.ReadSeekCloser
+	for i, ext := range []string{".info", ".mod", ".zip"} {
+		content, _ := sf.open(ctx, ext)
+		files[i] = content
+	}
+	return files[0], files[1], files[2], nil
+}
+
+// download downloads the module files of the modulePath and moduleVersion
+// from the g.fetcher, checking them if the g.SniffModuleFiles, the
+// g.ValidateModFiles, or the g.ValidateInfoFiles is true.
+func (g *Goproxy) download(ctx context.Context, modulePath, moduleVersion string) (info, mod, zip io.ReadSeekCloser, err error) {
+	info, mod, zip, err = g.fetchDownload(ctx, modulePath, moduleVersion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, f := range []struct {
+		ext     string
+		content *io.ReadSeekCloser
+	}{
+		{"info", &info},
+		{"mod", &mod},
+		{"zip", &zip},
+	} {
+		err := g.checkModuleFile(f.ext, *f.content, modulePath)
+		if err == nil {
+			continue
+		}
+		if g.ServeCachedOnMalformedUpstream {
+			if cached, ok := g.cachedModuleFile(ctx, modulePath, moduleVersion, f.ext); ok {
+				g.logErrorf("malformed module file from upstream, using cached copy: %s@%s.%s: %v", modulePath, moduleVersion, f.ext, err)
+				(*f.content).Close()
+				*f.content = cached
+				continue
+			}
+		}
+		info.Close()
+		mod.Close()
+		zip.Close()
+		return nil, nil, nil, err
+	}
+	if g.sampleShadowFetch() {
+		mod, zip = g.startShadowFetch(modulePath, moduleVersion, mod, zip)
+	}
+	return info, mod, zip, nil
+}
+
+// checkModuleFile checks the content of the fetched module file of the
+// modulePath with the ext, if the g.SniffModuleFiles, the g.ValidateModFiles,
+// or the g.ValidateInfoFiles is true.
+func (g *Goproxy) checkModuleFile(ext string, content io.ReadSeeker, modulePath string) error {
+	if g.SniffModuleFiles {
+		if err := sniffModuleFile(ext, content); err != nil {
+			return err
+		}
+	}
+	if g.ValidateModFiles && ext == "mod" {
+		return validateModFile(content, modulePath)
+	}
+	if g.ValidateInfoFiles && ext == "info" {
+		return validateInfoFile(content)
+	}
+	return nil
+}
+
+// checkQueryResult checks the .info file of the version and t resolved by a
+// version query from the g.fetcher, if the g.ValidateInfoFiles is true.
+func (g *Goproxy) checkQueryResult(version string, t time.Time) error {
+	if !g.ValidateInfoFiles {
+		return nil
+	}
+	return validateInfoFile(strings.NewReader(marshalInfo(version, t)))
+}
+
+// cachedModuleFile returns a copy of the cached module file of the modulePath
+// and moduleVersion with the ext for [Goproxy.ServeCachedOnMalformedUpstream].
+// The copy is buffered so that putting it back to the g.Cacher never reads the
+// cache file being written.
+func (g *Goproxy) cachedModuleFile(ctx context.Context, modulePath, moduleVersion, ext string) (io.ReadSeekCloser, bool) {
+	name, err := CacheName(modulePath, moduleVersion, ext)
+	if err != nil {
+		return nil, false
+	}
+	content, err := g.cache(ctx, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			g.logErrorf("failed to get cached module file: %s: %v", name, err)
+		}
+		return nil, false
+	}
+	defer content.Close()
+	rs, release, err := g.contentBuffer().buffer(content)
+	if err != nil {
+		g.logErrorf("failed to get cached module file: %s: %v", name, err)
+		return nil, false
+	}
+	return &bufferedContent{ReadSeeker: rs, release: release}, true
+}
+
+// bufferedContent is an [io.ReadSeekCloser] of content buffered by a
+// [contentBuffer]. Closing it releases the buffer.
+type bufferedContent struct {
+	io.ReadSeeker
+	release func()
+}
+
+// Close implements [io.Closer].
+func (bc *bufferedContent) Close() error {
+	bc.release()
+	return nil
+}
+
+// sniffModuleFile checks that the leading bytes of the content look like
+// those of a module file with the ext. The content is rewound to the start
+// after checking.
+func sniffModuleFile(ext string, content io.ReadSeeker) error {
+	b := make([]byte, 512)
+	n, err := io.ReadFull(content, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	b = b[:n]
+	switch ext {
+	case "info":
+		if trimmed := bytes.TrimLeft(b, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' {
+			return notExistErrorf("invalid info file: not a JSON object")
+		}
+	case "mod":
+		if trimmed := bytes.TrimLeft(bytes.TrimPrefix(b, []byte("\ufeff")), " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '<' {
+			return notExistErrorf("invalid mod file: looks like HTML")
+		}
+	case "zip":
+		if !bytes.HasPrefix(b, []byte("PK\x03\x04")) && !bytes.HasPrefix(b, []byte("PK\x05\x06")) {
+			return notExistErrorf("invalid zip file: missing zip header")
+		}
+	}
+	return nil
+}
+
+// validateModFile validates that the mod is a go.mod file of the modulePath.
+// The mod is rewound to the start after validation.
+func validateModFile(mod io.ReadSeeker, modulePath string) error {
+	b, err := io.ReadAll(mod)
+	if err != nil {
+		return err
+	}
+	if _, err := mod.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f, err := modfile.ParseLax("go.mod", b, nil)
+	if err != nil {
+		return notExistErrorf("invalid mod file: %w", err)
+	}
+	if f.Module == nil {
+		return notExistErrorf("invalid mod file: missing module directive")
+	}
+	if f.Module.Mod.Path != modulePath {
+		return notExistErrorf("invalid mod file: module path %q does not match %q", f.Module.Mod.Path, modulePath)
+	}
+	return nil
+}
+
+// validateInfoFile validates that the info is an .info file of a canonical
+// version. The info is rewound to the start after validation.
+func validateInfoFile(info io.ReadSeeker) error {
+	b, err := io.ReadAll(info)
+	if err != nil {
+		return err
+	}
+	if _, err := info.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	version, _, err := unmarshalInfo(string(b))
+	if err != nil {
+		return fmt.Errorf("%w: invalid info file: %v", errBadUpstream, err)
+	}
+	if module.CanonicalVersion(version) != version {
+		return fmt.Errorf("%w: invalid info file: non-canonical version %q", errBadUpstream, version)
+	}
+	return nil
+}
+
+// normalizeGoMod returns the mod normalized as per [Goproxy.NormalizeGoMod].
+func normalizeGoMod(mod []byte) ([]byte, error) {
+	f, err := modfile.Parse("go.mod", mod, nil)
+	if err != nil {
+		return nil, err
+	}
+	requires := make([]*modfile.Require, 0, len(f.Require))
+	requireIndexes := map[string]int{}
+	for _, r := range f.Require {
+		if i, ok := requireIndexes[r.Mod.Path]; ok {
+			if semver.Compare(r.Mod.Version, requires[i].Mod.Version) > 0 {
+				requires[i] = r
+			}
+			continue
+		}
+		requireIndexes[r.Mod.Path] = len(requires)
+		requires = append(requires, r)
+	}
+	if len(requires) < len(f.Require) {
+		f.SetRequire(requires)
+	}
+	excluded := map[module.Version]bool{}
+	var duplicateExcludes []module.Version
+	for _, x := range f.Exclude {
+		if excluded[x.Mod] {
+			duplicateExcludes = append(duplicateExcludes, x.Mod)
+		}
+		excluded[x.Mod] = true
+	}
+	for _, m := range duplicateExcludes {
+		if err := f.DropExclude(m.Path, m.Version); err != nil {
+			return nil, err
+		}
+		if err := f.AddExclude(m.Path, m.Version); err != nil {
+			return nil, err
+		}
+	}
+	f.SortBlocks()
+	f.Cleanup()
+	return modfile.Format(f.Syntax), nil
+}
+
+// normalizedGoMod returns the content of the .mod file targeted by the target
+// normalized as per the g.NormalizeGoMod, or as it is if it does not parse.
+func (g *Goproxy) normalizedGoMod(target string, content io.Reader) (io.ReadSeeker, error) {
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	nb, err := normalizeGoMod(b)
+	if err != nil {
+		g.logErrorf("failed to normalize mod file: %s: %v", target, err)
+		return bytes.NewReader(b), nil
+	}
+	return bytes.NewReader(nb), nil
+}
+
+// retractionsTTL is how long the retractions of a module are cached in memory.
+const retractionsTTL = 10 * time.Minute
+
+// moduleRetractions is the cached retractions of a module.
+type moduleRetractions struct {
+	retracts  []*modfile.Retract
+	expiresAt time.Time
+}
+
+// retraction reports whether the moduleVersion is retracted by the go.mod
+// file of the latest version of the modulePath, and returns the rationale of
+// the retraction if so.
+func (g *Goproxy) retraction(ctx context.Context, modulePath, moduleVersion string) (rationale string, retracted bool, err error) {
+	retracts, err := g.moduleRetracts(ctx, modulePath)
+	if err != nil {
+		return "", false, err
+	}
+	for _, r := range retracts {
+		if semver.Compare(r.Low, moduleVersion) <= 0 && semver.Compare(moduleVersion, r.High) <= 0 {
+			return r.Rationale, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// moduleRetracts returns the retract directives in the go.mod file of the
+// latest version of the modulePath, which is the highest release version, or
+// the highest pre-release version if there are no release versions, whether
+// or not it is retracted itself.
+func (g *Goproxy) moduleRetracts(ctx context.Context, modulePath string) ([]*modfile.Retract, error) {
+	g.retractionsMu.Lock()
+	mr, ok := g.retractions[modulePath]
+	g.retractionsMu.Unlock()
+	if ok && time.Now().Before(mr.expiresAt) {
+		return mr.retracts, nil
+	}
+
+	versions, err := g.list(ctx, modulePath)
+	if err != nil {
+		return nil, err
+	}
+	var latestRelease, latestPrerelease string
+	for _, version := range versions {
+		if !semver.IsValid(version) {
+			continue
+		}
+		if semver.Prerelease(version) == "" {
+			if semver.Compare(version, latestRelease) > 0 {
+				latestRelease = version
+			}
+		} else if semver.Compare(version, latestPrerelease) > 0 {
+			latestPrerelease = version
+		}
+	}
+	latest := latestRelease
+	if latest == "" {
+		latest = latestPrerelease
+	}
+
+	var retracts []*modfile.Retract
+	if latest != "" {
+		name, err := CacheName(modulePath, latest, "mod")
+		if err != nil {
+			return nil, err
+		}
+		content, err := g.GetOrFetch(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, err
+		}
+		f, err := modfile.ParseLax("go.mod", b, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mod file: %s: %w", name, err)
+		}
+		retracts = f.Retract
+	}
+
+	g.retractionsMu.Lock()
+	if g.retractions == nil {
+		g.retractions = map[string]*moduleRetractions{}
+	}
+	g.retractions[modulePath] = &moduleRetractions{retracts: retracts, expiresAt: time.Now().Add(retractionsTTL)}
+	g.retractionsMu.Unlock()
+	return retracts, nil
+}
+
+// ExportModule writes the cached module files of the modulePath and
+// moduleVersion from the g.Cacher to the w as a tar archive. The archive has
+// the same layout as $GOMODCACHE/cache/download, so it can be extracted into
+// a module cache or imported by [Cacher.Sync].
+//
+// The .info, .mod, and .zip files of the module version must all be cached.
+// Otherwise, an error that matches [fs.ErrNotExist] is returned before
+// anything is written to the w. The .ziphash file is also included if it is
+// cached.
+func (g *Goproxy) ExportModule(ctx context.Context, w io.Writer, modulePath, moduleVersion string) error {
+	if err := checkCanonicalVersion(modulePath, moduleVersion); err != nil {
+		return notExistErrorf("%w", err)
+	}
+
+	var contents []io.ReadCloser
+	defer func() {
+		for _, content := range contents {
+			content.Close()
+		}
+	}()
+	var names []string
+	for _, ext := range []string{"info", "mod", "zip", "ziphash"} {
+		name, err := CacheName(modulePath, moduleVersion, ext)
+		if err != nil {
+			return notExistErrorf("%w", err)
+		}
+		content, err := g.cache(ctx, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				if ext == "ziphash" {
+					continue
+				}
+				return notExistErrorf("%s@%s is not fully cached: missing %s", modulePath, moduleVersion, name)
+			}
+			return err
+		}
+		contents = append(contents, content)
+		names = append(names, name)
+	}
+
+	tw := tar.NewWriter(w)
+	for i, content := range contents {
+		if err := writeTarFile(tw, g.contentBuffer(), names[i], content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ExportOptions are the options for [Goproxy.Export].
+type ExportOptions struct {
+	// Prefix is the prefix of the names of the caches to export.
+	//
+	// If Prefix is empty, all caches are exported.
+	Prefix string
+
+	// Gzip indicates whether to compress the exported tar archive with
+	// gzip.
+	Gzip bool
+
+	// GzipLevel is the gzip compression level, ranging from
+	// [gzip.BestSpeed] to [gzip.BestCompression], or [gzip.HuffmanOnly]. It
+	// is used only if Gzip is true.
+	//
+	// If GzipLevel is zero, [gzip.DefaultCompression] is used.
+	GzipLevel int
+
+	// DereferenceSymlinks indicates whether to export caches that are
+	// symbolic links as regular files with the content of their targets.
+	//
+	// If DereferenceSymlinks is false and the g.Cacher implements
+	// [Readlinker], such caches are exported as symbolic links with the
+	// same targets instead, without following them, and [DirCacher.Sync]
+	// re-creates them as such. They are always exported by
+	// [Goproxy.DeltaExport], regardless of the remote manifest.
+	DereferenceSymlinks bool
+}
+
+// Export writes all caches from the g.Cacher whose names start with the
+// opts.Prefix to the w as a tar archive, in lexical order of their names. The
+// archive has the same layout as the one written by [Goproxy.ExportModule], so
+// it can be imported by [Cacher.Sync] (with the "application/gzip" compress
+// type if the opts.Gzip is true).
+//
+// The g.Cacher must implement [Lister]. Caches that disappear between being
+// listed and being read are skipped.
+//
+// The archive is streamed to the w as the caches are read, one at a time, so
+// the memory used does not depend on the number or sizes of the caches, and a
+// slow w throttles the reading. To upload the archive to an object storage
+// without a local copy, use [Goproxy.ExportToURL], or pass the writing end of
+// an [io.Pipe] whose reading end is given to a streaming (e.g., multipart)
+// uploader.
+func (g *Goproxy) Export(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	return g.export(ctx, w, opts, nil)
+}
+
+// DeltaExport is like [Goproxy.Export] but reads the remoteManifest, which is
+// of a downstream mirror and in the format written by [DirCacher.Manifest],
+// and exports only the caches that the downstream lacks or that differ from
+// its ones, so that the downstream can catch up by applying the archive with
+// [Cacher.Sync] instead of a full export.
+//
+// A cache differs from its entry in the remoteManifest if their sizes differ,
+// or if the entry has a hash (see [ManifestOptions.SHA256] and
+// [ManifestOptions.Digest]) that differs from the one of the cache computed
+// with the same hash function. Caches whose entries have digests of hash
+// functions other than "sha224", "sha256", "sha384" and "sha512" are always
+// exported. Modification times are not compared, as they vary between
+// mirrors. Entries of the remoteManifest that the g.Cacher lacks are ignored.
+func (g *Goproxy) DeltaExport(ctx context.Context, remoteManifest io.Reader, w io.Writer, opts ExportOptions) error {
+	remote, err := readManifest(remoteManifest)
+	if err != nil {
+		return fmt.Errorf("invalid remote manifest: %w", err)
+	}
+	return g.export(ctx, w, opts, remote)
+}
+
+// export implements [Goproxy.Export] and [Goproxy.DeltaExport]. If the remote
+// is not nil, caches that match their entries in it are skipped.
+func (g *Goproxy) export(ctx context.Context, w io.Writer, opts ExportOptions, remote map[string]ManifestEntry) error {
+	lister, ok := g.Cacher.(Lister)
+	if !ok {
+		return errors.New("cacher does not support listing")
+	}
+	var gw *gzip.Writer
+	if opts.Gzip {
+		level := opts.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var err error
+		if gw, err = gzip.NewWriterLevel(w, level); err != nil {
+			return err
+		}
+		w = gw
+	}
+	names, err := lister.List(ctx, opts.Prefix)
+	if err != nil {
+		return err
+	}
+	var readlinker Readlinker
+	if !opts.DereferenceSymlinks {
+		readlinker, _ = g.Cacher.(Readlinker)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if readlinker != nil {
+			target, err := readlinker.Readlink(ctx, name)
+			if errors.Is(err, ErrUnsupported) {
+				readlinker, target, err = nil, "", nil
+			}
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			if target != "" {
+				if err := writeTarSymlink(tw, name, target); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		content, err := g.cache(ctx, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if entry, ok := remote[name]; ok {
+			err = writeDeltaTarFile(tw, g.contentBuffer(), name, content, entry)
+		} else {
+			err = writeTarFile(tw, g.contentBuffer(), name, content)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gw != nil {
+		return gw.Close()
+	}
+	return nil
+}
+
+// ExportToURL is like [Goproxy.Export] but uploads the archive to the
+// uploadURL with a PUT request, whose body is streamed as the archive is
+// written (i.e., with chunked transfer encoding), and whose Content-Type is
+// "application/gzip" if the opts.Gzip is true, or "application/x-tar"
+// otherwise. Any 2xx response status code indicates success. This works with
+// object storages that accept uploads of unknown lengths, such as through
+// presigned URLs of resumable or streaming uploads.
+func (g *Goproxy) ExportToURL(ctx context.Context, uploadURL string, opts ExportOptions) error {
+	g.initOnce.Do(g.init)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, pr)
+	if err != nil {
+		return err
+	}
+	if opts.Gzip {
+		req.Header.Set("Content-Type", "application/gzip")
+	} else {
+		req.Header.Set("Content-Type", "application/x-tar")
+	}
+
+	exportErr := make(chan error, 1)
+	go func() {
+		err := g.Export(ctx, pw, opts)
+		pw.CloseWithError(err)
+		exportErr <- err
+	}()
+	resp, err := g.httpClient.Do(req)
+	pr.Close() // Unblock the export if the upload ended before reading it all.
+	eerr := <-exportErr
+	truncated := errors.Is(eerr, io.ErrClosedPipe)
+	if eerr != nil && !truncated {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return eerr
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("PUT %s: %s: %s", resp.Request.URL.Redacted(), resp.Status, respBody)
+	}
+	if truncated {
+		return fmt.Errorf("PUT %s: %s before the archive was fully uploaded", resp.Request.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+// CacheName returns the name that [Goproxy] uses as the key of the [Cacher]
+// for the module file of the modulePath and version with the ext, applying
+// the case-encoding of [module.EscapePath] and [module.EscapeVersion]. The ext
+// is one of the following:
+//   - "info", "mod", "zip", and "ziphash": the module files of the version
+//     (e.g., "example.com/!foo/@v/v1.0.0.info"). For "info", the version may
+//     also be a version query, since the results of such queries are cached
+//     under the same name.
+//   - "list": the list of versions (e.g., "example.com/!foo/@v/list"). The
+//     version must be empty.
+//   - "latest": the result of the latest version query (e.g.,
+//     "example.com/!foo/@latest"). The version must be empty.
+func CacheName(modulePath, version, ext string) (string, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+	switch ext {
+	case "list", "latest":
+		if version != "" {
+			return "", fmt.Errorf("unexpected version %q for %q", version, ext)
+		}
+		if ext == "list" {
+			return escapedModulePath + "/@v/list", nil
+		}
+		return escapedModulePath + "/@latest", nil
+	case "info", "mod", "zip", "ziphash":
+	default:
+		return "", fmt.Errorf("unexpected extension %q", ext)
+	}
+	if version == "" {
+		return "", fmt.Errorf("missing version for %q", ext)
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return escapedModulePath + "/@v/" + escapedVersion + "." + ext, nil
+}
+
+// ErrNotModified indicates that content has not changed since it was last
+// fetched. It is returned by [Goproxy.SyncFromURL] when the bundle has not
+// changed since it was last imported, and by a [Fetcher] when a conditional
+// fetch (see [RequestInfo.IfModifiedSince]) finds nothing new.
+var ErrNotModified = errors.New("not modified")
+
+// SyncFromURL downloads the bundle of cache files from the bundleURL and
+// imports it into the g.Cacher by using [Cacher.Sync] with the g.SyncOptions.
+// The bundle must be a tar archive or a gzipped tar archive, as indicated by
+// the Content-Type response header (or an alias of it, see
+// [SyncOptions.ContentTypeAliases]) or, failing that, by the ".tar", ".tar.gz",
+// ".tgz", or ".gz" extension of the bundleURL.
+//
+// If stateFile is not empty, the ETag of the bundle is stored in it after each
+// successful import, and sent in the If-None-Match request header next time.
+// If the bundle has not changed, the import is skipped and [ErrNotModified] is
+// returned. The stateFile is replaced atomically, so that it is never left
+// truncated by a crash.
+func (g *Goproxy) SyncFromURL(ctx context.Context, bundleURL, stateFile string) error {
+	g.initOnce.Do(g.init)
+	if g.Cacher == nil {
+		return errors.New("cacher is nil")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bundleURL, nil)
+	if err != nil {
+		return err
+	}
+	if stateFile != "" {
+		b, err := os.ReadFile(stateFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if etag := strings.TrimSpace(string(b)); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+	}
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return ErrNotModified
+	default:
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("GET %s: %s: %s", resp.Request.URL.Redacted(), resp.Status, respBody)
+	}
+
+	compressType := g.syncCompressType(resp.Header.Get("Content-Type"), resp.Request.URL.Path)
+	if err := g.syncCache(ctx, resp.Body, compressType); err != nil {
+		return err
+	}
+
+	if stateFile != "" {
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			return writeStateFile(stateFile, etag+"\n")
+		}
+		if err := os.Remove(stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStateFile atomically replaces the content of the named state file with
+// the content by writing it to a temporary file in the same directory first
+// and then renaming the temporary file into place.
+func writeStateFile(name, content string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp.*")
+	if err != nil {
+		return err
+	}
+	tempName := f.Name()
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if err := os.Chmod(tempName, 0o644); err != nil {
+		os.Remove(tempName)
+		return err
 	}
-	if _, err := content.Seek(0, io.SeekStart); err != nil {
-		g.logErrorf("failed to seek: %v", err)
-		responseInternalServerError(rw, req)
-		return
+	if err := os.Rename(tempName, name); err != nil {
+		os.Remove(tempName)
+		return err
 	}
-	responseSuccess(rw, req, content, contentType, 604800)
+	return nil
 }
 
 // serveSumDB serves checksum database proxy requests.
@@ -419,6 +3688,7 @@ func (g *Goproxy) serveSumDB(rw http.ResponseWriter, req *http.Request, target s
 	var (
 		contentType        string
 		cacheControlMaxAge int
+		immutable          bool
 	)
 	switch {
 	case path == "/supported":
@@ -429,16 +3699,43 @@ func (g *Goproxy) serveSumDB(rw http.ResponseWriter, req *http.Request, target s
 		contentType = "text/plain; charset=utf-8"
 		cacheControlMaxAge = 3600
 	case strings.HasPrefix(path, "/lookup/"):
+		if g.allowedPrefixes != "" {
+			escapedModulePath, _, _ := strings.Cut(strings.TrimPrefix(path, "/lookup/"), "@")
+			if modulePath, err := module.UnescapePath(escapedModulePath); err != nil || !g.allowsModule(modulePath) {
+				responseForbidden(rw, req, 86400, "module path not allowed")
+				return
+			}
+		}
 		contentType = "text/plain; charset=utf-8"
 		cacheControlMaxAge = 86400
+		immutable = true
 	case strings.HasPrefix(path, "/tile/"):
 		contentType = "application/octet-stream"
 		cacheControlMaxAge = 86400
+		immutable = true
 	default:
 		responseNotFound(rw, req, 86400)
 		return
 	}
 
+	// Tiles (including partial ones of a given width) never change, and
+	// neither do the records in lookup responses. The signed tree heads in lookup
+	// responses may be outdated when served from the cache, but the go
+	// command verifies them against its own latest known tree anyway. So
+	// both are served from the cache if possible.
+	if immutable {
+		if content, err := g.cache(req.Context(), target); err == nil {
+			defer content.Close()
+			g.setCacheStatusHeader(rw, req, true)
+			responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
+			return
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			g.logErrorf("failed to get cached checksum database file: %s: %v", target, err)
+			responseInternalServerError(rw, req)
+			return
+		}
+	}
+
 	tempDir, err := os.MkdirTemp(g.TempDir, tempDirPattern)
 	if err != nil {
 		g.logErrorf("failed to create temporary directory: %v", err)
@@ -447,10 +3744,10 @@ func (g *Goproxy) serveSumDB(rw http.ResponseWriter, req *http.Request, target s
 	}
 	defer os.RemoveAll(tempDir)
 
-	file, err := httpGetTemp(req.Context(), g.httpClient, appendURL(u, path).String(), tempDir)
+	file, err := g.proxySumDB(req.Context(), appendURL(u, path).String(), tempDir)
 	if err != nil {
 		g.serveCache(rw, req, target, contentType, cacheControlMaxAge, func() {
-			g.logErrorf("failed to proxy checksum database: %s: %v", target, err)
+			g.logFetchErrorf(err, "failed to proxy checksum database: %s: %v", target, err)
 			responseError(rw, req, err, true)
 		})
 		return
@@ -458,6 +3755,20 @@ func (g *Goproxy) serveSumDB(rw http.ResponseWriter, req *http.Request, target s
 	g.servePutCacheFile(rw, req, target, contentType, cacheControlMaxAge, file)
 }
 
+// proxySumDB gets the content from the url of a proxied checksum database
+// and saves it to a temporary file in the tempDir.
+func (g *Goproxy) proxySumDB(ctx context.Context, url, tempDir string) (string, error) {
+	release, err := acquireWorker(ctx, g.fetchWorkerPool)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	ctx, end := g.startSpan(ctx, "goproxy.sumdb.fetch", TraceAttribute{Key: "url.full", Value: url})
+	tempFile, err := httpGetTemp(ctx, g.httpClient, g.Backoff, url, tempDir)
+	end(err)
+	return tempFile, err
+}
+
 // serveCache serves requests with cached module files.
 func (g *Goproxy) serveCache(rw http.ResponseWriter, req *http.Request, name, contentType string, cacheControlMaxAge int, onNotFound func()) {
 	content, err := g.cache(req.Context(), name)
@@ -466,7 +3777,7 @@ func (g *Goproxy) serveCache(rw http.ResponseWriter, req *http.Request, name, co
 			if onNotFound != nil {
 				onNotFound()
 			} else {
-				responseNotFound(rw, req, 60, "temporarily unavailable")
+				g.responseNotCached(rw, req)
 			}
 			return
 		}
@@ -475,7 +3786,222 @@ func (g *Goproxy) serveCache(rw http.ResponseWriter, req *http.Request, name, co
 		return
 	}
 	defer content.Close()
+	g.setCacheStatusHeader(rw, req, true)
+	if !g.serveCacheRange(rw, req, name, content, contentType, cacheControlMaxAge) {
+		responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
+	}
+}
+
+// serveStaleCache is like [Goproxy.serveCache], but for the caches of
+// responses that can change over time that are served stale because they
+// cannot be refreshed. Caches older than the g.MaxStaleAge are treated as
+// nonexistent.
+func (g *Goproxy) serveStaleCache(rw http.ResponseWriter, req *http.Request, name, contentType string, cacheControlMaxAge int, onNotFound func()) {
+	content, err := g.cache(req.Context(), name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			onNotFound()
+			return
+		}
+		g.logErrorf("failed to get cached module file: %s: %v", name, err)
+		responseInternalServerError(rw, req)
+		return
+	}
+	defer content.Close()
+	if g.tooStale(contentModTime(content)) {
+		g.logErrorf("refused to serve stale module file: %s: older than %v", name, g.maxStaleAge())
+		onNotFound()
+		return
+	}
+	g.setCacheStatusHeader(rw, req, true)
+	if !g.serveCacheRange(rw, req, name, content, contentType, cacheControlMaxAge) {
+		responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
+	}
+}
+
+// maxStaleAge returns the effective g.MaxStaleAge, which is zero if stale
+// caches are served regardless of their age.
+func (g *Goproxy) maxStaleAge() time.Duration {
+	switch {
+	case g.MaxStaleAge == 0:
+		return 24 * time.Hour
+	case g.MaxStaleAge < 0:
+		return 0
+	}
+	return g.MaxStaleAge
+}
+
+// tooStale reports whether a cache whose modification time is the modTime is
+// too old to be served stale (see [Goproxy.MaxStaleAge]).
+func (g *Goproxy) tooStale(modTime time.Time) bool {
+	maxAge := g.maxStaleAge()
+	return maxAge > 0 && !modTime.IsZero() && time.Since(modTime) > maxAge
+}
+
+// responseNotCached responds to the req, which has the Disable-Module-Fetch
+// header, with the g.NotCachedMessage for content that is not cached.
+func (g *Goproxy) responseNotCached(rw http.ResponseWriter, req *http.Request) {
+	msg := g.NotCachedMessage
+	if msg == "" {
+		responseNotFound(rw, req, 60, "temporarily unavailable")
+		return
+	}
+	var modulePath, version string
+	if ri := RequestInfoFromContext(req.Context()); ri != nil {
+		modulePath, version = ri.ModulePath, ri.Version
+	}
+	msg = strings.NewReplacer("{module}", modulePath, "{version}", version).Replace(msg)
+	responseNotFound(rw, req, 60, msg)
+}
+
+// serveCacheRange serves the request with the requested range of the cache for
+// the name read by the g.Cacher if it implements [RangeReader]. The content is
+// the matched cache for the name, which is only used for its size and
+// validators. It reports whether the request has been served.
+//
+// Requests that cannot be served in this way (e.g., those with multiple
+// ranges, unsatisfiable ranges, or conditional headers other than a matching
+// If-Range) are left to [responseSuccess].
+func (g *Goproxy) serveCacheRange(rw http.ResponseWriter, req *http.Request, name string, content io.ReadCloser, contentType string, cacheControlMaxAge int) bool {
+	rr, ok := g.Cacher.(RangeReader)
+	if !ok || req.Method != http.MethodGet || req.Header.Get("Range") == "" {
+		return false
+	}
+	for _, header := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if req.Header.Get(header) != "" {
+			return false
+		}
+	}
+	size, ok := readCloserSize(content)
+	if !ok {
+		return false
+	}
+	start, end, ok := parseSingleByteRange(req.Header.Get("Range"), size)
+	if !ok {
+		return false
+	}
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, contentETag(content), contentModTime(content)) {
+		return false
+	}
+
+	ctx, endSpan := g.startSpan(req.Context(), "goproxy.cache.get_range", TraceAttribute{Key: "goproxy.cache.name", Value: name})
+	partial, err := rr.RangeReadCloser(ctx, g.cacheKey(ctx, name), start, end)
+	endSpan(err)
+	if err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			g.logErrorf("failed to get range of cached module file: %s: %v", name, err)
+		}
+		return false
+	}
+	defer partial.Close()
+	responsePartialContent(rw, req, partial, content, contentType, cacheControlMaxAge, start, end, size)
+	return true
+}
+
+// serveResolution serves requests with the content for the name from the
+// g.resolutions if it has not expired. It reports whether the request has been
+// served.
+func (g *Goproxy) serveResolution(rw http.ResponseWriter, req *http.Request, name, contentType string, cacheControlMaxAge int) bool {
+	content, ok := g.resolutions.get(name)
+	if !ok {
+		return false
+	}
+	g.setCacheStatusHeader(rw, req, true)
+	responseSuccess(rw, req, strings.NewReader(content), contentType, cacheControlMaxAge)
+	return true
+}
+
+// serveFreshCache serves requests with the matched cache for the name from the
+// g.Cacher if it is not older than the g.MutableCacheTTL, starting a refresh
+// in the background if it is older than the g.MutableCacheSoftTTL. It reports
+// whether the request has been served.
+func (g *Goproxy) serveFreshCache(rw http.ResponseWriter, req *http.Request, name, contentType string, cacheControlMaxAge int) bool {
+	if g.MutableCacheTTL <= 0 && g.MutableCacheSoftTTL <= 0 {
+		return false
+	}
+	content, err := g.cache(req.Context(), name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			g.logErrorf("failed to get cached module file: %s: %v", name, err)
+		} else {
+			g.reportCacheMiss(req)
+		}
+		return false
+	}
+	defer content.Close()
+	modTime := contentModTime(content)
+	if modTime.IsZero() || (g.MutableCacheTTL > 0 && time.Since(modTime) > g.MutableCacheTTL) || g.tooStale(modTime) {
+		if ri := RequestInfoFromContext(req.Context()); ri != nil {
+			ri.Stale = true
+			if g.RevalidateMutableCaches {
+				ri.IfModifiedSince = modTime
+			}
+		}
+		g.reportCacheMiss(req)
+		return false
+	}
+	if g.MutableCacheSoftTTL > 0 && time.Since(modTime) > g.MutableCacheSoftTTL {
+		g.refreshMutableCache(name, modTime)
+	}
+	g.setCacheStatusHeader(rw, req, true)
 	responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
+	return true
+}
+
+// refreshMutableCache refreshes the cache for the name, whose modification
+// time is the modTime, from the g.Fetcher in the background (see
+// [Goproxy.MutableCacheSoftTTL] and [Goproxy.startBackgroundFetch]). It does
+// nothing if the cache is already being refreshed or fetched.
+func (g *Goproxy) refreshMutableCache(name string, modTime time.Time) {
+	ft, err := parseFetchTarget(name)
+	if err != nil {
+		return
+	}
+	ri := ft.requestInfo()
+	ri.Stale = true
+	if g.RevalidateMutableCaches {
+		ri.IfModifiedSince = modTime
+	}
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, ri)
+	g.startBackgroundFetch(ctx, ft.fetchKey(name), func(ctx context.Context) error {
+		entries, closeEntries, err := g.fetchCacheEntries(ctx, ft, name)
+		if errors.Is(err, ErrNotModified) {
+			err = g.touchCache(ctx, name)
+		} else if err == nil {
+			err = g.putAllCache(ctx, entries)
+			closeEntries()
+		}
+		if err != nil {
+			g.logErrorf("failed to refresh module file: %s: %v", name, err)
+		}
+		return err
+	})
+}
+
+// touchCache puts the cache for the name to the g.Cacher again, so that its
+// age is reset.
+func (g *Goproxy) touchCache(ctx context.Context, name string) error {
+	content, err := g.cache(ctx, name)
+	if err != nil {
+		return err
+	}
+	rs, release, err := g.contentBuffer().buffer(content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return g.putCache(ctx, name, rs)
+}
+
+// contentBuffer returns the [contentBuffer] for buffering caches whose sizes
+// are unknown, as configured by the g.MaxMemoryBufferSize.
+func (g *Goproxy) contentBuffer() contentBuffer {
+	maxMemory := g.MaxMemoryBufferSize
+	if maxMemory == 0 {
+		maxMemory = 32 << 20
+	}
+	return contentBuffer{maxMemory: maxMemory, tempDir: g.TempDir}
 }
 
 // servePutCache serves requests after putting the content to the g.Cacher.
@@ -490,6 +4016,8 @@ func (g *Goproxy) servePutCache(rw http.ResponseWriter, req *http.Request, name,
 		responseInternalServerError(rw, req)
 		return
 	}
+	g.setCacheStatusHeader(rw, req, false)
+	g.setUpstreamHeader(rw, req)
 	responseSuccess(rw, req, content, contentType, cacheControlMaxAge)
 }
 
@@ -506,20 +4034,375 @@ func (g *Goproxy) servePutCacheFile(rw http.ResponseWriter, req *http.Request, n
 	g.servePutCache(rw, req, name, contentType, cacheControlMaxAge, f)
 }
 
+// setContentDispositionHeader sets the "Content-Disposition" header of the rw
+// to suggest a file name for the module zip file of the modulePath and
+// moduleVersion if the ext is ".zip" and the g.ZipContentDisposition is true.
+//
+// Since the file name must not contain path information (see RFC 6266,
+// section 4.3), the slashes in the modulePath are replaced with underscores.
+func (g *Goproxy) setContentDispositionHeader(rw http.ResponseWriter, modulePath, moduleVersion, ext string) {
+	if ext != ".zip" || !g.ZipContentDisposition {
+		return
+	}
+	filename := strings.ReplaceAll(modulePath, "/", "_") + "@" + moduleVersion + ext
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// reportCacheMiss reports a cache miss of the req to the g.OnCacheMiss.
+func (g *Goproxy) reportCacheMiss(req *http.Request) {
+	if g.OnCacheMiss == nil {
+		return
+	}
+	if ri := RequestInfoFromContext(req.Context()); ri != nil {
+		g.OnCacheMiss(*ri)
+	}
+}
+
+// setCacheStatusHeader sets the "X-Cache" header of the rw to report whether
+// the response content is a cache hit if the g.DebugHeaders is true. It also
+// records the cache status for the access log entry of the req, if any.
+func (g *Goproxy) setCacheStatusHeader(rw http.ResponseWriter, req *http.Request, hit bool) {
+	if entry, ok := req.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.setCacheStatus(hit)
+	}
+	if g.metrics != nil {
+		g.metrics.observeCacheStatus(hit)
+	}
+	if !g.DebugHeaders {
+		return
+	}
+	if hit {
+		rw.Header().Set("X-Cache", "HIT")
+	} else {
+		rw.Header().Set("X-Cache", "MISS")
+	}
+}
+
+// setUpstreamHeader sets the "X-Goproxy-Upstream" header of the rw to report
+// the [RequestInfo.Upstream] of the req if the g.DebugHeaders is true.
+func (g *Goproxy) setUpstreamHeader(rw http.ResponseWriter, req *http.Request) {
+	if !g.DebugHeaders {
+		return
+	}
+	if ri := RequestInfoFromContext(req.Context()); ri != nil && ri.Upstream != "" {
+		rw.Header().Set("X-Goproxy-Upstream", ri.Upstream)
+	}
+}
+
+// cacheKey returns the physical key in the g.Cacher of the cache for the name
+// resolved by the g.NameResolver.
+func (g *Goproxy) cacheKey(ctx context.Context, name string) string {
+	if g.NameResolver == nil {
+		return name
+	}
+	return g.NameResolver(ctx, name)
+}
+
+// cacheKeyEntries returns the entries with their names resolved by the
+// g.NameResolver.
+func (g *Goproxy) cacheKeyEntries(ctx context.Context, entries []CacheEntry) []CacheEntry {
+	if g.NameResolver == nil {
+		return entries
+	}
+	resolved := make([]CacheEntry, len(entries))
+	for i, entry := range entries {
+		resolved[i] = CacheEntry{Name: g.NameResolver(ctx, entry.Name), Content: entry.Content}
+	}
+	return resolved
+}
+
 // cache returns the matched cache for the name from the g.Cacher.
 func (g *Goproxy) cache(ctx context.Context, name string) (io.ReadCloser, error) {
 	if g.Cacher == nil {
 		return nil, fs.ErrNotExist
 	}
-	return g.Cacher.Get(ctx, name)
+	cb, _ := ctx.Value(cacheBypassKey{}).(*cacheBypass)
+	if cb.isBypassed() {
+		return nil, fs.ErrNotExist
+	}
+	ctx, end := g.startSpan(ctx, "goproxy.cache.get", TraceAttribute{Key: "goproxy.cache.name", Value: name})
+	cacher, key := g.Cacher, g.cacheKey(ctx, name)
+	content, err := cacher.Get(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) && g.FallbackCacher != nil {
+		cacher, key = g.FallbackCacher, name
+		content, err = cacher.Get(ctx, key)
+	}
+	end(err)
+	if err != nil {
+		if cb != nil && !errors.Is(err, fs.ErrNotExist) && ctx.Err() == nil {
+			if cb.bypass() {
+				g.logErrorf("bypassed unavailable cacher: %s: %v", name, err)
+			}
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	content = statSizedContent(ctx, cacher, key, content)
+	if g.CompletionMarkers {
+		if marker, ok := completionMarkerName(name); ok {
+			markerContent, err := g.cache(ctx, marker)
+			if err != nil {
+				content.Close()
+				if errors.Is(err, fs.ErrNotExist) {
+					g.logErrorf("ignored cache without completion marker: %s", name)
+				}
+				return nil, err
+			}
+			markerContent.Close()
+		}
+	}
+	if g.TreatEmptyCachesAsMisses && mustNotBeEmpty(name) {
+		if size, ok := readCloserSize(content); ok && size == 0 {
+			content.Close()
+			g.logErrorf("ignored empty cache: %s", name)
+			return nil, fs.ErrNotExist
+		}
+	}
+	return content, nil
+}
+
+// cacheBypassKey is the context key for the [cacheBypass] of a request (see
+// [Goproxy.BypassUnavailableCacher]).
+type cacheBypassKey struct{}
+
+// cacheBypass records whether the [Goproxy.Cacher] has been bypassed for a
+// request. A nil cacheBypass never bypasses it.
+type cacheBypass struct {
+	mu       sync.Mutex
+	bypassed bool
+}
+
+// bypass marks the cb as bypassed. It reports whether the cb was not bypassed
+// before.
+func (cb *cacheBypass) bypass() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.bypassed {
+		return false
+	}
+	cb.bypassed = true
+	return true
+}
+
+// isBypassed reports whether the cb has been bypassed.
+func (cb *cacheBypass) isBypassed() bool {
+	if cb == nil {
+		return false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.bypassed
+}
+
+// completionMarkerName returns the name of the completion marker of the module
+// version that the module file named by the name belongs to (see
+// [Goproxy.CompletionMarkers]). It reports false if the name is not of a
+// module file.
+func completionMarkerName(name string) (string, bool) {
+	switch ext := path.Ext(name); ext {
+	case ".info", ".mod", ".zip":
+		if !strings.Contains(name, "/@v/") {
+			return "", false
+		}
+		return strings.TrimSuffix(name, ext) + ".ready", true
+	}
+	return "", false
+}
+
+// withCompletionMarker returns the entries with the completion marker of the
+// module version whose cache names without extensions are the
+// nameWithoutExt appended if the g.CompletionMarkers is true.
+func (g *Goproxy) withCompletionMarker(entries []CacheEntry, nameWithoutExt string) []CacheEntry {
+	if !g.CompletionMarkers {
+		return entries
+	}
+	return append(entries, CacheEntry{Name: nameWithoutExt + ".ready", Content: strings.NewReader("")})
+}
+
+// withoutCachedEntries returns the entries of the module files of a module
+// version without the ones already cached in the g.Cacher if the
+// g.ImmutableVersions is true. Caches that cannot be got are considered not
+// cached, and so are empty ones that can never be valid.
+func (g *Goproxy) withoutCachedEntries(ctx context.Context, entries []CacheEntry) []CacheEntry {
+	if !g.ImmutableVersions || g.Cacher == nil {
+		return entries
+	}
+	uncached := make([]CacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		if content, err := g.Cacher.Get(ctx, g.cacheKey(ctx, entry.Name)); err == nil {
+			size, sizeKnown := readCloserSize(content)
+			content.Close()
+			if !mustNotBeEmpty(entry.Name) || !sizeKnown || size > 0 {
+				continue
+			}
+		}
+		uncached = append(uncached, entry)
+	}
+	return uncached
+}
+
+// mustNotBeEmpty reports whether the cache for the name can never be valid if
+// it is empty.
+func mustNotBeEmpty(name string) bool {
+	switch path.Ext(name) {
+	case ".info", ".mod":
+		return true
+	}
+	return strings.HasSuffix(name, "/@latest")
+}
+
+// readCloserSize returns the size of the rc if it can be determined without
+// consuming the rc.
+func readCloserSize(rc io.ReadCloser) (int64, bool) {
+	if s, ok := rc.(Sizer); ok {
+		return s.Size(), true
+	}
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		size, err := ContentSize(rs)
+		return size, err == nil
+	}
+	return 0, false
+}
+
+// statSizedContent returns the content of the cache for the name got from the
+// c, made to report its size (see [Sizer]) from the [Stater.Stat] of the c if
+// the size cannot be determined from the content itself.
+func statSizedContent(ctx context.Context, c Cacher, name string, content io.ReadCloser) io.ReadCloser {
+	if _, ok := readCloserSize(content); ok {
+		return content
+	}
+	stater, ok := c.(Stater)
+	if !ok {
+		return content
+	}
+	fi, err := stater.Stat(ctx, name)
+	if err != nil {
+		return content
+	}
+	return &sizedContent{ReadCloser: content, size: fi.Size()}
+}
+
+// sizedContent is a cache content with a known size. It keeps the validators
+// of the underlying content.
+type sizedContent struct {
+	io.ReadCloser
+	size int64
+}
+
+// Size implements [Sizer].
+func (sc *sizedContent) Size() int64 { return sc.size }
+
+// LastModified returns the modification time of the underlying content.
+func (sc *sizedContent) LastModified() time.Time { return contentModTime(sc.ReadCloser) }
+
+// ETag returns the entity tag of the underlying content.
+func (sc *sizedContent) ETag() string { return contentETag(sc.ReadCloser) }
+
+// contentModTime returns the modification time of the content in the same way
+// as [Cacher.Get] describes. It returns the zero time if the modification time
+// is unknown, including when the content reports the Unix epoch, which cachers
+// without meaningful modification times (e.g., in-memory ones) often do.
+func contentModTime(content interface{}) time.Time {
+	var modTime time.Time
+	if lm, ok := content.(interface{ LastModified() time.Time }); ok {
+		modTime = lm.LastModified()
+	} else if mt, ok := content.(interface{ ModTime() time.Time }); ok {
+		modTime = mt.ModTime()
+	}
+	if modTime.Equal(time.Unix(0, 0)) {
+		return time.Time{}
+	}
+	return modTime
+}
+
+// contentETag returns the ETag of the content, or an empty string if it is
+// unknown.
+func contentETag(content interface{}) string {
+	if et, ok := content.(interface{ ETag() string }); ok {
+		return et.ETag()
+	}
+	return ""
 }
 
 // putCache puts a cache to the g.Cacher for the name with the content.
 func (g *Goproxy) putCache(ctx context.Context, name string, content io.ReadSeeker) error {
-	if g.Cacher == nil {
+	cb, _ := ctx.Value(cacheBypassKey{}).(*cacheBypass)
+	if g.Cacher == nil || cb.isBypassed() {
 		return nil
 	}
-	return g.Cacher.Put(ctx, name, content)
+	var size int64
+	if g.metrics != nil || g.OnCacheMutation != nil || g.recentlyCached != nil {
+		size, _ = ContentSize(content)
+	}
+	ctx, end := g.startSpan(ctx, "goproxy.cache.put", TraceAttribute{Key: "goproxy.cache.name", Value: name})
+	err := g.Cacher.Put(ctx, g.cacheKey(ctx, name), content)
+	end(err)
+	if err != nil {
+		entries := []CacheEntry{{Name: name, Content: content}}
+		return g.bypassPutCacheError(ctx, cb, entries, g.putFallbackCache(ctx, entries, err))
+	}
+	g.forgetFallbackCache(ctx, name)
+	g.auditCacheMutation(ctx, AuditEvent{Operation: "put", Name: name, Bytes: size})
+	if g.metrics != nil {
+		g.metrics.observeCachePut(size)
+	}
+	return nil
+}
+
+// bypassPutCacheError returns the err of putting the caches for the entries,
+// or nil if the cb is not nil, in which case the g.Cacher is bypassed for the
+// rest of the request (see [Goproxy.BypassUnavailableCacher]).
+func (g *Goproxy) bypassPutCacheError(ctx context.Context, cb *cacheBypass, entries []CacheEntry, err error) error {
+	if err == nil || cb == nil || ctx.Err() != nil {
+		return err
+	}
+	if cb.bypass() {
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		g.logErrorf("bypassed unavailable cacher: %s: %v", strings.Join(names, ","), err)
+	}
+	return nil
+}
+
+// putAllCache puts caches for all the entries to the g.Cacher.
+func (g *Goproxy) putAllCache(ctx context.Context, entries []CacheEntry) error {
+	cb, _ := ctx.Value(cacheBypassKey{}).(*cacheBypass)
+	if g.Cacher == nil || cb.isBypassed() {
+		return nil
+	}
+	var (
+		size  int64
+		sizes []int64
+	)
+	if g.metrics != nil || g.OnCacheMutation != nil || g.recentlyCached != nil {
+		sizes = make([]int64, len(entries))
+		for i, entry := range entries {
+			if entrySize, err := ContentSize(entry.Content); err == nil {
+				size += entrySize
+				sizes[i] = entrySize
+			}
+		}
+	}
+	ctx, end := g.startSpan(ctx, "goproxy.cache.put", cacheNamesAttribute(entries))
+	err := PutAll(ctx, g.Cacher, g.cacheKeyEntries(ctx, entries))
+	end(err)
+	if err != nil {
+		return g.bypassPutCacheError(ctx, cb, entries, g.putFallbackCache(ctx, entries, err))
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	g.forgetFallbackCache(ctx, names...)
+	for i, size := range sizes {
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "put", Name: names[i], Bytes: size})
+	}
+	if g.metrics != nil {
+		g.metrics.observeCachePut(size)
+	}
+	return nil
 }
 
 // putCacheFile is like [putCache] but reads the content from the local file.
@@ -532,6 +4415,64 @@ func (g *Goproxy) putCacheFile(ctx context.Context, name, file string) error {
 	return g.putCache(ctx, name, f)
 }
 
+// syncOptions returns the g.SyncOptions, with its Logger and TempDir
+// defaulting to the g.ErrorLogger and the g.TempDir.
+func (g *Goproxy) syncOptions() SyncOptions {
+	opts := g.SyncOptions
+	if opts.Logger == nil {
+		opts.Logger = g.ErrorLogger
+	}
+	if opts.TempDir == "" {
+		opts.TempDir = g.TempDir
+	}
+	return opts
+}
+
+// syncCache imports the cache files in bulk from the uploadCacheDirReader with
+// the compressType into the g.Cacher, using the [Goproxy.syncOptions]. The
+// import is reported to the g.OnCacheMutation whether it succeeds or not.
+func (g *Goproxy) syncCache(ctx context.Context, uploadCacheDirReader io.Reader, compressType string) error {
+	opts := g.syncOptions()
+	if g.OnCacheMutation == nil {
+		return g.Cacher.Sync(ctx, uploadCacheDirReader, compressType, opts)
+	}
+	completed := false
+	onComplete := opts.OnComplete
+	opts.OnComplete = func(ctx context.Context, result SyncResult) error {
+		completed = true
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "sync", Bytes: result.Bytes, Files: result.Files})
+		if onComplete != nil {
+			return onComplete(ctx, result)
+		}
+		return nil
+	}
+	err := g.Cacher.Sync(ctx, uploadCacheDirReader, compressType, opts)
+	if err != nil && !completed {
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "sync", Err: err})
+	}
+	return err
+}
+
+// syncCompressType returns the compress type of a bundle with the contentType
+// for [Cacher.Sync], resolving its aliases in the same way as [Cacher.Sync]
+// does (see [SyncOptions.ContentTypeAliases]). If the contentType is still
+// not canonical (e.g., "application/octet-stream"), the compress type is
+// guessed by the ".tar", ".tar.gz", ".tgz", or ".gz" extension of the name.
+func (g *Goproxy) syncCompressType(contentType, name string) string {
+	compressType := g.SyncOptions.compressType(contentType)
+	switch compressType {
+	case "application/gzip", "application/x-tar":
+		return compressType
+	}
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".gz"):
+		return "application/gzip"
+	case strings.HasSuffix(name, ".tar"):
+		return "application/x-tar"
+	}
+	return compressType
+}
+
 // logErrorf formats according to a format specifier and writes to the g.ErrorLogger.
 func (g *Goproxy) logErrorf(format string, v ...any) {
 	msg := "goproxy: " + fmt.Sprintf(format, v...)
@@ -542,6 +4483,78 @@ func (g *Goproxy) logErrorf(format string, v ...any) {
 	}
 }
 
+// checkRequestPath checks whether the p is a canonical request path that
+// does not end with a slash. The returned error describes why the p is
+// rejected, so that slightly malformed URLs result in sensible responses
+// rather than misparsed module paths.
+func checkRequestPath(p string) error {
+	if cp := cleanPath(p); cp != p {
+		if len(cp) > 1 {
+			cp = strings.TrimSuffix(cp, "/")
+		}
+		return fmt.Errorf("non-canonical path (did you mean %q?)", cp)
+	}
+	if p[len(p)-1] == '/' {
+		if strings.HasSuffix(p, "/@v/") {
+			return errors.New("missing file name after /@v/ (use /@v/list to list versions)")
+		}
+		return errors.New("unexpected trailing slash")
+	}
+	return nil
+}
+
+// limitedFetcher is a [Fetcher] that limits the number of concurrent fetches
+// of the underlying Fetcher.
+type limitedFetcher struct {
+	Fetcher
+	workerPool chan struct{}
+}
+
+// Query implements [Fetcher].
+func (lf *limitedFetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	release, err := acquireWorker(ctx, lf.workerPool)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer release()
+	return lf.Fetcher.Query(ctx, path, query)
+}
+
+// List implements [Fetcher].
+func (lf *limitedFetcher) List(ctx context.Context, path string) ([]string, error) {
+	release, err := acquireWorker(ctx, lf.workerPool)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return lf.Fetcher.List(ctx, path)
+}
+
+// Download implements [Fetcher].
+func (lf *limitedFetcher) Download(ctx context.Context, path, version string) (io.ReadSeekCloser, io.ReadSeekCloser, io.ReadSeekCloser, error) {
+	release, err := acquireWorker(ctx, lf.workerPool)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer release()
+	return lf.Fetcher.Download(ctx, path, version)
+}
+
+// acquireWorker acquires a worker from the workerPool, waiting until one is
+// available or the ctx is done. The returned function releases the worker. A
+// nil workerPool has no limit.
+func acquireWorker(ctx context.Context, workerPool chan struct{}) (func(), error) {
+	if workerPool == nil {
+		return func() {}, nil
+	}
+	select {
+	case workerPool <- struct{}{}:
+		return func() { <-workerPool }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // cleanPath returns the canonical path for the p.
 func cleanPath(p string) string {
 	if p == "" {
@@ -1,25 +1,39 @@
 package goproxy
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
 )
 
 func TestGoproxyInit(t *testing.T) {
@@ -52,6 +66,105 @@ func TestGoproxyInit(t *testing.T) {
 	}
 }
 
+func TestGoproxyTransportOptions(t *testing.T) {
+	g := &Goproxy{TempDir: t.TempDir(), TransportOptions: TransportOptions{MaxIdleConns: 1000, MaxIdleConnsPerHost: 100, IdleConnTimeout: time.Minute}}
+	g.initOnce.Do(g.init)
+	transport, ok := g.httpClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("got %T, want *http.Transport", g.httpClient.Transport)
+	}
+	if got, want := transport.MaxIdleConns, 1000; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := transport.MaxIdleConnsPerHost, 100; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := transport.IdleConnTimeout, time.Minute; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if gf, ok := g.baseFetcher.(*GoFetcher); !ok {
+		t.Fatalf("got %T, want *GoFetcher", g.baseFetcher)
+	} else if got, want := gf.Transport, http.RoundTripper(transport); got != want {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	customTransport := &http.Transport{}
+	g = &Goproxy{TempDir: t.TempDir(), Transport: customTransport, TransportOptions: TransportOptions{MaxIdleConns: 1000}}
+	g.initOnce.Do(g.init)
+	if got, want := g.httpClient.Transport, http.RoundTripper(customTransport); got != want {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got, want := customTransport.MaxIdleConns, 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyMaxConcurrentFetches(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+			},
+		},
+		MaxConcurrentFetches: 2,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc, err := g.GetOrFetch(context.Background(), fmt.Sprintf("example.com/m%d/@latest", i))
+			if err != nil {
+				t.Errorf("unexpected error %q", err)
+				return
+			}
+			rc.Close()
+		}(i)
+	}
+	wg.Wait()
+	if got, want := maxInFlight, 2; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	g = &Goproxy{
+		Fetcher: &testFetcher{
+			query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+				started <- struct{}{}
+				<-release
+				return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+			},
+		},
+		MaxConcurrentFetches: 1,
+	}
+	go g.GetOrFetch(context.Background(), "example.com/@latest")
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.GetOrFetch(ctx, "example.com/foo/@latest"); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	close(release)
+}
+
 func TestGoproxyServeHTTP(t *testing.T) {
 	proxyServer, setProxyHandler := newHTTPTestServer()
 	defer proxyServer.Close()
@@ -60,13 +173,16 @@ func TestGoproxyServeHTTP(t *testing.T) {
 		responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
 	})
 	for _, tt := range []struct {
-		n                int
-		method           string
-		path             string
-		wantStatusCode   int
-		wantContentType  string
-		wantCacheControl string
-		wantContent      string
+		n                 int
+		method            string
+		path              string
+		disableUploadPage bool
+		wantStatusCode    int
+		wantContentType   string
+		wantCacheControl  string
+		wantAllow         string
+		wantCompressions  string
+		wantContent       string
 	}{
 		{
 			n:                1,
@@ -91,15 +207,17 @@ func TestGoproxyServeHTTP(t *testing.T) {
 			wantStatusCode:   http.StatusMethodNotAllowed,
 			wantContentType:  "text/plain; charset=utf-8",
 			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, OPTIONS",
 			wantContent:      "method not allowed",
 		},
 		{
-			n:                4,
-			path:             "/",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found",
+			n:                 4,
+			path:              "/",
+			disableUploadPage: true,
+			wantStatusCode:    http.StatusOK,
+			wantContentType:   "text/plain; charset=utf-8",
+			wantCacheControl:  "public, max-age=86400",
+			wantContent:       "goproxy",
 		},
 		{
 			n:                5,
@@ -107,7 +225,7 @@ func TestGoproxyServeHTTP(t *testing.T) {
 			wantStatusCode:   http.StatusNotFound,
 			wantContentType:  "text/plain; charset=utf-8",
 			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found",
+			wantContent:      `not found: non-canonical path (did you mean "/"?)`,
 		},
 		{
 			n:                6,
@@ -115,7 +233,7 @@ func TestGoproxyServeHTTP(t *testing.T) {
 			wantStatusCode:   http.StatusNotFound,
 			wantContentType:  "text/plain; charset=utf-8",
 			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found",
+			wantContent:      `not found: non-canonical path (did you mean "/example.com/@latest"?)`,
 		},
 		{
 			n:                7,
@@ -123,7 +241,7 @@ func TestGoproxyServeHTTP(t *testing.T) {
 			wantStatusCode:   http.StatusNotFound,
 			wantContentType:  "text/plain; charset=utf-8",
 			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found",
+			wantContent:      "not found: unexpected trailing slash",
 		},
 		{
 			n:                8,
@@ -133,15 +251,154 @@ func TestGoproxyServeHTTP(t *testing.T) {
 			wantCacheControl: "public, max-age=86400",
 			wantContent:      "not found",
 		},
+		{
+			n:                9,
+			path:             "/example.com/@v/",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: missing file name after /@v/ (use /@v/list to list versions)",
+		},
+		{
+			n:                10,
+			path:             "//example.com/@latest",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: non-canonical path (did you mean "/example.com/@latest"?)`,
+		},
+		{
+			n:                11,
+			path:             "/example.com//@v/list",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: non-canonical path (did you mean "/example.com/@v/list"?)`,
+		},
+		{
+			n:                12,
+			path:             "/example.com/@v//",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: non-canonical path (did you mean "/example.com/@v"?)`,
+		},
+		{
+			n:                13,
+			method:           http.MethodPut,
+			path:             "/example.com/@v/v1.0.0.zip",
+			wantStatusCode:   http.StatusMethodNotAllowed,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, OPTIONS",
+			wantContent:      "method not allowed",
+		},
+		{
+			n:                14,
+			method:           http.MethodDelete,
+			path:             "/example.com/@v/list",
+			wantStatusCode:   http.StatusMethodNotAllowed,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, OPTIONS",
+			wantContent:      "method not allowed",
+		},
+		{
+			n:                15,
+			method:           http.MethodOptions,
+			path:             "/example.com/@latest",
+			wantStatusCode:   http.StatusNoContent,
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, OPTIONS",
+		},
+		{
+			n:                16,
+			method:           http.MethodOptions,
+			path:             "/",
+			wantStatusCode:   http.StatusNoContent,
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, POST, OPTIONS",
+			wantCompressions: "application/gzip, application/x-tar",
+		},
+		{
+			n:                17,
+			method:           http.MethodOptions,
+			path:             "/upload",
+			wantStatusCode:   http.StatusNoContent,
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, POST, OPTIONS",
+			wantCompressions: "application/gzip, application/x-tar",
+		},
+		{
+			n:                 18,
+			method:            http.MethodHead,
+			path:              "/",
+			disableUploadPage: true,
+			wantStatusCode:    http.StatusOK,
+			wantContentType:   "text/plain; charset=utf-8",
+			wantCacheControl:  "public, max-age=86400",
+		},
+		{
+			n:                19,
+			path:             "/favicon.ico",
+			wantStatusCode:   http.StatusNoContent,
+			wantCacheControl: "public, max-age=86400",
+		},
+		{
+			n:                20,
+			method:           http.MethodPost,
+			path:             "/favicon.ico",
+			wantStatusCode:   http.StatusMethodNotAllowed,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, OPTIONS",
+			wantContent:      "method not allowed",
+		},
+		{
+			n:                21,
+			path:             "/example.com/@latest?foo=bar",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      info,
+		},
+		{
+			n:                22,
+			path:             "/example.com/@upgrade?foo=bar",
+			wantStatusCode:   http.StatusBadRequest,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `bad request: unsupported version query "upgrade" (resolved by the go command itself)`,
+		},
+		{
+			n:                23,
+			method:           http.MethodPost,
+			path:             "/sumdb/sumdb.example.com/supported",
+			wantStatusCode:   http.StatusMethodNotAllowed,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, OPTIONS",
+			wantContent:      "method not allowed",
+		},
+		{
+			n:                24,
+			method:           http.MethodOptions,
+			path:             "/api/sync",
+			wantStatusCode:   http.StatusNoContent,
+			wantCacheControl: "public, max-age=86400",
+			wantAllow:        "GET, HEAD, POST, OPTIONS",
+			wantCompressions: "application/gzip, application/x-tar",
+		},
 	} {
 		g := &Goproxy{
 			Fetcher: &GoFetcher{
 				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
 				TempDir: t.TempDir(),
 			},
-			Cacher:      DirCacher(t.TempDir()),
-			TempDir:     t.TempDir(),
-			ErrorLogger: log.New(io.Discard, "", 0),
+			Cacher:            &DirCacher{Dir: t.TempDir()},
+			TempDir:           t.TempDir(),
+			DisableUploadPage: tt.disableUploadPage,
+			ErrorLogger:       log.New(io.Discard, "", 0),
 		}
 		rec := httptest.NewRecorder()
 		g.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
@@ -155,6 +412,12 @@ func TestGoproxyServeHTTP(t *testing.T) {
 		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
+		if got, want := recr.Header.Get("Allow"), tt.wantAllow; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("X-Goproxy-Sync-Compressions"), tt.wantCompressions; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
 		if b, err := io.ReadAll(recr.Body); err != nil {
 			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
 		} else if got, want := string(b), tt.wantContent; got != want {
@@ -163,652 +426,5914 @@ func TestGoproxyServeHTTP(t *testing.T) {
 	}
 }
 
-func TestGoproxyServeFetch(t *testing.T) {
-	proxyServer, setProxyHandler := newHTTPTestServer()
-	defer proxyServer.Close()
-	list := "v1.0.0"
-	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
-	mod := "module example.com"
-	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
-	if err != nil {
-		t.Fatalf("unexpected error %q", err)
-	}
-	setProxyHandler(func(rw http.ResponseWriter, req *http.Request) {
-		switch req.URL.Path {
-		case "/example.com/@latest":
-			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
-		case "/example.com/@v/list":
-			responseSuccess(rw, req, strings.NewReader(list), "text/plain; charset=utf-8", -2)
-		default:
-			switch path.Ext(req.URL.Path) {
-			case ".info":
-				responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
-			case ".mod":
-				responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
-			case ".zip":
-				responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
-			default:
-				responseNotFound(rw, req, -2)
-			}
-		}
-	})
+func TestGoproxyLandingPage(t *testing.T) {
+	var logBuf strings.Builder
 	for _, tt := range []struct {
-		n                  int
-		cacher             Cacher
-		target             string
-		disableModuleFetch bool
-		wantStatusCode     int
-		wantContentType    string
-		wantCacheControl   string
-		wantContent        string
+		n                 int
+		landingPage       string
+		disableUploadPage bool
+		path              string
+		wantStatusCode    int
+		wantContentType   string
+		wantContent       string
 	}{
-		{
-			n:                1,
-			target:           "example.com/@latest",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      info,
-		},
-		{
-			n: 2,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(info)), nil
+		{1, "", true, "/", http.StatusOK, "text/plain; charset=utf-8", "goproxy"},
+		{2, "Go module proxy of example.com", true, "/", http.StatusOK, "text/plain; charset=utf-8", "Go module proxy of example.com"},
+		{3, "", false, "/", http.StatusOK, "text/html; charset=utf-8", ""},
+		{4, "", true, "/favicon.ico", http.StatusNoContent, "", ""},
+		{5, "", false, "/favicon.ico", http.StatusNoContent, "", ""},
+	} {
+		fetches := 0
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetches++
+					return "", time.Time{}, errors.New("unexpected fetch")
 				},
-			},
-			target:             "example.com/@latest",
-			disableModuleFetch: true,
-			wantStatusCode:     http.StatusOK,
-			wantContentType:    "application/json; charset=utf-8",
-			wantCacheControl:   "public, max-age=60",
-			wantContent:        info,
-		},
-		{
-			n:                3,
-			target:           "example.com/@v/list",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      list,
-		},
-		{
-			n: 4,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(list)), nil
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetches++
+					return nil, errors.New("unexpected fetch")
 				},
-			},
-			target:             "example.com/@v/list",
-			disableModuleFetch: true,
-			wantStatusCode:     http.StatusOK,
-			wantContentType:    "text/plain; charset=utf-8",
-			wantCacheControl:   "public, max-age=60",
-			wantContent:        list,
-		},
-		{
-			n:                5,
-			target:           "example.com/@v/v1.0.0.info",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      info,
-		},
-		{
-			n: 6,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(info)), nil
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					fetches++
+					return nil, nil, nil, errors.New("unexpected fetch")
 				},
 			},
-			target:             "example.com/@v/v1.0.0.info",
-			disableModuleFetch: true,
-			wantStatusCode:     http.StatusOK,
-			wantContentType:    "application/json; charset=utf-8",
-			wantCacheControl:   "public, max-age=604800",
-			wantContent:        info,
-		},
-		{
-			n:                7,
-			target:           "example.com/@v/v1.info",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      info,
-		},
-		{
-			n:                8,
-			target:           "example.com/@v/v1.0.info",
+			LandingPage:       tt.landingPage,
+			DisableUploadPage: tt.disableUploadPage,
+			ErrorLogger:       log.New(&logBuf, "", 0),
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Type"), tt.wantContentType; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.path == "/" && !tt.disableUploadPage {
+			if got, want := rec.Body.String(), `<form id="uploadForm"`; !strings.Contains(got, want) {
+				t.Errorf("test(%d): got %q, want it to contain %q", tt.n, got, want)
+			}
+		} else if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := fetches, 0; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+	if got, want := logBuf.String(), ""; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyPathPrefix(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n              int
+		pathPrefix     string
+		path           string
+		wantStatusCode int
+		wantContent    string
+		wantModulePath string
+	}{
+		{1, "", "/example.com/@latest", http.StatusOK, info, "example.com"},
+		{2, "", "/goproxy/example.com/@latest", http.StatusNotFound, `not found: invalid escaped module path "goproxy/example.com": malformed module path "goproxy/example.com": missing dot in first path element`, ""},
+		{3, "/goproxy", "/goproxy/example.com/@latest", http.StatusOK, info, "example.com"},
+		{4, "goproxy/", "/goproxy/example.com/@latest", http.StatusOK, info, "example.com"},
+		{5, "/goproxy/", "/goproxy/example.com/!foo/@latest", http.StatusOK, info, "example.com/Foo"},
+		{6, "/a/b", "/a/b/example.com/@latest", http.StatusOK, info, "example.com"},
+		{7, "/goproxy", "/example.com/@latest", http.StatusNotFound, "not found", ""},
+		{8, "/goproxy", "/goproxyexample.com/@latest", http.StatusNotFound, "not found", ""},
+		{9, "/goproxy", "/goproxy/../example.com/@latest", http.StatusNotFound, `not found: non-canonical path (did you mean "/example.com/@latest"?)`, ""},
+	} {
+		var gotModulePath string
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					gotModulePath = path
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+			},
+			ErrorLogger: log.New(io.Discard, "", 0),
+			PathPrefix:  tt.pathPrefix,
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("", "/", nil)
+		req.URL.Path = tt.path
+		g.ServeHTTP(rec, req)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := gotModulePath, tt.wantModulePath; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyAllowedPrefixes(t *testing.T) {
+	sumdbServer, setSumDBHandler := newHTTPTestServer()
+	defer sumdbServer.Close()
+	setSumDBHandler(func(rw http.ResponseWriter, req *http.Request) { fmt.Fprint(rw, req.URL.Path) })
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n               int
+		allowedPrefixes []string
+		path            string
+		wantStatusCode  int
+		wantContent     string
+		wantFetched     bool
+	}{
+		{1, nil, "/example.com/foo/@latest", http.StatusOK, info, true},
+		{2, []string{"github.com/ourorg", "golang.org/x"}, "/github.com/ourorg/foo/@latest", http.StatusOK, info, true},
+		{3, []string{"github.com/ourorg", "golang.org/x"}, "/golang.org/x/mod/@v/list", http.StatusOK, "v1.0.0", true},
+		{4, []string{"github.com/ourorg", "golang.org/x"}, "/github.com/otherorg/foo/@latest", http.StatusForbidden, "forbidden: module path not allowed", false},
+		{5, []string{"github.com/ourorg", "golang.org/x"}, "/github.com/ourorgfoo/@v/v1.0.0.info", http.StatusForbidden, "forbidden: module path not allowed", false},
+		{6, []string{" *.corp.example.com "}, "/git.corp.example.com/foo/@v/v1.0.0.info", http.StatusOK, info, true},
+		{7, []string{"*.corp.example.com"}, "/corp.example.com/foo/@v/v1.0.0.info", http.StatusForbidden, "forbidden: module path not allowed", false},
+		{8, []string{"golang.org/x"}, "/sumdb/sumdb.example.com/lookup/golang.org/x/mod@v1.0.0", http.StatusOK, "/lookup/golang.org/x/mod@v1.0.0", false},
+		{9, []string{"golang.org/x"}, "/sumdb/sumdb.example.com/lookup/example.com@v1.0.0", http.StatusForbidden, "forbidden: module path not allowed", false},
+		{10, []string{"golang.org/x"}, "/sumdb/sumdb.example.com/tile/2/0/0", http.StatusOK, "/tile/2/0/0", false},
+	} {
+		var fetched bool
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetched = true
+					return unmarshalInfo(info)
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetched = true
+					return []string{"v1.0.0"}, nil
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					fetched = true
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			ProxiedSumDBs:   []string{"sumdb.example.com " + sumdbServer.URL},
+			Cacher:          &DirCacher{Dir: t.TempDir()},
+			TempDir:         t.TempDir(),
+			ErrorLogger:     log.New(io.Discard, "", 0),
+			AllowedPrefixes: tt.allowedPrefixes,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := fetched, tt.wantFetched; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyMaxModuleLength(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	longPath := "example.com/" + strings.Repeat("abcdefghi/", 102) + "a"
+	longVersion := "v1.0.0-" + strings.Repeat("a", 256)
+	for _, tt := range []struct {
+		n                int
+		maxPathLength    int
+		maxVersionLength int
+		path             string
+		wantStatusCode   int
+		wantContent      string
+		wantFetched      bool
+	}{
+		{1, 0, 0, "/example.com/@v/v1.0.0.info", http.StatusOK, info, true},
+		{2, 0, 0, "/" + longPath + "/@v/list", http.StatusBadRequest, "bad request: module path too long: more than 1024 bytes", false},
+		{3, 0, 0, "/" + longPath + "/@latest", http.StatusBadRequest, "bad request: module path too long: more than 1024 bytes", false},
+		{4, 0, 0, "/example.com/@v/" + longVersion + ".info", http.StatusBadRequest, "bad request: module version too long: more than 256 bytes", false},
+		{5, 0, 0, "/example.com/@v/" + longVersion + ".zip", http.StatusBadRequest, "bad request: module version too long: more than 256 bytes", false},
+		{6, 0, 0, "/example.com/@v/" + longVersion + ".ziphash", http.StatusBadRequest, "bad request: module version too long: more than 256 bytes", false},
+		{7, 11, 0, "/example.com/@v/v1.0.0.info", http.StatusOK, info, true},
+		{8, 10, 0, "/example.com/@v/v1.0.0.info", http.StatusBadRequest, "bad request: module path too long: more than 10 bytes", false},
+		{9, 0, 5, "/example.com/@v/v1.0.0.info", http.StatusBadRequest, "bad request: module version too long: more than 5 bytes", false},
+		{10, -1, 0, "/" + longPath + "/@v/v1.0.0.info", http.StatusOK, info, true},
+	} {
+		var fetched bool
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetched = true
+					return unmarshalInfo(info)
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetched = true
+					return []string{"v1.0.0"}, nil
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					fetched = true
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:                 &DirCacher{Dir: t.TempDir()},
+			TempDir:                t.TempDir(),
+			ErrorLogger:            log.New(io.Discard, "", 0),
+			ServeZipHashes:         true,
+			MaxModulePathLength:    tt.maxPathLength,
+			MaxModuleVersionLength: tt.maxVersionLength,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := fetched, tt.wantFetched; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestRequestInfoFromContext(t *testing.T) {
+	var gotInfos []*RequestInfo
+	record := func(ctx context.Context) { gotInfos = append(gotInfos, RequestInfoFromContext(ctx)) }
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+				record(ctx)
+				return "", time.Time{}, fs.ErrNotExist
+			},
+			list: func(ctx context.Context, path string) ([]string, error) {
+				record(ctx)
+				return nil, fs.ErrNotExist
+			},
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				record(ctx)
+				return nil, nil, nil, fs.ErrNotExist
+			},
+		},
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	for _, tt := range []struct {
+		n        int
+		path     string
+		wantInfo *RequestInfo
+	}{
+		{
+			n:        1,
+			path:     "/example.com/!foo/@v/list",
+			wantInfo: &RequestInfo{ModulePath: "example.com/Foo", Operation: "list"},
+		},
+		{
+			n:        2,
+			path:     "/example.com/@latest",
+			wantInfo: &RequestInfo{ModulePath: "example.com", Version: "latest", Operation: "query"},
+		},
+		{
+			n:        3,
+			path:     "/example.com/@v/master.info",
+			wantInfo: &RequestInfo{ModulePath: "example.com", Version: "master", Operation: "query"},
+		},
+		{
+			n:        4,
+			path:     "/example.com/@v/v1.0.0-!r!c1.zip",
+			wantInfo: &RequestInfo{ModulePath: "example.com", Version: "v1.0.0-RC1", Operation: "download"},
+		},
+	} {
+		gotInfos = nil
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got, want := len(gotInfos), 1; got != want {
+			t.Fatalf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := gotInfos[0], tt.wantInfo; got == nil || *got != *want {
+			t.Errorf("test(%d): got %+v, want %+v", tt.n, got, want)
+		}
+	}
+
+	if got := RequestInfoFromContext(context.Background()); got != nil {
+		t.Errorf("got %+v, want nil", got)
+	}
+}
+
+func TestGoproxyUpstreamHeader(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	primaryServer, setPrimaryHandler := newHTTPTestServer()
+	defer primaryServer.Close()
+	setPrimaryHandler(func(rw http.ResponseWriter, req *http.Request) {
+		responseNotFound(rw, req, -2)
+	})
+	secondaryServer, setSecondaryHandler := newHTTPTestServer()
+	defer secondaryServer.Close()
+	setSecondaryHandler(func(rw http.ResponseWriter, req *http.Request) {
+		responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+	})
+	for _, tt := range []struct {
+		n            int
+		debugHeaders bool
+		cached       bool
+		wantUpstream string
+	}{
+		{1, true, false, secondaryServer.URL},
+		{2, true, true, ""},
+		{3, false, false, ""},
+	} {
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + primaryServer.URL + "," + secondaryServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:          &DirCacher{Dir: t.TempDir()},
+			ErrorLogger:     log.New(io.Discard, "", 0),
+			DebugHeaders:    tt.debugHeaders,
+			MutableCacheTTL: time.Hour,
+		}
+		if tt.cached {
+			g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/example.com/@latest", nil))
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/@latest", nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("X-Goproxy-Upstream"), tt.wantUpstream; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyErrorResponder(t *testing.T) {
+	errorResponder := func(rw http.ResponseWriter, req *http.Request, status int, err error) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		fmt.Fprintf(rw, `{"error":%q,"notExist":%t}`, err, errors.Is(err, fs.ErrNotExist))
+	}
+	for _, tt := range []struct {
+		n                int
+		method           string
+		path             string
+		errorResponder   func(rw http.ResponseWriter, req *http.Request, status int, err error)
+		wantStatusCode   int
+		wantContentType  string
+		wantCacheControl string
+		wantContent      string
+	}{
+		{
+			n:                1,
+			path:             "/example.com/@v/v1.0.0.info",
+			errorResponder:   errorResponder,
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "application/json",
+			wantCacheControl: "public, max-age=600",
+			wantContent:      `{"error":"not found: unknown revision","notExist":true}`,
+		},
+		{
+			n:                2,
+			path:             "/example.com/@v/master.mod",
+			errorResponder:   errorResponder,
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "application/json",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `{"error":"not found: unrecognized version","notExist":false}`,
+		},
+		{
+			n:                3,
+			path:             "/example.com/@latest",
+			errorResponder:   errorResponder,
+			wantStatusCode:   http.StatusInternalServerError,
+			wantContentType:  "application/json",
+			wantCacheControl: "",
+			wantContent:      `{"error":"internal server error","notExist":false}`,
+		},
+		{
+			n:                4,
+			method:           http.MethodPut,
+			path:             "/example.com/@latest",
+			errorResponder:   errorResponder,
+			wantStatusCode:   http.StatusMethodNotAllowed,
+			wantContentType:  "application/json",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `{"error":"method not allowed","notExist":false}`,
+		},
+		{
+			n:                5,
+			path:             "/example.com/@v/v1.0.0.info",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=600",
+			wantContent:      "not found: unknown revision",
+		},
+	} {
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					return "", time.Time{}, errors.New("internal")
+				},
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					return nil, nil, nil, notExistErrorf("unknown revision")
+				},
+			},
+			ErrorLogger:    log.New(io.Discard, "", 0),
+			ErrorResponder: tt.errorResponder,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyServeFetch(t *testing.T) {
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	list := "v1.0.0"
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	setProxyHandler(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/example.com/@latest":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		case "/example.com/@v/list":
+			responseSuccess(rw, req, strings.NewReader(list), "text/plain; charset=utf-8", -2)
+		default:
+			switch path.Ext(req.URL.Path) {
+			case ".info":
+				responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+			case ".mod":
+				responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
+			case ".zip":
+				responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
+			default:
+				responseNotFound(rw, req, -2)
+			}
+		}
+	})
+	for _, tt := range []struct {
+		n                  int
+		cacher             Cacher
+		target             string
+		disableModuleFetch bool
+		wantStatusCode     int
+		wantContentType    string
+		wantCacheControl   string
+		wantContent        string
+	}{
+		{
+			n:                1,
+			target:           "example.com/@latest",
 			wantStatusCode:   http.StatusOK,
 			wantContentType:  "application/json; charset=utf-8",
 			wantCacheControl: "public, max-age=60",
 			wantContent:      info,
 		},
 		{
-			n:                9,
-			target:           "example.com/@v/master.info",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      info,
+			n: 2,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			target:             "example.com/@latest",
+			disableModuleFetch: true,
+			wantStatusCode:     http.StatusOK,
+			wantContentType:    "application/json; charset=utf-8",
+			wantCacheControl:   "public, max-age=60",
+			wantContent:        info,
+		},
+		{
+			n:                3,
+			target:           "example.com/@v/list",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      list,
+		},
+		{
+			n: 4,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(list)), nil
+				},
+			},
+			target:             "example.com/@v/list",
+			disableModuleFetch: true,
+			wantStatusCode:     http.StatusOK,
+			wantContentType:    "text/plain; charset=utf-8",
+			wantCacheControl:   "public, max-age=60",
+			wantContent:        list,
+		},
+		{
+			n:                5,
+			target:           "example.com/@v/v1.0.0.info",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      info,
+		},
+		{
+			n: 6,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			target:             "example.com/@v/v1.0.0.info",
+			disableModuleFetch: true,
+			wantStatusCode:     http.StatusOK,
+			wantContentType:    "application/json; charset=utf-8",
+			wantCacheControl:   "public, max-age=604800",
+			wantContent:        info,
+		},
+		{
+			n:                7,
+			target:           "example.com/@v/v1.info",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      info,
+		},
+		{
+			n:                8,
+			target:           "example.com/@v/v1.0.info",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      info,
+		},
+		{
+			n:                9,
+			target:           "example.com/@v/master.info",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      info,
+		},
+		{
+			n:                10,
+			target:           "example.com/@v/v1.0.0.mod",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      mod,
+		},
+		{
+			n: 11,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(mod)), nil
+				},
+			},
+			target:             "example.com/@v/v1.0.0.mod",
+			disableModuleFetch: true,
+			wantStatusCode:     http.StatusOK,
+			wantContentType:    "text/plain; charset=utf-8",
+			wantCacheControl:   "public, max-age=604800",
+			wantContent:        mod,
+		},
+		{
+			n:                12,
+			target:           "example.com/@v/v1.0.0.zip",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/zip",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      string(zip),
+		},
+		{
+			n: 13,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(zip)), nil
+				},
+			},
+			target:             "example.com/@v/v1.0.0.zip",
+			disableModuleFetch: true,
+			wantStatusCode:     http.StatusOK,
+			wantContentType:    "application/zip",
+			wantCacheControl:   "public, max-age=604800",
+			wantContent:        string(zip),
+		},
+		{
+			n:                14,
+			target:           "example.com",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: missing /@v/",
+		},
+		{
+			n:                15,
+			target:           "example.com/@/",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: missing /@v/",
+		},
+		{
+			n:                16,
+			target:           "foobar/@latest",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: invalid escaped module path "foobar": malformed module path "foobar": missing dot in first path element`,
+		},
+		{
+			n:                17,
+			target:           "example.com/@v/foobar",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: no file extension in filename "foobar"`,
+		},
+		{
+			n:                18,
+			target:           "example.com/@v/foo.bar",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: unexpected extension ".bar"`,
+		},
+		{
+			n:                19,
+			target:           "example.com/@v/!!v1.0.0.info",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: invalid escaped version "!!v1.0.0"`,
+		},
+		{
+			n:                20,
+			target:           "example.com/@v/latest.info",
+			wantStatusCode:   http.StatusBadRequest,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `bad request: unsupported version query "latest" (use /@latest)`,
+		},
+		{
+			n:                21,
+			target:           "example.com/@v/upgrade.info",
+			wantStatusCode:   http.StatusBadRequest,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `bad request: unsupported version query "upgrade" (resolved by the go command itself)`,
+		},
+		{
+			n:                22,
+			target:           "example.com/@v/patch.info",
+			wantStatusCode:   http.StatusBadRequest,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `bad request: unsupported version query "patch" (resolved by the go command itself)`,
+		},
+		{
+			n:                23,
+			target:           "example.com/@v/master.mod",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: unrecognized version",
+		},
+		{
+			n:                24,
+			target:           "example.com/@upgrade",
+			wantStatusCode:   http.StatusBadRequest,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `bad request: unsupported version query "upgrade" (resolved by the go command itself)`,
+		},
+		{
+			n:                25,
+			target:           "example.com/@patch",
+			wantStatusCode:   http.StatusBadRequest,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `bad request: unsupported version query "patch" (resolved by the go command itself)`,
+		},
+		{
+			n:                26,
+			target:           "example.com/@v/latest.mod",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: invalid version",
+		},
+		{
+			n:                27,
+			target:           "example.com/@v/list/v1.0.0.info",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: unexpected slash in filename "list/v1.0.0.info"`,
+		},
+		{
+			n:                28,
+			target:           "example.com/@v/feature/foo.info",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: unexpected slash in filename "feature/foo.info"`,
+		},
+		{
+			n:                29,
+			target:           "example.com/@latest/v1.0.0.info",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: missing /@v/",
+		},
+		{
+			n:                30,
+			target:           "example.com/@v/listing",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      `not found: no file extension in filename "listing"`,
+		},
+		{
+			n:                31,
+			target:           "example.com/@v/v1.0.0.info.zip",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "not found: unrecognized version",
+		},
+	} {
+		if tt.cacher == nil {
+			tt.cacher = &DirCacher{Dir: t.TempDir()}
+		}
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:      tt.cacher,
+			TempDir:     t.TempDir(),
+			ErrorLogger: log.New(io.Discard, "", 0),
+		}
+		g.initOnce.Do(g.init)
+		req := httptest.NewRequest("", "/", nil)
+		if tt.disableModuleFetch {
+			req.Header.Set("Disable-Module-Fetch", "true")
+		}
+		rec := httptest.NewRecorder()
+		g.serveFetch(rec, req, tt.target)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyServeFetchQuery(t *testing.T) {
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
+		responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+	}
+	for _, tt := range []struct {
+		n                int
+		proxyHandler     http.HandlerFunc
+		cacher           Cacher
+		noFetch          bool
+		wantStatusCode   int
+		wantContentType  string
+		wantCacheControl string
+		wantContent      string
+	}{
+		{
+			n:                1,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      info,
+		},
+		{
+			n: 2,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			noFetch:          true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      info,
+		},
+		{
+			n:                3,
+			proxyHandler:     func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      "not found",
+		},
+	} {
+		if tt.proxyHandler == nil {
+			tt.proxyHandler = proxyHandler
+		}
+		setProxyHandler(tt.proxyHandler)
+		if tt.cacher == nil {
+			tt.cacher = &DirCacher{Dir: t.TempDir()}
+		}
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:      tt.cacher,
+			TempDir:     t.TempDir(),
+			ErrorLogger: log.New(io.Discard, "", 0),
+		}
+		g.initOnce.Do(g.init)
+		rec := httptest.NewRecorder()
+		g.serveFetchQuery(rec, httptest.NewRequest("", "/", nil), "example.com/@latest", "example.com", "latest", tt.noFetch)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyServeFetchList(t *testing.T) {
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	list := "v1.0.0\nv1.1.0"
+	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
+		responseSuccess(rw, req, strings.NewReader(list), "text/plain; charset=utf-8", -2)
+	}
+	for _, tt := range []struct {
+		n              int
+		proxyHandler   http.HandlerFunc
+		cacher         Cacher
+		noFetch        bool
+		wantStatusCode int
+		wantContent    string
+	}{
+		{
+			n:              1,
+			wantStatusCode: http.StatusOK,
+			wantContent:    list,
+		},
+		{
+			n: 2,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(list)), nil
+				},
+			},
+			noFetch:        true,
+			wantStatusCode: http.StatusOK,
+			wantContent:    list,
+		},
+		{
+			n:              3,
+			proxyHandler:   func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    "not found",
+		},
+	} {
+		if tt.proxyHandler == nil {
+			tt.proxyHandler = proxyHandler
+		}
+		setProxyHandler(tt.proxyHandler)
+		if tt.cacher == nil {
+			tt.cacher = &DirCacher{Dir: t.TempDir()}
+		}
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:      tt.cacher,
+			TempDir:     t.TempDir(),
+			ErrorLogger: log.New(io.Discard, "", 0),
+		}
+		g.initOnce.Do(g.init)
+		rec := httptest.NewRecorder()
+		g.serveFetchList(rec, httptest.NewRequest("", "/", nil), "example.com/@v/list", "example.com", tt.noFetch)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	versions := []string{"v1.1.0", "v0.0.0-20200101000000-000000000000", "v1.0.0", "v1.2.0-rc.1", "v1.0.1", "v2.0.0+incompatible"}
+	for _, tt := range []struct {
+		n    int
+		lo   ListOptions
+		want string
+	}{
+		{1, ListOptions{}, "v1.1.0,v0.0.0-20200101000000-000000000000,v1.0.0,v1.2.0-rc.1,v1.0.1,v2.0.0+incompatible"},
+		{2, ListOptions{Descending: true}, "v1.1.0,v0.0.0-20200101000000-000000000000,v1.0.0,v1.2.0-rc.1,v1.0.1,v2.0.0+incompatible"},
+		{3, ListOptions{Sort: true}, "v0.0.0-20200101000000-000000000000,v1.0.0,v1.0.1,v1.1.0,v1.2.0-rc.1,v2.0.0+incompatible"},
+		{4, ListOptions{Sort: true, Descending: true}, "v2.0.0+incompatible,v1.2.0-rc.1,v1.1.0,v1.0.1,v1.0.0,v0.0.0-20200101000000-000000000000"},
+		{5, ListOptions{ExcludePrereleases: true}, "v1.1.0,v0.0.0-20200101000000-000000000000,v1.0.0,v1.0.1,v2.0.0+incompatible"},
+		{6, ListOptions{ExcludePseudoVersions: true}, "v1.1.0,v1.0.0,v1.2.0-rc.1,v1.0.1,v2.0.0+incompatible"},
+		{7, ListOptions{ExcludePrereleases: true, ExcludePseudoVersions: true}, "v1.1.0,v1.0.0,v1.0.1,v2.0.0+incompatible"},
+		{8, ListOptions{Sort: true, ExcludePrereleases: true}, "v0.0.0-20200101000000-000000000000,v1.0.0,v1.0.1,v1.1.0,v2.0.0+incompatible"},
+		{9, ListOptions{Sort: true, ExcludePseudoVersions: true}, "v1.0.0,v1.0.1,v1.1.0,v1.2.0-rc.1,v2.0.0+incompatible"},
+		{10, ListOptions{Sort: true, Descending: true, ExcludePrereleases: true, ExcludePseudoVersions: true}, "v2.0.0+incompatible,v1.1.0,v1.0.1,v1.0.0"},
+	} {
+		got := tt.lo.apply(append([]string(nil), versions...))
+		if got, want := strings.Join(got, ","), tt.want; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			list: func(ctx context.Context, path string) ([]string, error) {
+				return append([]string(nil), versions...), nil
+			},
+		},
+		Cacher:      &DirCacher{Dir: t.TempDir()},
+		ListOptions: ListOptions{Sort: true, Descending: true, ExcludePseudoVersions: true},
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/list", nil))
+	recr := rec.Result()
+	if got, want := recr.StatusCode, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "v2.0.0+incompatible\nv1.2.0-rc.1\nv1.1.0\nv1.0.1\nv1.0.0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyServeFetchDownload(t *testing.T) {
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
+		switch path.Ext(req.URL.Path) {
+		case ".info":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		case ".mod":
+			responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
+		case ".zip":
+			responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
+		default:
+			responseNotFound(rw, req, -2)
+		}
+	}
+	for _, tt := range []struct {
+		n                int
+		proxyHandler     http.HandlerFunc
+		cacher           Cacher
+		target           string
+		noFetch          bool
+		debugHeaders     bool
+		zipDisposition   bool
+		wantStatusCode   int
+		wantContentType  string
+		wantCacheControl string
+		wantXCache       string
+		wantDisposition  string
+		wantContent      string
+	}{
+		{
+			n:                1,
+			target:           "example.com/@v/v1.0.0.info",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      info,
+		},
+		{
+			n: 2,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			target:           "example.com/@v/v1.0.0.info",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      info,
+		},
+		{
+			n: 3,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			target:           "example.com/@v/v1.0.0.info",
+			noFetch:          true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      info,
+		},
+		{
+			n:                4,
+			target:           "example.com/@v/v1.0.0.mod",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      mod,
+		},
+		{
+			n:                5,
+			target:           "example.com/@v/v1.0.0.zip",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/zip",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      string(zip),
+		},
+		{
+			n:                6,
+			proxyHandler:     func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
+			target:           "example.com/@v/v1.0.0.info",
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=600",
+			wantContent:      "not found",
+		},
+		{
+			n:                7,
+			target:           "example.com/@v/v1.0.0.info",
+			noFetch:          true,
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      "not found: temporarily unavailable",
+		},
+		{
+			n: 8,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return nil, errors.New("cannot get")
+				},
+			},
+			target:          "example.com/@v/v1.0.0.info",
+			wantStatusCode:  http.StatusInternalServerError,
+			wantContentType: "text/plain; charset=utf-8",
+			wantContent:     "internal server error",
+		},
+		{
+			n: 9,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					return errors.New("cannot put")
+				},
+			},
+			target:          "example.com/@v/v1.0.0.info",
+			wantStatusCode:  http.StatusInternalServerError,
+			wantContentType: "text/plain; charset=utf-8",
+			wantContent:     "internal server error",
+		},
+		{
+			n: 10,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					if path.Ext(name) == ".zip" {
+						return errors.New("cannot put")
+					}
+					return c.Put(ctx, name, content)
+				},
+			},
+			target:          "example.com/@v/v1.0.0.mod",
+			wantStatusCode:  http.StatusInternalServerError,
+			wantContentType: "text/plain; charset=utf-8",
+			wantContent:     "internal server error",
+		},
+		{
+			n:                11,
+			target:           "example.com/@v/v1.0.0.info",
+			debugHeaders:     true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantXCache:       "MISS",
+			wantContent:      info,
+		},
+		{
+			n: 12,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			target:           "example.com/@v/v1.0.0.info",
+			debugHeaders:     true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantXCache:       "HIT",
+			wantContent:      info,
+		},
+		{
+			n: 13,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(info)), nil
+				},
+			},
+			target:           "example.com/@v/v1.0.0.info",
+			noFetch:          true,
+			debugHeaders:     true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/json; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantXCache:       "HIT",
+			wantContent:      info,
+		},
+		{
+			n:                14,
+			target:           "example.com/@v/v1.0.0.zip",
+			zipDisposition:   true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/zip",
+			wantCacheControl: "public, max-age=604800",
+			wantDisposition:  `attachment; filename="example.com@v1.0.0.zip"`,
+			wantContent:      string(zip),
+		},
+		{
+			n: 15,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(zip)), nil
+				},
+			},
+			target:           "example.com/foo/!bar/@v/v1.0.0+incompatible.zip",
+			zipDisposition:   true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/zip",
+			wantCacheControl: "public, max-age=604800",
+			wantDisposition:  `attachment; filename="example.com_foo_Bar@v1.0.0+incompatible.zip"`,
+			wantContent:      string(zip),
+		},
+		{
+			n:                16,
+			target:           "example.com/@v/v1.0.0.mod",
+			zipDisposition:   true,
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=604800",
+			wantContent:      mod,
+		},
+		{
+			n:                17,
+			target:           "example.com/@v/v1.0.0.zip",
+			noFetch:          true,
+			zipDisposition:   true,
+			wantStatusCode:   http.StatusNotFound,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=60",
+			wantContent:      "not found: temporarily unavailable",
+		},
+	} {
+		if tt.proxyHandler == nil {
+			tt.proxyHandler = proxyHandler
+		}
+		setProxyHandler(tt.proxyHandler)
+		if tt.cacher == nil {
+			tt.cacher = &DirCacher{Dir: t.TempDir()}
+		}
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:                tt.cacher,
+			TempDir:               t.TempDir(),
+			ErrorLogger:           log.New(io.Discard, "", 0),
+			DebugHeaders:          tt.debugHeaders,
+			ZipContentDisposition: tt.zipDisposition,
+		}
+		g.initOnce.Do(g.init)
+		escapedModulePath, after, ok := strings.Cut(tt.target, "/@v/")
+		if !ok {
+			t.Fatalf("test(%d): invalid target %q", tt.n, tt.target)
+		}
+		modulePath, err := module.UnescapePath(escapedModulePath)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		moduleVersion, err := module.UnescapeVersion(strings.TrimSuffix(after, path.Ext(after)))
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		rec := httptest.NewRecorder()
+		g.serveFetchDownload(rec, httptest.NewRequest("", "/", nil), tt.target, modulePath, moduleVersion, tt.noFetch)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("X-Cache"), tt.wantXCache; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Disposition"), tt.wantDisposition; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyMajorVersionModules(t *testing.T) {
+	var downloads []string
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			list: func(ctx context.Context, path string) ([]string, error) {
+				switch path {
+				case "example.com/Foo":
+					return []string{"v1.0.0", "v2.0.0+incompatible"}, nil
+				case "example.com/Foo/v2":
+					return []string{"v2.0.0", "v2.1.0"}, nil
+				}
+				return nil, fs.ErrNotExist
+			},
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				downloads = append(downloads, path+"@"+version)
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher:      &DirCacher{Dir: t.TempDir()},
+		TempDir:     t.TempDir(),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	for _, tt := range []struct {
+		n              int
+		path           string
+		wantStatusCode int
+		wantContent    string
+		wantCacheName  string
+		wantDownload   string
+	}{
+		{
+			n:              1,
+			path:           "/example.com/!foo/v2/@v/v2.1.0.mod",
+			wantStatusCode: http.StatusOK,
+			wantContent:    "module example.com/Foo/v2",
+			wantCacheName:  "example.com/!foo/v2/@v/v2.1.0.mod",
+			wantDownload:   "example.com/Foo/v2@v2.1.0",
+		},
+		{
+			n:              2,
+			path:           "/example.com/!foo/@v/v2.0.0+incompatible.mod",
+			wantStatusCode: http.StatusOK,
+			wantContent:    "module example.com/Foo",
+			wantCacheName:  "example.com/!foo/@v/v2.0.0+incompatible.mod",
+			wantDownload:   "example.com/Foo@v2.0.0+incompatible",
+		},
+		{
+			n:              3,
+			path:           "/example.com/!foo/v2/@v/list",
+			wantStatusCode: http.StatusOK,
+			wantContent:    "v2.0.0\nv2.1.0",
+			wantCacheName:  "example.com/!foo/v2/@v/list",
+		},
+		{
+			n:              4,
+			path:           "/example.com/!foo/@v/list",
+			wantStatusCode: http.StatusOK,
+			wantContent:    "v1.0.0\nv2.0.0+incompatible",
+			wantCacheName:  "example.com/!foo/@v/list",
+		},
+		{
+			n:              5,
+			path:           "/example.com/!foo/v2/@v/v1.0.0.mod",
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			n:              6,
+			path:           "/example.com/!foo/@v/v2.0.0.mod",
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			n:              7,
+			path:           "/example.com/!foo/v2/@v/v2.0.0+incompatible.mod",
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			n:              8,
+			path:           "/example.com/!foo/@v/v1.0.0+incompatible.mod",
+			wantStatusCode: http.StatusNotFound,
+		},
+	} {
+		downloads = nil
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := strings.Join(downloads, ","), tt.wantDownload; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.wantStatusCode != http.StatusOK {
+			continue
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		rc, err := g.Cacher.Get(context.Background(), tt.wantCacheName)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyRetractedVersions(t *testing.T) {
+	latestMod := `module example.com
+
+retract v1.0.1 // Published accidentally.
+
+retract [v1.0.2, v1.0.5]
+`
+	for _, tt := range []struct {
+		n              int
+		warn           bool
+		reject         bool
+		version        string
+		wantStatusCode int
+		wantRetracted  string
+	}{
+		{1, true, false, "v1.0.0", http.StatusOK, ""},
+		{2, true, false, "v1.0.1", http.StatusOK, "Published accidentally."},
+		{3, true, false, "v1.0.3", http.StatusOK, "retracted"},
+		{4, false, true, "v1.0.1", http.StatusGone, ""},
+		{5, false, true, "v1.0.6", http.StatusOK, ""},
+		{6, false, false, "v1.0.1", http.StatusOK, ""},
+	} {
+		var listCalls int32
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				list: func(ctx context.Context, path string) ([]string, error) {
+					atomic.AddInt32(&listCalls, 1)
+					return []string{"v1.0.0", "v1.0.1", "v1.1.0", "v1.2.0-rc.1"}, nil
+				},
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					mod = nopReadSeekCloser("module " + path)
+					if version == "v1.1.0" {
+						mod = nopReadSeekCloser(latestMod)
+					}
+					return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), mod, nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:                  &DirCacher{Dir: t.TempDir()},
+			ErrorLogger:             log.New(io.Discard, "", 0),
+			WarnRetractedVersions:   tt.warn,
+			RejectRetractedVersions: tt.reject,
+		}
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/@v/"+tt.version+".info", nil))
+			recr := rec.Result()
+			if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if got, want := recr.Header.Get("X-Goproxy-Retracted"), tt.wantRetracted; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if tt.wantStatusCode == http.StatusGone {
+				if b, err := io.ReadAll(recr.Body); err != nil {
+					t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+				} else if got, want := string(b), "gone: retracted"; got != want {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+				}
+			}
+		}
+		wantListCalls := int32(0)
+		if tt.warn || tt.reject {
+			wantListCalls = 1
+		}
+		if got, want := atomic.LoadInt32(&listCalls), wantListCalls; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyServeZipHashes(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipFile := filepath.Join(t.TempDir(), "zip")
+	if err := os.WriteFile(zipFile, zip, 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHash, err := dirhash.HashZip(zipFile, dirhash.DefaultHash)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n              int
+		serveZipHashes bool
+		cachedZip      bool
+		method         string
+		target         string
+		header         http.Header
+		wantStatusCode int
+		wantContent    string
+		wantZipHash    bool
+	}{
+		{
+			n:              1,
+			cachedZip:      true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/v1.0.0.ziphash",
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    `not found: unexpected extension ".ziphash"`,
+		},
+		{
+			n:              2,
+			serveZipHashes: true,
+			cachedZip:      true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/v1.0.0.zip",
+			wantStatusCode: http.StatusOK,
+			wantContent:    string(zip),
+			wantZipHash:    true,
+		},
+		{
+			n:              3,
+			serveZipHashes: true,
+			cachedZip:      true,
+			method:         http.MethodHead,
+			target:         "/example.com/@v/v1.0.0.zip",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			n:              4,
+			serveZipHashes: true,
+			cachedZip:      true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/v1.0.0.zip",
+			header:         http.Header{"Range": {"bytes=0-1"}},
+			wantStatusCode: http.StatusPartialContent,
+			wantContent:    string(zip[:2]),
+		},
+		{
+			n:              5,
+			serveZipHashes: true,
+			cachedZip:      true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/v1.0.0.ziphash",
+			wantStatusCode: http.StatusOK,
+			wantContent:    zipHash,
+			wantZipHash:    true,
+		},
+		{
+			n:              6,
+			serveZipHashes: true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/v1.0.0.ziphash",
+			wantStatusCode: http.StatusOK,
+			wantContent:    zipHash,
+			wantZipHash:    true,
+		},
+		{
+			n:              7,
+			serveZipHashes: true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/v1.0.0.ziphash",
+			header:         http.Header{"Disable-Module-Fetch": {"true"}},
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    "not found: temporarily unavailable",
+		},
+		{
+			n:              8,
+			serveZipHashes: true,
+			method:         http.MethodGet,
+			target:         "/example.com/@v/master.ziphash",
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    "not found: unrecognized version",
+		},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		if tt.cachedZip {
+			if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.zip", bytes.NewReader(zip)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod_, zip_ io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser(mod), nopReadSeekCloser(string(zip)), nil
+				},
+			},
+			Cacher:         dc,
+			TempDir:        t.TempDir(),
+			ErrorLogger:    log.New(io.Discard, "", 0),
+			ServeZipHashes: tt.serveZipHashes,
+		}
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := os.ReadFile(filepath.Join(dc.Dir, "example.com", "@v", "v1.0.0.ziphash")); tt.wantZipHash {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), zipHash; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("test(%d): got error %v, want %v", tt.n, err, fs.ErrNotExist)
+		}
+	}
+}
+
+func TestGoproxyZipDigestTrailer(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip := strings.Repeat("zip content ", 1000)
+	zipSum := sha256.Sum256([]byte(zip))
+	partialSum := sha256.Sum256([]byte(zip[2:6]))
+	for _, tt := range []struct {
+		n                int
+		zipDigestTrailer bool
+		cached           bool
+		target           string
+		rangeHeader      string
+		wantStatusCode   int
+		wantTrailer      string
+	}{
+		{1, true, false, "/example.com/@v/v1.0.0.zip", "", http.StatusOK, hex.EncodeToString(zipSum[:])},
+		{2, true, true, "/example.com/@v/v1.0.0.zip", "", http.StatusOK, hex.EncodeToString(zipSum[:])},
+		{3, true, true, "/example.com/@v/v1.0.0.zip", "bytes=2-5", http.StatusPartialContent, hex.EncodeToString(partialSum[:])},
+		{4, true, false, "/example.com/@v/v1.0.0.info", "", http.StatusOK, ""},
+		{5, true, false, "/example.com/@v/v1.1.0.zip", "", http.StatusNotFound, ""},
+		{6, false, false, "/example.com/@v/v1.0.0.zip", "", http.StatusOK, ""},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		if tt.cached {
+			if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.zip", strings.NewReader(zip)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip_ io.ReadSeekCloser, err error) {
+					if version != "v1.0.0" {
+						return nil, nil, nil, notExistErrorf("not found")
+					}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(zip), nil
+				},
+			},
+			Cacher:           dc,
+			ErrorLogger:      log.New(io.Discard, "", 0),
+			ZipDigestTrailer: tt.zipDigestTrailer,
+		}
+		server := httptest.NewServer(g)
+		req, err := http.NewRequest(http.MethodGet, server.URL+tt.target, nil)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := resp.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := resp.Trailer.Get("X-Goproxy-Content-SHA256"), tt.wantTrailer; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.wantTrailer != "" {
+			if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != tt.wantTrailer {
+				t.Errorf("test(%d): got body hash %x, want %s", tt.n, sum, tt.wantTrailer)
+			}
+			if got, want := resp.ContentLength, int64(-1); got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestGoproxyServeCachedZipShortRead(t *testing.T) {
+	zip := strings.Repeat("zip content ", 1000)
+	wantLog := "goproxy: short read of cached module file: example.com/@v/v1.0.0.zip: served 6000 of 12000 bytes\n"
+	for _, tt := range []struct {
+		n                int
+		seekable         bool
+		readErr          error
+		zipDigestTrailer bool
+		wantErr          bool
+		wantLog          string
+	}{
+		{1, false, errors.New("connection reset"), false, true, ""},
+		{2, false, errors.New("connection reset"), true, true, ""},
+		{3, true, errors.New("connection reset"), false, true, wantLog},
+		{4, true, errors.New("connection reset"), true, true, wantLog},
+		{5, true, io.EOF, false, true, wantLog},
+		{6, true, io.EOF, true, true, wantLog},
+		{7, false, nil, true, false, ""},
+		{8, true, nil, true, false, ""},
+	} {
+		var errorLog strings.Builder
+		g := &Goproxy{
+			Cacher: &testCacher{
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					if name != "example.com/@v/v1.0.0.zip" {
+						return nil, fs.ErrNotExist
+					}
+					var read int
+					rs := &testReadSeeker{
+						ReadSeeker: strings.NewReader(zip),
+						read: func(rs io.ReadSeeker, p []byte) (int, error) {
+							if tt.readErr == nil {
+								return rs.Read(p)
+							}
+							if read >= len(zip)/2 {
+								return 0, tt.readErr
+							}
+							if len(p) > len(zip)/2-read {
+								p = p[:len(zip)/2-read]
+							}
+							n, err := rs.Read(p)
+							read += n
+							return n, err
+						},
+					}
+					if !tt.seekable {
+						return io.NopCloser(struct{ io.Reader }{rs}), nil
+					}
+					return struct {
+						io.ReadSeeker
+						io.Closer
+					}{rs, io.NopCloser(nil)}, nil
+				},
+			},
+			ProxiedSumDBs:    []string{},
+			ErrorLogger:      log.New(&errorLog, "", 0),
+			ZipDigestTrailer: tt.zipDigestTrailer,
+		}
+		server := httptest.NewServer(g)
+		resp, err := http.Get(server.URL + "/example.com/@v/v1.0.0.zip")
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("test(%d): expected error", tt.n)
+			}
+		} else if err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), zip; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := errorLog.String(), tt.wantLog; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyValidateModFiles(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                int
+		validateModFiles bool
+		mod              string
+		wantStatusCode   int
+		wantContent      string
+	}{
+		{1, true, "module example.com\n\ngo 1.18\n", http.StatusOK, "module example.com\n\ngo 1.18\n"},
+		{2, true, "module example.com\n\nfuture directive\n", http.StatusOK, "module example.com\n\nfuture directive\n"},
+		{3, true, "<!DOCTYPE html>\n<html><body>module unavailable</body></html>\n", http.StatusNotFound, "not found: invalid mod file: missing module directive"},
+		{4, true, "go 1.18\n", http.StatusNotFound, "not found: invalid mod file: missing module directive"},
+		{5, true, "module example.com/foo\n", http.StatusNotFound, `not found: invalid mod file: module path "example.com/foo" does not match "example.com"`},
+		{6, false, "<html></html>\n", http.StatusOK, "<html></html>\n"},
+		{7, true, "module \"example.com\n", http.StatusNotFound, "not found: invalid mod file: go.mod:1:20: unexpected newline in string"},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser(tt.mod), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:           dc,
+			TempDir:          t.TempDir(),
+			ErrorLogger:      log.New(io.Discard, "", 0),
+			ValidateModFiles: tt.validateModFiles,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.mod", nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := len(walkDirFiles(t, dc.Dir)) > 0, tt.wantStatusCode == http.StatusOK; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyValidateInfoFiles(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                 int
+		validateInfoFiles bool
+		info              string
+		wantStatusCode    int
+		wantContent       string
+	}{
+		{1, true, info, http.StatusOK, info},
+		{2, true, `{"Version":"v1.0.0"}`, http.StatusOK, `{"Version":"v1.0.0"}`},
+		{3, true, `{"Time":"2000-01-01T00:00:00Z"}`, http.StatusNotFound, "not found: bad upstream"},
+		{4, true, "<html></html>\n", http.StatusNotFound, "not found: bad upstream"},
+		{5, true, `{"Version":"v1.0.0","Time":"2000-13-01T00:00:00Z"}`, http.StatusNotFound, "not found: bad upstream"},
+		{6, true, `{"Version":"v1.0"}`, http.StatusNotFound, "not found: bad upstream"},
+		{7, false, "<html></html>\n", http.StatusOK, "<html></html>\n"},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(tt.info), nopReadSeekCloser("module example.com"), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:            dc,
+			TempDir:           t.TempDir(),
+			ErrorLogger:       log.New(io.Discard, "", 0),
+			ValidateInfoFiles: tt.validateInfoFiles,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := len(walkDirFiles(t, dc.Dir)) > 0, tt.wantStatusCode == http.StatusOK; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		n                 int
+		validateInfoFiles bool
+		version           string
+		wantStatusCode    int
+		wantContent       string
+	}{
+		{1, true, "v1.1.0", http.StatusOK, marshalInfo("v1.1.0", time.Time{})},
+		{2, true, "", http.StatusNotFound, "not found: bad upstream"},
+		{3, true, "master", http.StatusNotFound, "not found: bad upstream"},
+		{4, true, "v1.1.0+meta", http.StatusNotFound, "not found: bad upstream"},
+		{5, false, "", http.StatusOK, marshalInfo("", time.Time{})},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					return tt.version, time.Time{}, nil
+				},
+			},
+			Cacher:                  dc,
+			MutableNegativeCacheTTL: time.Hour,
+			ErrorLogger:             log.New(io.Discard, "", 0),
+			ValidateInfoFiles:       tt.validateInfoFiles,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@latest", nil))
+		if err := g.mutNegatives.notFound("example.com/@latest"); err != nil {
+			t.Errorf("test(%d): unexpected negative cache %q", tt.n, err)
+		}
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := len(walkDirFiles(t, dc.Dir)) > 0, tt.wantStatusCode == http.StatusOK; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyCanonicalizeVersions(t *testing.T) {
+	for _, tt := range []struct {
+		n                    int
+		canonicalizeVersions bool
+		targets              []string
+		wantStatusCode       int
+		wantDownloads        []string
+		wantQueries          []string
+	}{
+		{
+			n:                    1,
+			canonicalizeVersions: true,
+			targets:              []string{"/example.com/@v/v1.2.3.mod", "/example.com/@v/v1.2.3+meta.mod", "/example.com/@v/v1.2.3+build.1.mod"},
+			wantStatusCode:       http.StatusOK,
+			wantDownloads:        []string{"example.com@v1.2.3"},
+		},
+		{
+			n:                    2,
+			canonicalizeVersions: true,
+			targets:              []string{"/example.com/@v/v1.2.3+meta.info", "/example.com/@v/v1.2.3.info"},
+			wantStatusCode:       http.StatusOK,
+			wantDownloads:        []string{"example.com@v1.2.3"},
+		},
+		{
+			n:                    3,
+			canonicalizeVersions: true,
+			targets:              []string{"/example.com/@v/v2.0.0+incompatible.mod", "/example.com/@v/v2.0.0+incompatible.build.1.mod"},
+			wantStatusCode:       http.StatusOK,
+			wantDownloads:        []string{"example.com@v2.0.0+incompatible"},
+		},
+		{
+			n:                    4,
+			canonicalizeVersions: true,
+			targets:              []string{"/example.com/@v/v0.0.0-20191109021931-daa7c04131f5.mod", "/example.com/@v/v0.0.0-20191109021931-daa7c04131f5+meta.mod"},
+			wantStatusCode:       http.StatusOK,
+			wantDownloads:        []string{"example.com@v0.0.0-20191109021931-daa7c04131f5"},
+		},
+		{
+			n:                    5,
+			canonicalizeVersions: true,
+			targets:              []string{"/example.com/@v/v1.2.info"},
+			wantStatusCode:       http.StatusOK,
+			wantQueries:          []string{"example.com@v1.2"},
+		},
+		{
+			n:              6,
+			targets:        []string{"/example.com/@v/v1.2.3+meta.mod"},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			n:              7,
+			targets:        []string{"/example.com/@v/v1.2.3+meta.info"},
+			wantStatusCode: http.StatusOK,
+			wantQueries:    []string{"example.com@v1.2.3+meta"},
+		},
+	} {
+		var downloads, queries []string
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					queries = append(queries, path+"@"+query)
+					return "v1.2.3", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					downloads = append(downloads, path+"@"+version)
+					return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:               &DirCacher{Dir: t.TempDir()},
+			TempDir:              t.TempDir(),
+			ErrorLogger:          log.New(io.Discard, "", 0),
+			CanonicalizeVersions: tt.canonicalizeVersions,
+		}
+		for _, target := range tt.targets {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", target, nil))
+			if got, want := rec.Code, tt.wantStatusCode; got != want {
+				t.Errorf("test(%d): %s: got %d, want %d", tt.n, target, got, want)
+			}
+		}
+		if got, want := strings.Join(downloads, ","), strings.Join(tt.wantDownloads, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(queries, ","), strings.Join(tt.wantQueries, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyNormalizeGoMod(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	const (
+		mod           = "module   example.com\n\n\nrequire example.com/foo v1.0.0\nrequire example.com/foo v1.1.0\n"
+		normalizedMod = "module example.com\n\nrequire example.com/foo v1.1.0\n"
+	)
+	for _, tt := range []struct {
+		n                 int
+		normalizeGoMod    bool
+		serveWhileCaching bool
+		mod               string
+		wantContent       string
+	}{
+		{1, false, false, mod, mod},
+		{2, true, false, mod, normalizedMod},
+		{3, true, true, mod, normalizedMod},
+		{4, true, false, "module example.com\n\nfuture directive\n", "module example.com\n\nfuture directive\n"},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser(tt.mod), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:            dc,
+			TempDir:           t.TempDir(),
+			ErrorLogger:       log.New(io.Discard, "", 0),
+			NormalizeGoMod:    tt.normalizeGoMod,
+			ServeWhileCaching: tt.serveWhileCaching,
+		}
+		for _, cached := range []bool{false, true} {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.mod", nil))
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Errorf("test(%d): cached=%t: got %d, want %d", tt.n, cached, got, want)
+			}
+			if got, want := rec.Body.String(), tt.wantContent; got != want {
+				t.Errorf("test(%d): cached=%t: got %q, want %q", tt.n, cached, got, want)
+			}
+		}
+		if b, err := os.ReadFile(filepath.Join(dc.Dir, "example.com", "@v", "v1.0.0.mod")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.mod; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestNormalizeGoMod(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		mod     string
+		wantMod string
+		wantErr error
+	}{
+		{1, "module example.com\n", "module example.com\n", nil},
+		{2, "module   example.com\ngo    1.18\n\n\n\nrequire   example.com/foo v1.0.0\n", "module example.com\n\ngo 1.18\n\nrequire example.com/foo v1.0.0\n", nil},
+		{
+			3,
+			"module example.com\n\nrequire (\n\texample.com/foo v1.0.0\n\texample.com/bar v1.0.0 // indirect\n\texample.com/foo v1.2.0\n\texample.com/foo v1.1.0\n)\n",
+			"module example.com\n\nrequire (\n\texample.com/bar v1.0.0 // indirect\n\texample.com/foo v1.2.0\n)\n",
+			nil,
+		},
+		{
+			4,
+			"module example.com\n\nexclude example.com/foo v1.0.0\nexclude example.com/foo v1.0.0\nexclude example.com/bar v1.0.0\n",
+			"module example.com\n\nexclude example.com/bar v1.0.0\n\nexclude example.com/foo v1.0.0\n",
+			nil,
+		},
+		{5, "<html>", "", errors.New("go.mod:1: unknown directive: <html>")},
+	} {
+		mod, err := normalizeGoMod([]byte(tt.mod))
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(mod), tt.wantMod; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxySniffModuleFiles(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com\n"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	html := "<!DOCTYPE html>\n<html><body>Please log in</body></html>\n"
+	for _, tt := range []struct {
+		n                int
+		sniffModuleFiles bool
+		info             string
+		mod              string
+		zip              string
+		target           string
+		wantStatusCode   int
+		wantContent      string
+	}{
+		{1, true, info, mod, string(zip), "/example.com/@v/v1.0.0.info", http.StatusOK, info},
+		{2, true, "\n" + info, "\ufeff" + mod, string(zip), "/example.com/@v/v1.0.0.mod", http.StatusOK, "\ufeff" + mod},
+		{3, true, html, mod, string(zip), "/example.com/@v/v1.0.0.info", http.StatusNotFound, "not found: invalid info file: not a JSON object"},
+		{4, true, info, html, string(zip), "/example.com/@v/v1.0.0.mod", http.StatusNotFound, "not found: invalid mod file: looks like HTML"},
+		{5, true, info, "\ufeff  " + html, string(zip), "/example.com/@v/v1.0.0.mod", http.StatusNotFound, "not found: invalid mod file: looks like HTML"},
+		{6, true, info, mod, html, "/example.com/@v/v1.0.0.zip", http.StatusNotFound, "not found: invalid zip file: missing zip header"},
+		{7, true, info, mod, html, "/example.com/@v/v1.0.0.info", http.StatusNotFound, "not found: invalid zip file: missing zip header"},
+		{8, true, "", mod, string(zip), "/example.com/@v/v1.0.0.info", http.StatusNotFound, "not found: invalid info file: not a JSON object"},
+		{9, true, info, mod, "PK\x05\x06" + strings.Repeat("\x00", 18), "/example.com/@v/v1.0.0.mod", http.StatusOK, mod},
+		{10, false, info, mod, html, "/example.com/@v/v1.0.0.zip", http.StatusOK, html},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(tt.info), nopReadSeekCloser(tt.mod), nopReadSeekCloser(tt.zip), nil
+				},
+			},
+			Cacher:           dc,
+			TempDir:          t.TempDir(),
+			ErrorLogger:      log.New(io.Discard, "", 0),
+			SniffModuleFiles: tt.sniffModuleFiles,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", tt.target, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := len(walkDirFiles(t, dc.Dir)) > 0, tt.wantStatusCode == http.StatusOK; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyBypassUnavailableCacher(t *testing.T) {
+	infoTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var (
+		puts   []string
+		errLog bytes.Buffer
+	)
+	cacher := &testCacher{
+		Cacher: &DirCacher{Dir: t.TempDir()},
+		get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("input/output error")}
+		},
+		put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+			puts = append(puts, name)
+			return errors.New("input/output error")
+		},
+	}
+	fetcher := &testFetcher{
+		query: func(ctx context.Context, path, query string) (version string, time time.Time, err error) {
+			return "v1.0.0", infoTime, nil
+		},
+		list: func(ctx context.Context, path string) (versions []string, err error) {
+			return []string{"v1.0.0"}, nil
+		},
+		download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+			return nopReadSeekCloser(marshalInfo(version, infoTime)), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+		},
+	}
+	for _, tt := range []struct {
+		n                       int
+		bypassUnavailableCacher bool
+		target                  string
+		wantStatusCode          int
+		wantContent             string
+		wantErrLog              string
+		wantPuts                string
+	}{
+		{1, false, "/example.com/@v/v1.0.0.mod", http.StatusInternalServerError, "internal server error", "goproxy: failed to get cached module file: example.com/@v/v1.0.0.mod: open example.com/@v/v1.0.0.mod: input/output error\n", ""},
+		{2, true, "/example.com/@v/v1.0.0.mod", http.StatusOK, "module example.com", "goproxy: bypassed unavailable cacher: example.com/@v/v1.0.0.mod: open example.com/@v/v1.0.0.mod: input/output error\n", ""},
+		{3, true, "/example.com/@v/v1.0.0.info", http.StatusOK, marshalInfo("v1.0.0", infoTime), "goproxy: bypassed unavailable cacher: example.com/@v/v1.0.0.info: open example.com/@v/v1.0.0.info: input/output error\n", ""},
+		{4, true, "/example.com/@latest", http.StatusOK, marshalInfo("v1.0.0", infoTime), "goproxy: bypassed unavailable cacher: example.com/@latest: input/output error\n", "example.com/@latest"},
+		{5, true, "/example.com/@v/list", http.StatusOK, "v1.0.0", "goproxy: bypassed unavailable cacher: example.com/@v/list: input/output error\n", "example.com/@v/list"},
+	} {
+		puts = nil
+		errLog.Reset()
+		g := &Goproxy{
+			Fetcher:                 fetcher,
+			Cacher:                  cacher,
+			BypassUnavailableCacher: tt.bypassUnavailableCacher,
+			TempDir:                 t.TempDir(),
+			ErrorLogger:             log.New(&errLog, "", 0),
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := errLog.String(), tt.wantErrLog; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(puts, ","), tt.wantPuts; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyNotCachedMessage(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("module example.com")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n                int
+		notCachedMessage string
+		target           string
+		wantStatusCode   int
+		wantContent      string
+	}{
+		{1, "", "/example.com/@v/v1.1.0.mod", http.StatusNotFound, "not found: temporarily unavailable"},
+		{2, "{module}@{version} not present in offline mirror; request it be added", "/example.com/@v/v1.1.0.mod", http.StatusNotFound, "not found: example.com@v1.1.0 not present in offline mirror; request it be added"},
+		{3, "{module}@{version} not mirrored", "/example.com/@v/v1.1.0.zip", http.StatusNotFound, "not found: example.com@v1.1.0 not mirrored"},
+		{4, "{module}@{version} not mirrored", "/example.com/@latest", http.StatusNotFound, "not found: example.com@latest not mirrored"},
+		{5, "{module} not mirrored", "/example.com/@v/list", http.StatusNotFound, "not found: example.com not mirrored"},
+		{6, "{module}@{version} not mirrored", "/example.com/@v/v1.1.0.ziphash", http.StatusNotFound, "not found: example.com@v1.1.0 not mirrored"},
+		{7, "{module}@{version} not mirrored", "/example.com/@v/v1.0.0.mod", http.StatusOK, "module example.com"},
+	} {
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					t.Errorf("test(%d): unexpected download of %s@%s", tt.n, path, version)
+					return nil, nil, nil, errors.New("unexpected download")
+				},
+			},
+			Cacher:           dc,
+			NotCachedMessage: tt.notCachedMessage,
+			ServeZipHashes:   true,
+			TempDir:          t.TempDir(),
+			ErrorLogger:      log.New(io.Discard, "", 0),
+		}
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Header.Set("Disable-Module-Fetch", "true")
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyNameResolver(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	for name, content := range map[string]string{
+		"example.com/pinned/@v/v1.0.0.mod":         "module example.com/pinned // base",
+		"staging/example.com/pinned/@v/v1.0.0.mod": "module example.com/pinned // staging",
+	} {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	var downloads []string
+	newGoproxy := func(nameResolver func(ctx context.Context, name string) string) *Goproxy {
+		return &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					downloads = append(downloads, path+"@"+version)
+					zipContent, err := makeZip(map[string][]byte{path + "@" + version + "/go.mod": []byte("module " + path)})
+					if err != nil {
+						return nil, nil, nil, err
+					}
+					return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zipContent)), nil
+				},
+			},
+			Cacher:       dc,
+			NameResolver: nameResolver,
+			TempDir:      t.TempDir(),
+			ErrorLogger:  log.New(io.Discard, "", 0),
+		}
+	}
+	prod := newGoproxy(nil)
+	staging := newGoproxy(func(ctx context.Context, name string) string {
+		if strings.HasPrefix(name, "example.com/pinned/") {
+			return "staging/" + name
+		}
+		return name
+	})
+	for _, tt := range []struct {
+		n             int
+		g             *Goproxy
+		target        string
+		wantContent   string
+		wantDownloads []string
+	}{
+		{1, prod, "/example.com/pinned/@v/v1.0.0.mod", "module example.com/pinned // base", nil},
+		{2, staging, "/example.com/pinned/@v/v1.0.0.mod", "module example.com/pinned // staging", nil},
+		{3, staging, "/example.com/shared/@v/v1.0.0.mod", "module example.com/shared", []string{"example.com/shared@v1.0.0"}},
+		{4, prod, "/example.com/shared/@v/v1.0.0.mod", "module example.com/shared", nil},
+		{5, staging, "/example.com/pinned/@v/v1.1.0.mod", "module example.com/pinned", []string{"example.com/pinned@v1.1.0"}},
+		{6, prod, "/example.com/pinned/@v/v1.1.0.mod", "module example.com/pinned", []string{"example.com/pinned@v1.1.0"}},
+	} {
+		downloads = nil
+		rec := httptest.NewRecorder()
+		tt.g.ServeHTTP(rec, httptest.NewRequest("", tt.target, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(downloads, ","), strings.Join(tt.wantDownloads, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+	if names, err := dc.List(context.Background(), ""); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(names, "\n"), strings.Join([]string{
+		"example.com/pinned/@v/v1.0.0.mod",
+		"example.com/pinned/@v/v1.1.0.info",
+		"example.com/pinned/@v/v1.1.0.mod",
+		"example.com/pinned/@v/v1.1.0.zip",
+		"example.com/shared/@v/v1.0.0.info",
+		"example.com/shared/@v/v1.0.0.mod",
+		"example.com/shared/@v/v1.0.0.zip",
+		"staging/example.com/pinned/@v/v1.0.0.mod",
+		"staging/example.com/pinned/@v/v1.1.0.info",
+		"staging/example.com/pinned/@v/v1.1.0.mod",
+		"staging/example.com/pinned/@v/v1.1.0.zip",
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyServeCachedOnMalformedUpstream(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	html := "<!DOCTYPE html>\n<html><body>Please log in</body></html>\n"
+	for _, tt := range []struct {
+		n                              int
+		serveCachedOnMalformedUpstream bool
+		cached                         map[string]string
+		target                         string
+		wantStatusCode                 int
+		wantContent                    string
+		wantLog                        string
+	}{
+		{
+			n:                              1,
+			serveCachedOnMalformedUpstream: true,
+			cached:                         map[string]string{"example.com/@v/v1.0.0.zip": string(zip)},
+			target:                         "/example.com/@v/v1.0.0.info",
+			wantStatusCode:                 http.StatusOK,
+			wantContent:                    info,
+			wantLog:                        "goproxy: malformed module file from upstream, using cached copy: example.com@v1.0.0.zip: invalid zip file: missing zip header\n",
+		},
+		{
+			n:                              2,
+			serveCachedOnMalformedUpstream: true,
+			cached:                         map[string]string{"example.com/@v/v1.0.0.zip": string(zip)},
+			target:                         "/example.com/@v/v1.0.0.zip",
+			wantStatusCode:                 http.StatusOK,
+			wantContent:                    string(zip),
+		},
+		{
+			n:                              3,
+			serveCachedOnMalformedUpstream: true,
+			target:                         "/example.com/@v/v1.0.0.info",
+			wantStatusCode:                 http.StatusNotFound,
+			wantContent:                    "not found: invalid zip file: missing zip header",
+			wantLog:                        "goproxy: failed to download module version: example.com/@v/v1.0.0.info: invalid zip file: missing zip header\n",
+		},
+		{
+			n:              4,
+			cached:         map[string]string{"example.com/@v/v1.0.0.zip": string(zip)},
+			target:         "/example.com/@v/v1.0.0.info",
+			wantStatusCode: http.StatusNotFound,
+			wantContent:    "not found: invalid zip file: missing zip header",
+			wantLog:        "goproxy: failed to download module version: example.com/@v/v1.0.0.info: invalid zip file: missing zip header\n",
+		},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		for name, content := range tt.cached {
+			if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		var logBuf strings.Builder
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod_, zip_ io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser(mod), nopReadSeekCloser(html), nil
+				},
+			},
+			Cacher:                         dc,
+			TempDir:                        t.TempDir(),
+			ErrorLogger:                    log.New(&logBuf, "", 0),
+			SniffModuleFiles:               true,
+			ServeCachedOnMalformedUpstream: tt.serveCachedOnMalformedUpstream,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", tt.target, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := logBuf.String(), tt.wantLog; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if rc, err := dc.Get(context.Background(), "example.com/@v/v1.0.0.zip"); err == nil {
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), string(zip); got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if tt.cached != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+	}
+}
+
+func TestGoproxyServeWhileCaching(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	readerAtSeekCloser := func(s string) io.ReadSeekCloser {
+		return struct {
+			*strings.Reader
+			io.Closer
+		}{strings.NewReader(s), io.NopCloser(nil)}
+	}
+	for _, tt := range []struct {
+		n              int
+		readerAt       bool
+		cancel         bool
+		waitForServed  bool
+		wantStatusCode int
+		wantFiles      []string
+	}{
+		{
+			n:              1,
+			readerAt:       true,
+			waitForServed:  true,
+			wantStatusCode: http.StatusOK,
+			wantFiles:      []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.0.0.zip"},
+		},
+		{
+			n:              2,
+			wantStatusCode: http.StatusOK,
+			wantFiles:      []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.0.0.zip"},
+		},
+		{
+			n:              3,
+			readerAt:       true,
+			cancel:         true,
+			wantStatusCode: http.StatusOK,
+			wantFiles:      []string{"example.com/@v/v1.0.0.mod"},
+		},
+	} {
+		newFile := nopReadSeekCloser
+		if tt.readerAt {
+			newFile = readerAtSeekCloser
+		}
+		served := make(chan struct{})
+		zipPutStarted := make(chan struct{})
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					return newFile(info), newFile("module example.com"), newFile("zip"), nil
+				},
+			},
+			Cacher: &testCacher{
+				Cacher: dc,
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					if tt.waitForServed && path.Ext(name) == ".zip" {
+						select {
+						case <-served:
+						case <-time.After(10 * time.Second):
+							return errors.New("timed out waiting for the response to be served")
+						}
+					}
+					if tt.cancel && path.Ext(name) == ".zip" {
+						close(zipPutStarted)
+						select {
+						case <-ctx.Done():
+							return ctx.Err()
+						case <-time.After(10 * time.Second):
+							return errors.New("timed out waiting for the caching to be aborted")
+						}
+					}
+					return c.Put(ctx, name, content)
+				},
+			},
+			ServeWhileCaching: true,
+			TempDir:           t.TempDir(),
+			ErrorLogger:       log.New(io.Discard, "", 0),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancel {
+			go func() {
+				<-served
+				<-zipPutStarted
+				cancel()
+			}()
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(&notifyingResponseWriter{ResponseWriter: rec, written: served}, httptest.NewRequest("", "/example.com/@v/v1.0.0.zip", nil).WithContext(ctx))
+		cancel()
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), "zip"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dc.Dir), ","), strings.Join(tt.wantFiles, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyRedirectUpstream(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n              int
+		path           string
+		noFetch        bool
+		wantStatusCode int
+		wantLocation   string
+		wantCalls      string
+		wantDownloads  int
+	}{
+		{1, "/example.com/huge/@v/v1.0.0.zip", false, http.StatusFound, "https://upstream.example.com/example.com/huge/@v/v1.0.0.zip", "example.com/huge@v1.0.0 download", 0},
+		{2, "/example.com/huge/@v/v1.0.0.mod", false, http.StatusOK, "", "", 1},
+		{3, "/example.com/huge/@v/v1.0.0.info", false, http.StatusOK, "", "", 1},
+		{4, "/example.com/small/@v/v1.0.0.zip", false, http.StatusOK, "", "example.com/small@v1.0.0 download", 1},
+		{5, "/example.com/huge/@v/v1.0.0.zip", true, http.StatusNotFound, "", "", 0},
+	} {
+		var (
+			calls     []string
+			downloads int
+		)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					downloads++
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:      &DirCacher{Dir: t.TempDir()},
+			ErrorLogger: log.New(io.Discard, "", 0),
+			RedirectUpstream: func(modulePath, version, op string) (string, bool) {
+				calls = append(calls, modulePath+"@"+version+" "+op)
+				if modulePath != "example.com/huge" {
+					return "", false
+				}
+				return "https://upstream.example.com/" + modulePath + "/@v/" + version + ".zip", true
+			},
+		}
+		req := httptest.NewRequest("", tt.path, nil)
+		if tt.noFetch {
+			req.Header.Set("Disable-Module-Fetch", "true")
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Location"), tt.wantLocation; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(calls, ","), tt.wantCalls; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := downloads, tt.wantDownloads; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyIntegrityCheck(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	otherZip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com // tampered")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	sha256Hex := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	for _, tt := range []struct {
+		n              int
+		sampleRate     float64
+		upstreamZip    string
+		wantDownloads  int
+		wantMismatches []IntegrityMismatch
+	}{
+		{1, 0, string(otherZip), 0, nil},
+		{2, 1, string(zip), 1, nil},
+		{3, 1, string(otherZip), 1, []IntegrityMismatch{{Name: "example.com/@v/v1.0.0.zip", SHA256: sha256Hex(string(zip)), UpstreamSHA256: sha256Hex(string(otherZip))}}},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		for name, content := range map[string]string{
+			"example.com/@v/v1.0.0.info": string(info),
+			"example.com/@v/v1.0.0.mod":  "module example.com",
+			"example.com/@v/v1.0.0.zip":  string(zip),
+		} {
+			if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		var (
+			mu         sync.Mutex
+			downloads  int
+			mismatches []IntegrityMismatch
+		)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zipContent io.ReadSeekCloser, err error) {
+					mu.Lock()
+					downloads++
+					mu.Unlock()
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(tt.upstreamZip), nil
+				},
+			},
+			Cacher:                   dc,
+			IntegrityCheckSampleRate: tt.sampleRate,
+			OnIntegrityMismatch: func(m IntegrityMismatch) {
+				mu.Lock()
+				defer mu.Unlock()
+				mismatches = append(mismatches, m)
+			},
+			ErrorLogger: log.New(io.Discard, "", 0),
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.zip", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), string(zip); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			g.fetchGroup.mu.Lock()
+			_, ok := g.fetchGroup.calls[integrityCheckKey("example.com", "v1.0.0")]
+			g.fetchGroup.mu.Unlock()
+			if !ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("test(%d): timed out waiting for integrity check", tt.n)
+			}
+		}
+		mu.Lock()
+		if got, want := downloads, tt.wantDownloads; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := fmt.Sprintf("%+v", mismatches), fmt.Sprintf("%+v", tt.wantMismatches); got != want {
+			t.Errorf("test(%d): got %s, want %s", tt.n, got, want)
+		}
+		mu.Unlock()
+		if rc, err := dc.Get(context.Background(), "example.com/@v/v1.0.0.zip"); err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if b, err := io.ReadAll(rc); err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), string(zip); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		} else {
+			rc.Close()
+		}
+	}
+}
+
+func TestGoproxyShadowFetcher(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	otherZip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com // tampered")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	sha256Hex := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	for _, tt := range []struct {
+		n              int
+		shadowZip      string
+		shadowErr      error
+		wantMismatches []ShadowMismatch
+	}{
+		{
+			n:         1,
+			shadowZip: string(zip),
+		},
+		{
+			n:         2,
+			shadowZip: string(otherZip),
+			wantMismatches: []ShadowMismatch{
+				{Name: "example.com/@v/v1.0.0.zip", SHA256: sha256Hex(string(zip)), ShadowSHA256: sha256Hex(string(otherZip))},
+			},
+		},
+		{
+			n:         3,
+			shadowErr: notExistErrorf("example.com@v1.0.0: unknown revision"),
+			wantMismatches: []ShadowMismatch{
+				{Name: "example.com/@v/v1.0.0.mod", SHA256: sha256Hex("module example.com"), ShadowErr: notExistErrorf("example.com@v1.0.0: unknown revision")},
+				{Name: "example.com/@v/v1.0.0.zip", SHA256: sha256Hex(string(zip)), ShadowErr: notExistErrorf("example.com@v1.0.0: unknown revision")},
+			},
+		},
+	} {
+		var (
+			mismatches   = make(chan ShadowMismatch, 2)
+			shadowCalled = make(chan struct{})
+		)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zipContent io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zip)), nil
+				},
+			},
+			ShadowFetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zipContent io.ReadSeekCloser, err error) {
+					defer close(shadowCalled)
+					if tt.shadowErr != nil {
+						return nil, nil, nil, tt.shadowErr
+					}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(tt.shadowZip), nil
+				},
+			},
+			ShadowSampleRate: 1,
+			OnShadowMismatch: func(m ShadowMismatch) { mismatches <- m },
+			ErrorLogger:      log.New(io.Discard, "", 0),
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.zip", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), string(zip); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		select {
+		case <-shadowCalled:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("test(%d): timed out waiting for shadow fetch", tt.n)
+		}
+		for _, want := range tt.wantMismatches {
+			select {
+			case got := <-mismatches:
+				if got.Name != want.Name || got.SHA256 != want.SHA256 || got.ShadowSHA256 != want.ShadowSHA256 {
+					t.Errorf("test(%d): got %+v, want %+v", tt.n, got, want)
+				}
+				if want.ShadowErr == nil {
+					if got.ShadowErr != nil {
+						t.Errorf("test(%d): unexpected error %q", tt.n, got.ShadowErr)
+					}
+				} else if !compareErrors(got.ShadowErr, want.ShadowErr) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got.ShadowErr, want.ShadowErr)
+				} else if !errors.Is(got.ShadowErr, fs.ErrNotExist) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, got.ShadowErr, fs.ErrNotExist)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("test(%d): timed out waiting for shadow mismatch", tt.n)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case m := <-mismatches:
+			t.Errorf("test(%d): unexpected mismatch %+v", tt.n, m)
+		default:
+		}
+	}
+
+	g := &Goproxy{Fetcher: &testFetcher{}, ShadowFetcher: &testFetcher{}, ShadowSampleRate: 1e-12}
+	g.initOnce.Do(g.init)
+	for i := 0; i < 100; i++ {
+		if g.sampleShadowFetch() {
+			t.Fatal("unexpected shadow fetch")
+		}
+	}
+	g.ShadowSampleRate = 1
+	if !g.sampleShadowFetch() {
+		t.Error("expected shadow fetch")
+	}
+	g.ShadowSampleRate = 0
+	if g.sampleShadowFetch() {
+		t.Error("unexpected shadow fetch")
+	}
+}
+
+func TestGoproxyPrefetchModuleFiles(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                   int
+		prefetchModuleFiles bool
+		cachedExts          []string
+		ext                 string
+		wantPrefetch        bool
+		wantDownload        bool
+	}{
+		{1, true, []string{".info"}, ".info", true, true},
+		{2, true, []string{".info", ".mod"}, ".mod", true, true},
+		{3, true, []string{".info", ".mod", ".zip"}, ".info", true, false},
+		{4, true, []string{".zip"}, ".zip", false, false},
+		{5, false, []string{".info"}, ".info", false, false},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		for _, ext := range tt.cachedExts {
+			if err := dc.Put(context.Background(), "example.com/@v/v1.0.0"+ext, strings.NewReader("cached")); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		zipGot := make(chan error, 1)
+		zipPut := make(chan struct{}, 1)
+		downloaded := make(chan struct{}, 1)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					downloaded <- struct{}{}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module example.com"), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher: &testCacher{
+				Cacher: dc,
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					rc, err := c.Get(ctx, name)
+					if name == "example.com/@v/v1.0.0.zip" {
+						select {
+						case zipGot <- err:
+						default:
+						}
+					}
+					return rc, err
+				},
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					err := c.Put(ctx, name, content)
+					if name == "example.com/@v/v1.0.0.zip" {
+						zipPut <- struct{}{}
+					}
+					return err
+				},
+			},
+			ErrorLogger:         log.New(io.Discard, "", 0),
+			PrefetchModuleFiles: tt.prefetchModuleFiles,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0"+tt.ext, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), "cached"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if !tt.wantPrefetch {
+			select {
+			case <-zipGot:
+				if tt.ext != ".zip" {
+					t.Errorf("test(%d): unexpected prefetch", tt.n)
+				}
+			default:
+			}
+			continue
+		}
+		select {
+		case err := <-zipGot:
+			if got, want := err == nil, !tt.wantDownload; got != want {
+				t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test(%d): timed out waiting for prefetch", tt.n)
+		}
+		if !tt.wantDownload {
+			continue
+		}
+		select {
+		case <-zipPut:
+		case <-time.After(time.Second):
+			t.Fatalf("test(%d): timed out waiting for prefetch", tt.n)
+		}
+		select {
+		case <-downloaded:
+		default:
+			t.Errorf("test(%d): expected download", tt.n)
+		}
+		if b, err := os.ReadFile(filepath.Join(dc.Dir, "example.com", "@v", "v1.0.0.zip")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), "zip"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyMutableCacheTTL(t *testing.T) {
+	oldInfo := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	newInfo := marshalInfo("v1.1.0", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC))
+	fetchErr := errors.New("fetch error")
+	for _, tt := range []struct {
+		n               int
+		mutableCacheTTL time.Duration
+		name            string
+		cacheContent    string
+		cacheAge        time.Duration
+		fetchErr        error
+		wantFetched     bool
+		wantContent     string
+	}{
+		{1, 5 * time.Minute, "example.com/@latest", oldInfo, time.Minute, nil, false, oldInfo},
+		{2, 5 * time.Minute, "example.com/@latest", oldInfo, 10 * time.Minute, nil, true, newInfo},
+		{3, 5 * time.Minute, "example.com/@latest", oldInfo, 10 * time.Minute, fetchErr, true, oldInfo},
+		{4, 0, "example.com/@latest", oldInfo, time.Minute, nil, true, newInfo},
+		{5, 5 * time.Minute, "example.com/@v/master.info", oldInfo, time.Minute, nil, false, oldInfo},
+		{6, 5 * time.Minute, "example.com/@v/master.info", oldInfo, 10 * time.Minute, nil, true, newInfo},
+		{7, 5 * time.Minute, "example.com/@v/list", "v1.0.0", time.Minute, nil, false, "v1.0.0"},
+		{8, 5 * time.Minute, "example.com/@v/list", "v1.0.0", 10 * time.Minute, nil, true, "v1.0.0\nv1.1.0"},
+		{9, 5 * time.Minute, "example.com/@v/v1.0.0.info", oldInfo, 365 * 24 * time.Hour, nil, false, oldInfo},
+	} {
+		modTime := time.Now().Add(-tt.cacheAge)
+		dc := &DirCacher{Dir: t.TempDir(), nowFunc: func() time.Time { return modTime }}
+		if err := dc.Put(context.Background(), tt.name, strings.NewReader(tt.cacheContent)); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		dc.nowFunc = nil
+		var fetched bool
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetched = true
+					return "v1.1.0", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC), tt.fetchErr
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetched = true
+					return []string{"v1.0.0", "v1.1.0"}, tt.fetchErr
+				},
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					fetched = true
+					return nil, nil, nil, notExistErrorf("not found")
+				},
+			},
+			Cacher:          dc,
+			ErrorLogger:     log.New(io.Discard, "", 0),
+			MutableCacheTTL: tt.mutableCacheTTL,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/"+tt.name, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := fetched, tt.wantFetched; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := os.ReadFile(filepath.Join(dc.Dir, filepath.FromSlash(tt.name))); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyMutableCacheSoftTTL(t *testing.T) {
+	oldInfo := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	newInfo := marshalInfo("v1.1.0", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                   int
+		mutableCacheSoftTTL time.Duration
+		mutableCacheTTL     time.Duration
+		name                string
+		cacheContent        string
+		cacheAge            time.Duration
+		wantRefreshed       bool
+		wantContent         string
+		wantFetches         int32
+		wantFinalContent    string
+	}{
+		{1, time.Minute, 0, "example.com/@latest", oldInfo, 10 * time.Minute, true, oldInfo, 1, newInfo},
+		{2, time.Minute, 0, "example.com/@v/list", "v1.0.0", 10 * time.Minute, true, "v1.0.0", 1, "v1.0.0\nv1.1.0"},
+		{3, time.Minute, time.Hour, "example.com/@v/master.info", oldInfo, 10 * time.Minute, true, oldInfo, 1, newInfo},
+		{4, time.Minute, time.Hour, "example.com/@latest", oldInfo, 30 * time.Second, false, oldInfo, 0, oldInfo},
+		{5, time.Minute, 5 * time.Minute, "example.com/@latest", oldInfo, 10 * time.Minute, false, newInfo, 1, newInfo},
+	} {
+		modTime := time.Now().Add(-tt.cacheAge)
+		dc := &DirCacher{Dir: t.TempDir(), nowFunc: func() time.Time { return modTime }}
+		if err := dc.Put(context.Background(), tt.name, strings.NewReader(tt.cacheContent)); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		dc.nowFunc = nil
+		var fetches int32
+		release := make(chan struct{})
+		if !tt.wantRefreshed {
+			close(release)
+		}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					atomic.AddInt32(&fetches, 1)
+					<-release
+					return "v1.1.0", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC), nil
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					atomic.AddInt32(&fetches, 1)
+					<-release
+					return []string{"v1.0.0", "v1.1.0"}, nil
+				},
+			},
+			Cacher:              dc,
+			ErrorLogger:         log.New(io.Discard, "", 0),
+			MutableCacheTTL:     tt.mutableCacheTTL,
+			MutableCacheSoftTTL: tt.mutableCacheSoftTTL,
+		}
+		for i := 0; i < 3; i++ {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/"+tt.name, nil))
+			recr := rec.Result()
+			if got, want := recr.StatusCode, http.StatusOK; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if b, err := io.ReadAll(recr.Body); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), tt.wantContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if tt.wantRefreshed {
+			close(release)
+		}
+		cacheFile := filepath.Join(dc.Dir, filepath.FromSlash(tt.name))
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			b, err := os.ReadFile(cacheFile)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := string(b), tt.wantFinalContent; got == want {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if tt.wantRefreshed {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/"+tt.name, nil))
+			if got, want := rec.Body.String(), tt.wantFinalContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := atomic.LoadInt32(&fetches), tt.wantFetches; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyMaxStaleAge(t *testing.T) {
+	for _, tt := range []struct {
+		n                   int
+		maxStaleAge         time.Duration
+		mutableCacheSoftTTL time.Duration
+		cacheAge            time.Duration
+		listErr             error
+		wantStatusCode      int
+		wantContent         string
+		wantCache           string
+		wantLog             string
+	}{
+		{1, 0, 0, 48 * time.Hour, errors.New("bad upstream"), http.StatusInternalServerError, "internal server error", "v1.0.0", "goproxy: refused to serve stale module file: example.com/@v/list: older than 24h0m0s\ngoproxy: failed to list module versions: example.com/@v/list: bad upstream\n"},
+		{2, 0, 0, time.Hour, errors.New("bad upstream"), http.StatusOK, "v1.0.0", "v1.0.0", ""},
+		{3, -1, 0, 48 * time.Hour, errors.New("bad upstream"), http.StatusOK, "v1.0.0", "v1.0.0", ""},
+		{4, time.Hour, 0, 2 * time.Hour, fs.ErrNotExist, http.StatusNotFound, "not found", "v1.0.0", "goproxy: refused to serve stale module file: example.com/@v/list: older than 1h0m0s\ngoproxy: failed to list module versions: example.com/@v/list: file does not exist\n"},
+		{5, time.Hour, time.Minute, 30 * time.Minute, nil, http.StatusOK, "v1.0.0", "v1.0.0\nv1.1.0", ""},
+		{6, time.Hour, time.Minute, 2 * time.Hour, nil, http.StatusOK, "v1.0.0\nv1.1.0", "v1.0.0\nv1.1.0", ""},
+	} {
+		modTime := time.Now().Add(-tt.cacheAge)
+		dc := &DirCacher{Dir: t.TempDir(), nowFunc: func() time.Time { return modTime }}
+		if err := dc.Put(context.Background(), "example.com/@v/list", strings.NewReader("v1.0.0")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		dc.nowFunc = nil
+		var logBuf strings.Builder
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				list: func(ctx context.Context, path string) ([]string, error) {
+					if tt.listErr != nil {
+						return nil, tt.listErr
+					}
+					return []string{"v1.0.0", "v1.1.0"}, nil
+				},
+			},
+			Cacher:              dc,
+			ErrorLogger:         log.New(&logBuf, "", 0),
+			MutableCacheSoftTTL: tt.mutableCacheSoftTTL,
+			MaxStaleAge:         tt.maxStaleAge,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/list", nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := logBuf.String(), tt.wantLog; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		cacheFile := filepath.Join(dc.Dir, "example.com", "@v", "list")
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			b, err := os.ReadFile(cacheFile)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := string(b), tt.wantCache; got == want {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestGoproxyFallbackCacher(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	var (
+		putFails  int32 = 1
+		downloads int32
+	)
+	primary := &DirCacher{Dir: t.TempDir()}
+	fallback := &DirCacher{Dir: t.TempDir()}
+	newGoproxy := func(fallbackCacher Cacher) *Goproxy {
+		return &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					atomic.AddInt32(&downloads, 1)
+					return nopReadSeekCloser(info), nopReadSeekCloser("module example.com"), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher: &testCacher{
+				Cacher: primary,
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					if atomic.LoadInt32(&putFails) == 1 {
+						return errors.New("read-only file system")
+					}
+					return c.Put(ctx, name, content)
+				},
+			},
+			FallbackCacher:        fallbackCacher,
+			FallbackFlushInterval: 10 * time.Millisecond,
+			ErrorLogger:           log.New(io.Discard, "", 0),
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newGoproxy(nil).ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil))
+	if got, want := rec.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	g := newGoproxy(fallback)
+	for _, tt := range []struct {
+		n           int
+		target      string
+		wantContent string
+	}{
+		{1, "/example.com/@v/v1.0.0.info", info},
+		{2, "/example.com/@v/v1.0.0.mod", "module example.com"},
+		{3, "/example.com/@v/v1.0.0.zip", "zip"},
+	} {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", tt.target, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&downloads), int32(2); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := len(walkDirFiles(t, primary.Dir)), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	wantNames := "example.com/@v/v1.0.0.info,example.com/@v/v1.0.0.mod,example.com/@v/v1.0.0.zip"
+	if got, want := strings.Join(walkDirFiles(t, fallback.Dir), ","), wantNames; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	atomic.StoreInt32(&putFails, 0)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if strings.Join(walkDirFiles(t, primary.Dir), ",") == wantNames && len(walkDirFiles(t, fallback.Dir)) == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("got %q and %q, want %q and none", walkDirFiles(t, primary.Dir), walkDirFiles(t, fallback.Dir), wantNames)
+		}
+	}
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.zip", nil))
+	if got, want := rec.Body.String(), "zip"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := atomic.LoadInt32(&downloads), int32(2); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyClose(t *testing.T) {
+	var putFails int32 = 1
+	primary := &DirCacher{Dir: t.TempDir()}
+	fallback := &DirCacher{Dir: t.TempDir()}
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module example.com"), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher: &testCacher{
+			Cacher: primary,
+			put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+				if atomic.LoadInt32(&putFails) == 1 {
+					return errors.New("read-only file system")
+				}
+				return c.Put(ctx, name, content)
+			},
+		},
+		FallbackCacher:        fallback,
+		FallbackFlushInterval: 10 * time.Millisecond,
+		ErrorLogger:           log.New(io.Discard, "", 0),
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	atomic.StoreInt32(&putFails, 0)
+	time.Sleep(50 * time.Millisecond)
+	if got, want := len(walkDirFiles(t, primary.Dir)), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	wantNames := "example.com/@v/v1.0.0.info,example.com/@v/v1.0.0.mod,example.com/@v/v1.0.0.zip"
+	if got, want := strings.Join(walkDirFiles(t, fallback.Dir), ","), wantNames; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	atomic.StoreInt32(&putFails, 1)
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.1.0.info", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	g.fallbackCache.mu.Lock()
+	flushing := g.fallbackCache.flushing
+	g.fallbackCache.mu.Unlock()
+	if flushing != nil {
+		t.Error("expected no flushing after Close")
+	}
+	if err := g.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := new(Goproxy).Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
+
+func TestGoproxyOnCacheMiss(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                       int
+		mutableCacheTTL         time.Duration
+		revalidateMutableCaches bool
+		name                    string
+		cacheContent            string
+		cacheAge                time.Duration
+		downloadErr             error
+		wantMisses              []string
+	}{
+		{
+			n:          1,
+			name:       "example.com/@v/v1.0.0.info",
+			wantMisses: []string{"download example.com@v1.0.0 stale=false ims=false"},
+		},
+		{
+			n:           2,
+			name:        "example.com/@v/v1.0.0.zip",
+			downloadErr: notExistErrorf("not found"),
+			wantMisses: []string{
+				"download example.com@v1.0.0 stale=false ims=false",
+				"download example.com@v1.0.0 stale=false ims=false",
+			},
+		},
+		{
+			n:            3,
+			name:         "example.com/@v/v1.0.0.info",
+			cacheContent: info,
+		},
+		{
+			n:               4,
+			mutableCacheTTL: 5 * time.Minute,
+			name:            "example.com/@v/list",
+			wantMisses:      []string{"list example.com@ stale=false ims=false"},
+		},
+		{
+			n:               5,
+			mutableCacheTTL: 5 * time.Minute,
+			name:            "example.com/@latest",
+			cacheContent:    info,
+			cacheAge:        time.Minute,
+		},
+		{
+			n:               6,
+			mutableCacheTTL: 5 * time.Minute,
+			name:            "example.com/@latest",
+			cacheContent:    info,
+			cacheAge:        10 * time.Minute,
+			wantMisses:      []string{"query example.com@latest stale=true ims=false"},
+		},
+		{
+			n:                       7,
+			mutableCacheTTL:         5 * time.Minute,
+			revalidateMutableCaches: true,
+			name:                    "example.com/@v/list",
+			cacheContent:            "v1.0.0",
+			cacheAge:                10 * time.Minute,
+			wantMisses:              []string{"list example.com@ stale=true ims=true"},
+		},
+		{
+			n:    8,
+			name: "example.com/@v/list",
+		},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		if tt.cacheContent != "" {
+			modTime := time.Now().Add(-tt.cacheAge)
+			dc.nowFunc = func() time.Time { return modTime }
+			if err := dc.Put(context.Background(), tt.name, strings.NewReader(tt.cacheContent)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			dc.nowFunc = nil
+		}
+		var (
+			misses      []string
+			missesMutex sync.Mutex
+		)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					return []string{"v1.0.0"}, nil
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					if tt.downloadErr != nil {
+						return nil, nil, nil, tt.downloadErr
+					}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:                  dc,
+			ErrorLogger:             log.New(io.Discard, "", 0),
+			MutableCacheTTL:         tt.mutableCacheTTL,
+			RevalidateMutableCaches: tt.revalidateMutableCaches,
+			OnCacheMiss: func(info RequestInfo) {
+				missesMutex.Lock()
+				defer missesMutex.Unlock()
+				misses = append(misses, fmt.Sprintf("%s %s@%s stale=%t ims=%t", info.Operation, info.ModulePath, info.Version, info.Stale, !info.IfModifiedSince.IsZero()))
+			},
+		}
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/"+tt.name, nil))
+		}
+		if got, want := strings.Join(misses, "\n"), strings.Join(tt.wantMisses, "\n"); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyResolutionCache(t *testing.T) {
+	for _, tt := range []struct {
+		n                  int
+		resolutionCacheTTL time.Duration
+		maxEntries         int
+		paths              []string
+		wantFetches        int
+	}{
+		{1, 0, 0, []string{"/example.com/@latest", "/example.com/@latest"}, 2},
+		{2, time.Minute, 0, []string{"/example.com/@latest", "/example.com/@latest"}, 1},
+		{3, time.Minute, 0, []string{"/example.com/@v/list", "/example.com/@v/list"}, 1},
+		{4, time.Minute, 0, []string{"/example.com/@v/master.info", "/example.com/@v/master.info", "/example.com/@latest"}, 2},
+		{5, time.Minute, 1, []string{"/example.com/@v/list", "/example.org/@v/list", "/example.com/@v/list"}, 3},
+		{6, time.Nanosecond, 0, []string{"/example.com/@v/list", "/example.com/@v/list"}, 2},
+	} {
+		var fetches int
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetches++
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetches++
+					return []string{"v1.0.0"}, nil
+				},
+			},
+			Cacher:                    &DirCacher{Dir: t.TempDir()},
+			ErrorLogger:               log.New(io.Discard, "", 0),
+			ResolutionCacheTTL:        tt.resolutionCacheTTL,
+			ResolutionCacheMaxEntries: tt.maxEntries,
+		}
+		for _, p := range tt.paths {
+			if tt.resolutionCacheTTL == time.Nanosecond {
+				time.Sleep(time.Millisecond)
+			}
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", p, nil))
+			recr := rec.Result()
+			if got, want := recr.StatusCode, http.StatusOK; got != want {
+				t.Errorf("test(%d): %s: got %d, want %d", tt.n, p, got, want)
+			}
+			if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+				t.Errorf("test(%d): %s: got %q, want %q", tt.n, p, got, want)
+			}
+		}
+		if got, want := fetches, tt.wantFetches; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyNegativeCache(t *testing.T) {
+	for _, tt := range []struct {
+		n                       int
+		negativeCacheTTL        time.Duration
+		mutableNegativeCacheTTL time.Duration
+		fetchErr                error
+		paths                   []string
+		wantStatusCode          int
+		wantFetches             int
+	}{
+		{1, 0, 0, notExistErrorf("unknown revision v1.0.0"), []string{"/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.info"}, http.StatusNotFound, 2},
+		{2, time.Minute, 0, notExistErrorf("unknown revision v1.0.0"), []string{"/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.info"}, http.StatusNotFound, 1},
+		{3, time.Minute, 0, notExistErrorf("unknown revision v1.0.0"), []string{"/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.mod", "/example.com/@v/v1.0.0.zip"}, http.StatusNotFound, 1},
+		{4, time.Minute, 0, fs.ErrNotExist, []string{"/example.com/@v/v1.0.0.mod", "/example.com/@v/v1.0.0.mod"}, http.StatusNotFound, 1},
+		{5, time.Minute, 0, notExistErrorf("%w", errBadUpstream), []string{"/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.info"}, http.StatusNotFound, 2},
+		{6, time.Minute, 0, notExistErrorf("%w", errFetchTimedOut), []string{"/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.info"}, http.StatusNotFound, 2},
+		{7, time.Minute, 0, errors.New("internal error"), []string{"/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.info"}, http.StatusInternalServerError, 2},
+		{8, time.Minute, 0, notExistErrorf("unknown revision latest"), []string{"/example.com/@latest", "/example.com/@latest"}, http.StatusNotFound, 1},
+		{9, time.Minute, 0, notExistErrorf("unknown module"), []string{"/example.com/@v/list", "/example.com/@v/list", "/example.org/@v/list"}, http.StatusNotFound, 2},
+		{10, time.Minute, -1, notExistErrorf("unknown module"), []string{"/example.com/@v/list", "/example.com/@v/list"}, http.StatusNotFound, 2},
+		{11, 0, time.Minute, notExistErrorf("unknown module"), []string{"/example.com/@v/list", "/example.com/@v/list", "/example.com/@v/v1.0.0.info"}, http.StatusNotFound, 2},
+		{12, time.Minute, time.Nanosecond, notExistErrorf("unknown revision latest"), []string{"/example.com/@latest", "/example.com/@latest"}, http.StatusNotFound, 2},
+	} {
+		var fetches int
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetches++
+					return "", time.Time{}, tt.fetchErr
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetches++
+					return nil, tt.fetchErr
+				},
+				download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+					fetches++
+					return nil, nil, nil, tt.fetchErr
+				},
+			},
+			Cacher:                  &DirCacher{Dir: t.TempDir()},
+			ErrorLogger:             log.New(io.Discard, "", 0),
+			NegativeCacheTTL:        tt.negativeCacheTTL,
+			MutableNegativeCacheTTL: tt.mutableNegativeCacheTTL,
+		}
+		var firstContent string
+		for i, p := range tt.paths {
+			if tt.mutableNegativeCacheTTL == time.Nanosecond {
+				time.Sleep(time.Millisecond)
+			}
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", p, nil))
+			if got, want := rec.Code, tt.wantStatusCode; got != want {
+				t.Errorf("test(%d): %s: got %d, want %d", tt.n, p, got, want)
+			}
+			if i == 0 {
+				firstContent = rec.Body.String()
+			} else if got, want := rec.Body.String(), firstContent; got != want {
+				t.Errorf("test(%d): %s: got %q, want %q", tt.n, p, got, want)
+			}
+		}
+		if got, want := fetches, tt.wantFetches; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+
+	g := &Goproxy{Fetcher: &testFetcher{}, Cacher: &DirCacher{Dir: t.TempDir()}, NegativeCacheTTL: time.Minute}
+	g.initOnce.Do(g.init)
+	if got, want := g.mutNegatives.ttl, defaultMaxMutableNegativeCacheTTL; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestGoproxyRevalidateMutableCaches(t *testing.T) {
+	oldInfo := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	newInfo := marshalInfo("v1.1.0", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC))
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	for _, tt := range []struct {
+		n                   int
+		revalidate          bool
+		name                string
+		cacheContent        string
+		cacheAge            time.Duration
+		notModified         bool
+		wantIfModifiedSince bool
+		wantContent         string
+		wantAgeReset        bool
+	}{
+		{1, true, "example.com/@latest", oldInfo, 10 * time.Minute, true, true, oldInfo, true},
+		{2, true, "example.com/@latest", oldInfo, 10 * time.Minute, false, true, newInfo, true},
+		{3, false, "example.com/@latest", oldInfo, 10 * time.Minute, true, false, newInfo, true},
+		{4, true, "example.com/@v/master.info", oldInfo, 10 * time.Minute, true, true, oldInfo, true},
+		{5, true, "example.com/@v/list", "v1.0.0", 10 * time.Minute, true, true, "v1.0.0", true},
+		{6, true, "example.com/@v/list", "v1.0.0", 10 * time.Minute, false, true, "v1.0.0\nv1.1.0", true},
+		{7, true, "example.com/@latest", oldInfo, time.Minute, true, false, oldInfo, false},
+	} {
+		var gotIfModifiedSince string
+		setProxyHandler(func(rw http.ResponseWriter, req *http.Request) {
+			gotIfModifiedSince = req.Header.Get("If-Modified-Since")
+			if gotIfModifiedSince != "" && tt.notModified {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if strings.HasSuffix(req.URL.Path, "/@v/list") {
+				responseSuccess(rw, req, strings.NewReader("v1.0.0\nv1.1.0"), "text/plain; charset=utf-8", -2)
+				return
+			}
+			responseSuccess(rw, req, strings.NewReader(newInfo), "application/json; charset=utf-8", -2)
+		})
+		modTime := time.Now().Add(-tt.cacheAge).Truncate(time.Second)
+		dc := &DirCacher{Dir: t.TempDir(), nowFunc: func() time.Time { return modTime }}
+		if err := dc.Put(context.Background(), tt.name, strings.NewReader(tt.cacheContent)); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		dc.nowFunc = nil
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:                  dc,
+			ErrorLogger:             log.New(io.Discard, "", 0),
+			MutableCacheTTL:         5 * time.Minute,
+			RevalidateMutableCaches: tt.revalidate,
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/"+tt.name, nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		wantIfModifiedSince := ""
+		if tt.wantIfModifiedSince {
+			wantIfModifiedSince = modTime.UTC().Format(http.TimeFormat)
+		}
+		if got, want := gotIfModifiedSince, wantIfModifiedSince; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		fi, err := os.Stat(filepath.Join(dc.Dir, filepath.FromSlash(tt.name)))
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := time.Since(fi.ModTime()) < time.Minute, tt.wantAgeReset; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyLatestCacheName(t *testing.T) {
+	latestInfo := marshalInfo("v1.1.0", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC))
+	masterInfo := marshalInfo("v1.2.0-0.20000103000000-000000000000", time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC))
+	versionInfo := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	dc := &DirCacher{Dir: t.TempDir()}
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+				if query == "latest" {
+					return unmarshalInfo(latestInfo)
+				}
+				return unmarshalInfo(masterInfo)
+			},
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				return nopReadSeekCloser(versionInfo), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher:      dc,
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	tests := []struct {
+		n           int
+		version     string
+		ext         string
+		wantContent string
+	}{
+		{1, "", "latest", latestInfo},
+		{2, "v1.0.0", "info", versionInfo},
+		{3, "master", "info", masterInfo},
+	}
+	for _, tt := range tests {
+		name, err := CacheName("example.com", tt.version, tt.ext)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	// Every cache must still hold its own content after all of them have
+	// been cached.
+	for _, tt := range tests {
+		name, err := CacheName("example.com", tt.version, tt.ext)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(dc.Dir, filepath.FromSlash(name))); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/"+name, nil)
+		req.Header.Set("Disable-Module-Fetch", "true")
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyGetOrFetch(t *testing.T) {
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/@latest"), path.Ext(req.URL.Path) == ".info":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		case strings.HasSuffix(req.URL.Path, "/@v/list"):
+			responseSuccess(rw, req, strings.NewReader("v1.0.0"), "text/plain; charset=utf-8", -2)
+		case path.Ext(req.URL.Path) == ".mod":
+			responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
+		case path.Ext(req.URL.Path) == ".zip":
+			responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
+		default:
+			responseNotFound(rw, req, -2)
+		}
+	}
+	for _, tt := range []struct {
+		n            int
+		proxyHandler http.HandlerFunc
+		cacher       Cacher
+		noCacher     bool
+		name         string
+		wantContent  string
+		wantCached   []string
+		wantErr      error
+	}{
+		{
+			n:           1,
+			name:        "example.com/@v/v1.0.0.info",
+			wantContent: info,
+			wantCached:  []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.0.0.zip"},
+		},
+		{
+			n:           2,
+			name:        "example.com/@v/v1.0.0.zip",
+			wantContent: string(zip),
+			wantCached:  []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.0.0.zip"},
+		},
+		{
+			n:           3,
+			name:        "example.com/@latest",
+			wantContent: info,
+			wantCached:  []string{"example.com/@latest"},
+		},
+		{
+			n:           4,
+			name:        "example.com/@v/list",
+			wantContent: "v1.0.0",
+			wantCached:  []string{"example.com/@v/list"},
+		},
+		{
+			n: 5,
+			proxyHandler: func(rw http.ResponseWriter, req *http.Request) {
+				responseInternalServerError(rw, req)
+			},
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader("cached")), nil
+				},
+			},
+			name:        "example.com/@v/v1.0.0.mod",
+			wantContent: "cached",
+		},
+		{
+			n:           6,
+			noCacher:    true,
+			name:        "example.com/@v/v1.0.0.mod",
+			wantContent: mod,
+		},
+		{
+			n:       7,
+			name:    "example.com/@v/v1.0.0",
+			wantErr: fs.ErrNotExist,
+		},
+		{
+			n: 8,
+			proxyHandler: func(rw http.ResponseWriter, req *http.Request) {
+				responseNotFound(rw, req, -2)
+			},
+			name:    "example.com/@v/v1.0.0.info",
+			wantErr: fs.ErrNotExist,
+		},
+		{
+			n: 9,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return nil, errors.New("cannot get")
+				},
+			},
+			name:    "example.com/@v/v1.0.0.info",
+			wantErr: errors.New("cannot get"),
+		},
+		{
+			n: 10,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					return errors.New("cannot put")
+				},
+			},
+			name:    "example.com/@v/v1.0.0.info",
+			wantErr: errors.New("cannot put"),
+		},
+	} {
+		if tt.proxyHandler == nil {
+			tt.proxyHandler = proxyHandler
+		}
+		setProxyHandler(tt.proxyHandler)
+		dc := &DirCacher{Dir: t.TempDir()}
+		if tt.cacher == nil && !tt.noCacher {
+			tt.cacher = dc
+		}
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				TempDir: t.TempDir(),
+			},
+			Cacher:  tt.cacher,
+			TempDir: t.TempDir(),
+		}
+		rc, err := g.GetOrFetch(context.Background(), tt.name)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if b, err := io.ReadAll(rc); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if err := rc.Close(); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), tt.wantContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		for _, name := range tt.wantCached {
+			if _, err := os.Stat(filepath.Join(dc.Dir, filepath.FromSlash(name))); err != nil {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+	}
+}
+
+func TestGoproxyPrefetch(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+				if path != "example.com" {
+					return "", time.Time{}, notExistErrorf("%s@%s: unknown module", path, query)
+				}
+				return "v1.1.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+			},
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				if path != "example.com" {
+					return nil, nil, nil, notExistErrorf("%s@%s: unknown module", path, version)
+				}
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher:      dc,
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	for _, tt := range []struct {
+		n           int
+		modulePath  string
+		query       string
+		wantVersion string
+		wantErr     error
+	}{
+		{1, "example.com", "v1.0.0", "v1.0.0", nil},
+		{2, "example.com", "master", "v1.1.0", nil},
+		{3, "example.com", "", "v1.1.0", nil},
+		{4, "example.com/foo", "v1.0.0", "", errors.New("example.com/foo@v1.0.0: unknown module")},
+		{5, "example.com/foo", "latest", "", errors.New("example.com/foo@latest: unknown module")},
+		{6, "../foo", "v1.0.0", "", errors.New(`malformed module path "../foo": invalid path element ".."`)},
+	} {
+		version, err := g.Prefetch(context.Background(), tt.modulePath, tt.query)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := err, fs.ErrNotExist; !errors.Is(got, want) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := version, tt.wantVersion; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+	if names, err := dc.List(context.Background(), ""); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := strings.Join(names, "\n"), strings.Join([]string{
+		"example.com/@latest",
+		"example.com/@v/master.info",
+		"example.com/@v/v1.0.0.info",
+		"example.com/@v/v1.0.0.mod",
+		"example.com/@v/v1.0.0.zip",
+		"example.com/@v/v1.1.0.info",
+		"example.com/@v/v1.1.0.mod",
+		"example.com/@v/v1.1.0.zip",
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/prefetch", strings.NewReader("example.com/foo@v1.0.0"))
+	req.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	g.AdminHandler().ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := rec.Body.String(), `{"error":"example.com/foo@v1.0.0: unknown module"}`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyGetOrFetchMetricsHooks(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	var (
+		fetches, coalescedFetches int32
+		release                   = make(chan struct{})
+		started                   = make(chan struct{})
+	)
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+				close(started)
+				<-release
+				return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher: &DirCacher{Dir: t.TempDir()},
+		MetricsHooks: MetricsHooks{
+			OnFetch: func(ctx context.Context, name string) {
+				atomic.AddInt32(&fetches, 1)
+			},
+			OnFetchCoalesced: func(ctx context.Context, name string) {
+				atomic.AddInt32(&coalescedFetches, 1)
+			},
+		},
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	getOrFetch := func(i int) {
+		defer wg.Done()
+		rc, err := g.GetOrFetch(context.Background(), "example.com/@v/v1.0.0.info")
+		if err == nil {
+			rc.Close()
+		}
+		errs[i] = err
+	}
+	wg.Add(1)
+	go getOrFetch(0)
+	<-started
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go getOrFetch(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	if got, want := atomic.LoadInt32(&fetches), int32(1); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := atomic.LoadInt32(&coalescedFetches), int32(n-1); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyGetOrFetchConcurrent(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n      int
+		cacher Cacher
+	}{
+		{n: 1},
+		{n: 2, cacher: &DirCacher{Dir: t.TempDir()}},
+	} {
+		var (
+			fetches, closes int32
+			release         = make(chan struct{})
+			started         = make(chan struct{})
+		)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					atomic.AddInt32(&fetches, 1)
+					close(started)
+					<-release
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), struct {
+						io.ReadSeeker
+						io.Closer
+					}{strings.NewReader("zip content"), closerFunc(func() error {
+						atomic.AddInt32(&closes, 1)
+						return nil
+					})}, nil
+				},
+			},
+			Cacher: tt.cacher,
+		}
+
+		const n = 10
+		var (
+			wg, opened sync.WaitGroup
+			contents   = make([]string, n)
+			errs       = make([]error, n)
+		)
+		getOrFetch := func(i int) {
+			defer wg.Done()
+			rc, err := g.GetOrFetch(context.Background(), "example.com/@v/v1.0.0.zip")
+			if err != nil {
+				errs[i] = err
+				opened.Done()
+				return
+			}
+			defer rc.Close()
+			b := make([]byte, 4)
+			_, err = io.ReadFull(rc, b)
+			opened.Done()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			opened.Wait()
+			rest, err := io.ReadAll(rc)
+			contents[i], errs[i] = string(b)+string(rest), err
+		}
+		wg.Add(n)
+		opened.Add(n)
+		go getOrFetch(0)
+		<-started
+		for i := 1; i < n; i++ {
+			go getOrFetch(i)
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		for i := range errs {
+			if errs[i] != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, errs[i])
+			}
+			if got, want := contents[i], "zip content"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := atomic.LoadInt32(&fetches), int32(1); got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := atomic.LoadInt32(&closes), int32(1); got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyServeHTTPConcurrentFetches(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n            int
+		paths        []string
+		wantContents []string
+	}{
+		{
+			n:            1,
+			paths:        []string{"/example.com/@v/v1.0.0.zip", "/example.com/@v/v1.0.0.info", "/example.com/@v/v1.0.0.mod", "/example.com/@v/v1.0.0.zip"},
+			wantContents: []string{"zip", info, "module example.com", "zip"},
+		},
+		{
+			n:            2,
+			paths:        []string{"/example.com/@v/list", "/example.com/@v/list", "/example.com/@v/list"},
+			wantContents: []string{"v1.0.0", "v1.0.0", "v1.0.0"},
+		},
+		{
+			n:            3,
+			paths:        []string{"/example.com/@latest", "/example.com/@latest", "/example.com/@latest"},
+			wantContents: []string{info, info, info},
+		},
+	} {
+		var (
+			fetches int32
+			release = make(chan struct{})
+			started = make(chan struct{})
+		)
+		fetch := func() {
+			atomic.AddInt32(&fetches, 1)
+			close(started)
+			<-release
+		}
+		var coalesced int32
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					fetch()
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					fetch()
+					return []string{"v1.0.0"}, nil
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					fetch()
+					return nopReadSeekCloser(info), nopReadSeekCloser("module example.com"), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher: &DirCacher{Dir: t.TempDir()},
+			MetricsHooks: MetricsHooks{
+				OnFetchCoalesced: func(ctx context.Context, name string) { atomic.AddInt32(&coalesced, 1) },
+			},
+			ErrorLogger: log.New(io.Discard, "", 0),
+		}
+
+		var (
+			wg   sync.WaitGroup
+			recs = make([]*httptest.ResponseRecorder, len(tt.paths))
+		)
+		serve := func(i int) {
+			defer wg.Done()
+			recs[i] = httptest.NewRecorder()
+			g.ServeHTTP(recs[i], httptest.NewRequest("", tt.paths[i], nil))
+		}
+		wg.Add(len(tt.paths))
+		go serve(0)
+		<-started
+		for i := 1; i < len(tt.paths); i++ {
+			go serve(i)
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		for i, rec := range recs {
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if got, want := rec.Body.String(), tt.wantContents[i]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := atomic.LoadInt32(&fetches), int32(1); got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := atomic.LoadInt32(&coalesced), int32(len(tt.paths)-1); got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyMaxCoalescedWait(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n      int
+		cacher Cacher
+	}{
+		{n: 1},
+		{n: 2, cacher: &DirCacher{Dir: t.TempDir()}},
+	} {
+		var (
+			release = make(chan struct{})
+			started = make(chan struct{})
+		)
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zipContent io.ReadSeekCloser, err error) {
+					close(started)
+					<-release
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zip)), nil
+				},
+			},
+			Cacher:           tt.cacher,
+			MaxCoalescedWait: 10 * time.Millisecond,
+			ServeZipHashes:   true,
+			ErrorLogger:      log.New(io.Discard, "", 0),
+		}
+		leaderDone := make(chan error)
+		go func() {
+			rc, err := g.GetOrFetch(context.Background(), "example.com/@v/v1.0.0.zip")
+			if err == nil {
+				rc.Close()
+			}
+			leaderDone <- err
+		}()
+		<-started
+
+		if _, err := g.GetOrFetch(context.Background(), "example.com/@v/v1.0.0.zip"); err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		} else if got, want := err, fmt.Errorf("example.com/@v/v1.0.0.zip: %w", errFetchInProgress); !compareErrors(got, want) {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		if tt.cacher != nil {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.ziphash", nil))
+			recr := rec.Result()
+			if got, want := recr.StatusCode, http.StatusServiceUnavailable; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if got, want := recr.Header.Get("Retry-After"), "1"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := recr.Header.Get("Cache-Control"), "must-revalidate, no-cache, no-store"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := rec.Body.String(), "service unavailable: fetch in progress"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+
+		close(release)
+		if err := <-leaderDone; err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if tt.cacher != nil {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.ziphash", nil))
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestGoproxyRequestRate(t *testing.T) {
+	g := &Goproxy{Fetcher: &testFetcher{}, RequestRate: 0.5, RequestBurst: 2}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("%d: got %d, want %d", i, got, want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/list", nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusTooManyRequests; got != want {
+			t.Errorf("%d: got %d, want %d", i, got, want)
+		}
+		if retryAfter, err := strconv.Atoi(recr.Header.Get("Retry-After")); err != nil {
+			t.Errorf("%d: unexpected error %q", i, err)
+		} else if retryAfter < 2 || retryAfter > 3 {
+			t.Errorf("%d: got %d, want in range [2, 3]", i, retryAfter)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), "must-revalidate, no-cache, no-store"; got != want {
+			t.Errorf("%d: got %q, want %q", i, got, want)
+		}
+		if got, want := rec.Body.String(), "too many requests"; got != want {
+			t.Errorf("%d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestGoproxyMaxConcurrentRequests(t *testing.T) {
+	var (
+		started = make(chan struct{}, 2)
+		unblock = make(chan struct{})
+	)
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			list: func(ctx context.Context, path string) ([]string, error) {
+				started <- struct{}{}
+				<-unblock
+				return []string{"v1.0.0"}, nil
+			},
+		},
+		MaxConcurrentRequests: 2,
+	}
+	var wg sync.WaitGroup
+	for _, path := range []string{"example.com/a", "example.com/b"} {
+		path := path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/"+path+"/@v/list", nil))
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Errorf("%s: got %d, want %d", path, got, want)
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for requests")
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/c/@v/list", nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("%d: got %d, want %d", i, got, want)
+		}
+		if retryAfter, err := strconv.Atoi(recr.Header.Get("Retry-After")); err != nil {
+			t.Errorf("%d: unexpected error %q", i, err)
+		} else if retryAfter < 1 || retryAfter > 2 {
+			t.Errorf("%d: got %d, want in range [1, 2]", i, retryAfter)
+		}
+		if got, want := rec.Body.String(), "service unavailable: too many concurrent requests"; got != want {
+			t.Errorf("%d: got %q, want %q", i, got, want)
+		}
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	close(unblock)
+	wg.Wait()
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/c/@v/list", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyCacheControl(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for _, tt := range []struct {
+		n                     int
+		immutableCacheControl string
+		mutableCacheControl   string
+		target                string
+		wantStatusCode        int
+		wantCacheControl      string
+	}{
+		{1, "", "", "/example.com/@v/v1.0.0.info", http.StatusOK, "public, max-age=604800"},
+		{2, "", "", "/example.com/@v/list", http.StatusOK, "public, max-age=60"},
+		{3, "", "", "/example.com/@latest", http.StatusOK, "public, max-age=60"},
+		{4, "public, max-age=31536000, immutable", "", "/example.com/@v/v1.0.0.zip", http.StatusOK, "public, max-age=31536000, immutable"},
+		{5, "public, max-age=31536000, immutable", "", "/example.com/@v/v1.0.0.ziphash", http.StatusOK, "public, max-age=31536000, immutable"},
+		{6, "public, max-age=31536000, immutable", "", "/example.com/@latest", http.StatusOK, "public, max-age=60"},
+		{7, "public, max-age=31536000, immutable", "", "/example.com/@v/v1.1.0.mod", http.StatusNotFound, "public, max-age=600"},
+		{8, "", "public, max-age=30", "/example.com/@latest", http.StatusOK, "public, max-age=30"},
+		{9, "", "public, max-age=30", "/example.com/@v/master.info", http.StatusOK, "public, max-age=30"},
+		{10, "", "public, max-age=30", "/example.com/@v/list", http.StatusOK, "public, max-age=30"},
+		{11, "", "public, max-age=30", "/example.com/@v/v1.0.0.mod", http.StatusOK, "public, max-age=604800"},
+		{12, "", "public, max-age=30", "/nonexistent/@v/list", http.StatusNotFound, "public, max-age=86400"},
+	} {
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					if path != "example.com" {
+						return "", time.Time{}, notExistErrorf("unknown module")
+					}
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					if path != "example.com" {
+						return nil, notExistErrorf("unknown module")
+					}
+					return []string{"v1.0.0"}, nil
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zipContent io.ReadSeekCloser, err error) {
+					if version != "v1.0.0" {
+						return nil, nil, nil, notExistErrorf("unknown revision")
+					}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zip)), nil
+				},
+			},
+			ServeZipHashes:        true,
+			ImmutableCacheControl: tt.immutableCacheControl,
+			MutableCacheControl:   tt.mutableCacheControl,
+			TempDir:               t.TempDir(),
+			ErrorLogger:           log.New(io.Discard, "", 0),
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", tt.target, nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Header().Get("Cache-Control"), tt.wantCacheControl; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyContentLength(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("module example.com")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	nonSeekableGet := func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+		rc, err := c.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{rc, rc}, nil
+	}
+	for _, tt := range []struct {
+		n                 int
+		cacher            Cacher
+		rangeHeader       string
+		wantStatusCode    int
+		wantContentLength string
+		wantContent       string
+	}{
+		{1, dc, "", http.StatusOK, "18", "module example.com"},
+		{2, dc, "bytes=0-5", http.StatusPartialContent, "6", "module"},
+		{3, &testStatCacher{testCacher{Cacher: dc, get: nonSeekableGet}}, "", http.StatusOK, "18", "module example.com"},
+		{4, &testCacher{Cacher: dc, get: nonSeekableGet}, "", http.StatusOK, "", "module example.com"},
+	} {
+		g := &Goproxy{Fetcher: &testFetcher{}, Cacher: tt.cacher}
+		req := httptest.NewRequest("", "/example.com/@v/v1.0.0.mod", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Length"), tt.wantContentLength; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyCachedVersions(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	for _, name := range []string{
+		"example.com/!foo/@v/list",
+		"example.com/!foo/@v/v1.10.0.info",
+		"example.com/!foo/@v/v1.2.0.info",
+		"example.com/!foo/@v/v1.2.0.mod",
+		"example.com/!foo/@v/v1.3.0.mod",
+		"example.com/!foo/@v/v0.0.0-20000101000000-000000000000.info",
+		"example.com/!foo/@v/v1.0.0-rc.1.info",
+		"example.com/!foo/@v/latest.info",
+		"example.com/!foo/bar/@v/v1.0.0.info",
+	} {
+		if err := dc.Put(context.Background(), name, strings.NewReader("foobar")); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n            int
+		cacher       Cacher
+		modulePath   string
+		wantVersions []string
+		wantErr      error
+	}{
+		{
+			n:            1,
+			cacher:       dc,
+			modulePath:   "example.com/Foo",
+			wantVersions: []string{"v0.0.0-20000101000000-000000000000", "v1.0.0-rc.1", "v1.2.0", "v1.10.0"},
+		},
+		{
+			n:            2,
+			cacher:       dc,
+			modulePath:   "example.com/Foo/bar",
+			wantVersions: []string{"v1.0.0"},
 		},
 		{
-			n:                10,
-			target:           "example.com/@v/v1.0.0.mod",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      mod,
+			n:          3,
+			cacher:     dc,
+			modulePath: "example.com/nonexistent",
 		},
 		{
-			n: 11,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(mod)), nil
+			n:          4,
+			modulePath: "example.com/Foo",
+			wantErr:    errors.New("cacher does not support listing"),
+		},
+	} {
+		g := &Goproxy{Cacher: tt.cacher}
+		versions, err := g.CachedVersions(context.Background(), tt.modulePath)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(versions, ","), strings.Join(tt.wantVersions, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyInspect(t *testing.T) {
+	clearGoFetcherBuiltInEnv(t)
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	zip := strings.Repeat("zip", 100)
+	var zipDownloads int
+	setProxyHandler(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/example.com/@latest", "/example.com/@v/v1.0.0.info":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		case "/example.com/@v/v1.0.0.zip":
+			if req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+				zipDownloads++
+			}
+			responseSuccess(rw, req, strings.NewReader(zip), "application/zip", -2)
+		case "/example.org/@v/v1.0.0.info":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		default:
+			responseNotFound(rw, req, -2)
+		}
+	})
+	for _, tt := range []struct {
+		n               int
+		fetcher         Fetcher
+		allowedPrefixes []string
+		modules         []string
+		wantInfos       []ModuleInfo
+	}{
+		{
+			n: 1,
+			modules: []string{
+				"example.com@v1.0.0",
+				"example.com@latest",
+				"example.com@v1.1.0",
+				"example.org@v1.0.0",
+				"example.com",
+				"foobar@v1.0.0",
+			},
+			wantInfos: []ModuleInfo{
+				{Module: "example.com@v1.0.0", Path: "example.com", Version: "v1.0.0", Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), ZipSize: 300},
+				{Module: "example.com@latest", Path: "example.com", Version: "v1.0.0", Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), ZipSize: 300},
+				{Module: "example.com@v1.1.0", Path: "example.com", ZipSize: -1, Err: notExistErrorf("not found")},
+				{Module: "example.org@v1.0.0", Path: "example.org", Version: "v1.0.0", Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), ZipSize: -1, Err: notExistErrorf("HEAD %s/example.org/@v/v1.0.0.zip: 404 Not Found", proxyServer.URL)},
+				{Module: "example.com", ZipSize: -1, Err: notExistErrorf(`invalid module version "example.com": missing version`)},
+				{Module: "foobar@v1.0.0", Path: "foobar", ZipSize: -1, Err: notExistErrorf(`malformed module path "foobar": missing dot in first path element`)},
+			},
+		},
+		{
+			n:               2,
+			allowedPrefixes: []string{"example.org"},
+			modules:         []string{"example.com@v1.0.0"},
+			wantInfos: []ModuleInfo{
+				{Module: "example.com@v1.0.0", Path: "example.com", ZipSize: -1, Err: notExistErrorf("example.com: module path not allowed")},
+			},
+		},
+		{
+			n: 3,
+			fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
 				},
 			},
-			target:             "example.com/@v/v1.0.0.mod",
-			disableModuleFetch: true,
-			wantStatusCode:     http.StatusOK,
-			wantContentType:    "text/plain; charset=utf-8",
-			wantCacheControl:   "public, max-age=604800",
-			wantContent:        mod,
+			modules: []string{"example.com@latest"},
+			wantInfos: []ModuleInfo{
+				{Module: "example.com@latest", Path: "example.com", Version: "v1.0.0", Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), ZipSize: -1},
+			},
+		},
+	} {
+		if tt.fetcher == nil {
+			tt.fetcher = &GoFetcher{Env: []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"}, TempDir: t.TempDir()}
+		}
+		g := &Goproxy{
+			Fetcher:         tt.fetcher,
+			Cacher:          &DirCacher{Dir: t.TempDir()},
+			AllowedPrefixes: tt.allowedPrefixes,
+		}
+		infos, err := g.Inspect(context.Background(), tt.modules)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := len(infos), len(tt.wantInfos); got != want {
+			t.Fatalf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		for i, info := range infos {
+			wantInfo := tt.wantInfos[i]
+			if wantInfo.Err != nil {
+				if info.Err == nil {
+					t.Errorf("test(%d): %s: expected error", tt.n, info.Module)
+				} else if got, want := info.Err, wantInfo.Err; !compareErrors(got, want) {
+					t.Errorf("test(%d): %s: got %q, want %q", tt.n, info.Module, got, want)
+				}
+			} else if info.Err != nil {
+				t.Errorf("test(%d): %s: unexpected error %q", tt.n, info.Module, info.Err)
+			}
+			info.Err, wantInfo.Err = nil, nil
+			if got, want := info, wantInfo; got != want {
+				t.Errorf("test(%d): got %+v, want %+v", tt.n, got, want)
+			}
+		}
+		if names := walkDirFiles(t, g.Cacher.(*DirCacher).Dir); len(names) > 0 {
+			t.Errorf("test(%d): unexpected caches %q", tt.n, names)
+		}
+	}
+	if got, want := zipDownloads, 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g := &Goproxy{Fetcher: &testFetcher{}}
+	if infos, err := g.Inspect(ctx, []string{"example.com@v1.0.0"}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	} else if got, want := len(infos), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyMirrorModules(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	var mu sync.Mutex
+	var downloads []string
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			list: func(ctx context.Context, path string) ([]string, error) {
+				switch path {
+				case "example.com/foo":
+					return []string{"v1.0.0", "v1.1.0-beta.1", "v1.1.0", "v1.2.0", "master"}, nil
+				case "example.com/bar":
+					return []string{"v0.1.0"}, nil
+				}
+				return nil, notExistErrorf("%s: unknown module", path)
+			},
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				mu.Lock()
+				downloads = append(downloads, path+"@"+version)
+				mu.Unlock()
+				if version == "v1.2.0" {
+					return nil, nil, nil, notExistErrorf("%s@%s: broken", path, version)
+				}
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher:      dc,
+		TempDir:     t.TempDir(),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	for _, ext := range []string{"info", "mod", "zip"} {
+		name, _ := CacheName("example.com/foo", "v1.0.0", ext)
+		if err := dc.Put(context.Background(), name, strings.NewReader(ext)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	formatReport := func(report MirrorReport) string {
+		var lines []string
+		for _, mm := range report.Modules {
+			if mm.Err != nil {
+				lines = append(lines, mm.Path+": "+mm.Err.Error())
+				continue
+			}
+			for _, mv := range mm.Versions {
+				line := mm.Path + "@" + mv.Version + ": "
+				switch {
+				case mv.Err != nil:
+					line += mv.Err.Error()
+				case mv.Skipped:
+					line += "skipped"
+				default:
+					line += "ok"
+				}
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	for _, tt := range []struct {
+		n             int
+		modulePaths   []string
+		opts          MirrorOptions
+		wantReport    string
+		wantDownloads string
+	}{
+		{
+			n:           1,
+			modulePaths: []string{"example.com/foo", "example.com/bar", "example.com/baz", "Example.com"},
+			opts:        MirrorOptions{Concurrency: 2, SkipCached: true},
+			wantReport: strings.Join([]string{
+				"example.com/foo@v1.0.0: skipped",
+				"example.com/foo@v1.1.0: ok",
+				"example.com/foo@v1.2.0: example.com/foo@v1.2.0: broken",
+				"example.com/foo@master: example.com/foo@master: invalid version: not a semantic version",
+				"example.com/bar@v0.1.0: ok",
+				"example.com/baz: example.com/baz: unknown module",
+				`Example.com: malformed module path "Example.com": invalid char 'E' in first path element`,
+			}, "\n"),
+			wantDownloads: "example.com/bar@v0.1.0,example.com/foo@v1.1.0,example.com/foo@v1.2.0",
 		},
 		{
-			n:                12,
-			target:           "example.com/@v/v1.0.0.zip",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/zip",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      string(zip),
+			n:           2,
+			modulePaths: []string{"example.com/foo"},
+			opts:        MirrorOptions{IncludePrereleases: true, SkipCached: true},
+			wantReport: strings.Join([]string{
+				"example.com/foo@v1.0.0: skipped",
+				"example.com/foo@v1.1.0-beta.1: ok",
+				"example.com/foo@v1.1.0: skipped",
+				"example.com/foo@v1.2.0: example.com/foo@v1.2.0: broken",
+				"example.com/foo@master: example.com/foo@master: invalid version: not a semantic version",
+			}, "\n"),
+			wantDownloads: "example.com/foo@v1.1.0-beta.1,example.com/foo@v1.2.0",
 		},
 		{
-			n: 13,
+			n:           3,
+			modulePaths: []string{"example.com/bar"},
+			wantReport:  "example.com/bar@v0.1.0: ok",
+		},
+	} {
+		downloads = nil
+		report, err := g.MirrorModules(context.Background(), tt.modulePaths, tt.opts)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := formatReport(report), tt.wantReport; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		sort.Strings(downloads)
+		if got, want := strings.Join(downloads, ","), tt.wantDownloads; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report, err := g.MirrorModules(ctx, []string{"example.com/foo"}, MirrorOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	} else if got, want := formatReport(report), "example.com/foo: context canceled"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := (&Goproxy{}).MirrorModules(context.Background(), nil, MirrorOptions{}); err == nil {
+		t.Error("expected error")
+	} else if got, want := err.Error(), "cacher is not set"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyExportModule(t *testing.T) {
+	files := map[string]string{
+		"example.com/!foo/@v/v1.0.0.info":    marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/!foo/@v/v1.0.0.mod":     "module example.com/Foo",
+		"example.com/!foo/@v/v1.0.0.zip":     "zip",
+		"example.com/!foo/@v/v1.0.0.ziphash": "h1:hash",
+		"example.com/!foo/@v/v1.1.0.info":    marshalInfo("v1.1.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/!foo/@v/v1.1.0.mod":     "module example.com/Foo",
+		"example.com/!foo/@v/v1.1.0.zip":     "zip",
+		"example.com/!foo/@v/v1.2.0.info":    marshalInfo("v1.2.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/!foo/@v/v1.2.0.mod":     "module example.com/Foo",
+	}
+	dc := &DirCacher{Dir: t.TempDir()}
+	for name, content := range files {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n             int
+		cacher        Cacher
+		moduleVersion string
+		wantNames     []string
+		wantErr       error
+	}{
+		{
+			n:             1,
+			moduleVersion: "v1.0.0",
+			wantNames: []string{
+				"example.com/!foo/@v/v1.0.0.info",
+				"example.com/!foo/@v/v1.0.0.mod",
+				"example.com/!foo/@v/v1.0.0.zip",
+				"example.com/!foo/@v/v1.0.0.ziphash",
+			},
+		},
+		{
+			n:             2,
+			moduleVersion: "v1.1.0",
+			wantNames: []string{
+				"example.com/!foo/@v/v1.1.0.info",
+				"example.com/!foo/@v/v1.1.0.mod",
+				"example.com/!foo/@v/v1.1.0.zip",
+			},
+		},
+		{
+			n:             3,
+			moduleVersion: "v1.2.0",
+			wantErr:       notExistErrorf("example.com/Foo@v1.2.0 is not fully cached: missing example.com/!foo/@v/v1.2.0.zip"),
+		},
+		{
+			n:             4,
+			moduleVersion: "v1",
+			wantErr:       notExistErrorf("example.com/Foo@v1: invalid version: not a canonical version"),
+		},
+		{
+			n: 5,
 			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
+				Cacher: dc,
 				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(bytes.NewReader(zip)), nil
+					return nil, errors.New("cannot get")
 				},
 			},
-			target:             "example.com/@v/v1.0.0.zip",
-			disableModuleFetch: true,
-			wantStatusCode:     http.StatusOK,
-			wantContentType:    "application/zip",
-			wantCacheControl:   "public, max-age=604800",
-			wantContent:        string(zip),
+			moduleVersion: "v1.0.0",
+			wantErr:       errors.New("cannot get"),
+		},
+	} {
+		if tt.cacher == nil {
+			tt.cacher = dc
+		}
+		g := &Goproxy{Cacher: tt.cacher}
+		var buf bytes.Buffer
+		err := g.ExportModule(context.Background(), &buf, "example.com/Foo", tt.moduleVersion)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got := buf.Len(); got != 0 {
+				t.Errorf("test(%d): got %d, want 0", tt.n, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+
+		var names []string
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			names = append(names, header.Name)
+			if b, err := io.ReadAll(tr); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), files[header.Name]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := strings.Join(names, ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		importedDirCacher := &DirCacher{Dir: t.TempDir()}
+		if err := importedDirCacher.Sync(context.Background(), bytes.NewReader(buf.Bytes()), "application/x-tar", SyncOptions{}); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(walkDirFiles(t, importedDirCacher.Dir), ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyExport(t *testing.T) {
+	files := map[string]string{
+		"example.com/!foo/@v/list":        "v1.0.0",
+		"example.com/!foo/@v/v1.0.0.info": marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/!foo/@v/v1.0.0.mod":  "module example.com/Foo",
+		"example.com/bar/@latest":         marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	dc := &DirCacher{Dir: t.TempDir()}
+	for name, content := range files {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n         int
+		cacher    Cacher
+		opts      ExportOptions
+		wantNames []string
+		wantErr   error
+	}{
+		{
+			n: 1,
+			wantNames: []string{
+				"example.com/!foo/@v/list",
+				"example.com/!foo/@v/v1.0.0.info",
+				"example.com/!foo/@v/v1.0.0.mod",
+				"example.com/bar/@latest",
+			},
 		},
 		{
-			n:                14,
-			target:           "example.com",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found: missing /@v/",
+			n:         2,
+			opts:      ExportOptions{Prefix: "example.com/bar/"},
+			wantNames: []string{"example.com/bar/@latest"},
 		},
 		{
-			n:                15,
-			target:           "example.com/@/",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found: missing /@v/",
+			n:    3,
+			opts: ExportOptions{Gzip: true},
+			wantNames: []string{
+				"example.com/!foo/@v/list",
+				"example.com/!foo/@v/v1.0.0.info",
+				"example.com/!foo/@v/v1.0.0.mod",
+				"example.com/bar/@latest",
+			},
 		},
 		{
-			n:                16,
-			target:           "foobar/@latest",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      `not found: invalid escaped module path "foobar": malformed module path "foobar": missing dot in first path element`,
+			n:         4,
+			opts:      ExportOptions{Prefix: "example.com/!foo/@v/v1", Gzip: true, GzipLevel: gzip.BestSpeed},
+			wantNames: []string{"example.com/!foo/@v/v1.0.0.info", "example.com/!foo/@v/v1.0.0.mod"},
 		},
 		{
-			n:                17,
-			target:           "example.com/@v/foobar",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      `not found: no file extension in filename "foobar"`,
+			n:       5,
+			opts:    ExportOptions{Gzip: true, GzipLevel: 10},
+			wantErr: errors.New("gzip: invalid compression level: 10"),
+		},
+		{
+			n:       6,
+			cacher:  &HTTPCacher{},
+			wantErr: errors.New("cacher does not support listing"),
+		},
+		{
+			n: 7,
+			cacher: &struct {
+				*testCacher
+				Lister
+			}{&testCacher{
+				Cacher: dc,
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					if name == "example.com/bar/@latest" {
+						return nil, fs.ErrNotExist
+					}
+					return c.Get(ctx, name)
+				},
+			}, dc},
+			wantNames: []string{
+				"example.com/!foo/@v/list",
+				"example.com/!foo/@v/v1.0.0.info",
+				"example.com/!foo/@v/v1.0.0.mod",
+			},
 		},
+	} {
+		if tt.cacher == nil {
+			tt.cacher = dc
+		}
+		g := &Goproxy{Cacher: tt.cacher}
+		var buf bytes.Buffer
+		err := g.Export(context.Background(), &buf, tt.opts)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+
+		var r io.Reader = bytes.NewReader(buf.Bytes())
+		compressType := "application/x-tar"
+		if tt.opts.Gzip {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			r = gr
+			compressType = "application/gzip"
+		}
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			names = append(names, header.Name)
+			if b, err := io.ReadAll(tr); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), files[header.Name]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := strings.Join(names, ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		importedDirCacher := &DirCacher{Dir: t.TempDir()}
+		if err := importedDirCacher.Sync(context.Background(), bytes.NewReader(buf.Bytes()), compressType, SyncOptions{}); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := strings.Join(walkDirFiles(t, importedDirCacher.Dir), ","), strings.Join(tt.wantNames, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyDeltaExport(t *testing.T) {
+	files := map[string]string{
+		"example.com/@v/list":        "v1.0.0\nv1.1.0",
+		"example.com/@v/v1.0.0.info": marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/@v/v1.0.0.mod":  "module example.com",
+		"example.com/@v/v1.1.0.info": marshalInfo("v1.1.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/@v/v1.1.0.mod":  "module example.com",
+	}
+	dc := &DirCacher{Dir: t.TempDir()}
+	for name, content := range files {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n              int
+		remoteFiles    map[string]string
+		remoteHashFunc func() hash.Hash
+		remoteHashName string
+		manifest       ManifestOptions
+		opts           ExportOptions
+		wantNames      []string
+	}{
 		{
-			n:                18,
-			target:           "example.com/@v/foo.bar",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      `not found: unexpected extension ".bar"`,
+			n: 1,
+			remoteFiles: map[string]string{
+				"example.com/@v/list":        "v1.0.0",
+				"example.com/@v/v1.0.0.info": files["example.com/@v/v1.0.0.info"],
+				"example.com/@v/v1.0.0.mod":  "module example.org",
+				"example.com/@v/v2.0.0.mod":  "module example.com/v2",
+			},
+			manifest:  ManifestOptions{SHA256: true},
+			wantNames: []string{"example.com/@v/list", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.1.0.info", "example.com/@v/v1.1.0.mod"},
 		},
 		{
-			n:                19,
-			target:           "example.com/@v/!!v1.0.0.info",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      `not found: invalid escaped version "!!v1.0.0"`,
+			n: 2,
+			remoteFiles: map[string]string{
+				"example.com/@v/list":        "v1.0.0",
+				"example.com/@v/v1.0.0.info": files["example.com/@v/v1.0.0.info"],
+				"example.com/@v/v1.0.0.mod":  "module example.org",
+			},
+			wantNames: []string{"example.com/@v/list", "example.com/@v/v1.1.0.info", "example.com/@v/v1.1.0.mod"},
 		},
 		{
-			n:                20,
-			target:           "example.com/@v/latest.info",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found: invalid version",
+			n:           3,
+			remoteFiles: files,
+			manifest:    ManifestOptions{SHA256: true},
 		},
 		{
-			n:                21,
-			target:           "example.com/@v/upgrade.info",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found: invalid version",
+			n:         4,
+			opts:      ExportOptions{Prefix: "example.com/@v/v1.1.0", Gzip: true},
+			wantNames: []string{"example.com/@v/v1.1.0.info", "example.com/@v/v1.1.0.mod"},
 		},
 		{
-			n:                22,
-			target:           "example.com/@v/patch.info",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found: invalid version",
+			n: 5,
+			remoteFiles: map[string]string{
+				"example.com/@v/list":        "v1.0.0",
+				"example.com/@v/v1.0.0.info": files["example.com/@v/v1.0.0.info"],
+				"example.com/@v/v1.0.0.mod":  "module example.org",
+			},
+			remoteHashFunc: sha512.New,
+			remoteHashName: "sha512",
+			manifest:       ManifestOptions{Digest: true},
+			wantNames:      []string{"example.com/@v/list", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.1.0.info", "example.com/@v/v1.1.0.mod"},
 		},
 		{
-			n:                23,
-			target:           "example.com/@v/master.mod",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=86400",
-			wantContent:      "not found: unrecognized version",
+			n:              6,
+			remoteFiles:    files,
+			remoteHashFunc: sha512.New,
+			remoteHashName: "custom",
+			manifest:       ManifestOptions{Digest: true},
+			wantNames:      []string{"example.com/@v/list", "example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.1.0.info", "example.com/@v/v1.1.0.mod"},
 		},
 	} {
-		if tt.cacher == nil {
-			tt.cacher = DirCacher(t.TempDir())
+		remoteDirCacher := &DirCacher{Dir: t.TempDir(), HashFunc: tt.remoteHashFunc, HashName: tt.remoteHashName}
+		for name, content := range tt.remoteFiles {
+			if err := remoteDirCacher.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
 		}
-		g := &Goproxy{
-			Fetcher: &GoFetcher{
-				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
-				TempDir: t.TempDir(),
-			},
-			Cacher:      tt.cacher,
-			TempDir:     t.TempDir(),
-			ErrorLogger: log.New(io.Discard, "", 0),
+		var manifest bytes.Buffer
+		if err := remoteDirCacher.Manifest(context.Background(), &manifest, tt.manifest); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
 		}
-		g.initOnce.Do(g.init)
-		req := httptest.NewRequest("", "/", nil)
-		if tt.disableModuleFetch {
-			req.Header.Set("Disable-Module-Fetch", "true")
+
+		g := &Goproxy{Cacher: dc}
+		var buf bytes.Buffer
+		if err := g.DeltaExport(context.Background(), &manifest, &buf, tt.opts); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
 		}
-		rec := httptest.NewRecorder()
-		g.serveFetch(rec, req, tt.target)
-		recr := rec.Result()
-		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
-			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		var r io.Reader = bytes.NewReader(buf.Bytes())
+		compressType := "application/x-tar"
+		if tt.opts.Gzip {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			r = gr
+			compressType = "application/gzip"
 		}
-		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
-			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			names = append(names, header.Name)
+			if b, err := io.ReadAll(tr); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), files[header.Name]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
 		}
-		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+		if got, want := strings.Join(names, ","), strings.Join(tt.wantNames, ","); got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
-		if b, err := io.ReadAll(recr.Body); err != nil {
+
+		if err := remoteDirCacher.Sync(context.Background(), bytes.NewReader(buf.Bytes()), compressType, SyncOptions{}); err != nil {
 			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
-		} else if got, want := string(b), tt.wantContent; got != want {
-			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
+		for _, name := range tt.wantNames {
+			if b, err := os.ReadFile(filepath.Join(remoteDirCacher.Dir, filepath.FromSlash(name))); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), files[name]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+
+	g := &Goproxy{Cacher: dc}
+	if err := g.DeltaExport(context.Background(), strings.NewReader("foobar"), io.Discard, ExportOptions{}); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, errors.New("invalid remote manifest: invalid character 'o' in literal false (expecting 'a')"); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
 	}
 }
 
-func TestGoproxyServeFetchQuery(t *testing.T) {
-	proxyServer, setProxyHandler := newHTTPTestServer()
-	defer proxyServer.Close()
-	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
-	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
-		responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+func TestGoproxyExportSymlinks(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("module example.com")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := os.Symlink("v1.0.0.mod", filepath.Join(dc.Dir, "example.com", "@v", "v1.0.1.mod")); err != nil {
+		t.Fatalf("unexpected error %q", err)
 	}
+	g := &Goproxy{Cacher: dc}
 	for _, tt := range []struct {
 		n                int
-		proxyHandler     http.HandlerFunc
-		cacher           Cacher
-		noFetch          bool
-		wantStatusCode   int
-		wantContentType  string
-		wantCacheControl string
-		wantContent      string
+		opts             ExportOptions
+		syncOpts         SyncOptions
+		restrictSymlinks bool
+		wantTypeflag     byte
+		wantTarget       string
+	}{
+		{n: 1, syncOpts: SyncOptions{ImportSymlinks: true}, wantTypeflag: tar.TypeSymlink, wantTarget: "v1.0.0.mod"},
+		{n: 2, syncOpts: SyncOptions{ImportSymlinks: true, Staged: true}, wantTypeflag: tar.TypeSymlink, wantTarget: "v1.0.0.mod"},
+		{n: 3, syncOpts: SyncOptions{ImportSymlinks: true}, restrictSymlinks: true, wantTypeflag: tar.TypeSymlink, wantTarget: "v1.0.0.mod"},
+		{n: 4, opts: ExportOptions{DereferenceSymlinks: true}, wantTypeflag: tar.TypeReg},
+	} {
+		var buf bytes.Buffer
+		if err := g.Export(context.Background(), &buf, tt.opts); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if header.Name != "example.com/@v/v1.0.1.mod" {
+				continue
+			}
+			if got, want := header.Typeflag, tt.wantTypeflag; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := header.Linkname, tt.wantTarget; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+
+		synced := &DirCacher{Dir: t.TempDir(), RestrictSymlinks: tt.restrictSymlinks}
+		if err := synced.Sync(context.Background(), &buf, "application/x-tar", tt.syncOpts); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if target, err := synced.Readlink(context.Background(), "example.com/@v/v1.0.1.mod"); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := target, tt.wantTarget; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if rc, err := synced.Get(context.Background(), "example.com/@v/v1.0.1.mod"); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if b, err := io.ReadAll(rc); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), "module example.com"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		} else {
+			rc.Close()
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := g.Export(context.Background(), &buf, ExportOptions{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	synced := &DirCacher{Dir: t.TempDir()}
+	if err := synced.Sync(context.Background(), &buf, "application/x-tar", SyncOptions{Logger: log.New(io.Discard, "", 0)}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := os.Lstat(filepath.Join(synced.Dir, "example.com", "@v", "v1.0.1.mod")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+
+	for _, tt := range []struct {
+		n       int
+		staged  bool
+		headers []*tar.Header
 	}{
+		{n: 1, headers: []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "example.com/@v/v1.0.0.mod", Linkname: "../../../outside"}}},
+		{n: 2, headers: []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "example.com/@v/v1.0.0.mod", Linkname: "/etc/passwd"}}},
+		{n: 3, headers: []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "example.com/@v/v1.0.0.mod", Linkname: "../.."}}},
+		{n: 4, headers: []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "example.com/@v/v1.0.0.mod", Linkname: "a/../../b"}}},
 		{
-			n:                1,
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      info,
+			n: 5,
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeReg, Name: "d/keep"},
+				{Typeflag: tar.TypeSymlink, Name: "x/y/c", Linkname: "../../d"},
+				{Typeflag: tar.TypeSymlink, Name: "x/y/c/e", Linkname: "../../../b"},
+				{Typeflag: tar.TypeReg, Name: "x/y/c/e/pwn"},
+			},
 		},
 		{
-			n: 2,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(info)), nil
-				},
+			n: 6,
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeReg, Name: "d/keep"},
+				{Typeflag: tar.TypeSymlink, Name: "x/y/c", Linkname: "../../d"},
+				{Typeflag: tar.TypeReg, Name: "x/y/c/pwn"},
 			},
-			noFetch:          true,
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      info,
 		},
 		{
-			n:                3,
-			proxyHandler:     func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      "not found",
+			n:      7,
+			staged: true,
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeReg, Name: "d/keep"},
+				{Typeflag: tar.TypeSymlink, Name: "x/y/c", Linkname: "../../d"},
+				{Typeflag: tar.TypeSymlink, Name: "x/y/c/e", Linkname: "../../../b"},
+			},
 		},
 	} {
-		if tt.proxyHandler == nil {
-			tt.proxyHandler = proxyHandler
+		base := t.TempDir()
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, header := range tt.headers {
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
 		}
-		setProxyHandler(tt.proxyHandler)
-		if tt.cacher == nil {
-			tt.cacher = DirCacher(t.TempDir())
+		if err := tw.Close(); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
 		}
-		g := &Goproxy{
-			Fetcher: &GoFetcher{
-				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
-				TempDir: t.TempDir(),
+		synced := &DirCacher{Dir: filepath.Join(base, "a", "b", "cache")}
+		if err := synced.Sync(context.Background(), &buf, "application/x-tar", SyncOptions{ImportSymlinks: true, Staged: tt.staged}); err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		} else if got, want := err, ErrUnsafeSymlink; !errors.Is(got, want) {
+			t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, got, want)
+		}
+		for _, name := range []string{"a/b/pwn", "a/b/e", "a/b/cache/d/pwn"} {
+			if _, err := os.Lstat(filepath.Join(base, filepath.FromSlash(name))); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("test(%d): got %v, want fs.ErrNotExist", tt.n, err)
+			}
+		}
+	}
+}
+
+func TestGoproxyExportToURL(t *testing.T) {
+	files := map[string]string{
+		"example.com/@v/list":        "v1.0.0",
+		"example.com/@v/v1.0.0.info": marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"example.com/@v/v1.0.0.mod":  "module example.com",
+	}
+	dc := &DirCacher{Dir: t.TempDir()}
+	for name, content := range files {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	server, setHandler := newHTTPTestServer()
+	defer server.Close()
+	for _, tt := range []struct {
+		n               int
+		cacher          Cacher
+		opts            ExportOptions
+		handler         http.HandlerFunc
+		wantContentType string
+		wantNames       []string
+		wantErr         error
+	}{
+		{
+			n:               1,
+			wantContentType: "application/x-tar",
+			wantNames:       []string{"example.com/@v/list", "example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"},
+		},
+		{
+			n:               2,
+			opts:            ExportOptions{Prefix: "example.com/@v/v1.0.0.", Gzip: true},
+			wantContentType: "application/gzip",
+			wantNames:       []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"},
+		},
+		{
+			n: 3,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseForbidden(rw, req, -2)
 			},
-			Cacher:      tt.cacher,
-			TempDir:     t.TempDir(),
-			ErrorLogger: log.New(io.Discard, "", 0),
+			wantErr: fmt.Errorf("PUT %s/backup: 403 Forbidden: forbidden", server.URL),
+		},
+		{
+			n:       4,
+			cacher:  &HTTPCacher{},
+			wantErr: errors.New("cacher does not support listing"),
+		},
+	} {
+		var (
+			gotContentType string
+			uploaded       *DirCacher
+		)
+		setHandler(func(rw http.ResponseWriter, req *http.Request) {
+			if got, want := req.Method, http.MethodPut; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if tt.handler != nil {
+				tt.handler(rw, req)
+				return
+			}
+			gotContentType = req.Header.Get("Content-Type")
+			uploaded = &DirCacher{Dir: t.TempDir()}
+			// Read the upload one byte at a time to throttle the export.
+			if err := uploaded.Sync(req.Context(), iotest.OneByteReader(req.Body), gotContentType, SyncOptions{}); err != nil {
+				responseInternalServerError(rw, req)
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		})
+		cacher := tt.cacher
+		if cacher == nil {
+			cacher = dc
 		}
-		g.initOnce.Do(g.init)
-		rec := httptest.NewRecorder()
-		g.serveFetchQuery(rec, httptest.NewRequest("", "/", nil), "example.com/@latest", "example.com", "latest", tt.noFetch)
-		recr := rec.Result()
-		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
-			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		g := &Goproxy{Cacher: cacher}
+		err := g.ExportToURL(context.Background(), server.URL+"/backup", tt.opts)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
 		}
-		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := gotContentType, tt.wantContentType; got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
-		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+		for _, name := range tt.wantNames {
+			if b, err := os.ReadFile(filepath.Join(uploaded.Dir, filepath.FromSlash(name))); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), files[name]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := strings.Join(walkDirFiles(t, uploaded.Dir), ","), strings.Join(tt.wantNames, ","); got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
-		if b, err := io.ReadAll(recr.Body); err != nil {
+	}
+}
+
+func TestCanonicalizeVersion(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		version     string
+		wantVersion string
+	}{
+		{1, "v1.2.3", "v1.2.3"},
+		{2, "v1.2.3+meta", "v1.2.3"},
+		{3, "v1.2.3+build.1", "v1.2.3"},
+		{4, "v1.2.3-rc.1+meta", "v1.2.3-rc.1"},
+		{5, "v2.0.0+incompatible", "v2.0.0+incompatible"},
+		{6, "v2.0.0+incompatible.meta", "v2.0.0+incompatible"},
+		{7, "v0.0.0-20191109021931-daa7c04131f5+meta", "v0.0.0-20191109021931-daa7c04131f5"},
+		{8, "v1.2", "v1.2"},
+		{9, "v1.2+meta", "v1.2+meta"},
+		{10, "v1", "v1"},
+		{11, "v01.2.3", "v01.2.3"},
+		{12, "master", "master"},
+	} {
+		if got, want := canonicalizeVersion(tt.version), tt.wantVersion; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestCacheName(t *testing.T) {
+	for _, tt := range []struct {
+		n          int
+		modulePath string
+		version    string
+		ext        string
+		wantName   string
+		wantErr    error
+	}{
+		{1, "example.com/foo", "v1.0.0", "info", "example.com/foo/@v/v1.0.0.info", nil},
+		{2, "example.com/Foo", "v1.0.0", "mod", "example.com/!foo/@v/v1.0.0.mod", nil},
+		{3, "example.com/Foo", "v1.0.0-RC1", "zip", "example.com/!foo/@v/v1.0.0-!r!c1.zip", nil},
+		{4, "example.com/foo", "v1.0.0", "ziphash", "example.com/foo/@v/v1.0.0.ziphash", nil},
+		{5, "example.com/foo", "master", "info", "example.com/foo/@v/master.info", nil},
+		{6, "example.com/Foo", "", "list", "example.com/!foo/@v/list", nil},
+		{7, "example.com/Foo", "", "latest", "example.com/!foo/@latest", nil},
+		{8, "example.com/foo", "v1.0.0", "list", "", errors.New(`unexpected version "v1.0.0" for "list"`)},
+		{9, "example.com/foo", "v1.0.0", "latest", "", errors.New(`unexpected version "v1.0.0" for "latest"`)},
+		{10, "example.com/foo", "", "info", "", errors.New(`missing version for "info"`)},
+		{11, "example.com/foo", "v1.0.0", ".info", "", errors.New(`unexpected extension ".info"`)},
+		{12, "example.com/foo", "v1.0.0", "tar", "", errors.New(`unexpected extension "tar"`)},
+		{13, "foobar", "v1.0.0", "info", "", errors.New(`malformed module path "foobar": missing dot in first path element`)},
+		{14, "example.com/foo", "v1.0.0/bar", "info", "", errors.New(`version "v1.0.0/bar" invalid: disallowed version string`)},
+		{15, "example.com/Foo/v2", "v2.1.0", "mod", "example.com/!foo/v2/@v/v2.1.0.mod", nil},
+		{16, "example.com/foo/v2", "", "list", "example.com/foo/v2/@v/list", nil},
+		{17, "example.com/Foo", "v2.0.0+incompatible", "zip", "example.com/!foo/@v/v2.0.0+incompatible.zip", nil},
+		{18, "gopkg.in/yaml.v2", "v2.4.0", "info", "gopkg.in/yaml.v2/@v/v2.4.0.info", nil},
+	} {
+		name, err := CacheName(tt.modulePath, tt.version, tt.ext)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
 			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
-		} else if got, want := string(b), tt.wantContent; got != want {
+		} else if got, want := name, tt.wantName; got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
 	}
 }
 
-func TestGoproxyServeFetchList(t *testing.T) {
-	proxyServer, setProxyHandler := newHTTPTestServer()
-	defer proxyServer.Close()
-	list := "v1.0.0\nv1.1.0"
-	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
-		responseSuccess(rw, req, strings.NewReader(list), "text/plain; charset=utf-8", -2)
+func TestGoproxySyncFromURL(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"./example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
 	}
+	server, setHandler := newHTTPTestServer()
+	defer server.Close()
 	for _, tt := range []struct {
-		n              int
-		proxyHandler   http.HandlerFunc
-		cacher         Cacher
-		noFetch        bool
-		wantStatusCode int
-		wantContent    string
+		n                int
+		path             string
+		state            string
+		noStateFile      bool
+		handler          http.HandlerFunc
+		wantIfNoneMatch  string
+		wantState        string
+		wantStateRemoved bool
+		wantFiles        []string
+		wantErr          error
 	}{
 		{
-			n:              1,
-			wantStatusCode: http.StatusOK,
-			wantContent:    list,
+			n:    1,
+			path: "/bundle",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("ETag", `"v1"`)
+				responseSuccess(rw, req, bytes.NewReader(bundle), "application/x-tar", -2)
+			},
+			wantState: `"v1"` + "\n",
+			wantFiles: []string{"example.com/@v/list"},
+		},
+		{
+			n:     2,
+			path:  "/bundle",
+			state: `"v1"` + "\n",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == `"v1"` {
+					rw.WriteHeader(http.StatusNotModified)
+					return
+				}
+				responseSuccess(rw, req, bytes.NewReader(bundle), "application/x-tar", -2)
+			},
+			wantIfNoneMatch: `"v1"`,
+			wantState:       `"v1"` + "\n",
+			wantErr:         ErrNotModified,
+		},
+		{
+			n:     3,
+			path:  "/bundle",
+			state: `"v1"` + "\n",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("ETag", `"v2"`)
+				responseSuccess(rw, req, bytes.NewReader(bundle), "application/x-tar", -2)
+			},
+			wantIfNoneMatch: `"v1"`,
+			wantState:       `"v2"` + "\n",
+			wantFiles:       []string{"example.com/@v/list"},
+		},
+		{
+			n:     4,
+			path:  "/bundle.tar",
+			state: `"v1"` + "\n",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseSuccess(rw, req, bytes.NewReader(bundle), "application/octet-stream", -2)
+			},
+			wantIfNoneMatch:  `"v1"`,
+			wantStateRemoved: true,
+			wantFiles:        []string{"example.com/@v/list"},
 		},
 		{
-			n: 2,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(list)), nil
-				},
+			n:           5,
+			path:        "/bundle",
+			noStateFile: true,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("ETag", `"v1"`)
+				responseSuccess(rw, req, bytes.NewReader(bundle), "application/x-tar", -2)
 			},
-			noFetch:        true,
-			wantStatusCode: http.StatusOK,
-			wantContent:    list,
+			wantFiles: []string{"example.com/@v/list"},
 		},
 		{
-			n:              3,
-			proxyHandler:   func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
-			wantStatusCode: http.StatusNotFound,
-			wantContent:    "not found",
+			n:    6,
+			path: "/bundle",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseNotFound(rw, req, -2, "not found")
+			},
+			wantStateRemoved: true,
+			wantErr:          fmt.Errorf("GET %s/bundle: 404 Not Found: not found", server.URL),
 		},
 	} {
-		if tt.proxyHandler == nil {
-			tt.proxyHandler = proxyHandler
+		var gotIfNoneMatch string
+		setHandler(func(rw http.ResponseWriter, req *http.Request) {
+			gotIfNoneMatch = req.Header.Get("If-None-Match")
+			tt.handler(rw, req)
+		})
+		var stateFile string
+		if !tt.noStateFile {
+			stateFile = filepath.Join(t.TempDir(), "state")
+			if tt.state != "" {
+				if err := os.WriteFile(stateFile, []byte(tt.state), 0o644); err != nil {
+					t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+				}
+			}
 		}
-		setProxyHandler(tt.proxyHandler)
-		if tt.cacher == nil {
-			tt.cacher = DirCacher(t.TempDir())
+		dc := &DirCacher{Dir: t.TempDir()}
+		g := &Goproxy{Cacher: dc}
+		err := g.SyncFromURL(context.Background(), server.URL+tt.path, stateFile)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := gotIfNoneMatch, tt.wantIfNoneMatch; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(walkDirFiles(t, dc.Dir), ","), strings.Join(tt.wantFiles, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if stateFile == "" {
+			continue
+		}
+		if b, err := os.ReadFile(stateFile); tt.wantStateRemoved {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, fs.ErrNotExist)
+			}
+		} else if err != nil {
+			t.Errorf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantState; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got := walkDirFiles(t, filepath.Dir(stateFile)); len(got) > 1 {
+			t.Errorf("test(%d): got %q, want no temporary files", tt.n, got)
 		}
+	}
+
+	g := &Goproxy{}
+	if err := g.SyncFromURL(context.Background(), server.URL, ""); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, errors.New("cacher is nil"); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyServeSyncMaxBodySize(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "bundle.tar")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := fw.Write(bundle); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	for _, tt := range []struct {
+		n               int
+		maxSyncBodySize int64
+		wantStatusCode  int
+		wantContent     string
+		wantFiles       []string
+	}{
+		{1, 0, http.StatusOK, "sync upload file success", []string{"example.com/@v/list"}},
+		{2, int64(body.Len()), http.StatusOK, "sync upload file success", []string{"example.com/@v/list"}},
+		{3, int64(body.Len()) - 1, http.StatusRequestEntityTooLarge, fmt.Sprintf("request entity too large: more than %d bytes", body.Len()-1), nil},
+		{4, -1, http.StatusOK, "sync upload file success", []string{"example.com/@v/list"}},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		tempDir := t.TempDir()
 		g := &Goproxy{
-			Fetcher: &GoFetcher{
-				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
-				TempDir: t.TempDir(),
-			},
-			Cacher:      tt.cacher,
-			TempDir:     t.TempDir(),
-			ErrorLogger: log.New(io.Discard, "", 0),
+			Cacher:          dc,
+			TempDir:         tempDir,
+			MaxSyncBodySize: tt.maxSyncBodySize,
+			ErrorLogger:     log.New(io.Discard, "", 0),
 		}
-		g.initOnce.Do(g.init)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
 		rec := httptest.NewRecorder()
-		g.serveFetchList(rec, httptest.NewRequest("", "/", nil), "example.com/@v/list", "example.com", tt.noFetch)
-		recr := rec.Result()
-		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+		g.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
 			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
 		}
-		if got, want := recr.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
-		if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+		if got, want := strings.Join(walkDirFiles(t, dc.Dir), ","), strings.Join(tt.wantFiles, ","); got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
-		if b, err := io.ReadAll(recr.Body); err != nil {
+		if entries, err := os.ReadDir(tempDir); err != nil {
 			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
-		} else if got, want := string(b), tt.wantContent; got != want {
-			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		} else if got := len(entries); got != 0 {
+			t.Errorf("test(%d): got %d temporary files, want 0", tt.n, got)
 		}
 	}
 }
 
-func TestGoproxyServeFetchDownload(t *testing.T) {
-	proxyServer, setProxyHandler := newHTTPTestServer()
-	defer proxyServer.Close()
-	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
-	mod := "module example.com"
-	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+func TestGoproxyServeSyncErrors(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"example.com/@v/list": []byte("v1.0.0")})
 	if err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
-	proxyHandler := func(rw http.ResponseWriter, req *http.Request) {
-		switch path.Ext(req.URL.Path) {
-		case ".info":
-			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
-		case ".mod":
-			responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
-		case ".zip":
-			responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
-		default:
-			responseNotFound(rw, req, -2)
+	twoFileBundle, err := makeTar(map[string][]byte{
+		"example.com/@v/list":        []byte("v1.0.0"),
+		"example.com/@v/v1.0.0.info": []byte("{}"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	gzipTar := func(tarBundle []byte) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(tarBundle); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		return buf.Bytes()
+	}
+	bombBundle, err := makeTar(map[string][]byte{"example.com/@v/v1.0.0.zip": make([]byte, 16<<20)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	publicKey, privateKey, err := makeMinisignKey("12345678")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	otherZip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com // tampered")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHashBundle, err := makeTar(map[string][]byte{
+		"example.com/@v/v1.0.0.zip":     otherZip,
+		"example.com/@v/v1.0.0.ziphash": []byte(mustHashZip(t, zip)),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	syncErr := func(err error) Cacher {
+		return &testCacher{
+			Cacher: &DirCacher{Dir: t.TempDir()},
+			sync: func(ctx context.Context, c Cacher, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+				return err
+			},
 		}
 	}
 	for _, tt := range []struct {
-		n                int
-		proxyHandler     http.HandlerFunc
-		cacher           Cacher
-		target           string
-		noFetch          bool
-		wantStatusCode   int
-		wantContentType  string
-		wantCacheControl string
-		wantContent      string
+		n              int
+		cacher         Cacher
+		syncOptions    SyncOptions
+		filename       string
+		contentType    string
+		bundle         []byte
+		wantStatusCode int
+		wantContent    string
 	}{
 		{
-			n:                1,
-			target:           "example.com/@v/v1.0.0.info",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      info,
+			n:              1,
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusNotImplemented,
+			wantContent:    "not implemented: cacher is nil",
 		},
 		{
-			n: 2,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(info)), nil
-				},
-			},
-			target:           "example.com/@v/v1.0.0.info",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      info,
+			n:              2,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			filename:       "bundle.zip",
+			bundle:         bundle,
+			wantStatusCode: http.StatusUnsupportedMediaType,
+			wantContent:    `unsupported media type: unsupported compress type "application/octet-stream" (supported: application/gzip, application/x-tar)`,
 		},
 		{
-			n: 3,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return io.NopCloser(strings.NewReader(info)), nil
-				},
-			},
-			target:           "example.com/@v/v1.0.0.info",
-			noFetch:          true,
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/json; charset=utf-8",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      info,
+			n:              3,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			filename:       "bundle.tar.gz",
+			bundle:         bundle,
+			wantStatusCode: http.StatusBadRequest,
+			wantContent:    "bad request: gzip: invalid header",
 		},
 		{
-			n:                4,
-			target:           "example.com/@v/v1.0.0.mod",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      mod,
+			n:              4,
+			cacher:         syncErr(ErrSyncInProgress),
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusConflict,
+			wantContent:    "conflict: sync in progress",
 		},
 		{
-			n:                5,
-			target:           "example.com/@v/v1.0.0.zip",
-			wantStatusCode:   http.StatusOK,
-			wantContentType:  "application/zip",
-			wantCacheControl: "public, max-age=604800",
-			wantContent:      string(zip),
+			n:              5,
+			cacher:         syncErr(ErrSyncQueueFull),
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusTooManyRequests,
+			wantContent:    "too many requests: sync queue full",
 		},
 		{
-			n:                6,
-			proxyHandler:     func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
-			target:           "example.com/@v/v1.0.0.info",
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=600",
-			wantContent:      "not found",
+			n:              6,
+			cacher:         syncErr(fmt.Errorf("%w: example.com/@v/list", ErrDuplicateEntry)),
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusUnprocessableEntity,
+			wantContent:    "unprocessable entity: duplicate entry: example.com/@v/list",
 		},
 		{
-			n:                7,
-			target:           "example.com/@v/v1.0.0.info",
-			noFetch:          true,
-			wantStatusCode:   http.StatusNotFound,
-			wantContentType:  "text/plain; charset=utf-8",
-			wantCacheControl: "public, max-age=60",
-			wantContent:      "not found: temporarily unavailable",
+			n:              7,
+			cacher:         syncErr(errors.New("disk failure")),
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusInternalServerError,
+			wantContent:    "internal server error",
 		},
 		{
-			n: 8,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
-					return nil, errors.New("cannot get")
-				},
-			},
-			target:          "example.com/@v/v1.0.0.info",
-			wantStatusCode:  http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantContent:     "internal server error",
+			n:              8,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			syncOptions:    SyncOptions{MaxFiles: 1},
+			filename:       "bundle.tar",
+			bundle:         twoFileBundle,
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+			wantContent:    "request entity too large: too many files: more than 1 files",
 		},
 		{
-			n: 9,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
-					return errors.New("cannot put")
-				},
-			},
-			target:          "example.com/@v/v1.0.0.info",
-			wantStatusCode:  http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantContent:     "internal server error",
+			n:              9,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			syncOptions:    SyncOptions{MaxDecompressedBytes: 1024},
+			filename:       "bundle.tar.gz",
+			bundle:         gzipTar(bundle),
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+			wantContent:    "request entity too large: decompression bomb: decompressed size exceeds 1024 bytes",
 		},
 		{
-			n: 10,
-			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
-				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
-					if err := c.Put(ctx, name, content); err != nil {
-						return err
-					}
-					return content.(io.Closer).Close()
-				},
-			},
-			target:          "example.com/@v/v1.0.0.mod",
-			wantStatusCode:  http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantContent:     "internal server error",
+			n:              10,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			filename:       "bundle.tar.gz",
+			bundle:         gzipTar(bombBundle),
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+			wantContent:    "request entity too large: decompression bomb: decompression ratio exceeds 100",
+		},
+		{
+			n:              11,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			filename:       "bundle.tar.bz2",
+			contentType:    "application/x-bzip2",
+			bundle:         bundle,
+			wantStatusCode: http.StatusUnsupportedMediaType,
+			wantContent:    `unsupported media type: unsupported compress type "application/x-bzip2" (supported: application/gzip, application/x-tar)`,
+		},
+		{
+			n:              12,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			syncOptions:    SyncOptions{SignaturePublicKey: publicKey},
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusUnprocessableEntity,
+			wantContent:    "unprocessable entity: bad signature: missing signature",
+		},
+		{
+			n:              13,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			syncOptions:    SyncOptions{SignaturePublicKey: publicKey, Signature: makeMinisignSignature("12345678", privateKey, twoFileBundle)},
+			filename:       "bundle.tar",
+			bundle:         bundle,
+			wantStatusCode: http.StatusUnprocessableEntity,
+			wantContent:    "unprocessable entity: bad signature: signature verification failed",
+		},
+		{
+			n:              14,
+			cacher:         &DirCacher{Dir: t.TempDir()},
+			syncOptions:    SyncOptions{VerifyZipHashes: true},
+			filename:       "bundle.tar",
+			bundle:         zipHashBundle,
+			wantStatusCode: http.StatusUnprocessableEntity,
+			wantContent:    fmt.Sprintf("unprocessable entity: zip hash mismatch: example.com/@v/v1.0.0.zip: got %s, want %s", mustHashZip(t, otherZip), mustHashZip(t, zip)),
 		},
 	} {
-		if tt.proxyHandler == nil {
-			tt.proxyHandler = proxyHandler
-		}
-		setProxyHandler(tt.proxyHandler)
-		if tt.cacher == nil {
-			tt.cacher = DirCacher(t.TempDir())
-		}
-		g := &Goproxy{
-			Fetcher: &GoFetcher{
-				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
-				TempDir: t.TempDir(),
-			},
-			Cacher:      tt.cacher,
-			TempDir:     t.TempDir(),
-			ErrorLogger: log.New(io.Discard, "", 0),
+		if tt.contentType == "" {
+			tt.contentType = "application/octet-stream"
 		}
-		g.initOnce.Do(g.init)
-		escapedModulePath, after, ok := strings.Cut(tt.target, "/@v/")
-		if !ok {
-			t.Fatalf("test(%d): invalid target %q", tt.n, tt.target)
-		}
-		modulePath, err := module.UnescapePath(escapedModulePath)
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": tt.filename})},
+			"Content-Type":        {tt.contentType},
+		})
 		if err != nil {
 			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
 		}
-		moduleVersion, err := module.UnescapeVersion(strings.TrimSuffix(after, path.Ext(after)))
-		if err != nil {
+		if _, err := fw.Write(tt.bundle); err != nil {
 			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
 		}
+		if err := mw.Close(); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		var logs bytes.Buffer
+		g := &Goproxy{
+			Cacher:      tt.cacher,
+			TempDir:     t.TempDir(),
+			SyncOptions: tt.syncOptions,
+			ErrorLogger: log.New(&logs, "", 0),
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
 		rec := httptest.NewRecorder()
-		g.serveFetchDownload(rec, httptest.NewRequest("", "/", nil), tt.target, modulePath, moduleVersion, tt.noFetch)
-		recr := rec.Result()
-		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+		g.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
 			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
 		}
-		if got, want := recr.Header.Get("Content-Type"), tt.wantContentType; got != want {
-			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
-		}
-		if got, want := recr.Header.Get("Cache-Control"), tt.wantCacheControl; got != want {
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
-		if b, err := io.ReadAll(recr.Body); err != nil {
-			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
-		} else if got, want := string(b), tt.wantContent; got != want {
+		if tt.cacher != nil && !strings.Contains(logs.String(), "failed to sync cache: "+tt.filename) {
+			t.Errorf("test(%d): got logs %q, want the sync error logged", tt.n, logs.String())
+		}
+	}
+}
+
+func TestGoproxySyncCompressType(t *testing.T) {
+	for _, tt := range []struct {
+		n                  int
+		contentTypeAliases map[string]string
+		contentType        string
+		name               string
+		wantCompressType   string
+	}{
+		{1, nil, "application/gzip", "bundle", "application/gzip"},
+		{2, nil, "application/x-gzip", "bundle", "application/gzip"},
+		{3, nil, "application/octet-stream", "bundle.gz", "application/gzip"},
+		{4, nil, "application/octet-stream", "bundle.tar.gz", "application/gzip"},
+		{5, nil, "application/octet-stream", "bundle.tgz", "application/gzip"},
+		{6, nil, "application/octet-stream", "bundle.tar", "application/x-tar"},
+		{7, nil, "", "bundle.tar", "application/x-tar"},
+		{8, nil, "application/x-tar", "bundle.gz", "application/x-tar"},
+		{9, map[string]string{"application/x-bundle": "application/x-tar"}, "application/x-bundle", "bundle.gz", "application/x-tar"},
+		{10, nil, "application/octet-stream", "bundle", "application/octet-stream"},
+	} {
+		g := &Goproxy{SyncOptions: SyncOptions{ContentTypeAliases: tt.contentTypeAliases}}
+		if got, want := g.syncCompressType(tt.contentType, tt.name), tt.wantCompressType; got != want {
 			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
 		}
 	}
@@ -871,7 +6396,7 @@ func TestGoproxyServeSumDB(t *testing.T) {
 		{
 			n: 6,
 			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
+				Cacher: &DirCacher{Dir: t.TempDir()},
 				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
 					return errors.New("cannot put")
 				},
@@ -921,13 +6446,55 @@ func TestGoproxyServeSumDB(t *testing.T) {
 			wantContentType: "text/plain; charset=utf-8",
 			wantContent:     "internal server error",
 		},
+		{
+			n:            12,
+			sumdbHandler: func(rw http.ResponseWriter, req *http.Request) { responseInternalServerError(rw, req) },
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader("cached")), nil
+				},
+			},
+			target:           "sumdb/sumdb.example.com/tile/2/0/0",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "application/octet-stream",
+			wantCacheControl: "public, max-age=86400",
+			wantContent:      "cached",
+		},
+		{
+			n: 13,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader("cached")), nil
+				},
+			},
+			target:           "sumdb/sumdb.example.com/latest",
+			wantStatusCode:   http.StatusOK,
+			wantContentType:  "text/plain; charset=utf-8",
+			wantCacheControl: "public, max-age=3600",
+			wantContent:      "/latest",
+		},
+		{
+			n: 14,
+			cacher: &testCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return nil, errors.New("cannot get")
+				},
+			},
+			target:          "sumdb/sumdb.example.com/lookup/example.com@v1.0.0",
+			wantStatusCode:  http.StatusInternalServerError,
+			wantContentType: "text/plain; charset=utf-8",
+			wantContent:     "internal server error",
+		},
 	} {
 		if tt.sumdbHandler == nil {
 			tt.sumdbHandler = sumdbHandler
 		}
 		setSumDBHandler(tt.sumdbHandler)
 		if tt.cacher == nil {
-			tt.cacher = DirCacher(t.TempDir())
+			tt.cacher = &DirCacher{Dir: t.TempDir()}
 		}
 		if tt.tempDir == "" {
 			tt.tempDir = t.TempDir()
@@ -959,6 +6526,50 @@ func TestGoproxyServeSumDB(t *testing.T) {
 	}
 }
 
+func TestGoproxyServeSumDBCache(t *testing.T) {
+	sumdbServer, setSumDBHandler := newHTTPTestServer()
+	defer sumdbServer.Close()
+	var hits int
+	setSumDBHandler(func(rw http.ResponseWriter, req *http.Request) {
+		hits++
+		fmt.Fprint(rw, req.URL.Path)
+	})
+	g := &Goproxy{
+		ProxiedSumDBs: []string{"sumdb.example.com " + sumdbServer.URL},
+		Cacher:        &DirCacher{Dir: t.TempDir()},
+		TempDir:       t.TempDir(),
+		ErrorLogger:   log.New(io.Discard, "", 0),
+	}
+	for _, tt := range []struct {
+		n        int
+		target   string
+		wantHits int
+	}{
+		{1, "sumdb/sumdb.example.com/tile/2/0/0", 1},
+		{2, "sumdb/sumdb.example.com/tile/2/0/0.p/1", 1},
+		{3, "sumdb/sumdb.example.com/lookup/example.com@v1.0.0", 1},
+		{4, "sumdb/sumdb.example.com/latest", 2},
+	} {
+		hits = 0
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/"+tt.target, nil))
+			recr := rec.Result()
+			if got, want := recr.StatusCode, http.StatusOK; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if b, err := io.ReadAll(recr.Body); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), strings.TrimPrefix(tt.target, "sumdb/sumdb.example.com"); got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := hits, tt.wantHits; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
 func TestGoproxyServeCache(t *testing.T) {
 	for _, tt := range []struct {
 		n              int
@@ -970,7 +6581,7 @@ func TestGoproxyServeCache(t *testing.T) {
 		{
 			n: 1,
 			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
+				Cacher: &DirCacher{Dir: t.TempDir()},
 				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
 					return io.NopCloser(strings.NewReader("foobar")), nil
 				},
@@ -992,7 +6603,7 @@ func TestGoproxyServeCache(t *testing.T) {
 		{
 			n: 4,
 			cacher: &testCacher{
-				Cacher: DirCacher(t.TempDir()),
+				Cacher: &DirCacher{Dir: t.TempDir()},
 				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
 					return nil, errors.New("cannot get")
 				},
@@ -1002,7 +6613,7 @@ func TestGoproxyServeCache(t *testing.T) {
 		},
 	} {
 		if tt.cacher == nil {
-			tt.cacher = DirCacher(t.TempDir())
+			tt.cacher = &DirCacher{Dir: t.TempDir()}
 		}
 		g := &Goproxy{
 			Cacher:      tt.cacher,
@@ -1029,6 +6640,139 @@ func TestGoproxyServeCache(t *testing.T) {
 	}
 }
 
+func TestGoproxyServeCacheRange(t *testing.T) {
+	modTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		n                int
+		method           string
+		header           http.Header
+		rangeErr         error
+		wantStatusCode   int
+		wantContentRange string
+		wantContent      string
+		wantRanges       string
+	}{
+		{
+			n:                1,
+			header:           http.Header{"Range": {"bytes=2-5"}},
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 2-5/10",
+			wantContent:      "2345",
+			wantRanges:       "2-5",
+		},
+		{
+			n:                2,
+			header:           http.Header{"Range": {"bytes=-3"}},
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 7-9/10",
+			wantContent:      "789",
+			wantRanges:       "7-9",
+		},
+		{
+			n:                3,
+			header:           http.Header{"Range": {"bytes=8-100"}},
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 8-9/10",
+			wantContent:      "89",
+			wantRanges:       "8-9",
+		},
+		{
+			n:                4,
+			header:           http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"foobar"`}},
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 2-5/10",
+			wantContent:      "2345",
+			wantRanges:       "2-5",
+		},
+		{
+			n:                5,
+			header:           http.Header{"Range": {"bytes=2-5"}, "If-Range": {modTime.Format(http.TimeFormat)}},
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 2-5/10",
+			wantContent:      "2345",
+			wantRanges:       "2-5",
+		},
+		{
+			n:              6,
+			header:         http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"bar"`}},
+			wantStatusCode: http.StatusOK,
+			wantContent:    "0123456789",
+		},
+		{
+			n:              7,
+			header:         http.Header{"Range": {"bytes=2-5"}, "If-None-Match": {`"foobar"`}},
+			wantStatusCode: http.StatusNotModified,
+		},
+		{
+			n:                8,
+			header:           http.Header{"Range": {"bytes=10-"}},
+			wantStatusCode:   http.StatusRequestedRangeNotSatisfiable,
+			wantContentRange: "bytes */10",
+			wantContent:      "invalid range: failed to overlap\n",
+		},
+		{
+			n:                9,
+			header:           http.Header{"Range": {"bytes=2-5"}},
+			rangeErr:         errors.New("cannot get range"),
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 2-5/10",
+			wantContent:      "2345",
+			wantRanges:       "2-5",
+		},
+		{
+			n:              10,
+			wantStatusCode: http.StatusOK,
+			wantContent:    "0123456789",
+		},
+		{
+			n:                11,
+			method:           http.MethodHead,
+			header:           http.Header{"Range": {"bytes=2-5"}},
+			wantStatusCode:   http.StatusPartialContent,
+			wantContentRange: "bytes 2-5/10",
+		},
+	} {
+		var ranges []string
+		g := &Goproxy{
+			Cacher: &testRangeCacher{
+				Cacher: &DirCacher{Dir: t.TempDir()},
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					return &testRangeContent{Reader: strings.NewReader("0123456789"), etag: `"foobar"`, modTime: modTime}, nil
+				},
+				rangeReadCloser: func(ctx context.Context, c Cacher, name string, start, end int64) (io.ReadCloser, error) {
+					ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+					if tt.rangeErr != nil {
+						return nil, tt.rangeErr
+					}
+					return io.NopCloser(strings.NewReader("0123456789"[start : end+1])), nil
+				},
+			},
+			ErrorLogger: log.New(io.Discard, "", 0),
+		}
+		req := httptest.NewRequest(tt.method, "/example.com/@v/v1.0.0.zip", nil)
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Range"), tt.wantContentRange; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := strings.Join(ranges, ","), tt.wantRanges; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
 func TestGoproxyServePutCache(t *testing.T) {
 	for _, tt := range []struct {
 		n              int
@@ -1066,7 +6810,7 @@ func TestGoproxyServePutCache(t *testing.T) {
 		},
 	} {
 		g := &Goproxy{
-			Cacher:      DirCacher(t.TempDir()),
+			Cacher:      &DirCacher{Dir: t.TempDir()},
 			TempDir:     t.TempDir(),
 			ErrorLogger: log.New(io.Discard, "", 0),
 		}
@@ -1106,7 +6850,7 @@ func TestGoproxyServePutCacheFile(t *testing.T) {
 		},
 	} {
 		g := &Goproxy{
-			Cacher:      DirCacher(t.TempDir()),
+			Cacher:      &DirCacher{Dir: t.TempDir()},
 			TempDir:     t.TempDir(),
 			ErrorLogger: log.New(io.Discard, "", 0),
 		}
@@ -1130,10 +6874,10 @@ func TestGoproxyServePutCacheFile(t *testing.T) {
 }
 
 func TestGoproxyCache(t *testing.T) {
-	dc := DirCacher(t.TempDir())
+	dc := &DirCacher{Dir: t.TempDir()}
 	g := &Goproxy{Cacher: dc, TempDir: t.TempDir()}
 	g.initOnce.Do(g.init)
-	if err := os.WriteFile(filepath.Join(string(dc), "foo"), []byte("bar"), 0o644); err != nil {
+	if err := os.WriteFile(filepath.Join(dc.Dir, "foo"), []byte("bar"), 0o644); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
 	if rc, err := g.cache(context.Background(), "foo"); err != nil {
@@ -1160,14 +6904,251 @@ func TestGoproxyCache(t *testing.T) {
 	}
 }
 
+func TestGoproxyTreatEmptyCachesAsMisses(t *testing.T) {
+	for _, tt := range []struct {
+		n                        int
+		treatEmptyCachesAsMisses bool
+		name                     string
+		content                  string
+		wantErr                  error
+	}{
+		{1, false, "example.com/@v/v1.0.0.info", "", nil},
+		{2, true, "example.com/@v/v1.0.0.info", "", fs.ErrNotExist},
+		{3, true, "example.com/@v/v1.0.0.mod", "", fs.ErrNotExist},
+		{4, true, "example.com/@latest", "", fs.ErrNotExist},
+		{5, true, "example.com/@v/list", "", nil},
+		{6, true, "example.com/@v/v1.0.0.zip", "", nil},
+		{7, true, "example.com/@v/v1.0.0.info", "{}", nil},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		if err := dc.Put(context.Background(), tt.name, strings.NewReader(tt.content)); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		g := &Goproxy{
+			Cacher:                   dc,
+			ErrorLogger:              log.New(io.Discard, "", 0),
+			TreatEmptyCachesAsMisses: tt.treatEmptyCachesAsMisses,
+		}
+		g.initOnce.Do(g.init)
+		rc, err := g.cache(context.Background(), tt.name)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if b, err := io.ReadAll(rc); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if err := rc.Close(); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.content; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	proxyServer, setProxyHandler := newHTTPTestServer()
+	defer proxyServer.Close()
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	mod := "module example.com"
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte(mod)})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	setProxyHandler(func(rw http.ResponseWriter, req *http.Request) {
+		switch path.Ext(req.URL.Path) {
+		case ".info":
+			responseSuccess(rw, req, strings.NewReader(info), "application/json; charset=utf-8", -2)
+		case ".mod":
+			responseSuccess(rw, req, strings.NewReader(mod), "text/plain; charset=utf-8", -2)
+		case ".zip":
+			responseSuccess(rw, req, bytes.NewReader(zip), "application/zip", -2)
+		default:
+			responseNotFound(rw, req, -2)
+		}
+	})
+	dc := &DirCacher{Dir: t.TempDir()}
+	if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.info", strings.NewReader("")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	g := &Goproxy{
+		Fetcher: &GoFetcher{
+			Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+			TempDir: t.TempDir(),
+		},
+		Cacher:                   dc,
+		TempDir:                  t.TempDir(),
+		ErrorLogger:              log.New(io.Discard, "", 0),
+		TreatEmptyCachesAsMisses: true,
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil))
+	recr := rec.Result()
+	if got, want := recr.StatusCode, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), info; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyCompletionMarkers(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                 int
+		completionMarkers bool
+		serveWhileCaching bool
+		cachedNames       []string
+		wantDownloads     int32
+		wantContent       string
+	}{
+		{1, false, false, nil, 1, "module example.com"},
+		{2, false, false, []string{"example.com/@v/v1.0.0.mod"}, 0, "cached"},
+		{3, true, false, []string{"example.com/@v/v1.0.0.mod"}, 1, "module example.com"},
+		{4, true, false, []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.0.0.ready"}, 0, "cached"},
+		{5, true, false, nil, 1, "module example.com"},
+		{6, true, true, []string{"example.com/@v/v1.0.0.mod"}, 1, "module example.com"},
+	} {
+		dc := &DirCacher{Dir: t.TempDir()}
+		for _, name := range tt.cachedNames {
+			content := "cached"
+			if path.Ext(name) == ".ready" {
+				content = ""
+			}
+			if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		var downloads int32
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					atomic.AddInt32(&downloads, 1)
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:            dc,
+			ErrorLogger:       log.New(io.Discard, "", 0),
+			CompletionMarkers: tt.completionMarkers,
+			ServeWhileCaching: tt.serveWhileCaching,
+		}
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.mod", nil))
+			recr := rec.Result()
+			if got, want := recr.StatusCode, http.StatusOK; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+			if b, err := io.ReadAll(recr.Body); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), tt.wantContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := atomic.LoadInt32(&downloads), tt.wantDownloads; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		_, err := os.Stat(filepath.Join(dc.Dir, filepath.FromSlash("example.com/@v/v1.0.0.ready")))
+		if got, want := err == nil, tt.completionMarkers; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyImmutableVersions(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n                 int
+		immutableVersions bool
+		serveWhileCaching bool
+		getOrFetch        bool
+		wantPuts          []string
+	}{
+		{1, false, false, false, []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod", "example.com/@v/v1.0.0.zip"}},
+		{2, true, false, false, []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"}},
+		{3, true, true, false, []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"}},
+		{4, true, false, true, []string{"example.com/@v/v1.0.0.info", "example.com/@v/v1.0.0.mod"}},
+	} {
+		var (
+			mu        sync.Mutex
+			downloads int
+			puts      []string
+		)
+		dc := &DirCacher{Dir: t.TempDir()}
+		if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.zip", strings.NewReader("cached zip")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if err := dc.Put(context.Background(), "example.com/@v/v1.0.0.mod", strings.NewReader("")); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					mu.Lock()
+					downloads++
+					mu.Unlock()
+					return nopReadSeekCloser(info), nopReadSeekCloser("module example.com"), nopReadSeekCloser("fetched zip"), nil
+				},
+			},
+			Cacher: &testCacher{
+				Cacher: dc,
+				put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+					mu.Lock()
+					puts = append(puts, name)
+					mu.Unlock()
+					return c.Put(ctx, name, content)
+				},
+			},
+			ImmutableVersions: tt.immutableVersions,
+			ServeWhileCaching: tt.serveWhileCaching,
+			TempDir:           t.TempDir(),
+			ErrorLogger:       log.New(io.Discard, "", 0),
+		}
+		if tt.getOrFetch {
+			rc, err := g.GetOrFetch(context.Background(), "example.com/@v/v1.0.0.info")
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			rc.Close()
+		} else {
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.info", nil))
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+			}
+		}
+		sort.Strings(puts)
+		if got, want := strings.Join(puts, ","), strings.Join(tt.wantPuts, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", "/example.com/@v/v1.0.0.zip", nil))
+		wantZip := "cached zip"
+		if !tt.immutableVersions {
+			wantZip = "fetched zip"
+		}
+		if got, want := rec.Body.String(), wantZip; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := downloads, 1; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
 func TestGoproxyPutCache(t *testing.T) {
-	dc := DirCacher(t.TempDir())
+	dc := &DirCacher{Dir: t.TempDir()}
 	g := &Goproxy{Cacher: dc, TempDir: t.TempDir()}
 	g.initOnce.Do(g.init)
 	if err := g.putCache(context.Background(), "foo", strings.NewReader("bar")); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
-	if b, err := os.ReadFile(filepath.Join(string(dc), "foo")); err != nil {
+	if b, err := os.ReadFile(filepath.Join(dc.Dir, "foo")); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	} else if got, want := string(b), "bar"; got != want {
 		t.Errorf("got %q, want %q", got, want)
@@ -1181,24 +7162,24 @@ func TestGoproxyPutCache(t *testing.T) {
 }
 
 func TestGoproxyPutCacheFile(t *testing.T) {
-	dc := DirCacher(t.TempDir())
+	dc := &DirCacher{Dir: t.TempDir()}
 	g := &Goproxy{Cacher: dc, TempDir: t.TempDir()}
 	g.initOnce.Do(g.init)
 
-	cacheFile := filepath.Join(string(dc), "cache")
+	cacheFile := filepath.Join(dc.Dir, "cache")
 	if err := os.WriteFile(cacheFile, []byte("bar"), 0o644); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
 	if err := g.putCacheFile(context.Background(), "foo", cacheFile); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
-	if b, err := os.ReadFile(filepath.Join(string(dc), "foo")); err != nil {
+	if b, err := os.ReadFile(filepath.Join(dc.Dir, "foo")); err != nil {
 		t.Fatalf("unexpected error %q", err)
 	} else if got, want := string(b), "bar"; got != want {
 		t.Errorf("got %q, want %q", got, want)
 	}
 
-	if err := g.putCacheFile(context.Background(), "bar", filepath.Join(string(dc), "bar-sourcel")); err == nil {
+	if err := g.putCacheFile(context.Background(), "bar", filepath.Join(dc.Dir, "bar-sourcel")); err == nil {
 		t.Fatal("expected error")
 	} else if got, want := err, fs.ErrNotExist; !compareErrors(got, want) {
 		t.Errorf("got %q, want %q", got, want)
@@ -1328,10 +7309,45 @@ func (rs *testReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return rs.ReadSeeker.Seek(offset, whence)
 }
 
+type testFetcher struct {
+	query    func(ctx context.Context, path, query string) (string, time.Time, error)
+	list     func(ctx context.Context, path string) ([]string, error)
+	download func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error)
+}
+
+func (f *testFetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	if f.query != nil {
+		return f.query(ctx, path, query)
+	}
+	return "", time.Time{}, fs.ErrNotExist
+}
+
+func (f *testFetcher) List(ctx context.Context, path string) ([]string, error) {
+	if f.list != nil {
+		return f.list(ctx, path)
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (f *testFetcher) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	if f.download != nil {
+		return f.download(ctx, path, version)
+	}
+	return nil, nil, nil, fs.ErrNotExist
+}
+
+func nopReadSeekCloser(s string) io.ReadSeekCloser {
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{strings.NewReader(s), io.NopCloser(nil)}
+}
+
 type testCacher struct {
 	Cacher
-	get func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error)
-	put func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error
+	get  func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error)
+	put  func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error
+	sync func(ctx context.Context, c Cacher, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error
 }
 
 func (c *testCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
@@ -1347,3 +7363,54 @@ func (c *testCacher) Put(ctx context.Context, name string, content io.ReadSeeker
 	}
 	return c.Cacher.Put(ctx, name, content)
 }
+
+func (c *testCacher) Sync(ctx context.Context, uploadCacheDirReader io.Reader, compressType string, opts SyncOptions) error {
+	if c.sync != nil {
+		return c.sync(ctx, c.Cacher, uploadCacheDirReader, compressType, opts)
+	}
+	return c.Cacher.Sync(ctx, uploadCacheDirReader, compressType, opts)
+}
+
+type testStatCacher struct {
+	testCacher
+}
+
+func (c *testStatCacher) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	return c.Cacher.(Stater).Stat(ctx, name)
+}
+
+type testRangeCacher struct {
+	Cacher
+	get             func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error)
+	rangeReadCloser func(ctx context.Context, c Cacher, name string, start, end int64) (io.ReadCloser, error)
+}
+
+func (c *testRangeCacher) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return c.get(ctx, c.Cacher, name)
+}
+
+func (c *testRangeCacher) RangeReadCloser(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	return c.rangeReadCloser(ctx, c.Cacher, name, start, end)
+}
+
+type testRangeContent struct {
+	*strings.Reader
+	etag    string
+	modTime time.Time
+}
+
+func (c *testRangeContent) Close() error       { return nil }
+func (c *testRangeContent) ETag() string       { return c.etag }
+func (c *testRangeContent) ModTime() time.Time { return c.modTime }
+
+type notifyingResponseWriter struct {
+	http.ResponseWriter
+	written chan struct{}
+	once    sync.Once
+}
+
+func (rw *notifyingResponseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.once.Do(func() { close(rw.written) })
+	return n, err
+}
@@ -9,10 +9,12 @@ import (
 	"io/fs"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +26,10 @@ var (
 
 	// errFetchTimedOut indicates a fetch operation has timed out.
 	errFetchTimedOut = errors.New("fetch timed out")
+
+	// errFetchInProgress indicates a request has stopped waiting for an
+	// in-flight fetch (see [Goproxy.MaxCoalescedWait]).
+	errFetchInProgress = errors.New("fetch in progress")
 )
 
 // notExistError is like [fs.ErrNotExist] but with a custom underlying error.
@@ -46,14 +52,131 @@ func notExistErrorf(format string, v ...interface{}) error {
 	return &notExistError{err: fmt.Errorf(format, v...)}
 }
 
-// httpGet gets the content from the given url and writes it to the dst.
-func httpGet(ctx context.Context, client *http.Client, url string, dst io.Writer) error {
+// upstreamNotExistError returns the msg of a not-found error reported by an
+// upstream (e.g., in a response body or by the go command) as an error that is
+// equivalent to [fs.ErrNotExist]. If the msg reports that the upstream itself
+// failed to fetch (e.g., "not found: bad upstream" from another [Goproxy]),
+// the returned error also matches [errBadUpstream] or [errFetchTimedOut], so
+// that it is never taken for a definitive not-found error.
+func upstreamNotExistError(msg string) error {
+	for _, err := range []error{errBadUpstream, errFetchTimedOut} {
+		if strings.Contains(msg, err.Error()) {
+			return &notExistError{err: &upstreamError{msg: msg, err: err}}
+		}
+	}
+	return notExistErrorf("%s", msg)
+}
+
+// upstreamError is an error with the msg reported by an upstream, which wraps
+// the err it has been classified as.
+type upstreamError struct {
+	msg string
+	err error
+}
+
+// Error implements [error].
+func (e *upstreamError) Error() string { return e.msg }
+
+// Unwrap returns the underlying error.
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// TransportOptions is the options for the connection pool of the transport
+// used by [Goproxy] when [Goproxy.Transport] is nil. The defaults of
+// [http.DefaultTransport] keep only 2 idle connections per host, which makes a
+// busy proxy fetching from a single upstream GOPROXY close and reopen
+// connections all the time, and eventually run out of ephemeral ports. For
+// such a proxy, something like 1000 for MaxIdleConns and 100 for
+// MaxIdleConnsPerHost (with the default IdleConnTimeout) is a good start.
+type TransportOptions struct {
+	// MaxIdleConns is the maximum number of idle connections kept open
+	// across all hosts.
+	//
+	// If MaxIdleConns is zero, the default of [http.DefaultTransport] (100)
+	// is used. If it is negative, there is no limit.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept
+	// open per host.
+	//
+	// If MaxIdleConnsPerHost is zero, [http.DefaultMaxIdleConnsPerHost] (2)
+	// is used.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept open before it
+	// is closed.
+	//
+	// If IdleConnTimeout is zero, the default of [http.DefaultTransport]
+	// (90 seconds) is used. If it is negative, idle connections are kept
+	// open until they are closed by the other side.
+	IdleConnTimeout time.Duration
+
+	// DisableKeepAlives indicates whether to use each connection for only a
+	// single request.
+	DisableKeepAlives bool
+}
+
+// newTransport returns a clone of the [http.DefaultTransport] tuned by the
+// opts. If the [http.DefaultTransport] is not an [*http.Transport] (e.g., it has
+// been wrapped by instrumentation), a new [*http.Transport] with the same
+// defaults is used instead.
+func (opts TransportOptions) newTransport() *http.Transport {
+	var transport *http.Transport
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = t.Clone()
+	} else {
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+	}
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConns = opts.MaxIdleConns
+	} else if opts.MaxIdleConns < 0 {
+		transport.MaxIdleConns = 0
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	} else if opts.IdleConnTimeout < 0 {
+		transport.IdleConnTimeout = 0
+	}
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+	return transport
+}
+
+// httpGet gets the content from the given url and writes it to the dst. Failed
+// attempts are retried with the delays of the backoff (see [backoffDelay]).
+func httpGet(ctx context.Context, client *http.Client, backoff Backoff, url string, dst io.Writer) error {
+	return httpGetIfModifiedSince(ctx, client, backoff, url, time.Time{}, dst)
+}
+
+// httpGetIfModifiedSince is like [httpGet] but makes a conditional request
+// with an If-Modified-Since header of the ifModifiedSince, returning
+// [ErrNotModified] if the content has not been modified since then. If the
+// ifModifiedSince is zero, the request is unconditional.
+func httpGetIfModifiedSince(ctx context.Context, client *http.Client, backoff Backoff, url string, ifModifiedSince time.Time, dst io.Writer) error {
 	var lastErr error
 	for attempt := 0; attempt < 10; attempt++ {
 		if attempt > 0 {
+			end := startRequestTraceStep(ctx, "goproxy.fetch.retry",
+				TraceAttribute{Key: "url.full", Value: redactURL(url)},
+				TraceAttribute{Key: "goproxy.attempt", Value: strconv.Itoa(attempt + 1)},
+			)
 			select {
-			case <-time.After(backoffSleep(100*time.Millisecond, time.Second, attempt)):
+			case <-time.After(backoffDelay(backoff, attempt)):
+				end(lastErr)
 			case <-ctx.Done():
+				end(lastErr)
 				return lastErr
 			}
 		}
@@ -62,6 +185,9 @@ func httpGet(ctx context.Context, client *http.Client, url string, dst io.Writer
 		if err != nil {
 			return err
 		}
+		if !ifModifiedSince.IsZero() {
+			req.Header.Set("If-Modified-Since", ifModifiedSince.UTC().Format(http.TimeFormat))
+		}
 
 		resp, err := client.Do(req)
 		if err != nil {
@@ -71,6 +197,10 @@ func httpGet(ctx context.Context, client *http.Client, url string, dst io.Writer
 			}
 			return err
 		}
+		if resp.StatusCode == http.StatusNotModified && !ifModifiedSince.IsZero() {
+			resp.Body.Close()
+			return ErrNotModified
+		}
 		if resp.StatusCode == http.StatusOK {
 			if dst != nil {
 				_, err = io.Copy(dst, resp.Body)
@@ -88,7 +218,7 @@ func httpGet(ctx context.Context, client *http.Client, url string, dst io.Writer
 		case http.StatusBadRequest,
 			http.StatusNotFound,
 			http.StatusGone:
-			return notExistErrorf(string(respBody))
+			return upstreamNotExistError(string(respBody))
 		case http.StatusTooManyRequests,
 			http.StatusInternalServerError,
 			http.StatusBadGateway,
@@ -105,7 +235,7 @@ func httpGet(ctx context.Context, client *http.Client, url string, dst io.Writer
 
 // httpGetTemp is like [httpGet] but writes the content to a new temporary file
 // in tempDir.
-func httpGetTemp(ctx context.Context, client *http.Client, url, tempDir string) (tempFile string, err error) {
+func httpGetTemp(ctx context.Context, client *http.Client, backoff Backoff, url, tempDir string) (tempFile string, err error) {
 	f, err := os.CreateTemp(tempDir, "")
 	if err != nil {
 		return "", err
@@ -115,16 +245,58 @@ func httpGetTemp(ctx context.Context, client *http.Client, url, tempDir string)
 			os.Remove(f.Name())
 		}
 	}()
-	if err := httpGet(ctx, client, url, f); err != nil {
+	if err := httpGet(ctx, client, backoff, url, f); err != nil {
 		return "", err
 	}
 	return f.Name(), f.Close()
 }
 
+// httpContentSize returns the size of the content at the given url without
+// getting it, by making a HEAD request or, if the size is still unknown, a GET
+// request for only the first byte of the content. It returns -1 if the size
+// cannot be determined in either way.
+func httpContentSize(ctx context.Context, client *http.Client, url string) (int64, error) {
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		if method == http.MethodGet {
+			req.Header.Set("Range", "bytes=0-0")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if resp.ContentLength >= 0 {
+				return resp.ContentLength, nil
+			}
+		case http.StatusPartialContent:
+			if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+				if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+					return size, nil
+				}
+			}
+		case http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusGone:
+			return 0, notExistErrorf("%s %s: %s", method, resp.Request.URL.Redacted(), resp.Status)
+		default:
+			if method == http.MethodGet {
+				return 0, fmt.Errorf("%s %s: %s", method, resp.Request.URL.Redacted(), resp.Status)
+			}
+		}
+	}
+	return -1, nil
+}
+
 // isRetryableHTTPClientDoError reports whether the err is a retryable error
 // returned by [http.Client.Do].
 func isRetryableHTTPClientDoError(err error) bool {
-	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errRedirectRejected) {
 		return false
 	}
 	if ue, ok := err.(*url.Error); ok {
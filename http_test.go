@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -51,6 +52,84 @@ func TestNotExistError(t *testing.T) {
 	}
 }
 
+func TestUpstreamNotExistError(t *testing.T) {
+	for _, tt := range []struct {
+		n         int
+		msg       string
+		wantIs    error
+		wantIsNot error
+	}{
+		{1, "example.com@v1.0.0: unknown revision v1.0.0", fs.ErrNotExist, errBadUpstream},
+		{2, "not found: bad upstream", errBadUpstream, errFetchTimedOut},
+		{3, "not found: fetch timed out", errFetchTimedOut, errBadUpstream},
+		{4, "100%s", fs.ErrNotExist, errBadUpstream},
+	} {
+		err := upstreamNotExistError(tt.msg)
+		if got, want := err.Error(), tt.msg; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, fs.ErrNotExist)
+		}
+		if !errors.Is(err, tt.wantIs) {
+			t.Errorf("test(%d): got %q, want an error that matches %q", tt.n, err, tt.wantIs)
+		}
+		if errors.Is(err, tt.wantIsNot) {
+			t.Errorf("test(%d): got %q, want an error that does not match %q", tt.n, err, tt.wantIsNot)
+		}
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	for _, tt := range []struct {
+		n                       int
+		opts                    TransportOptions
+		wantMaxIdleConns        int
+		wantMaxIdleConnsPerHost int
+		wantIdleConnTimeout     time.Duration
+		wantDisableKeepAlives   bool
+	}{
+		{1, TransportOptions{}, defaultTransport.MaxIdleConns, defaultTransport.MaxIdleConnsPerHost, defaultTransport.IdleConnTimeout, false},
+		{2, TransportOptions{MaxIdleConns: 1000, MaxIdleConnsPerHost: 100, IdleConnTimeout: time.Minute}, 1000, 100, time.Minute, false},
+		{3, TransportOptions{MaxIdleConns: -1, IdleConnTimeout: -1}, 0, defaultTransport.MaxIdleConnsPerHost, 0, false},
+		{4, TransportOptions{DisableKeepAlives: true}, defaultTransport.MaxIdleConns, defaultTransport.MaxIdleConnsPerHost, defaultTransport.IdleConnTimeout, true},
+	} {
+		transport := tt.opts.newTransport()
+		if transport == defaultTransport {
+			t.Fatalf("test(%d): got %p, want a clone", tt.n, transport)
+		}
+		if got, want := transport.MaxIdleConns, tt.wantMaxIdleConns; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := transport.MaxIdleConnsPerHost, tt.wantMaxIdleConnsPerHost; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := transport.IdleConnTimeout, tt.wantIdleConnTimeout; got != want {
+			t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+		}
+		if got, want := transport.DisableKeepAlives, tt.wantDisableKeepAlives; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+
+	http.DefaultTransport = struct{ http.RoundTripper }{defaultTransport}
+	defer func() { http.DefaultTransport = defaultTransport }()
+	transport := TransportOptions{MaxIdleConnsPerHost: 100}.newTransport()
+	if got, want := transport.MaxIdleConns, defaultTransport.MaxIdleConns; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := transport.MaxIdleConnsPerHost, 100; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := transport.IdleConnTimeout, defaultTransport.IdleConnTimeout; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if transport.Proxy == nil {
+		t.Error("expected proxy from environment")
+	}
+}
+
 func TestHTTPGet(t *testing.T) {
 	server, setHandler := newHTTPTestServer()
 	defer server.Close()
@@ -160,7 +239,7 @@ func TestHTTPGet(t *testing.T) {
 		}
 		setHandler(tt.handler)
 		var content bytes.Buffer
-		err := httpGet(ctx, client, server.URL, &content)
+		err := httpGet(ctx, client, nil, server.URL, &content)
 		if tt.wantErr != nil {
 			if err == nil {
 				t.Fatalf("test(%d): expected error", tt.n)
@@ -177,11 +256,48 @@ func TestHTTPGet(t *testing.T) {
 		}
 	}
 
-	if err := httpGet(context.Background(), http.DefaultClient, "::", nil); err == nil {
+	if err := httpGet(context.Background(), http.DefaultClient, nil, "::", nil); err == nil {
 		t.Fatal("expected error")
 	}
 }
 
+func TestHTTPGetIfModifiedSince(t *testing.T) {
+	server, setHandler := newHTTPTestServer()
+	defer server.Close()
+	modTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	setHandler(func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "", modTime, strings.NewReader("foobar"))
+	})
+	for _, tt := range []struct {
+		n               int
+		ifModifiedSince time.Time
+		wantContent     string
+		wantErr         error
+	}{
+		{1, time.Time{}, "foobar", nil},
+		{2, modTime.Add(-time.Hour), "foobar", nil},
+		{3, modTime, "", ErrNotModified},
+		{4, modTime.Add(time.Hour), "", ErrNotModified},
+	} {
+		var content bytes.Buffer
+		err := httpGetIfModifiedSince(context.Background(), http.DefaultClient, nil, server.URL, tt.ifModifiedSince, &content)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := content.String(), tt.wantContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
+
 func TestHTTPGetTemp(t *testing.T) {
 	server, setHandler := newHTTPTestServer()
 	defer server.Close()
@@ -215,7 +331,7 @@ func TestHTTPGetTemp(t *testing.T) {
 		if tt.tempDir == "" {
 			tt.tempDir = t.TempDir()
 		}
-		tempFile, err := httpGetTemp(context.Background(), http.DefaultClient, server.URL, tt.tempDir)
+		tempFile, err := httpGetTemp(context.Background(), http.DefaultClient, nil, server.URL, tt.tempDir)
 		if tt.wantErr != nil {
 			if err == nil {
 				t.Fatalf("test(%d): expected error", tt.n)
@@ -240,6 +356,72 @@ func TestHTTPGetTemp(t *testing.T) {
 	}
 }
 
+func TestHTTPContentSize(t *testing.T) {
+	server, setHandler := newHTTPTestServer()
+	defer server.Close()
+	for _, tt := range []struct {
+		n        int
+		handler  http.HandlerFunc
+		wantSize int64
+		wantErr  error
+	}{
+		{
+			n: 1,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				responseSuccess(rw, req, strings.NewReader("foobar"), "text/plain; charset=utf-8", -2)
+			},
+			wantSize: 6,
+		},
+		{
+			n: 2,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodHead {
+					responseMethodNotAllowed(rw, req, -2)
+					return
+				}
+				responseSuccess(rw, req, strings.NewReader("foobar"), "text/plain; charset=utf-8", -2)
+			},
+			wantSize: 6,
+		},
+		{
+			n: 3,
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodHead {
+					responseMethodNotAllowed(rw, req, -2)
+					return
+				}
+				rw.(http.Flusher).Flush()
+				fmt.Fprint(rw, "foobar")
+			},
+			wantSize: -1,
+		},
+		{
+			n:       4,
+			handler: func(rw http.ResponseWriter, req *http.Request) { responseNotFound(rw, req, -2) },
+			wantErr: notExistErrorf("HEAD %s: 404 Not Found", server.URL),
+		},
+		{
+			n:       5,
+			handler: func(rw http.ResponseWriter, req *http.Request) { responseInternalServerError(rw, req) },
+			wantErr: fmt.Errorf("GET %s: 500 Internal Server Error", server.URL),
+		},
+	} {
+		setHandler(tt.handler)
+		size, err := httpContentSize(context.Background(), http.DefaultClient, server.URL)
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := size, tt.wantSize; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
 func TestIsRetryableHTTPClientDoError(t *testing.T) {
 	for _, tt := range []struct {
 		n               int
@@ -253,6 +435,7 @@ func TestIsRetryableHTTPClientDoError(t *testing.T) {
 		{5, &url.Error{Err: errors.New("oops")}, true},
 		{6, &url.Error{Err: x509.UnknownAuthorityError{}}, false},
 		{7, &url.Error{Err: errors.New("http: server gave HTTP response to HTTPS client")}, false},
+		{8, &url.Error{Err: fmt.Errorf("%w: stopped after 5 redirects", errRedirectRejected)}, false},
 	} {
 		if got, want := isRetryableHTTPClientDoError(tt.err), tt.wantIsRetryable; got != want {
 			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
@@ -0,0 +1,110 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// IntegrityMismatch is a divergence between a cached module file and the same
+// one downloaded from the [Goproxy.Fetcher] again, found by an integrity check
+// (see [Goproxy.IntegrityCheckSampleRate]).
+type IntegrityMismatch struct {
+	// Name is the cache name of the module file (e.g.,
+	// "example.com/@v/v1.0.0.zip").
+	Name string
+
+	// SHA256 is the hex-encoded SHA-256 hash of the cached module file.
+	SHA256 string
+
+	// UpstreamSHA256 is the hex-encoded SHA-256 hash of the module file
+	// downloaded from the [Goproxy.Fetcher] again.
+	UpstreamSHA256 string
+}
+
+// sampleIntegrityCheck reports whether a cache hit should be checked as per
+// the g.IntegrityCheckSampleRate.
+func (g *Goproxy) sampleIntegrityCheck() bool {
+	return g.IntegrityCheckSampleRate > 0 && sample(g.IntegrityCheckSampleRate)
+}
+
+// startIntegrityCheck starts downloading the module files of the modulePath
+// and moduleVersion from the g.fetcher again in the background, and reports
+// the cached .mod and .zip files that differ from the downloaded ones to the
+// g.OnIntegrityMismatch. Concurrent checks of the same module version are
+// coalesced into one (see [Goproxy.startBackgroundFetch]).
+func (g *Goproxy) startIntegrityCheck(modulePath, moduleVersion string) {
+	var names [2]string
+	for i, ext := range []string{"mod", "zip"} {
+		name, err := CacheName(modulePath, moduleVersion, ext)
+		if err != nil {
+			return
+		}
+		names[i] = name
+	}
+	g.startBackgroundFetch(context.Background(), integrityCheckKey(modulePath, moduleVersion), func(ctx context.Context) error {
+		info, mod, zip, err := g.fetchDownload(ctx, modulePath, moduleVersion)
+		if err != nil {
+			g.logErrorf("failed to download module version for integrity check: %s@%s: %v", modulePath, moduleVersion, err)
+			return err
+		}
+		defer func() {
+			info.Close()
+			mod.Close()
+			zip.Close()
+		}()
+		for i, upstream := range []io.ReadSeeker{mod, zip} {
+			if err := g.checkIntegrity(ctx, names[i], upstream); err != nil {
+				g.logErrorf("failed to check integrity of module file: %s: %v", names[i], err)
+			}
+		}
+		return nil
+	})
+}
+
+// integrityCheckKey returns the key of the [Goproxy.fetchGroup] for checking
+// the integrity of the modulePath at the moduleVersion, which never collides
+// with those of fetches as module paths cannot contain colons.
+func integrityCheckKey(modulePath, moduleVersion string) string {
+	return "integrity:" + modulePath + "@" + moduleVersion
+}
+
+// checkIntegrity compares the cached module file for the name with the
+// upstream one, reporting a divergence to the g.OnIntegrityMismatch. Module
+// files that are no longer cached are not checked.
+func (g *Goproxy) checkIntegrity(ctx context.Context, name string, upstream io.ReadSeeker) error {
+	content, err := g.cache(ctx, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer content.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	upstreamSum, err := hashReadSeeker(upstream)
+	if err != nil {
+		return err
+	}
+	if sum != upstreamSum {
+		g.reportIntegrityMismatch(IntegrityMismatch{Name: name, SHA256: sum, UpstreamSHA256: upstreamSum})
+	}
+	return nil
+}
+
+// reportIntegrityMismatch reports the m to the g.OnIntegrityMismatch, or logs
+// it to the g.ErrorLogger if the g.OnIntegrityMismatch is nil.
+func (g *Goproxy) reportIntegrityMismatch(m IntegrityMismatch) {
+	if g.OnIntegrityMismatch != nil {
+		g.OnIntegrityMismatch(m)
+		return
+	}
+	g.logErrorf("found integrity mismatch: %s: cached SHA-256 %s, upstream SHA-256 %s", m.Name, m.SHA256, m.UpstreamSHA256)
+}
@@ -0,0 +1,255 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetchDurationBuckets is the upper bounds (in seconds) of the buckets of the
+// "goproxy_fetch_duration_seconds" histogram.
+var fetchDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// MetricsHandler returns an [http.Handler] that serves the metrics collected
+// by the g in the Prometheus text exposition format, so that they can be
+// scraped by Prometheus without any client library. Like
+// [Goproxy.AdminHandler], it is independent of [Goproxy.ServeHTTP] and should
+// be mounted separately from the module proxy (e.g., at "/metrics" on another
+// address).
+//
+// The following metrics are served:
+//   - "goproxy_requests_total": a counter of the requests served by
+//     [Goproxy.ServeHTTP], labeled by the "operation" of their
+//     [RequestInfo] ("other" for requests without one) and the status
+//     "code" of their responses.
+//   - "goproxy_fetch_duration_seconds": a histogram of the durations of the
+//     fetches from the Fetcher, labeled by their "operation" ("query",
+//     "list", or "download").
+//   - "goproxy_inflight_fetches": a gauge of the fetches from the Fetcher in
+//     progress.
+//   - "goproxy_cache_hits_total" and "goproxy_cache_misses_total": counters
+//     of the responses served from the Cacher and those with content just
+//     fetched, respectively.
+//   - "goproxy_cache_bytes_total": a counter of the bytes of the caches put
+//     to the Cacher.
+//
+// Nothing is collected unless [Goproxy.Metrics] is true. Otherwise, the
+// returned handler responds with status 404.
+func (g *Goproxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		g.initOnce.Do(g.init)
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			responseMethodNotAllowed(rw, req, -2)
+			return
+		}
+		if g.metrics == nil {
+			responseNotFound(rw, req, -2, "metrics not enabled")
+			return
+		}
+		var b bytes.Buffer
+		g.metrics.writeTo(&b)
+		responseSuccess(rw, req, bytes.NewReader(b.Bytes()), "text/plain; version=0.0.4; charset=utf-8", -2)
+	})
+}
+
+// metrics is the metrics collected for [Goproxy.MetricsHandler].
+type metrics struct {
+	cacheHits       uint64
+	cacheMisses     uint64
+	cacheBytes      uint64
+	inflightFetches int64
+
+	mu             sync.Mutex
+	requests       map[requestMetricsKey]uint64
+	fetchDurations map[string]*histogram
+}
+
+// requestMetricsKey is the labels of the "goproxy_requests_total" counter.
+type requestMetricsKey struct {
+	operation string
+	code      int
+}
+
+// newMetrics returns a new [metrics].
+func newMetrics() *metrics {
+	return &metrics{
+		requests:       map[requestMetricsKey]uint64{},
+		fetchDurations: map[string]*histogram{},
+	}
+}
+
+// requestMetricsContextKey is the context key for the [requestMetrics] of a
+// request.
+type requestMetricsContextKey struct{}
+
+// requestMetrics is the metrics of a request being served, which are observed
+// once it has been served.
+type requestMetrics struct {
+	operation string
+}
+
+// setRequestOperation records the operation of the request with the ctx for
+// its metrics, if any.
+func setRequestOperation(ctx context.Context, operation string) {
+	if rm, ok := ctx.Value(requestMetricsContextKey{}).(*requestMetrics); ok {
+		rm.operation = operation
+	}
+}
+
+// observeRequest observes a request with the rm that has been responded with
+// the statusCode.
+func (m *metrics) observeRequest(rm *requestMetrics, statusCode int) {
+	key := requestMetricsKey{operation: rm.operation, code: statusCode}
+	if key.operation == "" {
+		key.operation = "other"
+	}
+	if key.code == 0 {
+		key.code = http.StatusOK
+	}
+	m.mu.Lock()
+	m.requests[key]++
+	m.mu.Unlock()
+}
+
+// observeCacheStatus observes a response whose content is a cache hit if the
+// hit is true, or a cache miss otherwise.
+func (m *metrics) observeCacheStatus(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&m.cacheMisses, 1)
+	}
+}
+
+// observeCachePut observes caches of the size in total put to the Cacher.
+func (m *metrics) observeCachePut(size int64) {
+	if size > 0 {
+		atomic.AddUint64(&m.cacheBytes, uint64(size))
+	}
+}
+
+// observeFetch observes the start of a fetch for the operation. The returned
+// function must be called once the fetch is done.
+func (m *metrics) observeFetch(operation string) func() {
+	atomic.AddInt64(&m.inflightFetches, 1)
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		atomic.AddInt64(&m.inflightFetches, -1)
+		m.mu.Lock()
+		h, ok := m.fetchDurations[operation]
+		if !ok {
+			h = &histogram{counts: make([]uint64, len(fetchDurationBuckets))}
+			m.fetchDurations[operation] = h
+		}
+		h.observe(d.Seconds())
+		m.mu.Unlock()
+	}
+}
+
+// writeTo writes the m to the w in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprint(w, "# HELP goproxy_requests_total Total number of requests served.\n")
+	fmt.Fprint(w, "# TYPE goproxy_requests_total counter\n")
+	requestKeys := make([]requestMetricsKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].operation != requestKeys[j].operation {
+			return requestKeys[i].operation < requestKeys[j].operation
+		}
+		return requestKeys[i].code < requestKeys[j].code
+	})
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "goproxy_requests_total{operation=%q,code=\"%d\"} %d\n", key.operation, key.code, m.requests[key])
+	}
+
+	fmt.Fprint(w, "# HELP goproxy_fetch_duration_seconds Duration of fetches from the fetcher.\n")
+	fmt.Fprint(w, "# TYPE goproxy_fetch_duration_seconds histogram\n")
+	operations := make([]string, 0, len(m.fetchDurations))
+	for operation := range m.fetchDurations {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		h := m.fetchDurations[operation]
+		for i, le := range fetchDurationBuckets {
+			fmt.Fprintf(w, "goproxy_fetch_duration_seconds_bucket{operation=%q,le=%q} %d\n", operation, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "goproxy_fetch_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, h.count)
+		fmt.Fprintf(w, "goproxy_fetch_duration_seconds_sum{operation=%q} %s\n", operation, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "goproxy_fetch_duration_seconds_count{operation=%q} %d\n", operation, h.count)
+	}
+
+	fmt.Fprint(w, "# HELP goproxy_inflight_fetches Number of fetches from the fetcher in progress.\n")
+	fmt.Fprint(w, "# TYPE goproxy_inflight_fetches gauge\n")
+	fmt.Fprintf(w, "goproxy_inflight_fetches %d\n", atomic.LoadInt64(&m.inflightFetches))
+
+	fmt.Fprint(w, "# HELP goproxy_cache_hits_total Total number of responses served from the cacher.\n")
+	fmt.Fprint(w, "# TYPE goproxy_cache_hits_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_hits_total %d\n", atomic.LoadUint64(&m.cacheHits))
+
+	fmt.Fprint(w, "# HELP goproxy_cache_misses_total Total number of responses with content just fetched.\n")
+	fmt.Fprint(w, "# TYPE goproxy_cache_misses_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_misses_total %d\n", atomic.LoadUint64(&m.cacheMisses))
+
+	fmt.Fprint(w, "# HELP goproxy_cache_bytes_total Total number of bytes of caches put to the cacher.\n")
+	fmt.Fprint(w, "# TYPE goproxy_cache_bytes_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_bytes_total %d\n", atomic.LoadUint64(&m.cacheBytes))
+}
+
+// histogram is a cumulative histogram of observations with the upper bounds of
+// its buckets in the fetchDurationBuckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe adds the v to the h.
+func (h *histogram) observe(v float64) {
+	for i, le := range fetchDurationBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricsFetcher is a [Fetcher] that observes the fetches of another
+// [Fetcher] for the metrics.
+type metricsFetcher struct {
+	Fetcher
+	metrics *metrics
+}
+
+// Query implements [Fetcher].
+func (mf *metricsFetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	defer mf.metrics.observeFetch("query")()
+	return mf.Fetcher.Query(ctx, path, query)
+}
+
+// List implements [Fetcher].
+func (mf *metricsFetcher) List(ctx context.Context, path string) ([]string, error) {
+	defer mf.metrics.observeFetch("list")()
+	return mf.Fetcher.List(ctx, path)
+}
+
+// Download implements [Fetcher].
+func (mf *metricsFetcher) Download(ctx context.Context, path, version string) (io.ReadSeekCloser, io.ReadSeekCloser, io.ReadSeekCloser, error) {
+	defer mf.metrics.observeFetch("download")()
+	return mf.Fetcher.Download(ctx, path, version)
+}
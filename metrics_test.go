@@ -0,0 +1,99 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoproxyMetricsHandler(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			list: func(ctx context.Context, path string) ([]string, error) {
+				return []string{"v1.0.0"}, nil
+			},
+			download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+				if version != "v1.0.0" {
+					return nil, nil, nil, notExistErrorf("not found")
+				}
+				return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher:      &DirCacher{Dir: t.TempDir()},
+		ErrorLogger: log.New(io.Discard, "", 0),
+		Metrics:     true,
+	}
+	for _, target := range []string{
+		"/example.com/@v/v1.0.0.info",
+		"/example.com/@v/v1.0.0.info",
+		"/example.com/@v/v1.1.0.info",
+		"/example.com/@v/list",
+		"/foobar",
+	} {
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	server := httptest.NewServer(g.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	lines := map[string]bool{}
+	for _, line := range strings.Split(string(b), "\n") {
+		lines[line] = true
+	}
+	for _, want := range []string{
+		"# TYPE goproxy_requests_total counter",
+		`goproxy_requests_total{operation="download",code="200"} 2`,
+		`goproxy_requests_total{operation="download",code="404"} 1`,
+		`goproxy_requests_total{operation="list",code="200"} 1`,
+		`goproxy_requests_total{operation="other",code="404"} 1`,
+		"# TYPE goproxy_fetch_duration_seconds histogram",
+		`goproxy_fetch_duration_seconds_bucket{operation="download",le="+Inf"} 2`,
+		`goproxy_fetch_duration_seconds_count{operation="download"} 2`,
+		`goproxy_fetch_duration_seconds_count{operation="list"} 1`,
+		"# TYPE goproxy_inflight_fetches gauge",
+		"goproxy_inflight_fetches 0",
+		"goproxy_cache_hits_total 1",
+		"goproxy_cache_misses_total 2",
+		"goproxy_cache_bytes_total " + strconv.Itoa(len(info)+len("module example.com")+len("zip")+len("v1.0.0")),
+	} {
+		if !lines[want] {
+			t.Errorf("missing line %q in %q", want, b)
+		}
+	}
+
+	resp, err = http.Post(server.URL+"/metrics", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	(&Goproxy{}).MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package goproxy
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is the token bucket limiting the rate of requests handled by
+// [Goproxy.ServeHTTP] (see [Goproxy.RequestRate]), and the IO rate of cache
+// verification (see [verifyThrottle]). A nil rateLimiter allows every request.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	nowFunc func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a new [rateLimiter] that allows rate requests per
+// second with bursts of up to burst requests. The bucket starts full.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// now returns the current time.
+func (rl *rateLimiter) now() time.Time {
+	if rl.nowFunc != nil {
+		return rl.nowFunc()
+	}
+	return time.Now()
+}
+
+// reserve takes a token for a request from the rl. It returns zero if a token
+// is available, or the time until one will be otherwise, in which case no
+// token is taken so that rejected requests do not delay later ones.
+func (rl *rateLimiter) reserve() time.Duration {
+	if rl == nil {
+		return 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refill()
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return 0
+	}
+	return time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
+
+// wait takes n tokens from the rl, waiting until they have been paid for or
+// the ctx is done. Unlike reserve, it always takes the tokens, running the
+// bucket into debt if needed, so that callers that must not be rejected are
+// throttled to the rate on average.
+func (rl *rateLimiter) wait(ctx context.Context, n float64) error {
+	if rl == nil {
+		return nil
+	}
+	rl.mu.Lock()
+	rl.refill()
+	rl.tokens -= n
+	delay := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refill adds the tokens accumulated since the last call to the rl. The rl.mu
+// must be held.
+func (rl *rateLimiter) refill() {
+	now := rl.now()
+	if !rl.last.IsZero() {
+		if elapsed := now.Sub(rl.last).Seconds(); elapsed > 0 {
+			rl.tokens = math.Min(rl.burst, rl.tokens+elapsed*rl.rate)
+		}
+	}
+	rl.last = now
+}
+
+// retryAfterSeconds returns the value of the "Retry-After" header for a
+// request rejected by a [rateLimiter] that will have a token after the delay.
+// It adds a random jitter of up to a second to the delay before rounding it
+// up to whole seconds, so that clients rejected at the same time do not all
+// retry at the same time.
+func retryAfterSeconds(delay time.Duration) int {
+	backoffRandMutex.Lock()
+	jitter := time.Duration(backoffRand.Int63n(int64(time.Second)))
+	backoffRandMutex.Unlock()
+	return int(math.Ceil((delay + jitter).Seconds()))
+}
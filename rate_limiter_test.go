@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(2, 3)
+	rl.nowFunc = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if got := rl.reserve(); got != 0 {
+			t.Errorf("%d: got %v, want 0", i, got)
+		}
+	}
+	if got, want := rl.reserve(), 500*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	now = now.Add(250 * time.Millisecond)
+	if got, want := rl.reserve(), 250*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if got := rl.reserve(); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if got := rl.reserve(); got != 0 {
+			t.Errorf("%d: got %v, want 0", i, got)
+		}
+	}
+	if got, want := rl.reserve(), 500*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	rl = newRateLimiter(1.5, 0)
+	if got, want := rl.burst, 2.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var nilLimiter *rateLimiter
+	if got := nilLimiter.reserve(); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	for _, tt := range []struct {
+		n     int
+		delay time.Duration
+	}{
+		{1, time.Millisecond},
+		{2, 500 * time.Millisecond},
+		{3, time.Second},
+		{4, 2500 * time.Millisecond},
+	} {
+		minSeconds := int(math.Ceil(tt.delay.Seconds()))
+		maxSeconds := int(math.Ceil((tt.delay + time.Second).Seconds()))
+		for i := 0; i < 100; i++ {
+			if got := retryAfterSeconds(tt.delay); got < minSeconds || got > maxSeconds {
+				t.Fatalf("test(%d): got %d, want in range [%d, %d]", tt.n, got, minSeconds, maxSeconds)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// ReadinessReport is the result of a readiness probe of a [Goproxy] (see
+// [Goproxy.Readiness]).
+type ReadinessReport struct {
+	// Ready indicates whether all stages of the probe have succeeded.
+	Ready bool
+
+	// Stages are the stages of the probe that have been run, in order. A
+	// failed stage is the last one, as the stages after it depend on it.
+	Stages []ReadinessStage
+
+	// Time is when the probe was run.
+	Time time.Time
+}
+
+// ReadinessStage is a stage of a readiness probe in a [ReadinessReport].
+type ReadinessStage struct {
+	// Name is the name of the stage. It is one of the following:
+	//  - "fetch": the download of the canary module version from the
+	//    Fetcher.
+	//  - "put": the put of its module files to the Cacher.
+	//  - "get": the get of its .mod file back from the Cacher, which must
+	//    match the fetched one.
+	Name string
+
+	// Duration is how long the stage took.
+	Duration time.Duration
+
+	// Err is the error that the stage failed with, if any.
+	Err error
+}
+
+// defaultReadinessCacheTTL is the default value of
+// [Goproxy.ReadinessCacheTTL].
+const defaultReadinessCacheTTL = 30 * time.Second
+
+// Readiness probes the whole pipeline of the g with the g.ReadinessCanary: it
+// downloads the canary module version from the g.Fetcher, puts its module
+// files to the g.Cacher, and gets its .mod file back, reporting the duration
+// and the error of each stage. The put and get stages are skipped if the
+// g.Cacher is nil, and the FallbackCacher is never used, so that a broken
+// Cacher is reported as such. If the g.ReadinessCanary is empty, nothing is
+// probed and the g is reported as ready.
+//
+// Reports are reused for the g.ReadinessCacheTTL, so that frequent probes do
+// not hammer the upstream. Concurrent calls wait for the same probe, and a call
+// whose ctx is done while waiting returns a report that is not ready and has
+// no stages, without failing the others. Note that every probe puts the canary
+// module files to the g.Cacher again, so the g.Cacher sees a write of the
+// size of the canary module version every g.ReadinessCacheTTL.
+func (g *Goproxy) Readiness(ctx context.Context) ReadinessReport {
+	g.initOnce.Do(g.init)
+	ttl := g.ReadinessCacheTTL
+	if ttl == 0 {
+		ttl = defaultReadinessCacheTTL
+	}
+	g.readinessMutex.Lock()
+	cached := g.readiness
+	g.readinessMutex.Unlock()
+	if cached != nil && ttl > 0 && time.Since(cached.Time) < ttl {
+		return *cached
+	}
+	val, _, err := g.readinessGroup.doValue(ctx, ctx, "", func(ctx context.Context) (interface{}, error) {
+		report := g.probeReadiness(ctx)
+		if ctx.Err() == nil {
+			g.readinessMutex.Lock()
+			g.readiness = &report
+			g.readinessMutex.Unlock()
+		}
+		return report, nil
+	}, nil, nil)
+	if err != nil {
+		return ReadinessReport{Time: time.Now()}
+	}
+	return val.(ReadinessReport)
+}
+
+// probeReadiness runs a readiness probe of the g (see [Goproxy.Readiness]).
+func (g *Goproxy) probeReadiness(ctx context.Context) ReadinessReport {
+	report := ReadinessReport{Ready: true, Time: time.Now()}
+	if g.ReadinessCanary == "" {
+		return report
+	}
+	stage := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		report.Stages = append(report.Stages, ReadinessStage{Name: name, Duration: time.Since(start), Err: err})
+		if err != nil {
+			report.Ready = false
+		}
+		return err == nil
+	}
+
+	var (
+		nameWithoutExt string
+		info, mod, zip io.ReadSeekCloser
+	)
+	if !stage("fetch", func() error {
+		modulePath, moduleVersion, ok := strings.Cut(g.ReadinessCanary, "@")
+		if !ok {
+			return fmt.Errorf("invalid readiness canary %q: missing version", g.ReadinessCanary)
+		}
+		if err := checkCanonicalVersion(modulePath, moduleVersion); err != nil {
+			return fmt.Errorf("invalid readiness canary %q: %w", g.ReadinessCanary, err)
+		}
+		escapedModulePath, err := module.EscapePath(modulePath)
+		if err != nil {
+			return err
+		}
+		escapedModuleVersion, err := module.EscapeVersion(moduleVersion)
+		if err != nil {
+			return err
+		}
+		nameWithoutExt = escapedModulePath + "/@v/" + escapedModuleVersion
+		info, mod, zip, err = g.fetchDownload(ctx, modulePath, moduleVersion)
+		return err
+	}) {
+		return report
+	}
+	defer func() {
+		info.Close()
+		mod.Close()
+		zip.Close()
+	}()
+	if g.Cacher == nil {
+		return report
+	}
+	if !stage("put", func() error {
+		return PutAll(ctx, g.Cacher, g.cacheKeyEntries(ctx, []CacheEntry{
+			{Name: nameWithoutExt + ".info", Content: info},
+			{Name: nameWithoutExt + ".mod", Content: mod},
+			{Name: nameWithoutExt + ".zip", Content: zip},
+		}))
+	}) {
+		return report
+	}
+	stage("get", func() error {
+		if _, err := mod.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		wantMod, err := io.ReadAll(mod)
+		if err != nil {
+			return err
+		}
+		content, err := g.Cacher.Get(ctx, g.cacheKey(ctx, nameWithoutExt+".mod"))
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		gotMod, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(gotMod, wantMod) {
+			return errors.New("cached .mod file does not match the fetched one")
+		}
+		return nil
+	})
+	return report
+}
+
+// ReadinessHandler returns an [http.Handler] that serves the report returned
+// by [Goproxy.Readiness], for readiness probes of orchestrators. Like
+// [Goproxy.AdminHandler], it is independent of [Goproxy.ServeHTTP] and should
+// be mounted separately from the module proxy.
+//
+// It accepts only GET and HEAD requests, and responds {"ready": <whether
+// ready>, "checked_at": <RFC 3339 time>, "stages": [{"name": <stage name>,
+// "duration_ms": <duration in milliseconds>, "error": <message if failed>},
+// ...]} with status 200 if the g is ready, or 503 otherwise.
+func (g *Goproxy) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			responseAdminError(rw, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		type readinessStage struct {
+			Name       string  `json:"name"`
+			DurationMs float64 `json:"duration_ms"`
+			Error      string  `json:"error,omitempty"`
+		}
+		report := g.Readiness(req.Context())
+		stages := make([]readinessStage, 0, len(report.Stages))
+		for _, s := range report.Stages {
+			stage := readinessStage{Name: s.Name, DurationMs: float64(s.Duration) / float64(time.Millisecond)}
+			if s.Err != nil {
+				stage.Error = s.Err.Error()
+			}
+			stages = append(stages, stage)
+		}
+		statusCode := http.StatusOK
+		if !report.Ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+		responseJSON(rw, statusCode, struct {
+			Ready     bool             `json:"ready"`
+			CheckedAt time.Time        `json:"checked_at"`
+			Stages    []readinessStage `json:"stages"`
+		}{report.Ready, report.Time.UTC(), stages})
+	})
+}
@@ -0,0 +1,319 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGoproxyReadiness(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		n              int
+		canary         string
+		cacher         func(dir string) Cacher
+		downloadErr    error
+		wantReady      bool
+		wantStages     []string
+		wantErr        string
+		wantDownloaded int
+	}{
+		{
+			n:              1,
+			canary:         "example.com/Canary@v1.0.0",
+			cacher:         func(dir string) Cacher { return &DirCacher{Dir: dir} },
+			wantReady:      true,
+			wantStages:     []string{"fetch", "put", "get"},
+			wantDownloaded: 1,
+		},
+		{
+			n:              2,
+			canary:         "example.com/Canary@v1.0.0",
+			wantReady:      true,
+			wantStages:     []string{"fetch"},
+			wantDownloaded: 1,
+		},
+		{
+			n:              3,
+			wantReady:      true,
+			wantStages:     []string{},
+			wantDownloaded: 0,
+		},
+		{
+			n:              4,
+			canary:         "example.com/Canary@v1.0.0",
+			cacher:         func(dir string) Cacher { return &DirCacher{Dir: dir} },
+			downloadErr:    errors.New("bad upstream"),
+			wantStages:     []string{"fetch"},
+			wantErr:        "bad upstream",
+			wantDownloaded: 1,
+		},
+		{
+			n:      5,
+			canary: "example.com/Canary@v1.0.0",
+			cacher: func(dir string) Cacher {
+				return &testCacher{
+					Cacher: &DirCacher{Dir: dir},
+					put: func(ctx context.Context, c Cacher, name string, content io.ReadSeeker) error {
+						return errors.New("disk full")
+					},
+				}
+			},
+			wantStages:     []string{"fetch", "put"},
+			wantErr:        "disk full",
+			wantDownloaded: 1,
+		},
+		{
+			n:      6,
+			canary: "example.com/Canary@v1.0.0",
+			cacher: func(dir string) Cacher {
+				return &testCacher{
+					Cacher: &DirCacher{Dir: dir},
+					get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+						return io.NopCloser(strings.NewReader("module example.com/other")), nil
+					},
+				}
+			},
+			wantStages:     []string{"fetch", "put", "get"},
+			wantErr:        "cached .mod file does not match the fetched one",
+			wantDownloaded: 1,
+		},
+		{
+			n:              7,
+			canary:         "example.com/Canary",
+			wantStages:     []string{"fetch"},
+			wantErr:        `invalid readiness canary "example.com/Canary": missing version`,
+			wantDownloaded: 0,
+		},
+		{
+			n:              8,
+			canary:         "example.com/Canary@master",
+			wantStages:     []string{"fetch"},
+			wantErr:        `invalid readiness canary "example.com/Canary@master": example.com/Canary@master: invalid version: not a semantic version`,
+			wantDownloaded: 0,
+		},
+	} {
+		downloaded := 0
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (_, _, _ io.ReadSeekCloser, err error) {
+					downloaded++
+					if tt.downloadErr != nil {
+						return nil, nil, nil, tt.downloadErr
+					}
+					return nopReadSeekCloser(info), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			ReadinessCanary: tt.canary,
+		}
+		if tt.cacher != nil {
+			g.Cacher = tt.cacher(t.TempDir())
+		}
+		for i := 0; i < 2; i++ {
+			report := g.Readiness(context.Background())
+			if got, want := report.Ready, tt.wantReady; got != want {
+				t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+			}
+			if report.Time.IsZero() {
+				t.Errorf("test(%d): got zero time", tt.n)
+			}
+			gotStages := []string{}
+			gotErr := ""
+			for _, stage := range report.Stages {
+				gotStages = append(gotStages, stage.Name)
+				if stage.Err != nil {
+					gotErr = stage.Err.Error()
+				}
+			}
+			if got, want := strings.Join(gotStages, ","), strings.Join(tt.wantStages, ","); got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := gotErr, tt.wantErr; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if got, want := downloaded, tt.wantDownloaded; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyReadinessCacheTTL(t *testing.T) {
+	downloaded := 0
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (_, _, _ io.ReadSeekCloser, err error) {
+				downloaded++
+				return nopReadSeekCloser("{}"), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		ReadinessCanary:   "example.com/canary@v1.0.0",
+		ReadinessCacheTTL: -1,
+	}
+	g.Readiness(context.Background())
+	g.Readiness(context.Background())
+	if got, want := downloaded, 2; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	g.ReadinessCacheTTL = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.readiness = nil
+	g.Readiness(ctx)
+	if g.readiness != nil {
+		t.Error("got cached report, want nil")
+	}
+	g.Readiness(context.Background())
+	g.Readiness(context.Background())
+	if got, want := downloaded, 3; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyReadinessConcurrentCalls(t *testing.T) {
+	var downloaded int32
+	downloadStarted := make(chan struct{})
+	releaseDownload := make(chan struct{})
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (_, _, _ io.ReadSeekCloser, err error) {
+				if atomic.AddInt32(&downloaded, 1) == 1 {
+					close(downloadStarted)
+				}
+				<-releaseDownload
+				return nopReadSeekCloser("{}"), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+			},
+		},
+		Cacher:          &DirCacher{Dir: t.TempDir()},
+		ReadinessCanary: "example.com/canary@v1.0.0",
+	}
+	reportc := make(chan ReadinessReport)
+	go func() { reportc <- g.Readiness(context.Background()) }()
+	<-downloadStarted
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report := g.Readiness(ctx)
+	if report.Ready {
+		t.Error("got ready, want not ready")
+	}
+	if got, want := len(report.Stages), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	close(releaseDownload)
+	report = <-reportc
+	if !report.Ready {
+		t.Errorf("got not ready, want ready: %+v", report.Stages)
+	}
+	if got, want := atomic.LoadInt32(&downloaded), int32(1); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestGoproxyReadinessHandler(t *testing.T) {
+	for _, tt := range []struct {
+		n              int
+		method         string
+		downloadErr    error
+		wantStatusCode int
+		wantAllow      string
+		wantReady      bool
+		wantStages     string
+		wantContent    string
+	}{
+		{
+			n:              1,
+			method:         http.MethodGet,
+			wantStatusCode: http.StatusOK,
+			wantReady:      true,
+			wantStages:     "fetch:,put:,get:",
+		},
+		{
+			n:              2,
+			method:         http.MethodHead,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			n:              3,
+			method:         http.MethodGet,
+			downloadErr:    errors.New("bad upstream"),
+			wantStatusCode: http.StatusServiceUnavailable,
+			wantStages:     "fetch:bad upstream",
+		},
+		{
+			n:              4,
+			method:         http.MethodPost,
+			wantStatusCode: http.StatusMethodNotAllowed,
+			wantAllow:      "GET, HEAD",
+			wantContent:    `{"error":"method not allowed"}`,
+		},
+	} {
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				download: func(ctx context.Context, path, version string) (_, _, _ io.ReadSeekCloser, err error) {
+					if tt.downloadErr != nil {
+						return nil, nil, nil, tt.downloadErr
+					}
+					return nopReadSeekCloser("{}"), nopReadSeekCloser("module " + path), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:          &DirCacher{Dir: t.TempDir()},
+			ReadinessCanary: "example.com/canary@v1.0.0",
+		}
+		rec := httptest.NewRecorder()
+		g.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(tt.method, "/", nil))
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Allow"), tt.wantAllow; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.method == http.MethodHead {
+			continue
+		}
+		if tt.wantContent != "" {
+			if got, want := strings.TrimSpace(rec.Body.String()), tt.wantContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
+		}
+		var body struct {
+			Ready     bool      `json:"ready"`
+			CheckedAt time.Time `json:"checked_at"`
+			Stages    []struct {
+				Name       string  `json:"name"`
+				DurationMs float64 `json:"duration_ms"`
+				Error      string  `json:"error"`
+			} `json:"stages"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := body.Ready, tt.wantReady; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+		if body.CheckedAt.IsZero() {
+			t.Errorf("test(%d): got zero checked_at", tt.n)
+		}
+		var stages []string
+		for _, stage := range body.Stages {
+			if stage.DurationMs < 0 {
+				t.Errorf("test(%d): got negative duration %v", tt.n, stage.DurationMs)
+			}
+			stages = append(stages, stage.Name+":"+stage.Error)
+		}
+		if got, want := strings.Join(stages, ","), tt.wantStages; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CacheEvent is a module version cached by a [Goproxy], as returned by
+// [Goproxy.RecentlyCached].
+type CacheEvent struct {
+	// Path is the module path.
+	Path string
+
+	// Version is the module version.
+	Version string
+
+	// Size is the size of the zip file of the module version in bytes, or
+	// zero if it is unknown.
+	Size int64
+
+	// Time is when the zip file of the module version was cached.
+	Time time.Time
+}
+
+// recentCaches is a bounded ring buffer of the most recent [CacheEvent] values
+// (see [Goproxy.RecentlyCachedSize]).
+type recentCaches struct {
+	mu     sync.Mutex
+	events []CacheEvent
+	next   int
+	full   bool
+}
+
+// newRecentCaches returns a new [recentCaches] that holds up to size events.
+func newRecentCaches(size int) *recentCaches {
+	return &recentCaches{events: make([]CacheEvent, size)}
+}
+
+// add adds the module version of the e to the rc if the e is a "put" of a .zip
+// file. It overwrites the oldest event once the rc is full.
+func (rc *recentCaches) add(e AuditEvent) {
+	if e.Operation != "put" {
+		return
+	}
+	ft, err := parseFetchTarget(e.Name)
+	if err != nil || ft.ext != ".zip" {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.events[rc.next] = CacheEvent{Path: ft.modulePath, Version: ft.moduleVersion, Size: e.Bytes, Time: e.Time}
+	rc.next++
+	if rc.next == len(rc.events) {
+		rc.next, rc.full = 0, true
+	}
+}
+
+// recent returns up to n events of the rc, most recent first. If n is not
+// positive, all events are returned.
+func (rc *recentCaches) recent(n int) []CacheEvent {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	count := rc.next
+	if rc.full {
+		count = len(rc.events)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	events := make([]CacheEvent, n)
+	for i := range events {
+		events[i] = rc.events[(rc.next-1-i+len(rc.events))%len(rc.events)]
+	}
+	return events
+}
+
+// RecentlyCached returns up to n of the module versions most recently cached
+// by the g, most recent first, as remembered by the g.RecentlyCachedSize. A
+// module version counts as cached when its zip file is put to the g.Cacher. If
+// n is not positive, all remembered module versions are returned.
+//
+// It returns nil if the g.RecentlyCachedSize is not positive.
+func (g *Goproxy) RecentlyCached(n int) []CacheEvent {
+	g.initOnce.Do(g.init)
+	if g.recentlyCached == nil {
+		return nil
+	}
+	return g.recentlyCached.recent(n)
+}
+
+// RecentlyCachedHandler returns an [http.Handler] that serves the module
+// versions returned by [Goproxy.RecentlyCached] as JSON, for status or
+// discovery pages. Like [Goproxy.AdminHandler], it is independent of
+// [Goproxy.ServeHTTP] and should be mounted separately from the module proxy.
+//
+// It accepts only GET and HEAD requests with an optional "n" query parameter
+// of the maximum number of module versions, and responds {"modules":
+// [{"path": <module path>, "version": <version>, "size": <size of the zip
+// file>, "cached_at": <RFC 3339 time>}, ...]}, most recent first. An invalid
+// "n" is responded with status 400 and {"error": <message>}.
+func (g *Goproxy) RecentlyCachedHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			responseAdminError(rw, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		n := 0
+		if s := req.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 0 {
+				responseAdminError(rw, http.StatusBadRequest, errors.New("invalid n"))
+				return
+			}
+		}
+		type cachedModule struct {
+			Path     string    `json:"path"`
+			Version  string    `json:"version"`
+			Size     int64     `json:"size"`
+			CachedAt time.Time `json:"cached_at"`
+		}
+		events := g.RecentlyCached(n)
+		modules := make([]cachedModule, 0, len(events))
+		for _, e := range events {
+			modules = append(modules, cachedModule{Path: e.Path, Version: e.Version, Size: e.Size, CachedAt: e.Time.UTC()})
+		}
+		responseJSON(rw, http.StatusOK, struct {
+			Modules []cachedModule `json:"modules"`
+		}{modules})
+	})
+}
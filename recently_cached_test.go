@@ -0,0 +1,116 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoproxyRecentlyCached(t *testing.T) {
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser(strings.Repeat("z", len(version))), nil
+			},
+		},
+		Cacher:             &DirCacher{Dir: t.TempDir()},
+		ErrorLogger:        log.New(io.Discard, "", 0),
+		RecentlyCachedSize: 3,
+	}
+	if got := g.RecentlyCached(0); len(got) != 0 {
+		t.Errorf("got %v, want no events", got)
+	}
+	for _, name := range []string{
+		"example.com/@v/v1.0.0.zip",
+		"example.com/@v/v1.1.0.info",
+		"example.com/@v/v1.10.0.zip",
+		"example.com/!foo/@v/v1.2.0.zip",
+		"example.com/@v/v1.100.0.zip",
+		"example.com/bar/@v/v0.1.0-alpha.zip",
+	} {
+		rc, err := g.GetOrFetch(context.Background(), name)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		rc.Close()
+	}
+	for _, tt := range []struct {
+		n    int
+		max  int
+		want []string
+	}{
+		{1, 0, []string{"example.com/bar@v0.1.0-alpha:12", "example.com@v1.100.0:8", "example.com/Foo@v1.2.0:6"}},
+		{2, 2, []string{"example.com/bar@v0.1.0-alpha:12", "example.com@v1.100.0:8"}},
+		{3, 10, []string{"example.com/bar@v0.1.0-alpha:12", "example.com@v1.100.0:8", "example.com/Foo@v1.2.0:6"}},
+	} {
+		var got []string
+		for _, e := range g.RecentlyCached(tt.max) {
+			if e.Time.IsZero() {
+				t.Errorf("test(%d): got zero time", tt.n)
+			}
+			got = append(got, e.Path+"@"+e.Version+":"+strconv.FormatInt(e.Size, 10))
+		}
+		if got, want := strings.Join(got, ","), strings.Join(tt.want, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		n              int
+		method         string
+		target         string
+		wantStatusCode int
+		wantModules    []string
+		wantContent    string
+	}{
+		{1, http.MethodGet, "/?n=2", http.StatusOK, []string{"example.com/bar@v0.1.0-alpha:12", "example.com@v1.100.0:8"}, ""},
+		{2, http.MethodGet, "/", http.StatusOK, []string{"example.com/bar@v0.1.0-alpha:12", "example.com@v1.100.0:8", "example.com/Foo@v1.2.0:6"}, ""},
+		{3, http.MethodGet, "/?n=-1", http.StatusBadRequest, nil, `{"error":"invalid n"}` + "\n"},
+		{4, http.MethodPost, "/", http.StatusMethodNotAllowed, nil, `{"error":"method not allowed"}` + "\n"},
+	} {
+		rec := httptest.NewRecorder()
+		g.RecentlyCachedHandler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if tt.wantModules == nil {
+			if got, want := rec.Body.String(), tt.wantContent; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			continue
+		}
+		var resp struct {
+			Modules []struct {
+				Path     string    `json:"path"`
+				Version  string    `json:"version"`
+				Size     int64     `json:"size"`
+				CachedAt time.Time `json:"cached_at"`
+			} `json:"modules"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		var got []string
+		for _, m := range resp.Modules {
+			if m.CachedAt.IsZero() {
+				t.Errorf("test(%d): got zero time", tt.n)
+			}
+			got = append(got, m.Path+"@"+m.Version+":"+strconv.FormatInt(m.Size, 10))
+		}
+		if got, want := strings.Join(got, ","), strings.Join(tt.wantModules, ","); got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	g = &Goproxy{}
+	if got := g.RecentlyCached(0); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
@@ -0,0 +1,127 @@
+package goproxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTraceHeader is the name of the request header that asks for a
+// request trace, and of the response trailer that carries it (see
+// [Goproxy.RequestTraces]).
+const requestTraceHeader = "X-Goproxy-Trace"
+
+// requestTraceKey is the context key for the [requestTrace] of the request
+// being served.
+type requestTraceKey struct{}
+
+// requestTrace records the decision path of a request being served (see
+// [Goproxy.RequestTraces]). A nil requestTrace records nothing.
+type requestTrace struct {
+	start time.Time
+
+	mu       sync.Mutex
+	steps    []*requestTraceStep
+	upstream string
+}
+
+// requestTraceStep is a step recorded by a [requestTrace].
+type requestTraceStep struct {
+	name     string
+	attrs    []TraceAttribute
+	duration time.Duration
+	err      error
+	ended    bool
+}
+
+// newRequestTrace returns a new [requestTrace] for the req if it asks for one
+// with the "X-Goproxy-Trace" header, or nil otherwise.
+func newRequestTrace(req *http.Request) *requestTrace {
+	if trace, _ := strconv.ParseBool(req.Header.Get(requestTraceHeader)); !trace {
+		return nil
+	}
+	return &requestTrace{start: time.Now()}
+}
+
+// startRequestTraceStep starts a step with the name and attrs in the
+// [requestTrace] carried by the ctx, if any. The returned function ends the
+// step with the err that it failed with, if any.
+func startRequestTraceStep(ctx context.Context, name string, attrs ...TraceAttribute) func(err error) {
+	rt, _ := ctx.Value(requestTraceKey{}).(*requestTrace)
+	if rt == nil {
+		return func(error) {}
+	}
+	step := &requestTraceStep{name: name, attrs: attrs}
+	start := time.Now()
+	rt.mu.Lock()
+	rt.steps = append(rt.steps, step)
+	rt.mu.Unlock()
+	return func(err error) {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		step.duration, step.err, step.ended = time.Since(start), err, true
+	}
+}
+
+// addCoalescedRequestTraceStep adds a "goproxy.fetch.coalesced" step to the
+// [requestTrace] carried by the ctx, if any, for a wait of the duration for a
+// fetch of the content for the name that was started by another request, with
+// the err that the fetch failed with, if any.
+func addCoalescedRequestTraceStep(ctx context.Context, name string, duration time.Duration, err error) {
+	if rt, _ := ctx.Value(requestTraceKey{}).(*requestTrace); rt != nil {
+		rt.mu.Lock()
+		rt.steps = append(rt.steps, &requestTraceStep{
+			name:     "goproxy.fetch.coalesced",
+			attrs:    []TraceAttribute{{Key: "goproxy.cache.name", Value: name}},
+			duration: duration,
+			err:      err,
+			ended:    true,
+		})
+		rt.mu.Unlock()
+	}
+}
+
+// setRequestTraceUpstream records the upstream that the content of the request
+// being served has been fetched from in the [requestTrace] carried by the ctx,
+// if any.
+func setRequestTraceUpstream(ctx context.Context, upstream string) {
+	if rt, _ := ctx.Value(requestTraceKey{}).(*requestTrace); rt != nil {
+		rt.mu.Lock()
+		rt.upstream = upstream
+		rt.mu.Unlock()
+	}
+}
+
+// String returns the steps recorded by the rt in the order they were started,
+// followed by the upstream (if known) and the total duration, all separated by
+// "; ". Each step is in the form "<name> <key>=<value>... <duration>",
+// followed by ` error="<message>"` if it failed.
+func (rt *requestTrace) String() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var parts []string
+	for _, step := range rt.steps {
+		var sb strings.Builder
+		sb.WriteString(step.name)
+		for _, attr := range step.attrs {
+			sb.WriteString(" " + attr.Key + "=" + attr.Value)
+		}
+		if step.ended {
+			sb.WriteString(" " + step.duration.String())
+		} else {
+			sb.WriteString(" (not ended)")
+		}
+		if step.err != nil {
+			sb.WriteString(" error=" + strconv.Quote(step.err.Error()))
+		}
+		parts = append(parts, sb.String())
+	}
+	if rt.upstream != "" {
+		parts = append(parts, "upstream "+rt.upstream)
+	}
+	parts = append(parts, "total "+time.Since(rt.start).String())
+	return strings.Join(parts, "; ")
+}
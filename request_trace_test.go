@@ -0,0 +1,168 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGoproxyRequestTraces(t *testing.T) {
+	requests := 0
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if requests++; requests == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(rw, "v1.0.0")
+	}))
+	defer proxyServer.Close()
+	durationRE := regexp.MustCompile(`\b[0-9][0-9.]*(ns|µs|ms|s)\b`)
+	for _, tt := range []struct {
+		n             int
+		requestTraces bool
+		debugHeaders  bool
+		traceHeader   string
+		wantTrace     string
+		wantLog       bool
+	}{
+		{
+			n:             1,
+			requestTraces: true,
+			debugHeaders:  true,
+			traceHeader:   "1",
+			wantTrace: strings.Join([]string{
+				`goproxy.fetch.list goproxy.module.path=example.com D`,
+				`goproxy.fetch.upstream goproxy.upstream=` + proxyServer.URL + ` D`,
+				`goproxy.fetch.retry url.full=` + proxyServer.URL + `/example.com/@v/list goproxy.attempt=2 D error="bad upstream"`,
+				`goproxy.cache.put goproxy.cache.name=example.com/@v/list D`,
+				`upstream ` + proxyServer.URL,
+				`total D`,
+			}, "; "),
+			wantLog: true,
+		},
+		{
+			n:             2,
+			requestTraces: true,
+			traceHeader:   "1",
+			wantTrace: strings.Join([]string{
+				`goproxy.fetch.list goproxy.module.path=example.com D`,
+				`goproxy.fetch.upstream goproxy.upstream=` + proxyServer.URL + ` D`,
+				`goproxy.fetch.retry url.full=` + proxyServer.URL + `/example.com/@v/list goproxy.attempt=2 D error="bad upstream"`,
+				`goproxy.cache.put goproxy.cache.name=example.com/@v/list D`,
+				`upstream ` + proxyServer.URL,
+				`total D`,
+			}, "; "),
+		},
+		{n: 3, requestTraces: true},
+		{n: 4, requestTraces: true, traceHeader: "0"},
+		{n: 5, traceHeader: "1"},
+	} {
+		requests = 0
+		var logBuf bytes.Buffer
+		g := &Goproxy{
+			Fetcher: &GoFetcher{
+				Env:     []string{"GOPROXY=" + proxyServer.URL, "GOSUMDB=off"},
+				Backoff: constantBackoff(0),
+			},
+			Cacher:        &DirCacher{Dir: t.TempDir()},
+			RequestTraces: tt.requestTraces,
+			DebugHeaders:  tt.debugHeaders,
+			ErrorLogger:   log.New(&logBuf, "", 0),
+		}
+		req := httptest.NewRequest("", "/example.com/@v/list", nil)
+		if tt.traceHeader != "" {
+			req.Header.Set("X-Goproxy-Trace", tt.traceHeader)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusOK; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		gotTrace := durationRE.ReplaceAllString(recr.Trailer.Get("X-Goproxy-Trace"), "D")
+		if got, want := gotTrace, tt.wantTrace; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		wantLog := ""
+		if tt.wantLog {
+			wantLog = "goproxy: trace: GET /example.com/@v/list: " + tt.wantTrace + "\n"
+		}
+		if got, want := durationRE.ReplaceAllString(logBuf.String(), "D"), wantLog; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestGoproxyRequestTracesCoalesced(t *testing.T) {
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	downloadStarted := make(chan struct{})
+	downloadRelease := make(chan struct{})
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info, mod, zipContent io.ReadSeekCloser, err error) {
+				close(downloadStarted)
+				<-downloadRelease
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module example.com"), nopReadSeekCloser(string(zip)), nil
+			},
+		},
+		Cacher:         &DirCacher{Dir: t.TempDir()},
+		ServeZipHashes: true,
+		RequestTraces:  true,
+		ErrorLogger:    log.New(io.Discard, "", 0),
+	}
+	var (
+		wg     sync.WaitGroup
+		traces [2]string
+	)
+	serve := func(i int) {
+		defer wg.Done()
+		req := httptest.NewRequest("", "/example.com/@v/v1.0.0.ziphash", nil)
+		req.Header.Set("X-Goproxy-Trace", "1")
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		traces[i] = rec.Result().Trailer.Get("X-Goproxy-Trace")
+	}
+	wg.Add(1)
+	go serve(0)
+	<-downloadStarted
+	wg.Add(1)
+	go serve(1)
+	for waits := 0; waits == 0; {
+		time.Sleep(time.Millisecond)
+		g.fetchGroup.mu.Lock()
+		if c, ok := g.fetchGroup.calls["example.com@v1.0.0"]; ok {
+			waits = c.waits
+		}
+		g.fetchGroup.mu.Unlock()
+	}
+	close(downloadRelease)
+	wg.Wait()
+
+	for i, tt := range []struct {
+		n             int
+		wantDownload  bool
+		wantCoalesced bool
+	}{
+		{1, true, false},
+		{2, false, true},
+	} {
+		if got, want := strings.Contains(traces[i], "goproxy.fetch.download "), tt.wantDownload; got != want {
+			t.Errorf("test(%d): got %t, want %t in %q", tt.n, got, want, traces[i])
+		}
+		if got, want := strings.Contains(traces[i], "goproxy.fetch.coalesced goproxy.cache.name=example.com/@v/v1.0.0.zip "), tt.wantCoalesced; got != want {
+			t.Errorf("test(%d): got %t, want %t in %q", tt.n, got, want, traces[i])
+		}
+	}
+}
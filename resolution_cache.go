@@ -0,0 +1,123 @@
+package goproxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// defaultMaxMutableNegativeCacheTTL is the maximum default value of
+// [Goproxy.MutableNegativeCacheTTL].
+const defaultMaxMutableNegativeCacheTTL = 10 * time.Second
+
+// resolutionCache is the in-memory cache of the responses that can change over
+// time (see [Goproxy.ResolutionCacheTTL]). It evicts the least recently used
+// entries beyond its maximum number of entries. A nil resolutionCache caches
+// nothing.
+type resolutionCache struct {
+	ttl        time.Duration
+	maxEntries int
+	nowFunc    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+// resolutionCacheEntry is an entry of a [resolutionCache].
+type resolutionCacheEntry struct {
+	name      string
+	content   string
+	expiresAt time.Time
+}
+
+// newResolutionCache returns a new [resolutionCache] with the ttl and
+// maxEntries.
+func newResolutionCache(ttl time.Duration, maxEntries int) *resolutionCache {
+	return &resolutionCache{ttl: ttl, maxEntries: maxEntries, entries: map[string]*list.Element{}}
+}
+
+// now returns the current time.
+func (rc *resolutionCache) now() time.Time {
+	if rc.nowFunc != nil {
+		return rc.nowFunc()
+	}
+	return time.Now()
+}
+
+// get returns the content for the name. It reports false if there is no such
+// content or it has expired.
+func (rc *resolutionCache) get(name string) (string, bool) {
+	if rc == nil {
+		return "", false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	elem, ok := rc.entries[name]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*resolutionCacheEntry)
+	if !rc.now().Before(entry.expiresAt) {
+		rc.lru.Remove(elem)
+		delete(rc.entries, name)
+		return "", false
+	}
+	rc.lru.MoveToFront(elem)
+	return entry.content, true
+}
+
+// put puts the content for the name, which expires after the rc.ttl.
+func (rc *resolutionCache) put(name, content string) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	expiresAt := rc.now().Add(rc.ttl)
+	if elem, ok := rc.entries[name]; ok {
+		entry := elem.Value.(*resolutionCacheEntry)
+		entry.content, entry.expiresAt = content, expiresAt
+		rc.lru.MoveToFront(elem)
+		return
+	}
+	rc.entries[name] = rc.lru.PushFront(&resolutionCacheEntry{name: name, content: content, expiresAt: expiresAt})
+	for rc.lru.Len() > rc.maxEntries {
+		elem := rc.lru.Back()
+		rc.lru.Remove(elem)
+		delete(rc.entries, elem.Value.(*resolutionCacheEntry).name)
+	}
+}
+
+// putNotFound puts the err for the name if it is a definitive not-found error
+// (see [Goproxy.NegativeCacheTTL]), so that [resolutionCache.notFound] returns
+// it until it expires.
+func (rc *resolutionCache) putNotFound(name string, err error) {
+	if !errors.Is(err, fs.ErrNotExist) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if errors.Is(err, errBadUpstream) || errors.Is(err, errFetchTimedOut) {
+		return
+	}
+	msg := err.Error()
+	if err == fs.ErrNotExist {
+		msg = ""
+	}
+	rc.put(name, msg)
+}
+
+// notFound returns the not-found error put by [resolutionCache.putNotFound]
+// for the name, or nil if there is no such error or it has expired.
+func (rc *resolutionCache) notFound(name string) error {
+	msg, ok := rc.get(name)
+	if !ok {
+		return nil
+	}
+	if msg == "" {
+		return fs.ErrNotExist
+	}
+	return notExistErrorf("%s", msg)
+}
@@ -0,0 +1,71 @@
+package goproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolutionCache(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rc := newResolutionCache(time.Minute, 2)
+	rc.nowFunc = func() time.Time { return now }
+
+	rc.put("a", "foo")
+	rc.put("b", "bar")
+	if content, ok := rc.get("a"); !ok {
+		t.Error("expected ok")
+	} else if got, want := content, "foo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	rc.put("c", "baz") // Evicts "b", which is the least recently used.
+	if _, ok := rc.get("b"); ok {
+		t.Error("expected not ok")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := rc.get(name); !ok {
+			t.Errorf("%s: expected ok", name)
+		}
+	}
+
+	now = now.Add(30 * time.Second)
+	rc.put("a", "qux")
+	now = now.Add(45 * time.Second)
+	if content, ok := rc.get("a"); !ok {
+		t.Error("expected ok")
+	} else if got, want := content, "qux"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, ok := rc.get("c"); ok {
+		t.Error("expected not ok")
+	}
+	if got, want := rc.lru.Len(), 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	var nilCache *resolutionCache
+	nilCache.put("a", "foo")
+	if _, ok := nilCache.get("a"); ok {
+		t.Error("expected not ok")
+	}
+}
+
+func TestResolutionCachePutNotFound(t *testing.T) {
+	for _, tt := range []struct {
+		n         int
+		err       error
+		wantFound bool
+	}{
+		{1, notExistErrorf("example.com@v1.0.0: unknown revision v1.0.0"), true},
+		{2, upstreamNotExistError("not found: bad upstream"), false},
+		{3, upstreamNotExistError("not found: fetch timed out"), false},
+		{4, notExistErrorf("%w: invalid info file: invalid version", errBadUpstream), false},
+		{5, errBadUpstream, false},
+	} {
+		rc := newResolutionCache(time.Minute, 1)
+		rc.putNotFound("a", tt.err)
+		if got, want := rc.notFound("a") != nil, tt.wantFound; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
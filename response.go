@@ -1,12 +1,18 @@
 package goproxy
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,6 +31,34 @@ func setResponseCacheControlHeader(rw http.ResponseWriter, maxAge int) {
 	rw.Header().Set("Cache-Control", cacheControl)
 }
 
+// cacheControlKey is the context key for the Cache-Control header of
+// successful responses set by [withCacheControl].
+type cacheControlKey struct{}
+
+// withCacheControl returns a shallow copy of the req whose successful
+// responses have the Cache-Control header of the cacheControl instead of the
+// one based on their max ages (see [Goproxy.ImmutableCacheControl] and
+// [Goproxy.MutableCacheControl]). It returns the req itself if the
+// cacheControl is empty.
+func withCacheControl(req *http.Request, cacheControl string) *http.Request {
+	if cacheControl == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), cacheControlKey{}, cacheControl))
+}
+
+// setSuccessCacheControlHeader is like [setResponseCacheControlHeader] but
+// for successful responses. It uses the Cache-Control header set by
+// [withCacheControl] in the context of the req, if any, instead of the one
+// based on the maxAge.
+func setSuccessCacheControlHeader(rw http.ResponseWriter, req *http.Request, maxAge int) {
+	if cacheControl, ok := req.Context().Value(cacheControlKey{}).(string); ok {
+		rw.Header().Set("Cache-Control", cacheControl)
+		return
+	}
+	setResponseCacheControlHeader(rw, maxAge)
+}
+
 // responseString responses the s as a "text/plain" content to the client with
 // the statusCode and cacheControlMaxAge.
 func responseString(rw http.ResponseWriter, req *http.Request, statusCode, cacheControlMaxAge int, s string) {
@@ -36,9 +70,45 @@ func responseString(rw http.ResponseWriter, req *http.Request, statusCode, cache
 	}
 }
 
+// errorResponderKey is the context key for the [Goproxy.ErrorResponder].
+type errorResponderKey struct{}
+
+// responseErr is the error passed to the [Goproxy.ErrorResponder].
+type responseErr struct {
+	msg string
+	err error
+}
+
+// Error implements [error].
+func (e *responseErr) Error() string { return e.msg }
+
+// Unwrap returns the underlying error.
+func (e *responseErr) Unwrap() error { return e.err }
+
+// responseErrorString is like [responseString] but for error responses. It
+// uses the [Goproxy.ErrorResponder] carried by the context of the req, if any,
+// to render the response with the underlying err.
+func responseErrorString(rw http.ResponseWriter, req *http.Request, statusCode, cacheControlMaxAge int, msg string, err error) {
+	if responder, ok := req.Context().Value(errorResponderKey{}).(func(http.ResponseWriter, *http.Request, int, error)); ok {
+		setResponseCacheControlHeader(rw, cacheControlMaxAge)
+		responder(rw, req, statusCode, &responseErr{msg: msg, err: err})
+		return
+	}
+	responseString(rw, req, statusCode, cacheControlMaxAge, msg)
+}
+
 // responseNotFound responses "not found" to the client with the
 // cacheControlMaxAge and optional msgs.
 func responseNotFound(rw http.ResponseWriter, req *http.Request, cacheControlMaxAge int, msgs ...any) {
+	var err error
+	if len(msgs) == 1 {
+		err, _ = msgs[0].(error)
+	}
+	responseNotFoundError(rw, req, cacheControlMaxAge, err, msgs...)
+}
+
+// responseNotFoundError is like [responseNotFound] but with the underlying err.
+func responseNotFoundError(rw http.ResponseWriter, req *http.Request, cacheControlMaxAge int, err error, msgs ...any) {
 	var msg string
 	if len(msgs) > 0 {
 		msg = strings.TrimPrefix(fmt.Sprint(msgs...), "bad request: ")
@@ -50,37 +120,85 @@ func responseNotFound(rw http.ResponseWriter, req *http.Request, cacheControlMax
 	if msg == "" {
 		msg = "not found"
 	}
-	responseString(rw, req, http.StatusNotFound, cacheControlMaxAge, msg)
+	responseErrorString(rw, req, http.StatusNotFound, cacheControlMaxAge, msg, err)
+}
+
+// responseBadRequest responses "bad request" to the client with the
+// cacheControlMaxAge and optional msgs.
+func responseBadRequest(rw http.ResponseWriter, req *http.Request, cacheControlMaxAge int, msgs ...any) {
+	msg := "bad request"
+	if len(msgs) > 0 {
+		msg += ": " + fmt.Sprint(msgs...)
+	}
+	responseErrorString(rw, req, http.StatusBadRequest, cacheControlMaxAge, msg, nil)
+}
+
+// responseForbidden responses "forbidden" to the client with the
+// cacheControlMaxAge and optional msgs.
+func responseForbidden(rw http.ResponseWriter, req *http.Request, cacheControlMaxAge int, msgs ...any) {
+	msg := "forbidden"
+	if len(msgs) > 0 {
+		msg += ": " + fmt.Sprint(msgs...)
+	}
+	responseErrorString(rw, req, http.StatusForbidden, cacheControlMaxAge, msg, nil)
+}
+
+// responseGone responses "gone" to the client with the cacheControlMaxAge and
+// optional msgs.
+func responseGone(rw http.ResponseWriter, req *http.Request, cacheControlMaxAge int, msgs ...any) {
+	msg := "gone"
+	if len(msgs) > 0 {
+		msg += ": " + fmt.Sprint(msgs...)
+	}
+	responseErrorString(rw, req, http.StatusGone, cacheControlMaxAge, msg, nil)
+}
+
+// responseRequestEntityTooLarge responses "request entity too large" to the
+// client with optional msgs.
+func responseRequestEntityTooLarge(rw http.ResponseWriter, req *http.Request, msgs ...any) {
+	msg := "request entity too large"
+	if len(msgs) > 0 {
+		msg += ": " + fmt.Sprint(msgs...)
+	}
+	responseErrorString(rw, req, http.StatusRequestEntityTooLarge, -1, msg, nil)
+}
+
+// responseTooManyRequests responses "too many requests" to the client with a
+// "Retry-After" header of the retryAfter seconds.
+func responseTooManyRequests(rw http.ResponseWriter, req *http.Request, retryAfter int) {
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	responseErrorString(rw, req, http.StatusTooManyRequests, -1, "too many requests", nil)
+}
+
+// responseServiceUnavailable responses "service unavailable" to the client
+// with a "Retry-After" header of the retryAfter seconds and the reason.
+func responseServiceUnavailable(rw http.ResponseWriter, req *http.Request, retryAfter int, reason string) {
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	responseErrorString(rw, req, http.StatusServiceUnavailable, -1, "service unavailable: "+reason, nil)
 }
 
 // responseMethodNotAllowed responses "method not allowed" to the client with
 // the cacheControlMaxAge.
 func responseMethodNotAllowed(rw http.ResponseWriter, req *http.Request, cacheControlMaxAge int) {
-	responseString(rw, req, http.StatusMethodNotAllowed, cacheControlMaxAge, "method not allowed")
+	responseErrorString(rw, req, http.StatusMethodNotAllowed, cacheControlMaxAge, "method not allowed", nil)
 }
 
 // responseInternalServerError responses "internal server error" to the client.
 func responseInternalServerError(rw http.ResponseWriter, req *http.Request) {
-	responseString(rw, req, http.StatusInternalServerError, -2, "internal server error")
+	responseErrorString(rw, req, http.StatusInternalServerError, -2, "internal server error", nil)
 }
 
 // responseSuccess responses success to the client with the content, contentType
 // , and cacheControlMaxAge.
 func responseSuccess(rw http.ResponseWriter, req *http.Request, content io.Reader, contentType string, cacheControlMaxAge int) {
 	rw.Header().Set("Content-Type", contentType)
-	setResponseCacheControlHeader(rw, cacheControlMaxAge)
-
-	var lastModified time.Time
-	if lm, ok := content.(interface{ LastModified() time.Time }); ok {
-		lastModified = lm.LastModified()
-	} else if mt, ok := content.(interface{ ModTime() time.Time }); ok {
-		lastModified = mt.ModTime()
-	}
+	setSuccessCacheControlHeader(rw, req, cacheControlMaxAge)
 
-	if et, ok := content.(interface{ ETag() string }); ok {
-		if etag := et.ETag(); etag != "" {
-			rw.Header().Set("ETag", etag)
-		}
+	// Validators that are unknown are omitted rather than sent as zero
+	// values, which would break the conditional requests of some caches.
+	lastModified := contentModTime(content)
+	if etag := contentETag(content); etag != "" {
+		rw.Header().Set("ETag", etag)
 	}
 
 	if content, ok := content.(io.ReadSeeker); ok {
@@ -91,15 +209,212 @@ func responseSuccess(rw http.ResponseWriter, req *http.Request, content io.Reade
 	if !lastModified.IsZero() {
 		rw.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
 	}
+	if s, ok := content.(Sizer); ok {
+		rw.Header().Set("Content-Length", strconv.FormatInt(s.Size(), 10))
+	}
 
 	rw.WriteHeader(http.StatusOK)
 	if req.Method != http.MethodHead {
-		io.Copy(rw, content)
+		if _, err := io.Copy(rw, content); err != nil {
+			// Without a Content-Length, simply returning here would
+			// end the response as if the content were complete.
+			// Aborting it instead makes sure that the client sees
+			// a failed response and retries.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// responsePartialContent responses the content as the bytes from the start to
+// the end of a content of the size to the client with the contentType and
+// cacheControlMaxAge. The validators of the response are taken from the meta
+// in the same way as [responseSuccess] does.
+func responsePartialContent(rw http.ResponseWriter, req *http.Request, content io.Reader, meta io.Reader, contentType string, cacheControlMaxAge int, start, end, size int64) {
+	rw.Header().Set("Content-Type", contentType)
+	setSuccessCacheControlHeader(rw, req, cacheControlMaxAge)
+	if etag := contentETag(meta); etag != "" {
+		rw.Header().Set("ETag", etag)
+	}
+	if lastModified := contentModTime(meta); !lastModified.IsZero() {
+		rw.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	rw.Header().Set("Accept-Ranges", "bytes")
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	rw.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	rw.WriteHeader(http.StatusPartialContent)
+	if req.Method != http.MethodHead {
+		io.CopyN(rw, content, end-start+1)
+	}
+}
+
+// parseSingleByteRange parses the s as a Range header with a single byte range
+// for a content of the size. It reports false if the s is not such a header or
+// the range is not satisfiable.
+func parseSingleByteRange(s string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimPrefix(s, "bytes="), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false
+		}
+		if n < end {
+			end = n
+		}
+	}
+	return start, end, true
+}
+
+// ifRangeMatches reports whether the ifRange, the value of an If-Range header,
+// matches the etag (using the strong comparison) or the lastModified.
+func ifRangeMatches(ifRange, etag string, lastModified time.Time) bool {
+	if strings.HasPrefix(ifRange, `"`) {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	if strings.HasPrefix(ifRange, "W/") || lastModified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && lastModified.Truncate(time.Second).Equal(t)
+}
+
+// digestTrailerName is the name of the HTTP trailer sent by a
+// [digestTrailerWriter].
+const digestTrailerName = "X-Goproxy-Content-SHA256"
+
+// digestTrailerWriter is an [http.ResponseWriter] that computes the SHA-256
+// hash of the response body while it is being written, and sends it in an
+// HTTP trailer once finished.
+type digestTrailerWriter struct {
+	http.ResponseWriter
+	hash       hash.Hash
+	statusCode int
+}
+
+// newDigestTrailerWriter returns a new [digestTrailerWriter] for the rw, which
+// declares its trailer immediately.
+func newDigestTrailerWriter(rw http.ResponseWriter) *digestTrailerWriter {
+	rw.Header().Add("Trailer", digestTrailerName)
+	return &digestTrailerWriter{ResponseWriter: rw, hash: sha256.New()}
+}
+
+// WriteHeader implements [http.ResponseWriter].
+func (dw *digestTrailerWriter) WriteHeader(statusCode int) {
+	if dw.statusCode == 0 {
+		dw.statusCode = statusCode
+		dw.Header().Del("Content-Length")
+	}
+	dw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements [http.ResponseWriter].
+func (dw *digestTrailerWriter) Write(b []byte) (int, error) {
+	if dw.statusCode == 0 {
+		dw.WriteHeader(http.StatusOK)
+	}
+	n, err := dw.ResponseWriter.Write(b)
+	dw.hash.Write(b[:n])
+	return n, err
+}
+
+// finish sends the trailer if the response is successful.
+func (dw *digestTrailerWriter) finish() {
+	switch dw.statusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		dw.Header().Set(digestTrailerName, hex.EncodeToString(dw.hash.Sum(nil)))
+	}
+}
+
+// countingResponseWriter is an [http.ResponseWriter] that counts the bytes of
+// the response body written through it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+// WriteHeader implements [http.ResponseWriter].
+func (cw *countingResponseWriter) WriteHeader(statusCode int) {
+	if cw.statusCode == 0 {
+		cw.statusCode = statusCode
+	}
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements [http.ResponseWriter].
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	if cw.statusCode == 0 {
+		cw.statusCode = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	cw.written += int64(n)
+	return n, err
+}
+
+// Flush implements [http.Flusher].
+func (cw *countingResponseWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		if cw.statusCode == 0 {
+			cw.statusCode = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// responseSyncError responses the err of an import of cache files in bulk (see
+// [Cacher.Sync]) to the client. Errors caused by the bundle being imported are
+// responded with the matching 4xx status, and the others with status 500.
+func responseSyncError(rw http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrTooManyFiles), errors.Is(err, ErrDecompressionBomb):
+		responseErrorString(rw, req, http.StatusRequestEntityTooLarge, -1, "request entity too large: "+err.Error(), err)
+	case errors.Is(err, ErrUnsupportedCompression):
+		responseErrorString(rw, req, http.StatusUnsupportedMediaType, -1, "unsupported media type: "+err.Error(), err)
+	case errors.Is(err, ErrSyncInProgress):
+		responseErrorString(rw, req, http.StatusConflict, -1, "conflict: "+err.Error(), err)
+	case errors.Is(err, ErrSyncQueueFull):
+		rw.Header().Set("Retry-After", "1")
+		responseErrorString(rw, req, http.StatusTooManyRequests, -1, "too many requests: "+err.Error(), err)
+	case errors.Is(err, ErrBadSignature),
+		errors.Is(err, ErrZipHashMismatch),
+		errors.Is(err, ErrPathTooDeep),
+		errors.Is(err, ErrDuplicateEntry),
+		errors.Is(err, ErrUnsafeSymlink):
+		responseErrorString(rw, req, http.StatusUnprocessableEntity, -1, "unprocessable entity: "+err.Error(), err)
+	case errors.Is(err, tar.ErrHeader),
+		errors.Is(err, gzip.ErrHeader),
+		errors.Is(err, gzip.ErrChecksum),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		responseErrorString(rw, req, http.StatusBadRequest, -1, "bad request: "+err.Error(), err)
+	default:
+		responseErrorString(rw, req, http.StatusInternalServerError, -2, "internal server error", err)
 	}
 }
 
 // responseError responses error to the client with the err and cacheSensitive.
 func responseError(rw http.ResponseWriter, req *http.Request, err error, cacheSensitive bool) {
+	setErrorReasonHeader(rw, req, err)
 	if errors.Is(err, fs.ErrNotExist) {
 		cacheControlMaxAge := -1
 		msg := err.Error()
@@ -115,14 +430,15 @@ func responseError(rw http.ResponseWriter, req *http.Request, err error, cacheSe
 		} else {
 			cacheControlMaxAge = 600
 		}
-		responseNotFound(rw, req, cacheControlMaxAge, msg)
+		responseNotFoundError(rw, req, cacheControlMaxAge, err, msg)
 	} else if errors.Is(err, errBadUpstream) {
-		responseNotFound(rw, req, -1, errBadUpstream)
-	} else if t, ok := err.(interface{ Timeout() bool }); (ok && t.Timeout()) ||
-		errors.Is(err, context.DeadlineExceeded) ||
-		errors.Is(err, errFetchTimedOut) {
-		responseNotFound(rw, req, -1, errFetchTimedOut)
+		responseNotFoundError(rw, req, -1, err, errBadUpstream)
+	} else if errors.Is(err, errFetchInProgress) {
+		rw.Header().Set("Retry-After", "1")
+		responseErrorString(rw, req, http.StatusServiceUnavailable, -1, "service unavailable: "+errFetchInProgress.Error(), err)
+	} else if isTimeoutError(err) {
+		responseNotFoundError(rw, req, -1, err, errFetchTimedOut)
 	} else {
-		responseInternalServerError(rw, req)
+		responseErrorString(rw, req, http.StatusInternalServerError, -2, "internal server error", err)
 	}
 }
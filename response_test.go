@@ -107,6 +107,141 @@ func TestResponseNotFound(t *testing.T) {
 	}
 }
 
+func TestResponseBadRequest(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		msgs        []any
+		wantContent string
+	}{
+		{1, nil, "bad request"},
+		{2, []any{"foobar"}, "bad request: foobar"},
+	} {
+		rec := httptest.NewRecorder()
+		responseBadRequest(rec, httptest.NewRequest("", "/", nil), 60, tt.msgs...)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusBadRequest; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestResponseForbidden(t *testing.T) {
+	for _, tt := range []struct {
+		n           int
+		msgs        []any
+		wantContent string
+	}{
+		{1, nil, "forbidden"},
+		{2, []any{"foobar"}, "forbidden: foobar"},
+	} {
+		rec := httptest.NewRecorder()
+		responseForbidden(rec, httptest.NewRequest("", "/", nil), 60, tt.msgs...)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, http.StatusForbidden; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestResponseGone(t *testing.T) {
+	rec := httptest.NewRecorder()
+	responseGone(rec, httptest.NewRequest("", "/", nil), 60, "foobar")
+	recr := rec.Result()
+	if got, want := recr.StatusCode, http.StatusGone; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "gone: foobar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResponseRequestEntityTooLarge(t *testing.T) {
+	rec := httptest.NewRecorder()
+	responseRequestEntityTooLarge(rec, httptest.NewRequest("", "/", nil), "foobar")
+	recr := rec.Result()
+	if got, want := recr.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := recr.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := recr.Header.Get("Cache-Control"), "must-revalidate, no-cache, no-store"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "request entity too large: foobar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResponseTooManyRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	responseTooManyRequests(rec, httptest.NewRequest("", "/", nil), 3)
+	recr := rec.Result()
+	if got, want := recr.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := recr.Header.Get("Retry-After"), "3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := recr.Header.Get("Cache-Control"), "must-revalidate, no-cache, no-store"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "too many requests"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResponseServiceUnavailable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	responseServiceUnavailable(rec, httptest.NewRequest("", "/", nil), 2, "foobar")
+	recr := rec.Result()
+	if got, want := recr.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := recr.Header.Get("Retry-After"), "2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := recr.Header.Get("Cache-Control"), "must-revalidate, no-cache, no-store"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "service unavailable: foobar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestResponseMethodNotAllowed(t *testing.T) {
 	rec := httptest.NewRecorder()
 	responseMethodNotAllowed(rec, httptest.NewRequest("", "/", nil), 60)
@@ -231,6 +366,32 @@ func TestResponseSuccess(t *testing.T) {
 			wantETag:         `"foobar"`,
 			wantContent:      "foobar",
 		},
+		{
+			n: 7,
+			content: struct {
+				io.Reader
+				successResponseBody_LastModified
+				successResponseBody_ETag
+			}{strings.NewReader("foobar"), successResponseBody_LastModified{}, successResponseBody_ETag{}},
+			wantContent: "foobar",
+		},
+		{
+			n: 8,
+			content: struct {
+				io.Reader
+				successResponseBody_ModTime
+			}{strings.NewReader("foobar"), successResponseBody_ModTime{modTime: time.Unix(0, 0)}},
+			wantContent: "foobar",
+		},
+		{
+			n: 9,
+			content: struct {
+				*strings.Reader
+				successResponseBody_LastModified
+				successResponseBody_ETag
+			}{strings.NewReader("foobar"), successResponseBody_LastModified{lastModified: time.Unix(0, 0)}, successResponseBody_ETag{}},
+			wantContent: "foobar",
+		},
 	} {
 		rec := httptest.NewRecorder()
 		responseSuccess(rec, httptest.NewRequest(tt.method, "/", nil), tt.content, "text/plain; charset=utf-8", 60)
@@ -258,6 +419,193 @@ func TestResponseSuccess(t *testing.T) {
 	}
 }
 
+func TestResponseSuccessIfRange(t *testing.T) {
+	modTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		n              int
+		content        io.Reader
+		ifRange        string
+		wantStatusCode int
+		wantContent    string
+	}{
+		{
+			n: 1,
+			content: struct {
+				*strings.Reader
+				successResponseBody_ETag
+			}{strings.NewReader("foobar"), successResponseBody_ETag{etag: `"foobar"`}},
+			ifRange:        `"foobar"`,
+			wantStatusCode: http.StatusPartialContent,
+			wantContent:    "foo",
+		},
+		{
+			n: 2,
+			content: struct {
+				*strings.Reader
+				successResponseBody_ETag
+			}{strings.NewReader("foobar"), successResponseBody_ETag{etag: `"foobar"`}},
+			ifRange:        `"stale"`,
+			wantStatusCode: http.StatusOK,
+			wantContent:    "foobar",
+		},
+		{
+			n: 3,
+			content: struct {
+				*strings.Reader
+				successResponseBody_ETag
+			}{strings.NewReader("foobar"), successResponseBody_ETag{etag: `W/"foobar"`}},
+			ifRange:        `W/"foobar"`,
+			wantStatusCode: http.StatusOK,
+			wantContent:    "foobar",
+		},
+		{
+			n: 4,
+			content: struct {
+				*strings.Reader
+				successResponseBody_LastModified
+			}{strings.NewReader("foobar"), successResponseBody_LastModified{lastModified: modTime}},
+			ifRange:        modTime.Format(http.TimeFormat),
+			wantStatusCode: http.StatusPartialContent,
+			wantContent:    "foo",
+		},
+		{
+			n: 5,
+			content: struct {
+				*strings.Reader
+				successResponseBody_LastModified
+			}{strings.NewReader("foobar"), successResponseBody_LastModified{lastModified: modTime}},
+			ifRange:        modTime.Add(-time.Hour).Format(http.TimeFormat),
+			wantStatusCode: http.StatusOK,
+			wantContent:    "foobar",
+		},
+		{
+			n:              6,
+			content:        strings.NewReader("foobar"),
+			ifRange:        `"foobar"`,
+			wantStatusCode: http.StatusOK,
+			wantContent:    "foobar",
+		},
+		{
+			n:              7,
+			content:        successResponseBody_ETag{Reader: strings.NewReader("foobar"), etag: `"foobar"`},
+			ifRange:        `"foobar"`,
+			wantStatusCode: http.StatusOK,
+			wantContent:    "foobar",
+		},
+	} {
+		req := httptest.NewRequest("", "/", nil)
+		req.Header.Set("Range", "bytes=0-2")
+		req.Header.Set("If-Range", tt.ifRange)
+		rec := httptest.NewRecorder()
+		responseSuccess(rec, req, tt.content, "text/plain; charset=utf-8", 60)
+		recr := rec.Result()
+		if got, want := recr.StatusCode, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if b, err := io.ReadAll(recr.Body); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got, want := string(b), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+func TestResponsePartialContent(t *testing.T) {
+	rec := httptest.NewRecorder()
+	meta := struct {
+		io.Reader
+		successResponseBody_LastModified
+		successResponseBody_ETag
+	}{strings.NewReader(""), successResponseBody_LastModified{lastModified: time.Unix(0, 0)}, successResponseBody_ETag{}}
+	responsePartialContent(rec, httptest.NewRequest("", "/", nil), strings.NewReader("2345"), meta, "text/plain; charset=utf-8", 60, 2, 5, 10)
+	recr := rec.Result()
+	for _, header := range []string{"Last-Modified", "ETag"} {
+		if _, ok := recr.Header[header]; ok {
+			t.Errorf("got %s header, want none", header)
+		}
+	}
+	if got, want := recr.StatusCode, http.StatusPartialContent; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := recr.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := recr.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := recr.Header.Get("Content-Range"), "bytes 2-5/10"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := recr.Header.Get("Content-Length"), "4"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b, err := io.ReadAll(recr.Body); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), "2345"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseSingleByteRange(t *testing.T) {
+	for _, tt := range []struct {
+		n         int
+		s         string
+		size      int64
+		wantStart int64
+		wantEnd   int64
+		wantOK    bool
+	}{
+		{1, "bytes=0-4", 10, 0, 4, true},
+		{2, "bytes=5-", 10, 5, 9, true},
+		{3, "bytes=-3", 10, 7, 9, true},
+		{4, "bytes=-20", 10, 0, 9, true},
+		{5, "bytes=8-20", 10, 8, 9, true},
+		{6, "bytes=10-", 10, 0, 0, false},
+		{7, "bytes=5-4", 10, 0, 0, false},
+		{8, "bytes=-0", 10, 0, 0, false},
+		{9, "bytes=0-1,3-4", 10, 0, 0, false},
+		{10, "items=0-4", 10, 0, 0, false},
+		{11, "bytes=a-b", 10, 0, 0, false},
+		{12, "bytes=-1", 0, 0, 0, false},
+	} {
+		start, end, ok := parseSingleByteRange(tt.s, tt.size)
+		if got, want := ok, tt.wantOK; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+		if got, want := start, tt.wantStart; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := end, tt.wantEnd; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lastModified := time.Date(2000, 1, 1, 0, 0, 0, 500, time.UTC)
+	for _, tt := range []struct {
+		n            int
+		ifRange      string
+		etag         string
+		lastModified time.Time
+		want         bool
+	}{
+		{1, `"foo"`, `"foo"`, time.Time{}, true},
+		{2, `"foo"`, `"bar"`, time.Time{}, false},
+		{3, `"foo"`, `W/"foo"`, time.Time{}, false},
+		{4, `W/"foo"`, `W/"foo"`, time.Time{}, false},
+		{5, `"foo"`, "", lastModified, false},
+		{6, lastModified.Format(http.TimeFormat), "", lastModified, true},
+		{7, lastModified.Add(time.Second).Format(http.TimeFormat), "", lastModified, false},
+		{8, lastModified.Format(http.TimeFormat), "", time.Time{}, false},
+		{9, "foobar", "", lastModified, false},
+	} {
+		if got, want := ifRangeMatches(tt.ifRange, tt.etag, tt.lastModified), tt.want; got != want {
+			t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+		}
+	}
+}
+
 func TestResponseError(t *testing.T) {
 	for _, tt := range []struct {
 		n                int
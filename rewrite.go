@@ -0,0 +1,163 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+)
+
+// rewritingFetcher is a [Fetcher] that fetches the module paths rewritten by
+// the rewrite from another [Fetcher] (see [Goproxy.RewritePath]).
+type rewritingFetcher struct {
+	Fetcher
+	rewrite func(path string) (string, error)
+	tempDir string
+}
+
+// Query implements [Fetcher].
+func (rf *rewritingFetcher) Query(ctx context.Context, path, query string) (version string, t time.Time, err error) {
+	realPath, err := rf.rewrite(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return rf.Fetcher.Query(ctx, realPath, query)
+}
+
+// List implements [Fetcher].
+func (rf *rewritingFetcher) List(ctx context.Context, path string) (versions []string, err error) {
+	realPath, err := rf.rewrite(path)
+	if err != nil {
+		return nil, err
+	}
+	return rf.Fetcher.List(ctx, realPath)
+}
+
+// Download implements [Fetcher]. The module directives of the .mod file and
+// the go.mod file in the .zip file, as well as the file paths in the .zip
+// file, are rewritten from the real module path to the path.
+func (rf *rewritingFetcher) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	realPath, err := rf.rewrite(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, mod, zip, err = rf.Fetcher.Download(ctx, realPath, version)
+	if err != nil || realPath == path {
+		return
+	}
+	modBytes, err := io.ReadAll(mod)
+	mod.Close()
+	if err == nil {
+		modBytes, err = rewriteModuleDirective(modBytes, path)
+	}
+	var zipFile *os.File
+	if err == nil {
+		zipFile, err = rewriteModuleZip(zip, rf.tempDir, realPath+"@"+version+"/", path+"@"+version+"/", modBytes)
+	}
+	zip.Close()
+	if err != nil {
+		info.Close()
+		return nil, nil, nil, err
+	}
+	mod = struct {
+		io.ReadSeeker
+		io.Closer
+	}{bytes.NewReader(modBytes), closerFunc(func() error { return nil })}
+	zip = struct {
+		io.ReadSeeker
+		io.Closer
+	}{zipFile, closerFunc(func() error {
+		defer os.Remove(zipFile.Name())
+		return zipFile.Close()
+	})}
+	return info, mod, zip, nil
+}
+
+// rewriteModuleDirective returns the mod with its module directive replaced
+// with one declaring the modulePath. A module directive is added if the mod
+// has none.
+func rewriteModuleDirective(mod []byte, modulePath string) ([]byte, error) {
+	f, err := modfile.ParseLax("go.mod", mod, nil)
+	if err != nil {
+		return nil, notExistErrorf("invalid go.mod file: %w", err)
+	}
+	if f.Module == nil {
+		return append([]byte("module "+modfile.AutoQuote(modulePath)+"\n"), mod...), nil
+	}
+	directive := "module " + modfile.AutoQuote(modulePath)
+	if f.Module.Syntax.InBlock {
+		directive = modfile.AutoQuote(modulePath)
+	}
+	start, end := f.Module.Syntax.Start.Byte, f.Module.Syntax.End.Byte
+	rewritten := make([]byte, 0, len(mod)-(end-start)+len(directive))
+	rewritten = append(rewritten, mod[:start]...)
+	rewritten = append(rewritten, directive...)
+	return append(rewritten, mod[end:]...), nil
+}
+
+// rewriteModuleZip copies the module zip file to a new temporary file in the
+// tempDir, replacing the fromPrefix of its file paths with the toPrefix and
+// the content of its go.mod file, if any, with the mod. The returned file is
+// positioned at its start.
+func rewriteModuleZip(zipContent io.ReadSeeker, tempDir, fromPrefix, toPrefix string, mod []byte) (_ *os.File, err error) {
+	size, err := zipContent.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(&readSeekerAt{rs: zipContent}, size)
+	if err != nil {
+		return nil, notExistErrorf("invalid zip file: %w", err)
+	}
+	f, err := os.CreateTemp(tempDir, tempDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	zw := zip.NewWriter(f)
+	for _, zf := range zr.File {
+		if !strings.HasPrefix(zf.Name, fromPrefix) {
+			return nil, notExistErrorf("invalid zip file: unexpected file path %q", zf.Name)
+		}
+		name := toPrefix + strings.TrimPrefix(zf.Name, fromPrefix)
+		if name == toPrefix+"go.mod" {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: zf.Modified})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(mod); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fh := zf.FileHeader
+		fh.Name = name
+		w, err := zw.CreateRaw(&fh)
+		if err != nil {
+			return nil, err
+		}
+		r, err := zf.OpenRaw()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
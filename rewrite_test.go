@@ -0,0 +1,173 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestGoproxyRewritePath(t *testing.T) {
+	realZip, err := makeZip(map[string][]byte{
+		"github.com/corp/foo-internal@v1.0.0/go.mod":   []byte("// Package foo.\nmodule github.com/corp/foo-internal // real\n\ngo 1.18\n"),
+		"github.com/corp/foo-internal@v1.0.0/foo.go":   []byte("package foo"),
+		"github.com/corp/foo-internal@v1.0.0/bar/b.go": []byte("package bar"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var (
+		mu      sync.Mutex
+		fetches []string
+	)
+	dc := &DirCacher{Dir: t.TempDir()}
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			list: func(ctx context.Context, path string) ([]string, error) {
+				mu.Lock()
+				fetches = append(fetches, "list "+path)
+				mu.Unlock()
+				return []string{"v1.0.0"}, nil
+			},
+			download: func(ctx context.Context, path, version string) (info, mod, zipContent io.ReadSeekCloser, err error) {
+				mu.Lock()
+				fetches = append(fetches, "download "+path+"@"+version)
+				mu.Unlock()
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))),
+					nopReadSeekCloser("// Package foo.\nmodule github.com/corp/foo-internal // real\n\ngo 1.18\n"),
+					nopReadSeekCloser(string(realZip)), nil
+			},
+		},
+		RewritePath: func(path string) (string, error) {
+			switch {
+			case path == "go.corp/foo":
+				return "github.com/corp/foo-internal", nil
+			case strings.HasPrefix(path, "go.corp/"):
+				return "", notExistErrorf("%s: unknown vanity module path", path)
+			}
+			return path, nil
+		},
+		Cacher:      dc,
+		TempDir:     t.TempDir(),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+
+	wantMod := "// Package foo.\nmodule go.corp/foo // real\n\ngo 1.18\n"
+	for _, tt := range []struct {
+		n              int
+		path           string
+		wantStatusCode int
+		wantContent    string
+	}{
+		{1, "/go.corp/foo/@v/v1.0.0.mod", http.StatusOK, wantMod},
+		{2, "/go.corp/foo/@v/list", http.StatusOK, "v1.0.0"},
+		{3, "/go.corp/bar/@v/v1.0.0.mod", http.StatusNotFound, "not found: go.corp/bar: unknown vanity module path"},
+	} {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("", tt.path, nil))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+	if got, want := strings.Join(fetches, ","), "download github.com/corp/foo-internal@v1.0.0,list github.com/corp/foo-internal"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	rc, err := dc.Get(context.Background(), "go.corp/foo/@v/v1.0.0.zip")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipBytes, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipFile := filepath.Join(t.TempDir(), "zip")
+	if err := os.WriteFile(zipFile, zipBytes, 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := modzip.CheckZip(module.Version{Path: "go.corp/foo", Version: "v1.0.0"}, zipFile); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var names []string
+	for _, zf := range zr.File {
+		names = append(names, zf.Name)
+		if zf.Name != "go.corp/foo@v1.0.0/go.mod" {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if got, want := string(b), wantMod; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, ","), "go.corp/foo@v1.0.0/bar/b.go,go.corp/foo@v1.0.0/foo.go,go.corp/foo@v1.0.0/go.mod"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if entries, err := os.ReadDir(g.TempDir); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got := len(entries); got != 0 {
+		t.Errorf("got %d temporary files, want 0", got)
+	}
+}
+
+func TestRewriteModuleDirective(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		mod     string
+		wantMod string
+		wantErr error
+	}{
+		{1, "module example.com/real\n", "module go.corp/foo\n", nil},
+		{2, "module \"example.com/real\" // comment\n\ngo 1.18\n", "module go.corp/foo // comment\n\ngo 1.18\n", nil},
+		{3, "module (\n\texample.com/real\n)\n", "module (\n\tgo.corp/foo\n)\n", nil},
+		{4, "go 1.18\n", "module go.corp/foo\ngo 1.18\n", nil},
+		{5, "module (\n", "", errors.New("invalid go.mod file: go.mod:2: syntax error (unterminated block started at go.mod:1:1)")},
+	} {
+		mod, err := rewriteModuleDirective([]byte(tt.mod), "go.corp/foo")
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if got, want := string(mod), tt.wantMod; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+	}
+}
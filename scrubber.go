@@ -0,0 +1,421 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// ScrubberOptions is the options for [Goproxy.StartScrubber].
+type ScrubberOptions struct {
+	// Rate is the maximum number of cached .zip files checked per second,
+	// so that the scrubber does not noticeably interfere with serving.
+	//
+	// If Rate is zero or negative, 1 is used.
+	Rate float64
+
+	// ByteRate is the maximum number of bytes of cached files read per
+	// second.
+	//
+	// If ByteRate is zero, 1 MiB is used. If it is negative, the bytes read
+	// are not limited.
+	ByteRate float64
+
+	// Concurrency is the maximum number of cached .zip files checked
+	// concurrently.
+	//
+	// If Concurrency is zero or negative, 1 is used.
+	Concurrency int
+
+	// Interval is the time to wait after each full pass over the cache
+	// before starting the next one.
+	//
+	// If Interval is zero, 24 hours is used.
+	Interval time.Duration
+
+	// Quarantine is where corrupt caches are put, under the same names,
+	// before they are deleted from the [Goproxy.Cacher], so that they can
+	// be inspected later.
+	//
+	// If Quarantine is nil, corrupt caches are deleted without being kept.
+	Quarantine Cacher
+
+	// OnCorrupt is called with the name of the .zip cache and the error
+	// describing the corruption for each corrupt cache found, after it has
+	// been quarantined. It may be called concurrently if Concurrency is
+	// greater than 1.
+	OnCorrupt func(name string, err error)
+}
+
+// StartScrubber starts a goroutine that walks the g.Cacher slowly (see
+// [ScrubberOptions.Rate], [ScrubberOptions.ByteRate], and
+// [ScrubberOptions.Concurrency]) and repeatedly, checking the integrity of every
+// cached .zip file. A .zip file is corrupt if it is not a valid module zip
+// file, or if its "h1:" hash no longer matches its cached .ziphash file.
+// Note that bit rot in a .zip file without a cached .ziphash file is caught
+// only if it breaks the zip format (see [Goproxy.ServeZipHashes]).
+//
+// Corrupt .zip files and their .ziphash files are quarantined (see
+// [ScrubberOptions.Quarantine]) and deleted, so that they are fetched again
+// on demand. Caches are deleted only if the g.Cacher implements [Deleter].
+// Corrupt caches and errors are also logged to the g.ErrorLogger.
+//
+// The g.Cacher must implement [Lister]. Otherwise, the scrubber logs an error
+// and stops immediately.
+//
+// The scrubber runs until the ctx is done or the returned function is called.
+// The returned function waits for the scrubber to stop.
+func (g *Goproxy) StartScrubber(ctx context.Context, opts ScrubberOptions) (stop func()) {
+	g.initOnce.Do(g.init)
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.scrub(ctx, opts)
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// scrub runs the scrubber with the opts until the ctx is done.
+func (g *Goproxy) scrub(ctx context.Context, opts ScrubberOptions) {
+	lister, ok := g.Cacher.(Lister)
+	if !ok {
+		g.logErrorf("failed to start cache scrubber: cacher does not support listing")
+		return
+	}
+	rate := opts.Rate
+	if rate <= 0 {
+		rate = 1
+	}
+	byteRate := opts.ByteRate
+	if byteRate == 0 {
+		byteRate = 1 << 20
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	interval := opts.Interval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	throttle := newVerifyThrottle(concurrency, rate, byteRate)
+	for {
+		names, err := lister.List(ctx, "")
+		if err != nil && ctx.Err() == nil {
+			g.logErrorf("failed to list caches for scrubbing: %v", err)
+		}
+		if err := g.verifyZipCaches(ctx, names, throttle, func(name string, corruptErr, err error) {
+			if err != nil {
+				if ctx.Err() == nil {
+					g.logErrorf("failed to scrub module file: %s: %v", name, err)
+				}
+				return
+			}
+			if corruptErr == nil {
+				return
+			}
+			g.logErrorf("found corrupt module file: %s: %v", name, corruptErr)
+			if err := g.quarantineZipCache(ctx, name, opts.Quarantine); err != nil {
+				g.logErrorf("failed to quarantine module file: %s: %v", name, err)
+			}
+			if opts.OnCorrupt != nil {
+				opts.OnCorrupt(name, corruptErr)
+			}
+		}); err != nil {
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// VerifyCacheOptions is the options for [Goproxy.VerifyCache].
+type VerifyCacheOptions struct {
+	// Concurrency is the maximum number of cached .zip files checked
+	// concurrently.
+	//
+	// If Concurrency is zero or negative, 4 is used.
+	Concurrency int
+
+	// Rate is the maximum number of cached .zip files checked per second.
+	//
+	// If Rate is zero or negative, it is not limited.
+	Rate float64
+
+	// ByteRate is the maximum number of bytes of cached files read per
+	// second.
+	//
+	// If ByteRate is zero or negative, it is not limited.
+	ByteRate float64
+}
+
+// VerifyCacheReport is the result of verifying caches (see
+// [Goproxy.VerifyCache]).
+type VerifyCacheReport struct {
+	// Checked is the number of cached .zip files that have been checked,
+	// including the corrupt ones.
+	Checked int
+
+	// Corrupt is the cached .zip files that have been found corrupt,
+	// sorted by name.
+	Corrupt []CacheProblem
+
+	// Failed is the cached .zip files that could not be checked, sorted by
+	// name.
+	Failed []CacheProblem
+}
+
+// CacheProblem is a cached file in a [VerifyCacheReport].
+type CacheProblem struct {
+	// Name is the name of the cache.
+	Name string
+
+	// Err is the error describing the corruption of the cache, or why it
+	// could not be checked.
+	Err error
+}
+
+// VerifyCache checks the integrity of every cached .zip file in the g.Cacher
+// once, in the same way as [Goproxy.StartScrubber], but without quarantining
+// or deleting anything. The checks run concurrently and may be throttled (see
+// [VerifyCacheOptions]), so that a run does not saturate the IO of a cache
+// that is being served from.
+//
+// The returned error is non-nil only if the g.Cacher is nil or does not
+// implement [Lister], if listing caches fails, or if the ctx is done before
+// all caches have been checked, in which case the report covers the caches
+// checked so far.
+func (g *Goproxy) VerifyCache(ctx context.Context, opts VerifyCacheOptions) (VerifyCacheReport, error) {
+	g.initOnce.Do(g.init)
+	var report VerifyCacheReport
+	if g.Cacher == nil {
+		return report, errors.New("cacher is not set")
+	}
+	lister, ok := g.Cacher.(Lister)
+	if !ok {
+		return report, errors.New("cacher does not support listing")
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	names, err := lister.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	var mu sync.Mutex
+	err = g.verifyZipCaches(ctx, names, newVerifyThrottle(concurrency, opts.Rate, opts.ByteRate), func(name string, corruptErr, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				report.Failed = append(report.Failed, CacheProblem{Name: name, Err: err})
+			}
+		case corruptErr != nil:
+			report.Checked++
+			report.Corrupt = append(report.Corrupt, CacheProblem{Name: name, Err: corruptErr})
+		default:
+			report.Checked++
+		}
+	})
+	sort.Slice(report.Corrupt, func(i, j int) bool { return report.Corrupt[i].Name < report.Corrupt[j].Name })
+	sort.Slice(report.Failed, func(i, j int) bool { return report.Failed[i].Name < report.Failed[j].Name })
+	return report, err
+}
+
+// verifyZipCaches checks the integrity of the cached .zip files among the
+// names (see [Goproxy.scrubZipCache]) with the concurrency and the IO rate
+// bounded by the throttle, calling the done with the result of each check,
+// possibly concurrently. It waits for all started checks to return, and
+// returns the ctx.Err if the ctx is done before all caches have been checked.
+func (g *Goproxy) verifyZipCaches(ctx context.Context, names []string, throttle *verifyThrottle, done func(name string, corruptErr, err error)) error {
+	var wg sync.WaitGroup
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".zip") || !strings.Contains(name, "/@v/") {
+			continue
+		}
+		release, err := throttle.acquire(ctx)
+		if err != nil {
+			break // The ctx is done.
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer release()
+			corruptErr, err := g.scrubZipCache(ctx, name, throttle)
+			done(name, corruptErr, err)
+		}(name)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// verifyThrottle bounds the concurrency and the IO rate of cache verification
+// (see [Goproxy.VerifyCache] and [Goproxy.StartScrubber]).
+type verifyThrottle struct {
+	workerPool chan struct{}
+	files      *rateLimiter
+	bytes      *rateLimiter
+}
+
+// newVerifyThrottle returns a new [verifyThrottle] that allows up to the
+// concurrency checks at a time, the fileRate checks per second, and the
+// byteRate bytes read per second. Rates that are zero or negative are not
+// limited.
+func newVerifyThrottle(concurrency int, fileRate, byteRate float64) *verifyThrottle {
+	vt := &verifyThrottle{workerPool: make(chan struct{}, concurrency)}
+	if fileRate > 0 {
+		vt.files = newRateLimiter(fileRate, 1)
+	}
+	if byteRate > 0 {
+		vt.bytes = newRateLimiter(byteRate, 0)
+	}
+	return vt
+}
+
+// acquire waits until a check is allowed by the vt, or until the ctx is done.
+// The returned release must be called once the check has returned.
+func (vt *verifyThrottle) acquire(ctx context.Context) (release func(), err error) {
+	release, err = acquireWorker(ctx, vt.workerPool)
+	if err != nil {
+		return nil, err
+	}
+	if err := vt.files.wait(ctx, 1); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// reader returns a reader of the r whose reads are throttled by the vt until
+// the ctx is done.
+func (vt *verifyThrottle) reader(ctx context.Context, r io.Reader) io.Reader {
+	if vt.bytes == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, rl: vt.bytes}
+}
+
+// throttledReader is a reader returned by [verifyThrottle.reader].
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	rl  *rateLimiter
+}
+
+// Read implements [io.Reader].
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if waitErr := tr.rl.wait(tr.ctx, float64(n)); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// scrubZipCache checks the integrity of the cached .zip file for the name,
+// reading the caches through the throttle. It returns a non-nil corruptErr if
+// the cache is corrupt, or a non-nil err if the cache cannot be checked.
+// Caches that no longer exist are not corrupt.
+func (g *Goproxy) scrubZipCache(ctx context.Context, name string, throttle *verifyThrottle) (corruptErr, err error) {
+	content, err := g.Cacher.Get(ctx, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer content.Close()
+	f, err := os.CreateTemp(g.TempDir, tempDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, throttle.reader(ctx, content)); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	zipHash, err := dirhash.HashZip(f.Name(), dirhash.DefaultHash)
+	if err != nil {
+		return fmt.Errorf("invalid zip file: %w", err), nil
+	}
+
+	zipHashContent, err := g.Cacher.Get(ctx, strings.TrimSuffix(name, ".zip")+".ziphash")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer zipHashContent.Close()
+	b, err := io.ReadAll(throttle.reader(ctx, zipHashContent))
+	if err != nil {
+		return nil, err
+	}
+	if want := strings.TrimSpace(string(b)); zipHash != want {
+		return fmt.Errorf("zip hash mismatch: got %s, want %s", zipHash, want), nil
+	}
+	return nil, nil
+}
+
+// quarantineZipCache puts the cached .zip file for the name and its .ziphash
+// file to the quarantine, if any, and then deletes them from the g.Cacher if it
+// implements [Deleter].
+func (g *Goproxy) quarantineZipCache(ctx context.Context, name string, quarantine Cacher) error {
+	names := []string{name, strings.TrimSuffix(name, ".zip") + ".ziphash"}
+	if quarantine != nil {
+		cb := g.contentBuffer()
+		for _, name := range names {
+			content, err := g.Cacher.Get(ctx, name)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			rs, release, err := cb.buffer(content)
+			content.Close()
+			if err != nil {
+				return err
+			}
+			err = quarantine.Put(ctx, name, rs)
+			release()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	deleter, ok := g.Cacher.(Deleter)
+	if !ok {
+		return errors.New("cacher does not support deleting")
+	}
+	for _, name := range names {
+		if err := deleter.Delete(ctx, name); err != nil {
+			return err
+		}
+		g.auditCacheMutation(ctx, AuditEvent{Operation: "delete", Name: name})
+	}
+	return nil
+}
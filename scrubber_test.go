@@ -0,0 +1,286 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+func TestGoproxyStartScrubber(t *testing.T) {
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHash := mustHashZip(t, zip)
+	otherZip, err := makeZip(map[string][]byte{"example.com@v1.1.0/go.mod": []byte("module example.com // tampered")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	dc := &DirCacher{Dir: t.TempDir()}
+	quarantine := &DirCacher{Dir: t.TempDir()}
+	for name, content := range map[string]string{
+		"example.com/@v/v1.0.0.zip":     string(zip),
+		"example.com/@v/v1.0.0.ziphash": zipHash,
+		"example.com/@v/v1.1.0.zip":     string(otherZip),
+		"example.com/@v/v1.1.0.ziphash": zipHash,
+		"example.com/@v/v1.2.0.zip":     "not a zip file",
+		"example.com/@v/v1.2.0.mod":     "module example.com",
+	} {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	g := &Goproxy{Cacher: dc, TempDir: t.TempDir(), ErrorLogger: log.New(io.Discard, "", 0)}
+
+	var (
+		mu      sync.Mutex
+		corrupt []string
+		done    = make(chan struct{})
+	)
+	stop := g.StartScrubber(context.Background(), ScrubberOptions{
+		Rate:       1000,
+		Interval:   time.Hour,
+		Quarantine: quarantine,
+		OnCorrupt: func(name string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			corrupt = append(corrupt, name+": "+err.Error())
+			if len(corrupt) == 2 {
+				close(done)
+			}
+		},
+	})
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for corrupt caches")
+	}
+	stop()
+
+	sort.Strings(corrupt)
+	if got, want := strings.Join(corrupt, "\n"), strings.Join([]string{
+		"example.com/@v/v1.1.0.zip: zip hash mismatch: got " + mustHashZip(t, otherZip) + ", want " + zipHash,
+		"example.com/@v/v1.2.0.zip: invalid zip file: zip: not a valid zip file",
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, tt := range []struct {
+		n          int
+		cacher     Cacher
+		name       string
+		wantExists bool
+	}{
+		{1, dc, "example.com/@v/v1.0.0.zip", true},
+		{2, dc, "example.com/@v/v1.0.0.ziphash", true},
+		{3, dc, "example.com/@v/v1.1.0.zip", false},
+		{4, dc, "example.com/@v/v1.1.0.ziphash", false},
+		{5, dc, "example.com/@v/v1.2.0.zip", false},
+		{6, dc, "example.com/@v/v1.2.0.mod", true},
+		{7, quarantine, "example.com/@v/v1.0.0.zip", false},
+		{8, quarantine, "example.com/@v/v1.1.0.zip", true},
+		{9, quarantine, "example.com/@v/v1.1.0.ziphash", true},
+		{10, quarantine, "example.com/@v/v1.2.0.zip", true},
+	} {
+		rc, err := tt.cacher.Get(context.Background(), tt.name)
+		if err == nil {
+			rc.Close()
+		}
+		if tt.wantExists {
+			if err != nil {
+				t.Errorf("test(%d): unexpected error %q", tt.n, err)
+			}
+		} else if got, want := err, fs.ErrNotExist; !compareErrors(got, want) {
+			t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+		}
+	}
+
+	var logBuf strings.Builder
+	g = &Goproxy{Cacher: &testCacher{Cacher: dc}, ErrorLogger: log.New(&logBuf, "", 0)}
+	g.StartScrubber(context.Background(), ScrubberOptions{})()
+	if got, want := logBuf.String(), "goproxy: failed to start cache scrubber: cacher does not support listing\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoproxyVerifyCache(t *testing.T) {
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHash := mustHashZip(t, zip)
+
+	dc := &DirCacher{Dir: t.TempDir()}
+	for name, content := range map[string]string{
+		"example.com/@v/v1.0.0.zip":     string(zip),
+		"example.com/@v/v1.0.0.ziphash": zipHash,
+		"example.com/@v/v1.1.0.zip":     string(zip),
+		"example.com/@v/v1.1.0.ziphash": "h1:bad",
+		"example.com/@v/v1.2.0.zip":     "not a zip file",
+		"example.com/@v/v1.3.0.zip":     string(zip),
+		"example.com/@v/v1.3.0.mod":     "module example.com",
+	} {
+		if err := dc.Put(context.Background(), name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	g := &Goproxy{
+		Cacher: &testListCacher{testCacher{
+			Cacher: dc,
+			get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+				if name == "example.com/@v/v1.3.0.zip" {
+					return nil, errors.New("disk error")
+				}
+				return c.Get(ctx, name)
+			},
+		}},
+		TempDir: t.TempDir(),
+	}
+	report, err := g.VerifyCache(context.Background(), VerifyCacheOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := report.Checked, 3; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	var corrupt, failed []string
+	for _, p := range report.Corrupt {
+		corrupt = append(corrupt, p.Name+": "+p.Err.Error())
+	}
+	for _, p := range report.Failed {
+		failed = append(failed, p.Name+": "+p.Err.Error())
+	}
+	if got, want := strings.Join(corrupt, "\n"), strings.Join([]string{
+		"example.com/@v/v1.1.0.zip: zip hash mismatch: got " + zipHash + ", want h1:bad",
+		"example.com/@v/v1.2.0.zip: invalid zip file: zip: not a valid zip file",
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(failed, "\n"), "example.com/@v/v1.3.0.zip: disk error"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, name := range []string{"example.com/@v/v1.1.0.zip", "example.com/@v/v1.2.0.zip"} {
+		if rc, err := dc.Get(context.Background(), name); err != nil {
+			t.Errorf("unexpected error %q", err)
+		} else {
+			rc.Close()
+		}
+	}
+
+	for _, tt := range []struct {
+		n       int
+		g       *Goproxy
+		wantErr string
+	}{
+		{1, &Goproxy{}, "cacher is not set"},
+		{2, &Goproxy{Cacher: &testCacher{Cacher: dc}}, "cacher does not support listing"},
+	} {
+		if _, err := tt.g.VerifyCache(context.Background(), VerifyCacheOptions{}); err == nil {
+			t.Fatalf("test(%d): expected error", tt.n)
+		} else if got, want := err.Error(), tt.wantErr; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (&Goproxy{Cacher: dc}).VerifyCache(ctx, VerifyCacheOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestGoproxyVerifyCacheThrottle(t *testing.T) {
+	dc := &DirCacher{Dir: t.TempDir()}
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("example.com/@v/v1.%d.0.zip", i)
+		if err := dc.Put(context.Background(), name, strings.NewReader(strings.Repeat("x", 1000))); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	for _, tt := range []struct {
+		n                  int
+		opts               VerifyCacheOptions
+		wantMinDuration    time.Duration
+		wantMaxConcurrency int
+	}{
+		{1, VerifyCacheOptions{Concurrency: 2}, 0, 2},
+		{2, VerifyCacheOptions{Concurrency: 1}, 0, 1},
+		{3, VerifyCacheOptions{Concurrency: 6, Rate: 20}, 250 * time.Millisecond, 6},
+		{4, VerifyCacheOptions{Concurrency: 6, ByteRate: 4000}, 400 * time.Millisecond, 6},
+	} {
+		var (
+			mu             sync.Mutex
+			concurrency    int
+			maxConcurrency int
+		)
+		g := &Goproxy{
+			Cacher: &testListCacher{testCacher{
+				Cacher: dc,
+				get: func(ctx context.Context, c Cacher, name string) (io.ReadCloser, error) {
+					if strings.HasSuffix(name, ".ziphash") {
+						return c.Get(ctx, name)
+					}
+					mu.Lock()
+					concurrency++
+					if concurrency > maxConcurrency {
+						maxConcurrency = concurrency
+					}
+					mu.Unlock()
+					time.Sleep(10 * time.Millisecond)
+					mu.Lock()
+					concurrency--
+					mu.Unlock()
+					return c.Get(ctx, name)
+				},
+			}},
+			TempDir: t.TempDir(),
+		}
+		start := time.Now()
+		report, err := g.VerifyCache(context.Background(), tt.opts)
+		if err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		}
+		if got, want := time.Since(start), tt.wantMinDuration; got < want {
+			t.Errorf("test(%d): got %v, want at least %v", tt.n, got, want)
+		}
+		if got, want := maxConcurrency, tt.wantMaxConcurrency; got > want {
+			t.Errorf("test(%d): got %d, want at most %d", tt.n, got, want)
+		}
+		if got, want := report.Checked, 6; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+	}
+}
+
+type testListCacher struct {
+	testCacher
+}
+
+func (c *testListCacher) List(ctx context.Context, prefix string) ([]string, error) {
+	return c.Cacher.(Lister).List(ctx, prefix)
+}
+
+func mustHashZip(t *testing.T, zip []byte) string {
+	t.Helper()
+	zipFile := filepath.Join(t.TempDir(), "zip")
+	if err := os.WriteFile(zipFile, zip, 0o644); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHash, err := dirhash.HashZip(zipFile, dirhash.DefaultHash)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	return zipHash
+}
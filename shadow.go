@@ -0,0 +1,173 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+)
+
+// ShadowMismatch is a discrepancy between a module file downloaded by the
+// [Goproxy.Fetcher] and the same one downloaded by the
+// [Goproxy.ShadowFetcher].
+type ShadowMismatch struct {
+	// Name is the cache name of the module file (e.g.,
+	// "example.com/@v/v1.0.0.zip").
+	Name string
+
+	// SHA256 is the hex-encoded SHA-256 hash of the module file downloaded
+	// by the [Goproxy.Fetcher].
+	SHA256 string
+
+	// ShadowSHA256 is the hex-encoded SHA-256 hash of the module file
+	// downloaded by the [Goproxy.ShadowFetcher]. It is empty if ShadowErr
+	// is not nil.
+	ShadowSHA256 string
+
+	// ShadowErr is the error that occurred while downloading the module
+	// file from the [Goproxy.ShadowFetcher]. It matches [fs.ErrNotExist]
+	// if the ShadowFetcher does not have the module version.
+	ShadowErr error
+}
+
+// sampleShadowFetch reports whether a download should be shadowed by the
+// g.ShadowFetcher as per the g.ShadowSampleRate.
+func (g *Goproxy) sampleShadowFetch() bool {
+	return g.shadowFetcher != nil && g.ShadowSampleRate > 0 && sample(g.ShadowSampleRate)
+}
+
+// sample reports whether to sample an event with the rate, which is the
+// probability in the range [0, 1].
+func sample(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	backoffRandMutex.Lock()
+	defer backoffRandMutex.Unlock()
+	return backoffRand.Float64() < rate
+}
+
+// startShadowFetch arranges for the mod and zip downloaded by the g.fetcher for
+// the modulePath and moduleVersion to be compared with those downloaded again
+// from the g.ShadowFetcher, reporting the ones that differ to the
+// g.OnShadowMismatch. It returns the mod and zip to be used instead of the
+// given ones. Once both of them are closed, the given ones are handed over to
+// a background fetch (see [Goproxy.startBackgroundFetch]), which hashes and
+// closes them before downloading from the g.ShadowFetcher, so that the shadow
+// fetch never delays the request.
+func (g *Goproxy) startShadowFetch(modulePath, moduleVersion string, mod, zip io.ReadSeekCloser) (io.ReadSeekCloser, io.ReadSeekCloser) {
+	var names [2]string
+	for i, ext := range []string{"mod", "zip"} {
+		name, err := CacheName(modulePath, moduleVersion, ext)
+		if err != nil {
+			return mod, zip
+		}
+		names[i] = name
+	}
+
+	var (
+		mu     sync.Mutex
+		opened = 2
+	)
+	closed := func() {
+		mu.Lock()
+		opened--
+		last := opened == 0
+		mu.Unlock()
+		if !last {
+			return
+		}
+		if !g.startBackgroundFetch(context.Background(), shadowFetchKey(modulePath, moduleVersion), func(ctx context.Context) error {
+			g.shadowFetch(ctx, modulePath, moduleVersion, names, mod, zip)
+			return nil
+		}) {
+			mod.Close()
+			zip.Close()
+		}
+	}
+	wrap := func(content io.ReadSeekCloser) io.ReadSeekCloser {
+		var once sync.Once
+		return struct {
+			io.ReadSeeker
+			io.Closer
+		}{content, closerFunc(func() error {
+			once.Do(closed)
+			return nil
+		})}
+	}
+	return wrap(mod), wrap(zip)
+}
+
+// shadowFetch hashes and closes the mod and zip downloaded by the g.fetcher
+// for the modulePath and moduleVersion, whose cache names are the names, and
+// then compares them with those downloaded from the g.ShadowFetcher.
+func (g *Goproxy) shadowFetch(ctx context.Context, modulePath, moduleVersion string, names [2]string, mod, zip io.ReadSeekCloser) {
+	var sums [2]string
+	for i, content := range []io.ReadSeekCloser{mod, zip} {
+		sum, err := hashReadSeeker(content)
+		content.Close()
+		if err != nil {
+			g.logErrorf("failed to hash module file for shadow fetch: %s: %v", names[i], err)
+			return
+		}
+		sums[i] = sum
+	}
+	info, shadowMod, shadowZip, err := g.shadowFetcher.Download(ctx, modulePath, moduleVersion)
+	if err != nil {
+		for i, name := range names {
+			g.reportShadowMismatch(ShadowMismatch{Name: name, SHA256: sums[i], ShadowErr: err})
+		}
+		return
+	}
+	defer func() {
+		info.Close()
+		shadowMod.Close()
+		shadowZip.Close()
+	}()
+	for i, content := range []io.ReadSeeker{shadowMod, shadowZip} {
+		shadowSum, err := hashReadSeeker(content)
+		if err != nil {
+			g.reportShadowMismatch(ShadowMismatch{Name: names[i], SHA256: sums[i], ShadowErr: err})
+		} else if shadowSum != sums[i] {
+			g.reportShadowMismatch(ShadowMismatch{Name: names[i], SHA256: sums[i], ShadowSHA256: shadowSum})
+		}
+	}
+}
+
+// shadowFetchKey returns the key of the [Goproxy.fetchGroup] for shadowing the
+// download of the modulePath at the moduleVersion (see
+// [integrityCheckKey]).
+func shadowFetchKey(modulePath, moduleVersion string) string {
+	return "shadow:" + modulePath + "@" + moduleVersion
+}
+
+// reportShadowMismatch reports the m to the g.OnShadowMismatch, or logs it to
+// the g.ErrorLogger if the g.OnShadowMismatch is nil.
+func (g *Goproxy) reportShadowMismatch(m ShadowMismatch) {
+	if g.OnShadowMismatch != nil {
+		g.OnShadowMismatch(m)
+		return
+	}
+	if m.ShadowErr != nil {
+		g.logErrorf("failed to shadow fetch module file: %s: %v", m.Name, m.ShadowErr)
+		return
+	}
+	g.logErrorf("found shadow fetch mismatch: %s: got SHA-256 %s, shadow SHA-256 %s", m.Name, m.SHA256, m.ShadowSHA256)
+}
+
+// hashReadSeeker returns the hex-encoded SHA-256 hash of the content from the
+// start of the rs, which is rewound to the start afterwards.
+func hashReadSeeker(rs io.ReadSeeker) (string, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,168 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrBadSignature is the error returned when importing cache files in bulk
+// from a bundle whose signature cannot be verified (see
+// [SyncOptions.SignaturePublicKey]).
+var ErrBadSignature = errors.New("bad signature")
+
+// minisignPublicKey is a parsed minisign public key.
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// parseMinisignPublicKey parses the s as a minisign public key, which is
+// either its base64 encoding or the content of a minisign public key file.
+func parseMinisignPublicKey(s string) (*minisignPublicKey, error) {
+	var encoded string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			encoded = line
+			break
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return nil, errors.New("invalid minisign public key")
+	}
+	pk := &minisignPublicKey{key: ed25519.PublicKey(b[10:])}
+	copy(pk.keyID[:], b[2:10])
+	return pk, nil
+}
+
+// minisignSignature is a parsed minisign signature.
+type minisignSignature struct {
+	keyID           [8]byte
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+}
+
+// parseMinisignSignature parses the b as the content of a minisign signature
+// file. Only prehashed signatures (those created by "minisign -S" since
+// version 0.8, or with "-H" before) are supported.
+func parseMinisignSignature(b []byte) (*minisignSignature, error) {
+	lines := strings.Split(strings.TrimRight(string(b), "\r\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return nil, errors.New("invalid minisign signature")
+	}
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign signature")
+	}
+	if string(sig[:2]) != "ED" {
+		return nil, fmt.Errorf("unsupported minisign signature algorithm %q", sig[:2])
+	}
+	if !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return nil, errors.New("invalid minisign trusted comment")
+	}
+	globalSignature, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSignature) != ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign global signature")
+	}
+	ms := &minisignSignature{
+		signature:       sig[10:],
+		trustedComment:  strings.TrimPrefix(lines[2], "trusted comment: "),
+		globalSignature: globalSignature,
+	}
+	copy(ms.keyID[:], sig[2:10])
+	return ms, nil
+}
+
+// verify verifies the ms against the digest (the BLAKE2b-512 hash of the
+// signed content) with the pk.
+func (ms *minisignSignature) verify(pk *minisignPublicKey, digest []byte) error {
+	if ms.keyID != pk.keyID {
+		return fmt.Errorf("key id %X does not match public key id %X", ms.keyID, pk.keyID)
+	}
+	if !ed25519.Verify(pk.key, digest, ms.signature) {
+		return errors.New("signature verification failed")
+	}
+	if !ed25519.Verify(pk.key, append(append([]byte{}, ms.signature...), ms.trustedComment...), ms.globalSignature) {
+		return errors.New("trusted comment verification failed")
+	}
+	return nil
+}
+
+// verifyBundle verifies the signature of the bundle read from the r against
+// the opts.SignaturePublicKey, if any. It returns a reader of the verified
+// bundle from where the r was, which must be used in place of the r. The
+// returned function must be called to release the resources once the reader
+// is no longer needed.
+//
+// If the r is not an [io.ReadSeeker], the bundle is buffered to a temporary
+// file in the opts.TempDir while hashing it, as verification needs the whole
+// bundle before extraction begins.
+func (opts SyncOptions) verifyBundle(r io.Reader) (io.Reader, func(), error) {
+	nop := func() {}
+	if opts.SignaturePublicKey == "" {
+		return r, nop, nil
+	}
+	pk, err := parseMinisignPublicKey(opts.SignaturePublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(bytes.TrimSpace(opts.Signature)) == 0 {
+		return nil, nil, fmt.Errorf("%w: missing signature", ErrBadSignature)
+	}
+	sig, err := parseMinisignSignature(opts.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, ok := r.(io.ReadSeeker)
+	release := nop
+	var start int64
+	if ok {
+		if start, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.Copy(h, rs); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		f, err := os.CreateTemp(opts.TempDir, "goproxy.sync.*")
+		if err != nil {
+			return nil, nil, err
+		}
+		release = func() {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+			release()
+			return nil, nil, err
+		}
+		rs = f
+	}
+	if err := sig.verify(pk, h.Sum(nil)); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return rs, release, nil
+}
@@ -0,0 +1,200 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// makeMinisignKey returns a new minisign public key and its private key.
+func makeMinisignKey(keyID string) (string, ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	b := append([]byte("Ed"+keyID), pub...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(b) + "\n", priv, nil
+}
+
+// makeMinisignSignature returns the minisign signature of the content with the
+// priv identified by the keyID.
+func makeMinisignSignature(keyID string, priv ed25519.PrivateKey, content []byte) []byte {
+	digest := blake2b.Sum512(content)
+	sig := ed25519.Sign(priv, digest[:])
+	trustedComment := "timestamp:1700000000\tfile:bundle.tar"
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, sig...), trustedComment...))
+	return []byte(fmt.Sprintf(
+		"untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append([]byte("ED"+keyID), sig...)),
+		trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig),
+	))
+}
+
+func TestDirCacherSyncSignature(t *testing.T) {
+	bundle, err := makeTar(map[string][]byte{"example.com/@v/list": []byte("v1.0.0")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	tamperedBundle, err := makeTar(map[string][]byte{"example.com/@v/list": []byte("v6.6.6")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	publicKey, privateKey, err := makeMinisignKey("12345678")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	otherPublicKey, otherPrivateKey, err := makeMinisignKey("87654321")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	sameIDPublicKey, _, err := makeMinisignKey("12345678")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	signature := makeMinisignSignature("12345678", privateKey, bundle)
+
+	for _, tt := range []struct {
+		n         int
+		bundle    []byte
+		seekable  bool
+		publicKey string
+		signature []byte
+		wantErr   error
+	}{
+		{
+			n:         1,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: publicKey,
+			signature: signature,
+		},
+		{
+			n:         2,
+			bundle:    bundle,
+			publicKey: publicKey,
+			signature: signature,
+		},
+		{
+			n:         3,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: "",
+			signature: nil,
+		},
+		{
+			n:         4,
+			bundle:    tamperedBundle,
+			seekable:  true,
+			publicKey: publicKey,
+			signature: signature,
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         5,
+			bundle:    tamperedBundle,
+			publicKey: publicKey,
+			signature: signature,
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         6,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: otherPublicKey,
+			signature: signature,
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         7,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: sameIDPublicKey,
+			signature: signature,
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         8,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: publicKey,
+			signature: makeMinisignSignature("12345678", otherPrivateKey, bundle),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         9,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: publicKey,
+			signature: nil,
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         10,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: publicKey,
+			signature: []byte("foobar"),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			n:         11,
+			bundle:    bundle,
+			seekable:  true,
+			publicKey: "foobar",
+			signature: signature,
+			wantErr:   errors.New("invalid minisign public key"),
+		},
+	} {
+		dirCacher := &DirCacher{Dir: t.TempDir()}
+		var r io.Reader = bytes.NewReader(tt.bundle)
+		if !tt.seekable {
+			r = io.MultiReader(r)
+		}
+		tempDir := t.TempDir()
+		err := dirCacher.Sync(context.Background(), r, "application/x-tar", SyncOptions{
+			SignaturePublicKey: tt.publicKey,
+			Signature:          tt.signature,
+			TempDir:            tempDir,
+		})
+		if tt.wantErr != nil {
+			if err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			}
+			if errors.Is(tt.wantErr, ErrBadSignature) {
+				if !errors.Is(err, ErrBadSignature) {
+					t.Errorf("test(%d): got %q, want %q", tt.n, err, tt.wantErr)
+				}
+			} else if got, want := err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if _, err := os.Stat(filepath.Join(dirCacher.Dir, "example.com")); !os.IsNotExist(err) {
+				t.Errorf("test(%d): got %v, want %v", tt.n, err, os.ErrNotExist)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+			if b, err := os.ReadFile(filepath.Join(dirCacher.Dir, "example.com", "@v", "list")); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			} else if got, want := string(b), "v1.0.0"; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+		}
+		if entries, err := os.ReadDir(tempDir); err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+		} else if got := len(entries); got != 0 {
+			t.Errorf("test(%d): got %d temporary files, want 0", tt.n, got)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package goproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// singleflightGroup coalesces concurrent calls with the same key into a single
+// execution. The zero value is ready to use.
+type singleflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*singleflightCall
+}
+
+// singleflightCall is an in-flight or completed call of a [singleflightGroup].
+type singleflightCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waits   int
+	waiting int
+	cancel  context.CancelFunc
+
+	// abandoned indicates whether the call, executed inline (see
+	// [singleflightGroup.doInline]), failed because the ctx of its caller
+	// is done.
+	abandoned bool
+}
+
+// do executes the fn for the key and returns its error. If a call for the same
+// key is already in flight, do waits for it to complete and returns its error
+// instead of executing the fn again. If the ctx is done while waiting, do
+// returns the ctx.Err without waiting for the in-flight call to complete.
+//
+// The fn is executed in the background with a ctx that carries the values of
+// the ctx of the call that started it but is not done with it. The ctx of the
+// fn is canceled only when all calls waiting for it have stopped waiting, so
+// that a call that gives up does not fail the others.
+func (g *singleflightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	_, err := g.doShared(ctx, ctx, key, fn)
+	return err
+}
+
+// doShared is like [singleflightGroup.do], but also reports whether the call
+// waited for an in-flight call for the same key instead of executing the fn.
+// If the call does so, it waits with the waitCtx instead of the ctx.
+func (g *singleflightGroup) doShared(ctx, waitCtx context.Context, key string, fn func(ctx context.Context) error) (shared bool, err error) {
+	_, shared, err = g.doValue(ctx, waitCtx, key, func(ctx context.Context) (interface{}, error) { return nil, fn(ctx) }, nil, nil)
+	return shared, err
+}
+
+// doValue is like [singleflightGroup.doShared], but the fn also returns a
+// value, which is returned to all calls that waited for it.
+//
+// If the fn succeeds, the hold is called with the value and the number of
+// calls that waited for it before any of them is woken up, so that the value
+// can be prepared for being shared (e.g., by counting references to it).
+// Each call that stops waiting because its ctx is done then calls the drop
+// with the value in the background once the fn completes, so that it can
+// still be accounted for. Both the hold and the drop may be nil.
+//
+// If the ctx is already done and no call for the key is in flight, doValue
+// returns the ctx.Err without executing the fn.
+func (g *singleflightGroup) doValue(ctx, waitCtx context.Context, key string, fn func(ctx context.Context) (interface{}, error), hold func(val interface{}, waits int), drop func(val interface{})) (val interface{}, shared bool, err error) {
+	g.mu.Lock()
+	c, shared := g.calls[key]
+	if shared {
+		c.waits++
+		c.waiting++
+		ctx = waitCtx
+	} else if err := ctx.Err(); err != nil {
+		g.mu.Unlock()
+		return nil, false, err
+	} else {
+		c = &singleflightCall{done: make(chan struct{}), waiting: 1}
+		if g.calls == nil {
+			g.calls = map[string]*singleflightCall{}
+		}
+		g.calls[key] = c
+		var fnCtx context.Context
+		fnCtx, c.cancel = context.WithCancel(detachedContext{ctx})
+		go g.run(key, c, fnCtx, fn, hold)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	c.waiting--
+	if c.waiting == 0 {
+		// Nobody is waiting for the call anymore, so later calls for the
+		// key start over rather than waiting for a canceled one.
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		c.cancel()
+	}
+	g.mu.Unlock()
+	if drop != nil {
+		go func() {
+			<-c.done
+			if c.err == nil {
+				drop(c.val)
+			}
+		}()
+	}
+	return nil, shared, ctx.Err()
+}
+
+// doInline is like [singleflightGroup.do], but the fn is executed inline by the
+// call that starts it, with the ctx of that call, rather than in the
+// background, so that the fn never outlives its caller (e.g., when the fn
+// reads from an [io.Reader] owned by the caller). If the fn fails because the
+// ctx of its caller is done, the calls waiting for it start over instead of
+// returning its error.
+func (g *singleflightGroup) doInline(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	for {
+		g.mu.Lock()
+		c, ok := g.calls[key]
+		if !ok {
+			c = &singleflightCall{done: make(chan struct{}), waiting: 1}
+			if g.calls == nil {
+				g.calls = map[string]*singleflightCall{}
+			}
+			g.calls[key] = c
+			var fnCtx context.Context
+			fnCtx, c.cancel = context.WithCancel(ctx)
+			g.mu.Unlock()
+			g.run(key, c, fnCtx, func(ctx context.Context) (interface{}, error) {
+				err := fn(ctx)
+				c.abandoned = err != nil && ctx.Err() != nil
+				return nil, err
+			}, nil)
+			return c.err
+		}
+		c.waits++
+		c.waiting++
+		g.mu.Unlock()
+
+		select {
+		case <-c.done:
+			if c.abandoned {
+				continue
+			}
+			return c.err
+		case <-ctx.Done():
+		}
+		g.mu.Lock()
+		c.waiting--
+		g.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// tryGo executes the fn for the key in the background with the ctx, unless a
+// call for the same key is already in flight, and reports whether it does so.
+// Calls for the same key made while the fn is executing wait for it as usual,
+// but the ctx of the fn is only done when the ctx is.
+func (g *singleflightGroup) tryGo(ctx context.Context, key string, fn func(ctx context.Context) error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.calls[key]; ok {
+		return false
+	}
+	c := &singleflightCall{done: make(chan struct{}), waiting: 1}
+	if g.calls == nil {
+		g.calls = map[string]*singleflightCall{}
+	}
+	g.calls[key] = c
+	var fnCtx context.Context
+	fnCtx, c.cancel = context.WithCancel(ctx)
+	go g.run(key, c, fnCtx, func(ctx context.Context) (interface{}, error) { return nil, fn(ctx) }, nil)
+	return true
+}
+
+// run executes the fn of the c for the key, and then wakes up the calls
+// waiting for it.
+func (g *singleflightGroup) run(key string, c *singleflightCall, ctx context.Context, fn func(ctx context.Context) (interface{}, error), hold func(val interface{}, waits int)) {
+	defer func() {
+		c.cancel()
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		waits := c.waits
+		g.mu.Unlock()
+		if c.err == nil && hold != nil {
+			hold(c.val, waits)
+		}
+		close(c.done)
+	}()
+	c.val, c.err = fn(ctx)
+}
+
+// detachedContext is a [context.Context] that carries the values of its parent
+// but is never done, so that work started on behalf of a request can outlive
+// it.
+type detachedContext struct {
+	parent context.Context
+}
+
+// Deadline implements [context.Context].
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+
+// Done implements [context.Context].
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+// Err implements [context.Context].
+func (detachedContext) Err() error { return nil }
+
+// Value implements [context.Context].
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
@@ -0,0 +1,238 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleflightGroup(t *testing.T) {
+	var (
+		g       singleflightGroup
+		calls   int32
+		release = make(chan struct{})
+		started = make(chan struct{})
+	)
+	fn := func(context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return errors.New("foobar")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = g.do(context.Background(), "foo", fn)
+	}()
+	<-started
+	for i := 1; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = g.do(context.Background(), "foo", fn)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got, want := atomic.LoadInt32(&calls), int32(1); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	for _, err := range errs {
+		if err == nil {
+			t.Fatal("expected error")
+		} else if got, want := err, errors.New("foobar"); !compareErrors(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if err := g.do(context.Background(), "foo", func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	release = make(chan struct{})
+	started = make(chan struct{})
+	go g.do(context.Background(), "bar", func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := g.do(ctx, "bar", fn); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	close(release)
+}
+
+func TestSingleflightGroupDoValue(t *testing.T) {
+	var (
+		g       singleflightGroup
+		release = make(chan struct{})
+		started = make(chan struct{})
+		holds   = make(chan int, 1)
+		drops   = make(chan interface{}, 1)
+	)
+	hold := func(val interface{}, waits int) { holds <- waits }
+	drop := func(val interface{}) { drops <- val }
+
+	var wg sync.WaitGroup
+	vals := make([]interface{}, 3)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		vals[0], _, _ = g.doValue(context.Background(), context.Background(), "foo", func(context.Context) (interface{}, error) {
+			close(started)
+			<-release
+			return "foobar", nil
+		}, hold, drop)
+	}()
+	<-started
+	for i := 1; i < len(vals); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var shared bool
+			vals[i], shared, _ = g.doValue(context.Background(), context.Background(), "foo", nil, hold, drop)
+			if !shared {
+				t.Errorf("test(%d): expected shared", i)
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := g.doValue(ctx, ctx, "foo", nil, hold, drop); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	close(release)
+	wg.Wait()
+	for i, val := range vals {
+		if got, want := val, interface{}("foobar"); got != want {
+			t.Errorf("test(%d): got %v, want %v", i, got, want)
+		}
+	}
+	if got, want := <-holds, 3; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := <-drops, interface{}("foobar"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSingleflightGroupDetached(t *testing.T) {
+	type ctxKey struct{}
+	var (
+		g       singleflightGroup
+		release = make(chan struct{})
+		started = make(chan struct{})
+		fnErr   = make(chan error, 1)
+	)
+	fn := func(ctx context.Context) error {
+		if got, want := ctx.Value(ctxKey{}), interface{}("foobar"); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		close(started)
+		select {
+		case <-release:
+			fnErr <- nil
+		case <-ctx.Done():
+			fnErr <- ctx.Err()
+		}
+		return ctx.Err()
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "foobar"))
+	leaderErr := make(chan error, 1)
+	go func() { leaderErr <- g.do(leaderCtx, "foo", fn) }()
+	<-started
+	followerErr := make(chan error, 1)
+	go func() { followerErr <- g.do(context.Background(), "foo", fn) }()
+	time.Sleep(10 * time.Millisecond)
+	cancelLeader()
+	if got, want := <-leaderErr, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	close(release)
+	if err := <-followerErr; err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+	if err := <-fnErr; err != nil {
+		t.Errorf("unexpected error %q", err)
+	}
+
+	release = make(chan struct{})
+	started = make(chan struct{})
+	leaderCtx, cancelLeader = context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "foobar"))
+	go func() { leaderErr <- g.do(leaderCtx, "foo", fn) }()
+	<-started
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	go func() { followerErr <- g.do(followerCtx, "foo", fn) }()
+	time.Sleep(10 * time.Millisecond)
+	cancelLeader()
+	<-leaderErr
+	select {
+	case err := <-fnErr:
+		t.Fatalf("unexpected fn completion with %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancelFollower()
+	if got, want := <-followerErr, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := <-fnErr, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	close(release)
+}
+
+func TestSingleflightGroupTryGo(t *testing.T) {
+	var (
+		g       singleflightGroup
+		release = make(chan struct{})
+		started = make(chan struct{})
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !g.tryGo(ctx, "foo", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return errors.New("foobar")
+	}) {
+		t.Fatal("expected true")
+	}
+	<-started
+	if g.tryGo(ctx, "foo", func(ctx context.Context) error { return nil }) {
+		t.Error("expected false")
+	}
+
+	waitCtx, cancelWait := context.WithCancel(context.Background())
+	cancelWait()
+	if err := g.do(waitCtx, "foo", nil); err == nil {
+		t.Fatal("expected error")
+	} else if got, want := err, context.Canceled; !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- g.do(context.Background(), "foo", nil) }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if got, want := <-errc, errors.New("foobar"); !compareErrors(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !g.tryGo(ctx, "foo", func(ctx context.Context) error { return nil }) {
+		t.Error("expected true")
+	}
+}
@@ -0,0 +1,118 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"path"
+)
+
+// syncStaging stages the files of a staged import of [DirCacher.Sync] (see
+// [SyncOptions.Staged]) as temporary files next to their targets, and
+// publishes them all at once when the import has succeeded.
+type syncStaging struct {
+	dc        *DirCacher
+	fsys      dirFS
+	files     []string
+	tempNames []string
+	links     []stagedSymlink
+}
+
+// newSyncStaging returns a new [syncStaging] for the dc.
+func (dc *DirCacher) newSyncStaging() (*syncStaging, error) {
+	fsys, err := dc.fs(true)
+	if err != nil {
+		return nil, err
+	}
+	return &syncStaging{dc: dc, fsys: fsys}, nil
+}
+
+// stage writes the content to a temporary file for the named file, without
+// making it visible under the name.
+func (s *syncStaging) stage(name string, content io.Reader) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	file := s.dc.fileName(name)
+	if err := s.fsys.mkdirAll(path.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tempName, err := s.dc.stageFile(s.fsys, file, content)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, file)
+	s.tempNames = append(s.tempNames, tempName)
+	return nil
+}
+
+// stagedSymlink is a symbolic link staged by [syncStaging.stageSymlink].
+type stagedSymlink struct {
+	file   string
+	target string
+}
+
+// stageSymlink records the named file as a symbolic link to the target, which
+// is created only when the staged files are published.
+func (s *syncStaging) stageSymlink(name, target string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	file := s.dc.fileName(name)
+	if err := checkSymlinkTarget(file, target); err != nil {
+		return err
+	}
+	s.links = append(s.links, stagedSymlink{file: file, target: target})
+	return nil
+}
+
+// publish renames the staged files into place, in the order they were staged
+// except that the ".info" files and the ".ready" files (see
+// [Goproxy.CompletionMarkers]) come last, so that a module version becomes
+// discoverable only once its other files have been published. The staged
+// symbolic links are created after all of them.
+func (s *syncStaging) publish(ctx context.Context) error {
+	order := make([]int, 0, len(s.files))
+	var infos, markers []int
+	for i, name := range s.files {
+		switch path.Ext(name) {
+		case ".info":
+			infos = append(infos, i)
+		case ".ready":
+			markers = append(markers, i)
+		default:
+			order = append(order, i)
+		}
+	}
+	order = append(append(order, infos...), markers...)
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := checkSymlinkParents(s.fsys, s.files[i])
+		if err == nil {
+			err = s.dc.commitFile(s.fsys, s.tempNames[i], s.files[i])
+			s.tempNames[i] = ""
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, link := range s.links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.dc.writeSymlink(s.fsys, link.file, link.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard removes the staged files that have not been published.
+func (s *syncStaging) discard() {
+	for _, tempName := range s.tempNames {
+		if tempName != "" {
+			s.fsys.remove(tempName)
+		}
+	}
+}
@@ -25,6 +25,7 @@ type sumdbClientOps struct {
 	urlDetermineErr   error
 	envGOPROXY        string
 	httpClient        *http.Client
+	backoff           Backoff
 }
 
 // newSumdbClientOps creates a new [sumdbClientOps].
@@ -62,7 +63,7 @@ func (sco *sumdbClientOps) url() (*url.URL, error) {
 	u := sco.directURL
 	err := walkEnvGOPROXY(sco.envGOPROXY, func(proxy *url.URL) error {
 		pu := appendURL(proxy, "sumdb", sco.name)
-		if err := httpGet(context.Background(), sco.httpClient, appendURL(pu, "/supported").String(), nil); err != nil {
+		if err := httpGet(context.Background(), sco.httpClient, sco.backoff, appendURL(pu, "/supported").String(), nil); err != nil {
 			return err
 		}
 		u = pu
@@ -86,7 +87,7 @@ func (sco *sumdbClientOps) ReadRemote(path string) ([]byte, error) {
 		return nil, err
 	}
 	var buf bytes.Buffer
-	if err := httpGet(context.Background(), sco.httpClient, appendURL(u, path).String(), &buf); err != nil {
+	if err := httpGet(context.Background(), sco.httpClient, sco.backoff, appendURL(u, path).String(), &buf); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -0,0 +1,144 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracer is used by [Goproxy] to trace the requests it serves. It is designed
+// to be easily adapted to distributed tracing systems such as OpenTelemetry,
+// without this package depending on any of them.
+//
+// The following spans are started, each as a child of the span carried by the
+// ctx (if any):
+//   - "goproxy.request": serving a request, with the "http.request.method"
+//     and "url.path" attributes. To continue an incoming trace (e.g., from the
+//     traceparent request header), extract it into the request context before
+//     calling [Goproxy.ServeHTTP].
+//   - "goproxy.cache.get": getting a cache from the [Cacher], with the
+//     "goproxy.cache.name" attribute.
+//   - "goproxy.cache.put": putting caches to the [Cacher], with the
+//     "goproxy.cache.name" attribute (the names separated by commas if there
+//     are several).
+//   - "goproxy.fetch.query", "goproxy.fetch.list", and
+//     "goproxy.fetch.download": fetching from the [Fetcher], with the
+//     "goproxy.module.path" attribute and, except for "goproxy.fetch.list",
+//     the "goproxy.module.version" attribute (the version query for
+//     "goproxy.fetch.query"). They include the time spent waiting for
+//     [Goproxy.MaxConcurrentFetches].
+//   - "goproxy.sumdb.fetch": fetching from a proxied checksum database, with
+//     the "url.full" attribute.
+//
+// When [Goproxy.GetOrFetch] needs to fetch while serving a request, the
+// "goproxy.coalesced" attribute is also set on the "goproxy.request" span
+// once the fetch completes, to "true" if the request waited for a fetch of
+// another request instead of fetching itself, or to "false" otherwise. This
+// requires the span to implement [TraceAttributeSetter].
+type Tracer interface {
+	// Start starts a span with the name and attrs as a child of the span
+	// carried by the ctx, if any. It returns a context carrying the new
+	// span and the span itself.
+	Start(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, TraceSpan)
+}
+
+// TraceAttribute is an attribute of a span started by a [Tracer].
+type TraceAttribute struct {
+	// Key is the key of the attribute.
+	Key string
+
+	// Value is the value of the attribute.
+	Value string
+}
+
+// TraceSpan is a span started by a [Tracer].
+type TraceSpan interface {
+	// End ends the span. The err is the error that the traced operation
+	// failed with, or nil if it succeeded.
+	End(err error)
+}
+
+// TraceAttributeSetter is an optional interface that a [TraceSpan] can
+// implement to have attributes set after it has been started.
+type TraceAttributeSetter interface {
+	// SetAttributes sets the attrs on the span.
+	SetAttributes(attrs ...TraceAttribute)
+}
+
+// traceSpanContextKey is the context key for the innermost [TraceSpan] started
+// by [Goproxy.startSpan].
+type traceSpanContextKey struct{}
+
+// startSpan starts a span with the g.Tracer, and a step in the request trace
+// carried by the ctx (see [Goproxy.RequestTraces]). The returned function ends
+// both. If the g.Tracer is nil, only the step is started, if any.
+func (g *Goproxy) startSpan(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, func(err error)) {
+	endStep := startRequestTraceStep(ctx, name, attrs...)
+	if g.Tracer == nil {
+		return ctx, endStep
+	}
+	ctx, span := g.Tracer.Start(ctx, name, attrs...)
+	return context.WithValue(ctx, traceSpanContextKey{}, span), func(err error) {
+		span.End(err)
+		endStep(err)
+	}
+}
+
+// setSpanAttributes sets the attrs on the innermost span started by
+// [Goproxy.startSpan] that the ctx carries, if it implements
+// [TraceAttributeSetter].
+func setSpanAttributes(ctx context.Context, attrs ...TraceAttribute) {
+	if setter, ok := ctx.Value(traceSpanContextKey{}).(TraceAttributeSetter); ok {
+		setter.SetAttributes(attrs...)
+	}
+}
+
+// coalescedAttribute returns the "goproxy.coalesced" attribute for the shared.
+func coalescedAttribute(shared bool) TraceAttribute {
+	return TraceAttribute{Key: "goproxy.coalesced", Value: strconv.FormatBool(shared)}
+}
+
+// cacheNamesAttribute returns the "goproxy.cache.name" attribute for the
+// entries.
+func cacheNamesAttribute(entries []CacheEntry) TraceAttribute {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	return TraceAttribute{Key: "goproxy.cache.name", Value: strings.Join(names, ",")}
+}
+
+// tracedFetcher is a [Fetcher] that traces the fetches of another [Fetcher].
+type tracedFetcher struct {
+	Fetcher
+	g *Goproxy
+}
+
+// Query implements [Fetcher].
+func (tf *tracedFetcher) Query(ctx context.Context, path, query string) (version string, t time.Time, err error) {
+	ctx, end := tf.g.startSpan(ctx, "goproxy.fetch.query",
+		TraceAttribute{Key: "goproxy.module.path", Value: path},
+		TraceAttribute{Key: "goproxy.module.version", Value: query},
+	)
+	defer func() { end(err) }()
+	return tf.Fetcher.Query(ctx, path, query)
+}
+
+// List implements [Fetcher].
+func (tf *tracedFetcher) List(ctx context.Context, path string) (versions []string, err error) {
+	ctx, end := tf.g.startSpan(ctx, "goproxy.fetch.list", TraceAttribute{Key: "goproxy.module.path", Value: path})
+	defer func() { end(err) }()
+	return tf.Fetcher.List(ctx, path)
+}
+
+// Download implements [Fetcher].
+func (tf *tracedFetcher) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	ctx, end := tf.g.startSpan(ctx, "goproxy.fetch.download",
+		TraceAttribute{Key: "goproxy.module.path", Value: path},
+		TraceAttribute{Key: "goproxy.module.version", Value: version},
+	)
+	defer func() { end(err) }()
+	return tf.Fetcher.Download(ctx, path, version)
+}
@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTracerSpanKey struct{}
+
+type testTracerSpan struct {
+	tracer *testTracer
+	name   string
+	attrs  []TraceAttribute
+	parent *testTracerSpan
+	ended  bool
+	err    error
+}
+
+func (s *testTracerSpan) End(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ended = true
+	s.err = err
+}
+
+func (s *testTracerSpan) SetAttributes(attrs ...TraceAttribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *testTracerSpan) String() string {
+	attrs := make([]string, len(s.attrs))
+	for i, attr := range s.attrs {
+		attrs[i] = attr.Key + "=" + attr.Value
+	}
+	parent := ""
+	if s.parent != nil {
+		parent = s.parent.name
+	}
+	return fmt.Sprintf("%s(%s)<%s>", s.name, strings.Join(attrs, " "), parent)
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testTracerSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, TraceSpan) {
+	parent, _ := ctx.Value(testTracerSpanKey{}).(*testTracerSpan)
+	s := &testTracerSpan{tracer: t, name: name, attrs: attrs, parent: parent}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, testTracerSpanKey{}, s), s
+}
+
+func TestGoproxyTracer(t *testing.T) {
+	info := marshalInfo("v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	fetchErr := notExistErrorf("not found")
+	for _, tt := range []struct {
+		n         int
+		path      string
+		wantSpans []string
+		wantErrs  []error
+	}{
+		{
+			n:    1,
+			path: "/example.com/@v/v1.0.0.info",
+			wantSpans: []string{
+				"goproxy.request(http.request.method=GET url.path=/example.com/@v/v1.0.0.info goproxy.coalesced=false)<>",
+				"goproxy.cache.get(goproxy.cache.name=example.com/@v/v1.0.0.info)<goproxy.request>",
+				"goproxy.fetch.download(goproxy.module.path=example.com goproxy.module.version=v1.0.0)<goproxy.request>",
+				"goproxy.cache.put(goproxy.cache.name=example.com/@v/v1.0.0.info,example.com/@v/v1.0.0.mod,example.com/@v/v1.0.0.zip)<goproxy.request>",
+			},
+			wantErrs: []error{nil, fs.ErrNotExist, nil, nil},
+		},
+		{
+			n:    2,
+			path: "/example.com/@v/v1.0.0.info",
+			wantSpans: []string{
+				"goproxy.request(http.request.method=GET url.path=/example.com/@v/v1.0.0.info)<>",
+				"goproxy.cache.get(goproxy.cache.name=example.com/@v/v1.0.0.info)<goproxy.request>",
+			},
+			wantErrs: []error{nil, nil},
+		},
+		{
+			n:    3,
+			path: "/example.com/@v/list",
+			wantSpans: []string{
+				"goproxy.request(http.request.method=GET url.path=/example.com/@v/list goproxy.coalesced=false)<>",
+				"goproxy.fetch.list(goproxy.module.path=example.com)<goproxy.request>",
+				"goproxy.cache.get(goproxy.cache.name=example.com/@v/list)<goproxy.request>",
+			},
+			wantErrs: []error{nil, fetchErr, fs.ErrNotExist},
+		},
+		{
+			n:    4,
+			path: "/example.com/@latest",
+			wantSpans: []string{
+				"goproxy.request(http.request.method=GET url.path=/example.com/@latest goproxy.coalesced=false)<>",
+				"goproxy.fetch.query(goproxy.module.path=example.com goproxy.module.version=latest)<goproxy.request>",
+				"goproxy.cache.put(goproxy.cache.name=example.com/@latest)<goproxy.request>",
+			},
+			wantErrs: []error{nil, nil, nil},
+		},
+	} {
+		tracer := &testTracer{}
+		g := &Goproxy{
+			Fetcher: &testFetcher{
+				query: func(ctx context.Context, path, query string) (string, time.Time, error) {
+					return "v1.0.0", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), nil
+				},
+				list: func(ctx context.Context, path string) ([]string, error) {
+					return nil, fetchErr
+				},
+				download: func(ctx context.Context, path, version string) (info_, mod, zip io.ReadSeekCloser, err error) {
+					return nopReadSeekCloser(info), nopReadSeekCloser("module example.com"), nopReadSeekCloser("zip"), nil
+				},
+			},
+			Cacher:      &DirCacher{Dir: t.TempDir()},
+			ErrorLogger: log.New(io.Discard, "", 0),
+			Tracer:      tracer,
+		}
+		if tt.n == 2 {
+			if err := g.Cacher.Put(context.Background(), "example.com/@v/v1.0.0.info", strings.NewReader(info)); err != nil {
+				t.Fatalf("test(%d): unexpected error %q", tt.n, err)
+			}
+		}
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", tt.path, nil))
+		if got, want := len(tracer.spans), len(tt.wantSpans); got != want {
+			t.Fatalf("test(%d): got %d (%q), want %d", tt.n, got, tracer.spans, want)
+		}
+		for i, span := range tracer.spans {
+			if got, want := span.String(), tt.wantSpans[i]; got != want {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if !span.ended {
+				t.Errorf("test(%d): span %q not ended", tt.n, span.name)
+			}
+			if got, want := span.err, tt.wantErrs[i]; !errors.Is(got, want) {
+				t.Errorf("test(%d): got %v, want %v", tt.n, got, want)
+			}
+		}
+	}
+}
+
+func TestGoproxyTracerCoalesced(t *testing.T) {
+	zip, err := makeZip(map[string][]byte{"example.com@v1.0.0/go.mod": []byte("module example.com")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	tracer := &testTracer{}
+	downloadStarted := make(chan struct{})
+	downloadRelease := make(chan struct{})
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info, mod, zipContent io.ReadSeekCloser, err error) {
+				close(downloadStarted)
+				<-downloadRelease
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module example.com"), nopReadSeekCloser(string(zip)), nil
+			},
+		},
+		Cacher:         &DirCacher{Dir: t.TempDir()},
+		ServeZipHashes: true,
+		ErrorLogger:    log.New(io.Discard, "", 0),
+		Tracer:         tracer,
+	}
+	var wg sync.WaitGroup
+	serve := func() {
+		defer wg.Done()
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/example.com/@v/v1.0.0.ziphash", nil))
+	}
+	wg.Add(1)
+	go serve()
+	<-downloadStarted
+	wg.Add(1)
+	go serve()
+	for waits := 0; waits == 0; {
+		time.Sleep(time.Millisecond)
+		g.fetchGroup.mu.Lock()
+		if c, ok := g.fetchGroup.calls["example.com@v1.0.0"]; ok {
+			waits = c.waits
+		}
+		g.fetchGroup.mu.Unlock()
+	}
+	close(downloadRelease)
+	wg.Wait()
+
+	var requestSpans []string
+	for _, span := range tracer.spans {
+		if span.name == "goproxy.request" {
+			requestSpans = append(requestSpans, span.String())
+		}
+	}
+	if got, want := strings.Join(requestSpans, "\n"), strings.Join([]string{
+		"goproxy.request(http.request.method=GET url.path=/example.com/@v/v1.0.0.ziphash goproxy.coalesced=false)<>",
+		"goproxy.request(http.request.method=GET url.path=/example.com/@v/v1.0.0.ziphash goproxy.coalesced=true)<>",
+	}, "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// ErrZipHashMismatch is the error returned when the "h1:" hash of a .zip file
+// in a bundle being imported does not match its sibling .ziphash file (see
+// [SyncOptions.VerifyZipHashes]), or when that of a prefetched .zip file does
+// not match its go.sum entry (see [Goproxy.PrefetchFromGoMod]).
+var ErrZipHashMismatch = errors.New("zip hash mismatch")
+
+// maxSyncZipHashSize is the maximum size of a .ziphash file in a bundle being
+// imported with [SyncOptions.VerifyZipHashes].
+const maxSyncZipHashSize = 1 << 10
+
+// syncZipHashVerifier verifies the .zip files of an import of cache files in
+// bulk against their sibling .ziphash files as the pairs are completed (see
+// [SyncOptions.VerifyZipHashes]). A nil syncZipHashVerifier verifies nothing.
+type syncZipHashVerifier struct {
+	tempDir  string
+	got      map[string]string
+	want     map[string]string
+	verified int
+}
+
+// newSyncZipHashVerifier returns a new [syncZipHashVerifier] for the opts, or
+// nil if the opts.VerifyZipHashes is false.
+func newSyncZipHashVerifier(opts SyncOptions) *syncZipHashVerifier {
+	if !opts.VerifyZipHashes {
+		return nil
+	}
+	return &syncZipHashVerifier{
+		tempDir: opts.TempDir,
+		got:     map[string]string{},
+		want:    map[string]string{},
+	}
+}
+
+// reader returns a reader of the content of the file targeted by the name,
+// which records the content for verification as it is read. The returned done
+// must be called with the error of importing the file, if any, once the
+// content has been read to the end. It returns that error, or the error of
+// the verification otherwise.
+func (v *syncZipHashVerifier) reader(name string, content io.Reader) (io.Reader, func(err error) error, error) {
+	nop := func(err error) error { return err }
+	if v == nil || !strings.Contains(name, "/@v/") {
+		return content, nop, nil
+	}
+	switch ext := path.Ext(name); ext {
+	case ".zip":
+		f, err := os.CreateTemp(v.tempDir, tempDirPattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.TeeReader(content, f), func(err error) error {
+			defer os.Remove(f.Name())
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			zipHash, err := dirhash.HashZip(f.Name(), dirhash.DefaultHash)
+			if err != nil {
+				return fmt.Errorf("%w: %s: invalid zip file: %v", ErrZipHashMismatch, name, err)
+			}
+			return v.add(v.got, strings.TrimSuffix(name, ext), zipHash)
+		}, nil
+	case ".ziphash":
+		var buf bytes.Buffer
+		return io.TeeReader(content, &limitedWriter{w: &buf, n: maxSyncZipHashSize}), func(err error) error {
+			if err != nil {
+				return err
+			}
+			if buf.Len() >= maxSyncZipHashSize {
+				return fmt.Errorf("%w: %s: too large", ErrZipHashMismatch, name)
+			}
+			return v.add(v.want, strings.TrimSuffix(name, ext), strings.TrimSpace(buf.String()))
+		}, nil
+	}
+	return content, nop, nil
+}
+
+// add adds the zipHash for the .zip or .ziphash file of the module version
+// identified by the key (i.e., the name without the extension) to the
+// hashes, which is either the v.got or the v.want, and then verifies the pair
+// if it is complete. A file imported again replaces the earlier one.
+func (v *syncZipHashVerifier) add(hashes map[string]string, key, zipHash string) error {
+	hashes[key] = zipHash
+	got, ok := v.got[key]
+	if !ok {
+		return nil
+	}
+	want, ok := v.want[key]
+	if !ok {
+		return nil
+	}
+	delete(v.got, key)
+	delete(v.want, key)
+	if got != want {
+		return fmt.Errorf("%w: %s.zip: got %s, want %s", ErrZipHashMismatch, key, got, want)
+	}
+	v.verified++
+	return nil
+}
+
+// result adds the number of verified pairs to the result.
+func (v *syncZipHashVerifier) result(result SyncResult) SyncResult {
+	if v != nil {
+		result.VerifiedZipHashes += v.verified
+	}
+	return result
+}
+
+// limitedWriter is an [io.Writer] that writes at most n bytes to the w,
+// silently discarding the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+// Write implements [io.Writer].
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) <= lw.n {
+		lw.n -= len(p)
+		return lw.w.Write(p)
+	}
+	if lw.n > 0 {
+		if _, err := lw.w.Write(p[:lw.n]); err != nil {
+			return 0, err
+		}
+		lw.n = 0
+	}
+	return len(p), nil
+}
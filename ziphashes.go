@@ -0,0 +1,175 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxZipHashesModules is the maximum number of module versions in a request to
+// the handler returned by [Goproxy.ZipHashesHandler].
+const maxZipHashesModules = 1000
+
+// ZipHash is the "h1:" hash of the zip file of a module version, as returned
+// by [Goproxy.ZipHashes].
+type ZipHash struct {
+	// Path is the module path.
+	Path string
+
+	// Version is the module version.
+	Version string
+
+	// Hash is the "h1:" hash of the zip file of the module version, as
+	// recorded in go.sum files.
+	Hash string
+
+	// Err is the error that occurred while getting the hash. It matches
+	// [fs.ErrNotExist] if the module version does not exist or is not
+	// allowed.
+	Err error
+}
+
+// ZipHashes returns the "h1:" hashes of the zip files of the modules, each in
+// the form "<module path>@<version>" with a canonical version, in the order
+// they were given. This saves a round trip per module version compared with
+// the /@v/<version>.ziphash endpoint (see [Goproxy.ServeZipHashes]).
+//
+// Each hash is served from the cached .ziphash file of the module version if
+// there is one. Otherwise, it is computed from the .zip file got by
+// [Goproxy.GetOrFetch] and then cached as the .ziphash file.
+//
+// Errors of individual module versions are reported in the returned
+// [ZipHash] values. The returned error is non-nil only if the ctx is done
+// before all hashes have been got, in which case the module versions not got
+// yet report the ctx.Err.
+func (g *Goproxy) ZipHashes(ctx context.Context, modules []string) ([]ZipHash, error) {
+	g.initOnce.Do(g.init)
+	workerPool := make(chan struct{}, 4)
+	var wg sync.WaitGroup
+	hashes := make([]ZipHash, len(modules))
+	for i, m := range modules {
+		zh := &hashes[i]
+		var ok bool
+		zh.Path, zh.Version, ok = strings.Cut(m, "@")
+		if !ok {
+			zh.Err = notExistErrorf("%s: missing version", m)
+			continue
+		}
+		release, err := acquireWorker(ctx, workerPool)
+		if err != nil {
+			zh.Err = err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			zh.Hash, zh.Err = g.zipHash(ctx, zh.Path, zh.Version)
+		}()
+	}
+	wg.Wait()
+	return hashes, ctx.Err()
+}
+
+// zipHash returns the "h1:" hash of the zip file of the modulePath and
+// moduleVersion for [Goproxy.ZipHashes].
+func (g *Goproxy) zipHash(ctx context.Context, modulePath, moduleVersion string) (string, error) {
+	if err := checkCanonicalVersion(modulePath, moduleVersion); err != nil {
+		return "", notExistErrorf("%w", err)
+	}
+	if !g.allowsModule(modulePath) {
+		return "", notExistErrorf("%s: module path not allowed", modulePath)
+	}
+	name, err := CacheName(modulePath, moduleVersion, "ziphash")
+	if err != nil {
+		return "", notExistErrorf("%w", err)
+	}
+	if content, err := g.cache(ctx, name); err == nil {
+		defer content.Close()
+		b, err := io.ReadAll(content)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	zipContent, err := g.GetOrFetch(ctx, strings.TrimSuffix(name, ".ziphash")+".zip")
+	if err != nil {
+		return "", err
+	}
+	defer zipContent.Close()
+	zipHash, err := g.computeZipHash(zipContent)
+	if err != nil {
+		return "", err
+	}
+	if err := g.putCache(ctx, name, strings.NewReader(zipHash)); err != nil {
+		g.logErrorf("failed to cache module file: %s: %v", name, err)
+	}
+	return zipHash, nil
+}
+
+// ZipHashesHandler returns an [http.Handler] that serves the hashes returned
+// by [Goproxy.ZipHashes] as JSON. Like [Goproxy.AdminHandler], it is
+// independent of [Goproxy.ServeHTTP] and should be mounted separately from the
+// module proxy, as the GOPROXY protocol has no such endpoint.
+//
+// It accepts only POST requests with a body of {"modules":
+// ["<module path>@<version>", ...]} of at most 1,000 module versions, and
+// responds {"hashes": [{"module": <module path>, "version": <version>,
+// "hash": <"h1:" hash>}, ...]} in the order of the request. A module version
+// whose hash cannot be got is responded as {"module": <module path>,
+// "version": <version>, "error": <message>, "not_found": <true if it does not
+// exist>} instead, without failing the others. Malformed requests are
+// responded with status 400 and {"error": <message>}.
+func (g *Goproxy) ZipHashesHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			responseAdminError(rw, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		var body struct {
+			Modules []string `json:"modules"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 1<<20)).Decode(&body); err != nil {
+			responseAdminError(rw, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		if len(body.Modules) > maxZipHashesModules {
+			responseAdminError(rw, http.StatusBadRequest, fmt.Errorf("too many modules: more than %d", maxZipHashesModules))
+			return
+		}
+		zipHashes, err := g.ZipHashes(req.Context(), body.Modules)
+		if err != nil {
+			responseAdminError(rw, http.StatusServiceUnavailable, err)
+			return
+		}
+		type zipHash struct {
+			Module   string `json:"module"`
+			Version  string `json:"version"`
+			Hash     string `json:"hash,omitempty"`
+			Error    string `json:"error,omitempty"`
+			NotFound bool   `json:"not_found,omitempty"`
+		}
+		hashes := make([]zipHash, 0, len(zipHashes))
+		for _, zh := range zipHashes {
+			h := zipHash{Module: zh.Path, Version: zh.Version, Hash: zh.Hash}
+			if zh.Err != nil {
+				h.Error = zh.Err.Error()
+				h.NotFound = errors.Is(zh.Err, fs.ErrNotExist)
+			}
+			hashes = append(hashes, h)
+		}
+		responseJSON(rw, http.StatusOK, struct {
+			Hashes []zipHash `json:"hashes"`
+		}{hashes})
+	})
+}
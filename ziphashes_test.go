@@ -0,0 +1,151 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGoproxyZipHashes(t *testing.T) {
+	zip, err := makeZip(map[string][]byte{"example.com/foo@v1.0.0/go.mod": []byte("module example.com/foo")})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	zipHash := mustHashZip(t, zip)
+	var (
+		mu        sync.Mutex
+		downloads []string
+	)
+	dc := &DirCacher{Dir: t.TempDir()}
+	g := &Goproxy{
+		Fetcher: &testFetcher{
+			download: func(ctx context.Context, path, version string) (info, mod, zipContent io.ReadSeekCloser, err error) {
+				mu.Lock()
+				downloads = append(downloads, path+"@"+version)
+				mu.Unlock()
+				if path != "example.com/foo" {
+					return nil, nil, nil, notExistErrorf("%s@%s: unknown module", path, version)
+				}
+				return nopReadSeekCloser(marshalInfo(version, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), nopReadSeekCloser("module " + path), nopReadSeekCloser(string(zip)), nil
+			},
+		},
+		Cacher:      dc,
+		TempDir:     t.TempDir(),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+	if err := dc.Put(context.Background(), "example.com/bar/@v/v1.0.0.ziphash", strings.NewReader("h1:cached=\n")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	modules := []string{"example.com/foo@v1.0.0", "example.com/bar@v1.0.0", "example.com/baz@v1.0.0", "example.com/foo@master", "example.com/foo"}
+	hashes, err := g.ZipHashes(context.Background(), modules)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for i, tt := range []struct {
+		n            int
+		wantPath     string
+		wantVersion  string
+		wantHash     string
+		wantErr      error
+		wantNotExist bool
+	}{
+		{1, "example.com/foo", "v1.0.0", zipHash, nil, false},
+		{2, "example.com/bar", "v1.0.0", "h1:cached=", nil, false},
+		{3, "example.com/baz", "v1.0.0", "", errors.New("example.com/baz@v1.0.0: unknown module"), true},
+		{4, "example.com/foo", "master", "", errors.New("example.com/foo@master: invalid version: not a semantic version"), true},
+		{5, "example.com/foo", "", "", errors.New("example.com/foo: missing version"), true},
+	} {
+		zh := hashes[i]
+		if got, want := zh.Path, tt.wantPath; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := zh.Version, tt.wantVersion; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if got, want := zh.Hash, tt.wantHash; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+		if tt.wantErr != nil {
+			if zh.Err == nil {
+				t.Fatalf("test(%d): expected error", tt.n)
+			} else if got, want := zh.Err, tt.wantErr; !compareErrors(got, want) {
+				t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+			}
+			if got, want := errors.Is(zh.Err, fs.ErrNotExist), tt.wantNotExist; got != want {
+				t.Errorf("test(%d): got %t, want %t", tt.n, got, want)
+			}
+		} else if zh.Err != nil {
+			t.Fatalf("test(%d): unexpected error %q", tt.n, zh.Err)
+		}
+	}
+	if rc, err := dc.Get(context.Background(), "example.com/foo/@v/v1.0.0.ziphash"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if b, err := io.ReadAll(rc); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	} else if got, want := string(b), zipHash; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	} else {
+		rc.Close()
+	}
+
+	downloads = nil
+	rec := httptest.NewRecorder()
+	g.ZipHashesHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"modules":["example.com/foo@v1.0.0","example.com/baz@v1.0.0"]}`)))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var resp struct {
+		Hashes []map[string]interface{} `json:"hashes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if got, want := len(resp.Hashes), 2; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	if got, want := resp.Hashes[0], map[string]interface{}{"module": "example.com/foo", "version": "v1.0.0", "hash": zipHash}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := resp.Hashes[1], map[string]interface{}{"module": "example.com/baz", "version": "v1.0.0", "error": "example.com/baz@v1.0.0: unknown module", "not_found": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Join(downloads, ","), "example.com/baz@v1.0.0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		n              int
+		method         string
+		body           string
+		wantStatusCode int
+		wantContent    string
+	}{
+		{1, http.MethodGet, "", http.StatusMethodNotAllowed, `{"error":"method not allowed"}` + "\n"},
+		{2, http.MethodPost, "foobar", http.StatusBadRequest, `{"error":"invalid request body: invalid character 'o' in literal false (expecting 'a')"}` + "\n"},
+		{3, http.MethodPost, `{"modules":[` + strings.Repeat(`"a@v1.0.0",`, 1000) + `"a@v1.0.0"]}`, http.StatusBadRequest, `{"error":"too many modules: more than 1000"}` + "\n"},
+		{4, http.MethodPost, `{"modules":[]}`, http.StatusOK, `{"hashes":[]}` + "\n"},
+	} {
+		rec := httptest.NewRecorder()
+		g.ZipHashesHandler().ServeHTTP(rec, httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body)))
+		if got, want := rec.Code, tt.wantStatusCode; got != want {
+			t.Errorf("test(%d): got %d, want %d", tt.n, got, want)
+		}
+		if got, want := rec.Body.String(), tt.wantContent; got != want {
+			t.Errorf("test(%d): got %q, want %q", tt.n, got, want)
+		}
+	}
+}